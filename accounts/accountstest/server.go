@@ -0,0 +1,270 @@
+// Package accountstest provides a fake accounts API for use in tests. The fake
+// runs as an httptest server and implements the wire format of the real
+// accounts API, that way tests exercise the actual accounts client rather than
+// a mock of the accounts API interface.
+package accountstest
+
+import (
+	"abuse-scanner/accounts"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EndpointBatch is the name of the batch upload info endpoint.
+	EndpointBatch = "batch"
+
+	// EndpointHealth is the name of the health endpoint.
+	EndpointHealth = "health"
+
+	// EndpointUploadInfo is the name of the upload info endpoint.
+	EndpointUploadInfo = "uploadinfo"
+)
+
+type (
+	// Server is a fake accounts API. It serves the upload info fixtures that
+	// were registered with SetUploadInfo, paginated like the real accounts API
+	// does, and it can be configured to simulate latency and errors. It is
+	// safe for concurrent use.
+	Server struct {
+		*httptest.Server
+
+		batchSupported bool
+		calls          map[string]uint64
+		errorRate      float64
+		failing        map[string]int
+		healthy        bool
+		infos          map[string][]accounts.UploadInfo
+		latency        time.Duration
+		mu             sync.Mutex
+	}
+)
+
+// NewServer returns a new fake accounts API that is healthy, has no fixtures
+// and does not support the batch endpoint. The caller is expected to close the
+// server.
+func NewServer() *Server {
+	s := &Server{
+		calls:   make(map[string]uint64),
+		failing: make(map[string]int),
+		healthy: true,
+		infos:   make(map[string][]accounts.UploadInfo),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Calls returns the amount of times the given endpoint got called.
+func (s *Server) Calls(endpoint string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[endpoint]
+}
+
+// AccountsClient returns an accounts client that talks to the fake accounts
+// API.
+func (s *Server) AccountsClient(opts accounts.AccountsClientOptions) (*accounts.AccountsClient, error) {
+	return accounts.NewAccountsClient(s.URL, "", opts)
+}
+
+// SetBatchSupported sets whether the fake supports the batch endpoint, if not
+// the batch endpoint responds with a 404 like older accounts APIs do.
+func (s *Server) SetBatchSupported(supported bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batchSupported = supported
+}
+
+// SetErrorRate sets the fraction of requests, between 0 and 1, that fail with
+// a 503 Service Unavailable.
+func (s *Server) SetErrorRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorRate = rate
+}
+
+// SetFailing makes every lookup of the given skylink fail with the given
+// status code, this includes batch lookups that contain the skylink. A status
+// code of zero resets the skylink.
+func (s *Server) SetFailing(skylink string, statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if statusCode == 0 {
+		delete(s.failing, skylink)
+		return
+	}
+	s.failing[skylink] = statusCode
+}
+
+// SetHealthy sets whether the fake reports its database is alive.
+func (s *Server) SetHealthy(healthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthy = healthy
+}
+
+// SetLatency sets the amount of time the fake waits before it responds.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// SetUploadInfo registers the upload info for the given skylink, lookups of
+// skylinks without upload info respond with a 404.
+func (s *Server) SetUploadInfo(skylink string, infos []accounts.UploadInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(infos) == 0 {
+		delete(s.infos, skylink)
+		return
+	}
+	s.infos[skylink] = append([]accounts.UploadInfo(nil), infos...)
+}
+
+// handle routes the given request to the handler of the endpoint.
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	// determine the endpoint
+	var endpoint string
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/health":
+		endpoint = EndpointHealth
+	case r.Method == http.MethodPost && r.URL.Path == "/uploadinfo/batch":
+		endpoint = EndpointBatch
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/uploadinfo/"):
+		endpoint = EndpointUploadInfo
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// record the call and fetch the settings
+	s.mu.Lock()
+	s.calls[endpoint]++
+	errorRate := s.errorRate
+	latency := s.latency
+	s.mu.Unlock()
+
+	// simulate latency, unless the client gave up
+	select {
+	case <-r.Context().Done():
+		return
+	case <-time.After(latency):
+	}
+
+	// simulate errors
+	if errorRate > 0 && rand.Float64() < errorRate {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch endpoint {
+	case EndpointHealth:
+		s.handleHealth(w)
+	case EndpointBatch:
+		s.handleBatch(w, r)
+	default:
+		s.handleUploadInfo(w, r)
+	}
+}
+
+// handleBatch handles a request to the batch upload info endpoint.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var skylinks []string
+	err := json.NewDecoder(r.Body).Decode(&skylinks)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.batchSupported {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	infos := make(map[string][]accounts.UploadInfo)
+	for _, skylink := range skylinks {
+		if statusCode, failing := s.failing[skylink]; failing {
+			w.WriteHeader(statusCode)
+			return
+		}
+		if info, exists := s.infos[skylink]; exists {
+			infos[skylink] = info
+		}
+	}
+	writeJSON(w, infos)
+}
+
+// handleHealth handles a request to the health endpoint.
+func (s *Server) handleHealth(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, accounts.HealthResponse{DBAlive: s.healthy})
+}
+
+// handleUploadInfo handles a request to the upload info endpoint, it returns
+// the page described by the offset and limit query parameters. If the limit is
+// not set, all upload infos from the offset onwards are returned.
+func (s *Server) handleUploadInfo(w http.ResponseWriter, r *http.Request) {
+	skylink := strings.TrimPrefix(r.URL.Path, "/uploadinfo/")
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if statusCode, failing := s.failing[skylink]; failing {
+		w.WriteHeader(statusCode)
+		return
+	}
+	infos, exists := s.infos[skylink]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// return the requested page
+	if offset > len(infos) {
+		offset = len(infos)
+	}
+	end := len(infos)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	writeJSON(w, infos[offset:end])
+}
+
+// parsePage parses the offset and limit query parameters of the given request,
+// both default to zero if they are not set.
+func parsePage(r *http.Request) (offset, limit int, err error) {
+	query := r.URL.Query()
+	if str := query.Get("offset"); str != "" {
+		offset, err = strconv.Atoi(str)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset '%v'", str)
+		}
+	}
+	if str := query.Get("limit"); str != "" {
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 0 {
+			return 0, 0, fmt.Errorf("invalid limit '%v'", str)
+		}
+	}
+	return offset, limit, nil
+}
+
+// writeJSON writes the given object JSON encoded to the response writer.
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(obj)
+}
@@ -0,0 +1,228 @@
+package accountstest
+
+import (
+	"abuse-scanner/accounts"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestServer is a collection of unit tests that verify the fake accounts API
+// using the actual accounts client.
+func TestServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	t.Run("Batch", testBatch)
+	t.Run("ErrorRate", testErrorRate)
+	t.Run("Failing", testFailing)
+	t.Run("Health", testHealth)
+	t.Run("Latency", testLatency)
+	t.Run("Pagination", testPagination)
+	t.Run("UploadInfo", testUploadInfo)
+}
+
+// testBatch verifies the batch endpoint is only served if it is supported.
+func testBatch(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer()
+	defer s.Close()
+	s.SetUploadInfo("skylink1", []accounts.UploadInfo{{Skylink: "skylink1", IP: "1.2.3.4"}})
+	c := newTestClient(t, s)
+
+	// assert the batch endpoint is not supported by default
+	_, err := c.UploadInfoBatchPOST(context.Background(), []string{"skylink1", "skylink2"})
+	if !errors.Contains(err, accounts.ErrBatchUnsupported) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert it returns the upload info of the skylinks that have any
+	s.SetBatchSupported(true)
+	infos, err := c.UploadInfoBatchPOST(context.Background(), []string{"skylink1", "skylink2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || len(infos["skylink1"]) != 1 || infos["skylink1"][0].IP != "1.2.3.4" {
+		t.Fatal("unexpected upload infos", infos)
+	}
+	if s.Calls(EndpointBatch) != 2 {
+		t.Fatal("unexpected amount of calls", s.Calls(EndpointBatch))
+	}
+}
+
+// testErrorRate verifies the fake fails requests at the configured rate.
+func testErrorRate(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer()
+	defer s.Close()
+	s.SetUploadInfo("skylink1", []accounts.UploadInfo{{Skylink: "skylink1"}})
+
+	// assert every request fails at an error rate of 1
+	s.SetErrorRate(1)
+	c := newTestClient(t, s)
+	_, err := c.UploadInfoGET(context.Background(), "skylink1")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert no request fails at an error rate of 0
+	s.SetErrorRate(0)
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testFailing verifies lookups of a failing skylink fail, both for the upload
+// info and the batch endpoint.
+func testFailing(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer()
+	defer s.Close()
+	s.SetBatchSupported(true)
+	s.SetUploadInfo("skylink1", []accounts.UploadInfo{{Skylink: "skylink1"}})
+	s.SetFailing("skylink1", http.StatusInternalServerError)
+	c := newTestClient(t, s)
+
+	_, err := c.UploadInfoGET(context.Background(), "skylink1")
+	if err == nil || errors.Contains(err, accounts.ErrUploadInfoNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = c.UploadInfoBatchPOST(context.Background(), []string{"skylink1"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert the lookup succeeds after resetting the skylink
+	s.SetFailing("skylink1", 0)
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHealth verifies the health endpoint reports the configured health.
+func testHealth(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer()
+	defer s.Close()
+	c := newTestClient(t, s)
+
+	err := c.HealthGET(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetHealthy(false)
+	err = c.HealthGET(context.Background())
+	if !errors.Contains(err, accounts.ErrUnhealthy) {
+		t.Fatal("unexpected error", err)
+	}
+	if s.Calls(EndpointHealth) != 2 {
+		t.Fatal("unexpected amount of calls", s.Calls(EndpointHealth))
+	}
+}
+
+// testLatency verifies the fake delays its responses, which causes the client
+// to time out if its timeout is lower than the latency.
+func testLatency(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer()
+	defer s.Close()
+	s.SetUploadInfo("skylink1", []accounts.UploadInfo{{Skylink: "skylink1"}})
+	s.SetLatency(500 * time.Millisecond)
+
+	c, err := s.AccountsClient(accounts.AccountsClientOptions{
+		MaxAttempts: 1,
+		Timeout:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if !errors.Contains(err, accounts.ErrTimeout) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testPagination verifies the fake paginates the upload info.
+func testPagination(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer()
+	defer s.Close()
+
+	var expected []accounts.UploadInfo
+	for i := 0; i < 25; i++ {
+		expected = append(expected, accounts.UploadInfo{Skylink: "skylink1", IP: fmt.Sprint(i)})
+	}
+	s.SetUploadInfo("skylink1", expected)
+
+	c, err := s.AccountsClient(accounts.AccountsClientOptions{PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Fatal("unexpected upload infos", infos)
+	}
+	if s.Calls(EndpointUploadInfo) != 3 {
+		t.Fatal("unexpected amount of calls", s.Calls(EndpointUploadInfo))
+	}
+}
+
+// testUploadInfo verifies the fake serves the registered upload info and
+// responds with a 404 for unknown skylinks.
+func testUploadInfo(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer()
+	defer s.Close()
+	expected := []accounts.UploadInfo{{
+		Skylink:   "skylink1",
+		IP:        "1.2.3.4",
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		UploaderInfo: accounts.UploaderInfo{
+			Email: "user@example.com",
+			Sub:   "sub",
+		},
+	}}
+	s.SetUploadInfo("skylink1", expected)
+	c := newTestClient(t, s)
+
+	infos, err := c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Fatal("unexpected upload infos", infos)
+	}
+	_, err = c.UploadInfoGET(context.Background(), "skylink2")
+	if !errors.Contains(err, accounts.ErrUploadInfoNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// newTestClient returns an accounts client for the given fake that does not
+// retry failed requests.
+func newTestClient(t *testing.T, s *Server) *accounts.AccountsClient {
+	c, err := s.AccountsClient(accounts.AccountsClientOptions{MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
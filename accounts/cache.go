@@ -0,0 +1,154 @@
+package accounts
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCacheEmptyTTL is the default amount of time an empty upload info
+	// lookup result is cached.
+	defaultCacheEmptyTTL = time.Minute
+
+	// defaultCacheSize is the default maximum amount of skylinks for which the
+	// upload info is cached.
+	defaultCacheSize = 10000
+
+	// defaultCacheTTL is the default amount of time an upload info lookup
+	// result is cached.
+	defaultCacheTTL = 10 * time.Minute
+)
+
+type (
+	// CacheStats contains the statistics of the upload info cache.
+	CacheStats struct {
+		Hits   uint64
+		Misses uint64
+		Size   int
+	}
+
+	// uploadInfoCache is an LRU cache of upload info lookup results, keyed by
+	// skylink, where every entry expires after a TTL. It is safe for
+	// concurrent use.
+	uploadInfoCache struct {
+		entries map[string]*list.Element
+		lru     *list.List
+		hits    uint64
+		misses  uint64
+		mu      sync.Mutex
+
+		staticEmptyTTL time.Duration
+		staticSize     int
+		staticTTL      time.Duration
+	}
+
+	// uploadInfoCacheEntry is a single entry in the upload info cache.
+	uploadInfoCacheEntry struct {
+		expiry  time.Time
+		infos   []UploadInfo
+		skylink string
+	}
+)
+
+// newUploadInfoCache returns a new upload info cache that holds at most size
+// entries. Non-empty results expire after ttl, empty results after emptyTTL.
+func newUploadInfoCache(size int, ttl, emptyTTL time.Duration) *uploadInfoCache {
+	return &uploadInfoCache{
+		entries:        make(map[string]*list.Element),
+		lru:            list.New(),
+		staticEmptyTTL: emptyTTL,
+		staticSize:     size,
+		staticTTL:      ttl,
+	}
+}
+
+// Get returns the cached upload info for the given skylink, the boolean
+// indicates whether the skylink was found in the cache. A nil slice indicates
+// the upload info was not found, as opposed to an empty slice.
+func (c *uploadInfoCache) Get(skylink string) ([]UploadInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, exists := c.entries[skylink]
+	if !exists {
+		c.misses++
+		return nil, false
+	}
+	entry := el.Value.(*uploadInfoCacheEntry)
+	if time.Now().After(entry.expiry) {
+		c.lru.Remove(el)
+		delete(c.entries, skylink)
+		c.misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+	return copyUploadInfos(entry.infos), true
+}
+
+// Set caches the given upload info for the given skylink, evicting the least
+// recently used entry if the cache is full.
+func (c *uploadInfoCache) Set(skylink string, infos []UploadInfo) {
+	ttl := c.staticTTL
+	if len(infos) == 0 {
+		ttl = c.staticEmptyTTL
+	}
+	entry := &uploadInfoCacheEntry{
+		expiry:  time.Now().Add(ttl),
+		infos:   copyUploadInfos(infos),
+		skylink: skylink,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// update the entry if it exists
+	if el, exists := c.entries[skylink]; exists {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	// evict the least recently used entry if the cache is full
+	if c.lru.Len() >= c.staticSize {
+		oldest := c.lru.Back()
+		if oldest != nil {
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*uploadInfoCacheEntry).skylink)
+		}
+	}
+	c.entries[skylink] = c.lru.PushFront(entry)
+}
+
+// Stats returns the cache statistics.
+func (c *uploadInfoCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Size:   c.lru.Len(),
+	}
+}
+
+// HitRate returns the ratio of cache lookups that resulted in a hit, it
+// returns zero if the cache has not been used yet.
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// copyUploadInfos returns a copy of the given upload infos, this ensures
+// callers can't alter the cached entries.
+func copyUploadInfos(infos []UploadInfo) []UploadInfo {
+	if infos == nil {
+		return nil
+	}
+	cpy := make([]UploadInfo, len(infos))
+	copy(cpy, infos)
+	return cpy
+}
@@ -0,0 +1,103 @@
+package accounts
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestUploadInfoCache is a collection of unit tests that verify the
+// functionality of the upload info cache.
+func TestUploadInfoCache(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Concurrency", testUploadInfoCacheConcurrency)
+	t.Run("Eviction", testUploadInfoCacheEviction)
+	t.Run("Expiry", testUploadInfoCacheExpiry)
+}
+
+// testUploadInfoCacheConcurrency verifies the cache is safe for concurrent use,
+// it is meant to be run with the race detector.
+func testUploadInfoCacheConcurrency(t *testing.T) {
+	t.Parallel()
+
+	c := newUploadInfoCache(10, time.Hour, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				skylink := fmt.Sprintf("skylink%d", (i+j)%20)
+				if _, exists := c.Get(skylink); !exists {
+					c.Set(skylink, []UploadInfo{{Skylink: skylink}})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	if stats.Hits+stats.Misses != 1000 || stats.Size > 10 {
+		t.Fatal("unexpected cache stats", stats)
+	}
+}
+
+// testUploadInfoCacheEviction verifies the least recently used entry is
+// evicted when the cache is full.
+func testUploadInfoCacheEviction(t *testing.T) {
+	t.Parallel()
+
+	c := newUploadInfoCache(2, time.Hour, time.Hour)
+	c.Set("skylink1", []UploadInfo{{Skylink: "skylink1"}})
+	c.Set("skylink2", []UploadInfo{{Skylink: "skylink2"}})
+
+	// use skylink1, making skylink2 the least recently used entry
+	if _, exists := c.Get("skylink1"); !exists {
+		t.Fatal("expected skylink1 to be cached")
+	}
+	c.Set("skylink3", []UploadInfo{{Skylink: "skylink3"}})
+
+	if _, exists := c.Get("skylink2"); exists {
+		t.Fatal("expected skylink2 to be evicted")
+	}
+	for _, skylink := range []string{"skylink1", "skylink3"} {
+		infos, exists := c.Get(skylink)
+		if !exists || len(infos) != 1 || infos[0].Skylink != skylink {
+			t.Fatal("unexpected cache entry", skylink, infos, exists)
+		}
+	}
+
+	// assert the cached entries can't be altered by the caller
+	infos, _ := c.Get("skylink1")
+	infos[0].Skylink = "altered"
+	infos, _ = c.Get("skylink1")
+	if infos[0].Skylink != "skylink1" {
+		t.Fatal("cached entry was altered")
+	}
+}
+
+// testUploadInfoCacheExpiry verifies entries expire after their TTL, where
+// empty results use the shorter TTL.
+func testUploadInfoCacheExpiry(t *testing.T) {
+	t.Parallel()
+
+	c := newUploadInfoCache(10, time.Hour, 50*time.Millisecond)
+	c.Set("skylink1", []UploadInfo{{Skylink: "skylink1"}})
+	c.Set("skylink2", nil)
+	if _, exists := c.Get("skylink2"); !exists {
+		t.Fatal("expected skylink2 to be cached")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, exists := c.Get("skylink2"); exists {
+		t.Fatal("expected skylink2 to be expired")
+	}
+	if _, exists := c.Get("skylink1"); !exists {
+		t.Fatal("expected skylink1 to be cached")
+	}
+	if c.Stats().Size != 1 {
+		t.Fatal("unexpected cache size", c.Stats().Size)
+	}
+}
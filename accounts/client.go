@@ -1,10 +1,15 @@
 package accounts
 
 import (
+	"abuse-scanner/utils"
+	"abuse-scanner/version"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
@@ -14,51 +19,335 @@ import (
 	"go.sia.tech/siad/node/api"
 )
 
+const (
+	// defaultBaseBackoff is the default backoff after the first failed
+	// attempt, it doubles with every subsequent attempt.
+	defaultBaseBackoff = 250 * time.Millisecond
+
+	// defaultMaxPages is the default maximum amount of pages we fetch when
+	// looking up the upload info of a single skylink.
+	defaultMaxPages = 10
+
+	// defaultPageSize is the default amount of upload infos we request per
+	// page when looking up the upload info of a single skylink.
+	defaultPageSize = 100
+
+	// defaultMaxAttempts is the default maximum amount of attempts for
+	// idempotent requests.
+	defaultMaxAttempts = 3
+
+	// defaultRetryBudget is the default maximum amount of time we spend on
+	// retrying a single idempotent request.
+	defaultRetryBudget = 10 * time.Second
+
+	// defaultTimeout is the default timeout of a single request to the
+	// accounts API.
+	defaultTimeout = 10 * time.Second
+)
+
+var (
+	// ErrBatchUnsupported is returned when the accounts service does not
+	// support the batch upload info endpoint, callers are expected to fall
+	// back to fetching the upload info per skylink.
+	ErrBatchUnsupported = errors.New("batch upload info endpoint not supported")
+
+	// ErrUploadInfoNotFound is returned when the accounts service has no
+	// upload info for a skylink, meaning the skylink was uploaded anonymously
+	// or not uploaded through this portal.
+	ErrUploadInfoNotFound = errors.New("upload info not found")
+
+	// ErrUnhealthy is returned when the accounts API reports it is not
+	// healthy.
+	ErrUnhealthy = errors.New("accounts API is unhealthy")
+
+	// ErrTimeout is returned when a request to the accounts API timed out,
+	// callers are expected to treat it as a transient error.
+	ErrTimeout = errors.New("accounts API request timed out")
+
+	// ErrInvalidResponse is returned when the response of the accounts API
+	// could not be decoded, or when it decoded into an invalid upload info.
+	// Such responses are not retried.
+	ErrInvalidResponse = errors.New("invalid accounts API response")
+
+	// ErrUploadInfoTruncated is returned alongside the upload info of a
+	// skylink when we stopped following the pages at MaxPages while the last
+	// page was full, meaning the upload info might be incomplete. Callers are
+	// expected to use the upload info that was returned.
+	ErrUploadInfoTruncated = errors.New("upload info might be truncated")
+)
+
 type (
 	// AccountsAPI defines an interface for the accounts API. This is useful for
 	// testing purposes as it can then be mocked in testing.
 	AccountsAPI interface {
-		// UploadInfoGET returns the upload info for given skylink
-		UploadInfoGET(skylink string) ([]UploadInfo, error)
+		// HealthGET returns nil if the accounts API is healthy
+		HealthGET(ctx context.Context) error
+
+		// UploadInfoBatchPOST returns the upload info for all given skylinks,
+		// keyed by skylink
+		UploadInfoBatchPOST(ctx context.Context, skylinks []string) (map[string][]UploadInfo, error)
+
+		// UploadInfoGET returns the upload info for given skylink, if the
+		// upload info might be incomplete it's returned alongside
+		// ErrUploadInfoTruncated
+		UploadInfoGET(ctx context.Context, skylink string) ([]UploadInfo, error)
 	}
 
 	// AccountsClient is a helper struct that is used to communicate with the
 	// accounts API.
 	AccountsClient struct {
 		staticAccountsURL string
+		staticCache       *uploadInfoCache
+		staticHTTPClient  *http.Client
+		staticOptions     AccountsClientOptions
+	}
+
+	// AccountsClientOptions contains the configurable options of the accounts
+	// client.
+	AccountsClientOptions struct {
+		// APIKey is an optional API key that is sent as bearer token in the
+		// Authorization header of every request, it is required by the
+		// privileged endpoints of the accounts API. It is never logged.
+		APIKey string
+
+		// BaseBackoff is the backoff after the first failed attempt of an
+		// idempotent request, it doubles with every subsequent attempt.
+		// Defaults to defaultBaseBackoff.
+		BaseBackoff time.Duration
+
+		// CacheEmptyTTL is the amount of time an empty upload info lookup
+		// result is cached, defaults to defaultCacheEmptyTTL.
+		CacheEmptyTTL time.Duration
+
+		// CacheSize is the maximum amount of skylinks for which the upload
+		// info is cached, defaults to defaultCacheSize.
+		CacheSize int
+
+		// CacheTTL is the amount of time an upload info lookup result is
+		// cached, defaults to defaultCacheTTL.
+		CacheTTL time.Duration
+
+		// HTTPClient is the shared HTTP client, the accounts client uses a
+		// copy of it with its own timeout, which shares its transport.
+		// Defaults to http.DefaultClient.
+		HTTPClient *http.Client
+
+		// MaxAttempts is the maximum amount of attempts for idempotent
+		// requests, defaults to defaultMaxAttempts.
+		MaxAttempts int
+
+		// MaxPages is the maximum amount of pages fetched when looking up the
+		// upload info of a single skylink, defaults to defaultMaxPages.
+		MaxPages int
+
+		// PageSize is the amount of upload infos requested per page when
+		// looking up the upload info of a single skylink, defaults to
+		// defaultPageSize.
+		PageSize int
+
+		// RetryBudget is the maximum amount of time spent on retrying a
+		// single idempotent request, defaults to defaultRetryBudget.
+		RetryBudget time.Duration
+
+		// StrictDecoding indicates whether responses that contain fields
+		// the client does not know about are rejected, which is useful to
+		// detect changes to the accounts API early.
+		StrictDecoding bool
+
+		// Timeout is the timeout of a single request to the accounts API,
+		// defaults to defaultTimeout.
+		Timeout time.Duration
+	}
+
+	// HealthResponse is the response returned by the `/health` endpoint of
+	// the accounts API.
+	HealthResponse struct {
+		DBAlive bool `json:"dbAlive"`
 	}
 
-	// UploadInfo TODO: replace with accounts struct
+	// statusError is returned when the accounts API responds with a status
+	// code that is not in the 200s.
+	statusError struct {
+		staticErr        error
+		staticStatusCode int
+	}
+
+	// UploadInfo is the upload info of a single upload of a skylink, as
+	// returned by the `/uploadinfo` endpoints of the accounts API. The info
+	// of the uploader is flattened into the upload info, it is empty if the
+	// skylink was uploaded anonymously.
 	UploadInfo struct {
-		Skylink   string
-		IP        string
-		CreatedAt time.Time
+		UploadID   primitive.ObjectID `json:"uploadId"`
+		Skylink    string             `json:"skylink"`
+		IP         string             `json:"ip"`
+		PortalName string             `json:"portalName"`
+		Unpinned   bool               `json:"unpinned"`
+		CreatedAt  time.Time          `json:"createdAt"`
 		UploaderInfo
 	}
 
-	// UploaderInfo TODO: replace with accounts struct
+	// UploaderInfo is the info of the user that uploaded a skylink.
 	UploaderInfo struct {
-		UserID   primitive.ObjectID
-		Email    string
-		Sub      string
-		StripeID string
+		UserID   primitive.ObjectID `json:"userId"`
+		Email    string             `json:"email"`
+		Sub      string             `json:"sub"`
+		StripeID string             `json:"stripeId"`
 	}
 )
 
-// NewAccountsClient returns a new accounts client
-func NewAccountsClient(host, port string) *AccountsClient {
+// NewAccountsClient returns a new accounts client, it returns an error if the
+// given host and port do not form a valid accounts API URL. The host may
+// contain a scheme, if it doesn't we default to http.
+func NewAccountsClient(host, port string, opts AccountsClientOptions) (*AccountsClient, error) {
+	accountsURL, err := utils.SanitizeServiceURL(host, port)
+	if err != nil {
+		return nil, errors.AddContext(err, "invalid accounts API URL")
+	}
+	if opts.BaseBackoff == 0 {
+		opts.BaseBackoff = defaultBaseBackoff
+	}
+	if opts.CacheEmptyTTL == 0 {
+		opts.CacheEmptyTTL = defaultCacheEmptyTTL
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = defaultCacheTTL
+	}
+	if opts.CacheEmptyTTL > opts.CacheTTL {
+		opts.CacheEmptyTTL = opts.CacheTTL
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.MaxPages == 0 {
+		opts.MaxPages = defaultMaxPages
+	}
+	if opts.PageSize == 0 {
+		opts.PageSize = defaultPageSize
+	}
+	if opts.RetryBudget == 0 {
+		opts.RetryBudget = defaultRetryBudget
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	client := *opts.HTTPClient
+	client.Timeout = opts.Timeout
 	return &AccountsClient{
-		staticAccountsURL: fmt.Sprintf("http://%s:%s", host, port),
+		staticAccountsURL: accountsURL,
+		staticCache:       newUploadInfoCache(opts.CacheSize, opts.CacheTTL, opts.CacheEmptyTTL),
+		staticHTTPClient:  &client,
+		staticOptions:     opts,
+	}, nil
+}
+
+// HealthGET calls the `/health` endpoint, it returns nil if the accounts API is
+// reachable and reports it is healthy. If the accounts API is reachable but not
+// healthy, it returns ErrUnhealthy.
+func (c *AccountsClient) HealthGET(ctx context.Context) error {
+	url := fmt.Sprintf("%s/health", c.staticAccountsURL)
+	var health HealthResponse
+	err := c.do(ctx, http.MethodGet, url, nil, &health)
+	if _, ok := err.(statusError); ok {
+		return errors.Compose(ErrUnhealthy, err)
+	}
+	if err != nil {
+		return errors.AddContext(err, "failed to reach the accounts API")
+	}
+	if !health.DBAlive {
+		return errors.AddContext(ErrUnhealthy, "database is not alive")
 	}
+	return nil
+}
+
+// CacheStats returns the statistics of the upload info cache.
+func (c *AccountsClient) CacheStats() CacheStats {
+	return c.staticCache.Stats()
 }
 
-// UploadInfoGET calls the `/uploadinfo/:skylink` endpoint with given parameters
-func (c *AccountsClient) UploadInfoGET(skylink string) ([]UploadInfo, error) {
-	// execute the get request
-	var info []UploadInfo
-	err := c.get(fmt.Sprintf("/uploadinfo/%s", skylink), url.Values{}, &info)
+// UploadInfoGET calls the `/uploadinfo/:skylink` endpoint with given
+// parameters. The endpoint is paginated, we follow the pages until they are
+// exhausted or until we fetched MaxPages pages, in which case the upload info
+// we fetched is returned alongside ErrUploadInfoTruncated. If the accounts
+// service has no upload info for the skylink, it returns ErrUploadInfoNotFound.
+// Results are cached, empty and not found results are cached for a shorter
+// amount of time, truncated results are not cached.
+func (c *AccountsClient) UploadInfoGET(ctx context.Context, skylink string) ([]UploadInfo, error) {
+	// check the cache
+	if info, exists := c.staticCache.Get(skylink); exists {
+		if info == nil {
+			return nil, ErrUploadInfoNotFound
+		}
+		return info, nil
+	}
+
+	// execute the get requests, one per page
+	info := []UploadInfo{}
+	limit := c.staticOptions.PageSize
+	truncated := true
+	for page := 0; page < c.staticOptions.MaxPages; page++ {
+		query := url.Values{}
+		query.Set("offset", fmt.Sprint(page*limit))
+		query.Set("limit", fmt.Sprint(limit))
+
+		var pageInfo []UploadInfo
+		err := c.get(ctx, fmt.Sprintf("/uploadinfo/%s", skylink), query, &pageInfo)
+		if isStatus(err, http.StatusNotFound) {
+			// a page past the last one might be reported as not found
+			if page > 0 {
+				truncated = false
+				break
+			}
+			c.staticCache.Set(skylink, nil)
+			return nil, ErrUploadInfoNotFound
+		}
+		if err == nil {
+			err = validateUploadInfos(pageInfo)
+		}
+		if err != nil {
+			return nil, errors.AddContext(err, fmt.Sprintf("failed to fetch upload info for skylink %s, page %v", skylink, page))
+		}
+		info = append(info, pageInfo...)
+
+		// a page that is not full is the last one, a page that exceeds the
+		// limit indicates the accounts service does not paginate
+		if len(pageInfo) != limit {
+			truncated = false
+			break
+		}
+	}
+
+	// don't cache a truncated result, it would hide the missing upload info
+	// for as long as it's cached
+	if truncated {
+		return info, errors.AddContext(ErrUploadInfoTruncated, fmt.Sprintf("stopped after %v pages for skylink %s", c.staticOptions.MaxPages, skylink))
+	}
+	c.staticCache.Set(skylink, info)
+	return info, nil
+}
+
+// UploadInfoBatchPOST calls the `/uploadinfo/batch` endpoint with given
+// skylinks. If the accounts service does not support the batch endpoint, it
+// returns ErrBatchUnsupported.
+func (c *AccountsClient) UploadInfoBatchPOST(ctx context.Context, skylinks []string) (map[string][]UploadInfo, error) {
+	// execute the post request
+	info := make(map[string][]UploadInfo)
+	err := c.post(ctx, "/uploadinfo/batch", skylinks, &info)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, ErrBatchUnsupported
+	}
+	if err == nil {
+		for _, infos := range info {
+			err = errors.Compose(err, validateUploadInfos(infos))
+		}
+	}
 	if err != nil {
-		return nil, errors.AddContext(err, fmt.Sprintf("failed to fetch upload info for skylink %s, err %v", skylink, err))
+		return nil, errors.AddContext(err, fmt.Sprintf("failed to fetch upload info for %v skylinks", len(skylinks)))
 	}
 
 	return info, nil
@@ -66,22 +355,72 @@ func (c *AccountsClient) UploadInfoGET(skylink string) ([]UploadInfo, error) {
 
 // get is a helper function that executes a GET request on the given endpoint
 // with the provided query values. The response will get unmarshaled into the
-// given response object.
-func (c *AccountsClient) get(endpoint string, query url.Values, obj interface{}) error {
-	// create the request
+// given response object. GET requests are idempotent, so the request is
+// retried with exponential backoff on connection errors and 5xx responses.
+func (c *AccountsClient) get(ctx context.Context, endpoint string, query url.Values, obj interface{}) error {
+	// build the url
 	queryString := query.Encode()
 	url := fmt.Sprintf("%s%s", c.staticAccountsURL, endpoint)
 	if queryString != "" {
 		url = fmt.Sprintf("%s%s?%s", c.staticAccountsURL, endpoint, queryString)
 	}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	// execute the request, with retries
+	policy := utils.RetryPolicy{
+		BaseBackoff: c.staticOptions.BaseBackoff,
+		Budget:      c.staticOptions.RetryBudget,
+		MaxAttempts: c.staticOptions.MaxAttempts,
+		Retryable: func(err error) bool {
+			return isRetryable(ctx, err)
+		},
+	}
+	return utils.Retry(ctx, policy, func() error {
+		return c.do(ctx, http.MethodGet, url, nil, obj)
+	})
+}
+
+// post is a helper function that executes a POST request on the given endpoint
+// with the given object JSON encoded as request body. The response will get
+// unmarshaled into the given response object.
+func (c *AccountsClient) post(ctx context.Context, endpoint string, body interface{}, obj interface{}) error {
+	// encode the body
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return errors.AddContext(err, "failed to encode request body")
+	}
+
+	// execute the request
+	url := fmt.Sprintf("%s%s", c.staticAccountsURL, endpoint)
+	return c.do(ctx, http.MethodPost, url, reqBody, obj)
+}
+
+// do is a helper function that executes a single request with the given
+// method, url and body. The response will get unmarshaled into the given
+// response object. If the response status code is not in the 200s, it returns
+// a statusError.
+func (c *AccountsClient) do(ctx context.Context, method, url string, body []byte, obj interface{}) error {
+	// create the request
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 	if err != nil {
 		return errors.AddContext(err, "failed to create request")
 	}
+	req.Header.Set("User-Agent", version.UserAgent())
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.staticOptions.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.staticOptions.APIKey)
+	}
 
 	// execute the request
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.staticHTTPClient.Do(req)
+	if isTimeout(err) {
+		return errors.Extend(err, ErrTimeout)
+	}
 	if err != nil {
 		return err
 	}
@@ -89,11 +428,77 @@ func (c *AccountsClient) get(endpoint string, query url.Values, obj interface{})
 
 	// return an error if the status code is not in the 200s
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return fmt.Errorf("GET request to '%s' with status %d error %v", url, res.StatusCode, readAPIError(res.Body))
+		return statusError{
+			staticErr:        fmt.Errorf("%s request to '%s' with status %d error %v", method, url, res.StatusCode, readAPIError(res.Body)),
+			staticStatusCode: res.StatusCode,
+		}
 	}
 
 	// handle the response body
-	return json.NewDecoder(res.Body).Decode(obj)
+	dec := json.NewDecoder(res.Body)
+	if c.staticOptions.StrictDecoding {
+		dec.DisallowUnknownFields()
+	}
+	err = dec.Decode(obj)
+	if isTimeout(err) {
+		return errors.Extend(err, ErrTimeout)
+	}
+	if err != nil {
+		return errors.Extend(errors.AddContext(err, fmt.Sprintf("failed to decode response of %s request to '%s'", method, url)), ErrInvalidResponse)
+	}
+	return nil
+}
+
+// Error implements the error interface.
+func (err statusError) Error() string {
+	return err.staticErr.Error()
+}
+
+// isRetryable returns whether a request that failed with the given error
+// should be retried. Connection errors and 5xx responses are retried, 4xx
+// responses are not, nor are requests of which the context is done.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Contains(err, ErrInvalidResponse) {
+		return false
+	}
+	if statusErr, ok := err.(statusError); ok {
+		return statusErr.staticStatusCode >= 500
+	}
+	return true
+}
+
+// validateUploadInfos returns an ErrInvalidResponse if any of the given upload
+// infos is invalid. Every upload info is expected to contain the skylink, an
+// upload info without skylink indicates a malformed response.
+func validateUploadInfos(infos []UploadInfo) error {
+	for i, info := range infos {
+		if info.Skylink == "" {
+			return errors.AddContext(ErrInvalidResponse, fmt.Sprintf("upload info at index %v is missing the skylink", i))
+		}
+	}
+	return nil
+}
+
+// isTimeout returns whether the given error is a timeout error.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// isStatus returns whether the given error is, or contains, a statusError with
+// given status code.
+func isStatus(err error, statusCode int) bool {
+	switch e := err.(type) {
+	case statusError:
+		return e.staticStatusCode == statusCode
+	case errors.Error:
+		for _, err := range e.ErrSet {
+			if isStatus(err, statusCode) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // drainAndClose reads rc until EOF and then closes it. drainAndClose should
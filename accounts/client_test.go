@@ -0,0 +1,664 @@
+package accounts
+
+import (
+	"abuse-scanner/version"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestAccountsClient is a collection of unit tests that verify the
+// functionality of the accounts client against a mocked accounts service.
+func TestAccountsClient(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	t.Run("APIKey", testAPIKey)
+	t.Run("HealthGET", testHealthGET)
+	t.Run("SharedHTTPClient", testSharedHTTPClient)
+	t.Run("UploadInfoBatchPOST", testUploadInfoBatchPOST)
+	t.Run("UploadInfoBatchPOSTUnsupported", testUploadInfoBatchPOSTUnsupported)
+	t.Run("UploadInfoGETCache", testUploadInfoGETCache)
+	t.Run("UploadInfoGETDecoding", testUploadInfoGETDecoding)
+	t.Run("UploadInfoGETPagination", testUploadInfoGETPagination)
+	t.Run("UploadInfoGETRetry", testUploadInfoGETRetry)
+	t.Run("UploadInfoGETNoRetry", testUploadInfoGETNoRetry)
+	t.Run("UploadInfoGETCancel", testUploadInfoGETCancel)
+	t.Run("UploadInfoGETTimeout", testUploadInfoGETTimeout)
+}
+
+// testAPIKey verifies the client sets the API key as bearer token in the
+// Authorization header, and omits the header if no API key is configured.
+func testAPIKey(t *testing.T) {
+	t.Parallel()
+
+	headers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("Authorization")
+		_ = json.NewEncoder(w).Encode([]UploadInfo{})
+	}))
+	defer server.Close()
+
+	hostPort := strings.TrimPrefix(server.URL, "http://")
+	parts := strings.SplitN(hostPort, ":", 2)
+
+	// assert the header is absent without API key
+	c, err := NewAccountsClient(parts[0], parts[1], AccountsClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := <-headers; header != "" {
+		t.Fatal("unexpected Authorization header", header)
+	}
+
+	// assert the header is present with API key
+	c, err = NewAccountsClient(parts[0], parts[1], AccountsClientOptions{APIKey: "apikey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := <-headers; header != "Bearer apikey" {
+		t.Fatal("unexpected Authorization header", header)
+	}
+}
+
+// testHealthGET verifies the client reports the health of the accounts API
+// correctly for a healthy, an unhealthy and an unreachable accounts API.
+func testHealthGET(t *testing.T) {
+	t.Parallel()
+
+	var status, dbAlive uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadUint64(&status)))
+		_ = json.NewEncoder(w).Encode(HealthResponse{DBAlive: atomic.LoadUint64(&dbAlive) == 1})
+	}))
+	defer server.Close()
+	c := newTestAccountsClient(t, server)
+
+	// healthy
+	atomic.StoreUint64(&status, http.StatusOK)
+	atomic.StoreUint64(&dbAlive, 1)
+	err := c.HealthGET(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unhealthy database
+	atomic.StoreUint64(&dbAlive, 0)
+	err = c.HealthGET(context.Background())
+	if !errors.Contains(err, ErrUnhealthy) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// unhealthy status
+	atomic.StoreUint64(&status, http.StatusServiceUnavailable)
+	err = c.HealthGET(context.Background())
+	if !errors.Contains(err, ErrUnhealthy) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// unreachable
+	server.Close()
+	err = c.HealthGET(context.Background())
+	if err == nil || errors.Contains(err, ErrUnhealthy) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testUploadInfoBatchPOST verifies the client posts the skylinks to the batch
+// endpoint, identifying itself with the scanner's User-Agent, and decodes the
+// response.
+func testUploadInfoBatchPOST(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/uploadinfo/batch" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.UserAgent() != version.UserAgent() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var skylinks []string
+		err := json.NewDecoder(r.Body).Decode(&skylinks)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		infos := make(map[string][]UploadInfo)
+		for _, skylink := range skylinks {
+			infos[skylink] = []UploadInfo{{Skylink: skylink, IP: "1.2.3.4"}}
+		}
+		_ = json.NewEncoder(w).Encode(infos)
+	}))
+	defer server.Close()
+
+	c := newTestAccountsClient(t, server)
+	infos, err := c.UploadInfoBatchPOST(context.Background(), []string{"skylink1", "skylink2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]UploadInfo{
+		"skylink1": {{Skylink: "skylink1", IP: "1.2.3.4"}},
+		"skylink2": {{Skylink: "skylink2", IP: "1.2.3.4"}},
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Fatal("unexpected upload infos", infos)
+	}
+}
+
+// testUploadInfoBatchPOSTUnsupported verifies the client returns
+// ErrBatchUnsupported if the batch endpoint does not exist.
+func testUploadInfoBatchPOSTUnsupported(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	c := newTestAccountsClient(t, server)
+	_, err := c.UploadInfoBatchPOST(context.Background(), []string{"skylink1"})
+	if !errors.Contains(err, ErrBatchUnsupported) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testUploadInfoGETCache verifies the client caches upload info lookups, both
+// positive and empty results, and that the cached entries expire.
+func testUploadInfoGETCache(t *testing.T) {
+	t.Parallel()
+
+	var calls uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		if strings.HasSuffix(r.URL.Path, "/empty") {
+			_ = json.NewEncoder(w).Encode([]UploadInfo{})
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]UploadInfo{{Skylink: "skylink1", IP: "1.2.3.4"}})
+	}))
+	defer server.Close()
+
+	hostPort := strings.TrimPrefix(server.URL, "http://")
+	parts := strings.SplitN(hostPort, ":", 2)
+	c, err := NewAccountsClient(parts[0], parts[1], AccountsClientOptions{
+		CacheEmptyTTL: 100 * time.Millisecond,
+		CacheTTL:      time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the second lookup of a skylink performs no HTTP call
+	for i := 0; i < 2; i++ {
+		infos, err := c.UploadInfoGET(context.Background(), "skylink1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || infos[0].IP != "1.2.3.4" {
+			t.Fatal("unexpected upload infos", infos)
+		}
+	}
+	if atomic.LoadUint64(&calls) != 1 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// assert empty results are cached too
+	for i := 0; i < 2; i++ {
+		infos, err := c.UploadInfoGET(context.Background(), "empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 0 {
+			t.Fatal("unexpected upload infos", infos)
+		}
+	}
+	if atomic.LoadUint64(&calls) != 2 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// assert the empty result expires while the positive one does not
+	time.Sleep(200 * time.Millisecond)
+	_, err = c.UploadInfoGET(context.Background(), "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint64(&calls) != 3 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// assert the cache stats
+	stats := c.CacheStats()
+	if stats.Hits != 3 || stats.Misses != 3 || stats.Size != 2 {
+		t.Fatal("unexpected cache stats", stats)
+	}
+	if stats.HitRate() != 0.5 {
+		t.Fatal("unexpected hit rate", stats.HitRate())
+	}
+}
+
+// testUploadInfoGETDecoding verifies the client decodes the upload info as it
+// is returned by the accounts service, and that it rejects malformed
+// responses with ErrInvalidResponse without retrying them.
+func testUploadInfoGETDecoding(t *testing.T) {
+	t.Parallel()
+
+	// uploadInfoJSON is a response of the accounts service, captured for a
+	// skylink that got uploaded twice, once by a user and once anonymously
+	uploadInfoJSON := `[
+	{
+		"uploadId": "61f2c1b8a6a9f3c0a8b0e1d2",
+		"skylink": "AADFiNQlasjKBFkSfzIUO2pjeJZvw4cwRyW6WdGc5cbeSg",
+		"ip": "81.196.117.164",
+		"portalName": "siasky.net",
+		"unpinned": false,
+		"createdAt": "2022-01-27T15:56:08Z",
+		"userId": "61f2c1b8a6a9f3c0a8b0e1d3",
+		"email": "user.one@gmail.com",
+		"sub": "user_1_sub",
+		"stripeId": "cus_KzE6xyzKzE6xyz"
+	},
+	{
+		"uploadId": "61f2c1b8a6a9f3c0a8b0e1d4",
+		"skylink": "AADFiNQlasjKBFkSfzIUO2pjeJZvw4cwRyW6WdGc5cbeSg",
+		"ip": "13.192.32.50",
+		"portalName": "siasky.net",
+		"unpinned": true,
+		"createdAt": "2022-01-28T09:12:44Z"
+	}
+]`
+
+	// responses maps the skylink to the response body of the server
+	responses := map[string]string{
+		"valid":           uploadInfoJSON,
+		"unknown-field":   `[{"skylink": "skylink1", "tags": ["csam"]}]`,
+		"missing-skylink": `[{"ip": "1.2.3.4"}]`,
+		"malformed":       `[{"skylink": 42}]`,
+	}
+	var calls uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		_, _ = w.Write([]byte(responses[strings.TrimPrefix(r.URL.Path, "/uploadinfo/")]))
+	}))
+	defer server.Close()
+	c := newTestAccountsClient(t, server)
+
+	// assert the valid response is decoded into the upload infos
+	infos, err := c.UploadInfoGET(context.Background(), "valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatal("unexpected amount of upload infos", len(infos))
+	}
+	first, second := infos[0], infos[1]
+	if first.UploadID.Hex() != "61f2c1b8a6a9f3c0a8b0e1d2" || first.PortalName != "siasky.net" || first.Unpinned {
+		t.Fatal("unexpected upload info", first)
+	}
+	if !first.CreatedAt.Equal(time.Date(2022, 1, 27, 15, 56, 8, 0, time.UTC)) {
+		t.Fatal("unexpected created at", first.CreatedAt)
+	}
+	if first.UserID.Hex() != "61f2c1b8a6a9f3c0a8b0e1d3" || first.Email != "user.one@gmail.com" || first.Sub != "user_1_sub" || first.StripeID != "cus_KzE6xyzKzE6xyz" {
+		t.Fatal("unexpected uploader info", first.UploaderInfo)
+	}
+	if !second.Unpinned || second.Sub != "" || !second.UserID.IsZero() {
+		t.Fatal("unexpected upload info", second)
+	}
+
+	// assert unknown fields are allowed by default
+	_, err = c.UploadInfoGET(context.Background(), "unknown-field")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the malformed responses are rejected and not retried
+	for _, skylink := range []string{"missing-skylink", "malformed"} {
+		atomic.StoreUint64(&calls, 0)
+		_, err = c.UploadInfoGET(context.Background(), skylink)
+		if !errors.Contains(err, ErrInvalidResponse) {
+			t.Fatal("unexpected error", skylink, err)
+		}
+		if atomic.LoadUint64(&calls) != 1 {
+			t.Fatal("unexpected amount of calls", skylink, calls)
+		}
+	}
+
+	// assert unknown fields are rejected when decoding strictly, note that we
+	// reset the cache as the upload info of both skylinks is cached
+	c.staticOptions.StrictDecoding = true
+	c.staticCache = newUploadInfoCache(defaultCacheSize, defaultCacheTTL, defaultCacheEmptyTTL)
+	_, err = c.UploadInfoGET(context.Background(), "unknown-field")
+	if !errors.Contains(err, ErrInvalidResponse) {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = c.UploadInfoGET(context.Background(), "valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testUploadInfoGETPagination verifies the client follows the pages of the
+// upload info endpoint until they are exhausted, bounded by the max pages.
+func testUploadInfoGETPagination(t *testing.T) {
+	t.Parallel()
+
+	// create a server that paginates 25 upload infos
+	var calls uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		offset, err1 := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, err2 := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err1 != nil || err2 != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		infos := []UploadInfo{}
+		for i := offset; i < offset+limit && i < 25; i++ {
+			infos = append(infos, UploadInfo{Skylink: strings.TrimPrefix(r.URL.Path, "/uploadinfo/"), IP: strconv.Itoa(i)})
+		}
+		_ = json.NewEncoder(w).Encode(infos)
+	}))
+	defer server.Close()
+
+	hostPort := strings.TrimPrefix(server.URL, "http://")
+	parts := strings.SplitN(hostPort, ":", 2)
+
+	// assert all pages are fetched and concatenated
+	c, err := NewAccountsClient(parts[0], parts[1], AccountsClientOptions{PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 25 {
+		t.Fatal("unexpected amount of upload infos", len(infos))
+	}
+	for i, info := range infos {
+		if info.IP != strconv.Itoa(i) {
+			t.Fatal("unexpected upload info", i, info)
+		}
+	}
+	if atomic.LoadUint64(&calls) != 3 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// assert an exactly full last page results in one more, empty, page
+	atomic.StoreUint64(&calls, 0)
+	c, err = NewAccountsClient(parts[0], parts[1], AccountsClientOptions{PageSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 25 || atomic.LoadUint64(&calls) != 6 {
+		t.Fatal("unexpected amount of upload infos or calls", len(infos), calls)
+	}
+
+	// assert the amount of pages is bounded, and that the truncated result
+	// is returned alongside an error and not cached
+	atomic.StoreUint64(&calls, 0)
+	c, err = NewAccountsClient(parts[0], parts[1], AccountsClientOptions{
+		MaxPages: 2,
+		PageSize: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if !errors.Contains(err, ErrUploadInfoTruncated) {
+		t.Fatal("unexpected error", err)
+	}
+	if len(infos) != 20 {
+		t.Fatal("unexpected amount of upload infos", len(infos))
+	}
+	if atomic.LoadUint64(&calls) != 2 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if !errors.Contains(err, ErrUploadInfoTruncated) {
+		t.Fatal("unexpected error", err)
+	}
+	if atomic.LoadUint64(&calls) != 4 {
+		t.Fatal("expected the truncated result not to be cached", calls)
+	}
+}
+
+// testUploadInfoGETRetry verifies the client retries GET requests that fail
+// with a 5xx status code.
+func testUploadInfoGETRetry(t *testing.T) {
+	t.Parallel()
+
+	// create a server that fails twice, then succeeds
+	var calls uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddUint64(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]UploadInfo{{Skylink: "skylink1", IP: "1.2.3.4"}})
+	}))
+	defer server.Close()
+
+	// assert the request succeeds after two retries
+	c := newTestAccountsClient(t, server)
+	infos, err := c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Skylink != "skylink1" {
+		t.Fatal("unexpected upload infos", infos)
+	}
+	if atomic.LoadUint64(&calls) != 3 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// assert the request fails if the attempts are exhausted, note that we
+	// use another skylink as the upload info of the first one is cached
+	atomic.StoreUint64(&calls, 0)
+	c.staticOptions.MaxAttempts = 2
+	_, err = c.UploadInfoGET(context.Background(), "skylink2")
+	if !isStatus(err, http.StatusBadGateway) {
+		t.Fatal("unexpected error", err)
+	}
+	if atomic.LoadUint64(&calls) != 2 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+}
+
+// testUploadInfoGETNoRetry verifies the client does not retry GET requests
+// that fail with a 4xx status code, and that it returns ErrUploadInfoNotFound
+// on a 404.
+func testUploadInfoGETNoRetry(t *testing.T) {
+	t.Parallel()
+
+	var calls uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	c := newTestAccountsClient(t, server)
+	_, err := c.UploadInfoGET(context.Background(), "skylink1")
+	if !errors.Contains(err, ErrUploadInfoNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+	if atomic.LoadUint64(&calls) != 1 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// assert the not found result is cached
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if !errors.Contains(err, ErrUploadInfoNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+	if atomic.LoadUint64(&calls) != 1 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+}
+
+// testUploadInfoGETCancel verifies cancelling the context aborts the retries.
+func testUploadInfoGETCancel(t *testing.T) {
+	t.Parallel()
+
+	var calls uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// use a long backoff and cancel the context while the client waits
+	c := newTestAccountsClient(t, server)
+	c.staticOptions.BaseBackoff = time.Minute
+	c.staticOptions.RetryBudget = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := c.UploadInfoGET(ctx, "skylink1")
+	if !errors.Contains(err, context.Canceled) {
+		t.Fatal("unexpected error", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("retries were not aborted")
+	}
+	if atomic.LoadUint64(&calls) != 1 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+}
+
+// testUploadInfoGETTimeout verifies requests to a slow server time out within
+// the configured bound and return ErrTimeout.
+func testUploadInfoGETTimeout(t *testing.T) {
+	t.Parallel()
+
+	// create a server that hangs until the test finishes
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	hostPort := strings.TrimPrefix(server.URL, "http://")
+	parts := strings.SplitN(hostPort, ":", 2)
+	c, err := NewAccountsClient(parts[0], parts[1], AccountsClientOptions{
+		MaxAttempts: 1,
+		Timeout:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if !errors.Contains(err, ErrTimeout) {
+		t.Fatal("unexpected error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("request did not time out within the configured bound", elapsed)
+	}
+}
+
+// testSharedHTTPClient verifies the client sends its requests through the
+// transport of the shared HTTP client, without altering the shared client.
+func testSharedHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]UploadInfo{})
+	}))
+	defer server.Close()
+
+	// create a shared client with a transport that counts the requests
+	var requests uint64
+	shared := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddUint64(&requests, 1)
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+		Timeout: time.Hour,
+	}
+
+	hostPort := strings.TrimPrefix(server.URL, "http://")
+	parts := strings.SplitN(hostPort, ":", 2)
+	c, err := NewAccountsClient(parts[0], parts[1], AccountsClientOptions{
+		HTTPClient: shared,
+		Timeout:    time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.UploadInfoGET(context.Background(), "skylink1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the request went through the shared transport, and the client
+	// uses its own timeout
+	if atomic.LoadUint64(&requests) != 1 {
+		t.Fatal("expected the shared transport to be used", requests)
+	}
+	if c.staticHTTPClient == shared || c.staticHTTPClient.Timeout != time.Second || shared.Timeout != time.Hour {
+		t.Fatal("unexpected client timeouts", c.staticHTTPClient.Timeout, shared.Timeout)
+	}
+}
+
+// roundTripperFunc is a helper type that implements the http.RoundTripper
+// interface using a function.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip implements the http.RoundTripper interface.
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newTestAccountsClient returns an accounts client that talks to the given
+// test server.
+func newTestAccountsClient(t *testing.T, server *httptest.Server) *AccountsClient {
+	hostPort := strings.TrimPrefix(server.URL, "http://")
+	parts := strings.SplitN(hostPort, ":", 2)
+	c, err := NewAccountsClient(parts[0], parts[1], AccountsClientOptions{
+		BaseBackoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,614 @@
+package api
+
+import (
+	"abuse-scanner/database"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// EmailStatusFailed lists the emails of which at least one skylink failed
+	// to get blocked.
+	EmailStatusFailed = "failed"
+
+	// EmailStatusUnblocked lists the parsed emails that have not been
+	// blocked.
+	EmailStatusUnblocked = "unblocked"
+
+	// EmailStatusUnfinalized lists the blocked emails that have not been
+	// finalized.
+	EmailStatusUnfinalized = "unfinalized"
+
+	// adminArchiveSuffix is the suffix of the admin endpoint that exports an
+	// email as an archive
+	adminArchiveSuffix = "/archive"
+
+	// adminEmailsPath is the path of the admin endpoints that operate on the
+	// emails, the uid of the email and the action follow the path
+	adminEmailsPath = "/admin/emails"
+
+	// adminQuarantinePath is the path of the admin endpoints that operate on
+	// the quarantined emails, the id of the email and the action follow the
+	// path
+	adminQuarantinePath = "/admin/quarantine"
+
+	// adminRefetchPath is the path of the admin endpoint that fetches a
+	// message from the mailbox again
+	adminRefetchPath = "/admin/refetch"
+
+	// adminReleaseSuffix is the suffix of the admin endpoint that releases a
+	// quarantined email
+	adminReleaseSuffix = "/release"
+
+	// adminStatsPath is the path of the admin endpoint that returns a time
+	// series of one of the database metrics
+	adminStatsPath = "/admin/stats"
+
+	// defaultAdminStatsBucket is the default bucket size of the stats
+	// endpoint
+	defaultAdminStatsBucket = 24 * time.Hour
+
+	// defaultAdminStatsWindow is the default time range covered by the stats
+	// endpoint, it ends now
+	defaultAdminStatsWindow = 7 * 24 * time.Hour
+)
+
+var (
+	// adminActions maps the actions that can be performed on an email onto
+	// the method of the admin database that performs it
+	adminActions = map[string]func(db AdminDatabase, uid string) error{
+		"reparse":        func(db AdminDatabase, uid string) error { return db.Reparse(uid) },
+		"requeue-block":  func(db AdminDatabase, uid string) error { return db.Requeue(uid) },
+		"suppress-reply": func(db AdminDatabase, uid string) error { return db.SuppressReply(uid) },
+	}
+)
+
+type (
+	// AdminDatabase is the database the admin API inspects and updates, it's
+	// implemented by the AbuseScannerDB. The updates respect the email locks.
+	AdminDatabase interface {
+		FindBlockFailed() ([]database.AbuseEmail, error)
+		FindOne(uid string) (*database.AbuseEmail, error)
+		FindQuarantined() ([]database.QuarantinedDocument, error)
+		FindReports(emailID primitive.ObjectID) ([]database.NCMECReport, error)
+		FindUnblocked() ([]database.AbuseEmail, error)
+		FindUnfinalized(mailbox string) ([]database.AbuseEmail, error)
+		InspectQuarantined(documentID interface{}) (*database.LooseAbuseEmail, error)
+		ReleaseQuarantined(documentID interface{}) error
+		Reparse(uid string) error
+		Requeue(uid string) error
+		SuppressReply(uid string) error
+		TimeSeries(metric string, bucket time.Duration, from, to time.Time) ([]database.TimeSeriesBucket, error)
+	}
+
+	// AdminEmail is the representation of an email in the admin API, the
+	// body is only included if it's requested explicitly.
+	AdminEmail struct {
+		UID       string `json:"uid"`
+		Mailbox   string `json:"mailbox"`
+		MessageID string `json:"message_id"`
+		Source    string `json:"source,omitempty"`
+		Subject   string `json:"subject"`
+		From      string `json:"from"`
+		ReplyTo   string `json:"reply_to"`
+		To        string `json:"to"`
+		Body      string `json:"body,omitempty"`
+
+		InsertedAt time.Time `json:"inserted_at"`
+		InsertedBy string    `json:"inserted_by"`
+		Skip       bool      `json:"skip"`
+		SkipReason string    `json:"skip_reason,omitempty"`
+
+		Parsed        bool        `json:"parsed"`
+		ParsedAt      time.Time   `json:"parsed_at"`
+		ParseResult   AdminReport `json:"parse_result"`
+		ResolutionLog string      `json:"resolution_log,omitempty"`
+
+		Blocked     bool      `json:"blocked"`
+		BlockedAt   time.Time `json:"blocked_at"`
+		BlockResult []string  `json:"block_result"`
+		DuplicateOf string    `json:"duplicate_of,omitempty"`
+		DryRun      bool      `json:"dry_run"`
+
+		Finalized       bool      `json:"finalized"`
+		FinalizedAt     time.Time `json:"finalized_at"`
+		ReplyHeld       bool      `json:"reply_held"`
+		ReplySuppressed bool      `json:"reply_suppressed"`
+
+		Reported             bool      `json:"reported"`
+		ReportedAt           time.Time `json:"reported_at"`
+		ReportLookupFailures []string  `json:"report_lookup_failures,omitempty"`
+	}
+
+	// AdminQuarantineResponse is the response of the admin endpoint that
+	// lists the quarantined documents.
+	AdminQuarantineResponse struct {
+		Documents []AdminQuarantinedDocument `json:"documents"`
+	}
+
+	// AdminQuarantinedDocument is the representation of a quarantined
+	// document in the admin API.
+	AdminQuarantinedDocument struct {
+		Collection    string      `json:"collection"`
+		DocumentID    interface{} `json:"document_id"`
+		Error         string      `json:"error"`
+		QuarantinedAt time.Time   `json:"quarantined_at"`
+	}
+
+	// AdminQuarantinedEmail is the loosely typed representation of a
+	// quarantined email in the admin API, it allows inspecting what fields
+	// are malformed.
+	AdminQuarantinedEmail struct {
+		ID      interface{}            `json:"id"`
+		UID     interface{}            `json:"uid"`
+		Version interface{}            `json:"version"`
+		Fields  map[string]interface{} `json:"fields"`
+	}
+
+	// AdminRefetchResponse is the response of the admin endpoint that fetches
+	// a message from the mailbox again.
+	AdminRefetchResponse struct {
+		UID string `json:"uid"`
+	}
+
+	// AdminEmailsResponse is the response of the admin endpoint that lists
+	// the emails with a given status.
+	AdminEmailsResponse struct {
+		Emails []AdminEmail `json:"emails"`
+	}
+
+	// AdminStatsResponse is the response of the admin endpoint that returns a
+	// time series of one of the database metrics.
+	AdminStatsResponse struct {
+		Metric  string                      `json:"metric"`
+		Buckets []database.TimeSeriesBucket `json:"buckets"`
+	}
+
+	// AdminReport is the representation of the parse result of an email in
+	// the admin API.
+	AdminReport struct {
+		Skylinks      []string `json:"skylinks"`
+		Tags          []string `json:"tags"`
+		ReporterOrg   string   `json:"reporter_org,omitempty"`
+		Sponsor       string   `json:"sponsor,omitempty"`
+		NeedsReview   bool     `json:"needs_review"`
+		ReviewReason  string   `json:"review_reason,omitempty"`
+		LowConfidence bool     `json:"low_confidence"`
+		Portal        string   `json:"portal,omitempty"`
+	}
+
+	// ErrorResponse is the response of the admin endpoints if the request
+	// failed.
+	ErrorResponse struct {
+		Message string `json:"message"`
+	}
+
+	// Refetcher fetches a message from the mailbox again, overwriting the
+	// email that was persisted for it, it's implemented by the Fetcher. It
+	// returns the uid of the email.
+	Refetcher interface {
+		Refetch(mailbox string, uid uint32) (string, error)
+	}
+)
+
+// SetAdminDatabase sets the database the admin API operates on, until then the
+// admin endpoints respond with a 503. The admin API is only served if an admin
+// token is configured.
+func (s *Server) SetAdminDatabase(db AdminDatabase) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adminDB = db
+}
+
+// SetRefetcher sets the refetcher the admin API uses to fetch a message from the
+// mailbox again, until then the refetch endpoint responds with a 503. It's
+// only set if the fetcher is enabled.
+func (s *Server) SetRefetcher(refetcher Refetcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refetcher = refetcher
+}
+
+// adminHandler handles the requests to the admin API, it authenticates the
+// request using the admin token and routes it to the handler of the endpoint.
+//
+// GET  /admin/emails?status=unblocked|unfinalized|failed
+// GET  /admin/emails/{uid}[?body=1]
+// GET  /admin/emails/{uid}/archive
+// POST /admin/emails/{uid}/reparse
+// POST /admin/emails/{uid}/requeue-block
+// POST /admin/emails/{uid}/suppress-reply
+// POST /admin/refetch?mailbox={mailbox}&uid={raw uid}
+// GET  /admin/quarantine
+// GET  /admin/quarantine/{id}
+// POST /admin/quarantine/{id}/release
+// GET  /admin/stats[?metric=emails&bucket=24h&from={time}&to={time}]
+func (s *Server) adminHandler(w http.ResponseWriter, req *http.Request) {
+	// authenticate the request, the token is compared in constant time
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.staticOptions.AdminToken)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Message: "invalid admin token"})
+		return
+	}
+
+	s.mu.Lock()
+	db := s.adminDB
+	s.mu.Unlock()
+	if db == nil {
+		writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Message: "the scanner is starting"})
+		return
+	}
+
+	// route the request, the uid is not split on slashes as the mailbox it
+	// contains can contain slashes
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if path == adminEmailsPath {
+		s.adminEmailsHandler(w, req, db)
+		return
+	}
+	if path == adminRefetchPath {
+		s.adminRefetchHandler(w, req)
+		return
+	}
+	if path == adminStatsPath {
+		s.adminStatsHandler(w, req, db)
+		return
+	}
+	if path == adminQuarantinePath {
+		s.adminQuarantineHandler(w, req, db)
+		return
+	}
+	if id := strings.TrimPrefix(path, adminQuarantinePath+"/"); id != path {
+		s.adminQuarantinedHandler(w, req, db, id)
+		return
+	}
+	uid := strings.TrimPrefix(path, adminEmailsPath+"/")
+	if uid == path || uid == "" {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Message: "unknown endpoint"})
+		return
+	}
+	if strings.HasSuffix(uid, adminArchiveSuffix) {
+		s.adminArchiveHandler(w, req, db, strings.TrimSuffix(uid, adminArchiveSuffix))
+		return
+	}
+	for action, fn := range adminActions {
+		if strings.HasSuffix(uid, "/"+action) {
+			s.adminActionHandler(w, req, db, strings.TrimSuffix(uid, "/"+action), action, fn)
+			return
+		}
+	}
+	s.adminEmailHandler(w, req, db, uid)
+}
+
+// adminEmailsHandler handles GET /admin/emails, it lists the emails with the
+// status given in the query.
+func (s *Server) adminEmailsHandler(w http.ResponseWriter, req *http.Request, db AdminDatabase) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+		return
+	}
+
+	var emails []database.AbuseEmail
+	var err error
+	switch status := req.URL.Query().Get("status"); status {
+	case EmailStatusFailed:
+		emails, err = db.FindBlockFailed()
+	case EmailStatusUnblocked:
+		emails, err = db.FindUnblocked()
+	case EmailStatusUnfinalized:
+		emails, err = db.FindUnfinalized("")
+	default:
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("invalid status '%v', expected one of '%v', '%v' or '%v'", status, EmailStatusUnblocked, EmailStatusUnfinalized, EmailStatusFailed)})
+		return
+	}
+	if err != nil {
+		s.staticLogger.Errorf("Failed to list emails, err %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	resp := AdminEmailsResponse{Emails: make([]AdminEmail, 0, len(emails))}
+	for _, email := range emails {
+		resp.Emails = append(resp.Emails, newAdminEmail(email, false))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// adminEmailHandler handles GET /admin/emails/{uid}, it responds with the
+// details of the email, the body is only included if the query contains
+// body=1.
+func (s *Server) adminEmailHandler(w http.ResponseWriter, req *http.Request, db AdminDatabase, uid string) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+		return
+	}
+
+	email, err := db.FindOne(uid)
+	if err != nil {
+		s.staticLogger.WithField("email_uid", uid).Errorf("Failed to find email, err %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if email == nil {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Message: database.ErrEmailNotFound.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminEmail(*email, req.URL.Query().Get("body") == "1"))
+}
+
+// adminActionHandler handles POST /admin/emails/{uid}/{action}, it performs the
+// given action on the email and responds with a 204 if it succeeded.
+func (s *Server) adminActionHandler(w http.ResponseWriter, req *http.Request, db AdminDatabase, uid, action string, fn func(db AdminDatabase, uid string) error) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+		return
+	}
+
+	logger := s.staticLogger.WithField("email_uid", uid)
+	err := fn(db, uid)
+	switch {
+	case errors.Contains(err, database.ErrEmailNotFound):
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Message: err.Error()})
+	case errors.Contains(err, database.ErrEmailSkipped), errors.Contains(err, database.ErrEmailFinalized):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Message: err.Error()})
+	case err != nil:
+		logger.Errorf("Failed to %v email, err %v", action, err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+	default:
+		logger.Infof("Performed %v through the admin API", action)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// adminRefetchHandler handles POST /admin/refetch, it fetches the message with
+// the raw uid given in the query from the mailbox given in the query again,
+// and responds with the uid of the email that got overwritten.
+func (s *Server) adminRefetchHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+		return
+	}
+
+	s.mu.Lock()
+	refetcher := s.refetcher
+	s.mu.Unlock()
+	if refetcher == nil {
+		writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{Message: "the fetcher is not enabled"})
+		return
+	}
+
+	mailbox := req.URL.Query().Get("mailbox")
+	if mailbox == "" {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Message: "missing mailbox"})
+		return
+	}
+	uidStr := req.URL.Query().Get("uid")
+	uid, err := strconv.ParseUint(uidStr, 10, 32)
+	if err != nil || uid == 0 {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("invalid uid '%v', expected a positive number", uidStr)})
+		return
+	}
+
+	logger := s.staticLogger.WithField("mailbox", mailbox)
+	emailUID, err := refetcher.Refetch(mailbox, uint32(uid))
+	switch {
+	case errors.Contains(err, database.ErrEmailNotFound):
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Message: err.Error()})
+	case errors.Contains(err, database.ErrEmailSkipped):
+		writeJSON(w, http.StatusConflict, ErrorResponse{Message: err.Error()})
+	case err != nil:
+		logger.Errorf("Failed to refetch message %v, err %v", uid, err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+	default:
+		logger.WithField("email_uid", emailUID).Infof("Refetched message %v through the admin API", uid)
+		writeJSON(w, http.StatusOK, AdminRefetchResponse{UID: emailUID})
+	}
+}
+
+// adminQuarantineHandler handles GET /admin/quarantine, it lists the
+// quarantined documents.
+func (s *Server) adminQuarantineHandler(w http.ResponseWriter, req *http.Request, db AdminDatabase) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+		return
+	}
+
+	docs, err := db.FindQuarantined()
+	if err != nil {
+		s.staticLogger.Errorf("Failed to list quarantined documents, err %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	resp := AdminQuarantineResponse{Documents: make([]AdminQuarantinedDocument, 0, len(docs))}
+	for _, doc := range docs {
+		resp.Documents = append(resp.Documents, AdminQuarantinedDocument{
+			Collection:    doc.Collection,
+			DocumentID:    doc.DocumentID,
+			Error:         doc.Error,
+			QuarantinedAt: doc.QuarantinedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// adminQuarantinedHandler handles GET /admin/quarantine/{id}, which responds
+// with the loosely typed quarantined email, and POST
+// /admin/quarantine/{id}/release, which releases the quarantined email once
+// it has been repaired and responds with a 204.
+func (s *Server) adminQuarantinedHandler(w http.ResponseWriter, req *http.Request, db AdminDatabase, id string) {
+	release := strings.HasSuffix(id, adminReleaseSuffix)
+	id = strings.TrimSuffix(id, adminReleaseSuffix)
+	if (release && req.Method != http.MethodPost) || (!release && req.Method != http.MethodGet) {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+		return
+	}
+	documentID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("invalid id '%v', expected an object id", id)})
+		return
+	}
+
+	logger := s.staticLogger.WithField("document_id", id)
+	if release {
+		err = db.ReleaseQuarantined(documentID)
+		switch {
+		case errors.Contains(err, database.ErrNotQuarantined):
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		case errors.Contains(err, database.ErrNotRepaired):
+			writeJSON(w, http.StatusConflict, ErrorResponse{Message: err.Error()})
+		case err != nil:
+			logger.Errorf("Failed to release quarantined email, err %v", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		default:
+			logger.Info("Released quarantined email through the admin API")
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	email, err := db.InspectQuarantined(documentID)
+	if errors.Contains(err, database.ErrNotQuarantined) {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Errorf("Failed to inspect quarantined email, err %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, AdminQuarantinedEmail{
+		ID:      email.ID,
+		UID:     email.UID,
+		Version: email.Version,
+		Fields:  email.Fields,
+	})
+}
+
+// adminStatsHandler handles GET /admin/stats, it responds with the time series
+// of the metric given in the query, like the stats command. The metric, the
+// bucket size and the time range default to the emails of the last week, per
+// day. The time range is given as dates or RFC3339 timestamps.
+func (s *Server) adminStatsHandler(w http.ResponseWriter, req *http.Request, db AdminDatabase) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+		return
+	}
+
+	query := req.URL.Query()
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = database.MetricEmails
+	}
+	bucket := defaultAdminStatsBucket
+	if bucketStr := query.Get("bucket"); bucketStr != "" {
+		var err error
+		bucket, err = time.ParseDuration(bucketStr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("invalid bucket '%v', %v", bucketStr, err)})
+			return
+		}
+	}
+	to := time.Now().UTC()
+	if toStr := query.Get("to"); toStr != "" {
+		var err error
+		to, err = parseAdminTime(toStr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("invalid to, %v", err)})
+			return
+		}
+	}
+	from := to.Add(-defaultAdminStatsWindow)
+	if fromStr := query.Get("from"); fromStr != "" {
+		var err error
+		from, err = parseAdminTime(fromStr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("invalid from, %v", err)})
+			return
+		}
+	}
+
+	buckets, err := db.TimeSeries(metric, bucket, from, to)
+	switch {
+	case errors.Contains(err, database.ErrUnknownMetric), errors.Contains(err, database.ErrInvalidTimeSeries):
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	case err != nil:
+		s.staticLogger.Errorf("Failed to compute the time series of %v, err %v", metric, err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, AdminStatsResponse{Metric: metric, Buckets: buckets})
+	}
+}
+
+// parseAdminTime is a helper function that parses the given value as either a
+// date or an RFC3339 timestamp, dates are interpreted as UTC.
+func parseAdminTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%v' is neither a date nor an RFC3339 timestamp", value)
+	}
+	return t.UTC(), nil
+}
+
+// newAdminEmail converts the given email into its representation in the admin
+// API, the body is only included if requested.
+func newAdminEmail(email database.AbuseEmail, includeBody bool) AdminEmail {
+	ae := AdminEmail{
+		UID:       email.UID,
+		Mailbox:   email.Mailbox,
+		MessageID: email.MessageID,
+		Source:    email.Source,
+		Subject:   email.Subject,
+		From:      email.From,
+		ReplyTo:   email.ReplyTo,
+		To:        email.To,
+
+		InsertedAt: email.InsertedAt,
+		InsertedBy: email.InsertedBy,
+		Skip:       email.Skip,
+		SkipReason: email.SkipReason,
+
+		Parsed:   email.Parsed,
+		ParsedAt: email.ParsedAt,
+		ParseResult: AdminReport{
+			Skylinks:      email.ParseResult.Skylinks,
+			Tags:          email.ParseResult.Tags,
+			ReporterOrg:   email.ParseResult.Reporter.ReporterOrg,
+			Sponsor:       email.ParseResult.Sponsor,
+			NeedsReview:   email.ParseResult.NeedsReview,
+			ReviewReason:  email.ParseResult.ReviewReason,
+			LowConfidence: email.ParseResult.LowConfidence,
+			Portal:        email.ParseResult.Portal,
+		},
+		ResolutionLog: email.ResolutionLog,
+
+		Blocked:     email.Blocked,
+		BlockedAt:   email.BlockedAt,
+		BlockResult: email.BlockResult,
+		DuplicateOf: email.DuplicateOf,
+		DryRun:      email.DryRun,
+
+		Finalized:       email.Finalized,
+		FinalizedAt:     email.FinalizedAt,
+		ReplyHeld:       email.ReplyHeld,
+		ReplySuppressed: email.ReplySuppressed,
+
+		Reported:             email.Reported,
+		ReportedAt:           email.ReportedAt,
+		ReportLookupFailures: email.ReportLookupFailures,
+	}
+	if includeBody {
+		ae.Body = string(email.Body)
+	}
+	return ae
+}
@@ -0,0 +1,671 @@
+package api
+
+import (
+	"abuse-scanner/database"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testAdminToken is the admin token of the test server
+const testAdminToken = "admintoken"
+
+// testAdminDB is an in-memory admin database.
+type testAdminDB struct {
+	emails  map[string]database.AbuseEmail
+	reports []database.NCMECReport
+
+	// quarantined maps the ids of the quarantined emails onto whether they
+	// have been repaired
+	quarantined map[primitive.ObjectID]bool
+
+	// timeSeries holds the arguments of the last time series request
+	timeSeries []interface{}
+
+	mu sync.Mutex
+}
+
+// newTestAdminDB returns an admin database that contains the given emails.
+func newTestAdminDB(emails ...database.AbuseEmail) *testAdminDB {
+	db := &testAdminDB{
+		emails:      make(map[string]database.AbuseEmail),
+		quarantined: make(map[primitive.ObjectID]bool),
+	}
+	for _, email := range emails {
+		db.emails[email.UID] = email
+	}
+	return db
+}
+
+// FindBlockFailed implements the AdminDatabase interface.
+func (db *testAdminDB) FindBlockFailed() ([]database.AbuseEmail, error) {
+	return db.filter(func(email database.AbuseEmail) bool {
+		for _, result := range email.BlockResult {
+			if result == database.AbuseStatusNotBlocked {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// FindOne implements the AdminDatabase interface.
+func (db *testAdminDB) FindOne(uid string) (*database.AbuseEmail, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	email, exists := db.emails[uid]
+	if !exists {
+		return nil, nil
+	}
+	return &email, nil
+}
+
+// FindQuarantined implements the AdminDatabase interface.
+func (db *testAdminDB) FindQuarantined() ([]database.QuarantinedDocument, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var docs []database.QuarantinedDocument
+	for id := range db.quarantined {
+		docs = append(docs, database.QuarantinedDocument{
+			Collection: "emails",
+			DocumentID: id,
+			Error:      "malformed",
+		})
+	}
+	return docs, nil
+}
+
+// FindReports implements the AdminDatabase interface.
+func (db *testAdminDB) FindReports(emailID primitive.ObjectID) ([]database.NCMECReport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var reports []database.NCMECReport
+	for _, report := range db.reports {
+		if report.EmailID == emailID {
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
+
+// FindUnblocked implements the AdminDatabase interface.
+func (db *testAdminDB) FindUnblocked() ([]database.AbuseEmail, error) {
+	return db.filter(func(email database.AbuseEmail) bool {
+		return email.Parsed && !email.Blocked && !email.Finalized
+	}), nil
+}
+
+// FindUnfinalized implements the AdminDatabase interface.
+func (db *testAdminDB) FindUnfinalized(string) ([]database.AbuseEmail, error) {
+	return db.filter(func(email database.AbuseEmail) bool {
+		return email.Parsed && email.Blocked && !email.Finalized
+	}), nil
+}
+
+// InspectQuarantined implements the AdminDatabase interface.
+func (db *testAdminDB) InspectQuarantined(documentID interface{}) (*database.LooseAbuseEmail, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, exists := db.quarantined[documentID.(primitive.ObjectID)]; !exists {
+		return nil, database.ErrNotQuarantined
+	}
+	return &database.LooseAbuseEmail{
+		ID:     documentID,
+		UID:    "INBOX-1",
+		Fields: bson.M{"parsed": "yes"},
+	}, nil
+}
+
+// ReleaseQuarantined implements the AdminDatabase interface.
+func (db *testAdminDB) ReleaseQuarantined(documentID interface{}) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	id := documentID.(primitive.ObjectID)
+	repaired, exists := db.quarantined[id]
+	if !exists {
+		return database.ErrNotQuarantined
+	}
+	if !repaired {
+		return database.ErrNotRepaired
+	}
+	delete(db.quarantined, id)
+	return nil
+}
+
+// Reparse implements the AdminDatabase interface.
+func (db *testAdminDB) Reparse(uid string) error {
+	return errors.New("not implemented")
+}
+
+// Requeue implements the AdminDatabase interface.
+func (db *testAdminDB) Requeue(uid string) error {
+	return errors.New("not implemented")
+}
+
+// SuppressReply implements the AdminDatabase interface.
+func (db *testAdminDB) SuppressReply(uid string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	email, exists := db.emails[uid]
+	if !exists {
+		return errors.AddContext(database.ErrEmailNotFound, uid)
+	}
+	if email.Finalized {
+		return errors.AddContext(database.ErrEmailFinalized, uid)
+	}
+	email.ReplySuppressed = true
+	db.emails[uid] = email
+	return nil
+}
+
+// TimeSeries implements the AdminDatabase interface.
+func (db *testAdminDB) TimeSeries(metric string, bucket time.Duration, from, to time.Time) ([]database.TimeSeriesBucket, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if metric != database.MetricEmails && metric != database.MetricBlocked {
+		return nil, database.ErrUnknownMetric
+	}
+	db.timeSeries = []interface{}{metric, bucket, from, to}
+	return []database.TimeSeriesBucket{{Time: from, Value: 1}}, nil
+}
+
+// filter returns the emails that match the given filter.
+func (db *testAdminDB) filter(match func(email database.AbuseEmail) bool) []database.AbuseEmail {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var emails []database.AbuseEmail
+	for _, email := range db.emails {
+		if match(email) {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// testRefetcher is a refetcher that refetches the messages of a single
+// mailbox, it knows which messages exist and which ones get skipped.
+type testRefetcher struct {
+	mailbox string
+	skipped map[uint32]bool
+}
+
+// Refetch implements the Refetcher interface.
+func (r *testRefetcher) Refetch(mailbox string, uid uint32) (string, error) {
+	skipped, exists := r.skipped[uid]
+	if mailbox != r.mailbox || !exists {
+		return "", database.ErrEmailNotFound
+	}
+	if skipped {
+		return "", database.ErrEmailSkipped
+	}
+	return fmt.Sprintf("%v-1-%v", mailbox, uid), nil
+}
+
+// TestAdmin is a collection of unit tests that verify the functionality of the
+// admin API.
+func TestAdmin(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	t.Run("Archive", testAdminArchive)
+	t.Run("Auth", testAdminAuth)
+	t.Run("Detail", testAdminDetail)
+	t.Run("List", testAdminList)
+	t.Run("Quarantine", testAdminQuarantine)
+	t.Run("Refetch", testAdminRefetch)
+	t.Run("Stats", testAdminStats)
+	t.Run("SuppressReply", testAdminSuppressReply)
+}
+
+// testAdminArchive verifies an email is exported as an archive that holds the
+// email, its NCMEC reports, its events and the raw email.
+func testAdminArchive(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServerWithOptions(t, ServerOptions{AdminToken: testAdminToken})
+	defer stopTestServer(t, s)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	email := database.AbuseEmail{
+		ID:          primitive.NewObjectID(),
+		UID:         "INBOX/abuse-42",
+		Body:        []byte("Subject: Abuse report\r\n\r\nabusive content"),
+		Subject:     "Abuse report",
+		InsertedAt:  now.Add(-3 * time.Hour),
+		InsertedBy:  "scanner-1",
+		Parsed:      true,
+		ParsedAt:    now.Add(-2 * time.Hour),
+		ParseResult: database.AbuseReport{Skylinks: []string{"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"}, Tags: []string{"csam"}},
+		Blocked:     true,
+		BlockedAt:   now.Add(-time.Hour),
+	}
+	db := newTestAdminDB(email)
+	db.reports = []database.NCMECReport{
+		{ID: primitive.NewObjectID(), EmailID: email.ID, Filed: true, FiledAt: now, Report: "<report/>", ReportID: 1337, InsertedAt: now.Add(-30 * time.Minute)},
+		{ID: primitive.NewObjectID(), EmailID: primitive.NewObjectID(), Report: "<other/>"},
+	}
+	s.SetAdminDatabase(db)
+
+	// assert the archive requires a GET, and that unknown emails are not found
+	if status := adminRequest(t, s, http.MethodPost, "/admin/emails/INBOX/abuse-42/archive", testAdminToken, nil); status != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status code", status)
+	}
+	if status := adminRequest(t, s, http.MethodGet, "/admin/emails/INBOX-unknown/archive", testAdminToken, nil); status != http.StatusNotFound {
+		t.Fatal("unexpected status code", status)
+	}
+
+	// download the archive
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%v/admin/emails/INBOX/abuse-42/archive", s.Address()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatal("unexpected response", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != `attachment; filename="abuse-INBOX_abuse-42.zip"` {
+		t.Fatal("unexpected content disposition", cd)
+	}
+	archive, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read the files in the archive
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+		files[f.Name] = content
+	}
+	if len(files) != 4 {
+		t.Fatal("unexpected files", len(files))
+	}
+
+	// assert the raw email and the email
+	if !bytes.Equal(files[archiveMessageFile], email.Body) {
+		t.Fatal("unexpected raw email", string(files[archiveMessageFile]))
+	}
+	var ae AdminEmail
+	if err := json.Unmarshal(files[archiveEmailFile], &ae); err != nil {
+		t.Fatal(err)
+	}
+	if ae.UID != email.UID || ae.Body != "" || !ae.Blocked || len(ae.ParseResult.Skylinks) != 1 {
+		t.Fatal("unexpected email", ae)
+	}
+
+	// assert only the reports of the email are included
+	var reports []AdminNCMECReport
+	if err := json.Unmarshal(files[archiveReportsFile], &reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].ReportID != 1337 || reports[0].Report != "<report/>" || !reports[0].Filed {
+		t.Fatal("unexpected reports", reports)
+	}
+
+	// assert the events are sorted, steps that did not happen are omitted
+	var events []AdminEvent
+	if err := json.Unmarshal(files[archiveEventsFile], &events); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, event := range events {
+		names = append(names, event.Event)
+	}
+	expected := []string{"fetched", "parsed", "blocked", "ncmec report built", "ncmec report filed"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatal("unexpected events", names)
+	}
+	if events[0].By != "scanner-1" {
+		t.Fatal("unexpected event", events[0])
+	}
+}
+
+// testAdminAuth verifies the admin API is only served if a token is configured,
+// and that requests without the token are rejected.
+func testAdminAuth(t *testing.T) {
+	t.Parallel()
+
+	// assert the admin API is not served without a token
+	disabled := newTestServer(t)
+	defer stopTestServer(t, disabled)
+	if status := adminRequest(t, disabled, http.MethodGet, "/admin/emails?status=unblocked", testAdminToken, nil); status != http.StatusNotFound {
+		t.Fatal("unexpected status code", status)
+	}
+
+	// assert requests without a valid token are rejected
+	s := newTestServerWithOptions(t, ServerOptions{AdminToken: testAdminToken})
+	defer stopTestServer(t, s)
+	for _, token := range []string{"", "invalid", testAdminToken + "x"} {
+		if status := adminRequest(t, s, http.MethodGet, "/admin/emails?status=unblocked", token, nil); status != http.StatusUnauthorized {
+			t.Fatal("unexpected status code", token, status)
+		}
+	}
+
+	// assert the admin API is unavailable until the database is set
+	if status := adminRequest(t, s, http.MethodGet, "/admin/emails?status=unblocked", testAdminToken, nil); status != http.StatusServiceUnavailable {
+		t.Fatal("unexpected status code", status)
+	}
+	s.SetAdminDatabase(newTestAdminDB())
+	if status := adminRequest(t, s, http.MethodGet, "/admin/emails?status=unblocked", testAdminToken, nil); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+}
+
+// testAdminDetail verifies the details of an email are returned, and that the
+// body is only included if requested.
+func testAdminDetail(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServerWithOptions(t, ServerOptions{AdminToken: testAdminToken})
+	defer stopTestServer(t, s)
+	s.SetAdminDatabase(newTestAdminDB(database.AbuseEmail{
+		UID:         "INBOX/abuse-42",
+		Body:        []byte("abusive content"),
+		Subject:     "Abuse report",
+		Parsed:      true,
+		ParseResult: database.AbuseReport{Skylinks: []string{"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"}, Tags: []string{"phishing"}},
+	}))
+
+	// assert the body is omitted by default, the uid contains a slash
+	var email AdminEmail
+	if status := adminRequest(t, s, http.MethodGet, "/admin/emails/INBOX/abuse-42", testAdminToken, &email); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+	if email.UID != "INBOX/abuse-42" || email.Subject != "Abuse report" || email.Body != "" || !email.Parsed || len(email.ParseResult.Skylinks) != 1 {
+		t.Fatal("unexpected email", email)
+	}
+
+	// assert the body is included when requested
+	email = AdminEmail{}
+	if status := adminRequest(t, s, http.MethodGet, "/admin/emails/INBOX/abuse-42?body=1", testAdminToken, &email); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+	if email.Body != "abusive content" {
+		t.Fatal("unexpected body", email.Body)
+	}
+
+	// assert an unknown email is not found
+	if status := adminRequest(t, s, http.MethodGet, "/admin/emails/INBOX-unknown", testAdminToken, nil); status != http.StatusNotFound {
+		t.Fatal("unexpected status code", status)
+	}
+}
+
+// testAdminList verifies the emails are listed by status.
+func testAdminList(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServerWithOptions(t, ServerOptions{AdminToken: testAdminToken})
+	defer stopTestServer(t, s)
+	s.SetAdminDatabase(newTestAdminDB(
+		database.AbuseEmail{UID: "INBOX-1", Body: []byte("body"), Parsed: true},
+		database.AbuseEmail{UID: "INBOX-2", Parsed: true, Blocked: true, BlockResult: []string{database.AbuseStatusBlocked}},
+		database.AbuseEmail{UID: "INBOX-3", Parsed: true, Blocked: true, Finalized: true, BlockResult: []string{database.AbuseStatusNotBlocked}},
+	))
+
+	for status, uid := range map[string]string{
+		EmailStatusFailed:      "INBOX-3",
+		EmailStatusUnblocked:   "INBOX-1",
+		EmailStatusUnfinalized: "INBOX-2",
+	} {
+		var resp AdminEmailsResponse
+		if code := adminRequest(t, s, http.MethodGet, "/admin/emails?status="+status, testAdminToken, &resp); code != http.StatusOK {
+			t.Fatal("unexpected status code", status, code)
+		}
+		if len(resp.Emails) != 1 || resp.Emails[0].UID != uid || resp.Emails[0].Body != "" {
+			t.Fatal("unexpected emails", status, resp.Emails)
+		}
+	}
+
+	// assert an unknown status is rejected
+	if code := adminRequest(t, s, http.MethodGet, "/admin/emails?status=stuck", testAdminToken, nil); code != http.StatusBadRequest {
+		t.Fatal("unexpected status code", code)
+	}
+	if code := adminRequest(t, s, http.MethodPost, "/admin/emails?status=unblocked", testAdminToken, nil); code != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status code", code)
+	}
+}
+
+// testAdminQuarantine verifies the quarantined emails can be listed, inspected
+// and released once they have been repaired.
+func testAdminQuarantine(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServerWithOptions(t, ServerOptions{AdminToken: testAdminToken})
+	defer stopTestServer(t, s)
+	db := newTestAdminDB()
+	malformed, repaired := primitive.NewObjectID(), primitive.NewObjectID()
+	db.quarantined[malformed] = false
+	db.quarantined[repaired] = true
+	s.SetAdminDatabase(db)
+
+	// assert the quarantined emails are listed
+	var list AdminQuarantineResponse
+	if status := adminRequest(t, s, http.MethodGet, "/admin/quarantine", testAdminToken, &list); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+	if len(list.Documents) != 2 || list.Documents[0].Collection != "emails" || list.Documents[0].Error != "malformed" {
+		t.Fatal("unexpected documents", list.Documents)
+	}
+
+	// assert a quarantined email can be inspected
+	var email AdminQuarantinedEmail
+	if status := adminRequest(t, s, http.MethodGet, "/admin/quarantine/"+malformed.Hex(), testAdminToken, &email); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+	if email.ID != malformed.Hex() || email.UID != "INBOX-1" || email.Fields["parsed"] != "yes" {
+		t.Fatal("unexpected email", email)
+	}
+
+	// assert only the repaired email can be released
+	if status := adminRequest(t, s, http.MethodGet, "/admin/quarantine/"+repaired.Hex()+"/release", testAdminToken, nil); status != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status code", status)
+	}
+	if status := adminRequest(t, s, http.MethodPost, "/admin/quarantine/"+malformed.Hex()+"/release", testAdminToken, nil); status != http.StatusConflict {
+		t.Fatal("unexpected status code", status)
+	}
+	if status := adminRequest(t, s, http.MethodPost, "/admin/quarantine/"+repaired.Hex()+"/release", testAdminToken, nil); status != http.StatusNoContent {
+		t.Fatal("unexpected status code", status)
+	}
+
+	// assert invalid and unknown ids are rejected
+	for path, expected := range map[string]int{
+		"/admin/quarantine/abc":                              http.StatusBadRequest,
+		"/admin/quarantine/" + repaired.Hex():                http.StatusNotFound,
+		"/admin/quarantine/" + primitive.NewObjectID().Hex(): http.StatusNotFound,
+	} {
+		if status := adminRequest(t, s, http.MethodGet, path, testAdminToken, nil); status != expected {
+			t.Fatal("unexpected status code", path, status)
+		}
+	}
+	if status := adminRequest(t, s, http.MethodPost, "/admin/quarantine/"+repaired.Hex()+"/release", testAdminToken, nil); status != http.StatusNotFound {
+		t.Fatal("unexpected status code", status)
+	}
+}
+
+// testAdminRefetch verifies a message can be fetched from the mailbox again once
+// the refetcher is set.
+func testAdminRefetch(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServerWithOptions(t, ServerOptions{AdminToken: testAdminToken})
+	defer stopTestServer(t, s)
+	s.SetAdminDatabase(newTestAdminDB())
+
+	// assert the endpoint is unavailable until the refetcher is set
+	if status := adminRequest(t, s, http.MethodPost, "/admin/refetch?mailbox=INBOX&uid=1", testAdminToken, nil); status != http.StatusServiceUnavailable {
+		t.Fatal("unexpected status code", status)
+	}
+	s.SetRefetcher(&testRefetcher{mailbox: "INBOX", skipped: map[uint32]bool{1: false, 2: true}})
+
+	// assert the mutation requires a POST
+	if status := adminRequest(t, s, http.MethodGet, "/admin/refetch?mailbox=INBOX&uid=1", testAdminToken, nil); status != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status code", status)
+	}
+
+	// refetch the message and assert the uid of the email is returned
+	var resp AdminRefetchResponse
+	if status := adminRequest(t, s, http.MethodPost, "/admin/refetch?mailbox=INBOX&uid=1", testAdminToken, &resp); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+	if resp.UID != "INBOX-1-1" {
+		t.Fatal("unexpected uid", resp.UID)
+	}
+
+	// assert invalid, unknown and skipped messages are rejected
+	for path, expected := range map[string]int{
+		"/admin/refetch?uid=1":                 http.StatusBadRequest,
+		"/admin/refetch?mailbox=INBOX":         http.StatusBadRequest,
+		"/admin/refetch?mailbox=INBOX&uid=0":   http.StatusBadRequest,
+		"/admin/refetch?mailbox=INBOX&uid=-1":  http.StatusBadRequest,
+		"/admin/refetch?mailbox=INBOX&uid=abc": http.StatusBadRequest,
+		"/admin/refetch?mailbox=INBOX&uid=3":   http.StatusNotFound,
+		"/admin/refetch?mailbox=Archive&uid=1": http.StatusNotFound,
+		"/admin/refetch?mailbox=INBOX&uid=2":   http.StatusConflict,
+	} {
+		if status := adminRequest(t, s, http.MethodPost, path, testAdminToken, nil); status != expected {
+			t.Fatal("unexpected status code", path, status)
+		}
+	}
+}
+
+// testAdminStats verifies the time series of a metric is returned, and that
+// the query defaults to the emails of the last week, per day.
+func testAdminStats(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServerWithOptions(t, ServerOptions{AdminToken: testAdminToken})
+	defer stopTestServer(t, s)
+	db := newTestAdminDB()
+	s.SetAdminDatabase(db)
+
+	// assert the defaults
+	var resp AdminStatsResponse
+	if status := adminRequest(t, s, http.MethodGet, "/admin/stats", testAdminToken, &resp); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+	if resp.Metric != database.MetricEmails || len(resp.Buckets) != 1 || resp.Buckets[0].Value != 1 {
+		t.Fatal("unexpected response", resp)
+	}
+	db.mu.Lock()
+	from, to := db.timeSeries[2].(time.Time), db.timeSeries[3].(time.Time)
+	if db.timeSeries[1] != 24*time.Hour || to.Sub(from) != defaultAdminStatsWindow || time.Since(to) > time.Minute {
+		t.Fatal("unexpected time series", db.timeSeries)
+	}
+	db.mu.Unlock()
+
+	// assert the query is passed on
+	if status := adminRequest(t, s, http.MethodGet, "/admin/stats?metric=blocked&bucket=1h&from=2022-03-01&to=2022-03-02T12:00:00Z", testAdminToken, &resp); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+	db.mu.Lock()
+	expected := []interface{}{database.MetricBlocked, time.Hour, time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.March, 2, 12, 0, 0, 0, time.UTC)}
+	if !reflect.DeepEqual(db.timeSeries, expected) {
+		t.Fatal("unexpected time series", db.timeSeries)
+	}
+	db.mu.Unlock()
+
+	// assert invalid queries are rejected
+	for _, query := range []string{"metric=unknown", "bucket=day", "from=yesterday", "to=tomorrow"} {
+		if status := adminRequest(t, s, http.MethodGet, "/admin/stats?"+query, testAdminToken, nil); status != http.StatusBadRequest {
+			t.Fatal("unexpected status code", query, status)
+		}
+	}
+	if status := adminRequest(t, s, http.MethodPost, "/admin/stats", testAdminToken, nil); status != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status code", status)
+	}
+}
+
+// testAdminSuppressReply verifies the reply to an email can be suppressed until
+// the email is finalized.
+func testAdminSuppressReply(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServerWithOptions(t, ServerOptions{AdminToken: testAdminToken})
+	defer stopTestServer(t, s)
+	db := newTestAdminDB(
+		database.AbuseEmail{UID: "INBOX-1", Parsed: true, Blocked: true},
+		database.AbuseEmail{UID: "INBOX-2", Parsed: true, Blocked: true, Finalized: true},
+	)
+	s.SetAdminDatabase(db)
+
+	// assert the mutation requires a POST
+	if status := adminRequest(t, s, http.MethodGet, "/admin/emails/INBOX-1/suppress-reply", testAdminToken, nil); status != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status code", status)
+	}
+
+	// suppress the reply and assert it's reflected in the details
+	if status := adminRequest(t, s, http.MethodPost, "/admin/emails/INBOX-1/suppress-reply", testAdminToken, nil); status != http.StatusNoContent {
+		t.Fatal("unexpected status code", status)
+	}
+	var email AdminEmail
+	if status := adminRequest(t, s, http.MethodGet, "/admin/emails/INBOX-1", testAdminToken, &email); status != http.StatusOK {
+		t.Fatal("unexpected status code", status)
+	}
+	if !email.ReplySuppressed {
+		t.Fatal("expected the reply to be suppressed")
+	}
+
+	// assert finalized and unknown emails are rejected
+	if status := adminRequest(t, s, http.MethodPost, "/admin/emails/INBOX-2/suppress-reply", testAdminToken, nil); status != http.StatusConflict {
+		t.Fatal("unexpected status code", status)
+	}
+	if status := adminRequest(t, s, http.MethodPost, "/admin/emails/INBOX-3/suppress-reply", testAdminToken, nil); status != http.StatusNotFound {
+		t.Fatal("unexpected status code", status)
+	}
+}
+
+// adminRequest is a helper function that sends a request to the admin API
+// using the given token, it decodes the response into the given object if
+// it's not nil and returns the status code.
+func adminRequest(t *testing.T, s *Server, method, path, token string, obj interface{}) int {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%v%v", s.Address(), path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if obj != nil && resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
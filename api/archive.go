@@ -0,0 +1,228 @@
+package api
+
+import (
+	"abuse-scanner/database"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	// archiveEmailFile is the name of the file in the archive that holds the
+	// email, without its body
+	archiveEmailFile = "email.json"
+
+	// archiveEventsFile is the name of the file in the archive that holds the
+	// events of the email
+	archiveEventsFile = "events.json"
+
+	// archiveMessageFile is the name of the file in the archive that holds the
+	// raw email, it's only included if the body was retained
+	archiveMessageFile = "message.eml"
+
+	// archiveReportsFile is the name of the file in the archive that holds
+	// the NCMEC reports of the email
+	archiveReportsFile = "reports.json"
+)
+
+var (
+	// archiveFilenameRE matches the characters that are replaced in the
+	// filename of the archive
+	archiveFilenameRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+type (
+	// AdminEvent is an event in the processing of an email, the events in
+	// the archive are reconstructed from the timestamps that are recorded on
+	// the email and its NCMEC reports.
+	AdminEvent struct {
+		Time    time.Time `json:"time"`
+		Event   string    `json:"event"`
+		By      string    `json:"by,omitempty"`
+		Details string    `json:"details,omitempty"`
+	}
+
+	// AdminNCMECReport is the representation of an NCMEC report in the admin
+	// API, the report holds the XML that was sent to NCMEC.
+	AdminNCMECReport struct {
+		ID          string    `json:"id"`
+		Filed       bool      `json:"filed"`
+		FiledAt     time.Time `json:"filed_at"`
+		FiledErr    string    `json:"filed_err,omitempty"`
+		Report      string    `json:"report"`
+		ReportID    uint64    `json:"report_id"`
+		ReportDebug bool      `json:"report_debug"`
+		DryRun      bool      `json:"dry_run"`
+		InsertedAt  time.Time `json:"inserted_at"`
+	}
+)
+
+// adminArchiveHandler handles GET /admin/emails/{uid}/archive, it responds with
+// a zip archive that holds everything we know about the email, which is what
+// we hand over when records are requested for a complaint. The archive holds
+// the email, its NCMEC reports and its events as JSON, and the raw email if its
+// body was retained.
+func (s *Server) adminArchiveHandler(w http.ResponseWriter, req *http.Request, db AdminDatabase, uid string) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "method not allowed"})
+		return
+	}
+
+	logger := s.staticLogger.WithField("email_uid", uid)
+	email, err := db.FindOne(uid)
+	if err != nil {
+		logger.Errorf("Failed to find email, err %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if email == nil {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Message: database.ErrEmailNotFound.Error()})
+		return
+	}
+	reports, err := db.FindReports(email.ID)
+	if err != nil {
+		logger.Errorf("Failed to find NCMEC reports, err %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// build the archive before we write the headers, so we can still respond
+	// with an error if it fails
+	archive, err := buildArchive(*email, reports)
+	if err != nil {
+		logger.Errorf("Failed to build archive, err %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	filename := fmt.Sprintf("abuse-%s.zip", archiveFilenameRE.ReplaceAllString(uid, "_"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(archive)
+	if err != nil {
+		logger.Errorf("Failed to write archive, err %v", err)
+		return
+	}
+	logger.Infof("Exported archive through the admin API")
+}
+
+// buildArchive returns a zip archive that holds the given email, its NCMEC
+// reports and its events, alongside the raw email if its body was retained.
+func buildArchive(email database.AbuseEmail, reports []database.NCMECReport) ([]byte, error) {
+	adminReports := make([]AdminNCMECReport, 0, len(reports))
+	for _, report := range reports {
+		adminReports = append(adminReports, newAdminNCMECReport(report))
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	files := []struct {
+		name string
+		obj  interface{}
+	}{
+		{archiveEmailFile, newAdminEmail(email, false)},
+		{archiveEventsFile, archiveEvents(email, reports)},
+		{archiveReportsFile, adminReports},
+	}
+	for _, file := range files {
+		content, err := json.MarshalIndent(file.obj, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %v, err %v", file.name, err)
+		}
+		err = writeArchiveFile(zw, file.name, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(email.Body) > 0 {
+		err := writeArchiveFile(zw, archiveMessageFile, email.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close archive, err %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// archiveEvents returns the events of the given email and its NCMEC reports,
+// sorted by time. The events are reconstructed from the recorded timestamps,
+// the steps that did not happen yet are omitted.
+func archiveEvents(email database.AbuseEmail, reports []database.NCMECReport) []AdminEvent {
+	events := make([]AdminEvent, 0)
+	add := func(t time.Time, event, by, details string) {
+		if t.IsZero() {
+			return
+		}
+		events = append(events, AdminEvent{Time: t, Event: event, By: by, Details: details})
+	}
+
+	add(email.InsertedAt, "fetched", email.InsertedBy, email.SkipReason)
+	if email.Parsed {
+		add(email.ParsedAt, "parsed", email.ParsedBy, fmt.Sprintf("%v skylinks", len(email.ParseResult.Skylinks)))
+	}
+	if email.Blocked {
+		add(email.BlockedAt, "blocked", email.BlockedBy, email.DuplicateOf)
+	}
+	if email.Finalized {
+		add(email.FinalizedAt, "finalized", email.FinalizedBy, "")
+	}
+	if email.Reported {
+		add(email.ReportedAt, "reported", email.ReportedBy, "")
+	}
+	for _, report := range reports {
+		id := report.ID.Hex()
+		add(report.InsertedAt, "ncmec report built", "", id)
+		switch {
+		case report.Filed:
+			add(report.FiledAt, "ncmec report filed", "", fmt.Sprintf("%v, NCMEC report id %v", id, report.ReportID))
+		case report.FiledErr != "":
+			add(report.FiledAt, "ncmec report failed", "", fmt.Sprintf("%v, %v", id, report.FiledErr))
+		case report.ReportID != 0:
+			add(report.FiledAt, "ncmec report opened", "", fmt.Sprintf("%v, NCMEC report id %v", id, report.ReportID))
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events
+}
+
+// newAdminNCMECReport converts the given NCMEC report into its representation
+// in the admin API.
+func newAdminNCMECReport(report database.NCMECReport) AdminNCMECReport {
+	return AdminNCMECReport{
+		ID:          report.ID.Hex(),
+		Filed:       report.Filed,
+		FiledAt:     report.FiledAt,
+		FiledErr:    report.FiledErr,
+		Report:      report.Report,
+		ReportID:    report.ReportID,
+		ReportDebug: report.ReportDebug,
+		DryRun:      report.DryRun,
+		InsertedAt:  report.InsertedAt,
+	}
+}
+
+// writeArchiveFile writes a file with given name and content to the archive.
+func writeArchiveFile(zw *zip.Writer, name string, content []byte) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create %v, err %v", name, err)
+	}
+	_, err = fw.Write(content)
+	if err != nil {
+		return fmt.Errorf("failed to write %v, err %v", name, err)
+	}
+	return nil
+}
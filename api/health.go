@@ -0,0 +1,213 @@
+package api
+
+import (
+	"abuse-scanner/metrics"
+	"abuse-scanner/version"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// DefaultLoopGracePeriod is the default amount of time a module's main
+	// loop can be late before it is considered wedged.
+	DefaultLoopGracePeriod = 15 * time.Minute
+
+	// DefaultMaxFetchAge is the default maximum age of the last successful
+	// fetch before the fetcher is considered unhealthy.
+	DefaultMaxFetchAge = 15 * time.Minute
+
+	// StatusDegraded is the overall status if a non-critical component is
+	// unhealthy.
+	StatusDegraded = "degraded"
+
+	// StatusOK is the status of a healthy component, and the overall status
+	// if all components are healthy.
+	StatusOK = "ok"
+
+	// StatusStarting is the overall status while the scanner is starting.
+	StatusStarting = "starting"
+
+	// StatusUnhealthy is the status of an unhealthy component, and the
+	// overall status if a critical component is unhealthy.
+	StatusUnhealthy = "unhealthy"
+
+	// checkTimeout is the amount of time a single health check may take.
+	checkTimeout = 5 * time.Second
+)
+
+type (
+	// CheckFunc checks the health of a component, it returns an error if
+	// the component is unhealthy.
+	CheckFunc func(ctx context.Context) error
+
+	// check is a health check for a single component.
+	check struct {
+		staticCheck    CheckFunc
+		staticCritical bool
+		staticName     string
+	}
+
+	// ComponentStatus is the status of a single component.
+	ComponentStatus struct {
+		Critical bool   `json:"critical"`
+		Error    string `json:"error,omitempty"`
+		Status   string `json:"status"`
+	}
+
+	// HealthResponse is the response of the health and ready endpoints, it
+	// includes the version of the scanner.
+	HealthResponse struct {
+		Components map[string]ComponentStatus `json:"components,omitempty"`
+		Status     string                     `json:"status"`
+		Version    version.Info               `json:"version"`
+	}
+)
+
+// AddCheck adds a health check for the component with the given name. If a
+// critical component is unhealthy, the scanner is unhealthy.
+func (s *Server) AddCheck(name string, critical bool, fn CheckFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks = append(s.checks, check{
+		staticCheck:    fn,
+		staticCritical: critical,
+		staticName:     name,
+	})
+}
+
+// SetReady marks the scanner as ready, which means all of its modules were
+// started. Until then the ready endpoint responds with a 503.
+func (s *Server) SetReady() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = true
+}
+
+// healthHandler handles GET /health, it responds with the status of every
+// component. The status code is 503 if any critical component is unhealthy.
+func (s *Server) healthHandler(w http.ResponseWriter, req *http.Request) {
+	s.managedWriteHealth(req.Context(), w)
+}
+
+// readyHandler handles GET /ready, it responds like the health endpoint once
+// the scanner is ready, and with a 503 while it's still starting.
+func (s *Server) readyHandler(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: StatusStarting, Version: version.Current()})
+		return
+	}
+	s.managedWriteHealth(req.Context(), w)
+}
+
+// managedWriteHealth runs all health checks and writes the outcome.
+func (s *Server) managedWriteHealth(ctx context.Context, w http.ResponseWriter) {
+	s.mu.Lock()
+	checks := make([]check, len(s.checks))
+	copy(checks, s.checks)
+	s.mu.Unlock()
+
+	resp := runChecks(ctx, checks)
+	resp.Version = version.Current()
+	status := http.StatusOK
+	if resp.Status == StatusUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// AgeCheck returns a health check that verifies the time returned by the given
+// function is not older than the given maximum age. The zero time indicates it
+// never happened, which is considered unhealthy as well.
+func AgeCheck(last func() time.Time, maxAge time.Duration) CheckFunc {
+	return func(_ context.Context) error {
+		lastTime := last()
+		if lastTime.IsZero() {
+			return errors.New("never succeeded")
+		}
+		if age := time.Since(lastTime); age > maxAge {
+			return fmt.Errorf("last success was %v ago, which exceeds the maximum of %v", age.Round(time.Second), maxAge)
+		}
+		return nil
+	}
+}
+
+// LoopCheck returns a health check that verifies the main loop of the given
+// module is alive, meaning its next iteration is not overdue by more than the
+// given grace period, and that it did not give up. It relies on the iterations
+// the modules record in the metrics package.
+func LoopCheck(module string, gracePeriod time.Duration) CheckFunc {
+	return func(_ context.Context) error {
+		if reason, stopped := metrics.LoopStopped(module); stopped {
+			return fmt.Errorf("module %v stopped its loop, it %v", module, reason)
+		}
+		deadline, exists := metrics.LoopDeadline(module)
+		if !exists {
+			return fmt.Errorf("module %v did not report any loop iteration", module)
+		}
+		if late := time.Since(deadline); late > gracePeriod {
+			return fmt.Errorf("module %v is %v late for its next loop iteration", module, late.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// runChecks is a helper function that runs the given health checks in
+// parallel and returns the aggregated outcome. The overall status is unhealthy
+// if any critical component is unhealthy, and degraded if any non-critical
+// component is unhealthy.
+func runChecks(ctx context.Context, checks []check) HealthResponse {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	// run the checks
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			errs[i] = c.staticCheck(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	// aggregate the outcome
+	resp := HealthResponse{
+		Components: make(map[string]ComponentStatus, len(checks)),
+		Status:     StatusOK,
+	}
+	for i, c := range checks {
+		component := ComponentStatus{
+			Critical: c.staticCritical,
+			Status:   StatusOK,
+		}
+		if errs[i] != nil {
+			component.Error = errs[i].Error()
+			component.Status = StatusUnhealthy
+			if c.staticCritical {
+				resp.Status = StatusUnhealthy
+			} else if resp.Status == StatusOK {
+				resp.Status = StatusDegraded
+			}
+		}
+		resp.Components[c.staticName] = component
+	}
+	return resp
+}
+
+// writeJSON is a helper function that writes the given object as JSON with
+// the given status code.
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(obj)
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// DefaultListenAddress is the address the HTTP server listens on by
+	// default.
+	DefaultListenAddress = ":9091"
+
+	// defaultGoroutineLogInterval is the default interval at which the amount
+	// of running goroutines is logged.
+	defaultGoroutineLogInterval = 10 * time.Minute
+
+	// shutdownTimeout is the amount of time we wait for open requests to
+	// complete when the server shuts down.
+	shutdownTimeout = 10 * time.Second
+)
+
+type (
+	// Server is the HTTP server of the abuse scanner, it serves the metrics
+	// of the scanner at /metrics and its health at /health and /ready. If
+	// enabled, it serves the pprof profiles at /debug/pprof/ and the admin
+	// API at /admin/.
+	Server struct {
+		listener net.Listener
+
+		staticAddress   string
+		staticLogger    *logrus.Entry
+		staticOptions   ServerOptions
+		staticServer    *http.Server
+		staticStopChan  chan struct{}
+		staticWaitGroup sync.WaitGroup
+
+		adminDB   AdminDatabase
+		checks    []check
+		ready     bool
+		refetcher Refetcher
+		mu        sync.Mutex
+	}
+
+	// ServerOptions contains the configurable options of the HTTP server.
+	ServerOptions struct {
+		// AdminToken is the shared token that authenticates the requests to
+		// the admin API, which is only served if the token is set. The token
+		// is passed in the Authorization header as a bearer token.
+		AdminToken string
+
+		// EnablePprof mounts the net/http/pprof handlers under
+		// /debug/pprof/, it is disabled by default as profiles expose
+		// internals of the scanner.
+		EnablePprof bool
+
+		// GoroutineLogInterval is the interval at which the amount of
+		// running goroutines is logged, if zero it defaults to
+		// defaultGoroutineLogInterval.
+		GoroutineLogInterval time.Duration
+	}
+)
+
+// NewServer creates a new HTTP server that listens on the given address and
+// serves the metrics in the given registry.
+func NewServer(address string, registry *prometheus.Registry, opts ServerOptions, logger *logrus.Logger) *Server {
+	// set the defaults
+	if address == "" {
+		address = DefaultListenAddress
+	}
+	if opts.GoroutineLogInterval == 0 {
+		opts.GoroutineLogInterval = defaultGoroutineLogInterval
+	}
+
+	s := &Server{
+		staticAddress:  address,
+		staticLogger:   logger.WithField("module", "Server"),
+		staticOptions:  opts,
+		staticStopChan: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/health", s.healthHandler)
+	mux.HandleFunc("/ready", s.readyHandler)
+	if opts.AdminToken != "" {
+		mux.HandleFunc("/admin/", s.adminHandler)
+	}
+
+	// the pprof handlers are registered explicitly, rather than through the
+	// side effect of importing the package, so they are only exposed when
+	// enabled
+	if opts.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	s.staticServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Address returns the address the server is listening on, it returns an empty
+// string if the server was not started.
+func (s *Server) Address() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Start starts listening on the server's address and serves requests in a
+// background thread. It returns an error if it fails to listen.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.staticAddress)
+	if err != nil {
+		return errors.AddContext(err, "failed to listen on "+s.staticAddress)
+	}
+	s.listener = listener
+
+	s.staticWaitGroup.Add(1)
+	go func() {
+		defer s.staticWaitGroup.Done()
+		err := s.staticServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			s.staticLogger.Errorf("HTTP server stopped unexpectedly, err %v", err)
+		}
+	}()
+	s.staticWaitGroup.Add(1)
+	go func() {
+		defer s.staticWaitGroup.Done()
+		s.threadedLogGoroutines()
+	}()
+
+	s.staticLogger.Infof("Listening on %v", s.Address())
+	if s.staticOptions.EnablePprof {
+		s.staticLogger.Warnf("Serving pprof profiles at /debug/pprof/")
+	}
+	return nil
+}
+
+// Stop gracefully shuts down the server, waiting for open requests to
+// complete.
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	close(s.staticStopChan)
+	err := s.staticServer.Shutdown(ctx)
+	s.staticWaitGroup.Wait()
+	if err != nil {
+		return errors.AddContext(err, "unclean server shutdown")
+	}
+	return nil
+}
+
+// threadedLogGoroutines periodically logs the amount of running goroutines,
+// which makes goroutine leaks visible in the logs. The amount is exported as
+// the go_goroutines metric as well.
+func (s *Server) threadedLogGoroutines() {
+	ticker := time.NewTicker(s.staticOptions.GoroutineLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.staticStopChan:
+			return
+		case <-ticker.C:
+		}
+		s.staticLogger.Infof("%v goroutines running", runtime.NumGoroutine())
+	}
+}
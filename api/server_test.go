@@ -0,0 +1,260 @@
+package api
+
+import (
+	"abuse-scanner/metrics"
+	"abuse-scanner/version"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestServer is a collection of unit tests that verify the functionality of
+// the HTTP server.
+func TestServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	t.Run("Health", testHealth)
+	t.Run("LoopCheck", testLoopCheck)
+	t.Run("Metrics", testMetrics)
+	t.Run("Pprof", testPprof)
+	t.Run("Ready", testReady)
+}
+
+// testHealth verifies the health endpoint reports the status of every
+// component, and degrades to a 503 if a critical component is unhealthy.
+func testHealth(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t)
+	defer stopTestServer(t, s)
+
+	// assert the scanner is healthy without any checks, and that it reports
+	// its version
+	status, resp := getHealth(t, s, "/health")
+	if status != http.StatusOK || resp.Status != StatusOK {
+		t.Fatal("unexpected response", status, resp)
+	}
+	if resp.Version != version.Current() {
+		t.Fatal("unexpected version", resp.Version)
+	}
+
+	// add a healthy fetcher and an unhealthy non-critical component
+	lastFetch := time.Now()
+	s.AddCheck("fetcher", true, AgeCheck(func() time.Time { return lastFetch }, time.Minute))
+	s.AddCheck("blocker", false, func(context.Context) error { return errors.New("unreachable") })
+
+	// assert the scanner is degraded but still responds with a 200
+	status, resp = getHealth(t, s, "/health")
+	if status != http.StatusOK || resp.Status != StatusDegraded {
+		t.Fatal("unexpected response", status, resp)
+	}
+	if resp.Components["fetcher"].Status != StatusOK || !resp.Components["fetcher"].Critical {
+		t.Fatal("unexpected fetcher status", resp.Components["fetcher"])
+	}
+	if resp.Components["blocker"].Status != StatusUnhealthy || resp.Components["blocker"].Error != "unreachable" {
+		t.Fatal("unexpected blocker status", resp.Components["blocker"])
+	}
+
+	// simulate a stale fetcher and assert the scanner is unhealthy
+	lastFetch = time.Now().Add(-time.Hour)
+	status, resp = getHealth(t, s, "/health")
+	if status != http.StatusServiceUnavailable || resp.Status != StatusUnhealthy {
+		t.Fatal("unexpected response", status, resp)
+	}
+	if resp.Components["fetcher"].Status != StatusUnhealthy || !strings.Contains(resp.Components["fetcher"].Error, "exceeds the maximum") {
+		t.Fatal("unexpected fetcher status", resp.Components["fetcher"])
+	}
+}
+
+// testLoopCheck verifies the loop check detects modules that are wedged.
+func testLoopCheck(t *testing.T) {
+	t.Parallel()
+
+	// assert a module that never reported an iteration is unhealthy
+	module := t.Name()
+	check := LoopCheck(module, time.Minute)
+	if err := check(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert a module that is on schedule is healthy
+	metrics.RecordLoopIteration(module, time.Minute)
+	if err := check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert a module that is late beyond the grace period is unhealthy
+	wedged := module + "Wedged"
+	metrics.RecordLoopIteration(wedged, -time.Hour)
+	if err := LoopCheck(wedged, time.Minute)(context.Background()); err == nil || !strings.Contains(err.Error(), "late") {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testMetrics verifies the server serves the metrics of the abuse scanner and
+// shuts down cleanly.
+func testMetrics(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t)
+
+	// scrape the metrics
+	metrics.RecordLoopIteration("Fetcher", time.Minute)
+	resp, err := http.Get(fmt.Sprintf("http://%v/metrics", s.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status code", resp.StatusCode)
+	}
+
+	// assert it contains both scanner and Go metrics
+	for _, family := range []string{
+		"# TYPE abuse_scanner_loop_iterations_total counter",
+		`abuse_scanner_loop_iterations_total{module="Fetcher"}`,
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(string(body), family) {
+			t.Fatal("expected metrics to contain", family, string(body))
+		}
+	}
+
+	// assert the server shuts down cleanly and stops listening
+	stopTestServer(t, s)
+	_, err = http.Get(fmt.Sprintf("http://%v/metrics", s.Address()))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// testPprof verifies the pprof endpoints are only served when enabled.
+func testPprof(t *testing.T) {
+	t.Parallel()
+
+	// getStatus is a helper that returns the status code of a GET request to
+	// the given path
+	getStatus := func(s *Server, path string) int {
+		resp, err := http.Get(fmt.Sprintf("http://%v%v", s.Address(), path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	paths := []string{
+		"/debug/pprof/",
+		"/debug/pprof/goroutine?debug=1",
+		"/debug/pprof/cmdline",
+	}
+
+	// assert the endpoints are absent by default
+	disabled := newTestServer(t)
+	defer stopTestServer(t, disabled)
+	for _, path := range paths {
+		if status := getStatus(disabled, path); status != http.StatusNotFound {
+			t.Fatalf("unexpected status code for %v, %v != %v", path, status, http.StatusNotFound)
+		}
+	}
+
+	// assert the endpoints respond when enabled
+	enabled := newTestServerWithOptions(t, ServerOptions{EnablePprof: true})
+	defer stopTestServer(t, enabled)
+	for _, path := range paths {
+		if status := getStatus(enabled, path); status != http.StatusOK {
+			t.Fatalf("unexpected status code for %v, %v != %v", path, status, http.StatusOK)
+		}
+	}
+}
+
+// testReady verifies the ready endpoint responds with a 503 until the scanner
+// is ready.
+func testReady(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t)
+	defer stopTestServer(t, s)
+
+	status, resp := getHealth(t, s, "/ready")
+	if status != http.StatusServiceUnavailable || resp.Status != StatusStarting {
+		t.Fatal("unexpected response", status, resp)
+	}
+
+	s.SetReady()
+	status, resp = getHealth(t, s, "/ready")
+	if status != http.StatusOK || resp.Status != StatusOK {
+		t.Fatal("unexpected response", status, resp)
+	}
+
+	s.AddCheck("mongo", true, func(context.Context) error { return errors.New("no reachable servers") })
+	status, resp = getHealth(t, s, "/ready")
+	if status != http.StatusServiceUnavailable || resp.Status != StatusUnhealthy {
+		t.Fatal("unexpected response", status, resp)
+	}
+}
+
+// getHealth is a helper function that queries the given health endpoint and
+// returns the status code and the decoded response.
+func getHealth(t *testing.T, s *Server, endpoint string) (int, HealthResponse) {
+	resp, err := http.Get(fmt.Sprintf("http://%v%v", s.Address(), endpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var hr HealthResponse
+	err = json.NewDecoder(resp.Body).Decode(&hr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, hr
+}
+
+// newTestServer is a helper function that starts a server on a random port.
+func newTestServer(t *testing.T) *Server {
+	return newTestServerWithOptions(t, ServerOptions{})
+}
+
+// newTestServerWithOptions is a helper function that starts a server with the
+// given options on a random port.
+func newTestServerWithOptions(t *testing.T, opts ServerOptions) *Server {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	s := NewServer("127.0.0.1:0", metrics.Registry, opts, logger)
+	err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// stopTestServer is a helper function that stops the given server.
+func stopTestServer(t *testing.T, s *Server) {
+	err := s.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"abuse-scanner/accounts"
+	"abuse-scanner/database"
+	"abuse-scanner/email"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// checkTimeout is the maximum amount of time a single connectivity check
+	// is allowed to take
+	checkTimeout = 10 * time.Second
+
+	// the outcomes of a connectivity check
+	checkFail = "FAIL"
+	checkPass = "PASS"
+	checkSkip = "SKIP"
+)
+
+type (
+	// dependencyCheck verifies the scanner can reach one of its dependencies
+	dependencyCheck struct {
+		name string
+		run  func(ctx context.Context) error
+
+		// skip is the reason the check is skipped, the check is run if it's
+		// empty
+		skip string
+	}
+
+	// checkResult is the outcome of a single dependency check
+	checkResult struct {
+		name     string
+		duration time.Duration
+		err      error
+		skip     string
+	}
+)
+
+// status returns the outcome of the check, it's one of checkFail, checkPass or
+// checkSkip.
+func (r checkResult) status() string {
+	switch {
+	case r.skip != "":
+		return checkSkip
+	case r.err != nil:
+		return checkFail
+	default:
+		return checkPass
+	}
+}
+
+// dependencyChecks returns the connectivity checks of all dependencies of the
+// scanner, the checks of the dependencies that are only used by modules that
+// are disabled are skipped.
+func dependencyChecks(cfg Config, logger *logrus.Logger) []dependencyCheck {
+	// skipUnless is a helper that returns the reason a check is skipped if
+	// the dependency is not used
+	skipUnless := func(used bool, reason string) string {
+		if used {
+			return ""
+		}
+		return reason
+	}
+	skipDryRun := func(used bool, reason string) string {
+		if used && cfg.DryRun {
+			return "dry run"
+		}
+		return skipUnless(used, reason)
+	}
+
+	return []dependencyCheck{
+		{
+			name: "mongo",
+			run: func(ctx context.Context) error {
+				abuseDB, err := database.NewAbuseScannerDB(ctx, cfg.ServerDomain, database.DBAbuseScanner, cfg.DBURI, cfg.DBCredentials, cfg.DBOptions(), logger)
+				if err != nil {
+					return errors.AddContext(err, "failed to connect")
+				}
+				return errors.Compose(abuseDB.Probe(ctx), abuseDB.Close())
+			},
+		},
+		{
+			name: "imap",
+			skip: skipUnless(cfg.ModuleFetcher || cfg.ModuleFinalizer, "fetcher and finalizer disabled"),
+			run: func(context.Context) error {
+				return email.CheckMailbox(cfg.EmailCredentials, cfg.AbuseMailbox)
+			},
+		},
+		{
+			name: "smtp",
+			skip: skipDryRun(cfg.ModuleFinalizer, "finalizer disabled"),
+			run: func(context.Context) error {
+				return email.CheckSMTP(cfg.EmailCredentials)
+			},
+		},
+		{
+			name: "blocker_api",
+			skip: skipDryRun(cfg.ModuleBlocker, "blocker disabled"),
+			run: func(ctx context.Context) error {
+				return email.NewBlocker(ctx, cfg.BlockerURL, cfg.ServerDomain, nil, cfg.BlockerOptions(), logger).Health(ctx)
+			},
+		},
+		{
+			name: "accounts_api",
+			skip: skipUnless(cfg.NCMECReportingEnabled, "NCMEC reporting disabled"),
+			run: func(ctx context.Context) error {
+				client, err := accounts.NewAccountsClient(cfg.AccountsHost, cfg.AccountsPort, cfg.AccountsClientOptions())
+				if err != nil {
+					return err
+				}
+				return client.HealthGET(ctx)
+			},
+		},
+		{
+			name: "ncmec_api",
+			skip: skipDryRun(cfg.NCMECReportingEnabled, "NCMEC reporting disabled"),
+			run: func(context.Context) error {
+				return email.NewNCMECClient(cfg.NCMECCredentials, cfg.HTTPClient).Status()
+			},
+		},
+	}
+}
+
+// runChecks runs the given checks concurrently, every check is given the
+// given timeout. It returns the results in the order of the checks.
+func runChecks(ctx context.Context, checks []dependencyCheck, timeout time.Duration) []checkResult {
+	results := make([]checkResult, len(checks))
+	done := make(chan struct{})
+	for i, check := range checks {
+		i, check := i, check
+		go func() {
+			defer func() { done <- struct{}{} }()
+			results[i] = runCheck(ctx, check, timeout)
+		}()
+	}
+	for range checks {
+		<-done
+	}
+	return results
+}
+
+// runCheck runs the given check, it fails if the check takes longer than the
+// given timeout. Not every dependency accepts a context, so a check that times
+// out is abandoned rather than interrupted.
+func runCheck(ctx context.Context, check dependencyCheck, timeout time.Duration) checkResult {
+	result := checkResult{name: check.name, skip: check.skip}
+	if check.skip != "" {
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- check.run(ctx)
+	}()
+	select {
+	case result.err = <-errChan:
+	case <-ctx.Done():
+		result.err = fmt.Errorf("timed out after %v", timeout)
+	}
+	result.duration = time.Since(start)
+	return result
+}
+
+// checkResultsErr returns an error if any of the given checks failed.
+func checkResultsErr(results []checkResult) error {
+	var failed []string
+	for _, result := range results {
+		if result.status() == checkFail {
+			failed = append(failed, result.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%v of %v dependency checks failed: %v", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// printCheckResults writes the given results as a table to the given writer.
+func printCheckResults(w io.Writer, results []checkResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDURATION\tDETAILS")
+	for _, result := range results {
+		var duration, details string
+		switch result.status() {
+		case checkFail:
+			duration = result.duration.Round(time.Millisecond).String()
+			details = result.err.Error()
+		case checkPass:
+			duration = result.duration.Round(time.Millisecond).String()
+		case checkSkip:
+			details = result.skip
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", result.name, result.status(), duration, details)
+	}
+	return tw.Flush()
+}
+
+// checkDependencies runs the connectivity checks of all dependencies of the
+// scanner and writes the outcome to the given writer, it returns an error if
+// any of the checks failed.
+func checkDependencies(ctx context.Context, w io.Writer, cfg Config, logger *logrus.Logger) error {
+	results := runChecks(ctx, dependencyChecks(cfg, logger), checkTimeout)
+	err := printCheckResults(w, results)
+	if err != nil {
+		return errors.AddContext(err, "failed to print the dependency checks")
+	}
+	return checkResultsErr(results)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestRunChecks verifies the check runner reports the outcome of every check
+// in order, and that a check that hangs fails once it timed out.
+func TestRunChecks(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	checks := []dependencyCheck{
+		{name: "pass", run: func(context.Context) error { return nil }},
+		{name: "fail", run: func(context.Context) error { return errors.New("connection refused") }},
+		{name: "hang", run: func(context.Context) error {
+			// ignore the context, like a dependency that doesn't accept one
+			<-release
+			return nil
+		}},
+		{name: "skip", skip: "module disabled", run: func(context.Context) error {
+			t.Error("skipped check should not run")
+			return nil
+		}},
+	}
+	results := runChecks(context.Background(), checks, 100*time.Millisecond)
+
+	expected := []string{checkPass, checkFail, checkFail, checkSkip}
+	if len(results) != len(expected) {
+		t.Fatal("unexpected amount of results", len(results))
+	}
+	for i, result := range results {
+		if result.name != checks[i].name || result.status() != expected[i] {
+			t.Fatalf("unexpected result %v, %v != %v", result.name, result.status(), expected[i])
+		}
+	}
+	if !strings.Contains(results[2].err.Error(), "timed out after 100ms") {
+		t.Fatal("unexpected error", results[2].err)
+	}
+
+	// assert the table contains a row for every check
+	var buf bytes.Buffer
+	err := printCheckResults(&buf, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "CHECK") {
+		t.Fatal("unexpected table", buf.String())
+	}
+	if !strings.Contains(lines[2], "fail") || !strings.Contains(lines[2], "FAIL") || !strings.Contains(lines[2], "connection refused") {
+		t.Fatal("unexpected row", lines[2])
+	}
+	if !strings.Contains(lines[4], "SKIP") || !strings.Contains(lines[4], "module disabled") {
+		t.Fatal("unexpected row", lines[4])
+	}
+
+	// assert the error lists the failed checks
+	err = checkResultsErr(results)
+	if err == nil || !strings.Contains(err.Error(), "2 of 4 dependency checks failed: fail, hang") {
+		t.Fatal("unexpected error", err)
+	}
+	if err := checkResultsErr(results[:1]); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// TestDependencyChecks verifies the checks of dependencies that are only used
+// by disabled modules are skipped, and runs the blocker check against a
+// mocked blocker API.
+func TestDependencyChecks(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// skipped returns the skip reason of every check by name
+	skipped := func(checks []dependencyCheck) map[string]string {
+		skips := make(map[string]string)
+		for _, check := range checks {
+			skips[check.name] = check.skip
+		}
+		return skips
+	}
+
+	// assert only mongo is checked if only the parser is enabled
+	skips := skipped(dependencyChecks(Config{ModuleParser: true}, logger))
+	if len(skips) != 6 || skips["mongo"] != "" {
+		t.Fatal("unexpected checks", skips)
+	}
+	for _, name := range []string{"imap", "smtp", "blocker_api", "accounts_api", "ncmec_api"} {
+		if skips[name] == "" {
+			t.Fatalf("expected %v to be skipped", name)
+		}
+	}
+
+	// assert the dependencies that aren't used in dry-run mode are skipped
+	cfg := Config{
+		DryRun:                true,
+		ModuleBlocker:         true,
+		ModuleFetcher:         true,
+		ModuleFinalizer:       true,
+		ModuleParser:          true,
+		NCMECReportingEnabled: true,
+	}
+	skips = skipped(dependencyChecks(cfg, logger))
+	for name, skip := range skips {
+		dryRun := name == "smtp" || name == "blocker_api" || name == "ncmec_api"
+		if dryRun && skip != "dry run" || !dryRun && skip != "" {
+			t.Fatalf("unexpected skip reason for %v, '%v'", name, skip)
+		}
+	}
+
+	// mock the blocker API
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cfg = Config{
+		BlockerURL:    server.URL,
+		HTTPClient:    server.Client(),
+		ModuleBlocker: true,
+	}
+	var blocker []dependencyCheck
+	for _, check := range dependencyChecks(cfg, logger) {
+		if check.name == "blocker_api" {
+			blocker = append(blocker, check)
+		}
+	}
+	results := runChecks(context.Background(), blocker, time.Second)
+	if len(results) != 1 || results[0].status() != checkPass {
+		t.Fatal("unexpected results", results)
+	}
+
+	// assert an unhealthy blocker API fails the check
+	status = http.StatusServiceUnavailable
+	results = runChecks(context.Background(), blocker, time.Second)
+	if len(results) != 1 || results[0].status() != checkFail {
+		t.Fatal("unexpected results", results)
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"abuse-scanner/accounts"
+	"abuse-scanner/database"
+	"abuse-scanner/email"
+	"abuse-scanner/version"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// commandExport exports the emails as CSV
+	commandExport = "export"
+
+	// commandHealthcheck probes the health of the scanner that runs in the
+	// same container
+	commandHealthcheck = "healthcheck"
+
+	// commandPause pauses the processing of all instances of the scanner
+	commandPause = "pause"
+
+	// commandReparse resets emails so they get parsed again
+	commandReparse = "reparse"
+
+	// commandRequeue resets emails so they get blocked and finalized again
+	commandRequeue = "requeue"
+
+	// commandResume resumes the processing of all instances of the scanner
+	commandResume = "resume"
+
+	// commandRun runs the scanner as a long-running process, this is the
+	// default command
+	commandRun = "run"
+
+	// commandScanOnce runs a single fetch, parse, block, finalize and report
+	// pass
+	commandScanOnce = "scan-once"
+
+	// commandStats prints a time series of one of the database metrics
+	commandStats = "stats"
+
+	// commandVersion prints the version of the scanner
+	commandVersion = "version"
+
+	// defaultStatsBucket is the default bucket size of the stats command
+	defaultStatsBucket = 24 * time.Hour
+
+	// defaultStatsWindow is the default time range covered by the stats and
+	// export commands, it ends at the current time
+	defaultStatsWindow = 7 * 24 * time.Hour
+)
+
+// usage is printed when the scanner is invoked with an unknown command or with
+// the help flag.
+const usage = `Usage: abuse-scanner [-config path] [-check] [-version] [command] [flags]
+
+The config is loaded from the environment, and from the YAML or JSON config
+file passed with -config, or with ABUSE_CONFIG_FILE if -config is not passed.
+The environment overrides the config file.
+
+With -check the scanner verifies it can reach all dependencies of the enabled
+modules, prints the outcome of every check and exits, it exits with a non-zero
+status if any check failed. The same checks run when the scanner is started.
+With -version the scanner prints its version and exits.
+
+Commands:
+  run               run the scanner as a long-running process (default)
+  scan-once [flags] fetch, parse, block, finalize and report once, print a
+                    JSON summary to stdout and exit
+  reparse <uid>...  reset the given emails so they get parsed again
+  requeue <uid>...  reset the given emails so they get blocked and finalized again
+  pause [flags]     pause the processing of all instances of the scanner
+  resume            resume the processing of all instances of the scanner
+  stats [flags]     print a time series of one of the database metrics
+  export [flags]    export the emails as CSV to stdout
+  healthcheck       probe the health of the scanner, exits with a non-zero
+                    status if it's unhealthy or doesn't respond within 5s
+  version           print the version of the scanner
+
+Run 'abuse-scanner <command> -h' to list the flags of a command.
+
+The healthcheck command is meant to be used as the HEALTHCHECK of the image,
+by default it probes the /health endpoint of the scanner's HTTP server, with
+-probe mongo it pings the database instead:
+
+  HEALTHCHECK --interval=30s --timeout=10s CMD ["abuse-scanner", "healthcheck"]
+`
+
+// csvHeader is the header of the CSV that is written by the export command.
+var csvHeader = []string{
+	"uid",
+	"message_id",
+	"mailbox",
+	"from",
+	"subject",
+	"inserted_at",
+	"skip_reason",
+	"parsed",
+	"tags",
+	"skylinks",
+	"blocked",
+	"finalized",
+	"reported",
+	"source",
+}
+
+type (
+	// command is a parsed subcommand of the CLI
+	command struct {
+		name string
+
+		// configPath is the path of the config file, it's optional
+		configPath string
+
+		// check indicates the connectivity to the dependencies is checked
+		// rather than running the scanner
+		check bool
+
+		// uids are the email UIDs passed to the reparse and requeue commands
+		uids []string
+
+		// reason is the reason passed to the pause command
+		reason string
+
+		// maxErrors is the amount of errors every stage of the scan-once
+		// command may record before the scan fails
+		maxErrors uint64
+
+		// probe is the probe of the healthcheck command
+		probe string
+
+		// metric and bucket are the arguments of the stats command, the
+		// time range is used by both the stats and export commands
+		metric string
+		bucket time.Duration
+		from   time.Time
+		to     time.Time
+	}
+
+	// errorCounter is a logrus hook that counts the amount of errors that
+	// get logged per module, modules log their errors rather than returning
+	// them so this is used to decide whether a scan was successful.
+	errorCounter struct {
+		counts map[string]uint64
+		mu     sync.Mutex
+	}
+
+	// scanSummary is the summary of a scan-once pass, it's printed as JSON
+	// so it can be picked up by monitoring. The counts of a module are only
+	// set if the module ran.
+	scanSummary struct {
+		Blocker   *email.BlockStats    `json:"blocker,omitempty"`
+		Fetcher   *email.FetchStats    `json:"fetcher,omitempty"`
+		Finalizer *email.FinalizeStats `json:"finalizer,omitempty"`
+		Parser    *email.ParseStats    `json:"parser,omitempty"`
+		Reporter  *email.ReportStats   `json:"reporter,omitempty"`
+
+		// Errors is the amount of errors that got logged per stage, keyed by
+		// the lowercased name of the module, errors that were not logged by
+		// a module are keyed by 'other'.
+		Errors map[string]uint64 `json:"errors"`
+
+		// DurationSeconds is the duration of the pass in seconds.
+		DurationSeconds float64 `json:"duration_seconds"`
+	}
+)
+
+// Counts returns the amount of errors that were logged per module, see
+// scanSummary.Errors.
+func (c *errorCounter) Counts() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]uint64, len(c.counts))
+	for module, count := range c.counts {
+		counts[module] = count
+	}
+	return counts
+}
+
+// Fire implements the logrus.Hook interface.
+func (c *errorCounter) Fire(entry *logrus.Entry) error {
+	module := "other"
+	if name, ok := entry.Data["module"].(string); ok && name != "" {
+		module = strings.ToLower(name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[module]++
+	return nil
+}
+
+// Levels implements the logrus.Hook interface.
+func (c *errorCounter) Levels() []logrus.Level {
+	return []logrus.Level{logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel}
+}
+
+// parseCommand parses the given arguments, without the program name, into a
+// command. Invoking the scanner without arguments is equal to the run command.
+// Usage information is written to the given output, flag.ErrHelp is returned
+// if the help was requested.
+func parseCommand(args []string, output io.Writer, now time.Time) (command, error) {
+	// parse the global flags, they precede the command
+	var check, showVersion bool
+	var configPath string
+	global := flag.NewFlagSet("abuse-scanner", flag.ContinueOnError)
+	global.SetOutput(output)
+	global.Usage = func() {
+		fmt.Fprint(output, usage)
+	}
+	global.BoolVar(&check, "check", false, "check the connectivity to all dependencies and exit")
+	global.StringVar(&configPath, "config", "", "the path of the YAML or JSON config file, defaults to $"+configFileEnv)
+	global.BoolVar(&showVersion, "version", false, "print the version and exit")
+	err := global.Parse(args)
+	if err != nil {
+		return command{}, err
+	}
+	args = global.Args()
+	if showVersion {
+		return command{name: commandVersion}, nil
+	}
+
+	if len(args) == 0 {
+		return command{name: commandRun, configPath: configPath, check: check}, nil
+	}
+	if check && args[0] != commandRun {
+		return command{}, fmt.Errorf("-check can't be combined with the %v command", args[0])
+	}
+
+	cmd := command{name: args[0], configPath: configPath, check: check}
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	var from, to string
+	switch cmd.name {
+	case commandRun, commandReparse, commandRequeue, commandResume, commandVersion:
+	case commandScanOnce:
+		fs.Uint64Var(&cmd.maxErrors, "max-errors", 0, "the amount of errors every stage may record before the scan fails")
+	case commandHealthcheck:
+		fs.StringVar(&cmd.probe, "probe", probeHTTP, fmt.Sprintf("the probe, either '%v' to request the health endpoint or '%v' to ping the database", probeHTTP, probeMongo))
+	case commandPause:
+		fs.StringVar(&cmd.reason, "reason", "", "the reason the processing is paused, e.g. a link to the incident")
+	case commandStats:
+		fs.StringVar(&cmd.metric, "metric", database.MetricEmails, fmt.Sprintf("the metric, one of '%v', '%v', '%v' or '%v'", database.MetricBlocked, database.MetricEmails, database.MetricNCMECReports, database.MetricSkylinks))
+		fs.DurationVar(&cmd.bucket, "bucket", defaultStatsBucket, "the bucket size, a whole amount of minutes, hours or days")
+		fallthrough
+	case commandExport:
+		fs.StringVar(&from, "from", "", "the start of the time range, as a date or RFC3339 timestamp, defaults to a week before the end")
+		fs.StringVar(&to, "to", "", "the end of the time range, as a date or RFC3339 timestamp, defaults to now")
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(output, usage)
+		return command{}, flag.ErrHelp
+	default:
+		fmt.Fprint(output, usage)
+		return command{}, fmt.Errorf("unknown command '%v'", cmd.name)
+	}
+
+	err = fs.Parse(args[1:])
+	if err != nil {
+		return command{}, err
+	}
+
+	// validate the positional arguments
+	switch cmd.name {
+	case commandReparse, commandRequeue:
+		cmd.uids = fs.Args()
+		if len(cmd.uids) == 0 {
+			return command{}, fmt.Errorf("%v expects at least one email uid", cmd.name)
+		}
+	default:
+		if fs.NArg() > 0 {
+			return command{}, fmt.Errorf("%v does not expect any arguments, found '%v'", cmd.name, strings.Join(fs.Args(), " "))
+		}
+	}
+
+	// validate the time range
+	if cmd.name == commandStats || cmd.name == commandExport {
+		cmd.to = now
+		if to != "" {
+			cmd.to, err = parseTime(to)
+			if err != nil {
+				return command{}, errors.AddContext(err, "invalid value for -to")
+			}
+		}
+		cmd.from = cmd.to.Add(-defaultStatsWindow)
+		if from != "" {
+			cmd.from, err = parseTime(from)
+			if err != nil {
+				return command{}, errors.AddContext(err, "invalid value for -from")
+			}
+		}
+		if !cmd.from.Before(cmd.to) {
+			return command{}, fmt.Errorf("the start of the time range %v is not before its end %v", cmd.from, cmd.to)
+		}
+	}
+	if cmd.name == commandHealthcheck && cmd.probe != probeHTTP && cmd.probe != probeMongo {
+		return command{}, fmt.Errorf("invalid probe '%v', expected one of '%v' or '%v'", cmd.probe, probeHTTP, probeMongo)
+	}
+	if cmd.name == commandStats && cmd.bucket <= 0 {
+		return command{}, fmt.Errorf("the bucket size has to be positive, found %v", cmd.bucket)
+	}
+	return cmd, nil
+}
+
+// printVersion writes the version of the scanner to the given writer.
+func printVersion(w io.Writer) error {
+	_, err := fmt.Fprintln(w, version.Current())
+	return err
+}
+
+// parseTime is a helper function that parses the given value as either a date
+// or an RFC3339 timestamp, dates are interpreted as UTC.
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%v' is neither a date nor an RFC3339 timestamp", value)
+	}
+	return t.UTC(), nil
+}
+
+// scanOnce runs a single fetch, parse, block, finalize and report pass and
+// writes its summary as JSON to the given writer. It returns an error if any
+// stage logged more than the given amount of errors during the pass. Modules
+// that are disabled are skipped, as is the reporter if NCMEC reporting is
+// disabled.
+func scanOnce(ctx context.Context, w io.Writer, cfg Config, maxErrors uint64, logger *logrus.Logger) (err error) {
+	abuseDB, err := database.NewAbuseScannerDB(ctx, cfg.ServerDomain, database.DBAbuseScanner, cfg.DBURI, cfg.DBCredentials, cfg.DBOptions(), logger)
+	if err != nil {
+		return errors.AddContext(err, "failed to initialize database client")
+	}
+	defer func() {
+		err = errors.Compose(err, abuseDB.Close())
+	}()
+
+	summary, err := scanPass(ctx, abuseDB, cfg, logger)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(summary)
+	if err != nil {
+		return errors.AddContext(err, "failed to write the summary")
+	}
+	return summary.checkErrors(maxErrors)
+}
+
+// scanPass runs every enabled module once, in the order in which the emails
+// flow through them, and returns the summary of the pass.
+func scanPass(ctx context.Context, abuseDB *database.AbuseScannerDB, cfg Config, logger *logrus.Logger) (scanSummary, error) {
+	counter := new(errorCounter)
+	logger.AddHook(counter)
+	start := time.Now()
+
+	var summary scanSummary
+	if cfg.ModuleFetcher {
+		stats := email.NewFetcher(ctx, abuseDB, cfg.EmailCredentials, cfg.AbuseMailbox, cfg.ServerDomain, cfg.FetcherOptions(), newModuleLogger(logger, cfg, moduleFetcher)).RunOnce()
+		summary.Fetcher = &stats
+	}
+	if cfg.ModuleParser {
+		stats := email.NewParser(ctx, abuseDB, cfg.ServerDomain, cfg.AbuseSponsor, cfg.ParserOptions(), newModuleLogger(logger, cfg, moduleParser)).RunOnce()
+		summary.Parser = &stats
+	}
+	if cfg.ModuleBlocker {
+		stats := email.NewBlocker(ctx, cfg.BlockerURL, cfg.ServerDomain, abuseDB, cfg.BlockerOptions(), newModuleLogger(logger, cfg, moduleBlocker)).RunOnce()
+		summary.Blocker = &stats
+	}
+	if cfg.ModuleFinalizer {
+		stats := email.NewFinalizer(ctx, abuseDB, cfg.EmailCredentials, cfg.AbuseMailaddress, cfg.AbuseMailbox, cfg.ServerDomain, cfg.FinalizerOptions(), newModuleLogger(logger, cfg, moduleFinalizer)).RunOnce()
+		summary.Finalizer = &stats
+	}
+	if cfg.NCMECReportingEnabled {
+		accountsClient, err := accounts.NewAccountsClient(cfg.AccountsHost, cfg.AccountsPort, cfg.AccountsClientOptions())
+		if err != nil {
+			return scanSummary{}, errors.AddContext(err, fmt.Sprintf("failed to create the accounts client for host '%s' and port '%s'", cfg.AccountsHost, cfg.AccountsPort))
+		}
+		stats := email.NewReporter(abuseDB, accountsClient, cfg.NCMECCredentials, cfg.PortalURLs, cfg.ServerDomain, cfg.NCMECReporter, cfg.ReporterOptions(), newModuleLogger(logger, cfg, moduleReporter)).RunOnce()
+		summary.Reporter = &stats
+	}
+
+	summary.Errors = counter.Counts()
+	summary.DurationSeconds = time.Since(start).Seconds()
+	return summary, nil
+}
+
+// checkErrors returns an error that lists the stages that recorded more than
+// the given amount of errors, if any.
+func (s scanSummary) checkErrors(maxErrors uint64) error {
+	var exceeded []string
+	for stage, count := range s.Errors {
+		if count > maxErrors {
+			exceeded = append(exceeded, fmt.Sprintf("%v recorded %v error(s)", stage, count))
+		}
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+	sort.Strings(exceeded)
+	return fmt.Errorf("scan exceeded %v error(s) per stage, %v", maxErrors, strings.Join(exceeded, ", "))
+}
+
+// resetEmails resets every email with given uid using the given reset
+// function, it continues with the other emails if resetting one fails.
+func resetEmails(uids []string, reset func(uid string) error, logger *logrus.Logger) error {
+	var errs []error
+	for _, uid := range uids {
+		err := reset(uid)
+		if err != nil {
+			errs = append(errs, errors.AddContext(err, fmt.Sprintf("failed to reset email %v", uid)))
+			continue
+		}
+		logger.Infof("Reset email %v", uid)
+	}
+	return errors.Compose(errs...)
+}
+
+// setPaused pauses or resumes the processing of all instances of the scanner,
+// the instances pick up the change within the interval at which they poll the
+// pause switch.
+func setPaused(abuseDB *database.AbuseScannerDB, paused bool, reason string, logger *logrus.Logger) error {
+	err := abuseDB.SetPaused(paused, reason)
+	if err != nil {
+		return err
+	}
+	if paused {
+		logger.Infof("Paused the processing, the scanner pauses within %v", database.DefaultPauseSwitchInterval)
+		return nil
+	}
+	logger.Infof("Resumed the processing, the scanner resumes within %v", database.DefaultPauseSwitchInterval)
+	return nil
+}
+
+// printStats writes the time series of the metric in the given command as a
+// table to the given writer, followed by the amount of emails that were skipped
+// since the start of the time range per skip reason, if any.
+func printStats(w io.Writer, abuseDB *database.AbuseScannerDB, cmd command) error {
+	buckets, err := abuseDB.TimeSeries(cmd.metric, cmd.bucket, cmd.from, cmd.to)
+	if err != nil {
+		return err
+	}
+	skips, err := abuseDB.CountSkipsByReason(time.Since(cmd.from))
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tVALUE\tTAGS")
+	for _, bucket := range buckets {
+		tags := make([]string, 0, len(bucket.Tags))
+		for tag, value := range bucket.Tags {
+			tags = append(tags, fmt.Sprintf("%v=%v", tag, value))
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", bucket.Time.Format(time.RFC3339), bucket.Value, strings.Join(tags, ","))
+	}
+	if len(skips) == 0 {
+		return tw.Flush()
+	}
+
+	reasons := make([]string, 0, len(skips))
+	for reason := range skips {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "SKIP REASON\tSKIPPED")
+	for _, reason := range reasons {
+		fmt.Fprintf(tw, "%v\t%v\n", reason, skips[reason])
+	}
+	return tw.Flush()
+}
+
+// exportEmails writes every email that was inserted within the time range of
+// the given command as CSV to the given writer. The emails are streamed from
+// the database, they are never all held in memory.
+func exportEmails(ctx context.Context, w io.Writer, abuseDB *database.AbuseScannerDB, cmd command) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+
+	err = abuseDB.ForEachEmail(ctx, cmd.from, cmd.to, func(e database.AbuseEmail) error {
+		return cw.Write([]string{
+			e.UID,
+			e.MessageID,
+			e.Mailbox,
+			e.From,
+			e.Subject,
+			e.InsertedAt.UTC().Format(time.RFC3339),
+			e.SkipReason,
+			strconv.FormatBool(e.Parsed),
+			strings.Join(e.ParseResult.Tags, " "),
+			strings.Join(e.ParseResult.Skylinks, " "),
+			strconv.FormatBool(e.Blocked),
+			strconv.FormatBool(e.Finalized),
+			strconv.FormatBool(e.Reported),
+			e.Source,
+		})
+	})
+	if err != nil {
+		return errors.AddContext(err, "failed to export emails")
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"abuse-scanner/database"
+	"abuse-scanner/email"
+	"abuse-scanner/version"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestParseCommand is a table-driven unit test that covers the parseCommand
+// helper.
+func TestParseCommand(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, time.March, 15, 12, 0, 0, 0, time.UTC)
+	weekAgo := now.Add(-defaultStatsWindow)
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected command
+		err      string
+	}{
+		{
+			name:     "NoArgs",
+			args:     nil,
+			expected: command{name: commandRun},
+		},
+		{
+			name:     "Run",
+			args:     []string{"run"},
+			expected: command{name: commandRun},
+		},
+		{
+			name:     "ConfigFile",
+			args:     []string{"--config", "/etc/abuse-scanner/config.yaml"},
+			expected: command{name: commandRun, configPath: "/etc/abuse-scanner/config.yaml"},
+		},
+		{
+			name:     "Check",
+			args:     []string{"--check", "-config", "config.yaml"},
+			expected: command{name: commandRun, configPath: "config.yaml", check: true},
+		},
+		{
+			name:     "CheckRun",
+			args:     []string{"-check", "run"},
+			expected: command{name: commandRun, check: true},
+		},
+		{
+			name: "CheckCommand",
+			args: []string{"-check", "stats"},
+			err:  "-check can't be combined with the stats command",
+		},
+		{
+			name:     "ConfigFileCommand",
+			args:     []string{"-config=config.json", "requeue", "INBOX-1-1"},
+			expected: command{name: commandRequeue, configPath: "config.json", uids: []string{"INBOX-1-1"}},
+		},
+		{
+			name:     "ScanOnce",
+			args:     []string{"scan-once"},
+			expected: command{name: commandScanOnce},
+		},
+		{
+			name:     "ScanOnceMaxErrors",
+			args:     []string{"scan-once", "-max-errors", "3"},
+			expected: command{name: commandScanOnce, maxErrors: 3},
+		},
+		{
+			name:     "Reparse",
+			args:     []string{"reparse", "INBOX-1-1", "INBOX-1-2"},
+			expected: command{name: commandReparse, uids: []string{"INBOX-1-1", "INBOX-1-2"}},
+		},
+		{
+			name:     "Requeue",
+			args:     []string{"requeue", "INBOX-1-1"},
+			expected: command{name: commandRequeue, uids: []string{"INBOX-1-1"}},
+		},
+		{
+			name:     "Pause",
+			args:     []string{"pause", "-reason", "false positives"},
+			expected: command{name: commandPause, reason: "false positives"},
+		},
+		{
+			name:     "Resume",
+			args:     []string{"resume"},
+			expected: command{name: commandResume},
+		},
+		{
+			name: "ResumeArgs",
+			args: []string{"resume", "now"},
+			err:  "resume does not expect any arguments, found 'now'",
+		},
+		{
+			name:     "StatsDefaults",
+			args:     []string{"stats"},
+			expected: command{name: commandStats, metric: database.MetricEmails, bucket: defaultStatsBucket, from: weekAgo, to: now},
+		},
+		{
+			name: "Stats",
+			args: []string{"stats", "-metric", "skylinks", "-bucket", "1h", "-from", "2022-03-01", "-to", "2022-03-02T06:00:00+02:00"},
+			expected: command{
+				name:   commandStats,
+				metric: database.MetricSkylinks,
+				bucket: time.Hour,
+				from:   time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC),
+				to:     time.Date(2022, time.March, 2, 4, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:     "ExportDefaults",
+			args:     []string{"export"},
+			expected: command{name: commandExport, from: weekAgo, to: now},
+		},
+		{
+			name:     "ExportFrom",
+			args:     []string{"export", "-from", "2022-03-01"},
+			expected: command{name: commandExport, from: time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC), to: now},
+		},
+		{
+			name:     "Healthcheck",
+			args:     []string{"healthcheck"},
+			expected: command{name: commandHealthcheck, probe: probeHTTP},
+		},
+		{
+			name:     "HealthcheckMongo",
+			args:     []string{"healthcheck", "-probe", "mongo"},
+			expected: command{name: commandHealthcheck, probe: probeMongo},
+		},
+		{
+			name:     "Version",
+			args:     []string{"version"},
+			expected: command{name: commandVersion},
+		},
+		{
+			name:     "VersionFlag",
+			args:     []string{"-config", "config.yaml", "-version"},
+			expected: command{name: commandVersion},
+		},
+		{
+			name: "UnknownCommand",
+			args: []string{"scan"},
+			err:  "unknown command 'scan'",
+		},
+		{
+			name: "UnknownFlag",
+			args: []string{"export", "-metric", "emails"},
+			err:  "flag provided but not defined: -metric",
+		},
+		{
+			name: "ConfigFileAfterCommand",
+			args: []string{"run", "-config", "config.yaml"},
+			err:  "flag provided but not defined: -config",
+		},
+		{
+			name: "MissingUIDs",
+			args: []string{"reparse"},
+			err:  "reparse expects at least one email uid",
+		},
+		{
+			name: "UnexpectedArgs",
+			args: []string{"scan-once", "INBOX-1-1"},
+			err:  "scan-once does not expect any arguments, found 'INBOX-1-1'",
+		},
+		{
+			name: "InvalidTime",
+			args: []string{"export", "-from", "yesterday"},
+			err:  "invalid value for -from",
+		},
+		{
+			name: "InvalidTimeRange",
+			args: []string{"stats", "-from", "2022-03-02", "-to", "2022-03-01"},
+			err:  "is not before its end",
+		},
+		{
+			name: "InvalidProbe",
+			args: []string{"healthcheck", "-probe", "tcp"},
+			err:  "invalid probe 'tcp'",
+		},
+		{
+			name: "InvalidBucket",
+			args: []string{"stats", "-bucket", "0s"},
+			err:  "the bucket size has to be positive",
+		},
+	}
+	for _, test := range tests {
+		cmd, err := parseCommand(test.args, ioutil.Discard, now)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("%v: expected error containing '%v', got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+		if !reflect.DeepEqual(cmd, test.expected) {
+			t.Fatalf("%v: unexpected command, %+v != %+v", test.name, cmd, test.expected)
+		}
+	}
+
+	// assert the help prints the usage
+	var buf bytes.Buffer
+	_, err := parseCommand([]string{"help"}, &buf, now)
+	if err != flag.ErrHelp {
+		t.Fatal("expected ErrHelp", err)
+	}
+	if !strings.Contains(buf.String(), "scan-once") {
+		t.Fatal("expected usage to be printed", buf.String())
+	}
+}
+
+// TestPrintVersion verifies the output of the version command.
+func TestPrintVersion(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := printVersion(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("abuse-scanner %v (commit %v, built %v)\n", version.Version, version.Commit, version.BuildDate)
+	if buf.String() != expected {
+		t.Fatalf("unexpected output, %q != %q", buf.String(), expected)
+	}
+}
+
+// TestStatsAndExport verifies the output of the stats and export commands
+// against the test database.
+func TestStatsAndExport(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// insert two emails on consecutive days, and one outside of the range
+	day := func(d int) time.Time {
+		return time.Date(2022, time.March, d, 12, 0, 0, 0, time.UTC)
+	}
+	for i, insertedAt := range []time.Time{day(1), day(2), day(10)} {
+		err = db.InsertOne(database.AbuseEmail{
+			ID:         primitive.NewObjectID(),
+			UID:        fmt.Sprintf("INBOX-1-%d", i+1),
+			From:       "someone@gmail.com",
+			Subject:    "Abuse, \"quoted\"",
+			Parsed:     true,
+			Source:     database.EmailSourceIMAP,
+			InsertedAt: insertedAt,
+			ParseResult: database.AbuseReport{
+				Skylinks: []string{"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"},
+				Tags:     []string{"phishing"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd, err := parseCommand([]string{"stats", "-from", "2022-03-01", "-to", "2022-03-03"}, ioutil.Discard, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the stats contain a bucket per day, and no skip reasons
+	var buf bytes.Buffer
+	err = printStats(&buf, db, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatal("unexpected stats", buf.String())
+	}
+
+	// insert a skipped email, outside of the range of the time series
+	err = db.InsertOne(database.AbuseEmail{
+		ID:         primitive.NewObjectID(),
+		UID:        "INBOX-1-4",
+		Skip:       true,
+		SkipReason: database.SkipReasonNoBody,
+		InsertedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the skip reasons follow the time series
+	buf.Reset()
+	err = printStats(&buf, db, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 6 || lines[4] != "SKIP REASON  SKIPPED" || lines[5] != database.SkipReasonNoBody+"      1" {
+		t.Fatal("unexpected stats", buf.String())
+	}
+	for i, prefix := range []string{"TIME", "2022-03-01T00:00:00Z  1", "2022-03-02T00:00:00Z  1"} {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Fatalf("unexpected line %v, expected prefix '%v' in '%v'", i, prefix, lines[i])
+		}
+	}
+
+	// assert the export contains the header and the emails within range
+	buf.Reset()
+	cmd.name = commandExport
+	err = exportEmails(ctx, &buf, db, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatal("unexpected amount of records", records)
+	}
+	if !reflect.DeepEqual(records[0], csvHeader) {
+		t.Fatal("unexpected header", records[0])
+	}
+	if records[1][0] != "INBOX-1-1" || records[2][0] != "INBOX-1-2" {
+		t.Fatal("unexpected records", records)
+	}
+	if records[1][4] != "Abuse, \"quoted\"" || records[1][5] != "2022-03-01T12:00:00Z" || records[1][8] != "phishing" || records[1][13] != database.EmailSourceIMAP {
+		t.Fatal("unexpected record", records[1])
+	}
+}
+
+// TestScanSummary verifies the errors of a scan are counted per stage, and
+// that the scan fails once a stage exceeds the error threshold.
+func TestScanSummary(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	counter := new(errorCounter)
+	logger.AddHook(counter)
+
+	// log errors from two modules and from outside of the modules
+	logger.WithField("module", email.ModuleFetcher).Error("fetch failed")
+	logger.WithField("module", email.ModuleParser).Error("parse failed")
+	logger.WithField("module", email.ModuleParser).Error("parse failed")
+	logger.WithField("module", email.ModuleParser).Warn("parse slow")
+	logger.Error("database unavailable")
+
+	summary := scanSummary{Errors: counter.Counts()}
+	expected := map[string]uint64{"fetcher": 1, "parser": 2, "other": 1}
+	if !reflect.DeepEqual(summary.Errors, expected) {
+		t.Fatal("unexpected errors", summary.Errors)
+	}
+
+	// assert the threshold applies per stage
+	err := summary.checkErrors(0)
+	if err == nil || err.Error() != "scan exceeded 0 error(s) per stage, fetcher recorded 1 error(s), other recorded 1 error(s), parser recorded 2 error(s)" {
+		t.Fatal("unexpected error", err)
+	}
+	err = summary.checkErrors(1)
+	if err == nil || err.Error() != "scan exceeded 1 error(s) per stage, parser recorded 2 error(s)" {
+		t.Fatal("unexpected error", err)
+	}
+	if err := summary.checkErrors(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := (scanSummary{}).checkErrors(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestScanPass runs a single scan pass over seeded emails and verifies the
+// summary of the pass.
+func TestScanPass(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// seed two unparsed emails that both contain a skylink
+	body := "Content-Type: text/plain\r\n\r\nPlease take down this phishing page https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g\r\n"
+	for i := 0; i < 2; i++ {
+		err = db.InsertOne(database.AbuseEmail{
+			ID:         primitive.NewObjectID(),
+			UID:        fmt.Sprintf("INBOX-1-%d", i+1),
+			UIDRaw:     uint32(i + 1),
+			Body:       []byte(body),
+			From:       "someone@gmail.com",
+			Subject:    "Abuse Subject",
+			MessageID:  fmt.Sprintf("<msg_uid_%d>@gmail.com", i+1),
+			Source:     database.EmailSourceIMAP,
+			InsertedBy: "dev.siasky.net",
+			InsertedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// run the parser and the blocker, in dry-run mode the blocker API is
+	// never called
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	cfg := Config{
+		DryRun:        true,
+		ModuleBlocker: true,
+		ModuleParser:  true,
+		ServerDomain:  "dev.siasky.net",
+	}
+	summary, err := scanPass(ctx, db, cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the summary
+	if summary.Fetcher != nil || summary.Finalizer != nil || summary.Reporter != nil {
+		t.Fatal("expected the disabled modules to be skipped", summary)
+	}
+	if summary.Parser == nil || summary.Parser.Parsed != 2 {
+		t.Fatal("unexpected parser stats", summary.Parser)
+	}
+	if summary.Blocker == nil || summary.Blocker.Blocked != 2 || summary.Blocker.Statuses[database.AbuseStatusDryRun] != 2 {
+		t.Fatal("unexpected blocker stats", summary.Blocker)
+	}
+	if len(summary.Errors) != 0 {
+		t.Fatal("unexpected errors", summary.Errors)
+	}
+	if err := summary.checkErrors(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the summary is written as JSON
+	b, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"parser":{"parsed":2}`) || !strings.Contains(string(b), `"statuses":{"DRY RUN":2}`) || strings.Contains(string(b), `"fetcher"`) {
+		t.Fatal("unexpected summary", string(b))
+	}
+
+	// assert a second pass finds nothing left to do
+	summary, err = scanPass(ctx, db, cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Parser.Parsed != 0 || summary.Blocker.Blocked != 0 {
+		t.Fatal("unexpected summary", summary)
+	}
+}
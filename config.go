@@ -0,0 +1,1070 @@
+package main
+
+import (
+	"abuse-scanner/accounts"
+	"abuse-scanner/api"
+	"abuse-scanner/database"
+	"abuse-scanner/email"
+	"abuse-scanner/notifier"
+	"abuse-scanner/utils"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// configFileEnv is the env variable that holds the path of the config
+	// file, it's used if no path is passed using the -config flag.
+	configFileEnv = "ABUSE_CONFIG_FILE"
+
+	// minAdminTokenLength is the minimum length of the token that
+	// authenticates the requests to the admin API
+	minAdminTokenLength = 16
+
+	// logFormatJSON logs every entry as a JSON object, with the fields of the
+	// entry as keys
+	logFormatJSON = "json"
+
+	// logFormatText logs every entry as a line of text, this is the default
+	logFormatText = "text"
+
+	// maskedSuffixLength is the number of trailing characters of a masked
+	// value that are shown in the config summary, e.g. of a username
+	maskedSuffixLength = 4
+
+	// redacted is the value that replaces secrets in the config summary
+	redacted = "<redacted>"
+)
+
+type (
+	// Config contains the configuration of the abuse scanner, it is loaded
+	// from the environment and validated on startup.
+	Config struct {
+		AdminToken      string
+		DebugPprof      bool
+		DryRun          bool
+		ListenAddress   string
+		LogFormat       string
+		LogLevel        logrus.Level
+		SentryDSN       string
+		ServerDomain    string
+		ShutdownTimeout time.Duration
+
+		// LogFile is the path of the file the logs are written to alongside
+		// stderr, the file is rotated once it exceeds LogFileMaxSize
+		LogFile           string
+		LogFileMaxAge     time.Duration
+		LogFileMaxBackups int
+		LogFileMaxSize    int
+
+		// ModuleLogLevels override the log level of the modules, keyed by
+		// the name of the module, e.g. moduleParser
+		ModuleLogLevels map[string]logrus.Level
+
+		// HTTPClient is shared by all components that make outbound
+		// requests, so the connection limits of its transport apply to all
+		// of them together
+		HTTPClient *http.Client
+
+		// Notifier notifies the on-call of high-severity events, it's shared
+		// by all modules
+		Notifier *notifier.Notifier
+
+		// modules, the reporter is enabled through NCMECReportingEnabled
+		ModuleBlocker   bool
+		ModuleFetcher   bool
+		ModuleFinalizer bool
+		ModuleParser    bool
+
+		// health
+		HealthLoopGracePeriod time.Duration
+		HealthMaxFetchAge     time.Duration
+
+		// IngestAlertWindow is the window within which the fetcher has to
+		// ingest a new email, the watchdog alerts otherwise. It's disabled
+		// if it's zero.
+		IngestAlertWindow time.Duration
+
+		// database
+		DBCredentials      options.Credential
+		DBMaxUpdateRetries int
+		DBTagPriorities    map[string]int
+		DBURI              string
+
+		// LeaderLeaseTTL is the TTL of the leases that ensure the jobs that
+		// have to run exactly once across all instances run on a single one
+		LeaderLeaseTTL time.Duration
+
+		// email
+		AbuseMailaddress string
+		AbuseMailbox     string
+		AbuseSponsor     string
+		EmailCredentials email.Credentials
+
+		// fetcher
+		AllowedRecipients []string
+		DedupeByMessageID bool
+
+		// parser
+		AuthMode              string
+		AuthServID            string
+		ConflictPatterns      []*regexp.Regexp
+		ConflictTags          []string
+		EvidenceHosts         []string
+		ExtractionMode        string
+		FallbackReporterEmail string
+		IDNMode               string
+		KnownPortals          []string
+		LinkUnwrapRules       map[string]string
+		MailboxTags           map[string]string
+		ParseTimeout          time.Duration
+		ReporterOrgs          map[string]string
+		ShortenerHosts        []string
+
+		// SkyTransferResolutionMaxAge is the maximum age of a stored
+		// SkyTransfer resolution for it to be reused
+		SkyTransferResolutionMaxAge time.Duration
+
+		// redaction, the redactor is shared by the parser and the finalizer
+		Redactor *email.Redactor
+
+		// blocker
+		BlockerAdditionalURLs    []string
+		BlockerBacklogSLA        time.Duration
+		BlockerBreakerCooldown   time.Duration
+		BlockerBreakerThreshold  int
+		BlockerIncludeExcerpt    bool
+		BlockerInflightHandling  string
+		BlockerInflightKey       string
+		BlockerMergeTags         bool
+		BlockerRecentBlockWindow time.Duration
+		BlockerRetryPolicy       utils.RetryPolicy
+		BlockerURL               string
+
+		// finalizer
+		HoldLowConfidence     bool
+		MarkFlag              string
+		MarkMailbox           string
+		MarkMode              string
+		NCMECNotifyReporters  []string
+		ReplyDigestWindow     time.Duration
+		ReplyGroupSkyTransfer bool
+		ReplyLocales          map[string]string
+		ReplyTemplates        map[string]database.ResponseTemplates
+
+		// reporter
+		AccountsAPIKey           string
+		AccountsBreakerCooldown  time.Duration
+		AccountsBreakerThreshold int
+		AccountsCacheTTL         time.Duration
+		AccountsHost             string
+		AccountsPort             string
+		AccountsRequireHealthy   bool
+		AccountsStrictDecoding   bool
+		AccountsTimeout          time.Duration
+		NCMECCredentials         email.NCMECCredentials
+		NCMECMaxReportSize       int
+		NCMECReporter            email.NCMECReporter
+		NCMECResponseActions     map[uint64]string
+		NCMECReportingEnabled    bool
+		NCMECScreenshotDir       string
+		NCMECSkylinkVersions     []string
+		PortalURLs               []string
+
+		// variables contains the raw value of every env variable that was
+		// loaded, it is used to print the config summary
+		variables []configVariable
+	}
+
+	// configVariable is a single env variable that was loaded, the location
+	// is only set if it was loaded from the config file. The value of a secret
+	// is redacted in the summary, only the last characters of the value of a
+	// masked variable are shown.
+	configVariable struct {
+		name     string
+		value    string
+		location string
+		masked   bool
+		secret   bool
+	}
+
+	// configLoader is a helper that loads env variables and collects every
+	// problem it encounters, this allows reporting all of them at once.
+	// Variables that are not set in the environment are loaded from the
+	// config file, if any.
+	configLoader struct {
+		errs      []error
+		file      map[string]configFileValue
+		known     map[string]struct{}
+		variables []configVariable
+	}
+)
+
+// loadConfig loads the config from the environment and the config file at the
+// given path, the path is optional. The env variables override the values in
+// the config file. It returns every problem with the configuration rather than
+// only the first one.
+func loadConfig(path string) (Config, []error) {
+	l, err := newConfigLoader(path)
+	if err != nil {
+		return Config{}, []error{err}
+	}
+
+	var cfg Config
+	cfg.ServerDomain = l.required("SERVER_DOMAIN")
+	cfg.LogLevel = logrus.InfoLevel
+	if logLevelStr := l.optional("ABUSE_LOG_LEVEL"); logLevelStr != "" {
+		logLevel, moduleLogLevels, err := parseLogLevels(logLevelStr)
+		if err != nil {
+			l.errorf("invalid value for env variable ABUSE_LOG_LEVEL '%s', err %v", logLevelStr, err)
+		}
+		cfg.LogLevel = logLevel
+		cfg.ModuleLogLevels = moduleLogLevels
+	}
+	cfg.LogFormat = logFormatText
+	if logFormat := l.optional("ABUSE_LOG_FORMAT"); logFormat != "" {
+		switch logFormat {
+		case logFormatJSON, logFormatText:
+			cfg.LogFormat = logFormat
+		default:
+			l.errorf("invalid value for env variable ABUSE_LOG_FORMAT '%s', expected one of '%s' or '%s'", logFormat, logFormatJSON, logFormatText)
+		}
+	}
+
+	// log file, logs are only written to stderr if no file is set
+	cfg.LogFile = l.optional("ABUSE_LOG_FILE")
+	cfg.LogFileMaxAge = l.positiveDuration("ABUSE_LOG_FILE_MAX_AGE")
+	cfg.LogFileMaxBackups = l.positiveInt("ABUSE_LOG_FILE_MAX_BACKUPS")
+	cfg.LogFileMaxSize = l.positiveInt("ABUSE_LOG_FILE_MAX_SIZE")
+
+	// error reporting, Sentry is disabled if no DSN is set
+	cfg.SentryDSN = l.secret("ABUSE_SENTRY_DSN", false)
+	if cfg.SentryDSN != "" {
+		// the error is not logged as it might contain the DSN
+		if _, err := sentry.NewDsn(cfg.SentryDSN); err != nil {
+			l.errorf("failed parsing the value for env variable ABUSE_SENTRY_DSN as a Sentry DSN, expected format 'https://<key>@<host>/<project>'")
+		}
+	}
+
+	// shutdown
+	cfg.ShutdownTimeout = l.positiveDuration("ABUSE_SHUTDOWN_TIMEOUT")
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	// server
+	cfg.ListenAddress = l.listenAddress()
+	cfg.AdminToken = l.secret("ABUSE_ADMIN_TOKEN", false)
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < minAdminTokenLength {
+		l.errorf("invalid value for env variable ABUSE_ADMIN_TOKEN, it has to be at least %v characters", minAdminTokenLength)
+	}
+	cfg.DebugPprof = l.bool("ABUSE_DEBUG_PPROF")
+	cfg.DryRun = l.bool("ABUSE_DRY_RUN")
+
+	// modules, the variables that are only used by modules that are disabled
+	// are not required
+	cfg.ModuleBlocker = l.defaultBool("ABUSE_MODULE_BLOCKER", true)
+	cfg.ModuleFetcher = l.defaultBool("ABUSE_MODULE_FETCHER", true)
+	cfg.ModuleFinalizer = l.defaultBool("ABUSE_MODULE_FINALIZER", true)
+	cfg.ModuleParser = l.defaultBool("ABUSE_MODULE_PARSER", true)
+	emailRequired := cfg.ModuleFetcher || cfg.ModuleFinalizer
+
+	cfg.HealthLoopGracePeriod = l.positiveDuration("ABUSE_HEALTH_LOOP_GRACE_PERIOD")
+	if cfg.HealthLoopGracePeriod == 0 {
+		cfg.HealthLoopGracePeriod = api.DefaultLoopGracePeriod
+	}
+	cfg.HealthMaxFetchAge = l.positiveDuration("ABUSE_HEALTH_MAX_FETCH_AGE")
+	if cfg.HealthMaxFetchAge == 0 {
+		cfg.HealthMaxFetchAge = api.DefaultMaxFetchAge
+	}
+	cfg.IngestAlertWindow = l.positiveDuration("ABUSE_INGEST_ALERT_WINDOW")
+
+	// outbound HTTP requests
+	cfg.HTTPClient = utils.NewHTTPClient(utils.HTTPClientOptions{
+		DialTimeout:           l.positiveDuration("ABUSE_HTTP_DIAL_TIMEOUT"),
+		IdleConnTimeout:       l.positiveDuration("ABUSE_HTTP_IDLE_CONN_TIMEOUT"),
+		MaxConnsPerHost:       l.positiveInt("ABUSE_HTTP_MAX_CONNS_PER_HOST"),
+		MaxIdleConns:          l.positiveInt("ABUSE_HTTP_MAX_IDLE_CONNS"),
+		MaxIdleConnsPerHost:   l.positiveInt("ABUSE_HTTP_MAX_IDLE_CONNS_PER_HOST"),
+		ResponseHeaderTimeout: l.positiveDuration("ABUSE_HTTP_RESPONSE_HEADER_TIMEOUT"),
+	})
+
+	// notifications, they're disabled if no webhook URL is set
+	notifyURL := l.secret("ABUSE_NOTIFY_WEBHOOK_URL", false)
+	if notifyURL != "" {
+		// the error is not logged as the URL contains the webhook's token
+		if u, err := url.Parse(notifyURL); err != nil || u.Scheme != "https" || u.Hostname() == "" {
+			l.errorf("failed parsing the value for env variable ABUSE_NOTIFY_WEBHOOK_URL as a webhook URL, expected format 'https://<host>/<path>'")
+		}
+	}
+	notifyFormat := l.optional("ABUSE_NOTIFY_FORMAT")
+	switch notifyFormat {
+	case "", notifier.FormatSlack, notifier.FormatDiscord:
+	default:
+		l.errorf("invalid value for env variable ABUSE_NOTIFY_FORMAT '%s', expected one of '%s' or '%s'", notifyFormat, notifier.FormatSlack, notifier.FormatDiscord)
+	}
+	cfg.Notifier = notifier.NewNotifier(notifyURL, notifier.NotifierOptions{
+		Format:       notifyFormat,
+		HTTPClient:   cfg.HTTPClient,
+		MinInterval:  l.positiveDuration("ABUSE_NOTIFY_MIN_INTERVAL"),
+		ServerDomain: cfg.ServerDomain,
+	})
+
+	// database
+	cfg.DBCredentials, cfg.DBURI = l.dbConnection()
+	cfg.DBMaxUpdateRetries = l.positiveInt("ABUSE_DB_MAX_UPDATE_RETRIES")
+	tagPrioritiesStr := l.optional("ABUSE_TAG_PRIORITIES")
+	tagPriorities, err := parseTagPriorities(tagPrioritiesStr)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable ABUSE_TAG_PRIORITIES '%s', err %v", tagPrioritiesStr, err)
+	}
+	cfg.DBTagPriorities = tagPriorities
+	cfg.LeaderLeaseTTL = l.positiveDuration("ABUSE_LEADER_LEASE_TTL")
+	if cfg.LeaderLeaseTTL != 0 && cfg.LeaderLeaseTTL < database.MinLeaderLeaseTTL {
+		l.errorf("invalid value for env variable ABUSE_LEADER_LEASE_TTL '%v', it has to be at least %v", cfg.LeaderLeaseTTL, database.MinLeaderLeaseTTL)
+	}
+
+	// email
+	cfg.AbuseMailaddress = l.lookup("ABUSE_MAILADDRESS", cfg.ModuleFinalizer, false)
+	cfg.AbuseMailbox = strings.Trim(l.lookup("ABUSE_MAILBOX", emailRequired, false), "\"")
+	cfg.AbuseSponsor = strings.Trim(l.optional("ABUSE_SPONSOR"), "\"")
+	cfg.EmailCredentials.Address = l.lookup("EMAIL_SERVER", emailRequired, false)
+	cfg.EmailCredentials.Username = l.username("EMAIL_USERNAME", emailRequired)
+	cfg.EmailCredentials.Password = l.secret("EMAIL_PASSWORD", emailRequired)
+
+	// fetcher
+	cfg.AllowedRecipients = parseList(l.optional("ABUSE_ALLOWED_RECIPIENTS"))
+	cfg.DedupeByMessageID = l.bool("ABUSE_DEDUPE_BY_MESSAGE_ID")
+
+	// parser
+	conflictPatternsStr := l.optional("ABUSE_CONFLICT_PATTERNS")
+	conflictPatterns, err := parseConflictPatterns(conflictPatternsStr)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable ABUSE_CONFLICT_PATTERNS '%s', err %v", conflictPatternsStr, err)
+	}
+	cfg.ConflictPatterns = conflictPatterns
+	cfg.ConflictTags = parseList(l.optional("ABUSE_CONFLICT_TAGS"))
+	cfg.EvidenceHosts = parseList(l.optional("ABUSE_EVIDENCE_HOSTS"))
+	if fallbackReporter := l.optional("ABUSE_FALLBACK_REPORTER_EMAIL"); fallbackReporter != "" {
+		address, err := mail.ParseAddress(fallbackReporter)
+		if err != nil {
+			l.errorf("failed parsing the value for env variable ABUSE_FALLBACK_REPORTER_EMAIL '%s' as an email address, err %v", fallbackReporter, err)
+		} else {
+			cfg.FallbackReporterEmail = address.Address
+		}
+	}
+	cfg.KnownPortals = parseList(l.optional("ABUSE_KNOWN_PORTALS"))
+	linkUnwrapRulesStr := l.optional("ABUSE_LINK_UNWRAP_RULES")
+	linkUnwrapRules, err := email.ParseLinkUnwrapRules(linkUnwrapRulesStr)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable ABUSE_LINK_UNWRAP_RULES '%s', err %v", linkUnwrapRulesStr, err)
+	}
+	cfg.LinkUnwrapRules = linkUnwrapRules
+	cfg.ParseTimeout = l.positiveDuration("ABUSE_PARSE_TIMEOUT")
+	cfg.ShortenerHosts = parseList(l.optional("ABUSE_SHORTENER_HOSTS"))
+	cfg.SkyTransferResolutionMaxAge = l.positiveDuration("ABUSE_SKYTRANSFER_RESOLUTION_MAX_AGE")
+	reporterOrgsStr := l.optional("ABUSE_REPORTER_ORGS")
+	reporterOrgs, err := parseReporterOrgs(reporterOrgsStr)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable ABUSE_REPORTER_ORGS '%s', err %v", reporterOrgsStr, err)
+	}
+	cfg.ReporterOrgs = reporterOrgs
+	mailboxTagsStr := l.optional("ABUSE_MAILBOX_TAGS")
+	mailboxTags, err := parseMailboxTags(mailboxTagsStr)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable ABUSE_MAILBOX_TAGS '%s', err %v", mailboxTagsStr, err)
+	}
+	cfg.MailboxTags = mailboxTags
+
+	cfg.ExtractionMode = l.optional("ABUSE_EXTRACTION_MODE")
+	switch cfg.ExtractionMode {
+	case "", email.ExtractionModeRecall:
+	case email.ExtractionModePrecision:
+		if len(cfg.KnownPortals) == 0 {
+			l.errorf("env variable ABUSE_KNOWN_PORTALS is required when ABUSE_EXTRACTION_MODE is '%s'", email.ExtractionModePrecision)
+		}
+	default:
+		l.errorf("invalid value for env variable ABUSE_EXTRACTION_MODE '%s', expected one of '%s' or '%s'", cfg.ExtractionMode, email.ExtractionModeRecall, email.ExtractionModePrecision)
+	}
+	cfg.AuthMode = l.optional("ABUSE_AUTH_MODE")
+	switch cfg.AuthMode {
+	case "", email.AuthModeNone, email.AuthModeRecord, email.AuthModeReview:
+	default:
+		l.errorf("invalid value for env variable ABUSE_AUTH_MODE '%s', expected one of '%s', '%s' or '%s'", cfg.AuthMode, email.AuthModeNone, email.AuthModeRecord, email.AuthModeReview)
+	}
+	cfg.AuthServID = l.optional("ABUSE_AUTH_SERV_ID")
+	cfg.IDNMode = l.optional("ABUSE_IDN_MODE")
+	switch cfg.IDNMode {
+	case "", email.IDNModeNormalize, email.IDNModeIgnore:
+	default:
+		l.errorf("invalid value for env variable ABUSE_IDN_MODE '%s', expected one of '%s' or '%s'", cfg.IDNMode, email.IDNModeNormalize, email.IDNModeIgnore)
+	}
+
+	// redaction, the key is always loaded if set as it's required to reply to
+	// emails that were redacted before the redaction got disabled
+	redactionMode := l.optional("ABUSE_PII_REDACTION")
+	redactionKeyRequired := false
+	switch redactionMode {
+	case "", email.RedactionModeNone:
+		redactionMode = email.RedactionModeNone
+	case email.RedactionModeHash, email.RedactionModeRedact:
+		redactionKeyRequired = true
+	default:
+		l.errorf("invalid value for env variable ABUSE_PII_REDACTION '%s', expected one of '%s', '%s' or '%s'", redactionMode, email.RedactionModeNone, email.RedactionModeHash, email.RedactionModeRedact)
+		redactionMode = ""
+	}
+	redactionKey := l.secret("ABUSE_PII_KEY", redactionKeyRequired)
+	if redactionMode != "" && redactionKey != "" {
+		cfg.Redactor, err = email.NewRedactor(redactionMode, redactionKey)
+		if err != nil {
+			l.errorf("failed to create the redactor, err %v", err)
+		}
+	}
+
+	// blocker
+	cfg.BlockerBacklogSLA = l.positiveDuration("ABUSE_BLOCKER_BACKLOG_SLA")
+	cfg.BlockerBreakerCooldown = l.positiveDuration("ABUSE_BLOCKER_BREAKER_COOLDOWN")
+	cfg.BlockerBreakerThreshold = l.positiveInt("ABUSE_BLOCKER_BREAKER_THRESHOLD")
+	cfg.BlockerIncludeExcerpt = l.bool("ABUSE_BLOCKER_INCLUDE_EXCERPT")
+	cfg.BlockerInflightHandling = l.optional("ABUSE_BLOCKER_INFLIGHT_HANDLING")
+	switch cfg.BlockerInflightHandling {
+	case "", email.InflightHandlingNone, email.InflightHandlingDefer, email.InflightHandlingMerge:
+	default:
+		l.errorf("invalid value for env variable ABUSE_BLOCKER_INFLIGHT_HANDLING '%s', expected one of '%s', '%s' or '%s'", cfg.BlockerInflightHandling, email.InflightHandlingNone, email.InflightHandlingDefer, email.InflightHandlingMerge)
+	}
+	cfg.BlockerInflightKey = l.optional("ABUSE_BLOCKER_INFLIGHT_KEY")
+	switch cfg.BlockerInflightKey {
+	case "", email.InflightKeySkylinks, email.InflightKeyMessageID:
+	default:
+		l.errorf("invalid value for env variable ABUSE_BLOCKER_INFLIGHT_KEY '%s', expected one of '%s' or '%s'", cfg.BlockerInflightKey, email.InflightKeySkylinks, email.InflightKeyMessageID)
+	}
+	cfg.BlockerMergeTags = l.bool("ABUSE_BLOCKER_MERGE_TAGS")
+	cfg.BlockerRecentBlockWindow = l.positiveDuration("ABUSE_BLOCKER_RECENT_BLOCK_WINDOW")
+	blockerRetryPolicyStr := l.optional("ABUSE_BLOCKER_RETRY_POLICY")
+	cfg.BlockerRetryPolicy, err = utils.ParseRetryPolicy(blockerRetryPolicyStr)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable ABUSE_BLOCKER_RETRY_POLICY '%s', err %v", blockerRetryPolicyStr, err)
+	}
+	for _, additionalURL := range parseList(l.optional("ABUSE_BLOCKER_ADDITIONAL_URLS")) {
+		blockerURL, err := utils.SanitizeServiceURL(additionalURL, "")
+		if err != nil {
+			l.errorf("invalid value for env variable ABUSE_BLOCKER_ADDITIONAL_URLS '%s', err %v", additionalURL, err)
+			continue
+		}
+		cfg.BlockerAdditionalURLs = append(cfg.BlockerAdditionalURLs, blockerURL)
+	}
+	blockerHost := l.lookup("BLOCKER_HOST", cfg.ModuleBlocker, false)
+	blockerPort := l.port("BLOCKER_PORT", cfg.ModuleBlocker)
+	if blockerHost != "" && blockerPort != "" {
+		cfg.BlockerURL, err = utils.SanitizeServiceURL(blockerHost, blockerPort)
+		if err != nil {
+			l.errorf("invalid value for env variables BLOCKER_HOST '%s' and BLOCKER_PORT '%s', err %v", blockerHost, blockerPort, err)
+		}
+	}
+
+	// finalizer
+	cfg.HoldLowConfidence = l.bool("ABUSE_HOLD_LOW_CONFIDENCE_REPLIES")
+	cfg.ReplyGroupSkyTransfer = l.bool("ABUSE_REPLY_GROUP_SKYTRANSFER")
+	cfg.MarkFlag = l.optional("ABUSE_MARK_FLAG")
+	if strings.ContainsAny(cfg.MarkFlag, " ()[]{}%*\"\\") {
+		l.errorf("invalid value for env variable ABUSE_MARK_FLAG '%s', it has to be a valid IMAP keyword", cfg.MarkFlag)
+	}
+	cfg.MarkMailbox = strings.Trim(l.optional("ABUSE_MARK_MAILBOX"), "\"")
+	cfg.MarkMode = l.optional("ABUSE_MARK_MODE")
+	switch cfg.MarkMode {
+	case "", email.MarkModeNone, email.MarkModeFlag:
+	case email.MarkModeMove:
+		if cfg.MarkMailbox == "" {
+			l.errorf("env variable ABUSE_MARK_MAILBOX is required when ABUSE_MARK_MODE is '%s'", email.MarkModeMove)
+		}
+	default:
+		l.errorf("invalid value for env variable ABUSE_MARK_MODE '%s', expected one of '%s', '%s' or '%s'", cfg.MarkMode, email.MarkModeNone, email.MarkModeFlag, email.MarkModeMove)
+	}
+	cfg.NCMECNotifyReporters = parseList(l.optional("ABUSE_NCMEC_NOTIFY_REPORTERS"))
+	cfg.ReplyDigestWindow = l.positiveDuration("ABUSE_REPLY_DIGEST_WINDOW")
+	replyLocalesStr := l.optional("ABUSE_REPLY_LOCALES")
+	replyLocales, err := parseReplyLocales(replyLocalesStr)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable ABUSE_REPLY_LOCALES '%s', err %v", replyLocalesStr, err)
+	}
+	cfg.ReplyLocales = replyLocales
+	if replyTemplatesDir := l.optional("ABUSE_REPLY_TEMPLATES_DIR"); replyTemplatesDir != "" {
+		cfg.ReplyTemplates, err = database.LoadResponseTemplates(replyTemplatesDir)
+		if err != nil {
+			l.errorf("failed loading the reply templates from env variable ABUSE_REPLY_TEMPLATES_DIR '%s', err %v", replyTemplatesDir, err)
+		}
+	}
+
+	// reporter, its variables are only required if NCMEC reporting is enabled
+	cfg.NCMECReportingEnabled = l.bool("ABUSE_NCMEC_REPORTING_ENABLED")
+	required := cfg.NCMECReportingEnabled
+	cfg.AccountsAPIKey = l.secret("SKYNET_ACCOUNTS_API_KEY", false)
+	cfg.AccountsBreakerCooldown = l.positiveDuration("ABUSE_ACCOUNTS_BREAKER_COOLDOWN")
+	cfg.AccountsBreakerThreshold = l.positiveInt("ABUSE_ACCOUNTS_BREAKER_THRESHOLD")
+	cfg.AccountsCacheTTL = l.positiveDuration("ABUSE_ACCOUNTS_CACHE_TTL")
+	cfg.AccountsRequireHealthy = l.bool("ABUSE_ACCOUNTS_REQUIRE_HEALTHY")
+	cfg.AccountsStrictDecoding = l.bool("ABUSE_ACCOUNTS_STRICT_DECODING")
+	cfg.AccountsTimeout = l.positiveDuration("ABUSE_ACCOUNTS_TIMEOUT")
+	cfg.NCMECMaxReportSize = l.positiveInt("ABUSE_NCMEC_MAX_REPORT_SIZE")
+	cfg.NCMECResponseActions, err = email.ParseNCMECResponseActions(l.optional("ABUSE_NCMEC_RESPONSE_ACTIONS"))
+	if err != nil {
+		l.errorf("invalid value for env variable ABUSE_NCMEC_RESPONSE_ACTIONS, err %v", err)
+	}
+	cfg.NCMECSkylinkVersions = parseList(strings.ToLower(l.optional("ABUSE_NCMEC_SKYLINK_VERSIONS")))
+	for _, v := range cfg.NCMECSkylinkVersions {
+		if v != email.SkylinkVersionV1 && v != email.SkylinkVersionV2 {
+			l.errorf("invalid value for env variable ABUSE_NCMEC_SKYLINK_VERSIONS '%s', expected '%s' or '%s'", v, email.SkylinkVersionV1, email.SkylinkVersionV2)
+		}
+	}
+	cfg.NCMECScreenshotDir = l.optional("ABUSE_NCMEC_SCREENSHOT_DIR")
+	if cfg.NCMECScreenshotDir != "" {
+		info, err := os.Stat(cfg.NCMECScreenshotDir)
+		if err != nil || !info.IsDir() {
+			l.errorf("invalid value for env variable ABUSE_NCMEC_SCREENSHOT_DIR '%s', expected an existing directory", cfg.NCMECScreenshotDir)
+		}
+	}
+	for _, portalURL := range l.urls("ABUSE_PORTAL_URL", required) {
+		cfg.PortalURLs = append(cfg.PortalURLs, utils.SanitizeURL(portalURL, true))
+	}
+	cfg.AccountsHost = l.lookup("SKYNET_ACCOUNTS_HOST", required, false)
+	cfg.AccountsPort = l.port("SKYNET_ACCOUNTS_PORT", required)
+	if cfg.AccountsHost != "" {
+		_, err = utils.SanitizeServiceURL(cfg.AccountsHost, cfg.AccountsPort)
+		if err != nil {
+			l.errorf("invalid value for env variables SKYNET_ACCOUNTS_HOST '%s' and SKYNET_ACCOUNTS_PORT '%s', err %v", cfg.AccountsHost, cfg.AccountsPort, err)
+		}
+	}
+	cfg.NCMECCredentials.Username = l.username("NCMEC_USERNAME", required)
+	cfg.NCMECCredentials.Password = l.secret("NCMEC_PASSWORD", required)
+	cfg.NCMECCredentials.Debug = l.requiredBool("NCMEC_DEBUG", required)
+	reporterFirstName := l.lookup("NCMEC_REPORTER_FIRSTNAME", required, false)
+	reporterLastName := l.lookup("NCMEC_REPORTER_LASTNAME", required, false)
+	reporterEmail := l.lookup("NCMEC_REPORTER_EMAIL", required, false)
+	if required {
+		cfg.NCMECReporter = email.NewNCMECReporter(reporterFirstName, reporterLastName, reporterEmail)
+	}
+	if len(cfg.EnabledModules()) == 0 {
+		l.errorf("every module is disabled, enable at least one of the modules using ABUSE_MODULE_BLOCKER, ABUSE_MODULE_FETCHER, ABUSE_MODULE_FINALIZER, ABUSE_MODULE_PARSER or ABUSE_NCMEC_REPORTING_ENABLED")
+	}
+
+	// every variable is looked up by now, so a variable in the config file
+	// that is unknown is most likely a typo
+	var unknown []string
+	for name := range l.file {
+		if _, ok := l.known[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		l.errorf("unknown variable %v at %v", name, l.file[name].location)
+	}
+
+	cfg.variables = l.variables
+	return cfg, l.errs
+}
+
+// loadHealthcheckConfig loads only the variables the healthcheck requires from
+// the environment and the config file at the given path, i.e. the listen
+// address and the database connection. The healthcheck runs frequently, the
+// rest of the config is validated when the scanner starts.
+func loadHealthcheckConfig(path string) (Config, []error) {
+	l, err := newConfigLoader(path)
+	if err != nil {
+		return Config{}, []error{err}
+	}
+	l.errs = nil
+
+	var cfg Config
+	cfg.ListenAddress = l.listenAddress()
+	cfg.DBCredentials, cfg.DBURI = l.dbConnection()
+	return cfg, l.errs
+}
+
+// configFilePath returns the path of the config file, which is the given path
+// that was passed using the -config flag, or the value of configFileEnv if no
+// path was passed.
+func configFilePath(flagPath string) string {
+	if flagPath != "" {
+		return flagPath
+	}
+	return os.Getenv(configFileEnv)
+}
+
+// AccountsClientOptions returns the options for the accounts client.
+func (cfg Config) AccountsClientOptions() accounts.AccountsClientOptions {
+	return accounts.AccountsClientOptions{
+		APIKey:         cfg.AccountsAPIKey,
+		CacheTTL:       cfg.AccountsCacheTTL,
+		HTTPClient:     cfg.HTTPClient,
+		StrictDecoding: cfg.AccountsStrictDecoding,
+		Timeout:        cfg.AccountsTimeout,
+	}
+}
+
+// BlockerOptions returns the options for the blocker.
+func (cfg Config) BlockerOptions() email.BlockerOptions {
+	return email.BlockerOptions{
+		AdditionalURLs:    cfg.BlockerAdditionalURLs,
+		BacklogSLA:        cfg.BlockerBacklogSLA,
+		BreakerCooldown:   cfg.BlockerBreakerCooldown,
+		BreakerThreshold:  cfg.BlockerBreakerThreshold,
+		DryRun:            cfg.DryRun,
+		HTTPClient:        cfg.HTTPClient,
+		IncludeExcerpt:    cfg.BlockerIncludeExcerpt,
+		InflightHandling:  cfg.BlockerInflightHandling,
+		InflightKey:       cfg.BlockerInflightKey,
+		MergeTags:         cfg.BlockerMergeTags,
+		Notifier:          cfg.Notifier,
+		RecentBlockWindow: cfg.BlockerRecentBlockWindow,
+		RetryPolicy:       cfg.BlockerRetryPolicy,
+		ShutdownTimeout:   cfg.componentShutdownTimeout(),
+	}
+}
+
+// DBOptions returns the options for the abuse scanner database.
+func (cfg Config) DBOptions() database.AbuseScannerDBOptions {
+	return database.AbuseScannerDBOptions{
+		MaxUpdateRetries: cfg.DBMaxUpdateRetries,
+		TagPriorities:    cfg.DBTagPriorities,
+	}
+}
+
+// EnabledModules returns the names of the modules that are enabled, in the
+// order in which they are started.
+func (cfg Config) EnabledModules() []string {
+	var modules []string
+	if cfg.ModuleFetcher {
+		modules = append(modules, moduleFetcher)
+	}
+	if cfg.ModuleParser {
+		modules = append(modules, moduleParser)
+	}
+	if cfg.ModuleBlocker {
+		modules = append(modules, moduleBlocker)
+	}
+	if cfg.ModuleFinalizer {
+		modules = append(modules, moduleFinalizer)
+	}
+	if cfg.NCMECReportingEnabled {
+		modules = append(modules, moduleReporter)
+	}
+	return modules
+}
+
+// FetcherOptions returns the options for the fetcher.
+func (cfg Config) FetcherOptions() email.FetcherOptions {
+	return email.FetcherOptions{
+		AllowedRecipients: cfg.AllowedRecipients,
+		DedupeByMessageID: cfg.DedupeByMessageID,
+		Notifier:          cfg.Notifier,
+		ShutdownTimeout:   cfg.componentShutdownTimeout(),
+	}
+}
+
+// FinalizerOptions returns the options for the finalizer.
+func (cfg Config) FinalizerOptions() email.FinalizerOptions {
+	return email.FinalizerOptions{
+		DigestWindow:         cfg.ReplyDigestWindow,
+		DryRun:               cfg.DryRun,
+		GroupSkyTransfer:     cfg.ReplyGroupSkyTransfer,
+		HoldLowConfidence:    cfg.HoldLowConfidence,
+		MarkMode:             cfg.MarkMode,
+		MarkFlag:             cfg.MarkFlag,
+		MarkMailbox:          cfg.MarkMailbox,
+		NCMECNotifyReporters: cfg.NCMECNotifyReporters,
+		Notifier:             cfg.Notifier,
+		Redactor:             cfg.Redactor,
+		ReplyLocales:         cfg.ReplyLocales,
+		ReplyTemplates:       cfg.ReplyTemplates,
+		ShutdownTimeout:      cfg.componentShutdownTimeout(),
+	}
+}
+
+// LogFileOptions returns the options for the rotating log file.
+func (cfg Config) LogFileOptions() utils.RotatingFileOptions {
+	return utils.RotatingFileOptions{
+		MaxAge:     cfg.LogFileMaxAge,
+		MaxBackups: cfg.LogFileMaxBackups,
+		MaxSize:    int64(cfg.LogFileMaxSize),
+	}
+}
+
+// ParserOptions returns the options for the parser.
+func (cfg Config) ParserOptions() email.ParserOptions {
+	return email.ParserOptions{
+		AuthMode:                    cfg.AuthMode,
+		AuthServID:                  cfg.AuthServID,
+		ConflictPatterns:            cfg.ConflictPatterns,
+		ConflictTags:                cfg.ConflictTags,
+		EvidenceHosts:               cfg.EvidenceHosts,
+		ExtractionMode:              cfg.ExtractionMode,
+		FallbackReporterEmail:       cfg.FallbackReporterEmail,
+		HTTPClient:                  cfg.HTTPClient,
+		IDNMode:                     cfg.IDNMode,
+		KnownPortals:                cfg.KnownPortals,
+		LinkUnwrapRules:             cfg.LinkUnwrapRules,
+		MailboxTags:                 cfg.MailboxTags,
+		Notifier:                    cfg.Notifier,
+		ParseTimeout:                cfg.ParseTimeout,
+		PortalURLs:                  cfg.PortalURLs,
+		Redactor:                    cfg.Redactor,
+		ReporterOrgs:                cfg.ReporterOrgs,
+		ShortenerHosts:              cfg.ShortenerHosts,
+		ShutdownTimeout:             cfg.componentShutdownTimeout(),
+		SkyTransferResolutionMaxAge: cfg.SkyTransferResolutionMaxAge,
+	}
+}
+
+// ReporterOptions returns the options for the NCMEC reporter.
+func (cfg Config) ReporterOptions() email.ReporterOptions {
+	opts := email.ReporterOptions{
+		AccountsBreakerCooldown:  cfg.AccountsBreakerCooldown,
+		AccountsBreakerThreshold: cfg.AccountsBreakerThreshold,
+		DryRun:                   cfg.DryRun,
+		HTTPClient:               cfg.HTTPClient,
+		MaxReportSize:            cfg.NCMECMaxReportSize,
+		NCMECResponseActions:     cfg.NCMECResponseActions,
+		Notifier:                 cfg.Notifier,
+		RequireAccountsHealthy:   cfg.AccountsRequireHealthy,
+		ShutdownTimeout:          cfg.componentShutdownTimeout(),
+		SkylinkVersions:          cfg.NCMECSkylinkVersions,
+	}
+	if cfg.NCMECScreenshotDir != "" {
+		opts.Screenshots = email.ScreenshotDir(cfg.NCMECScreenshotDir)
+	}
+	return opts
+}
+
+// ServerOptions returns the options for the HTTP server.
+func (cfg Config) ServerOptions() api.ServerOptions {
+	return api.ServerOptions{
+		AdminToken:  cfg.AdminToken,
+		EnablePprof: cfg.DebugPprof,
+	}
+}
+
+// String returns a summary of the config, it lists the value of every env
+// variable that was set, alongside the location of the variables that were
+// loaded from the config file, followed by the values that are derived from
+// them. Secrets are redacted and usernames are masked.
+func (cfg Config) String() string {
+	variables := make([]configVariable, len(cfg.variables))
+	copy(variables, cfg.variables)
+	sort.Slice(variables, func(i, j int) bool {
+		return variables[i].name < variables[j].name
+	})
+
+	var sb strings.Builder
+	for _, variable := range variables {
+		value := variable.value
+		if variable.secret {
+			value = redacted
+		} else if variable.masked {
+			value = mask(value)
+		}
+		if variable.location != "" {
+			value = fmt.Sprintf("%v (%v)", value, variable.location)
+		}
+		sb.WriteString(fmt.Sprintf("%v: %v\n", variable.name, value))
+	}
+
+	// the derived values are the ones that are actually used, e.g. the
+	// sanitized URLs, they don't contain any secrets
+	sb.WriteString("Derived values:\n")
+	for _, derived := range [][2]string{
+		{"blocker URLs", strings.Join(cfg.blockerURLs(), ", ")},
+		{"database URI", cfg.DBURI},
+		{"enabled modules", strings.Join(cfg.EnabledModules(), ", ")},
+		{"log level", cfg.logLevels()},
+		{"portal URLs", strings.Join(cfg.PortalURLs, ", ")},
+	} {
+		if derived[1] != "" {
+			sb.WriteString(fmt.Sprintf("  %v: %v\n", derived[0], derived[1]))
+		}
+	}
+	return sb.String()
+}
+
+// blockerURLs returns the URLs of all blocker APIs, starting with the one of
+// the local blocker.
+func (cfg Config) blockerURLs() []string {
+	var urls []string
+	if cfg.BlockerURL != "" {
+		urls = append(urls, cfg.BlockerURL)
+	}
+	return append(urls, cfg.BlockerAdditionalURLs...)
+}
+
+// componentShutdownTimeout returns the amount of time every component is
+// allowed to take to shut down, it's an equal share of the shutdown budget.
+func (cfg Config) componentShutdownTimeout() time.Duration {
+	return cfg.ShutdownTimeout / shutdownComponentCount
+}
+
+// logLevels returns the log level followed by the levels of the modules that
+// override it, e.g. 'info (Blocker=warn, Parser=debug)'.
+func (cfg Config) logLevels() string {
+	if len(cfg.ModuleLogLevels) == 0 {
+		return cfg.LogLevel.String()
+	}
+	var overrides []string
+	for module, level := range cfg.ModuleLogLevels {
+		overrides = append(overrides, fmt.Sprintf("%v=%v", module, level))
+	}
+	sort.Strings(overrides)
+	return fmt.Sprintf("%v (%v)", cfg.LogLevel, strings.Join(overrides, ", "))
+}
+
+// bool loads the given optional env variable as a boolean, only 'true' and
+// 'false' are accepted.
+func (l *configLoader) bool(name string) bool {
+	return l.requiredBool(name, false)
+}
+
+// defaultBool loads the given optional env variable as a boolean, only 'true'
+// and 'false' are accepted. It returns the given default if it's not set.
+func (l *configLoader) defaultBool(name string, def bool) bool {
+	valueStr := l.optional(name)
+	if valueStr == "" {
+		return def
+	}
+	return l.parseBool(name, valueStr)
+}
+
+// errorf records a problem with the config. If the problem concerns variables
+// that were loaded from the config file, their location is added to it.
+func (l *configLoader) errorf(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+
+	var locations []string
+	words := strings.FieldsFunc(problem, func(r rune) bool {
+		return !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_')
+	})
+	for _, variable := range l.variables {
+		if variable.location == "" {
+			continue
+		}
+		for _, word := range words {
+			if word == variable.name {
+				locations = append(locations, variable.location)
+				break
+			}
+		}
+	}
+	if len(locations) > 0 {
+		problem = fmt.Sprintf("%v (set at %v)", problem, strings.Join(locations, ", "))
+	}
+	l.errs = append(l.errs, errors.New(problem))
+}
+
+// newConfigLoader returns a config loader that loads the variables that are not
+// set in the environment from the config file at the given path, the path is
+// optional. The problems with the values in the config file are recorded on
+// the loader.
+func newConfigLoader(path string) (*configLoader, error) {
+	l := &configLoader{known: make(map[string]struct{})}
+	if path != "" {
+		file, problems, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		l.file = file
+		l.errs = problems
+	}
+	return l, nil
+}
+
+// dbConnection loads the credentials and the URI of the database.
+func (l *configLoader) dbConnection() (options.Credential, string) {
+	creds := options.Credential{
+		Username: l.username("SKYNET_DB_USER", true),
+		Password: l.secret("SKYNET_DB_PASS", true),
+	}
+	dbHost := l.required("SKYNET_DB_HOST")
+	dbPort := l.port("SKYNET_DB_PORT", true)
+	return creds, fmt.Sprintf("mongodb://%v:%v", dbHost, dbPort)
+}
+
+// listenAddress loads the address the HTTP server listens on, it defaults to
+// api.DefaultListenAddress.
+func (l *configLoader) listenAddress() string {
+	listenAddress := l.optional("ABUSE_LISTEN_ADDRESS")
+	if listenAddress == "" {
+		return api.DefaultListenAddress
+	}
+	_, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable ABUSE_LISTEN_ADDRESS '%s' as a listen address, err %v", listenAddress, err)
+	} else if portNum, err := strconv.Atoi(port); err != nil || portNum < 0 || portNum > 65535 {
+		l.errorf("failed parsing the value for env variable ABUSE_LISTEN_ADDRESS '%s' as a listen address, invalid port '%s'", listenAddress, port)
+	}
+	return listenAddress
+}
+
+// lookup loads the given env variable, if it's not set in the environment it
+// is loaded from the config file. It records a problem if the variable is
+// required but not set.
+func (l *configLoader) lookup(name string, required, secret bool) string {
+	return l.load(configVariable{name: name, secret: secret}, required)
+}
+
+// load loads the value of the given variable, see lookup.
+func (l *configLoader) load(variable configVariable, required bool) string {
+	name := variable.name
+	l.known[name] = struct{}{}
+
+	value, ok := os.LookupEnv(name)
+	if ok {
+		variable.value = value
+	} else if fileValue, exists := l.file[name]; exists {
+		variable.value = fileValue.value
+		variable.location = fileValue.location
+	} else {
+		if required {
+			l.errs = append(l.errs, errors.New("missing env var "+name))
+		}
+		return ""
+	}
+	l.variables = append(l.variables, variable)
+	return variable.value
+}
+
+// optional loads the given optional env variable.
+func (l *configLoader) optional(name string) string {
+	return l.lookup(name, false, false)
+}
+
+// parseBool parses the value of the given env variable as a boolean, only
+// 'true' and 'false' are accepted.
+func (l *configLoader) parseBool(name, valueStr string) bool {
+	switch valueStr {
+	case "true":
+		return true
+	case "false":
+		return false
+	default:
+		l.errorf("failed parsing the value for env variable %s '%s' as a boolean, expected 'true' or 'false'", name, valueStr)
+		return false
+	}
+}
+
+// parseURL parses the given value of the given env variable as a URL, the
+// scheme is optional.
+func (l *configLoader) parseURL(name, valueStr string) string {
+	if valueStr == "" {
+		return ""
+	}
+	_, err := utils.SanitizeURLStrict(valueStr, false)
+	if err != nil {
+		l.errorf("failed parsing the value for env variable %s '%s' as a URL, err %v", name, valueStr, err)
+		return ""
+	}
+	return valueStr
+}
+
+// port loads the given env variable as a port number.
+func (l *configLoader) port(name string, required bool) string {
+	valueStr := l.lookup(name, required, false)
+	if valueStr == "" {
+		if required {
+			l.errorf("env variable %s can't be empty", name)
+		}
+		return ""
+	}
+	port, err := strconv.Atoi(valueStr)
+	if err != nil || port <= 0 || port > 65535 {
+		l.errorf("failed parsing the value for env variable %s '%s' as a port number", name, valueStr)
+		return ""
+	}
+	return valueStr
+}
+
+// positiveDuration loads the given optional env variable as a positive
+// duration.
+func (l *configLoader) positiveDuration(name string) time.Duration {
+	valueStr := l.optional(name)
+	if valueStr == "" {
+		return 0
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil || value <= 0 {
+		l.errorf("failed parsing the value for env variable %s '%s' as a positive duration, err %v", name, valueStr, err)
+		return 0
+	}
+	return value
+}
+
+// positiveInt loads the given optional env variable as a positive integer.
+func (l *configLoader) positiveInt(name string) int {
+	valueStr := l.optional(name)
+	if valueStr == "" {
+		return 0
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value <= 0 {
+		l.errorf("failed parsing the value for env variable %s '%s' as a positive integer, err %v", name, valueStr, err)
+		return 0
+	}
+	return value
+}
+
+// required loads the given required env variable.
+func (l *configLoader) required(name string) string {
+	return l.lookup(name, true, false)
+}
+
+// requiredBool loads the given env variable as a boolean, only 'true' and
+// 'false' are accepted.
+func (l *configLoader) requiredBool(name string, required bool) bool {
+	valueStr := l.lookup(name, required, false)
+	if valueStr == "" {
+		return false
+	}
+	return l.parseBool(name, valueStr)
+}
+
+// secret loads the given env variable, its value is redacted in the summary.
+func (l *configLoader) secret(name string, required bool) string {
+	return l.lookup(name, required, true)
+}
+
+// username loads the given env variable, only the last characters of its
+// value are shown in the summary.
+func (l *configLoader) username(name string, required bool) string {
+	return l.load(configVariable{name: name, masked: true}, required)
+}
+
+// urls loads the given env variable as a comma separated list of URLs, the
+// scheme is optional.
+func (l *configLoader) urls(name string, required bool) []string {
+	var urls []string
+	for _, valueStr := range strings.Split(l.lookup(name, required, false), ",") {
+		if u := l.parseURL(name, strings.TrimSpace(valueStr)); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// mask masks all but the last characters of the given value, values that are
+// too short to hide anything are redacted entirely.
+func mask(value string) string {
+	if len(value) <= maskedSuffixLength {
+		return redacted
+	}
+	return "****" + value[len(value)-maskedSuffixLength:]
+}
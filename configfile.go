@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// configFileLists are the variables that accept a list in the config
+	// file, mapped onto the separator of the list in the env variable
+	configFileLists = map[string]string{
+		"ABUSE_ALLOWED_RECIPIENTS":      ",",
+		"ABUSE_BLOCKER_ADDITIONAL_URLS": ",",
+		"ABUSE_CONFLICT_PATTERNS":       ";",
+		"ABUSE_CONFLICT_TAGS":           ",",
+		"ABUSE_EVIDENCE_HOSTS":          ",",
+		"ABUSE_KNOWN_PORTALS":           ",",
+		"ABUSE_NCMEC_NOTIFY_REPORTERS":  ",",
+		"ABUSE_NCMEC_SKYLINK_VERSIONS":  ",",
+		"ABUSE_PORTAL_URL":              ",",
+		"ABUSE_SHORTENER_HOSTS":         ",",
+	}
+
+	// configFileMaps are the variables that accept a mapping in the config
+	// file, the mapping is converted into a comma separated list of
+	// key=value pairs
+	configFileMaps = map[string]struct{}{
+		"ABUSE_LINK_UNWRAP_RULES": {},
+		"ABUSE_MAILBOX_TAGS":      {},
+		"ABUSE_REPLY_LOCALES":     {},
+		"ABUSE_REPORTER_ORGS":     {},
+		"ABUSE_TAG_PRIORITIES":    {},
+	}
+)
+
+type (
+	// configFileValue is the value of a variable in the config file.
+	configFileValue struct {
+		value    string
+		location string
+	}
+)
+
+// loadConfigFile loads the YAML or JSON config file at the given path. The
+// file is a mapping of env variable names, which are case-insensitive, onto
+// their value. Every value is a scalar, except for the lists and mappings in
+// configFileLists and configFileMaps. A syntax error is returned as the error,
+// every problem with the values is returned as a separate problem.
+func loadConfigFile(path string) (map[string]configFileValue, []error, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.AddContext(err, "failed to read config file")
+	}
+	var root yaml.Node
+	err = yaml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, nil, errors.AddContext(err, fmt.Sprintf("failed to parse config file %v", path))
+	}
+
+	// an empty file is a valid config file
+	values := make(map[string]configFileValue)
+	if len(root.Content) == 0 {
+		return values, nil, nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("invalid config file %v, expected a mapping of variable names onto values at %v", path, nodeLocation(path, doc))
+	}
+
+	var problems []error
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, node := doc.Content[i], doc.Content[i+1]
+		name := strings.ToUpper(key.Value)
+		location := nodeLocation(path, key)
+		if key.Kind != yaml.ScalarNode || name == "" {
+			problems = append(problems, fmt.Errorf("invalid variable name at %v", location))
+			continue
+		}
+		if previous, exists := values[name]; exists {
+			problems = append(problems, fmt.Errorf("duplicate variable %v at %v, it's already set at %v", name, location, previous.location))
+			continue
+		}
+		value, err := configFileNodeValue(name, node)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("invalid value for variable %v at %v, %v", name, nodeLocation(path, node), err))
+			continue
+		}
+		values[name] = configFileValue{value: value, location: location}
+	}
+	return values, problems, nil
+}
+
+// configFileNodeValue converts the given node into the value of the env
+// variable with the given name.
+func configFileNodeValue(name string, node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		separator, ok := configFileLists[name]
+		if !ok {
+			return "", errors.New("expected a single value, found a list")
+		}
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("expected a list of values")
+			}
+			if strings.Contains(item.Value, separator) {
+				return "", fmt.Errorf("list item '%v' can't contain '%v'", item.Value, separator)
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, separator), nil
+	case yaml.MappingNode:
+		if _, ok := configFileMaps[name]; !ok {
+			return "", errors.New("expected a single value, found a mapping")
+		}
+		pairs := make([]string, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode {
+				return "", errors.New("expected a mapping of values")
+			}
+			pairs = append(pairs, key.Value+"="+value.Value)
+		}
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", errors.New("aliases are not supported")
+	}
+}
+
+// nodeLocation returns the location of the given node in the config file at
+// the given path.
+func nodeLocation(path string, node *yaml.Node) string {
+	return fmt.Sprintf("%v:%v:%v", path, node.Line, node.Column)
+}
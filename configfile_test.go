@@ -0,0 +1,255 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfigFile is a valid config file that sets every required variable
+const testConfigFile = `# abuse scanner config
+server_domain: siasky.net
+ABUSE_MAILADDRESS: abuse@siasky.net
+ABUSE_MAILBOX: INBOX
+ABUSE_SHUTDOWN_TIMEOUT: 2m
+ABUSE_DEDUPE_BY_MESSAGE_ID: true
+ABUSE_KNOWN_PORTALS:
+  - siasky.net
+  - skyportal.xyz
+ABUSE_CONFLICT_PATTERNS:
+  - 'not (a|an) (phishing|malware)'
+  - 'false positive'
+ABUSE_REPORTER_ORGS:
+  switch.ch: SWITCH-CERT
+BLOCKER_HOST: blocker
+BLOCKER_PORT: 4000
+EMAIL_PASSWORD: emailpass
+EMAIL_SERVER: imap.siasky.net:993
+EMAIL_USERNAME: abuse
+SKYNET_DB_HOST: mongo
+SKYNET_DB_PASS: dbpass
+SKYNET_DB_PORT: 27017
+SKYNET_DB_USER: admin
+`
+
+// TestLoadConfigFile is a unit test that covers loading the config from a
+// config file, and the precedence of the environment over the config file.
+func TestLoadConfigFile(t *testing.T) {
+	// create a function to restore the environment
+	restoreEnvFn := restoreEnv(configVariables)
+	defer func() {
+		err := restoreEnvFn()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	resetEnv := func(env map[string]string) {
+		for _, variable := range configVariables {
+			if err := os.Unsetenv(variable); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for variable, value := range env {
+			if err := os.Setenv(variable, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	path := writeFile("config.yaml", testConfigFile)
+
+	// assert the config can be loaded from the file only
+	resetEnv(nil)
+	cfg, errs := loadConfig(path)
+	if len(errs) != 0 {
+		t.Fatal("unexpected problems", errs)
+	}
+	if cfg.ServerDomain != "siasky.net" || cfg.AbuseMailbox != "INBOX" || cfg.DBURI != "mongodb://mongo:27017" {
+		t.Fatal("unexpected config", cfg)
+	}
+	if cfg.ShutdownTimeout != 2*time.Minute || !cfg.DedupeByMessageID {
+		t.Fatal("unexpected config", cfg.ShutdownTimeout, cfg.DedupeByMessageID)
+	}
+	if !reflect.DeepEqual(cfg.KnownPortals, []string{"siasky.net", "skyportal.xyz"}) {
+		t.Fatal("unexpected known portals", cfg.KnownPortals)
+	}
+	if len(cfg.ConflictPatterns) != 2 || !cfg.ConflictPatterns[0].MatchString("this is NOT a phishing page") {
+		t.Fatal("unexpected conflict patterns", cfg.ConflictPatterns)
+	}
+	if cfg.ReporterOrgs["switch.ch"] != "SWITCH-CERT" {
+		t.Fatal("unexpected reporter orgs", cfg.ReporterOrgs)
+	}
+
+	// assert the summary points to the config file and redacts the secrets
+	summary := cfg.String()
+	if !strings.Contains(summary, "SERVER_DOMAIN: siasky.net ("+path+":2:1)") {
+		t.Fatal("expected the location in the summary", summary)
+	}
+	if strings.Contains(summary, "dbpass") {
+		t.Fatal("secret not redacted", summary)
+	}
+
+	// assert the environment overrides the config file
+	resetEnv(map[string]string{
+		"ABUSE_KNOWN_PORTALS": "siasky.dev",
+		"SERVER_DOMAIN":       "siasky.dev",
+	})
+	cfg, errs = loadConfig(path)
+	if len(errs) != 0 {
+		t.Fatal("unexpected problems", errs)
+	}
+	if cfg.ServerDomain != "siasky.dev" || !reflect.DeepEqual(cfg.KnownPortals, []string{"siasky.dev"}) {
+		t.Fatal("expected the environment to take precedence", cfg.ServerDomain, cfg.KnownPortals)
+	}
+	if cfg.AbuseMailaddress != "abuse@siasky.net" {
+		t.Fatal("expected the config file to be used for unset variables", cfg.AbuseMailaddress)
+	}
+
+	// assert the config can be loaded from the environment only, the
+	// variables in the env are not reported as missing
+	resetEnv(map[string]string{
+		"SERVER_DOMAIN": "siasky.dev",
+	})
+	_, errs = loadConfig("")
+	if len(errs) == 0 {
+		t.Fatal("expected missing variables")
+	}
+	for _, err := range errs {
+		if strings.Contains(err.Error(), "SERVER_DOMAIN") {
+			t.Fatal("unexpected problem", err)
+		}
+	}
+
+	// assert JSON config files are supported
+	resetEnv(nil)
+	jsonPath := writeFile("config.json", `{
+  "SERVER_DOMAIN": "siasky.net",
+  "ABUSE_MAILADDRESS": "abuse@siasky.net",
+  "ABUSE_MAILBOX": "INBOX",
+  "ABUSE_SHORTENER_HOSTS": ["bit.ly", "tinyurl.com"],
+  "BLOCKER_HOST": "blocker",
+  "BLOCKER_PORT": 4000,
+  "EMAIL_PASSWORD": "emailpass",
+  "EMAIL_SERVER": "imap.siasky.net:993",
+  "EMAIL_USERNAME": "abuse",
+  "SKYNET_DB_HOST": "mongo",
+  "SKYNET_DB_PASS": "dbpass",
+  "SKYNET_DB_PORT": 27017,
+  "SKYNET_DB_USER": "admin"
+}`)
+	cfg, errs = loadConfig(jsonPath)
+	if len(errs) != 0 {
+		t.Fatal("unexpected problems", errs)
+	}
+	if !reflect.DeepEqual(cfg.ShortenerHosts, []string{"bit.ly", "tinyurl.com"}) {
+		t.Fatal("unexpected shortener hosts", cfg.ShortenerHosts)
+	}
+
+	// assert every problem with the config file is reported with its location
+	invalidPath := writeFile("invalid.yaml", testConfigFile+`ABUSE_SHUTDOWN_TIMEUOT: 1m
+ABUSE_LOG_LEVEL:
+  - debug
+ABUSE_HEALTH_MAX_FETCH_AGE: 10
+Server_Domain: siasky.dev
+`)
+	_, errs = loadConfig(invalidPath)
+	expected := []string{
+		"unknown variable ABUSE_SHUTDOWN_TIMEUOT at " + invalidPath + ":24:1",
+		"invalid value for variable ABUSE_LOG_LEVEL at " + invalidPath + ":26:3, expected a single value, found a list",
+		"ABUSE_HEALTH_MAX_FETCH_AGE '10' as a positive duration, err time: missing unit in duration \"10\" (set at " + invalidPath + ":27:1)",
+		"duplicate variable SERVER_DOMAIN at " + invalidPath + ":28:1, it's already set at " + invalidPath + ":2:1",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("unexpected amount of problems", len(errs), errs)
+	}
+	for _, problem := range expected {
+		var found bool
+		for _, err := range errs {
+			if strings.Contains(err.Error(), problem) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatal("expected problem not found", problem, errs)
+		}
+	}
+
+	// assert a syntax error is reported with its line
+	_, errs = loadConfig(writeFile("syntax.yaml", "SERVER_DOMAIN: siasky.net\n  BLOCKER_HOST: blocker\n"))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "failed to parse config file") || !strings.Contains(errs[0].Error(), "line 2") {
+		t.Fatal("unexpected problems", errs)
+	}
+
+	// assert a missing config file is reported
+	_, errs = loadConfig(filepath.Join(dir, "missing.yaml"))
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "failed to read config file") {
+		t.Fatal("unexpected problems", errs)
+	}
+}
+
+// TestLoadHealthcheckConfig verifies the healthcheck only loads the variables
+// it requires, so the problems with the rest of the config don't fail it, and
+// that the config file can be passed using the env.
+func TestLoadHealthcheckConfig(t *testing.T) {
+	// create a function to restore the environment
+	restoreEnvFn := restoreEnv(configVariables)
+	defer func() {
+		err := restoreEnvFn()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	for _, variable := range configVariables {
+		if err := os.Unsetenv(variable); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// write a config file without most of the required variables, and with
+	// an invalid and an unknown variable
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte(`ABUSE_LISTEN_ADDRESS: :4000
+ABUSE_LOG_LEVEL: loud
+ABUSE_SHUTDOWN_TIMEUOT: 1m
+SKYNET_DB_HOST: mongo
+SKYNET_DB_PASS: dbpass
+SKYNET_DB_PORT: 27017
+SKYNET_DB_USER: admin
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the config file is passed using the env unless the flag is set
+	t.Setenv(configFileEnv, path)
+	if configFilePath("") != path || configFilePath("other.yaml") != "other.yaml" {
+		t.Fatal("unexpected config file path", configFilePath(""))
+	}
+
+	cfg, errs := loadHealthcheckConfig(configFilePath(""))
+	if len(errs) != 0 {
+		t.Fatal("unexpected problems", errs)
+	}
+	if cfg.ListenAddress != ":4000" || cfg.DBURI != "mongodb://mongo:27017" || cfg.DBCredentials.Username != "admin" || cfg.DBCredentials.Password != "dbpass" {
+		t.Fatal("unexpected config", cfg)
+	}
+
+	// assert the problems with the variables it requires are reported
+	_, errs = loadHealthcheckConfig("")
+	if len(errs) == 0 {
+		t.Fatal("expected missing variables")
+	}
+}
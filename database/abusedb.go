@@ -5,6 +5,8 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -27,10 +29,19 @@ const (
 	// collLocks is the name of the collection that contains locks
 	collLocks = "locks"
 
+	// defaultMaxUpdateRetries is the default amount of times we retry an
+	// update that failed due to the email being updated concurrently.
+	defaultMaxUpdateRetries = 3
+
 	// collNCMECReports is the name of the collection that contains all NCMEC
 	// reports.
 	collNCMECReports = "ncmec_reports"
 
+	// maxTestDBNamePrefixLen is the maximum length of the name we use as a
+	// prefix for test databases, mongo limits database names to 64 bytes so
+	// we have to account for the unique suffix.
+	maxTestDBNamePrefixLen = 38
+
 	// lockOwnerName is passed as the 'Owner' when creating a new lock in
 	// the db for tus uploads.
 	lockOwnerName = "Abuse Scanner"
@@ -40,9 +51,38 @@ const (
 
 	// resourceEmails is the resource name used when locking mails
 	resourceEmails = "emails"
+
+	// TestUIDPrefix is the prefix of the UID of synthetic emails that are
+	// inserted during development, these emails are considered test data and
+	// are removed by PurgeTestData.
+	TestUIDPrefix = "TEST-"
 )
 
 var (
+	// DefaultTagPriorities are the default priorities of the emails with the
+	// given tags, the high-severity reports are processed first.
+	DefaultTagPriorities = map[string]int{
+		"csam":      1,
+		"terrorism": 1,
+	}
+
+	// ErrEmailNotFound is returned when an operation targets an email that
+	// does not exist.
+	ErrEmailNotFound = errors.New("email not found")
+
+	// ErrEmailFinalized is returned when the reply to an email is suppressed
+	// after the email was finalized, the reply has been sent by then.
+	ErrEmailFinalized = errors.New("email was finalized")
+
+	// ErrEmailSkipped is returned when an email is reprocessed that was
+	// skipped by the fetcher, these emails were persisted without a body so
+	// they can't be processed.
+	ErrEmailSkipped = errors.New("email was skipped")
+
+	// ErrVersionMismatch is returned when an email is updated using a stale
+	// version, meaning it has been updated concurrently by another process.
+	ErrVersionMismatch = errors.New("email version mismatch")
+
 	// mongoDefaultTimeout is the default timeout for mongo operations that
 	// require a context but where the input arguments don't contain a
 	// context.
@@ -52,6 +92,10 @@ var (
 	// name that's already taken by a collection that exists.
 	mongoErrCollectionExists = errors.New("Collection already exists")
 
+	// invalidDBNameChars matches all characters we don't want to use in test
+	// database names.
+	invalidDBNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
 	// mongoErrNoDocuments is returned when a database operation completes
 	// successfully but it doesn't find or affect any documents.
 	mongoErrNoDocuments = errors.New("no documents in result")
@@ -62,9 +106,36 @@ type (
 	AbuseScannerDB struct {
 		MongoDB
 		lock.Client
+		staticOptions        AbuseScannerDBOptions
 		staticPortalHostName string
 	}
 
+	// AbuseScannerDBOptions contains the configurable options of the abuse
+	// scanner database.
+	AbuseScannerDBOptions struct {
+		// MaxUpdateRetries is the amount of times an update is retried when it
+		// failed due to the email being updated concurrently, if zero it
+		// defaults to defaultMaxUpdateRetries. Updates are always retried at
+		// least once, as a concurrent update is expected while the modules
+		// process the same email.
+		MaxUpdateRetries int
+
+		// TagPriorities maps a tag onto the priority of the emails that have
+		// it, the queries for emails return them by descending priority so
+		// high-severity reports jump the queue during a backlog. The
+		// priority of an email is the highest priority of its tags, tags
+		// without a priority have priority 0. The priorities extend and
+		// override DefaultTagPriorities.
+		TagPriorities map[string]int
+	}
+
+	// TestCleaner is the interface that allows registering a function that
+	// gets called when a test finishes, it is implemented by testing.T.
+	TestCleaner interface {
+		Cleanup(func())
+		Errorf(format string, args ...interface{})
+	}
+
 	// abuseLock represents a lock on an entity in the abuse database.
 	abuseLock struct {
 		staticClient         *lock.Client
@@ -75,10 +146,22 @@ type (
 )
 
 // NewAbuseScannerDB returns an instance of the Mongo DB.
-func NewAbuseScannerDB(ctx context.Context, portalHostName, mongoDbName, mongoUri string, mongoCreds options.Credential, logger *logrus.Logger) (*AbuseScannerDB, error) {
+func NewAbuseScannerDB(ctx context.Context, portalHostName, mongoDbName, mongoUri string, mongoCreds options.Credential, opts AbuseScannerDBOptions, logger *logrus.Logger) (*AbuseScannerDB, error) {
+	// set the defaults
+	if opts.MaxUpdateRetries == 0 {
+		opts.MaxUpdateRetries = defaultMaxUpdateRetries
+	}
+	priorities := make(map[string]int)
+	for _, p := range []map[string]int{DefaultTagPriorities, opts.TagPriorities} {
+		for tag, priority := range p {
+			priorities[tag] = priority
+		}
+	}
+	opts.TagPriorities = priorities
+
 	// create the client
-	opts := options.Client().ApplyURI(mongoUri).SetAuth(mongoCreds)
-	client, err := mongo.NewClient(opts)
+	clientOpts := options.Client().ApplyURI(mongoUri).SetAuth(mongoCreds)
+	client, err := mongo.NewClient(clientOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -115,6 +198,7 @@ func NewAbuseScannerDB(ctx context.Context, portalHostName, mongoDbName, mongoUr
 			staticName:     DBAbuseScanner,
 		},
 		*lock.NewClient(database.Collection(collLocks)),
+		opts,
 		portalHostName,
 	}
 
@@ -139,6 +223,10 @@ func NewAbuseScannerDB(ctx context.Context, portalHostName, mongoDbName, mongoUr
 				Keys:    bson.M{"blocked": 1},
 				Options: options.Index(),
 			},
+			{
+				Keys:    bson.M{"blocked_at": 1},
+				Options: options.Index(),
+			},
 			{
 				Keys:    bson.M{"finalized": 1},
 				Options: options.Index(),
@@ -147,6 +235,34 @@ func NewAbuseScannerDB(ctx context.Context, portalHostName, mongoDbName, mongoUr
 				Keys:    bson.M{"reported": 1},
 				Options: options.Index(),
 			},
+			{
+				Keys:    bson.M{"skip_reason": 1},
+				Options: options.Index(),
+			},
+			{
+				Keys:    bson.M{"parse_result.skylinks": 1},
+				Options: options.Index(),
+			},
+			{
+				Keys:    bson.D{{Key: "email_mailbox", Value: 1}, {Key: "email_message_id", Value: 1}},
+				Options: options.Index(),
+			},
+		},
+		collQuarantine: {
+			{
+				Keys:    bson.D{{Key: "collection", Value: 1}, {Key: "document_id", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		collSkyTransferResolutions: {
+			{
+				Keys:    bson.M{"url": 1},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys:    bson.M{"skylinks": 1},
+				Options: options.Index(),
+			},
 		},
 		collNCMECReports: {
 			{
@@ -166,7 +282,9 @@ func NewAbuseScannerDB(ctx context.Context, portalHostName, mongoDbName, mongoUr
 	return db, nil
 }
 
-// NewTestAbuseScannerDB returns a new test database.
+// NewTestAbuseScannerDB returns a new test database. The database name is
+// derived from the given name and suffixed with a unique identifier, that way
+// parallel test runs on a shared database server don't collide.
 //
 // NOTE: the database is purged before it gets returned.
 func NewTestAbuseScannerDB(ctx context.Context, dbName string) (*AbuseScannerDB, error) {
@@ -175,11 +293,11 @@ func NewTestAbuseScannerDB(ctx context.Context, dbName string) (*AbuseScannerDB,
 	logger.Out = ioutil.Discard
 
 	// create the database
-	dbName = strings.Replace(dbName, "/", "_", -1)
-	db, err := NewAbuseScannerDB(ctx, "", dbName, test.MongoDBConnString, options.Credential{
+	dbName = testDatabaseName(dbName)
+	db, err := NewAbuseScannerDB(ctx, "", dbName, test.MongoDBURI(), options.Credential{
 		Username: test.MongoDBUsername,
 		Password: test.MongoDBPassword,
-	}, logger)
+	}, AbuseScannerDBOptions{}, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -193,6 +311,139 @@ func NewTestAbuseScannerDB(ctx context.Context, dbName string) (*AbuseScannerDB,
 	return db, nil
 }
 
+// NewTestAbuseScannerDBWithCleanup returns a new test database, similar to
+// NewTestAbuseScannerDB, but it registers a cleanup function on the given test
+// that drops the database when the test finishes.
+func NewTestAbuseScannerDBWithCleanup(ctx context.Context, t TestCleaner, dbName string) (*AbuseScannerDB, error) {
+	db, err := NewTestAbuseScannerDB(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	// register a cleanup that drops the database, we use a separate client
+	// for this since the test usually closes the database before the cleanup
+	// functions are executed
+	name := db.staticDatabase.Name()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+		defer cancel()
+
+		err := dropTestDatabases(ctx, name)
+		if err != nil {
+			t.Errorf("failed to drop test database %v, err %v", name, err)
+		}
+	})
+	return db, nil
+}
+
+// PurgeStaleTestDatabases drops all test databases that start with the given
+// prefix and that were created more than the given duration ago. Test
+// databases that were not properly cleaned up accumulate on the test server,
+// this function allows getting rid of them periodically.
+func PurgeStaleTestDatabases(ctx context.Context, prefix string, olderThan time.Duration) ([]string, error) {
+	client, err := newTestClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = client.Disconnect(context.Background())
+	}()
+
+	// list all database names that start with the given prefix
+	names, err := client.ListDatabaseNames(ctx, bson.M{"name": bson.M{"$regex": primitive.Regex{
+		Pattern: fmt.Sprintf("^%v", regexp.QuoteMeta(prefix)),
+	}}})
+	if err != nil {
+		return nil, errors.AddContext(err, "could not list databases")
+	}
+
+	// collect the stale databases, the creation time is encoded in the suffix
+	var stale []string
+	cutoff := time.Now().Add(-olderThan)
+	for _, name := range names {
+		createdAt, ok := testDatabaseCreatedAt(name)
+		if ok && createdAt.Before(cutoff) {
+			stale = append(stale, name)
+		}
+	}
+
+	// drop them
+	err = dropTestDatabases(ctx, stale...)
+	if err != nil {
+		return nil, err
+	}
+	return stale, nil
+}
+
+// dropTestDatabases drops the test databases with given names.
+func dropTestDatabases(ctx context.Context, names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	client, err := newTestClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = client.Disconnect(context.Background())
+	}()
+
+	var errs []error
+	for _, name := range names {
+		err := client.Database(name).Drop(ctx)
+		if err != nil {
+			errs = append(errs, errors.AddContext(err, fmt.Sprintf("could not drop database %v", name)))
+		}
+	}
+	return errors.Compose(errs...)
+}
+
+// newTestClient returns a client that is connected to the test database
+// server.
+func newTestClient(ctx context.Context) (*mongo.Client, error) {
+	opts := options.Client().ApplyURI(test.MongoDBURI()).SetAuth(options.Credential{
+		Username: test.MongoDBUsername,
+		Password: test.MongoDBPassword,
+	})
+	client, err := mongo.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// testDatabaseName returns a unique database name for the given name. It
+// sanitizes the name so it only contains characters mongo allows in database
+// names and appends a unique suffix, which holds the creation time of the
+// database.
+func testDatabaseName(name string) string {
+	name = invalidDBNameChars.ReplaceAllString(name, "_")
+	if len(name) > maxTestDBNamePrefixLen {
+		name = name[:maxTestDBNamePrefixLen]
+	}
+	return fmt.Sprintf("%v_%v", name, primitive.NewObjectID().Hex())
+}
+
+// testDatabaseCreatedAt returns the creation time of the test database with
+// the given name, the boolean indicates whether the name is a valid test
+// database name.
+func testDatabaseCreatedAt(name string) (time.Time, bool) {
+	sep := strings.LastIndex(name, "_")
+	if sep == -1 {
+		return time.Time{}, false
+	}
+	oid, err := primitive.ObjectIDFromHex(name[sep+1:])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return oid.Timestamp(), true
+}
+
 // Close will disconnect from the database
 func (db *AbuseScannerDB) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
@@ -200,6 +451,83 @@ func (db *AbuseScannerDB) Close() error {
 	return db.staticClient.Disconnect(ctx)
 }
 
+// CountSkipsByReason returns the amount of skipped emails per skip reason. Only
+// emails that were inserted within the given window are taken into account, if
+// the window is zero all skipped emails are counted.
+func (db *AbuseScannerDB) CountSkipsByReason(window time.Duration) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	// build the filter
+	filter := bson.M{"skip": true}
+	if window > 0 {
+		filter["inserted_at"] = bson.M{"$gte": time.Now().UTC().Add(-window)}
+	}
+
+	// group the skipped emails by their skip reason
+	collEmails := db.staticDatabase.Collection(collEmails)
+	cursor, err := collEmails.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$skip_reason",
+			"count": bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "could not aggregate skipped emails")
+	}
+
+	var results []struct {
+		Reason string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}
+	err = cursor.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "could not decode skip counts")
+	}
+
+	counts := make(map[string]int64, len(results))
+	for _, result := range results {
+		counts[result.Reason] = result.Count
+	}
+	return counts, nil
+}
+
+// ForEachEmail calls the given function for every email that was inserted
+// within the given time range, ordered by the time they were inserted. The
+// emails are streamed from the database, which makes it suitable for exporting
+// large amounts of emails. Iteration stops at the first error returned by the
+// given function.
+func (db *AbuseScannerDB) ForEachEmail(ctx context.Context, from, to time.Time, fn func(email AbuseEmail) error) error {
+	collEmails := db.staticDatabase.Collection(collEmails)
+	cursor, err := collEmails.Find(ctx, bson.M{
+		"inserted_at": bson.M{"$gte": from, "$lt": to},
+	}, options.Find().SetSort(bson.D{{Key: "inserted_at", Value: 1}}))
+	if err != nil {
+		return errors.AddContext(err, "could not retrieve emails")
+	}
+	defer func() {
+		_ = cursor.Close(context.Background())
+	}()
+
+	for cursor.Next(ctx) {
+		var email AbuseEmail
+		err = cursor.Decode(&email)
+		if err != nil {
+			qErr := db.quarantine(ctx, collEmails.Name(), cursor.Current, err)
+			if qErr != nil {
+				db.staticLogger.Errorf("failed to quarantine email that failed to decode, err: %v, decode err: %v", qErr, err)
+			}
+			continue
+		}
+		err = fn(email)
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
 // FindOne returns the message with given uid
 func (db *AbuseScannerDB) FindOne(emailUid string) (*AbuseEmail, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
@@ -222,6 +550,176 @@ func (db *AbuseScannerDB) FindOne(emailUid string) (*AbuseEmail, error) {
 	return &email, nil
 }
 
+// FindOneByMessageID returns the message with given Message-ID that was
+// fetched from the given mailbox, it returns nil if the message ID is empty or
+// if no such message exists.
+func (db *AbuseScannerDB) FindOneByMessageID(mailbox, messageID string) (*AbuseEmail, error) {
+	if messageID == "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	collEmails := db.staticDatabase.Collection(collEmails)
+	res := collEmails.FindOne(ctx, bson.M{
+		"email_mailbox":    mailbox,
+		"email_message_id": messageID,
+	})
+	if isDocumentNotFound(res.Err()) {
+		return nil, nil
+	}
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	var email AbuseEmail
+	err := res.Decode(&email)
+	if err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+// FindInflightCopy returns the earliest prior copy of the given email that was
+// still in flight when the given email got inserted, meaning it was inserted
+// within the given window before the email and it was not finalized yet at
+// the time. If matchMessageID is true, copies are matched on their message id,
+// otherwise they are matched on their sender and the set of skylinks they
+// report. It returns nil if the email has no in-flight copy.
+func (db *AbuseScannerDB) FindInflightCopy(email AbuseEmail, matchMessageID bool, window time.Duration) (*AbuseEmail, error) {
+	filter := bson.M{
+		"email_uid": bson.M{"$ne": email.UID},
+		"skip":      false,
+		"inserted_at": bson.M{
+			"$gte": email.InsertedAt.Add(-window),
+			"$lte": email.InsertedAt,
+		},
+		"$or": bson.A{
+			bson.M{"finalized": false},
+			bson.M{"finalized_at": bson.M{"$gte": email.InsertedAt}},
+		},
+	}
+	if matchMessageID {
+		if email.MessageID == "" {
+			return nil, nil
+		}
+		filter["email_message_id"] = email.MessageID
+	} else {
+		skylinks := email.ParseResult.Skylinks
+		if len(skylinks) == 0 {
+			return nil, nil
+		}
+		filter["email_from"] = email.From
+		filter["parse_result.skylinks"] = bson.M{
+			"$all":  skylinks,
+			"$size": len(skylinks),
+		}
+	}
+
+	copies, err := db.find(filter)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find in-flight copies")
+	}
+
+	// only consider the copies that precede the email, copies inserted at
+	// the same time are ordered by their id
+	var inflight *AbuseEmail
+	for i := range copies {
+		c := copies[i]
+		if !precedes(c, email) {
+			continue
+		}
+		if inflight == nil || precedes(c, *inflight) {
+			inflight = &c
+		}
+	}
+	return inflight, nil
+}
+
+// FindRecentlyBlocked returns which of the given skylinks got blocked within
+// the given window, i.e. were blocked while blocking an email that was blocked
+// since then. Only a block result of AbuseStatusBlocked counts, a skylink that
+// was recorded as already blocked does not, so the window starts at the last
+// time the skylink was submitted to the blocker API. Emails that were blocked
+// in dry-run mode are ignored.
+func (db *AbuseScannerDB) FindRecentlyBlocked(skylinks []string, window time.Duration) (map[string]struct{}, error) {
+	recent := make(map[string]struct{})
+	if len(skylinks) == 0 {
+		return recent, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	// only the skylinks and their block results are fetched
+	collEmails := db.staticDatabase.Collection(collEmails)
+	cursor, err := collEmails.Find(ctx, bson.M{
+		"blocked":               true,
+		"blocked_at":            bson.M{"$gte": time.Now().UTC().Add(-window)},
+		"dry_run":               bson.M{"$ne": true},
+		"parse_result.skylinks": bson.M{"$in": skylinks},
+	}, options.Find().SetProjection(bson.M{
+		"block_result":          1,
+		"parse_result.skylinks": 1,
+	}))
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find recently blocked emails")
+	}
+	var emails []struct {
+		BlockResult []string `bson:"block_result"`
+		ParseResult struct {
+			Skylinks []string `bson:"skylinks"`
+		} `bson:"parse_result"`
+	}
+	err = cursor.All(ctx, &emails)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode recently blocked emails")
+	}
+
+	wanted := make(map[string]struct{}, len(skylinks))
+	for _, skylink := range skylinks {
+		wanted[skylink] = struct{}{}
+	}
+	for _, email := range emails {
+		if len(email.BlockResult) != len(email.ParseResult.Skylinks) {
+			continue
+		}
+		for i, skylink := range email.ParseResult.Skylinks {
+			if _, exists := wanted[skylink]; exists && email.BlockResult[i] == AbuseStatusBlocked {
+				recent[skylink] = struct{}{}
+			}
+		}
+	}
+	return recent, nil
+}
+
+// FindSkylinkTags returns the tags of all blocked emails that reported the
+// given skylink, sorted alphabetically. It allows merging the tags of a
+// skylink that got reported multiple times under different tags.
+func (db *AbuseScannerDB) FindSkylinkTags(skylink string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	collEmails := db.staticDatabase.Collection(collEmails)
+	values, err := collEmails.Distinct(ctx, "parse_result.tags", bson.M{
+		"blocked":               true,
+		"parse_result.skylinks": skylink,
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "could not find tags for skylink")
+	}
+
+	tags := make([]string, 0, len(values))
+	for _, value := range values {
+		if tag, ok := value.(string); ok {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
 // FindUnblocked returns the messages that have not been blocked.
 func (db *AbuseScannerDB) FindUnblocked() ([]AbuseEmail, error) {
 	emails, err := db.find(bson.M{
@@ -235,19 +733,70 @@ func (db *AbuseScannerDB) FindUnblocked() ([]AbuseEmail, error) {
 	return emails, nil
 }
 
-// FindUnfinalized returns the messages that have not been finalized.
+// FindBlockFailed returns the blocked messages of which at least one skylink
+// failed to get blocked.
+func (db *AbuseScannerDB) FindBlockFailed() ([]AbuseEmail, error) {
+	emails, err := db.find(bson.M{
+		"blocked":      true,
+		"block_result": AbuseStatusNotBlocked,
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find emails that failed to get blocked")
+	}
+	return emails, nil
+}
+
+// FindUnfinalized returns the messages in the given mailbox that have not been
+// finalized, if the mailbox is empty it returns those of all mailboxes.
 func (db *AbuseScannerDB) FindUnfinalized(mailbox string) ([]AbuseEmail, error) {
+	filter := bson.M{
+		"parsed":    true,
+		"blocked":   true,
+		"finalized": false,
+	}
+	if mailbox != "" {
+		filter["email_uid"] = bson.M{"$regex": primitive.Regex{
+			Pattern: fmt.Sprintf("^%v-", mailbox),
+		}}
+	}
+	emails, err := db.find(filter)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find unfinalized emails")
+	}
+	return emails, nil
+}
+
+// FindReplyHeld returns the finalized messages for which the reply to the
+// reporter was held back, they await a manual review.
+func (db *AbuseScannerDB) FindReplyHeld() ([]AbuseEmail, error) {
+	emails, err := db.find(bson.M{
+		"finalized":  true,
+		"reply_held": true,
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find emails with a held reply")
+	}
+	return emails, nil
+}
+
+// FindNCMECUnnotified returns the finalized messages in the given mailbox that
+// were reported to NCMEC since the given time, but of which the reporter was not
+// notified yet. The NCMEC reports of these messages are not necessarily filed.
+func (db *AbuseScannerDB) FindNCMECUnnotified(mailbox string, since time.Time) ([]AbuseEmail, error) {
 	emails, err := db.find(bson.M{
 		"email_uid": bson.M{"$regex": primitive.Regex{
 			Pattern: fmt.Sprintf("^%v-", mailbox),
 		}},
 
-		"parsed":    true,
-		"blocked":   true,
-		"finalized": false,
+		"finalized":      true,
+		"reported":       true,
+		"reported_at":    bson.M{"$gte": since},
+		"dry_run":        bson.M{"$ne": true},
+		"ncmec_notified": bson.M{"$ne": true},
+		"reply_held":     bson.M{"$ne": true},
 	})
 	if err != nil {
-		return nil, errors.AddContext(err, "failed to find unfinalized emails")
+		return nil, errors.AddContext(err, "failed to find unnotified emails")
 	}
 	return emails, nil
 }
@@ -265,14 +814,29 @@ func (db *AbuseScannerDB) FindUnparsed() ([]AbuseEmail, error) {
 	return emails, nil
 }
 
+// FindNeedsReview returns the parsed messages that need a manual review before
+// they can be reported.
+func (db *AbuseScannerDB) FindNeedsReview() ([]AbuseEmail, error) {
+	emails, err := db.find(bson.M{
+		"parsed":                    true,
+		"parse_result.needs_review": true,
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to find emails that need review")
+	}
+	return emails, nil
+}
+
 // FindUnreported returns the messages that have the 'csam' tag but have not
-// been reported to NCMEC.
+// been reported to NCMEC. Messages that need a manual review are excluded.
 func (db *AbuseScannerDB) FindUnreported() ([]AbuseEmail, error) {
 	emails, err := db.find(bson.M{
 		"parsed":   true,
 		"reported": false,
 
 		"parse_result.tags": "csam",
+
+		"parse_result.needs_review": bson.M{"$ne": true},
 	})
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to find unblocked emails")
@@ -280,17 +844,243 @@ func (db *AbuseScannerDB) FindUnreported() ([]AbuseEmail, error) {
 	return emails, nil
 }
 
-// Purge removes all documents from the emails and locks collection
+// Purge removes all documents from the emails, locks, reports, quarantine,
+// switches and skytransfer resolutions collection
 func (db *AbuseScannerDB) Purge(ctx context.Context) error {
 	collEmails := db.staticDatabase.Collection(collEmails)
 	collLocks := db.staticDatabase.Collection(collLocks)
 	collReports := db.staticDatabase.Collection(collNCMECReports)
+	collQuarantine := db.staticDatabase.Collection(collQuarantine)
+	collSwitches := db.staticDatabase.Collection(collSwitches)
+	collResolutions := db.staticDatabase.Collection(collSkyTransferResolutions)
 
 	_, purgeEmailsErr := collEmails.DeleteMany(ctx, bson.M{})
 	_, purgeLocksErr := collLocks.DeleteMany(ctx, bson.M{})
 	_, purgeReportsErr := collReports.DeleteMany(ctx, bson.M{})
+	_, purgeQuarantineErr := collQuarantine.DeleteMany(ctx, bson.M{})
+	_, purgeSwitchesErr := collSwitches.DeleteMany(ctx, bson.M{})
+	_, purgeResolutionsErr := collResolutions.DeleteMany(ctx, bson.M{})
+
+	return errors.Compose(purgeEmailsErr, purgeLocksErr, purgeReportsErr, purgeQuarantineErr, purgeSwitchesErr, purgeResolutionsErr)
+}
+
+// Reparse resets the email with given uid to the state it was in right after
+// it was fetched, discarding the parse and block results. The email is picked
+// up by the parser again, after which it is blocked and the reporter receives
+// a reply containing the new results. This is useful after the parser was
+// improved or when an email was parsed incorrectly.
+func (db *AbuseScannerDB) Reparse(uid string) error {
+	set, unset := reparseFields()
+	return db.managedReset(uid, bson.M{
+		"$set":   set,
+		"$unset": unset,
+	})
+}
+
+// Refetch overwrites the email with the uid of the given email with the given
+// email, which was fetched from the mailbox again, and resets it like Reparse.
+// The fetched fields are overwritten, the id and the time the email was first
+// inserted are kept. An email that was skipped is no longer skipped. If the
+// email does not exist yet it's inserted. This is useful if a prior fetch
+// stored a truncated or corrupted body.
+func (db *AbuseScannerDB) Refetch(email AbuseEmail) (err error) {
+	lock := db.NewLock(email.UID)
+
+	// acquire a lock on the email UID and defer an unlock
+	err = lock.Lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unLockErr := lock.Unlock()
+		err = errors.Compose(err, unLockErr)
+	}()
+
+	existing, err := db.FindOne(email.UID)
+	if err != nil {
+		return errors.AddContext(err, "could not find email")
+	}
+	if existing == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+		defer cancel()
+		_, err = db.staticDatabase.Collection(collEmails).InsertOne(ctx, email)
+		return err
+	}
+
+	// overwrite the fetched fields and reset the email like Reparse, an email
+	// that was skipped is no longer skipped
+	fetched := bson.M{
+		"email_body":       email.Body,
+		"email_from":       email.From,
+		"email_message_id": email.MessageID,
+		"email_reply_to":   email.ReplyTo,
+		"email_subject":    email.Subject,
+		"email_to":         email.To,
+		"email_uid_raw":    email.UIDRaw,
+		"inserted_by":      email.InsertedBy,
+		"refetched_at":     time.Now().UTC(),
+		"source":           email.Source,
+
+		"skip": false,
+	}
+	set, unset := reparseFields()
+	for field, value := range fetched {
+		set[field] = value
+	}
+	unset["skip_reason"] = ""
+	return db.UpdateNoLock(*existing, bson.M{
+		"$set":   set,
+		"$unset": unset,
+	})
+}
+
+// Requeue resets the email with given uid so it gets blocked and finalized
+// again using its current parse result. This is useful to retry emails for
+// which blocking failed, or for which the reply was never sent.
+func (db *AbuseScannerDB) Requeue(uid string) error {
+	return db.managedReset(uid, bson.M{
+		"$set": bson.M{
+			"blocked":   false,
+			"finalized": false,
+		},
+		"$unset": bson.M{
+			"block_result":    "",
+			"blocker_results": "",
+			"dry_run":         "",
+			"duplicate_of":    "",
+			"reply_held":      "",
+		},
+	})
+}
 
-	return errors.Compose(purgeEmailsErr, purgeLocksErr, purgeReportsErr)
+// reparseFields returns the fields to set and the fields to unset to reset an
+// email to the state it was in right after it was fetched, discarding the parse
+// and block results. It's shared by Reparse and Refetch, every call returns new
+// maps so the caller can extend them.
+func reparseFields() (set, unset bson.M) {
+	set = bson.M{
+		"parsed":    false,
+		"blocked":   false,
+		"finalized": false,
+	}
+	unset = bson.M{
+		"block_result":    "",
+		"blocker_results": "",
+		"dry_run":         "",
+		"duplicate_of":    "",
+		"parse_result":    "",
+		"reply_held":      "",
+		"resolution_log":  "",
+	}
+	return set, unset
+}
+
+// SuppressReply marks the email with given uid so the reporter does not get the
+// automated reply once it's finalized, it returns an error if the email does
+// not exist or if it was finalized already.
+func (db *AbuseScannerDB) SuppressReply(uid string) (err error) {
+	lock := db.NewLock(uid)
+
+	// acquire a lock on the email UID and defer an unlock
+	err = lock.Lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unLockErr := lock.Unlock()
+		err = errors.Compose(err, unLockErr)
+	}()
+
+	email, err := db.FindOne(uid)
+	if err != nil {
+		return errors.AddContext(err, "could not find email")
+	}
+	if email == nil {
+		return errors.AddContext(ErrEmailNotFound, uid)
+	}
+	if email.Finalized {
+		return errors.AddContext(ErrEmailFinalized, uid)
+	}
+	return db.UpdateNoLock(*email, bson.M{
+		"$set": bson.M{"reply_suppressed": true},
+	})
+}
+
+// managedReset applies the given update to the email with given uid, it
+// returns an error if the email does not exist or if it was skipped.
+func (db *AbuseScannerDB) managedReset(uid string, update bson.M) (err error) {
+	lock := db.NewLock(uid)
+
+	// acquire a lock on the email UID and defer an unlock
+	err = lock.Lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unLockErr := lock.Unlock()
+		err = errors.Compose(err, unLockErr)
+	}()
+
+	email, err := db.FindOne(uid)
+	if err != nil {
+		return errors.AddContext(err, "could not find email")
+	}
+	if email == nil {
+		return errors.AddContext(ErrEmailNotFound, uid)
+	}
+	if email.Skip {
+		return errors.AddContext(ErrEmailSkipped, uid)
+	}
+	return db.UpdateNoLock(*email, update)
+}
+
+// PurgeTestData removes all test data from the database, unlike Purge it leaves
+// real data intact, which makes it safe to use on a shared database. Test data
+// are emails with a UID that starts with TestUIDPrefix, NCMEC reports that
+// were created in debug mode and all reports that belong to a test email. It
+// returns the amount of emails and reports that were removed.
+func (db *AbuseScannerDB) PurgeTestData(ctx context.Context) (emails int64, reports int64, err error) {
+	collEmails := db.staticDatabase.Collection(collEmails)
+	collReports := db.staticDatabase.Collection(collNCMECReports)
+
+	// collect the ids of all test emails
+	cursor, err := collEmails.Find(ctx, bson.M{
+		"email_uid": bson.M{"$regex": primitive.Regex{
+			Pattern: fmt.Sprintf("^%v", regexp.QuoteMeta(TestUIDPrefix)),
+		}},
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "could not find test emails")
+	}
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "could not decode test emails")
+	}
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+
+	// remove the reports first, that way we never leave reports behind that
+	// point to an email that no longer exists
+	res, err := collReports.DeleteMany(ctx, bson.M{"$or": []bson.M{
+		{"report_debug": true},
+		{"email_id": bson.M{"$in": ids}},
+	}})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "could not purge test reports")
+	}
+	reports = res.DeletedCount
+
+	res, err = collEmails.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, reports, errors.AddContext(err, "could not purge test emails")
+	}
+	emails = res.DeletedCount
+	return emails, reports, nil
 }
 
 // find is a function that retrieves emails based on the given filter. It's a
@@ -311,15 +1101,27 @@ func (db *AbuseScannerDB) find(filter interface{}) ([]AbuseEmail, error) {
 		var email AbuseEmail
 		err = cursor.Decode(&email)
 		if err != nil {
-			db.staticLogger.Error("failed to parse email", err)
+			qErr := db.quarantine(ctx, collEmails.Name(), cursor.Current, err)
+			if qErr != nil {
+				db.staticLogger.Errorf("failed to quarantine email that failed to decode, err: %v, decode err: %v", qErr, err)
+			}
 			continue
 		}
 		emails = append(emails, email)
 	}
 
+	sortByPriority(emails, db.staticOptions.TagPriorities)
 	return emails, nil
 }
 
+// sortByPriority sorts the given emails by descending priority, emails with the
+// same priority keep their order.
+func sortByPriority(emails []AbuseEmail, priorities map[string]int) {
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].ParseResult.Priority(priorities) > emails[j].ParseResult.Priority(priorities)
+	})
+}
+
 // InsertOne inserts the given email into the database
 func (db *AbuseScannerDB) InsertOne(email AbuseEmail) (err error) {
 	lock := db.NewLock(email.UID)
@@ -386,20 +1188,58 @@ func (db *AbuseScannerDB) newLockCustom(resourceName, lockID string) *abuseLock
 
 // UpdateNoLock will update the given email, this method does not lock the given
 // email as it is expected for the caller to have acquired the lock.
-func (db *AbuseScannerDB) UpdateNoLock(email AbuseEmail, update interface{}) (err error) {
+//
+// The update is conditioned on the version of the given email, and increments
+// it, if the email has been updated in the meantime ErrVersionMismatch is
+// returned.
+func (db *AbuseScannerDB) UpdateNoLock(email AbuseEmail, update bson.M) (err error) {
 	// create a context with default timeout
 	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
 	defer cancel()
 
 	collEmails := db.staticDatabase.Collection(collEmails)
-	_, err = collEmails.UpdateOne(ctx, bson.M{"email_uid": email.UID}, update)
+	res, err := collEmails.UpdateOne(ctx, bson.M{
+		"email_uid": email.UID,
+		"version":   versionFilter(email.Version),
+	}, withVersionIncrement(update))
 	if err != nil {
 		return err
 	}
+	if res.MatchedCount == 0 {
+		return ErrVersionMismatch
+	}
 
 	return nil
 }
 
+// UpdateNoLockRetry will update the given email, if the update fails because
+// the email was updated concurrently it reloads the email and retries the
+// update using the current version. Before retrying, the given done function is
+// called with the current state of the email, if it returns true the update is
+// no longer necessary, e.g. because another process already performed it, and
+// we return without updating the email.
+func (db *AbuseScannerDB) UpdateNoLockRetry(email AbuseEmail, update bson.M, done func(current AbuseEmail) bool) error {
+	for retry := 0; ; retry++ {
+		err := db.UpdateNoLock(email, update)
+		if !errors.Contains(err, ErrVersionMismatch) || retry >= db.staticOptions.MaxUpdateRetries {
+			return err
+		}
+
+		// reload the email
+		current, err := db.FindOne(email.UID)
+		if err != nil {
+			return errors.AddContext(err, "could not reload email")
+		}
+		if current == nil {
+			return fmt.Errorf("email %v not found", email.UID)
+		}
+		if done != nil && done(*current) {
+			return nil
+		}
+		email = *current
+	}
+}
+
 // Lock exclusively locks the lock. It returns handler.ErrFileLocked if the
 // email is already locked and it will put an expiration time on the lock in
 // case the server dies while the file is locked. That way emails won't remain
@@ -438,6 +1278,44 @@ func (l *abuseLock) Unlock() error {
 	}
 }
 
+// precedes is a helper function that returns true if email a got inserted
+// before email b, emails that got inserted at the same time are ordered by
+// their id.
+func precedes(a, b AbuseEmail) bool {
+	if !a.InsertedAt.Equal(b.InsertedAt) {
+		return a.InsertedAt.Before(b.InsertedAt)
+	}
+	return a.ID.Hex() < b.ID.Hex()
+}
+
+// versionFilter is a helper function that returns the filter value that matches
+// the given email version. Emails that were inserted before we versioned them
+// don't have a version field, so we match those as version zero.
+func versionFilter(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
+
+// withVersionIncrement is a helper function that returns a copy of the given
+// update that increments the email version.
+func withVersionIncrement(update bson.M) bson.M {
+	inc := bson.M{"version": 1}
+	if existing, ok := update["$inc"].(bson.M); ok {
+		for k, v := range existing {
+			inc[k] = v
+		}
+	}
+
+	updated := make(bson.M, len(update)+1)
+	for k, v := range update {
+		updated[k] = v
+	}
+	updated["$inc"] = inc
+	return updated
+}
+
 // isDocumentNotFound is a helper function that returns whether the given error
 // contains the mongo documents not found error message.
 func isDocumentNotFound(err error) bool {
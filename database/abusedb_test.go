@@ -1,12 +1,16 @@
 package database
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -33,7 +37,7 @@ func TestAbuseScannerDB(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
 	defer cancel()
 
-	db, err := NewTestAbuseScannerDB(ctx, t.Name())
+	db, err := NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -47,14 +51,34 @@ func TestAbuseScannerDB(t *testing.T) {
 		name string
 		test func(ctx context.Context, t *testing.T, db *AbuseScannerDB)
 	}{
+		{
+			name: "CountSkipsByReason",
+			test: testCountSkipsByReason,
+		},
+		{
+			name: "CountUnfiledReports",
+			test: testCountUnfiledReports,
+		},
+		{
+			name: "FindBlockFailed",
+			test: testFindBlockFailed,
+		},
 		{
 			name: "FindUnblocked",
 			test: testFindUnblocked,
 		},
+		{
+			name: "UpdateConcurrent",
+			test: testUpdateConcurrent,
+		},
 		{
 			name: "FindUnfinalized",
 			test: testFindUnfinalized,
 		},
+		{
+			name: "FindPriority",
+			test: testFindPriority,
+		},
 		{
 			name: "FindUnparsed",
 			test: testFindUnparsed,
@@ -63,6 +87,42 @@ func TestAbuseScannerDB(t *testing.T) {
 			name: "FindUnreported",
 			test: testFindUnreported,
 		},
+		{
+			name: "LeaderLease",
+			test: testLeaderLease,
+		},
+		{
+			name: "PauseSwitch",
+			test: testPauseSwitch,
+		},
+		{
+			name: "PurgeTestData",
+			test: testPurgeTestData,
+		},
+		{
+			name: "Quarantine",
+			test: testQuarantine,
+		},
+		{
+			name: "Refetch",
+			test: testRefetch,
+		},
+		{
+			name: "ReparseRequeue",
+			test: testReparseRequeue,
+		},
+		{
+			name: "SkyTransferResolutions",
+			test: testSkyTransferResolutions,
+		},
+		{
+			name: "SuppressReply",
+			test: testSuppressReply,
+		},
+		{
+			name: "TimeSeries",
+			test: testTimeSeries,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -71,6 +131,148 @@ func TestAbuseScannerDB(t *testing.T) {
 	}
 }
 
+// testCountSkipsByReason is a unit test for the method CountSkipsByReason.
+func testCountSkipsByReason(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert there are no skips
+	counts, err := db.CountSkipsByReason(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Fatal("unexpected counts", counts)
+	}
+
+	// insert a couple of skipped emails
+	for _, reason := range []string{
+		SkipReasonNoBody,
+		SkipReasonNoBody,
+		SkipReasonScannerOrigin,
+	} {
+		email := newTestEmail()
+		email.Skip = true
+		email.SkipReason = reason
+		err = db.InsertOne(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// insert an old skipped email
+	email := newTestEmail()
+	email.Skip = true
+	email.SkipReason = SkipReasonDuplicate
+	email.InsertedAt = time.Now().UTC().Add(-48 * time.Hour)
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert an email that was not skipped
+	err = db.InsertOne(newTestEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the counts within a window of one day
+	counts, err = db.CountSkipsByReason(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts[SkipReasonNoBody] != 2 || counts[SkipReasonScannerOrigin] != 1 {
+		t.Fatal("unexpected counts", counts)
+	}
+
+	// assert the counts without a window
+	counts, err = db.CountSkipsByReason(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 3 || counts[SkipReasonDuplicate] != 1 {
+		t.Fatal("unexpected counts", counts)
+	}
+}
+
+// testCountUnfiledReports is a unit test for the method CountUnfiledReports.
+func testCountUnfiledReports(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a filed report, two pending reports and a failed report
+	for _, report := range []NCMECReport{
+		{Filed: true},
+		{Filed: false},
+		{Filed: false},
+		{Filed: false, FiledErr: "status 500"},
+	} {
+		report.ID = primitive.NewObjectID()
+		err = db.InsertReport(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending, failed, err := db.CountUnfiledReports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 2 || failed != 1 {
+		t.Fatalf("unexpected counts, %v != 2 or %v != 1", pending, failed)
+	}
+
+	// assert the pending reports are the ones that get filed
+	unfiled, err := db.FindUnfiledReports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(unfiled)) != pending {
+		t.Fatalf("unexpected amount of unfiled reports, %v != %v", len(unfiled), pending)
+	}
+}
+
+// testFindBlockFailed is a unit test for the method FindBlockFailed.
+func testFindBlockFailed(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert an email that got blocked, and one of which a skylink failed to
+	// get blocked
+	blocked := newTestEmail()
+	blocked.Parsed = true
+	blocked.Blocked = true
+	blocked.BlockResult = []string{AbuseStatusBlocked, AbuseStatusBlocked}
+	err = db.InsertOne(blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := newTestEmail()
+	failed.Parsed = true
+	failed.Blocked = true
+	failed.Finalized = true
+	failed.BlockResult = []string{AbuseStatusBlocked, AbuseStatusNotBlocked}
+	err = db.InsertOne(failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert only the failed email is returned
+	emails, err := db.FindBlockFailed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].UID != failed.UID {
+		t.Fatal("unexpected emails", emails)
+	}
+}
+
 // testFindUnblocked is a unit test for the method FindUnblocked.
 func testFindUnblocked(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
 	err := db.Purge(ctx)
@@ -97,6 +299,53 @@ func testFindUnblocked(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
 	}
 }
 
+// testFindPriority verifies the emails are returned by descending priority, the
+// emails with high-severity tags are returned before the others.
+func testFindPriority(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert emails with mixed severities, low-severity ones first
+	var expected []string
+	var low []string
+	for _, tags := range [][]string{
+		{"phishing"},
+		{"csam"},
+		nil,
+		{"phishing", "terrorism"},
+		{"malware"},
+	} {
+		email := newTestEmail()
+		email.Parsed = true
+		email.ParseResult.Tags = tags
+		err = db.InsertOne(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if email.ParseResult.Priority(DefaultTagPriorities) > 0 {
+			expected = append(expected, email.UID)
+		} else {
+			low = append(low, email.UID)
+		}
+	}
+	expected = append(expected, low...)
+
+	// assert the high-severity emails are returned first, in query order
+	emails, err := db.FindUnblocked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uids []string
+	for _, email := range emails {
+		uids = append(uids, email.UID)
+	}
+	if !reflect.DeepEqual(uids, expected) {
+		t.Fatalf("unexpected order, %v != %v", uids, expected)
+	}
+}
+
 // testFindUnfinalized is a unit test for the method FindUnfinalized.
 func testFindUnfinalized(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
 	err := db.Purge(ctx)
@@ -141,6 +390,42 @@ func testFindUnfinalized(ctx context.Context, t *testing.T, db *AbuseScannerDB)
 	if err := assertUnfinalizedCount(0, "UNKNOWN"); err != nil {
 		t.Fatal(err)
 	}
+
+	// insert an email in another inbox and assert it's only returned if we
+	// don't filter by inbox
+	other := newTestEmail()
+	other.UID = "OTHER-" + other.UID
+	other.Parsed = true
+	other.Blocked = true
+	err = db.InsertOne(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertUnfinalizedCount(1, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertUnfinalizedCount(2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a finalized email for which the reply was held
+	email = newTestEmail()
+	email.Parsed = true
+	email.Blocked = true
+	email.Finalized = true
+	email.ReplyHeld = true
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert it awaits review but is not unfinalized
+	if err := assertCount(db.FindReplyHeld, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertUnfinalizedCount(1, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
 }
 
 // testFindUnparsed is a unit test for the method FindUnparsed.
@@ -234,7 +519,12 @@ func testFindUnreported(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
 		t.Fatal(err)
 	}
 
-	// update the email to be reported
+	// update the email to be reported, we reload it first since the previous
+	// update incremented its version
+	first, err = db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
 	err = db.UpdateNoLock(*first, bson.M{
 		"$set": bson.M{
 			"reported": true,
@@ -263,6 +553,428 @@ func testFindUnreported(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
 	if err := assertCount(db.FindUnreported, 0); err != nil {
 		t.Fatal(err)
 	}
+
+	// insert a csam email that needs a manual review
+	email = newTestEmail()
+	email.Parsed = true
+	email.Reported = false
+	email.ParseResult = AbuseReport{Tags: []string{"csam"}, NeedsReview: true, ReviewReason: "conflict"}
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert it's not reported but awaits review
+	if err := assertCount(db.FindUnreported, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertCount(db.FindNeedsReview, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPurgeTestData is a unit test for the method PurgeTestData.
+func testPurgeTestData(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a real email and a test email
+	email := newTestEmail()
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEmail := newTestEmail()
+	testEmail.UID = TestUIDPrefix + testEmail.UID
+	err = db.InsertOne(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a regular and a debug report for the real email, and a regular
+	// report for the test email
+	realReport := NCMECReport{ID: primitive.NewObjectID(), EmailID: email.ID}
+	for _, report := range []NCMECReport{
+		realReport,
+		{ID: primitive.NewObjectID(), EmailID: email.ID, ReportDebug: true},
+		{ID: primitive.NewObjectID(), EmailID: testEmail.ID},
+	} {
+		err = db.InsertReport(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// purge the test data
+	emails, reports, err := db.PurgeTestData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails != 1 || reports != 2 {
+		t.Fatalf("unexpected amount of purged documents, %v != 1 or %v != 2", emails, reports)
+	}
+
+	// assert only the test data was removed
+	exists, err := db.Exists(email.UID)
+	if err != nil || !exists {
+		t.Fatal("expected real email to exist", err)
+	}
+	exists, err = db.Exists(testEmail.UID)
+	if err != nil || exists {
+		t.Fatal("expected test email to be purged", err)
+	}
+	remaining, err := db.FindReports(email.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].ID != realReport.ID {
+		t.Fatal("unexpected reports", remaining)
+	}
+	remaining, err = db.FindReports(testEmail.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Fatal("unexpected reports", remaining)
+	}
+
+	// purging again should be a no-op
+	emails, reports, err = db.PurgeTestData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails != 0 || reports != 0 {
+		t.Fatalf("unexpected amount of purged documents, %v != 0 or %v != 0", emails, reports)
+	}
+}
+
+// testRefetch is a unit test for the method Refetch.
+func testRefetch(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a finalized email with a truncated body
+	email := newTestEmail()
+	email.Body = []byte("Subject: Phishing\n\nhttps://siasky.net/")
+	email.Parsed = true
+	email.ParseResult = AbuseReport{Tags: []string{"phishing"}}
+	email.Blocked = true
+	email.BlockerResults = []BlockerResult{{Blocker: "http://blocker:4000", Result: []string{"blocked"}}}
+	email.DuplicateOf = "INBOX-1-0"
+	email.Finalized = true
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// refetch the email, it should be overwritten and parsed again
+	refetched := newTestEmail()
+	refetched.UID = email.UID
+	refetched.Body = []byte("Subject: Phishing\n\nhttps://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g")
+	err = db.Refetch(refetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertCount(db.FindUnparsed, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.ID != email.ID || !bytes.Equal(current.Body, refetched.Body) || current.RefetchedAt.IsZero() {
+		t.Fatal("unexpected email after refetch", current)
+	}
+	if current.Parsed || current.Blocked || current.Finalized || len(current.ParseResult.Tags) != 0 {
+		t.Fatal("unexpected email after refetch", current)
+	}
+	if len(current.BlockerResults) != 0 || current.DuplicateOf != "" {
+		t.Fatal("unexpected email after refetch", current)
+	}
+
+	// refetch a skipped email, it should no longer be skipped
+	skipped := newTestEmail()
+	skipped.Parsed = true
+	skipped.Blocked = true
+	skipped.Finalized = true
+	skipped.Skip = true
+	skipped.SkipReason = SkipReasonNoBody
+	err = db.InsertOne(skipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refetched.UID = skipped.UID
+	err = db.Refetch(refetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err = db.FindOne(skipped.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Skip || current.SkipReason != "" || current.Parsed {
+		t.Fatal("unexpected email after refetch", current)
+	}
+
+	// refetch an unknown email, it should be inserted
+	unknown := newTestEmail()
+	err = db.Refetch(unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertCount(db.FindUnparsed, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testReparseRequeue is a unit test for the methods Reparse and Requeue.
+func testReparseRequeue(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a finalized email and a skipped email
+	email := newTestEmail()
+	email.Parsed = true
+	email.ParseResult = AbuseReport{Skylinks: []string{"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"}, Tags: []string{"phishing"}}
+	email.Blocked = true
+	email.BlockResult = []string{"failed"}
+	email.BlockerResults = []BlockerResult{{Blocker: "http://blocker:4000", Result: []string{"failed"}}}
+	email.DuplicateOf = "INBOX-1-0"
+	email.Finalized = true
+	email.DryRun = true
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := newTestEmail()
+	skipped.Parsed = true
+	skipped.Blocked = true
+	skipped.Finalized = true
+	skipped.Skip = true
+	err = db.InsertOne(skipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// requeue the email, it should be blocked again using its parse result
+	err = db.Requeue(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertCount(db.FindUnblocked, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.Parsed || current.Blocked || current.Finalized || current.DryRun || len(current.BlockResult) != 0 || len(current.ParseResult.Skylinks) != 1 {
+		t.Fatal("unexpected email after requeue", current)
+	}
+	if len(current.BlockerResults) != 0 || current.DuplicateOf != "" {
+		t.Fatal("unexpected email after requeue", current)
+	}
+
+	// reparse the email after it got blocked again, it should discard the
+	// results of the blocker APIs and the duplicate it was a copy of
+	err = db.UpdateNoLock(*current, bson.M{"$set": bson.M{
+		"blocked":         true,
+		"blocker_results": email.BlockerResults,
+		"duplicate_of":    email.DuplicateOf,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reparse the email, it should be parsed again from scratch
+	err = db.Reparse(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertCount(db.FindUnparsed, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err = db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Parsed || current.Blocked || current.Finalized || len(current.ParseResult.Skylinks) != 0 {
+		t.Fatal("unexpected email after reparse", current)
+	}
+	if len(current.BlockerResults) != 0 || current.DuplicateOf != "" {
+		t.Fatal("unexpected email after reparse", current)
+	}
+
+	// assert skipped and unknown emails can't be reset
+	err = db.Reparse(skipped.UID)
+	if !errors.Contains(err, ErrEmailSkipped) {
+		t.Fatal("unexpected error", err)
+	}
+	err = db.Requeue("INBOX-unknown")
+	if !errors.Contains(err, ErrEmailNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testSuppressReply is a unit test for the method SuppressReply.
+func testSuppressReply(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a blocked email and a finalized email
+	email := newTestEmail()
+	email.Parsed = true
+	email.Blocked = true
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finalized := newTestEmail()
+	finalized.Parsed = true
+	finalized.Blocked = true
+	finalized.Finalized = true
+	err = db.InsertOne(finalized)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// suppress the reply and assert it's persisted
+	err = db.SuppressReply(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.ReplySuppressed || current.Finalized {
+		t.Fatal("unexpected email after suppressing the reply", current)
+	}
+
+	// assert finalized and unknown emails are rejected
+	err = db.SuppressReply(finalized.UID)
+	if !errors.Contains(err, ErrEmailFinalized) {
+		t.Fatal("unexpected error", err)
+	}
+	err = db.SuppressReply("INBOX-unknown")
+	if !errors.Contains(err, ErrEmailNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testUpdateConcurrent verifies that concurrent updates to the same email are
+// detected through the email version, and that stale updates are retried.
+func testUpdateConcurrent(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert an email
+	email := newTestEmail()
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate two workers that both loaded the same version of the email
+	first, err := db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := *first
+
+	// update the email from the first worker
+	err = db.UpdateNoLock(*first, bson.M{"$set": bson.M{"parsed": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the update from the second worker is rejected
+	err = db.UpdateNoLock(second, bson.M{"$set": bson.M{"blocked": true}})
+	if err != ErrVersionMismatch {
+		t.Fatal("expected version mismatch", err)
+	}
+
+	// assert the second worker does not retry if the work was already done
+	err = db.UpdateNoLockRetry(second, bson.M{"$set": bson.M{"parsed_by": "second"}}, func(current AbuseEmail) bool {
+		return current.Parsed
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ParsedBy != "" || updated.Version != 1 {
+		t.Fatal("unexpected update", updated.ParsedBy, updated.Version)
+	}
+
+	// assert the second worker retries the update if the work is not done
+	err = db.UpdateNoLockRetry(second, bson.M{"$set": bson.M{"blocked": true}}, func(current AbuseEmail) bool {
+		return current.Blocked
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err = db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Parsed || !updated.Blocked || updated.Version != 2 {
+		t.Fatal("unexpected update", updated.Parsed, updated.Blocked, updated.Version)
+	}
+}
+
+// TestTestDatabaseName is a unit test that covers the testDatabaseName and
+// testDatabaseCreatedAt helpers.
+func TestTestDatabaseName(t *testing.T) {
+	t.Parallel()
+
+	// assert the name is sanitized and unique
+	name1 := testDatabaseName("TestFoo/Bar baz.qux")
+	name2 := testDatabaseName("TestFoo/Bar baz.qux")
+	if name1 == name2 {
+		t.Fatal("expected unique names", name1)
+	}
+	if !strings.HasPrefix(name1, "TestFoo_Bar_baz_qux_") {
+		t.Fatal("unexpected name", name1)
+	}
+
+	// assert long names are truncated
+	name := testDatabaseName(strings.Repeat("a", 100))
+	if len(name) >= 64 {
+		t.Fatal("unexpected name length", len(name))
+	}
+
+	// assert we can extract the creation time
+	createdAt, ok := testDatabaseCreatedAt(name1)
+	if !ok {
+		t.Fatal("expected valid test database name")
+	}
+	if time.Since(createdAt) > time.Minute {
+		t.Fatal("unexpected creation time", createdAt)
+	}
+
+	// assert regular databases are not considered test databases
+	for _, name := range []string{"admin", "abuse-scanner", "local", "foo_bar"} {
+		if _, ok := testDatabaseCreatedAt(name); ok {
+			t.Fatal("unexpected test database", name)
+		}
+	}
 }
 
 // TestHasTag is a simple unit test that covers the functionality of the HasTag
@@ -282,6 +994,32 @@ func TestHasTag(t *testing.T) {
 	}
 }
 
+// TestSortByPriority verifies emails are sorted by the highest priority of
+// their tags, and that emails with the same priority keep their order.
+func TestSortByPriority(t *testing.T) {
+	t.Parallel()
+
+	priorities := map[string]int{"csam": 2, "terrorism": 1, "spam": -1}
+	emails := []AbuseEmail{
+		{UID: "spam", ParseResult: AbuseReport{Tags: []string{"spam"}}},
+		{UID: "phishing", ParseResult: AbuseReport{Tags: []string{"phishing"}}},
+		{UID: "terrorism", ParseResult: AbuseReport{Tags: []string{"phishing", "terrorism"}}},
+		{UID: "untagged"},
+		{UID: "csam", ParseResult: AbuseReport{Tags: []string{"terrorism", "csam"}}},
+		{UID: "spam-phishing", ParseResult: AbuseReport{Tags: []string{"spam", "phishing"}}},
+	}
+	sortByPriority(emails, priorities)
+
+	var uids []string
+	for _, email := range emails {
+		uids = append(uids, email.UID)
+	}
+	expected := []string{"csam", "terrorism", "phishing", "untagged", "spam-phishing", "spam"}
+	if !reflect.DeepEqual(uids, expected) {
+		t.Fatalf("unexpected order, %v != %v", uids, expected)
+	}
+}
+
 // newTestEmail returns a test email object
 func newTestEmail() AbuseEmail {
 	emailUIDMu.Lock()
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"abuse-scanner/version"
 	"fmt"
 	"strings"
 	"time"
@@ -16,9 +17,77 @@ const (
 	// AbuseStatusNotBlocked denotes the not blocked status.
 	AbuseStatusNotBlocked = "NOT BLOCKED"
 
+	// AbuseStatusAlreadyBlocked denotes the status of skylinks that were not
+	// submitted to the blocker API because they got blocked recently, while
+	// blocking a prior email.
+	AbuseStatusAlreadyBlocked = "ALREADY BLOCKED"
+
+	// AbuseStatusDryRun denotes the status of skylinks that were not blocked
+	// because the scanner runs in dry-run mode.
+	AbuseStatusDryRun = "DRY RUN"
+
 	// AbuseDefaultTag is the tag used when there are no tags found in the email
 	AbuseDefaultTag = "abusive"
 
+	// SkylinkSourceAttachment is the source of skylinks that were extracted
+	// from a text attachment of the email.
+	SkylinkSourceAttachment = "attachment"
+
+	// SkylinkSourceBody is the source of skylinks that were extracted from the
+	// plain text body of the email.
+	SkylinkSourceBody = "body"
+
+	// SkylinkSourceEvidence is the source of skylinks that were extracted from
+	// an evidence document linked in the email.
+	SkylinkSourceEvidence = "evidence"
+
+	// SkylinkSourceHeader is the source of skylinks that were extracted from
+	// the email headers, other than the subject.
+	SkylinkSourceHeader = "header"
+
+	// SkylinkSourceHTML is the source of skylinks that were extracted from the
+	// HTML body of the email.
+	SkylinkSourceHTML = "html"
+
+	// SkylinkSourceShortener is the source of skylinks that were found by
+	// expanding a short URL of an allowlisted URL shortener.
+	SkylinkSourceShortener = "shortener"
+
+	// SkylinkSourceSkyTransfer is the source of skylinks that were resolved
+	// from a SkyTransfer URL found in the email.
+	SkylinkSourceSkyTransfer = "skytransfer"
+
+	// SkylinkSourceSubject is the source of skylinks that were extracted from
+	// the email subject.
+	SkylinkSourceSubject = "subject"
+
+	// EmailSourceAPI is the source of emails that were submitted through the
+	// HTTP API.
+	EmailSourceAPI = "api"
+
+	// EmailSourceIMAP is the source of emails that were fetched from the
+	// mailbox.
+	EmailSourceIMAP = "imap"
+
+	// EmailSourceWebhook is the source of emails that were received through a
+	// webhook.
+	EmailSourceWebhook = "webhook"
+
+	// SkipReasonDuplicate is the skip reason used for emails that are a
+	// duplicate of an email that was already processed.
+	SkipReasonDuplicate = "duplicate"
+
+	// SkipReasonNoBody is the skip reason used for emails without a body.
+	SkipReasonNoBody = "no_body"
+
+	// SkipReasonScannerOrigin is the skip reason used for emails that were
+	// sent by the abuse scanner itself.
+	SkipReasonScannerOrigin = "scanner_origin"
+
+	// SkipReasonUnlistedRecipient is the skip reason used for emails that
+	// were not addressed to any of the allowed recipients.
+	SkipReasonUnlistedRecipient = "unlisted_recipient"
+
 	// responseLegalNotice is a small notice we append to the automated response
 	// that mentions we do not store any content on our servers
 	responseLegalNotice = `
@@ -35,20 +104,39 @@ type (
 	AbuseEmail struct {
 		// fields set by fetcher
 		ID        primitive.ObjectID `bson:"_id"`
+		Version   int                `bson:"version"`
 		UID       string             `bson:"email_uid"`
 		UIDRaw    uint32             `bson:"email_uid_raw"`
 		Body      []byte             `bson:"email_body"`
 		MessageID string             `bson:"email_message_id"`
 		Subject   string             `bson:"email_subject"`
 
+		// Mailbox is the name of the mailbox the email was fetched from
+		Mailbox string `bson:"email_mailbox"`
+
+		// Source is the ingestion source that created the email, e.g.
+		// EmailSourceIMAP, it's empty for emails that were inserted before
+		// the source was recorded
+		Source string `bson:"source,omitempty"`
+
 		From    string `bson:"email_from"`
 		ReplyTo string `bson:"email_reply_to"`
 		To      string `bson:"email_to"`
 
+		// ReplyToken is the encrypted reply address of an email of which the
+		// reporter's PII got redacted, From and ReplyTo then only contain a
+		// pseudonym of the reporter's addresses
+		ReplyToken string `bson:"reply_token,omitempty"`
+
 		InsertedBy string    `bson:"inserted_by"`
 		InsertedAt time.Time `bson:"inserted_at"`
 
-		Skip bool `bson:"skip"`
+		// RefetchedAt is the time the email was last fetched from the mailbox
+		// again by an operator, it's zero if it never was, see Refetch
+		RefetchedAt time.Time `bson:"refetched_at,omitempty"`
+
+		Skip       bool   `bson:"skip"`
+		SkipReason string `bson:"skip_reason"`
 
 		// fields set by parser
 		Parsed      bool        `bson:"parsed"`
@@ -56,21 +144,64 @@ type (
 		ParsedBy    string      `bson:"parsed_by"`
 		ParseResult AbuseReport `bson:"parse_result"`
 
+		// ResolutionLog is the (bounded) raw output of the SkyTransfer
+		// resolver, it is only set if the resolution failed
+		ResolutionLog string `bson:"resolution_log,omitempty"`
+
 		// fields set by blocker
 		Blocked     bool      `bson:"blocked"`
 		BlockedAt   time.Time `bson:"blocked_at"`
 		BlockedBy   string    `bson:"blocked_by"`
 		BlockResult []string  `bson:"block_result"`
 
+		// BlockerResults contains the block result of every blocker API the
+		// skylinks were blocked on, it's only set if the blocker is
+		// configured with more than one blocker API. The BlockResult then
+		// aggregates these results, a skylink is only considered blocked if
+		// it got blocked on all of them.
+		BlockerResults []BlockerResult `bson:"blocker_results,omitempty"`
+
+		// DuplicateOf is the uid of the email of which this email is a copy,
+		// it is set by the blocker if the email arrived while its copy was
+		// still in flight and the block result of that copy got merged into
+		// this email. The reporter gets no reply to a duplicate.
+		DuplicateOf string `bson:"duplicate_of,omitempty"`
+
+		// DryRun indicates the email was blocked, finalized or reported in
+		// dry-run mode, meaning the skylinks were not blocked, no emails were
+		// sent and no NCMEC reports were filed, it's set by the blocker, the
+		// finalizer and the reporter
+		DryRun bool `bson:"dry_run,omitempty"`
+
 		// fields set by finalizer
 		Finalized   bool      `bson:"finalized"`
 		FinalizedAt time.Time `bson:"finalized_at"`
 		FinalizedBy string    `bson:"finalized_by"`
 
+		// ReplyHeld indicates the automated reply to the reporter was held
+		// back because the email was parsed with low confidence, these
+		// emails await a manual review before the reporter gets a reply.
+		ReplyHeld bool `bson:"reply_held,omitempty"`
+
+		// ReplySuppressed indicates an operator suppressed the automated
+		// reply to the reporter, the email is finalized as usual but the
+		// reporter never gets a reply.
+		ReplySuppressed bool `bson:"reply_suppressed,omitempty"`
+
+		// NCMECNotified indicates the reporter was notified that the email
+		// was reported to NCMEC, which only happens for trusted reporters
+		// once all of its NCMEC reports have been filed.
+		NCMECNotified bool `bson:"ncmec_notified,omitempty"`
+
 		// fields set by reporter
 		Reported   bool      `bson:"reported"`
 		ReportedAt time.Time `bson:"reported_at"`
 		ReportedBy string    `bson:"reported_by"`
+
+		// ReportLookupFailures contains the skylinks for which the uploader
+		// lookup failed while building the NCMEC reports, these skylinks are
+		// reported anonymously.
+		ReportLookupFailures []string `bson:"report_lookup_failures"`
 	}
 
 	// AbuseReport contains all information about an abuse report.
@@ -79,6 +210,51 @@ type (
 		Reporter AbuseReporter `bson:"reporter"`
 		Sponsor  string        `bson:"sponsor"`
 		Tags     []string      `bson:"tags"`
+
+		// SkylinkSources records, per skylink, the extraction method that
+		// found it, e.g. body, html or subject.
+		SkylinkSources map[string]string `bson:"skylink_sources,omitempty"`
+
+		// SkyTransferURLs records, per skylink that was resolved from a
+		// SkyTransfer URL, the URL it was resolved from. A single URL can
+		// resolve to many skylinks, e.g. when it points to a folder.
+		SkyTransferURLs map[string]string `bson:"skytransfer_urls,omitempty"`
+
+		// NeedsReview indicates the report has conflicting signals, e.g. a
+		// high-severity tag on what appears to be a discussion of our policy.
+		// These reports are not reported automatically but need a manual
+		// review, the reason is recorded in ReviewReason.
+		NeedsReview  bool   `bson:"needs_review,omitempty"`
+		ReviewReason string `bson:"review_reason,omitempty"`
+
+		// LowConfidence indicates the skylinks were only found as loose
+		// tokens, rather than in links, and no tags were found in the email.
+		LowConfidence bool `bson:"low_confidence,omitempty"`
+
+		// ParseTimedOut indicates the parsing of the email exceeded the parse
+		// timeout, the report only contains the skylinks and tags that were
+		// found before it timed out.
+		ParseTimedOut bool `bson:"parse_timed_out,omitempty"`
+
+		// AuthChecked indicates the parser checked the Authentication-Results
+		// header our mail server added to the email, DKIMPass and SPFPass
+		// then indicate whether the email passed DKIM and SPF respectively,
+		// for a domain that aligns with the domain of the From address.
+		AuthChecked bool `bson:"auth_checked,omitempty"`
+		DKIMPass    bool `bson:"dkim_pass,omitempty"`
+		SPFPass     bool `bson:"spf_pass,omitempty"`
+
+		// Portal is the URL of the portal the skylinks were reported on, it's
+		// detected from the links in the email. It's empty if the email does
+		// not link to any of our portals.
+		Portal string `bson:"portal,omitempty"`
+	}
+
+	// BlockerResult contains the block result of a single blocker API, in the
+	// order of the skylinks of the parse result.
+	BlockerResult struct {
+		Blocker string   `bson:"blocker"`
+		Result  []string `bson:"result"`
 	}
 
 	// AbuseReporter encapsulates some information about the reporter.
@@ -86,11 +262,31 @@ type (
 		Name         string `bson:"name"`
 		Email        string `bson:"email"`
 		OtherContact string `bson:"other_contact"`
+		ReporterOrg  string `bson:"reporter_org"`
+
+		// NoReply indicates the email has no sender we can reply to, which
+		// is the case for automated submissions with an empty envelope. The
+		// email is still blocked and reported, but the reporter is never
+		// replied to. The email of the reporter is the fallback contact, if
+		// one is configured.
+		NoReply bool `bson:"no_reply,omitempty"`
+	}
+
+	// ResponseOptions contains the options of the automated responses.
+	ResponseOptions struct {
+		// GroupSkyTransfer indicates whether the skylinks that were resolved
+		// from a SkyTransfer URL are listed under that URL, alongside the
+		// amount of skylinks it resolved to, rather than as separate links.
+		GroupSkyTransfer bool
+
+		// Templates are the templates the response is built from, they
+		// default to the English ones.
+		Templates ResponseTemplates
 	}
 )
 
 // Response returns an automated Response for this abuse email
-func (a AbuseEmail) Response() string {
+func (a AbuseEmail) Response(opts ResponseOptions) string {
 	// sanity check
 	if !a.Parsed || !a.Blocked {
 		build.Critical("result should only be called when the email has been parsed and blocked")
@@ -99,41 +295,105 @@ func (a AbuseEmail) Response() string {
 
 	// fetch which skylinks were blocked and which ones weren't
 	blocked, unblocked := a.result()
+	templates := opts.Templates.withDefaults()
 
 	// if no skylinks were found, return another version of the template
 	if len(blocked) == 0 && len(unblocked) == 0 {
-		return fmt.Sprintf(`
-Hello,
-
-we have processed your report but were unable to find any valid links.
-Please verify the link is not corrupted as we need it in order to prevent access to it from our portals.
-%s
-`, responseLegalNotice)
+		return fmt.Sprintf("\n%s\n\n%s\n%s\n", templates.Greeting, templates.NoLinks, templates.legalNotice())
 	}
 
 	// build the response template
 	var sb strings.Builder
-	sb.WriteString("Hello,\n\n")
+	sb.WriteString(templates.Greeting + "\n\n")
 
 	if len(blocked) > 0 {
-		sb.WriteString(fmt.Sprintf("the following links were identified and blocked on all of our servers as of %v\n\n", a.BlockedAt.Format(time.RFC1123)))
-		for _, skylink := range blocked {
-			sb.WriteString(fmt.Sprintf("- %s\n", skylink))
-		}
+		sb.WriteString(templates.blocked(a.BlockedAt.Format(time.RFC1123)) + "\n\n")
+		a.writeResponseSkylinks(&sb, blocked, opts, "all blocked")
 	}
 
 	if len(unblocked) > 0 {
-		sb.WriteString("\nthe following links could not be blocked:\n\n")
-		for _, skylink := range unblocked {
-			sb.WriteString(fmt.Sprintf("- %s\n", skylink))
+		sb.WriteString("\n" + templates.Unblocked + "\n\n")
+		a.writeResponseSkylinks(&sb, unblocked, opts, "none blocked")
+	}
+
+	sb.WriteString(templates.legalNotice())
+	return sb.String()
+}
+
+// DigestResponse returns a single automated response for the given abuse
+// emails, it summarizes the links that were blocked per email. The emails are
+// expected to be sent by the same reporter.
+func DigestResponse(emails []AbuseEmail, opts ResponseOptions) string {
+	templates := opts.Templates.withDefaults()
+	var sb strings.Builder
+	sb.WriteString(templates.Greeting + "\n\n")
+	sb.WriteString(templates.digestProcessed(len(emails)) + "\n")
+
+	for _, email := range emails {
+		// sanity check
+		if !email.Parsed || !email.Blocked {
+			build.Critical("digest response should only be built for emails that have been parsed and blocked")
+			continue
+		}
+
+		blocked, unblocked := email.result()
+		sb.WriteString("\n" + templates.digestReport(email.Subject) + "\n")
+		if len(blocked) == 0 && len(unblocked) == 0 {
+			sb.WriteString(templates.DigestNoLinks + "\n")
+			continue
 		}
+		if len(blocked) > 0 {
+			sb.WriteString(templates.blocked(email.BlockedAt.Format(time.RFC1123)) + "\n\n")
+			email.writeResponseSkylinks(&sb, blocked, opts, "all blocked")
+		}
+		if len(unblocked) > 0 {
+			sb.WriteString("\n" + templates.Unblocked + "\n\n")
+			email.writeResponseSkylinks(&sb, unblocked, opts, "none blocked")
+		}
+	}
+
+	sb.WriteString(templates.legalNotice())
+	return sb.String()
+}
+
+// NCMECResponse returns the follow-up that notifies the reporter that the
+// content they reported was reported to NCMEC in the reports with given ids.
+// It deliberately contains no details about the content nor its uploader.
+func NCMECResponse(reportIDs []uint64) string {
+	ids := make([]string, len(reportIDs))
+	for i, id := range reportIDs {
+		ids[i] = fmt.Sprint(id)
 	}
 
-	sb.WriteString(responseLegalNotice)
+	var sb strings.Builder
+	sb.WriteString("Hello,\n\n")
+	sb.WriteString("as a follow-up to your report, we would like to let you know the content you reported has been reported to the National Center for Missing & Exploited Children (NCMEC).\n\n")
+	if len(ids) == 1 {
+		sb.WriteString(fmt.Sprintf("NCMEC report ID: %s\n", ids[0]))
+	} else {
+		sb.WriteString(fmt.Sprintf("NCMEC report IDs: %s\n", strings.Join(ids, ", ")))
+	}
+	sb.WriteString("\nThank you for your report.\n")
 	return sb.String()
 }
 
-// result returns which skylinks were blocked and which we failed to block
+// extractionFailure returns the reason the extraction of the skylinks from
+// the email failed, it returns an empty string if the extraction succeeded,
+// meaning an email without skylinks contained no links to begin with, e.g. a
+// reply in a thread.
+func (a AbuseEmail) extractionFailure() string {
+	switch {
+	case a.ParseResult.ParseTimedOut:
+		return "parsing the email timed out"
+	case a.ResolutionLog != "":
+		return "the SkyTransfer URLs could not be resolved"
+	default:
+		return ""
+	}
+}
+
+// result returns which skylinks were blocked and which we failed to block, the
+// skylinks that were already blocked count as blocked
 func (a AbuseEmail) result() ([]string, []string) {
 	// sanity check
 	if !a.Parsed || !a.Blocked {
@@ -145,7 +405,7 @@ func (a AbuseEmail) result() ([]string, []string) {
 	var blocked []string
 	var unblocked []string
 	for i, skylink := range a.ParseResult.Skylinks {
-		if a.BlockResult[i] == AbuseStatusBlocked {
+		if isBlockedStatus(a.BlockResult[i]) {
 			blocked = append(blocked, skylink)
 		} else {
 			unblocked = append(unblocked, skylink)
@@ -154,14 +414,86 @@ func (a AbuseEmail) result() ([]string, []string) {
 	return blocked, unblocked
 }
 
+// alreadyBlocked returns the amount of skylinks that were not submitted to the
+// blocker API because they got blocked recently.
+func (a AbuseEmail) alreadyBlocked() int {
+	var count int
+	for _, result := range a.BlockResult {
+		if result == AbuseStatusAlreadyBlocked {
+			count++
+		}
+	}
+	return count
+}
+
+// writeResponseSkylinks writes the given skylinks of the email to the given
+// response as a list. If the options group the SkyTransfer skylinks, the
+// skylinks that were resolved from a SkyTransfer URL are listed under that URL
+// instead, after the other skylinks. The given status is appended to the URLs
+// of which all skylinks are in the list, e.g. "all blocked".
+func (a AbuseEmail) writeResponseSkylinks(sb *strings.Builder, skylinks []string, opts ResponseOptions, status string) {
+	var urls []string
+	grouped := make(map[string][]string)
+	for _, skylink := range skylinks {
+		url, exists := a.ParseResult.SkyTransferURLs[skylink]
+		if !opts.GroupSkyTransfer || !exists {
+			sb.WriteString(fmt.Sprintf("- %s\n", skylink))
+			continue
+		}
+		if _, exists := grouped[url]; !exists {
+			urls = append(urls, url)
+		}
+		grouped[url] = append(grouped[url], skylink)
+	}
+
+	// count the skylinks every URL resolved to
+	resolved := make(map[string]int)
+	for _, url := range a.ParseResult.SkyTransferURLs {
+		resolved[url]++
+	}
+
+	for _, url := range urls {
+		if len(grouped[url]) == resolved[url] {
+			sb.WriteString(fmt.Sprintf("- %v resolved from %s, %s\n", pluralizeFiles(resolved[url]), url, status))
+		} else {
+			sb.WriteString(fmt.Sprintf("- %v of the %v resolved from %s\n", len(grouped[url]), pluralizeFiles(resolved[url]), url))
+		}
+		for _, skylink := range grouped[url] {
+			sb.WriteString(fmt.Sprintf("  - %s\n", skylink))
+		}
+	}
+}
+
+// pluralizeFiles is a helper function that returns the given amount of files
+// in words, e.g. "1 file" or "3 files".
+func pluralizeFiles(n int) string {
+	if n == 1 {
+		return "1 file"
+	}
+	return fmt.Sprintf("%v files", n)
+}
+
+// HasSender returns true if the email has an address we can reply to, either
+// in the ReplyTo or in the From header. Automated submissions sometimes have
+// an empty envelope, in which case neither holds an address.
+func (a AbuseEmail) HasSender() bool {
+	return a.ReplyToEmail() != ""
+}
+
 // ReplyToEmail is a helper function that returns the email address to which a
 // reply has to be sent. By default it returns the field from the ReplyTo header
-// but it falls back to the From field if that was empty
+// but it falls back to the From field if that was empty. It returns an empty
+// string if neither holds an address. If the reporter's PII got redacted this
+// returns a pseudonym, the actual reply address is encrypted in the reply
+// token.
 func (a AbuseEmail) ReplyToEmail() string {
-	if a.ReplyTo != "" {
+	if isAddress(a.ReplyTo) {
 		return a.ReplyTo
 	}
-	return a.From
+	if isAddress(a.From) {
+		return a.From
+	}
+	return ""
 }
 
 // String returns a string representation of the abuse email
@@ -174,10 +506,18 @@ func (a AbuseEmail) String() string {
 
 	// write summary
 	sb.WriteString("\nSummary:\n")
-	if len(blocked) == 0 && len(unblocked) == 0 {
-		sb.WriteString("FAILURE - no skylinks found.\n")
+	if a.DryRun {
+		sb.WriteString("DRY RUN - no skylinks blocked, no replies sent.\n")
+	} else if len(blocked) == 0 && len(unblocked) == 0 {
+		if reason := a.extractionFailure(); reason != "" {
+			sb.WriteString(fmt.Sprintf("FAILURE - no skylinks found, %v.\n", reason))
+		} else {
+			sb.WriteString("NO LINKS - no skylinks found, nothing to block.\n")
+		}
 	} else if len(unblocked) != 0 {
 		sb.WriteString("FAILURE - not all skylinks blocked.\n")
+	} else if alreadyBlocked := a.alreadyBlocked(); alreadyBlocked > 0 {
+		sb.WriteString(fmt.Sprintf("SUCCESS - all skylinks blocked, %v of %v were already blocked recently.\n", alreadyBlocked, len(blocked)))
 	} else {
 		sb.WriteString("SUCCESS - all skylinks blocked.\n")
 	}
@@ -185,15 +525,78 @@ func (a AbuseEmail) String() string {
 	// write server info
 	sb.WriteString("\nServer Info:\n")
 	sb.WriteString(fmt.Sprintf("Domain: %v\n", a.InsertedBy))
+	sb.WriteString(fmt.Sprintf("Version: %v\n", version.Current()))
+
+	// write the result per blocker API
+	if len(a.BlockerResults) > 0 {
+		sb.WriteString("\nBlocker Results:\n")
+		for _, br := range a.BlockerResults {
+			var blocked int
+			for _, result := range br.Result {
+				if isBlockedStatus(result) {
+					blocked++
+				}
+			}
+			sb.WriteString(fmt.Sprintf("- %v: %v/%v blocked\n", br.Blocker, blocked, len(br.Result)))
+		}
+	}
 
 	// write reporter info
 	sb.WriteString("\nReporter:\n")
 	sb.WriteString(fmt.Sprintf("Name: %v\n", a.ParseResult.Reporter.Name))
 	sb.WriteString(fmt.Sprintf("Email: %v\n", a.ParseResult.Reporter.Email))
 
+	// write missing sender info
+	if a.ParseResult.Reporter.NoReply {
+		sb.WriteString("\nMissing Sender:\n")
+		sb.WriteString("The email has no From nor Reply-To address, no reply was sent to the reporter.\n")
+	}
+
+	// write review info
+	if a.ParseResult.NeedsReview {
+		sb.WriteString("\nNeeds Review:\n")
+		sb.WriteString(fmt.Sprintf("Reason: %v\n", a.ParseResult.ReviewReason))
+	}
+
+	// write duplicate info
+	if a.DuplicateOf != "" {
+		sb.WriteString("\nDuplicate:\n")
+		sb.WriteString(fmt.Sprintf("Copy of email %v, no reply was sent to the reporter.\n", a.DuplicateOf))
+	}
+
+	// write confidence info
+	if a.ParseResult.LowConfidence {
+		sb.WriteString("\nLow Confidence:\n")
+		sb.WriteString("Skylinks were not found in links and no tags were found.\n")
+		if a.ReplyHeld {
+			sb.WriteString("The reply to the reporter was held for manual review.\n")
+		}
+	}
+
+	// write timeout info
+	if a.ParseResult.ParseTimedOut {
+		sb.WriteString("\nParse Timed Out:\n")
+		sb.WriteString("Parsing the email exceeded the timeout, the skylinks might be incomplete.\n")
+	}
+
+	// write skylink sources
+	if len(a.ParseResult.SkylinkSources) > 0 {
+		sb.WriteString("\nSkylink Sources:\n")
+		for _, skylink := range a.ParseResult.Skylinks {
+			source, exists := a.ParseResult.SkylinkSources[skylink]
+			if !exists {
+				source = "unknown"
+			}
+			if url, exists := a.ParseResult.SkyTransferURLs[skylink]; exists {
+				source = fmt.Sprintf("%v (%v)", source, url)
+			}
+			sb.WriteString(fmt.Sprintf("- %v: %v\n", skylink, source))
+		}
+	}
+
 	// write response template
 	sb.WriteString("\nResponse Template:\n\n")
-	sb.WriteString(a.Response())
+	sb.WriteString(a.Response(ResponseOptions{}))
 	return sb.String()
 }
 
@@ -204,6 +607,22 @@ func (a AbuseEmail) Success() bool {
 	return len(blocked) > 0 && len(unblocked) == 0
 }
 
+// Priority returns the priority of the abuse report, which is the highest of
+// the priorities of its tags in the given mapping. Tags that are not in the
+// mapping have priority 0, as do reports without tags.
+func (ar AbuseReport) Priority(priorities map[string]int) int {
+	if len(ar.Tags) == 0 {
+		return 0
+	}
+	priority := priorities[ar.Tags[0]]
+	for _, tag := range ar.Tags[1:] {
+		if p := priorities[tag]; p > priority {
+			priority = p
+		}
+	}
+	return priority
+}
+
 // HasTag returns true if the abuse report contains the given tag.
 func (ar AbuseReport) HasTag(tag string) bool {
 	for _, arTag := range ar.Tags {
@@ -213,3 +632,19 @@ func (ar AbuseReport) HasTag(tag string) bool {
 	}
 	return false
 }
+
+// isAddress is a helper function that returns true if the given string looks
+// like an email address, i.e. it has both a local part and a domain. An empty
+// envelope address is fetched as '@', which is not an address.
+func isAddress(address string) bool {
+	address = strings.TrimSpace(address)
+	at := strings.LastIndex(address, "@")
+	return at > 0 && at < len(address)-1
+}
+
+// isBlockedStatus is a helper function that returns true if the given block
+// status means the skylink is blocked, which is the case if it got blocked or
+// if it was already blocked.
+func isBlockedStatus(status string) bool {
+	return status == AbuseStatusBlocked || status == AbuseStatusAlreadyBlocked
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"abuse-scanner/version"
 	"fmt"
 	"strings"
 	"testing"
@@ -33,6 +34,10 @@ func TestAbuseEmail(t *testing.T) {
 			name: "Template",
 			test: testTemplate,
 		},
+		{
+			name: "TemplateSkyTransfer",
+			test: testTemplateSkyTransfer,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, test.test)
@@ -62,7 +67,20 @@ func testSender(t *testing.T) {
 
 	// only reply to filled
 	email.From = ""
-	if email.ReplyToEmail() != "john.doe@examle.com" {
+	if email.ReplyToEmail() != "john.doe@examle.com" || !email.HasSender() {
+		t.Fatal("unexpected sender", email.ReplyToEmail())
+	}
+
+	// empty envelope, which is fetched as '@'
+	email.From = "@"
+	email.ReplyTo = "@"
+	if email.ReplyToEmail() != "" || email.HasSender() {
+		t.Fatal("unexpected sender", email.ReplyToEmail())
+	}
+
+	// empty reply to falls back to from
+	email.From = "abuse@siasky.net"
+	if email.ReplyToEmail() != "abuse@siasky.net" {
 		t.Fatal("unexpected sender", email.ReplyToEmail())
 	}
 }
@@ -100,10 +118,21 @@ func testString(t *testing.T) {
 		return strings.Contains(email.String(), s)
 	}
 
-	// check output of the summary
-	if !hasString("FAILURE - no skylinks found") {
+	// check output of the summary, an email without skylinks is only a
+	// failure if the extraction failed
+	if !hasString("NO LINKS - no skylinks found, nothing to block.") {
+		t.Fatal("unexpected", email.String())
+	}
+	email.ParseResult.ParseTimedOut = true
+	if !hasString("FAILURE - no skylinks found, parsing the email timed out.") {
+		t.Fatal("unexpected", email.String())
+	}
+	email.ParseResult.ParseTimedOut = false
+	email.ResolutionLog = "cypress failed"
+	if !hasString("FAILURE - no skylinks found, the SkyTransfer URLs could not be resolved.") {
 		t.Fatal("unexpected", email.String())
 	}
+	email.ResolutionLog = ""
 	email.ParseResult.Skylinks = []string{
 		"BBB6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ",
 		"EAC6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ",
@@ -129,6 +158,7 @@ SUCCESS - all skylinks blocked.
 
 Server Info:
 Domain: some-server.skynetlabs.com
+Version: %v
 
 Reporter:
 Name: Skynetlabs Dev Team
@@ -148,13 +178,49 @@ Therefore we are not to be held accountable for any potential abusive content it
 We will, however, do everything in our power to block access from said content when it gets reported.
 
 Thank you for your report.
-`, blockedAt.Format(time.RFC1123))
+`, version.Current(), blockedAt.Format(time.RFC1123))
 
 	// assert it's identical
 	actual := email.String()
 	if actual != expected {
 		t.Fatal(diff.LineDiff(expected, actual))
 	}
+
+	// assert the skylink sources are listed if they are known
+	email.ParseResult.SkylinkSources = map[string]string{
+		"BBB6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ": SkylinkSourceBody,
+	}
+	if !hasString("\nSkylink Sources:\n- BBB6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ: body\n- EAC6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ: unknown\n") {
+		t.Fatal("unexpected", email.String())
+	}
+
+	// assert the report notes the missing sender
+	if hasString("Missing Sender") {
+		t.Fatal("unexpected", email.String())
+	}
+	email.ParseResult.Reporter.NoReply = true
+	if !hasString("Email: devs@skynetlabs.com\n\nMissing Sender:\nThe email has no From nor Reply-To address, no reply was sent to the reporter.\n") {
+		t.Fatal("unexpected", email.String())
+	}
+
+	// assert the report notes the parsing timed out
+	email.ParseResult.ParseTimedOut = true
+	if !hasString("\nParse Timed Out:\nParsing the email exceeded the timeout, the skylinks might be incomplete.\n\nSkylink Sources:\n") {
+		t.Fatal("unexpected", email.String())
+	}
+
+	// assert the summary mentions the skylinks that were already blocked
+	email.BlockResult = []string{AbuseStatusAlreadyBlocked, AbuseStatusBlocked}
+	if !hasString("\nSummary:\nSUCCESS - all skylinks blocked, 1 of 2 were already blocked recently.\n") {
+		t.Fatal("unexpected", email.String())
+	}
+
+	// assert the summary of an email that was handled in dry-run mode
+	email.DryRun = true
+	email.BlockResult = []string{AbuseStatusDryRun, AbuseStatusDryRun}
+	if !hasString("\nSummary:\nDRY RUN - no skylinks blocked, no replies sent.\n") {
+		t.Fatal("unexpected", email.String())
+	}
 }
 
 // testSuccess is a small unit test that verifies the Success method
@@ -197,6 +263,12 @@ func testSuccess(t *testing.T) {
 	if !email.Success() {
 		t.Fatal("unexpected result")
 	}
+
+	// already blocked case
+	email.BlockResult[0] = AbuseStatusAlreadyBlocked
+	if !email.Success() {
+		t.Fatal("unexpected result")
+	}
 }
 
 // testTemplate verifies the implementation of the response template method on
@@ -241,7 +313,7 @@ Thank you for your report.
 
 `
 	// assert it's identical
-	actual := email.Response()
+	actual := email.Response(ResponseOptions{})
 	if actual != expected {
 		t.Fatal(diff.LineDiff(expected, actual))
 	}
@@ -265,7 +337,7 @@ Thank you for your report.
 `, blockedAt.Format(time.RFC1123))
 
 	// assert it's identical
-	actual = email.Response()
+	actual = email.Response(ResponseOptions{})
 	if actual != expected {
 		t.Fatal("\n" + diff.LineDiff(expected, actual))
 	}
@@ -293,8 +365,97 @@ Thank you for your report.
 `, blockedAt.Format(time.RFC1123))
 
 	// assert it's identical
-	actual = email.Response()
+	actual = email.Response(ResponseOptions{})
+	if actual != expected {
+		t.Fatal(diff.LineDiff(expected, actual))
+	}
+}
+
+// testTemplateSkyTransfer verifies the skylinks that were resolved from a
+// SkyTransfer URL are grouped under that URL in the response, if enabled.
+func testTemplateSkyTransfer(t *testing.T) {
+	t.Parallel()
+
+	// create an email in which a SkyTransfer URL resolved to three skylinks,
+	// alongside a skylink that was reported directly
+	url := "https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63"
+	skylink := "EAC6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ"
+	resolved := []string{
+		"4BHyW37RDVl_I475WfO-5FD8zNOBbSCYJ9U_C9n3yondMw",
+		"AAAFb6q43vcBvF8KByAygTvWEDHW9pq95WyTDrQhPrhqRg",
+		"BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA",
+	}
+	blockedAt := time.Now().UTC()
+	email := AbuseEmail{
+		Blocked:   true,
+		BlockedAt: blockedAt,
+		Parsed:    true,
+		ParseResult: AbuseReport{
+			Skylinks: append([]string{resolved[0], skylink}, resolved[1:]...),
+			SkyTransferURLs: map[string]string{
+				resolved[0]: url,
+				resolved[1]: url,
+				resolved[2]: url,
+			},
+		},
+		BlockResult: []string{AbuseStatusBlocked, AbuseStatusBlocked, AbuseStatusBlocked, AbuseStatusBlocked},
+	}
+
+	// assert the resolved skylinks are listed separately by default
+	actual := email.Response(ResponseOptions{})
+	for _, sl := range append(resolved, skylink) {
+		if !strings.Contains(actual, fmt.Sprintf("\n- %s\n", sl)) {
+			t.Fatal("expected the skylink to be listed separately", sl, actual)
+		}
+	}
+
+	// assert they're grouped under their URL if enabled
+	expected := fmt.Sprintf(`Hello,
+
+the following links were identified and blocked on all of our servers as of %v
+
+- EAC6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ
+- 3 files resolved from https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63, all blocked
+  - 4BHyW37RDVl_I475WfO-5FD8zNOBbSCYJ9U_C9n3yondMw
+  - AAAFb6q43vcBvF8KByAygTvWEDHW9pq95WyTDrQhPrhqRg
+  - BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA
+%s`, blockedAt.Format(time.RFC1123), responseLegalNotice)
+	actual = email.Response(ResponseOptions{GroupSkyTransfer: true})
 	if actual != expected {
 		t.Fatal(diff.LineDiff(expected, actual))
 	}
+
+	// assert a URL of which only some skylinks got blocked is listed in both
+	// sections
+	email.BlockResult[2] = AbuseStatusNotBlocked
+	expected = fmt.Sprintf(`Hello,
+
+the following links were identified and blocked on all of our servers as of %v
+
+- EAC6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ
+- 2 of the 3 files resolved from https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63
+  - 4BHyW37RDVl_I475WfO-5FD8zNOBbSCYJ9U_C9n3yondMw
+  - BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA
+
+the following links could not be blocked:
+
+- 1 of the 3 files resolved from https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63
+  - AAAFb6q43vcBvF8KByAygTvWEDHW9pq95WyTDrQhPrhqRg
+%s`, blockedAt.Format(time.RFC1123), responseLegalNotice)
+	actual = email.Response(ResponseOptions{GroupSkyTransfer: true})
+	if actual != expected {
+		t.Fatal(diff.LineDiff(expected, actual))
+	}
+
+	// assert the digest response groups them too
+	digest := DigestResponse([]AbuseEmail{email}, ResponseOptions{GroupSkyTransfer: true})
+	if !strings.Contains(digest, "- 2 of the 3 files resolved from "+url+"\n") {
+		t.Fatal("unexpected digest response", digest)
+	}
+
+	// assert the URL is part of the skylink sources
+	email.ParseResult.SkylinkSources = map[string]string{resolved[0]: SkylinkSourceSkyTransfer}
+	if !strings.Contains(email.String(), fmt.Sprintf("- %s: skytransfer (%s)\n", resolved[0], url)) {
+		t.Fatal("unexpected string", email.String())
+	}
 }
@@ -3,9 +3,22 @@ package database
 import (
 	"context"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	// collProbe is the name of the collection that is written to when
+	// verifying the database accepts writes, the probe documents are removed
+	// right away
+	collProbe = "probe"
 )
 
 type (
@@ -22,6 +35,41 @@ type (
 	dbSchema map[string][]mongo.IndexModel
 )
 
+// PingMongo connects to the database at the given URI using the given
+// credentials and pings it, it's a lightweight alternative to creating the
+// database when we only want to verify it can be reached.
+func PingMongo(ctx context.Context, uri string, creds options.Credential) (err error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetAuth(creds))
+	if err != nil {
+		return errors.AddContext(err, "failed to connect")
+	}
+	defer func() {
+		err = errors.Compose(err, client.Disconnect(context.Background()))
+	}()
+	return client.Ping(ctx, readpref.Primary())
+}
+
+// Ping verifies the database can be reached.
+func (db *MongoDB) Ping(ctx context.Context) error {
+	return db.staticClient.Ping(ctx, readpref.Primary())
+}
+
+// Probe verifies the database accepts writes, it inserts a document into the
+// probe collection and removes it again.
+func (db *MongoDB) Probe(ctx context.Context) error {
+	coll := db.staticDatabase.Collection(collProbe)
+	id := primitive.NewObjectID()
+	_, err := coll.InsertOne(ctx, bson.M{"_id": id, "inserted_at": time.Now().UTC()})
+	if err != nil {
+		return errors.AddContext(err, "failed to insert probe document")
+	}
+	_, err = coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return errors.AddContext(err, "failed to remove probe document")
+	}
+	return nil
+}
+
 // ensureSchema ensures the given database schema
 func (db *MongoDB) ensureSchema(ctx context.Context, schema dbSchema) error {
 	for collName, models := range schema {
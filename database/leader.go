@@ -0,0 +1,197 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	lock "github.com/square/mongo-lock"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// DefaultLeaderLeaseTTL is the default time-to-live of a leader lease.
+	DefaultLeaderLeaseTTL = 30 * time.Second
+
+	// MinLeaderLeaseTTL is the minimum time-to-live of a leader lease, the
+	// lock library stores the TTL in seconds and refuses to renew a lock
+	// that expires within a second, so shorter leases can't be renewed
+	// reliably.
+	MinLeaderLeaseTTL = 3 * time.Second
+
+	// leaderLeaseRenewals is the amount of times a lease is renewed within
+	// its TTL, a follower tries to acquire the lease at the same frequency
+	// so it takes over within two lease periods after the leader died.
+	leaderLeaseRenewals = 3
+
+	// resourceLeader is the prefix of the resource name used when locking a
+	// cluster-wide job
+	resourceLeader = "leader"
+)
+
+type (
+	// LeaderLease elects a single leader for a job across all instances of
+	// the scanner that share the database. The leader holds a lock on the job
+	// with a TTL that it renews periodically, if it dies the lock expires
+	// and another instance takes over.
+	LeaderLease struct {
+		// leader indicates whether we hold the lease, it's only valid until
+		// expiresAt, which guards against acting as the leader while we're
+		// unable to renew the lease.
+		leader    bool
+		expiresAt time.Time
+		mu        sync.Mutex
+
+		staticCancel    context.CancelFunc
+		staticClient    *lock.Client
+		staticCtx       context.Context
+		staticHost      string
+		staticJob       string
+		staticLockID    string
+		staticLogger    *logrus.Entry
+		staticTTL       time.Duration
+		staticWaitGroup sync.WaitGroup
+	}
+)
+
+// NewLeaderLease returns a leader lease for the job with given name, the lease
+// is maintained until the given context is cancelled or the lease is stopped.
+// If the TTL is zero it defaults to DefaultLeaderLeaseTTL, it's rounded down
+// to a whole amount of seconds.
+func (db *AbuseScannerDB) NewLeaderLease(ctx context.Context, job string, ttl time.Duration) *LeaderLease {
+	if ttl == 0 {
+		ttl = DefaultLeaderLeaseTTL
+	}
+	if ttl < MinLeaderLeaseTTL {
+		ttl = MinLeaderLeaseTTL
+	}
+	ttl = ttl.Truncate(time.Second)
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &LeaderLease{
+		staticCancel: cancel,
+		staticClient: &db.Client,
+		staticCtx:    ctx,
+		staticHost:   db.staticPortalHostName,
+		staticJob:    job,
+		staticLockID: fmt.Sprintf("%s/%s/%s", resourceLeader, job, primitive.NewObjectID().Hex()),
+		staticLogger: db.staticLogger.WithFields(logrus.Fields{
+			"module": "Leader",
+			"job":    job,
+		}),
+		staticTTL: ttl,
+	}
+}
+
+// Start starts maintaining the lease, it tries to acquire the lease right away
+// and keeps renewing it once it's acquired.
+func (l *LeaderLease) Start() error {
+	l.managedUpdateLease()
+
+	l.staticWaitGroup.Add(1)
+	go func() {
+		l.threadedMaintainLease()
+		l.staticWaitGroup.Done()
+	}()
+	return nil
+}
+
+// Stop stops maintaining the lease and steps down if we're the leader, which
+// allows another instance to take over right away rather than after the lease
+// expired.
+func (l *LeaderLease) Stop() error {
+	l.staticCancel()
+	l.staticWaitGroup.Wait()
+	return l.managedStepDown()
+}
+
+// IsLeader returns true if we currently hold the lease.
+func (l *LeaderLease) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader && time.Now().Before(l.expiresAt)
+}
+
+// managedStepDown releases the lease if we hold it.
+func (l *LeaderLease) managedStepDown() error {
+	l.mu.Lock()
+	leader := l.leader
+	l.leader = false
+	l.mu.Unlock()
+	if !leader {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	_, err := l.staticClient.Unlock(ctx, l.staticLockID)
+	if err != nil {
+		return errors.AddContext(err, fmt.Sprintf("failed to step down as leader of job %v", l.staticJob))
+	}
+	l.staticLogger.Info("Stepped down as leader")
+	return nil
+}
+
+// managedUpdateLease renews the lease if we're the leader, or tries to acquire
+// it otherwise. If renewing the lease fails we are no longer the leader.
+func (l *LeaderLease) managedUpdateLease() {
+	ctx, cancel := context.WithTimeout(l.staticCtx, l.staticTTL/leaderLeaseRenewals)
+	defer cancel()
+
+	// the lease expires at the earliest one TTL after we sent the request
+	start := time.Now()
+	ttl := uint(l.staticTTL / time.Second)
+
+	l.mu.Lock()
+	leader := l.leader
+	l.mu.Unlock()
+
+	var err error
+	if leader {
+		_, err = l.staticClient.Renew(ctx, l.staticLockID, ttl)
+	} else {
+		err = l.staticClient.XLock(ctx, fmt.Sprintf("%s/%s", resourceLeader, l.staticJob), l.staticLockID, lock.LockDetails{
+			Owner: lockOwnerName,
+			Host:  l.staticHost,
+			TTL:   ttl,
+		})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case err == nil:
+		if !leader {
+			l.staticLogger.Info("Acquired leadership")
+		}
+		l.leader = true
+		l.expiresAt = start.Add(l.staticTTL)
+	case leader:
+		l.staticLogger.Warnf("Lost leadership, failed to renew the lease, err %v", err)
+		l.leader = false
+	case errors.Contains(err, lock.ErrAlreadyLocked):
+		l.staticLogger.Debugln("Another instance is the leader")
+	default:
+		l.staticLogger.Errorf("Failed to acquire the lease, err %v", err)
+	}
+}
+
+// threadedMaintainLease periodically renews or acquires the lease until the
+// context is cancelled.
+func (l *LeaderLease) threadedMaintainLease() {
+	ticker := time.NewTicker(l.staticTTL / leaderLeaseRenewals)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.staticCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		l.managedUpdateLease()
+	}
+}
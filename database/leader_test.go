@@ -0,0 +1,135 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/build"
+)
+
+// testLeaderLease verifies only one of two instances competing for the same
+// job is the leader, and that the other instance takes over once the leader
+// stops or dies.
+func testLeaderLease(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leaders returns how many of the given leases are the leader
+	leaders := func(leases ...*LeaderLease) (n int) {
+		for _, lease := range leases {
+			if lease.IsLeader() {
+				n++
+			}
+		}
+		return
+	}
+
+	// start two instances, the first one acquires the lease on start
+	ttl := MinLeaderLeaseTTL
+	first := db.NewLeaderLease(ctx, "digest", ttl)
+	err = first.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := db.NewLeaderLease(ctx, "digest", ttl)
+	err = second.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatal("expected the first instance to be the leader")
+	}
+
+	// assert the leases of other jobs are independent
+	other := db.NewLeaderLease(ctx, "ncmec_filing", ttl)
+	err = other.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !other.IsLeader() {
+		t.Fatal("expected the instance to be the leader of another job")
+	}
+	err = other.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert there's a single leader while the first instance renews the
+	// lease for longer than its TTL
+	for start := time.Now(); time.Since(start) < 2*ttl; time.Sleep(100 * time.Millisecond) {
+		if !first.IsLeader() || leaders(first, second) != 1 {
+			t.Fatal("expected the first instance to remain the only leader")
+		}
+	}
+
+	// stop the first instance, the second one takes over
+	start := time.Now()
+	err = first.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.IsLeader() {
+		t.Fatal("expected the first instance to step down")
+	}
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		if !second.IsLeader() {
+			return errors.New("second instance is not the leader")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 2*ttl {
+		t.Fatal("takeover took too long", time.Since(start))
+	}
+
+	// stop the second instance and simulate a new leader dying by stopping
+	// its loop without stepping down, a third instance only takes over once
+	// the lease of the dead instance expired
+	err = second.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dying := db.NewLeaderLease(ctx, "digest", ttl)
+	err = dying.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dying.IsLeader() {
+		t.Fatal("expected the instance to be the leader")
+	}
+	dying.staticCancel()
+	dying.staticWaitGroup.Wait()
+
+	third := db.NewLeaderLease(ctx, "digest", ttl)
+	start = time.Now()
+	err = third.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := third.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if third.IsLeader() {
+		t.Fatal("expected the lease of the dead instance to be held until it expires")
+	}
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		if !third.IsLeader() {
+			return errors.New("third instance is not the leader")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 2*ttl {
+		t.Fatal("takeover took too long", time.Since(start))
+	}
+}
@@ -0,0 +1,13 @@
+package database
+
+import (
+	"abuse-scanner/test/mongotest"
+	"os"
+	"testing"
+)
+
+// TestMain starts a disposable test DB for the tests that touch the database if
+// opted into, see mongotest.Main.
+func TestMain(m *testing.M) {
+	os.Exit(mongotest.Main(m))
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"abuse-scanner/metrics"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// DefaultPauseSwitchInterval is the default interval at which the pause
+	// switch polls the database, it's the maximum amount of time it takes
+	// for all instances to pause after the scanner got paused.
+	DefaultPauseSwitchInterval = 5 * time.Second
+
+	// collSwitches is the name of the collection that contains the switches
+	// that are shared by all instances of the scanner
+	collSwitches = "switches"
+
+	// switchPause is the ID of the document of the pause switch
+	switchPause = "pause"
+)
+
+type (
+	// PauseState is a database entity that contains the state of the global
+	// pause switch, it pauses the processing of all instances of the scanner
+	// that share the database.
+	PauseState struct {
+		Paused    bool      `bson:"paused"`
+		Reason    string    `bson:"reason"`
+		Host      string    `bson:"host"`
+		UpdatedAt time.Time `bson:"updated_at"`
+	}
+
+	// PauseSwitch watches the global pause switch in the database, it polls
+	// the switch periodically and caches its state so it can be checked on
+	// every loop iteration of the modules.
+	PauseSwitch struct {
+		paused bool
+		mu     sync.Mutex
+
+		staticCancel    context.CancelFunc
+		staticCtx       context.Context
+		staticDatabase  *AbuseScannerDB
+		staticInterval  time.Duration
+		staticLogger    *logrus.Entry
+		staticWaitGroup sync.WaitGroup
+	}
+)
+
+// PauseState returns the state of the global pause switch, the scanner is not
+// paused if the switch was never set.
+func (db *AbuseScannerDB) PauseState(ctx context.Context) (PauseState, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoDefaultTimeout)
+	defer cancel()
+
+	var state PauseState
+	coll := db.staticDatabase.Collection(collSwitches)
+	err := coll.FindOne(ctx, bson.M{"_id": switchPause}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return PauseState{}, nil
+	}
+	if err != nil {
+		return PauseState{}, errors.AddContext(err, "could not find the pause switch")
+	}
+	return state, nil
+}
+
+// SetPaused sets the global pause switch, pausing or resuming the processing
+// of all instances of the scanner. The reason is shown to the operators that
+// check why the scanner is paused.
+func (db *AbuseScannerDB) SetPaused(paused bool, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	coll := db.staticDatabase.Collection(collSwitches)
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": switchPause}, bson.M{
+		"$set": PauseState{
+			Paused:    paused,
+			Reason:    reason,
+			Host:      db.staticPortalHostName,
+			UpdatedAt: time.Now().UTC(),
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return errors.AddContext(err, "could not update the pause switch")
+	}
+	return nil
+}
+
+// NewPauseSwitch returns a pause switch that polls the global pause switch at
+// the given interval until the given context is cancelled or the switch is
+// stopped. If the interval is zero it defaults to DefaultPauseSwitchInterval.
+func (db *AbuseScannerDB) NewPauseSwitch(ctx context.Context, interval time.Duration) *PauseSwitch {
+	if interval == 0 {
+		interval = DefaultPauseSwitchInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &PauseSwitch{
+		staticCancel:   cancel,
+		staticCtx:      ctx,
+		staticDatabase: db,
+		staticInterval: interval,
+		staticLogger:   db.staticLogger.WithField("module", "PauseSwitch"),
+	}
+}
+
+// Start polls the pause switch right away, and keeps polling it in a
+// background thread.
+func (s *PauseSwitch) Start() error {
+	s.managedUpdate()
+
+	s.staticWaitGroup.Add(1)
+	go func() {
+		s.threadedPoll()
+		s.staticWaitGroup.Done()
+	}()
+	return nil
+}
+
+// Stop stops polling the pause switch.
+func (s *PauseSwitch) Stop() error {
+	s.staticCancel()
+	s.staticWaitGroup.Wait()
+	return nil
+}
+
+// IsPaused returns true if the scanner is paused.
+func (s *PauseSwitch) IsPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// managedUpdate polls the pause switch, if that fails the switch keeps its
+// last known state.
+func (s *PauseSwitch) managedUpdate() {
+	state, err := s.staticDatabase.PauseState(s.staticCtx)
+	if err != nil {
+		s.staticLogger.Errorf("Failed to poll the pause switch, err %v", err)
+		return
+	}
+	metrics.RecordPaused(state.Paused)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case state.Paused && !s.paused:
+		s.staticLogger.Warnf("Processing paused by %v at %v, reason: '%v'", state.Host, state.UpdatedAt, state.Reason)
+	case !state.Paused && s.paused:
+		s.staticLogger.Infof("Processing resumed by %v at %v", state.Host, state.UpdatedAt)
+	}
+	s.paused = state.Paused
+}
+
+// threadedPoll polls the pause switch periodically until the context is
+// cancelled.
+func (s *PauseSwitch) threadedPoll() {
+	ticker := time.NewTicker(s.staticInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.staticCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.managedUpdate()
+	}
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.sia.tech/siad/build"
+)
+
+// testPauseSwitch verifies the pause switch picks up the scanner getting
+// paused and resumed.
+func testPauseSwitch(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the scanner is not paused if the switch was never set
+	state, err := db.PauseState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Paused {
+		t.Fatal("expected the scanner not to be paused")
+	}
+
+	pause := db.NewPauseSwitch(ctx, 100*time.Millisecond)
+	err = pause.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := pause.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if pause.IsPaused() {
+		t.Fatal("expected the switch not to be paused")
+	}
+
+	// pause the scanner and assert the switch picks it up
+	err = db.SetPaused(true, "false positives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = db.PauseState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Paused || state.Reason != "false positives" || state.Host != db.staticPortalHostName || state.UpdatedAt.IsZero() {
+		t.Fatal("unexpected state", state)
+	}
+	err = build.Retry(50, 100*time.Millisecond, func() error {
+		if !pause.IsPaused() {
+			return errors.New("switch is not paused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resume the scanner and assert the switch picks it up
+	err = db.SetPaused(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(50, 100*time.Millisecond, func() error {
+		if pause.IsPaused() {
+			return errors.New("switch is still paused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
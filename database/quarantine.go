@@ -0,0 +1,165 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// collQuarantine is the name of the collection that contains references
+	// to all documents that failed to decode.
+	collQuarantine = "quarantine"
+)
+
+var (
+	// ErrNotQuarantined is returned when a document is not quarantined.
+	ErrNotQuarantined = errors.New("document is not quarantined")
+
+	// ErrNotRepaired is returned when a quarantined email is released while
+	// it still fails to decode.
+	ErrNotRepaired = errors.New("email still fails to decode")
+)
+
+type (
+	// QuarantinedDocument is a database entity that references a document
+	// that failed to decode. These documents can't be processed by any of
+	// the modules until they are repaired manually.
+	QuarantinedDocument struct {
+		Collection    string      `bson:"collection"`
+		DocumentID    interface{} `bson:"document_id"`
+		Error         string      `bson:"error"`
+		QuarantinedAt time.Time   `bson:"quarantined_at"`
+	}
+
+	// LooseAbuseEmail is a loosely typed representation of an abuse email,
+	// it is used to decode quarantined emails for manual inspection. The
+	// identifying fields are decoded as is, all other fields end up in
+	// Fields.
+	LooseAbuseEmail struct {
+		ID      interface{} `bson:"_id"`
+		UID     interface{} `bson:"email_uid"`
+		Version interface{} `bson:"version"`
+		Fields  bson.M      `bson:",inline"`
+	}
+)
+
+// FindQuarantined returns all quarantined documents.
+func (db *AbuseScannerDB) FindQuarantined() ([]QuarantinedDocument, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	coll := db.staticDatabase.Collection(collQuarantine)
+	cursor, err := coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"quarantined_at": 1}))
+	if err != nil {
+		return nil, errors.AddContext(err, "could not retrieve quarantined documents")
+	}
+
+	var docs []QuarantinedDocument
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, errors.AddContext(err, "could not decode quarantined documents")
+	}
+	return docs, nil
+}
+
+// InspectQuarantined decodes the quarantined email with given id into a
+// loosely typed struct, which allows inspecting what fields are malformed.
+func (db *AbuseScannerDB) InspectQuarantined(documentID interface{}) (*LooseAbuseEmail, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	raw, err := db.findQuarantinedEmail(ctx, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	var email LooseAbuseEmail
+	err = bson.Unmarshal(raw, &email)
+	if err != nil {
+		return nil, errors.AddContext(err, "could not decode quarantined email")
+	}
+	return &email, nil
+}
+
+// ReleaseQuarantined releases the quarantined email with given id, it only
+// does so if the email decodes successfully, meaning it has been repaired.
+func (db *AbuseScannerDB) ReleaseQuarantined(documentID interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	raw, err := db.findQuarantinedEmail(ctx, documentID)
+	if err != nil {
+		return err
+	}
+
+	var email AbuseEmail
+	err = bson.Unmarshal(raw, &email)
+	if err != nil {
+		return errors.AddContext(ErrNotRepaired, err.Error())
+	}
+
+	coll := db.staticDatabase.Collection(collQuarantine)
+	_, err = coll.DeleteOne(ctx, bson.M{
+		"collection":  collEmails,
+		"document_id": documentID,
+	})
+	return err
+}
+
+// findQuarantinedEmail returns the raw document of the quarantined email with
+// given id.
+func (db *AbuseScannerDB) findQuarantinedEmail(ctx context.Context, documentID interface{}) (bson.Raw, error) {
+	coll := db.staticDatabase.Collection(collQuarantine)
+	res := coll.FindOne(ctx, bson.M{
+		"collection":  collEmails,
+		"document_id": documentID,
+	})
+	if isDocumentNotFound(res.Err()) {
+		return nil, ErrNotQuarantined
+	}
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+
+	emails := db.staticDatabase.Collection(collEmails)
+	return emails.FindOne(ctx, bson.M{"_id": documentID}).DecodeBytes()
+}
+
+// quarantine records the given document, which failed to decode with the given
+// error, in the quarantine collection. A document is only quarantined once,
+// subsequent calls for the same document are no-ops.
+func (db *AbuseScannerDB) quarantine(ctx context.Context, collection string, doc bson.Raw, decodeErr error) error {
+	idVal, err := doc.LookupErr("_id")
+	if err != nil {
+		return errors.AddContext(err, "document has no _id")
+	}
+	var documentID interface{}
+	err = idVal.Unmarshal(&documentID)
+	if err != nil {
+		return errors.AddContext(err, "could not decode document _id")
+	}
+
+	coll := db.staticDatabase.Collection(collQuarantine)
+	res, err := coll.UpdateOne(ctx, bson.M{
+		"collection":  collection,
+		"document_id": documentID,
+	}, bson.M{
+		"$setOnInsert": QuarantinedDocument{
+			Collection:    collection,
+			DocumentID:    documentID,
+			Error:         decodeErr.Error(),
+			QuarantinedAt: time.Now().UTC(),
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return errors.AddContext(err, "could not quarantine document")
+	}
+	if res.UpsertedCount == 1 {
+		db.staticLogger.Errorf("quarantined document %v in collection %v, err: %v", documentID, collection, decodeErr)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testQuarantine verifies emails that fail to decode are quarantined exactly
+// once and can be released after they have been repaired.
+func testQuarantine(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a valid email
+	err = db.InsertOne(newTestEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert a deliberately malformed email, the inserted_at field is a
+	// string instead of a date
+	id := primitive.NewObjectID()
+	coll := db.staticDatabase.Collection(collEmails)
+	_, err = coll.InsertOne(ctx, bson.M{
+		"_id":         id,
+		"email_uid":   "INBOX-1-malformed",
+		"parsed":      false,
+		"blocked":     false,
+		"finalized":   false,
+		"inserted_at": "yesterday",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the malformed email is not returned but quarantined, we run
+	// through the queue multiple times to assert it's quarantined once
+	for i := 0; i < 3; i++ {
+		emails, err := db.FindUnparsed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(emails) != 1 {
+			t.Fatal("unexpected amount of unparsed emails", len(emails))
+		}
+	}
+	quarantined, err := db.FindQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 {
+		t.Fatal("unexpected amount of quarantined documents", len(quarantined))
+	}
+	q := quarantined[0]
+	if q.Collection != collEmails || q.DocumentID != id || q.Error == "" || q.QuarantinedAt.IsZero() {
+		t.Fatal("unexpected quarantined document", q)
+	}
+	count, err := db.staticDatabase.Collection(collQuarantine).CountDocuments(ctx, bson.M{"document_id": id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("unexpected amount of quarantine records", count)
+	}
+
+	// assert we can inspect the malformed email
+	loose, err := db.InspectQuarantined(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loose.ID != id || loose.UID != "INBOX-1-malformed" || loose.Fields["inserted_at"] != "yesterday" {
+		t.Fatal("unexpected loose email", loose)
+	}
+
+	// assert we can't release the email as long as it's malformed
+	err = db.ReleaseQuarantined(id)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// repair the email and release it
+	_, err = coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"inserted_at": time.Now().UTC()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.ReleaseQuarantined(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantined, err = db.FindQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 0 {
+		t.Fatal("unexpected amount of quarantined documents", len(quarantined))
+	}
+
+	// assert the repaired email is returned again
+	emails, err := db.FindUnparsed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 2 {
+		t.Fatal("unexpected amount of unparsed emails", len(emails))
+	}
+
+	// assert releasing an email that's not quarantined returns an error
+	err = db.ReleaseQuarantined(id)
+	if err != ErrNotQuarantined {
+		t.Fatal("unexpected error", err)
+	}
+}
@@ -28,6 +28,10 @@ type (
 		ReportID    uint64 `bson:"report_id"`
 		ReportDebug bool   `bson:"report_debug"`
 
+		// DryRun indicates the report was built in dry-run mode, these
+		// reports are never filed with NCMEC
+		DryRun bool `bson:"dry_run,omitempty"`
+
 		InsertedAt time.Time `bson:"inserted_at"`
 	}
 )
@@ -90,12 +94,42 @@ func (db *AbuseScannerDB) FindReports(emailID primitive.ObjectID) ([]NCMECReport
 	return reports, nil
 }
 
+// CountUnfiledReports returns the amount of NCMEC reports that have not been
+// filed, split into the reports that are pending, meaning we did not attempt
+// to file them yet, and the reports that failed to get filed. Failed reports
+// are not retried, so they require manual intervention. Reports that were
+// built in dry-run mode are not counted.
+func (db *AbuseScannerDB) CountUnfiledReports() (pending int64, failed int64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	coll := db.staticDatabase.Collection(collNCMECReports)
+	pending, err = coll.CountDocuments(ctx, bson.M{
+		"filed":     false,
+		"filed_err": "",
+		"dry_run":   bson.M{"$ne": true},
+	})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "could not count pending reports")
+	}
+	failed, err = coll.CountDocuments(ctx, bson.M{
+		"filed":     false,
+		"filed_err": bson.M{"$ne": ""},
+	})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "could not count failed reports")
+	}
+	return pending, failed, nil
+}
+
 // FindUnfiledReports returns all NCMEC reports that have not been successfully
 // filed yet, a report is filed once it's been successfully reported with NCMEC.
+// Reports that were built in dry-run mode are never filed.
 //
-// NOTE: we do not retry when we failed to file a report successfully, before
-// filing a report we ensure we can reach the NCMEC server using their status
-// endpoint
+// NOTE: we do not retry when we failed to file a report successfully, unless
+// the response code of the NCMEC API indicates the failure is transient, in
+// which case the report err is not set. Before filing a report we ensure we
+// can reach the NCMEC server using their status endpoint
 func (db *AbuseScannerDB) FindUnfiledReports() ([]NCMECReport, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
 	defer cancel()
@@ -104,6 +138,7 @@ func (db *AbuseScannerDB) FindUnfiledReports() ([]NCMECReport, error) {
 	cursor, err := coll.Find(ctx, bson.M{
 		"filed":     false,
 		"filed_err": "",
+		"dry_run":   bson.M{"$ne": true},
 	})
 	if err != nil {
 		return nil, errors.AddContext(err, "could not retrieve reports")
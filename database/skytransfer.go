@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// collSkyTransferResolutions is the name of the collection that maps
+	// SkyTransfer URLs onto the skylinks they resolved to.
+	collSkyTransferResolutions = "skytransfer_resolutions"
+)
+
+type (
+	// SkyTransferResolution is a database entity that records the skylinks a
+	// SkyTransfer URL resolved to. Resolving a SkyTransfer URL is expensive,
+	// the resolution is reused when the same URL gets reported again.
+	SkyTransferResolution struct {
+		URL        string    `bson:"url"`
+		Skylinks   []string  `bson:"skylinks"`
+		ResolvedAt time.Time `bson:"resolved_at"`
+		ResolvedBy string    `bson:"resolved_by"`
+	}
+)
+
+// FindSkyTransferResolutions returns the resolutions of the given SkyTransfer
+// URLs that were resolved after the given time, keyed by their URL. URLs that
+// were never resolved, or only before the given time, are omitted.
+func (db *AbuseScannerDB) FindSkyTransferResolutions(urls []string, since time.Time) (map[string]SkyTransferResolution, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	coll := db.staticDatabase.Collection(collSkyTransferResolutions)
+	cursor, err := coll.Find(ctx, bson.M{
+		"url":         bson.M{"$in": urls},
+		"resolved_at": bson.M{"$gt": since},
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "could not retrieve skytransfer resolutions")
+	}
+
+	var found []SkyTransferResolution
+	err = cursor.All(ctx, &found)
+	if err != nil {
+		return nil, errors.AddContext(err, "could not decode skytransfer resolutions")
+	}
+	resolutions := make(map[string]SkyTransferResolution, len(found))
+	for _, resolution := range found {
+		resolutions[resolution.URL] = resolution
+	}
+	return resolutions, nil
+}
+
+// UpsertSkyTransferResolution stores the given resolution, it replaces the
+// previous resolution of the same URL.
+func (db *AbuseScannerDB) UpsertSkyTransferResolution(resolution SkyTransferResolution) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	coll := db.staticDatabase.Collection(collSkyTransferResolutions)
+	_, err := coll.ReplaceOne(ctx, bson.M{"url": resolution.URL}, resolution, options.Replace().SetUpsert(true))
+	return errors.AddContext(err, "could not store skytransfer resolution")
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testSkyTransferResolutions verifies the resolutions of SkyTransfer URLs are
+// stored, replaced and found by their URL.
+func testSkyTransferResolutions(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url1 := "https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63"
+	url2 := "https://skytransfer.hns.siasky.net/#/v2/12a75f63/d871327"
+	now := time.Now().UTC()
+	for _, resolution := range []SkyTransferResolution{
+		{URL: url1, Skylinks: []string{"outdated"}, ResolvedAt: now.Add(-time.Hour)},
+		{URL: url1, Skylinks: []string{"skylink1"}, ResolvedAt: now, ResolvedBy: "dev.siasky.net"},
+		{URL: url2, Skylinks: []string{"skylink2"}, ResolvedAt: now.Add(-time.Hour)},
+	} {
+		err = db.UpsertSkyTransferResolution(resolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert the resolution of the first URL was replaced
+	resolutions, err := db.FindSkyTransferResolutions([]string{url1, url2, "https://skytransfer.hns.siasky.net/#/v2/unknown"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resolutions) != 2 {
+		t.Fatal("unexpected resolutions", resolutions)
+	}
+	if !reflect.DeepEqual(resolutions[url1].Skylinks, []string{"skylink1"}) || resolutions[url1].ResolvedBy != "dev.siasky.net" {
+		t.Fatal("unexpected resolution", resolutions[url1])
+	}
+
+	// assert the resolutions from before the given time are omitted
+	resolutions, err = db.FindSkyTransferResolutions([]string{url1, url2}, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := resolutions[url2]; len(resolutions) != 1 || exists {
+		t.Fatal("unexpected resolutions", resolutions)
+	}
+}
@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// MetricBlocked is the time series metric that counts the amount of
+	// blocked emails, bucketed by the time they were blocked.
+	MetricBlocked = "blocked"
+
+	// MetricEmails is the time series metric that counts the amount of
+	// emails, bucketed by the time they were inserted.
+	MetricEmails = "emails"
+
+	// MetricNCMECReports is the time series metric that counts the amount of
+	// NCMEC reports, bucketed by the time they were inserted.
+	MetricNCMECReports = "ncmec_reports"
+
+	// MetricSkylinks is the time series metric that counts the amount of
+	// reported skylinks, bucketed by the time the email was inserted.
+	MetricSkylinks = "skylinks"
+
+	// maxTimeSeriesBuckets is the maximum amount of buckets a time series can
+	// contain.
+	maxTimeSeriesBuckets = 10000
+)
+
+var (
+	// ErrInvalidTimeSeries is returned when a time series is requested with an
+	// invalid bucket size or time range.
+	ErrInvalidTimeSeries = errors.New("invalid time series")
+
+	// ErrUnknownMetric is returned when a time series is requested for a
+	// metric that does not exist.
+	ErrUnknownMetric = errors.New("unknown metric")
+
+	// timeSeriesReference is the reference date mongo uses to align buckets
+	// when truncating dates using a bin size larger than one.
+	timeSeriesReference = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	// timeSeriesMetrics contains the definition of every supported time
+	// series metric.
+	timeSeriesMetrics = map[string]timeSeriesMetric{
+		MetricBlocked: {
+			collection: collEmails,
+			filter:     bson.M{"blocked": true},
+			timeField:  "blocked_at",
+			value:      1,
+		},
+		MetricEmails: {
+			collection: collEmails,
+			timeField:  "inserted_at",
+			value:      1,
+		},
+		MetricNCMECReports: {
+			collection: collNCMECReports,
+			timeField:  "inserted_at",
+			value:      1,
+		},
+		MetricSkylinks: {
+			collection: collEmails,
+			timeField:  "inserted_at",
+			value:      bson.M{"$size": bson.M{"$ifNull": bson.A{"$parse_result.skylinks", bson.A{}}}},
+		},
+	}
+)
+
+type (
+	// TimeSeriesBucket is a single bucket in a time series, it contains the
+	// value of the metric within the bucket, both in total and by tag.
+	TimeSeriesBucket struct {
+		Time  time.Time        `json:"time"`
+		Value int64            `json:"value"`
+		Tags  map[string]int64 `json:"tags,omitempty"`
+	}
+
+	// timeSeriesMetric describes how a time series metric is computed.
+	timeSeriesMetric struct {
+		collection string
+		filter     bson.M
+		timeField  string
+		value      interface{}
+	}
+)
+
+// TimeSeries returns the value of the given metric over time, bucketed by the
+// given bucket size. The returned buckets are ordered and contain all buckets
+// between from and to, including the empty ones. The bucket size has to be a
+// whole amount of minutes, hours or days.
+func (db *AbuseScannerDB) TimeSeries(metric string, bucket time.Duration, from, to time.Time) ([]TimeSeriesBucket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDefaultTimeout)
+	defer cancel()
+
+	// validate the input
+	m, exists := timeSeriesMetrics[metric]
+	if !exists {
+		return nil, errors.AddContext(ErrUnknownMetric, metric)
+	}
+	unit, binSize, err := dateTruncUnit(bucket)
+	if err != nil {
+		return nil, errors.AddContext(ErrInvalidTimeSeries, err.Error())
+	}
+	if !to.After(from) {
+		return nil, errors.AddContext(ErrInvalidTimeSeries, "'to' has to be after 'from'")
+	}
+	from, to = from.UTC(), to.UTC()
+	if to.Sub(timeSeriesStart(from, bucket))/bucket > maxTimeSeriesBuckets {
+		return nil, errors.AddContext(ErrInvalidTimeSeries, fmt.Sprintf("time series exceeds the max amount of buckets %v", maxTimeSeriesBuckets))
+	}
+
+	// build the filter
+	filter := bson.M{m.timeField: bson.M{"$gte": from, "$lt": to}}
+	for k, v := range m.filter {
+		filter[k] = v
+	}
+
+	// aggregate the metric per bucket, both in total and by tag
+	coll := db.staticDatabase.Collection(m.collection)
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$project", Value: bson.M{
+			"bucket": bson.M{"$dateTrunc": bson.M{
+				"date":    "$" + m.timeField,
+				"unit":    unit,
+				"binSize": binSize,
+			}},
+			"tags":  bson.M{"$ifNull": bson.A{"$parse_result.tags", bson.A{}}},
+			"value": m.value,
+		}}},
+		{{Key: "$facet", Value: bson.M{
+			"total": bson.A{
+				bson.M{"$group": bson.M{
+					"_id":   "$bucket",
+					"value": bson.M{"$sum": "$value"},
+				}},
+			},
+			"by_tag": bson.A{
+				bson.M{"$unwind": "$tags"},
+				bson.M{"$group": bson.M{
+					"_id":   bson.M{"bucket": "$bucket", "tag": "$tags"},
+					"value": bson.M{"$sum": "$value"},
+				}},
+			},
+		}}},
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "could not aggregate time series")
+	}
+
+	var results []struct {
+		Total []struct {
+			Bucket time.Time `bson:"_id"`
+			Value  int64     `bson:"value"`
+		} `bson:"total"`
+		ByTag []struct {
+			ID struct {
+				Bucket time.Time `bson:"bucket"`
+				Tag    string    `bson:"tag"`
+			} `bson:"_id"`
+			Value int64 `bson:"value"`
+		} `bson:"by_tag"`
+	}
+	err = cursor.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "could not decode time series")
+	}
+
+	// build all buckets, including the empty ones
+	var buckets []TimeSeriesBucket
+	indices := make(map[int64]int)
+	for t := timeSeriesStart(from, bucket); t.Before(to); t = t.Add(bucket) {
+		indices[t.Unix()] = len(buckets)
+		buckets = append(buckets, TimeSeriesBucket{Time: t})
+	}
+	if len(results) == 0 {
+		return buckets, nil
+	}
+
+	// fill the buckets
+	for _, total := range results[0].Total {
+		i, exists := indices[total.Bucket.Unix()]
+		if !exists {
+			db.staticLogger.Errorf("time series bucket %v out of range", total.Bucket)
+			continue
+		}
+		buckets[i].Value = total.Value
+	}
+	for _, byTag := range results[0].ByTag {
+		i, exists := indices[byTag.ID.Bucket.Unix()]
+		if !exists {
+			db.staticLogger.Errorf("time series bucket %v out of range", byTag.ID.Bucket)
+			continue
+		}
+		if buckets[i].Tags == nil {
+			buckets[i].Tags = make(map[string]int64)
+		}
+		buckets[i].Tags[byTag.ID.Tag] = byTag.Value
+	}
+	return buckets, nil
+}
+
+// dateTruncUnit translates the given bucket size into the unit and bin size
+// arguments expected by mongo's $dateTrunc operator.
+func dateTruncUnit(bucket time.Duration) (string, int64, error) {
+	switch {
+	case bucket <= 0:
+	case bucket%(24*time.Hour) == 0:
+		return "day", int64(bucket / (24 * time.Hour)), nil
+	case bucket%time.Hour == 0:
+		return "hour", int64(bucket / time.Hour), nil
+	case bucket%time.Minute == 0:
+		return "minute", int64(bucket / time.Minute), nil
+	}
+	return "", 0, fmt.Errorf("invalid bucket size %v, it has to be a whole amount of minutes, hours or days", bucket)
+}
+
+// timeSeriesStart returns the start of the bucket the given time falls in,
+// buckets are aligned the same way mongo aligns them in $dateTrunc.
+func timeSeriesStart(t time.Time, bucket time.Duration) time.Time {
+	n := t.Sub(timeSeriesReference) / bucket
+	start := timeSeriesReference.Add(n * bucket)
+	if start.After(t) {
+		start = start.Add(-bucket)
+	}
+	return start
+}
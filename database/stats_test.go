@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestTimeSeriesHelpers is a unit test that covers the dateTruncUnit and
+// timeSeriesStart helpers.
+func TestTimeSeriesHelpers(t *testing.T) {
+	t.Parallel()
+
+	// assert the bucket is translated into the correct unit and bin size
+	tests := []struct {
+		bucket  time.Duration
+		unit    string
+		binSize int64
+		valid   bool
+	}{
+		{24 * time.Hour, "day", 1, true},
+		{7 * 24 * time.Hour, "day", 7, true},
+		{time.Hour, "hour", 1, true},
+		{36 * time.Hour, "hour", 36, true},
+		{90 * time.Minute, "minute", 90, true},
+		{0, "", 0, false},
+		{-time.Hour, "", 0, false},
+		{1500 * time.Millisecond, "", 0, false},
+	}
+	for _, test := range tests {
+		unit, binSize, err := dateTruncUnit(test.bucket)
+		if test.valid != (err == nil) {
+			t.Fatal("unexpected error", test.bucket, err)
+		}
+		if unit != test.unit || binSize != test.binSize {
+			t.Fatal("unexpected unit or bin size", test.bucket, unit, binSize)
+		}
+	}
+
+	// assert buckets are aligned like mongo aligns them
+	at := time.Date(2022, time.March, 15, 13, 37, 0, 0, time.UTC)
+	if start := timeSeriesStart(at, 24*time.Hour); !start.Equal(time.Date(2022, time.March, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("unexpected start", start)
+	}
+	if start := timeSeriesStart(at, time.Hour); !start.Equal(time.Date(2022, time.March, 15, 13, 0, 0, 0, time.UTC)) {
+		t.Fatal("unexpected start", start)
+	}
+	// 2022-03-15 is 8109 days after 2000-01-01, so the 7-day bucket starts on
+	// day 8106 which is 2022-03-12
+	if start := timeSeriesStart(at, 7*24*time.Hour); !start.Equal(time.Date(2022, time.March, 12, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("unexpected start", start)
+	}
+	before := time.Date(1999, time.December, 31, 13, 0, 0, 0, time.UTC)
+	if start := timeSeriesStart(before, 24*time.Hour); !start.Equal(time.Date(1999, time.December, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("unexpected start", start)
+	}
+}
+
+// testTimeSeries is a unit test for the method TimeSeries.
+func testTimeSeries(ctx context.Context, t *testing.T, db *AbuseScannerDB) {
+	err := db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seed data across several days
+	day0 := time.Now().UTC().Truncate(24 * time.Hour).Add(-7 * 24 * time.Hour)
+	day := func(n int) time.Time { return day0.Add(time.Duration(n)*24*time.Hour + 2*time.Hour) }
+
+	emails := []struct {
+		insertedAt time.Time
+		blockedAt  time.Time
+		skylinks   []string
+		tags       []string
+	}{
+		// outside of the range
+		{day(-1), time.Time{}, []string{"a"}, []string{"phishing"}},
+		// day 0, one of them blocked on day 1
+		{day(0), day(1), []string{"a", "b"}, []string{"phishing"}},
+		{day(0), time.Time{}, []string{"c", "d"}, []string{"phishing"}},
+		// day 2, blocked on the same day
+		{day(2), day(2), []string{"e", "f", "g"}, []string{"copyright", "phishing"}},
+	}
+	for _, e := range emails {
+		email := newTestEmail()
+		email.InsertedAt = e.insertedAt
+		email.Parsed = true
+		email.ParseResult = AbuseReport{Skylinks: e.skylinks, Tags: e.tags}
+		email.Blocked = !e.blockedAt.IsZero()
+		email.BlockedAt = e.blockedAt
+		err = db.InsertOne(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.InsertReport(NCMECReport{ID: primitive.NewObjectID(), InsertedAt: day(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// from is not aligned on purpose, the first bucket should start on day 0
+	from := day0.Add(time.Hour)
+	to := day0.Add(4 * 24 * time.Hour)
+	tests := []struct {
+		metric string
+		values []int64
+		tags   []map[string]int64
+	}{
+		{MetricEmails, []int64{2, 0, 1, 0}, []map[string]int64{{"phishing": 2}, nil, {"copyright": 1, "phishing": 1}, nil}},
+		{MetricSkylinks, []int64{4, 0, 3, 0}, []map[string]int64{{"phishing": 4}, nil, {"copyright": 3, "phishing": 3}, nil}},
+		{MetricBlocked, []int64{0, 1, 1, 0}, []map[string]int64{nil, {"phishing": 1}, {"copyright": 1, "phishing": 1}, nil}},
+		{MetricNCMECReports, []int64{0, 0, 1, 0}, []map[string]int64{nil, nil, nil, nil}},
+	}
+	for _, test := range tests {
+		buckets, err := db.TimeSeries(test.metric, 24*time.Hour, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != len(test.values) {
+			t.Fatalf("unexpected amount of buckets for metric %v, %v != %v", test.metric, len(buckets), len(test.values))
+		}
+		for i, bucket := range buckets {
+			if !bucket.Time.Equal(day0.Add(time.Duration(i) * 24 * time.Hour)) {
+				t.Fatalf("unexpected bucket time for metric %v, bucket %v, %v", test.metric, i, bucket.Time)
+			}
+			if bucket.Value != test.values[i] {
+				t.Fatalf("unexpected value for metric %v, bucket %v, %v != %v", test.metric, i, bucket.Value, test.values[i])
+			}
+			if len(bucket.Tags) != len(test.tags[i]) {
+				t.Fatalf("unexpected tags for metric %v, bucket %v, %v != %v", test.metric, i, bucket.Tags, test.tags[i])
+			}
+			for tag, value := range test.tags[i] {
+				if bucket.Tags[tag] != value {
+					t.Fatalf("unexpected tags for metric %v, bucket %v, %v != %v", test.metric, i, bucket.Tags, test.tags[i])
+				}
+			}
+		}
+	}
+
+	// assert an unknown metric returns an error
+	_, err = db.TimeSeries("unknown", 24*time.Hour, from, to)
+	if !errors.Contains(err, ErrUnknownMetric) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert an invalid bucket size returns an error
+	_, err = db.TimeSeries(MetricEmails, time.Second, from, to)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// assert an invalid range returns an error
+	_, err = db.TimeSeries(MetricEmails, 24*time.Hour, to, from)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
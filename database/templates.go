@@ -0,0 +1,158 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// DefaultResponseLocale is the locale of the default response templates,
+	// replies fall back to it if there are no templates for the locale of
+	// the reporter.
+	DefaultResponseLocale = "en"
+
+	// placeholderBlockedAt, placeholderCount and placeholderSubject are the
+	// placeholders in the response templates that are replaced by the time
+	// the links were blocked, the amount of reports in a digest and the
+	// subject of a report respectively.
+	placeholderBlockedAt = "{blocked_at}"
+	placeholderCount     = "{count}"
+	placeholderSubject   = "{subject}"
+)
+
+var (
+	// DefaultResponseTemplates are the English templates of the automated
+	// responses.
+	DefaultResponseTemplates = ResponseTemplates{
+		Blocked:         "the following links were identified and blocked on all of our servers as of " + placeholderBlockedAt,
+		DigestNoLinks:   "we were unable to find any valid links.",
+		DigestProcessed: "we have processed " + placeholderCount + " of your reports.",
+		DigestReport:    "Report '" + placeholderSubject + "':",
+		Greeting:        "Hello,",
+		LegalNotice:     strings.Trim(responseLegalNotice, "\n"),
+		NoLinks:         "we have processed your report but were unable to find any valid links.\nPlease verify the link is not corrupted as we need it in order to prevent access to it from our portals.",
+		Unblocked:       "the following links could not be blocked:",
+	}
+)
+
+type (
+	// ResponseTemplates are the phrases the automated responses are built
+	// from, which allows replying to reporters in their own language. The
+	// listed links, and the lines that group them under a SkyTransfer URL,
+	// are never localized. Empty templates default to the English ones, see
+	// DefaultResponseTemplates.
+	ResponseTemplates struct {
+		// Blocked introduces the links that were blocked, {blocked_at} is
+		// replaced by the time they were blocked.
+		Blocked string `json:"blocked"`
+
+		// DigestNoLinks replaces the links of a report in a digest in which
+		// no links were found.
+		DigestNoLinks string `json:"digest_no_links"`
+
+		// DigestProcessed opens a digest, {count} is replaced by the amount
+		// of reports it covers.
+		DigestProcessed string `json:"digest_processed"`
+
+		// DigestReport introduces every report in a digest, {subject} is
+		// replaced by the subject of the report.
+		DigestReport string `json:"digest_report"`
+
+		// Greeting opens every response.
+		Greeting string `json:"greeting"`
+
+		// LegalNotice closes every response.
+		LegalNotice string `json:"legal_notice"`
+
+		// NoLinks is the response to a report in which no links were found.
+		NoLinks string `json:"no_links"`
+
+		// Unblocked introduces the links that could not be blocked.
+		Unblocked string `json:"unblocked"`
+	}
+)
+
+// LoadResponseTemplates loads the response templates from the given directory,
+// which contains a JSON file per locale named after the locale, e.g. `de.json`
+// holds the German templates. The returned templates are keyed by the lowercase
+// locale, templates that are missing from a file default to the English ones.
+func LoadResponseTemplates(dir string) (map[string]ResponseTemplates, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, errors.AddContext(err, "could not list the response templates")
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no response templates found in '%v'", dir)
+	}
+
+	templates := make(map[string]ResponseTemplates, len(paths))
+	for _, path := range paths {
+		locale := strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.AddContext(err, fmt.Sprintf("could not read the response templates for locale '%v'", locale))
+		}
+		var t ResponseTemplates
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&t)
+		if err != nil {
+			return nil, errors.AddContext(err, fmt.Sprintf("could not decode the response templates for locale '%v'", locale))
+		}
+		templates[locale] = t.withDefaults()
+	}
+	return templates, nil
+}
+
+// blocked returns the template that introduces the links that were blocked at
+// the given time.
+func (t ResponseTemplates) blocked(blockedAt string) string {
+	return strings.ReplaceAll(t.Blocked, placeholderBlockedAt, blockedAt)
+}
+
+// digestProcessed returns the template that opens a digest of the given amount
+// of reports.
+func (t ResponseTemplates) digestProcessed(count int) string {
+	return strings.ReplaceAll(t.DigestProcessed, placeholderCount, fmt.Sprint(count))
+}
+
+// digestReport returns the template that introduces the report with the given
+// subject in a digest.
+func (t ResponseTemplates) digestReport(subject string) string {
+	return strings.ReplaceAll(t.DigestReport, placeholderSubject, subject)
+}
+
+// legalNotice returns the legal notice, surrounded by an empty line.
+func (t ResponseTemplates) legalNotice() string {
+	return "\n" + strings.Trim(t.LegalNotice, "\n") + "\n"
+}
+
+// withDefaults returns the templates with the empty templates replaced by the
+// English ones.
+func (t ResponseTemplates) withDefaults() ResponseTemplates {
+	defaults := DefaultResponseTemplates
+	for _, field := range []struct {
+		value *string
+		def   string
+	}{
+		{&t.Blocked, defaults.Blocked},
+		{&t.DigestNoLinks, defaults.DigestNoLinks},
+		{&t.DigestProcessed, defaults.DigestProcessed},
+		{&t.DigestReport, defaults.DigestReport},
+		{&t.Greeting, defaults.Greeting},
+		{&t.LegalNotice, defaults.LegalNotice},
+		{&t.NoLinks, defaults.NoLinks},
+		{&t.Unblocked, defaults.Unblocked},
+	} {
+		if strings.TrimSpace(*field.value) == "" {
+			*field.value = field.def
+		}
+	}
+	return t
+}
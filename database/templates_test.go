@@ -0,0 +1,90 @@
+package database
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadResponseTemplates is a unit test that covers LoadResponseTemplates
+// and the responses that are built from the loaded templates.
+func TestLoadResponseTemplates(t *testing.T) {
+	t.Parallel()
+
+	// assert a directory without templates is rejected
+	dir := t.TempDir()
+	_, err := LoadResponseTemplates(dir)
+	if err == nil || !strings.Contains(err.Error(), "no response templates found") {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert unknown fields are rejected
+	err = ioutil.WriteFile(filepath.Join(dir, "nl.json"), []byte(`{"greting": "Hallo,"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadResponseTemplates(dir)
+	if err == nil || !strings.Contains(err.Error(), "locale 'nl'") {
+		t.Fatal("unexpected error", err)
+	}
+
+	// write the German templates, leaving out the legal notice
+	err = ioutil.WriteFile(filepath.Join(dir, "nl.json"), []byte(`{"greeting": "Hallo,"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	de := `{
+	"blocked": "die folgenden Links wurden am {blocked_at} gesperrt",
+	"digest_processed": "wir haben {count} Ihrer Meldungen bearbeitet.",
+	"digest_report": "Meldung '{subject}':",
+	"greeting": "Hallo,",
+	"unblocked": "die folgenden Links konnten nicht gesperrt werden:"
+}`
+	err = ioutil.WriteFile(filepath.Join(dir, "DE.json"), []byte(de), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := LoadResponseTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 2 || templates["nl"].Greeting != "Hallo," {
+		t.Fatal("unexpected templates", templates)
+	}
+
+	// assert the responses are built from the German templates, and that
+	// the missing templates fall back to English
+	blockedAt := time.Now().UTC()
+	email := AbuseEmail{
+		Subject:     "Phishing",
+		Parsed:      true,
+		Blocked:     true,
+		BlockedAt:   blockedAt,
+		ParseResult: AbuseReport{Skylinks: []string{"skylink1", "skylink2"}},
+		BlockResult: []string{AbuseStatusBlocked, AbuseStatusNotBlocked},
+	}
+	opts := ResponseOptions{Templates: templates["de"]}
+	for _, response := range []string{email.Response(opts), DigestResponse([]AbuseEmail{email}, opts)} {
+		for _, expected := range []string{
+			"Hallo,\n\n",
+			"die folgenden Links wurden am " + blockedAt.Format(time.RFC1123) + " gesperrt\n\n- skylink1\n",
+			"\ndie folgenden Links konnten nicht gesperrt werden:\n\n- skylink2\n",
+			"\nThank you for your report.\n",
+		} {
+			if !strings.Contains(response, expected) {
+				t.Fatalf("expected response to contain %q, response %v", expected, response)
+			}
+		}
+	}
+	digest := DigestResponse([]AbuseEmail{email}, opts)
+	if !strings.Contains(digest, "wir haben 1 Ihrer Meldungen bearbeitet.\n\nMeldung 'Phishing':\n") {
+		t.Fatal("unexpected digest", digest)
+	}
+
+	// assert the default templates build the English response
+	if email.Response(ResponseOptions{}) != email.Response(ResponseOptions{Templates: DefaultResponseTemplates}) {
+		t.Fatal("expected the empty templates to default to English")
+	}
+}
@@ -0,0 +1,163 @@
+package email
+
+import (
+	"abuse-scanner/utils"
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+)
+
+const (
+	// AuthModeNone does not verify the authentication of incoming emails.
+	AuthModeNone = "none"
+
+	// AuthModeRecord records whether an email passed DKIM and SPF on its
+	// parse result.
+	AuthModeRecord = "record"
+
+	// AuthModeReview records whether an email passed DKIM and SPF, and routes
+	// the emails that passed neither to a manual review.
+	AuthModeReview = "review"
+
+	// authResultsHeader is the header in which the receiving mail server
+	// records the outcome of the authentication of an email, see RFC 8601.
+	authResultsHeader = "Authentication-Results"
+
+	// authResultPass is the result of an authentication method that passed.
+	authResultPass = "pass"
+
+	// authPropertyDKIMDomain is the property of a DKIM result that holds the
+	// domain that signed the email.
+	authPropertyDKIMDomain = "header.d"
+
+	// authPropertySPFDomain is the property of an SPF result that holds the
+	// envelope sender, either an address or a domain.
+	authPropertySPFDomain = "smtp.mailfrom"
+
+	// reviewReasonAuth is the reason an email needs a manual review if it
+	// passed neither DKIM nor SPF.
+	reviewReasonAuth = "the email passed neither DKIM nor SPF authentication"
+)
+
+type (
+	// authResults is the outcome of the authentication of an email, as
+	// recorded by the receiving mail server. DKIM and SPF only count as
+	// passed if the authenticated domain aligns with the domain of the From
+	// address, otherwise anyone could pass them using their own domain.
+	authResults struct {
+		checked  bool
+		dkimPass bool
+		spfPass  bool
+	}
+)
+
+// passed returns true if the email passed either DKIM or SPF for the domain of
+// its From address, which, like DMARC, is what we require to trust the sender
+// of the email.
+func (ar authResults) passed() bool {
+	return ar.dkimPass || ar.spfPass
+}
+
+// parseAuthResults is a helper function that returns the outcome of the
+// authentication of the given raw email from its Authentication-Results
+// header. Every mail server the email passes through can add such a header,
+// and a sender can forge them, so only the header of our own mail server is
+// trusted. That's the header of which the authserv-id equals the given one,
+// or the topmost header if no authserv-id is given. The results are not
+// checked if the email has no such header. A passed result only counts if its
+// domain aligns with the domain of the From address, see domainsAlign.
+func parseAuthResults(raw []byte, authServID string) authResults {
+	header, _ := splitHeader(raw)
+	if len(header) == 0 {
+		return authResults{}
+	}
+	msg, err := mail.ReadMessage(io.MultiReader(bytes.NewReader(header), strings.NewReader("\r\n\r\n")))
+	if err != nil {
+		return authResults{}
+	}
+
+	var fromDomain string
+	if _, domain, err := utils.NormalizeEmail(msg.Header.Get("From")); err == nil {
+		fromDomain = domain
+	}
+
+	for _, value := range msg.Header[authResultsHeader] {
+		results := strings.Split(stripHeaderComments(value), ";")
+		servID := strings.Fields(results[0])
+		if authServID != "" && (len(servID) == 0 || !strings.EqualFold(servID[0], authServID)) {
+			continue
+		}
+
+		ar := authResults{checked: true}
+		for _, result := range results[1:] {
+			fields := strings.Fields(result)
+			if len(fields) == 0 {
+				continue
+			}
+			method := strings.SplitN(strings.ToLower(fields[0]), "=", 2)
+			if len(method) != 2 || method[1] != authResultPass {
+				continue
+			}
+			switch method[0] {
+			case "dkim":
+				domain := authProperty(fields[1:], authPropertyDKIMDomain)
+				ar.dkimPass = ar.dkimPass || domainsAlign(domain, fromDomain)
+			case "spf":
+				domain := authProperty(fields[1:], authPropertySPFDomain)
+				if at := strings.LastIndex(domain, "@"); at != -1 {
+					domain = domain[at+1:]
+				}
+				ar.spfPass = ar.spfPass || domainsAlign(domain, fromDomain)
+			}
+		}
+		return ar
+	}
+	return authResults{}
+}
+
+// authProperty is a helper function that returns the lowercased value of the
+// property with given name from the given properties of an authentication
+// result, e.g. `header.d=example.com`. It returns an empty string if the
+// property is not found.
+func authProperty(properties []string, name string) string {
+	for _, property := range properties {
+		kv := strings.SplitN(property, "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], name) {
+			return strings.TrimSuffix(strings.ToLower(kv[1]), ".")
+		}
+	}
+	return ""
+}
+
+// domainsAlign is a helper function that returns true if the given
+// authenticated domain aligns with the given domain of the From address. Like
+// the relaxed alignment of DMARC the domains align if they are equal or if one
+// is a subdomain of the other, e.g. `mail.example.com` aligns with
+// `example.com`. Empty domains never align.
+func domainsAlign(authDomain, fromDomain string) bool {
+	if authDomain == "" || fromDomain == "" {
+		return false
+	}
+	return authDomain == fromDomain ||
+		strings.HasSuffix(authDomain, "."+fromDomain) ||
+		strings.HasSuffix(fromDomain, "."+authDomain)
+}
+
+// stripHeaderComments is a helper function that removes the comments, i.e.
+// the text in parentheses, from the given header value.
+func stripHeaderComments(value string) string {
+	var sb strings.Builder
+	var depth int
+	for _, r := range value {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,160 @@
+package email
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// authPassFixture is an email that passed both DKIM and SPF according to
+	// our mail server, the header of an upstream server claims it failed
+	authPassFixture = "Authentication-Results: mx.siasky.net;\r\n" +
+		"\tdkim=pass (2048-bit key; unprotected) header.d=example.com header.i=@example.com header.b=abc;\r\n" +
+		"\tspf=pass (mx.siasky.net: domain of abuse@example.com designates 192.0.2.1 as permitted sender) smtp.mailfrom=abuse@example.com;\r\n" +
+		"\tdmarc=pass (p=REJECT) header.from=example.com\r\n" +
+		"Authentication-Results: relay.example.org; dkim=fail; spf=fail\r\n" +
+		"From: Abuse <abuse@example.com>\r\n" +
+		"Subject: Report\r\n" +
+		"\r\n" +
+		"Hello,\r\n\r\nplease remove https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g\r\n"
+
+	// authFailFixture is an email that failed both DKIM and SPF according to
+	// our mail server, though the sender forged a header that claims it
+	// passed
+	authFailFixture = "Authentication-Results: mx.siasky.net; dkim=fail (signature did not verify) header.d=example.com;\n" +
+		" spf=softfail (mx.siasky.net: domain of transitioning abuse@example.com does not designate 198.51.100.1 as permitted sender) smtp.mailfrom=abuse@example.com\n" +
+		"Authentication-Results: mx.siasky.net.example.com; dkim=pass; spf=pass\n" +
+		"From: Abuse <abuse@example.com>\n" +
+		"Subject: Report\n" +
+		"\n" +
+		"Hello,\n\nplease remove https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g\n"
+
+	// authPartialFixture is an email that passed SPF but not DKIM, the
+	// authserv-id of its header is uppercase and followed by a version
+	authPartialFixture = "Authentication-Results: MX.SIASKY.NET 1;\n" +
+		" dkim=none; dkim=neutral (no key) header.d=example.com; spf=PASS smtp.mailfrom=example.com\n" +
+		"From: abuse@reports.example.com\n" +
+		"Subject: Report\n" +
+		"\n" +
+		"Hello\n"
+
+	// authSpoofFixture is an email that claims to be sent from a domain we
+	// trust, it passed DKIM and SPF but for the domain of the sender, which
+	// does not align with the domain of the From address
+	authSpoofFixture = "Authentication-Results: mx.siasky.net;\n" +
+		" dkim=pass header.d=attacker.example header.i=@attacker.example;\n" +
+		" spf=pass smtp.mailfrom=bounce@attacker.example;\n" +
+		" dmarc=fail header.from=trusted.example\n" +
+		"From: Abuse <abuse@trusted.example>\n" +
+		"Subject: Report\n" +
+		"\n" +
+		"Hello,\n\nplease remove https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g\n"
+
+	// authSubdomainFixture is an email that passed DKIM for a subdomain of the
+	// domain of the From address, and SPF for an unrelated domain that merely
+	// ends with the same characters
+	authSubdomainFixture = "Authentication-Results: mx.siasky.net;\n" +
+		" dkim=pass header.d=mail.example.com;\n" +
+		" spf=pass smtp.mailfrom=notexample.com\n" +
+		"From: abuse@example.com\n" +
+		"Subject: Report\n" +
+		"\n" +
+		"Hello\n"
+
+	// authMissingFixture is an email without an Authentication-Results header
+	authMissingFixture = "From: Abuse <abuse@example.com>\nSubject: Report\n\nHello,\n\nplease remove https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g\n"
+)
+
+// TestParseAuthResults verifies the outcome of the authentication of an email
+// is parsed from the Authentication-Results header of our mail server.
+func TestParseAuthResults(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		raw        string
+		authServID string
+		expected   authResults
+	}{
+		{"Pass", authPassFixture, "mx.siasky.net", authResults{checked: true, dkimPass: true, spfPass: true}},
+		{"PassTopmost", authPassFixture, "", authResults{checked: true, dkimPass: true, spfPass: true}},
+		{"PassUpstream", authPassFixture, "relay.example.org", authResults{checked: true}},
+		{"Fail", authFailFixture, "mx.siasky.net", authResults{checked: true}},
+		{"FailTopmost", authFailFixture, "", authResults{checked: true}},
+		{"Partial", authPartialFixture, "mx.siasky.net", authResults{checked: true, spfPass: true}},
+		{"Spoof", authSpoofFixture, "mx.siasky.net", authResults{checked: true}},
+		{"Subdomain", authSubdomainFixture, "mx.siasky.net", authResults{checked: true, dkimPass: true}},
+		{"Missing", authMissingFixture, "mx.siasky.net", authResults{}},
+		{"UnknownServID", authPassFixture, "mx.example.com", authResults{}},
+		{"NoHeader", "", "", authResults{}},
+	}
+	for _, test := range tests {
+		if ar := parseAuthResults([]byte(test.raw), test.authServID); ar != test.expected {
+			t.Errorf("%v: unexpected auth results %+v, expected %+v", test.name, ar, test.expected)
+		}
+	}
+
+	// assert the body is left untouched
+	raw := []byte(authFailFixture)
+	parseAuthResults(raw, "mx.siasky.net")
+	if string(raw) != authFailFixture {
+		t.Fatal("unexpected modification of the email")
+	}
+}
+
+// TestParserAuthMode verifies the parser records whether an email passed DKIM
+// and SPF on its parse result, and routes the emails that passed neither to a
+// manual review in AuthModeReview.
+func TestParserAuthMode(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	newParser := func(mode string) *Parser {
+		return NewParser(context.Background(), nil, "dev.siasky.net", "somesponsor", ParserOptions{
+			AuthMode:   mode,
+			AuthServID: "mx.siasky.net",
+		}, logger)
+	}
+
+	tests := []struct {
+		mode        string
+		raw         string
+		checked     bool
+		dkimPass    bool
+		spfPass     bool
+		needsReview bool
+	}{
+		{"", authFailFixture, false, false, false, false},
+		{AuthModeNone, authPassFixture, false, false, false, false},
+		{AuthModeRecord, authPassFixture, true, true, true, false},
+		{AuthModeRecord, authFailFixture, true, false, false, false},
+		{AuthModeReview, authPassFixture, true, true, true, false},
+		{AuthModeReview, authFailFixture, true, false, false, true},
+		{AuthModeReview, authSpoofFixture, true, false, false, true},
+		{AuthModeReview, authMissingFixture, false, false, false, true},
+	}
+	for _, test := range tests {
+		email := newTestEmail()
+		email.Body = []byte(test.raw)
+		report, _, err := newParser(test.mode).buildAbuseReport(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.AuthChecked != test.checked || report.DKIMPass != test.dkimPass || report.SPFPass != test.spfPass {
+			t.Errorf("mode '%v': unexpected auth status %v %v %v", test.mode, report.AuthChecked, report.DKIMPass, report.SPFPass)
+		}
+		if report.NeedsReview != test.needsReview {
+			t.Errorf("mode '%v': unexpected needs review %v", test.mode, report.NeedsReview)
+		}
+		if test.needsReview && report.ReviewReason != reviewReasonAuth {
+			t.Errorf("mode '%v': unexpected review reason '%v'", test.mode, report.ReviewReason)
+		}
+		if len(report.Skylinks) != 1 {
+			t.Errorf("mode '%v': unexpected skylinks %v", test.mode, report.Skylinks)
+		}
+	}
+}
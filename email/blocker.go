@@ -2,14 +2,22 @@ package email
 
 import (
 	"abuse-scanner/database"
+	"abuse-scanner/metrics"
+	"abuse-scanner/notifier"
+	"abuse-scanner/skylink"
+	"abuse-scanner/utils"
+	"abuse-scanner/version"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
@@ -17,42 +25,252 @@ import (
 )
 
 const (
+	// DefaultBacklogSLA is the default maximum amount of time an email may
+	// wait to get blocked, after which the on-call gets notified.
+	DefaultBacklogSLA = time.Hour
+
 	// blockFrequency defines the frequency with which we scan for emails for
 	// which the parsed emails have not been blocked yet.
 	blockFrequency = 30 * time.Second
+
+	// defaultBreakerCooldown is the default amount of time the circuit
+	// breaker stays open before it allows a trial request.
+	defaultBreakerCooldown = 5 * time.Minute
+
+	// defaultBreakerThreshold is the default amount of consecutive failed
+	// requests to the blocker API after which the circuit breaker opens.
+	defaultBreakerThreshold = 5
+
+	// defaultExcerptMaxLength is the default maximum amount of characters of
+	// the complaint excerpt that is included in the block request.
+	defaultExcerptMaxLength = 200
+
+	// excerptRedacted replaces the email addresses in the complaint excerpt.
+	excerptRedacted = "[redacted]"
+
+	// inflightWindow is the amount of time within which an email is
+	// considered a copy of an email that was inserted before it. It's also
+	// the maximum amount of time an email is deferred while its copy is in
+	// flight.
+	inflightWindow = 15 * time.Minute
+
+	// InflightHandlingDefer defers blocking an email while a copy of it is
+	// still in flight, it's blocked as usual once the copy got finalized.
+	InflightHandlingDefer = "defer"
+
+	// InflightHandlingMerge defers blocking an email while a copy of it is
+	// still in flight, once the copy got finalized its block result is merged
+	// into the email and the email is marked as a duplicate.
+	InflightHandlingMerge = "merge"
+
+	// InflightHandlingNone processes every email independently, even if a
+	// copy of it is still in flight.
+	InflightHandlingNone = "none"
+
+	// InflightKeyMessageID considers emails with the same message id copies.
+	InflightKeyMessageID = "message_id"
+
+	// InflightKeySkylinks considers emails that were sent by the same sender
+	// and report the same set of skylinks copies.
+	InflightKeySkylinks = "skylinks"
+)
+
+var (
+	// errBreakerOpen is returned when a block request is not attempted
+	// because the circuit breaker is open.
+	errBreakerOpen = errors.New("blocker API circuit breaker is open")
+
+	// excerptEmailRE is the regex used to redact email addresses from the
+	// complaint excerpt.
+	excerptEmailRE = regexp.MustCompile(`[^\s<>()\[\]"',;:]+@[^\s<>()\[\]"',;:]+`)
 )
 
 type (
 	// Blocker is an object that will periodically scan the database for abuse
 	// reports that have not been blocked yet.
 	Blocker struct {
-		staticBlockerApiUrl string
+		staticBlockers      []*blockerAPI
 		staticContext       context.Context
 		staticDatabase      *database.AbuseScannerDB
+		staticLogSuppressor *utils.LogSuppressor
 		staticLogger        *logrus.Entry
+		staticOptions       BlockerOptions
 		staticServerDomain  string
 		staticWaitGroup     sync.WaitGroup
 	}
 
+	// blockerAPI is a blocker API the skylinks are blocked on, every blocker
+	// API has its own circuit breaker so a blocker API that is unavailable
+	// does not prevent blocking the skylinks on the others.
+	blockerAPI struct {
+		staticBreaker *utils.CircuitBreaker
+		staticURL     string
+	}
+
+	// BlockerOptions contains the configurable options of the blocker.
+	BlockerOptions struct {
+		// AdditionalURLs are the URLs of the blocker APIs of the other
+		// portals we operate, every skylink is blocked on the blocker API the
+		// blocker is created with and on all of these. A skylink is only
+		// considered blocked if it got blocked on every blocker API.
+		AdditionalURLs []string
+
+		// BacklogSLA is the maximum amount of time an email may wait to get
+		// blocked after it was received, if the oldest unblocked email
+		// exceeds it the on-call gets notified. Defaults to
+		// DefaultBacklogSLA.
+		BacklogSLA time.Duration
+
+		// BreakerCooldown is the amount of time the circuit breaker stays
+		// open before it allows a trial request, defaults to
+		// defaultBreakerCooldown.
+		BreakerCooldown time.Duration
+
+		// BreakerThreshold is the amount of consecutive failed requests to the
+		// blocker API after which the circuit breaker opens, defaults to
+		// defaultBreakerThreshold.
+		BreakerThreshold int
+
+		// DryRun indicates whether the blocker runs in dry-run mode, in which
+		// case the blocker API is never called. Every skylink gets the
+		// database.AbuseStatusDryRun status and the email is marked as dry
+		// run.
+		DryRun bool
+
+		// ExcerptMaxLength is the maximum amount of characters of the
+		// complaint excerpt, defaults to defaultExcerptMaxLength.
+		ExcerptMaxLength int
+
+		// HTTPClient is the shared HTTP client used to call the blocker API,
+		// defaults to http.DefaultClient.
+		HTTPClient *http.Client
+
+		// InflightHandling defines how an email is handled that arrives while
+		// a copy of it is still in flight, it's one of InflightHandlingNone,
+		// InflightHandlingDefer or InflightHandlingMerge. If empty it
+		// defaults to InflightHandlingNone.
+		InflightHandling string
+
+		// InflightKey defines which emails are considered copies, it's one of
+		// InflightKeySkylinks or InflightKeyMessageID. If empty it defaults
+		// to InflightKeySkylinks.
+		InflightKey string
+
+		// IncludeExcerpt indicates whether a sanitized excerpt of the
+		// complaint is included in the block request, which allows the blocker
+		// to record why a skylink was blocked.
+		IncludeExcerpt bool
+
+		// MergeTags indicates whether the tags of a skylink are merged with
+		// the tags it was blocked under before, when the same skylink gets
+		// reported in multiple emails. This ensures the blocker API receives
+		// the union of all categories the skylink was reported for.
+		MergeTags bool
+
+		// Notifier notifies the on-call when the backlog exceeds the SLA, if
+		// nil no notifications are sent.
+		Notifier *notifier.Notifier
+
+		// Pause pauses the blocker while the processing is paused, its loop
+		// keeps ticking but skips its work. If nil it's never paused.
+		Pause Pauser
+
+		// RecentBlockWindow is the window within which a skylink that got
+		// blocked while blocking a prior email is not submitted to the
+		// blocker API again, it gets the database.AbuseStatusAlreadyBlocked
+		// status instead. If zero every skylink is submitted.
+		RecentBlockWindow time.Duration
+
+		// RetryPolicy defines how a block request that failed, either to
+		// execute or with a 5xx response, is retried before the failure is
+		// recorded in the circuit breaker. If its MaxAttempts is zero the
+		// request is not retried.
+		RetryPolicy utils.RetryPolicy
+
+		// ShutdownTimeout is the amount of time Stop waits for the blocker to
+		// shut down before it returns an error, defaults to
+		// defaultShutdownTimeout.
+		ShutdownTimeout time.Duration
+	}
+
 	// BlockPOST is the datastructure expected by the blocker API
 	BlockPOST struct {
 		Skylink  string                 `json:"skylink"`
 		Reporter database.AbuseReporter `json:"reporter"`
 		Tags     []string               `json:"tags"`
+
+		// Excerpt is a short sanitized excerpt of the complaint, it is only
+		// set if the blocker is configured to include it.
+		Excerpt string `json:"excerpt,omitempty"`
+	}
+
+	// BlockStats are the counts of a single block pass.
+	BlockStats struct {
+		// Blocked is the amount of emails of which the skylinks got blocked.
+		Blocked int `json:"blocked"`
+
+		// Deferred is the amount of emails that got deferred because a copy
+		// of the email was still in flight.
+		Deferred int `json:"deferred"`
+
+		// Statuses is the amount of skylinks per block status, e.g. blocked
+		// or dry-run, of the emails that got blocked.
+		Statuses map[string]int `json:"statuses,omitempty"`
 	}
 )
 
 // NewBlocker creates a new blocker.
-func NewBlocker(ctx context.Context, blockerApiUrl, serverDomain string, database *database.AbuseScannerDB, logger *logrus.Logger) *Blocker {
+func NewBlocker(ctx context.Context, blockerApiUrl, serverDomain string, database *database.AbuseScannerDB, opts BlockerOptions, logger *logrus.Logger) *Blocker {
+	if opts.BacklogSLA == 0 {
+		opts.BacklogSLA = DefaultBacklogSLA
+	}
+	if opts.BreakerCooldown == 0 {
+		opts.BreakerCooldown = defaultBreakerCooldown
+	}
+	if opts.BreakerThreshold == 0 {
+		opts.BreakerThreshold = defaultBreakerThreshold
+	}
+	if opts.ExcerptMaxLength == 0 {
+		opts.ExcerptMaxLength = defaultExcerptMaxLength
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.InflightHandling == "" {
+		opts.InflightHandling = InflightHandlingNone
+	}
+	if opts.InflightKey == "" {
+		opts.InflightKey = InflightKeySkylinks
+	}
+	if opts.RetryPolicy.MaxAttempts == 0 {
+		opts.RetryPolicy.MaxAttempts = 1
+	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
+	var blockers []*blockerAPI
+	for _, url := range append([]string{blockerApiUrl}, opts.AdditionalURLs...) {
+		blockers = append(blockers, &blockerAPI{
+			staticBreaker: utils.NewCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+			staticURL:     url,
+		})
+	}
 	return &Blocker{
-		staticBlockerApiUrl: blockerApiUrl,
+		staticBlockers:      blockers,
 		staticContext:       ctx,
 		staticDatabase:      database,
-		staticLogger:        logger.WithField("module", "Blocker"),
+		staticLogSuppressor: utils.NewLogSuppressor(utils.DefaultLogSuppressInterval),
+		staticLogger:        logger.WithField("module", ModuleBlocker),
+		staticOptions:       opts,
 		staticServerDomain:  serverDomain,
 	}
 }
 
+// Name returns the name of the blocker.
+func (b *Blocker) Name() string {
+	return ModuleBlocker
+}
+
 // Start initializes the blocker process.
 func (b *Blocker) Start() error {
 	b.staticWaitGroup.Add(1)
@@ -63,6 +281,51 @@ func (b *Blocker) Start() error {
 	return nil
 }
 
+// RunOnce blocks the skylinks of all unblocked messages a single time, it does
+// not require the blocker to be started. It returns the counts of the block
+// pass.
+func (b *Blocker) RunOnce() BlockStats {
+	return b.blockMessages()
+}
+
+// Health verifies the blocker APIs are reachable, it returns an error if the
+// request fails, the API responds with a server error or the circuit breaker is
+// open for any of them.
+func (b *Blocker) Health(ctx context.Context) error {
+	var errs error
+	for _, blocker := range b.staticBlockers {
+		err := b.blockerHealth(ctx, blocker)
+		if err != nil && len(b.staticBlockers) > 1 {
+			err = errors.AddContext(err, blocker.staticURL)
+		}
+		errs = errors.Compose(errs, err)
+	}
+	return errs
+}
+
+// blockerHealth verifies the given blocker API is reachable.
+func (b *Blocker) blockerHealth(ctx context.Context, blocker *blockerAPI) error {
+	if blocker.staticBreaker.State() == utils.BreakerOpen {
+		return errBreakerOpen
+	}
+
+	url := fmt.Sprintf("%s/health", blocker.staticURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", version.UserAgent())
+	resp, err := b.staticOptions.HTTPClient.Do(req)
+	if err != nil {
+		return errors.AddContext(err, "blocker API unreachable")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status code %v from blocker API", resp.StatusCode)
+	}
+	return nil
+}
+
 // Stop waits for the blocker's waitgroup and times out after one minute.
 func (b *Blocker) Stop() error {
 	c := make(chan struct{})
@@ -73,7 +336,7 @@ func (b *Blocker) Stop() error {
 	select {
 	case <-c:
 		return nil
-	case <-time.After(time.Minute):
+	case <-time.After(b.staticOptions.ShutdownTimeout):
 		return errors.New("unclean blocker shutdown")
 	}
 }
@@ -88,9 +351,13 @@ func (b *Blocker) threadedBlockMessages() {
 	ticker := time.NewTicker(blockFrequency)
 
 	// start the loop
+	guard := newLoopGuard(ModuleBlocker, b.staticOptions.Notifier, logger)
 	for {
 		logger.Debugln("threadedBlockMessages loop iteration triggered")
-		b.blockMessages()
+		metrics.RecordLoopIteration(ModuleBlocker, blockFrequency)
+		if !runIterationUnlessPaused(b.staticContext.Done(), guard, b.staticOptions.Pause, func() { b.blockMessages() }) {
+			return
+		}
 
 		select {
 		case <-b.staticContext.Done():
@@ -103,42 +370,88 @@ func (b *Blocker) threadedBlockMessages() {
 
 // blockMessages is executed on every iteration of the loop in
 // threadedBlockMessages, it will scan for emails for which the skylinks have
-// not been blocked yet and attempt to block them.
-func (b *Blocker) blockMessages() {
+// not been blocked yet and attempt to block them. It returns the counts of the
+// block pass.
+func (b *Blocker) blockMessages() (stats BlockStats) {
 	// convenience variables
 	abuseDB := b.staticDatabase
 	logger := b.staticLogger
 
-	// fetch all unblocked emails
+	// fetch all unblocked emails, the backlog is checked before the circuit
+	// breaker as it's most likely to exceed the SLA while the breaker is open
 	toBlock, err := abuseDB.FindUnblocked()
 	if err != nil {
 		logger.Errorf("Failed fetching unblocked emails, error %v", err)
-		return
+		return stats
+	}
+	b.checkBacklogSLA(toBlock)
+
+	// leave the emails unblocked for later if the circuit breakers of all
+	// blocker APIs are open
+	if b.breakersOpen() {
+		logger.Debugln("Blocker API circuit breaker is open, skipping block attempts")
+		return stats
 	}
 
 	// log unblocked messages count
 	numUnblocked := len(toBlock)
 	if numUnblocked == 0 {
 		logger.Debugf("Found %v unblocked messages", numUnblocked)
-		return
+		return stats
 	}
 
 	logger.Infof("Found %v unblocked messages", numUnblocked)
 
 	// loop all emails and block the skylinks they contain
 	for _, email := range toBlock {
-		err := b.blockEmail(email)
+		err := b.blockEmail(email, &stats)
+		if errors.Contains(err, errBreakerOpen) {
+			logger.Warnf("Blocker API circuit breaker is open, pausing block attempts for %v", b.staticOptions.BreakerCooldown)
+			return stats
+		}
 		if err != nil {
-			logger.Errorf("Failed to parse email %v, error %v", email.UID, err)
+			b.staticLogSuppressor.Errorf(logger.WithField("email_uid", email.UID), "Failed to block email, error %v", err)
+		}
+	}
+	return stats
+}
+
+// checkBacklogSLA notifies the on-call if the oldest of the given unblocked
+// emails has been waiting to get blocked for longer than the SLA.
+func (b *Blocker) checkBacklogSLA(toBlock []database.AbuseEmail) {
+	var oldest database.AbuseEmail
+	for _, email := range toBlock {
+		if oldest.InsertedAt.IsZero() || email.InsertedAt.Before(oldest.InsertedAt) {
+			oldest = email
 		}
 	}
+	if oldest.InsertedAt.IsZero() {
+		return
+	}
+	age := time.Since(oldest.InsertedAt)
+	if age <= b.staticOptions.BacklogSLA {
+		return
+	}
+
+	b.staticLogger.Warnf("Oldest unblocked email %v has been waiting for %v, exceeding the SLA of %v", oldest.UID, age.Round(time.Second), b.staticOptions.BacklogSLA)
+	err := b.staticOptions.Notifier.Notify(notifier.SeverityWarning, "Blocker backlog exceeds SLA", []notifier.Field{
+		{Name: "Unblocked Emails", Value: fmt.Sprint(len(toBlock))},
+		{Name: "Oldest Email UID", Value: oldest.UID},
+		{Name: "Oldest Email Age", Value: age.Round(time.Second).String()},
+		{Name: "SLA", Value: b.staticOptions.BacklogSLA.String()},
+		{Name: "Circuit Breaker", Value: b.breakerState()},
+	})
+	if err != nil {
+		b.staticLogger.Errorf("Failed to notify of the blocker backlog, error %v", err)
+	}
 }
 
 // blockEmail will block the skylinks that are contained in the parse result of
-// the given email.
-func (b *Blocker) blockEmail(email database.AbuseEmail) (err error) {
+// the given email, it adds the outcome to the given stats.
+func (b *Blocker) blockEmail(email database.AbuseEmail, stats *BlockStats) (err error) {
 	// convenience variables
 	abuseDB := b.staticDatabase
+	logger := b.staticLogger.WithField("email_uid", email.UID)
 
 	// acquire the lock
 	lock := abuseDB.NewLock(email.UID)
@@ -156,82 +469,295 @@ func (b *Blocker) blockEmail(email database.AbuseEmail) (err error) {
 		}
 	}()
 
-	// block the skylinks from the parse result
-	result, err := b.blockReport(email.ParseResult)
+	// check whether a copy of the email is still in flight, if so we defer
+	// the email until the copy got finalized, after which we either merge its
+	// block result or block the email as usual
+	inflight, err := b.inflightCopy(email)
 	if err != nil {
-		return errors.AddContext(err, "failed blocking skylinks in the parse result")
+		return errors.AddContext(err, "could not find in-flight copy")
+	}
+	var result []string
+	var blockerResults []database.BlockerResult
+	var duplicateOf string
+	if inflight != nil && !inflight.Finalized && time.Since(email.InsertedAt) < inflightWindow {
+		logger.Infof("Deferring email, copy %v is still in flight", inflight.UID)
+		stats.Deferred++
+		return nil
+	}
+	if inflight != nil && b.staticOptions.InflightHandling == InflightHandlingMerge {
+		var merged bool
+		result, merged = mergedBlockResult(email.ParseResult, *inflight)
+		if merged {
+			duplicateOf = inflight.UID
+		}
 	}
 
-	// update the email
-	err = abuseDB.UpdateNoLock(email, bson.M{
-		"$set": bson.M{
-			"blocked":      true,
-			"blocked_by":   b.staticServerDomain,
-			"blocked_at":   time.Now().UTC(),
-			"block_result": result,
-		},
-	})
+	// block the skylinks from the parse result, in dry-run mode we only
+	// record what we would have blocked
+	if duplicateOf != "" {
+		logger.Infof("Merged the block result of copy %v", duplicateOf)
+	} else if b.staticOptions.DryRun {
+		result = dryRunBlockResult(email.ParseResult)
+		logger.Infof("Dry run, not blocking %v skylinks", len(result))
+	} else {
+		blockerResults, err = b.blockReport(email.ParseResult, b.excerpt(email))
+		if err != nil {
+			return errors.AddContext(err, "failed blocking skylinks in the parse result")
+		}
+		result = aggregateBlockResults(blockerResults)
+	}
+
+	// update the email, the result per blocker API is only recorded if the
+	// skylinks got blocked on more than one
+	update := bson.M{
+		"blocked":      true,
+		"blocked_by":   b.staticServerDomain,
+		"blocked_at":   time.Now().UTC(),
+		"block_result": result,
+	}
+	if len(blockerResults) > 1 {
+		update["blocker_results"] = blockerResults
+	}
+	if b.staticOptions.DryRun || duplicateOf != "" && inflight.DryRun {
+		update["dry_run"] = true
+	}
+	if duplicateOf != "" {
+		update["duplicate_of"] = duplicateOf
+	}
+	err = abuseDB.UpdateNoLockRetry(email, bson.M{
+		"$set": update,
+	}, func(current database.AbuseEmail) bool { return current.Blocked })
 	if err != nil {
 		return errors.AddContext(err, "could not update email")
 	}
+	stats.record(result)
 	return nil
 }
 
-// blockReport will block all skylinks from the given abuse report.
-func (b *Blocker) blockReport(report database.AbuseReport) ([]string, error) {
-	var results []string
+// inflightCopy returns the earliest copy of the given email that was still in
+// flight when the email got inserted, it returns nil if the blocker is not
+// configured to handle in-flight copies or if there's no such copy.
+func (b *Blocker) inflightCopy(email database.AbuseEmail) (*database.AbuseEmail, error) {
+	if b.staticOptions.InflightHandling == InflightHandlingNone {
+		return nil, nil
+	}
+	matchMessageID := b.staticOptions.InflightKey == InflightKeyMessageID
+	return b.staticDatabase.FindInflightCopy(email, matchMessageID, inflightWindow)
+}
+
+// blockReport will block all skylinks from the given abuse report on every
+// blocker API, it returns the block result of every blocker API. Failed requests
+// to a blocker API are recorded in its circuit breaker, the skylinks are not
+// blocked on the blocker APIs of which the breaker is open. If the breakers of
+// all blocker APIs are open blockReport returns errBreakerOpen. The given
+// excerpt is included in every block request, unless it is empty.
+func (b *Blocker) blockReport(report database.AbuseReport, excerpt string) ([]database.BlockerResult, error) {
+	results := make([]database.BlockerResult, len(b.staticBlockers))
+	for i, blocker := range b.staticBlockers {
+		results[i].Blocker = blocker.staticURL
+	}
+
+	recent := b.recentlyBlocked(report.Skylinks)
 	for _, skylink := range report.Skylinks {
-		result := func() string {
-			// build the request
-			req, err := b.buildBlockRequest(skylink, report)
-			if err != nil {
-				return fmt.Sprintf("failed to build request, err: %v", err.Error())
+		// skip the skylinks that got blocked recently, on every blocker API
+		if _, exists := recent[skylink]; exists {
+			for i := range results {
+				results[i].Result = append(results[i].Result, database.AbuseStatusAlreadyBlocked)
 			}
+			continue
+		}
+		skylinkReport := b.skylinkReport(skylink, report)
 
-			// execute the request
-			b.staticLogger.Debugf("blocking %v...%v", skylink[:4], skylink[len(skylink)-4:])
-			resp, err := http.DefaultClient.Do(req)
+		var breakerErr error
+		var unavailable int
+		for i, blocker := range b.staticBlockers {
+			result, err := b.blockSkylink(blocker, skylink, skylinkReport, excerpt)
 			if err != nil {
-				return fmt.Sprintf("failed to execute request, err: %v", err.Error())
-			}
-			defer func() {
-				err = resp.Body.Close()
-				if err != nil {
-					b.staticLogger.Errorf("failed to close response body, err: %v", err)
-				}
-			}()
-
-			// handle the response
-			switch resp.StatusCode {
-			case http.StatusOK, http.StatusNoContent:
-				return database.AbuseStatusBlocked
-			default:
-				respBody, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return fmt.Sprintf("failed to read response body, err: %v", err.Error())
-				}
-				return fmt.Sprintf("failed to block skylink, status %v response: %v", resp.Status, string(respBody))
+				breakerErr = err
+				unavailable++
+				result = fmt.Sprintf("failed to block skylink, %v", err)
 			}
-		}()
-		results = append(results, result)
+			results[i].Result = append(results[i].Result, result)
+		}
+
+		// abort if the skylink can't be blocked on any of the blocker APIs,
+		// so the email is left unblocked and retried later
+		if unavailable == len(b.staticBlockers) {
+			return nil, breakerErr
+		}
 	}
 
 	// sanity check we have a result for every skylink
-	if len(results) != len(report.Skylinks) {
-		return nil, errors.New("block result not defined for every skylink")
+	for _, result := range results {
+		if len(result.Result) != len(report.Skylinks) {
+			return nil, errors.New("block result not defined for every skylink")
+		}
 	}
 
 	return results, nil
 }
 
-// buildBlockRequest builds a request to be sent to the blocker API using the
-// provided input.
-func (b *Blocker) buildBlockRequest(skylink string, report database.AbuseReport) (*http.Request, error) {
+// recentlyBlocked returns which of the given skylinks got blocked within the
+// recent block window, it returns nil if the window is not set. Failing to
+// look those up is not fatal, we then submit every skylink.
+func (b *Blocker) recentlyBlocked(skylinks []string) map[string]struct{} {
+	if b.staticOptions.RecentBlockWindow <= 0 {
+		return nil
+	}
+
+	recent, err := b.staticDatabase.FindRecentlyBlocked(skylinks, b.staticOptions.RecentBlockWindow)
+	if err != nil {
+		b.staticLogger.Warnf("failed to find recently blocked skylinks, err: %v", err)
+		return nil
+	}
+	if len(recent) > 0 {
+		b.staticLogger.Debugf("skipping %v recently blocked skylinks", len(recent))
+	}
+	return recent
+}
+
+// blockSkylink will block the given skylink on the given blocker API and
+// returns the block result. The outcome is recorded in the circuit breaker of
+// the blocker API, blockSkylink returns errBreakerOpen if the breaker is open
+// or if it opened because of this request.
+func (b *Blocker) blockSkylink(blocker *blockerAPI, skylink string, report database.AbuseReport, excerpt string) (string, error) {
+	// convenience variables
+	logger := b.staticLogger.WithField("skylink", skylink)
+	if len(b.staticBlockers) > 1 {
+		logger = logger.WithField("blocker", blocker.staticURL)
+	}
+
+	if !blocker.staticBreaker.Allow() {
+		return "", errBreakerOpen
+	}
+
+	// execute the request, failed requests are retried according to the
+	// retry policy
+	var result string
+	var failed bool
+	_ = utils.Retry(b.staticContext, b.staticOptions.RetryPolicy, func() error {
+		result, failed = b.sendBlockRequest(blocker, skylink, report, excerpt, logger)
+		if failed {
+			return errors.New(result)
+		}
+		return nil
+	})
+
+	if result != database.AbuseStatusBlocked {
+		b.staticLogSuppressor.Errorf(logger, "Failed to block skylink, %v", result)
+	}
+
+	// record the outcome in the circuit breaker
+	if !failed {
+		if blocker.staticBreaker.RecordSuccess() {
+			logger.Infoln("Blocker API recovered, circuit breaker closed")
+		}
+	} else if blocker.staticBreaker.RecordFailure() {
+		return "", errors.AddContext(errBreakerOpen, result)
+	}
+	return result, nil
+}
+
+// sendBlockRequest sends a single request to the given blocker API to block
+// the given skylink. It returns the block result, and whether the request
+// failed in a way that indicates the blocker API is unavailable, i.e. it could
+// not be executed or got a 5xx response.
+func (b *Blocker) sendBlockRequest(blocker *blockerAPI, skylink string, report database.AbuseReport, excerpt string, logger *logrus.Entry) (string, bool) {
+	// build the request
+	req, err := b.buildBlockRequest(blocker.staticURL, skylink, report, excerpt)
+	if err != nil {
+		return fmt.Sprintf("failed to build request, err: %v", err.Error()), false
+	}
+
+	// execute the request
+	logger.Debugf("blocking %v...%v", skylink[:4], skylink[len(skylink)-4:])
+	resp, err := b.staticOptions.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Sprintf("failed to execute request, err: %v", err.Error()), true
+	}
+	defer func() {
+		err = resp.Body.Close()
+		if err != nil {
+			logger.Errorf("failed to close response body, err: %v", err)
+		}
+	}()
+
+	// handle the response
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return database.AbuseStatusBlocked, false
+	default:
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Sprintf("failed to read response body, err: %v", err.Error()), true
+		}
+		return fmt.Sprintf("failed to block skylink, status %v response: %v", resp.Status, string(respBody)), resp.StatusCode >= 500
+	}
+}
+
+// breakersOpen returns true if the circuit breakers of all blocker APIs are
+// open.
+func (b *Blocker) breakersOpen() bool {
+	for _, blocker := range b.staticBlockers {
+		if blocker.staticBreaker.State() != utils.BreakerOpen {
+			return false
+		}
+	}
+	return true
+}
+
+// breakerState returns the state of the circuit breaker of the blocker API, or
+// the state of every breaker alongside the URL of its blocker API if there are
+// multiple blocker APIs.
+func (b *Blocker) breakerState() string {
+	if len(b.staticBlockers) == 1 {
+		return b.staticBlockers[0].staticBreaker.State()
+	}
+	states := make([]string, len(b.staticBlockers))
+	for i, blocker := range b.staticBlockers {
+		states[i] = fmt.Sprintf("%v: %v", blocker.staticURL, blocker.staticBreaker.State())
+	}
+	return strings.Join(states, ", ")
+}
+
+// skylinkReport returns the report that is sent to the blocker API for the
+// given skylink. If the blocker is configured to merge tags, the tags of the
+// report are merged with the tags of prior blocks of the same skylink. Failing
+// to look those up is not fatal, we block the skylink using its own tags.
+func (b *Blocker) skylinkReport(skylink string, report database.AbuseReport) database.AbuseReport {
+	if !b.staticOptions.MergeTags {
+		return report
+	}
+
+	prior, err := b.staticDatabase.FindSkylinkTags(skylink)
+	if err != nil {
+		b.staticLogger.WithField("skylink", skylink).Warnf("failed to find prior tags, err: %v", err)
+		return report
+	}
+	report.Tags = mergeTags(report.Tags, prior)
+	return report
+}
+
+// excerpt returns the excerpt of the given email that is included in the block
+// requests, it is empty if the blocker is not configured to include it. We
+// only use the subject of the complaint, as the body is more likely to contain
+// sensitive information.
+func (b *Blocker) excerpt(email database.AbuseEmail) string {
+	if !b.staticOptions.IncludeExcerpt {
+		return ""
+	}
+	return buildExcerpt(email.Subject, b.staticOptions.ExcerptMaxLength)
+}
+
+// buildBlockRequest builds a request to be sent to the blocker API at the given
+// URL using the provided input.
+func (b *Blocker) buildBlockRequest(blockerURL, skylink string, report database.AbuseReport, excerpt string) (*http.Request, error) {
 	// build the request body
 	reqBody := BlockPOST{
 		Skylink:  skylink,
 		Reporter: report.Reporter,
 		Tags:     report.Tags,
+		Excerpt:  excerpt,
 	}
 
 	// build the request
@@ -241,13 +767,137 @@ func (b *Blocker) buildBlockRequest(skylink string, report database.AbuseReport)
 	}
 	reqBodyBuffer := bytes.NewBuffer(reqBodyBytes)
 
-	url := fmt.Sprintf("%s/block", b.staticBlockerApiUrl)
+	url := fmt.Sprintf("%s/block", blockerURL)
 	req, err := http.NewRequest(http.MethodPost, url, reqBodyBuffer)
 	if err != nil {
 		return nil, err
 	}
 
 	// add the headers
-	req.Header.Set("User-Agent", "Sia-Agent")
+	req.Header.Set("User-Agent", version.UserAgent())
 	return req, nil
 }
+
+// record adds an email with the given block result to the stats.
+func (s *BlockStats) record(result []string) {
+	if s.Statuses == nil {
+		s.Statuses = make(map[string]int)
+	}
+	s.Blocked++
+	for _, status := range result {
+		s.Statuses[status]++
+	}
+}
+
+// aggregateBlockResults is a helper function that aggregates the given block
+// results of the blocker APIs into a single block result per skylink. A skylink
+// is blocked if it got blocked on all blocker APIs, otherwise its result
+// mentions on how many of them it got blocked and why it failed on the others.
+// A skylink that was already blocked has that status on every blocker API.
+func aggregateBlockResults(results []database.BlockerResult) []string {
+	if len(results) == 1 {
+		return results[0].Result
+	}
+
+	aggregated := make([]string, len(results[0].Result))
+	for i := range aggregated {
+		if results[0].Result[i] == database.AbuseStatusAlreadyBlocked {
+			aggregated[i] = database.AbuseStatusAlreadyBlocked
+			continue
+		}
+		var blocked int
+		var failures []string
+		for _, result := range results {
+			if result.Result[i] == database.AbuseStatusBlocked {
+				blocked++
+				continue
+			}
+			failures = append(failures, fmt.Sprintf("%v: %v", result.Blocker, result.Result[i]))
+		}
+		if blocked == len(results) {
+			aggregated[i] = database.AbuseStatusBlocked
+			continue
+		}
+		aggregated[i] = fmt.Sprintf("blocked on %v/%v blockers, failed on %v", blocked, len(results), strings.Join(failures, "; "))
+	}
+	return aggregated
+}
+
+// dryRunBlockResult is a helper function that returns the block result for
+// the given abuse report in dry-run mode, every skylink gets the dry-run
+// status.
+func dryRunBlockResult(report database.AbuseReport) []string {
+	results := make([]string, len(report.Skylinks))
+	for i := range results {
+		results[i] = database.AbuseStatusDryRun
+	}
+	return results
+}
+
+// mergedBlockResult is a helper function that returns the block result for the
+// given abuse report, taken from the block result of the given inflight. It
+// returns false if the copy was not blocked or if it has no block result for
+// every skylink in the report.
+func mergedBlockResult(report database.AbuseReport, inflight database.AbuseEmail) ([]string, bool) {
+	if !inflight.Blocked || len(inflight.BlockResult) != len(inflight.ParseResult.Skylinks) {
+		return nil, false
+	}
+	merged := make([]string, len(report.Skylinks))
+	for i, sl := range report.Skylinks {
+		j := indexSkylink(inflight.ParseResult.Skylinks, sl)
+		if j == -1 {
+			return nil, false
+		}
+		merged[i] = inflight.BlockResult[j]
+	}
+	return merged, true
+}
+
+// indexSkylink is a helper function that returns the index of the given
+// skylink in the given skylinks, regardless of how they are encoded. It
+// returns -1 if the skylink is not present.
+func indexSkylink(skylinks []string, sl string) int {
+	for i, candidate := range skylinks {
+		if candidate == sl || skylink.Equal(candidate, sl) {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeTags is a helper function that returns the union of the given tags and
+// the given prior tags. The order of the given tags is preserved, the prior
+// tags that were missing are appended in the order they were given in.
+func mergeTags(tags, prior []string) []string {
+	merged := make([]string, 0, len(tags)+len(prior))
+	seen := make(map[string]struct{}, len(tags)+len(prior))
+	for _, tag := range append(append([]string{}, tags...), prior...) {
+		if _, exists := seen[tag]; exists {
+			continue
+		}
+		seen[tag] = struct{}{}
+		merged = append(merged, tag)
+	}
+	return merged
+}
+
+// buildExcerpt is a helper function that turns the given complaint text into an
+// excerpt that is safe to share with the blocker. It redacts email addresses,
+// removes control characters, collapses whitespace and truncates the result to
+// the given maximum amount of characters.
+func buildExcerpt(text string, maxLength int) string {
+	text = excerptEmailRE.ReplaceAllString(text, excerptRedacted)
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+
+	runes := []rune(text)
+	if len(runes) > maxLength {
+		text = strings.TrimSpace(string(runes[:maxLength]))
+	}
+	return text
+}
@@ -2,16 +2,25 @@ package email
 
 import (
 	"abuse-scanner/database"
+	"abuse-scanner/notifier"
+	"abuse-scanner/utils"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
 	skyapi "gitlab.com/SkynetLabs/skyd/node/api"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.sia.tech/siad/build"
 )
@@ -27,10 +36,42 @@ func TestBlocker(t *testing.T) {
 		name string
 		test func(t *testing.T)
 	}{
+		{
+			name: "BacklogSLA",
+			test: testBlockerBacklogSLA,
+		},
 		{
 			name: "Blocker",
 			test: testBlocker,
 		},
+		{
+			name: "CircuitBreaker",
+			test: testBlockerCircuitBreaker,
+		},
+		{
+			name: "Excerpt",
+			test: testBlockerExcerpt,
+		},
+		{
+			name: "Inflight",
+			test: testBlockerInflight,
+		},
+		{
+			name: "MergeTags",
+			test: testBlockerMergeTags,
+		},
+		{
+			name: "MultipleBlockers",
+			test: testBlockerMultipleBlockers,
+		},
+		{
+			name: "RecentBlockWindow",
+			test: testBlockerRecentBlockWindow,
+		},
+		{
+			name: "Retry",
+			test: testBlockerRetry,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, test.test)
@@ -49,7 +90,7 @@ func testBlocker(t *testing.T) {
 
 	// create the abuse databases
 	abuseDBName := t.Name() + "_AbuseDB"
-	abuseDB, err := database.NewTestAbuseScannerDB(ctx, abuseDBName)
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, abuseDBName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -69,7 +110,7 @@ func testBlocker(t *testing.T) {
 
 	// create a blocker
 	domain := "dev.siasky.net"
-	bl := NewBlocker(ctx, server.URL, domain, abuseDB, logger)
+	bl := NewBlocker(ctx, server.URL, domain, abuseDB, BlockerOptions{}, logger)
 
 	// insert an email to report
 	insertedAt := time.Now().UTC()
@@ -142,3 +183,746 @@ func testBlocker(t *testing.T) {
 	// call cancel so we can cleanly stop the blocker
 	cancel()
 }
+
+// testBlockerBacklogSLA verifies the on-call is notified when the oldest
+// unblocked email exceeds the backlog SLA.
+func testBlockerBacklogSLA(t *testing.T) {
+	// create a webhook that counts the notifications
+	var notified uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&notified, 1)
+	}))
+	defer server.Close()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create a blocker
+	b := NewBlocker(context.Background(), "", "", nil, BlockerOptions{
+		BacklogSLA: time.Hour,
+		Notifier:   notifier.NewNotifier(server.URL, notifier.NotifierOptions{}),
+	}, logger)
+
+	// assert a backlog within the SLA does not notify
+	now := time.Now().UTC()
+	b.checkBacklogSLA(nil)
+	b.checkBacklogSLA([]database.AbuseEmail{{UID: "a", InsertedAt: now.Add(-time.Minute)}})
+	if atomic.LoadUint64(&notified) != 0 {
+		t.Fatal("unexpected notification")
+	}
+
+	// assert a backlog that exceeds the SLA notifies, only once as the
+	// notifications are rate limited
+	toBlock := []database.AbuseEmail{
+		{UID: "a", InsertedAt: now.Add(-time.Minute)},
+		{UID: "b", InsertedAt: now.Add(-2 * time.Hour)},
+	}
+	b.checkBacklogSLA(toBlock)
+	b.checkBacklogSLA(toBlock)
+	if atomic.LoadUint64(&notified) != 1 {
+		t.Fatal("unexpected amount of notifications", atomic.LoadUint64(&notified))
+	}
+}
+
+// testBlockerCircuitBreaker verifies the blocker stops calling the blocker API
+// when it fails consistently, and resumes once it has recovered.
+func testBlockerCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create a test server that fails while failing is set
+	var calls, failing uint64
+	atomic.StoreUint64(&failing, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&calls, 1)
+		if atomic.LoadUint64(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		skyapi.WriteSuccess(w)
+	}))
+	defer server.Close()
+
+	// create a blocker
+	cooldown := 100 * time.Millisecond
+	bl := NewBlocker(context.Background(), server.URL, "dev.siasky.net", nil, BlockerOptions{
+		BreakerCooldown:  cooldown,
+		BreakerThreshold: 2,
+	}, logger)
+
+	report := database.AbuseReport{
+		Skylinks: []string{
+			"AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg",
+			"BBBg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg",
+			"CADEnmNNR6arnyDSH60MlGjQK5O3Sv-ecK1PGt3MNmQUhA",
+		},
+		Tags: []string{"phishing"},
+	}
+
+	// assert the breaker opens after two consecutive failures
+	_, err := bl.blockReport(report, "")
+	if !errors.Contains(err, errBreakerOpen) {
+		t.Fatal("unexpected error", err)
+	}
+	if atomic.LoadUint64(&calls) != 2 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// assert the blocker API is not called while the breaker is open
+	_, err = bl.blockReport(report, "")
+	if !errors.Contains(err, errBreakerOpen) {
+		t.Fatal("unexpected error", err)
+	}
+	if atomic.LoadUint64(&calls) != 2 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// assert a failed trial after the cooldown opens the breaker again
+	time.Sleep(2 * cooldown)
+	if bl.staticBlockers[0].staticBreaker.State() != utils.BreakerHalfOpen {
+		t.Fatal("unexpected breaker state", bl.staticBlockers[0].staticBreaker.State())
+	}
+	_, err = bl.blockReport(report, "")
+	if !errors.Contains(err, errBreakerOpen) {
+		t.Fatal("unexpected error", err)
+	}
+	if atomic.LoadUint64(&calls) != 3 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+
+	// recover the blocker API and assert the breaker closes after the cooldown
+	atomic.StoreUint64(&failing, 0)
+	time.Sleep(2 * cooldown)
+	results, err := bl.blockReport(report, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results[0].Result {
+		if result != database.AbuseStatusBlocked {
+			t.Fatal("unexpected result", result)
+		}
+	}
+	if atomic.LoadUint64(&calls) != 6 {
+		t.Fatal("unexpected amount of calls", calls)
+	}
+	if bl.staticBlockers[0].staticBreaker.State() != utils.BreakerClosed {
+		t.Fatal("unexpected breaker state", bl.staticBlockers[0].staticBreaker.State())
+	}
+}
+
+// testBlockerMultipleBlockers verifies the skylinks are blocked on every
+// blocker API, that the block results are aggregated across the blocker APIs
+// and that a blocker API of which the circuit breaker is open doesn't prevent
+// blocking the skylinks on the others.
+func testBlockerMultipleBlockers(t *testing.T) {
+	t.Parallel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create two test servers that record the skylinks they receive, the
+	// second one refuses to block the first skylink
+	report := database.AbuseReport{
+		Skylinks: []string{
+			"AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg",
+			"BBBg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg",
+		},
+		Tags: []string{"phishing"},
+	}
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	newServer := func(name string, refuse string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body BlockPOST
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			received[name] = append(received[name], body.Skylink)
+			mu.Unlock()
+			if body.Skylink == refuse {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			skyapi.WriteSuccess(w)
+		}))
+	}
+	first := newServer("first", "")
+	defer first.Close()
+	second := newServer("second", report.Skylinks[0])
+	defer second.Close()
+
+	// assert both blocker APIs receive every skylink
+	bl := NewBlocker(context.Background(), first.URL, "dev.siasky.net", nil, BlockerOptions{
+		AdditionalURLs: []string{second.URL},
+	}, logger)
+	results, err := bl.blockReport(report, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(received["first"], report.Skylinks) || !reflect.DeepEqual(received["second"], report.Skylinks) {
+		t.Fatal("unexpected requests", received)
+	}
+	mu.Unlock()
+	if len(results) != 2 || results[0].Blocker != first.URL || results[1].Blocker != second.URL {
+		t.Fatal("unexpected results", results)
+	}
+
+	// assert the results are aggregated, the first skylink only got blocked
+	// on one of the blocker APIs
+	aggregated := aggregateBlockResults(results)
+	if len(aggregated) != 2 || aggregated[1] != database.AbuseStatusBlocked {
+		t.Fatal("unexpected aggregated results", aggregated)
+	}
+	if !strings.HasPrefix(aggregated[0], "blocked on 1/2 blockers, failed on "+second.URL+": failed to block skylink, status 400") {
+		t.Fatal("unexpected aggregated result", aggregated[0])
+	}
+
+	// assert the report shows the result per blocker API
+	email := database.AbuseEmail{
+		Parsed:         true,
+		Blocked:        true,
+		ParseResult:    report,
+		BlockResult:    aggregated,
+		BlockerResults: results,
+	}
+	expected := fmt.Sprintf("\nBlocker Results:\n- %v: 2/2 blocked\n- %v: 1/2 blocked\n", first.URL, second.URL)
+	if !strings.Contains(email.String(), expected) {
+		t.Fatal("unexpected report", email.String())
+	}
+
+	// assert the skylinks are still blocked on the first blocker API if the
+	// second one is unavailable, and that we abort once both are
+	second.Close()
+	bl = NewBlocker(context.Background(), first.URL, "dev.siasky.net", nil, BlockerOptions{
+		AdditionalURLs:   []string{second.URL},
+		BreakerThreshold: 1,
+	}, logger)
+	results, err = bl.blockReport(report, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Result[1] != database.AbuseStatusBlocked || !strings.Contains(results[1].Result[1], errBreakerOpen.Error()) {
+		t.Fatal("unexpected results", results)
+	}
+	if bl.breakersOpen() {
+		t.Fatal("expected the breaker of the first blocker API to be closed")
+	}
+	first.Close()
+	_, err = bl.blockReport(report, "")
+	if !errors.Contains(err, errBreakerOpen) || !bl.breakersOpen() {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testBlockerExcerpt verifies the sanitized complaint excerpt is included in the
+// block request when the blocker is configured to do so.
+func testBlockerExcerpt(t *testing.T) {
+	t.Parallel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create a test server that records the excerpts it receives
+	var mu sync.Mutex
+	var excerpts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body BlockPOST
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		excerpts = append(excerpts, body.Excerpt)
+		mu.Unlock()
+		skyapi.WriteSuccess(w)
+	}))
+	defer server.Close()
+
+	email := database.AbuseEmail{
+		Subject: "[Ticket#123]  Phishing site\r\n reported by john.doe@example.com",
+		ParseResult: database.AbuseReport{
+			Skylinks: []string{"AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg"},
+			Tags:     []string{"phishing"},
+		},
+	}
+
+	// assert the excerpt is not included by default
+	bl := NewBlocker(context.Background(), server.URL, "dev.siasky.net", nil, BlockerOptions{}, logger)
+	_, err := bl.blockReport(email.ParseResult, bl.excerpt(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the excerpt is included and sanitized when enabled
+	bl = NewBlocker(context.Background(), server.URL, "dev.siasky.net", nil, BlockerOptions{
+		IncludeExcerpt: true,
+	}, logger)
+	_, err = bl.blockReport(email.ParseResult, bl.excerpt(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(excerpts) != 2 {
+		t.Fatal("unexpected amount of requests", len(excerpts))
+	}
+	if excerpts[0] != "" {
+		t.Fatal("unexpected excerpt", excerpts[0])
+	}
+	if excerpts[1] != "[Ticket#123] Phishing site reported by [redacted]" {
+		t.Fatal("unexpected excerpt", excerpts[1])
+	}
+
+	// assert the excerpt helper truncates the excerpt
+	excerpt := buildExcerpt(email.Subject, 26)
+	if excerpt != "[Ticket#123] Phishing site" {
+		t.Fatal("unexpected excerpt", excerpt)
+	}
+}
+
+// testBlockerRetry verifies block requests that fail with a 5xx response are
+// retried according to the retry policy, and that requests that are refused
+// are not.
+func testBlockerRetry(t *testing.T) {
+	t.Parallel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create a test server that is unavailable for the first two requests,
+	// and refuses to block the second skylink
+	report := database.AbuseReport{
+		Skylinks: []string{
+			"AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg",
+			"BBBg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg",
+		},
+		Tags: []string{"phishing"},
+	}
+	var requests uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddUint64(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var body BlockPOST
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || body.Skylink == report.Skylinks[1] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		skyapi.WriteSuccess(w)
+	}))
+	defer server.Close()
+
+	bl := NewBlocker(context.Background(), server.URL, "dev.siasky.net", nil, BlockerOptions{
+		RetryPolicy: utils.RetryPolicy{BaseBackoff: time.Millisecond, MaxAttempts: 3},
+	}, logger)
+
+	// assert the first skylink got blocked on the third attempt
+	result, err := bl.blockSkylink(bl.staticBlockers[0], report.Skylinks[0], report, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != database.AbuseStatusBlocked || atomic.LoadUint64(&requests) != 3 {
+		t.Fatal("unexpected result", result, requests)
+	}
+
+	// assert the refused skylink is not retried
+	result, err = bl.blockSkylink(bl.staticBlockers[0], report.Skylinks[1], report, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == database.AbuseStatusBlocked || atomic.LoadUint64(&requests) != 4 {
+		t.Fatal("unexpected result", result, requests)
+	}
+
+	// assert block requests are not retried by default
+	atomic.StoreUint64(&requests, 0)
+	bl = NewBlocker(context.Background(), server.URL, "dev.siasky.net", nil, BlockerOptions{}, logger)
+	result, err = bl.blockSkylink(bl.staticBlockers[0], report.Skylinks[0], report, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == database.AbuseStatusBlocked || atomic.LoadUint64(&requests) != 1 {
+		t.Fatal("unexpected result", result, requests)
+	}
+}
+
+// testBlockerRecentBlockWindow verifies a skylink that got blocked recently,
+// while blocking a prior email, is not submitted to the blocker API again if
+// the recent block window is set.
+func testBlockerRecentBlockWindow(t *testing.T) {
+	t.Parallel()
+
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// create a test server that records the skylinks it receives
+	var mu sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body BlockPOST
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requested = append(requested, body.Skylink)
+		mu.Unlock()
+		skyapi.WriteSuccess(w)
+	}))
+	defer server.Close()
+
+	// blockAndAssert is a helper that inserts an email reporting the given
+	// skylinks, blocks it and asserts its block result and the skylinks the
+	// blocker API received
+	skylink1 := "AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg"
+	skylink2 := "BBBg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg"
+	blockAndAssert := func(bl *Blocker, uid string, skylinks, expectedResult, expectedRequested []string) {
+		email := database.AbuseEmail{
+			ID:     primitive.NewObjectID(),
+			UID:    uid,
+			Parsed: true,
+			ParseResult: database.AbuseReport{
+				Skylinks: skylinks,
+				Tags:     []string{"phishing"},
+			},
+			InsertedAt: time.Now().UTC(),
+		}
+		err := abuseDB.InsertOne(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		requested = nil
+		mu.Unlock()
+		err = bl.blockEmail(email, new(BlockStats))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blocked, err := abuseDB.FindOne(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(blocked.BlockResult, expectedResult) {
+			t.Fatalf("unexpected block result, %v != %v", blocked.BlockResult, expectedResult)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(requested, expectedRequested) {
+			t.Fatalf("unexpected requests, %v != %v", requested, expectedRequested)
+		}
+	}
+
+	// assert the skylinks are submitted again if the window is not set
+	bl := NewBlocker(ctx, server.URL, "dev.siasky.net", abuseDB, BlockerOptions{}, logger)
+	blockAndAssert(bl, "INBOX-1", []string{skylink1}, []string{database.AbuseStatusBlocked}, []string{skylink1})
+	blockAndAssert(bl, "INBOX-2", []string{skylink1}, []string{database.AbuseStatusBlocked}, []string{skylink1})
+
+	// assert the recently blocked skylink is skipped if the window is set
+	bl = NewBlocker(ctx, server.URL, "dev.siasky.net", abuseDB, BlockerOptions{RecentBlockWindow: time.Hour}, logger)
+	blockAndAssert(bl, "INBOX-3", []string{skylink1, skylink2}, []string{database.AbuseStatusAlreadyBlocked, database.AbuseStatusBlocked}, []string{skylink2})
+	blockAndAssert(bl, "INBOX-4", []string{skylink2, skylink1}, []string{database.AbuseStatusAlreadyBlocked, database.AbuseStatusAlreadyBlocked}, nil)
+
+	// assert the already blocked status is not aggregated across blocker APIs
+	aggregated := aggregateBlockResults([]database.BlockerResult{
+		{Blocker: "a", Result: []string{database.AbuseStatusAlreadyBlocked, database.AbuseStatusBlocked}},
+		{Blocker: "b", Result: []string{database.AbuseStatusAlreadyBlocked, database.AbuseStatusBlocked}},
+	})
+	if !reflect.DeepEqual(aggregated, []string{database.AbuseStatusAlreadyBlocked, database.AbuseStatusBlocked}) {
+		t.Fatal("unexpected aggregated results", aggregated)
+	}
+}
+
+// testBlockerMergeTags verifies a skylink that gets reported again under a
+// different tag accumulates the tags of all emails it was reported in.
+func testBlockerMergeTags(t *testing.T) {
+	t.Parallel()
+
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// create a test server that records the tags it receives
+	var mu sync.Mutex
+	var tags [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body BlockPOST
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		tags = append(tags, body.Tags)
+		mu.Unlock()
+		skyapi.WriteSuccess(w)
+	}))
+	defer server.Close()
+
+	// blockAndAssert is a helper that inserts an email reporting the skylink
+	// under the given tags, blocks it and asserts the tags the blocker API
+	// received
+	skylink := "AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg"
+	blockAndAssert := func(bl *Blocker, uid string, reported, expected []string) {
+		email := database.AbuseEmail{
+			ID:     primitive.NewObjectID(),
+			UID:    uid,
+			Parsed: true,
+			ParseResult: database.AbuseReport{
+				Skylinks: []string{skylink},
+				Tags:     reported,
+			},
+			InsertedAt: time.Now().UTC(),
+		}
+		err := abuseDB.InsertOne(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bl.blockEmail(email, new(BlockStats))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(tags) == 0 || !reflect.DeepEqual(tags[len(tags)-1], expected) {
+			t.Fatalf("unexpected tags, %v != %v", tags, expected)
+		}
+	}
+
+	// assert the tags are not merged by default
+	bl := NewBlocker(ctx, server.URL, "dev.siasky.net", abuseDB, BlockerOptions{}, logger)
+	blockAndAssert(bl, "INBOX-1", []string{"phishing"}, []string{"phishing"})
+	blockAndAssert(bl, "INBOX-2", []string{"malware"}, []string{"malware"})
+
+	// assert the tags accumulate when enabled
+	bl = NewBlocker(ctx, server.URL, "dev.siasky.net", abuseDB, BlockerOptions{MergeTags: true}, logger)
+	blockAndAssert(bl, "INBOX-3", []string{"malware"}, []string{"malware", "phishing"})
+	blockAndAssert(bl, "INBOX-4", []string{"csam"}, []string{"csam", "malware", "phishing"})
+
+	// assert the merge helper preserves the order and dedupes the tags
+	merged := mergeTags([]string{"phishing", "csam"}, []string{"csam", "copyright", "malware"})
+	if !reflect.DeepEqual(merged, []string{"phishing", "csam", "copyright", "malware"}) {
+		t.Fatal("unexpected merged tags", merged)
+	}
+}
+
+// testBlockerInflight verifies an email that arrives while an identical copy
+// of it is still in flight is deferred until the copy got finalized, after
+// which the block result of the copy is either merged or the email is blocked
+// as usual.
+func testBlockerInflight(t *testing.T) {
+	t.Parallel()
+
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// create a test server that counts the block requests
+	var requests uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&requests, 1)
+		skyapi.WriteSuccess(w)
+	}))
+	defer server.Close()
+
+	// insert is a helper that inserts a parsed email reporting the given
+	// skylinks
+	skylink1 := "AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg"
+	skylink2 := "AAB4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg_"
+	insert := func(uid, from string, insertedAt time.Time, skylinks ...string) {
+		err := abuseDB.InsertOne(database.AbuseEmail{
+			ID:          primitive.NewObjectID(),
+			UID:         uid,
+			From:        from,
+			MessageID:   fmt.Sprintf("<%v@example.com>", uid),
+			Parsed:      true,
+			ParseResult: database.AbuseReport{Skylinks: skylinks},
+			InsertedAt:  insertedAt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// finalize is a helper that marks the email with given uid as finalized
+	finalize := func(uid string) {
+		email, err := abuseDB.FindOne(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = abuseDB.UpdateNoLock(*email, bson.M{"$set": bson.M{
+			"finalized":    true,
+			"finalized_at": time.Now().UTC(),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// find is a helper that returns the email with given uid
+	find := func(uid string) database.AbuseEmail {
+		email, err := abuseDB.FindOne(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *email
+	}
+
+	// simulate two near-simultaneous identical emails, and an email from
+	// another reporter that reports the same skylinks
+	now := time.Now().UTC()
+	insert("INBOX-1", "reporter@example.com", now.Add(-2*time.Second), skylink1, skylink2)
+	insert("INBOX-2", "reporter@example.com", now.Add(-time.Second), skylink2, skylink1)
+	insert("INBOX-3", "other@example.com", now.Add(-time.Second), skylink1, skylink2)
+
+	// assert the copy is deferred while the first email is in flight
+	bl := NewBlocker(ctx, server.URL, "dev.siasky.net", abuseDB, BlockerOptions{InflightHandling: InflightHandlingMerge}, logger)
+	bl.RunOnce()
+	if !find("INBOX-1").Blocked || !find("INBOX-3").Blocked {
+		t.Fatal("expected the first email and the email from another reporter to be blocked")
+	}
+	if find("INBOX-2").Blocked {
+		t.Fatal("expected the copy to be deferred")
+	}
+	if atomic.LoadUint64(&requests) != 4 {
+		t.Fatal("unexpected amount of block requests", requests)
+	}
+
+	// finalize the first email, assert the copy got merged without blocking
+	// the skylinks again
+	finalize("INBOX-1")
+	bl.RunOnce()
+	duplicate := find("INBOX-2")
+	if !duplicate.Blocked || duplicate.DuplicateOf != "INBOX-1" {
+		t.Fatal("expected the copy to be merged", duplicate.Blocked, duplicate.DuplicateOf)
+	}
+	if !reflect.DeepEqual(duplicate.BlockResult, []string{database.AbuseStatusBlocked, database.AbuseStatusBlocked}) {
+		t.Fatal("unexpected block result", duplicate.BlockResult)
+	}
+	if atomic.LoadUint64(&requests) != 4 {
+		t.Fatal("unexpected amount of block requests", requests)
+	}
+
+	// assert an email that arrives after its copies got finalized is not
+	// considered a duplicate
+	finalize("INBOX-2")
+	finalize("INBOX-3")
+	insert("INBOX-4", "reporter@example.com", time.Now().UTC(), skylink1, skylink2)
+	bl.RunOnce()
+	if email := find("INBOX-4"); !email.Blocked || email.DuplicateOf != "" {
+		t.Fatal("expected the email to be blocked as usual", email.Blocked, email.DuplicateOf)
+	}
+	if atomic.LoadUint64(&requests) != 6 {
+		t.Fatal("unexpected amount of block requests", requests)
+	}
+
+	// assert the copy is blocked as usual once its copy got finalized if the
+	// blocker is configured to defer copies, and that copies can be matched
+	// on their message id
+	bl = NewBlocker(ctx, server.URL, "dev.siasky.net", abuseDB, BlockerOptions{InflightHandling: InflightHandlingDefer, InflightKey: InflightKeyMessageID}, logger)
+	now = time.Now().UTC()
+	insert("INBOX-5", "reporter@example.com", now.Add(-time.Second), skylink1)
+	err = abuseDB.InsertOne(database.AbuseEmail{
+		ID:          primitive.NewObjectID(),
+		UID:         "INBOX-6",
+		MessageID:   "<INBOX-5@example.com>",
+		Parsed:      true,
+		ParseResult: database.AbuseReport{Skylinks: []string{skylink2}},
+		InsertedAt:  now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl.RunOnce()
+	if !find("INBOX-5").Blocked || find("INBOX-6").Blocked {
+		t.Fatal("expected the copy with the same message id to be deferred")
+	}
+	finalize("INBOX-5")
+	bl.RunOnce()
+	if email := find("INBOX-6"); !email.Blocked || email.DuplicateOf != "" {
+		t.Fatal("expected the copy to be blocked as usual", email.Blocked, email.DuplicateOf)
+	}
+	if atomic.LoadUint64(&requests) != 8 {
+		t.Fatal("unexpected amount of block requests", requests)
+	}
+
+	// assert the block result of a copy is only merged if it covers every
+	// skylink
+	inflight := database.AbuseEmail{
+		Blocked:     true,
+		BlockResult: []string{database.AbuseStatusBlocked, database.AbuseStatusNotBlocked},
+		ParseResult: database.AbuseReport{Skylinks: []string{skylink1, skylink2}},
+	}
+	merged, ok := mergedBlockResult(database.AbuseReport{Skylinks: []string{skylink2, skylink1}}, inflight)
+	if !ok || !reflect.DeepEqual(merged, []string{database.AbuseStatusNotBlocked, database.AbuseStatusBlocked}) {
+		t.Fatal("unexpected merged block result", merged, ok)
+	}
+	_, ok = mergedBlockResult(database.AbuseReport{Skylinks: []string{skylink1, "AAC4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg_"}}, inflight)
+	if ok {
+		t.Fatal("expected the block result not to be merged")
+	}
+}
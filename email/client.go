@@ -1,6 +1,8 @@
 package email
 
 import (
+	"fmt"
+
 	"github.com/emersion/go-imap/client"
 	"gitlab.com/NebulousLabs/errors"
 )
@@ -36,3 +38,21 @@ func NewClient(credentials Credentials) (*client.Client, error) {
 
 	return c, nil
 }
+
+// CheckMailbox verifies we can log in to the IMAP server using the given
+// credentials and select the given mailbox, the mailbox is selected read-only.
+func CheckMailbox(credentials Credentials, mailbox string) (err error) {
+	c, err := NewClient(credentials)
+	if err != nil {
+		return errors.AddContext(err, "failed to log in")
+	}
+	defer func() {
+		err = errors.Compose(err, c.Logout())
+	}()
+
+	_, err = c.Select(mailbox, true)
+	if err != nil {
+		return errors.AddContext(err, fmt.Sprintf("failed to select mailbox %v", mailbox))
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package email
+
+import (
+	"abuse-scanner/database"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/build"
+)
+
+type (
+	// testCountingTransport is an HTTP transport that counts the requests
+	// rather than executing them.
+	testCountingTransport struct {
+		calls uint64
+	}
+)
+
+// RoundTrip implements the http.RoundTripper interface.
+func (tct *testCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddUint64(&tct.calls, 1)
+	return nil, fmt.Errorf("unexpected request to %v", req.URL)
+}
+
+// TestDryRun walks a single email through the parser, blocker, finalizer and
+// reporter in dry-run mode and verifies none of them make an outbound call.
+func TestDryRun(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// count every outbound HTTP request
+	transport := new(testCountingTransport)
+	httpClient := &http.Client{Transport: transport}
+
+	// count every connection to the mail server, it is used for both IMAP and
+	// SMTP
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var connections uint64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddUint64(&connections, 1)
+			_ = conn.Close()
+		}
+	}()
+	smtpAddress := smtpServerAddress
+	smtpServerAddress = listener.Addr().String()
+	defer func() {
+		smtpServerAddress = smtpAddress
+	}()
+	creds := Credentials{
+		Address:  listener.Addr().String(),
+		Username: "abuse",
+		Password: "password",
+	}
+
+	// insert an email that reports a csam skylink
+	skylink := "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"
+	domain := "dev.siasky.net"
+	email := database.AbuseEmail{
+		ID:         primitive.NewObjectID(),
+		UID:        "INBOX-1-1",
+		UIDRaw:     1,
+		Body:       []byte(fmt.Sprintf("Subject: Child abuse\nFrom: reporter@gmail.com\nTo: abuse@siasky.net\n\nhttps://siasky.net/%s", skylink)),
+		Subject:    "Child abuse",
+		Mailbox:    "INBOX",
+		Source:     database.EmailSourceIMAP,
+		From:       "reporter@gmail.com",
+		To:         "abuse@siasky.net",
+		InsertedBy: domain,
+		InsertedAt: time.Now().UTC(),
+	}
+	err = abuseDB.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run the email through the pipeline
+	NewParser(ctx, abuseDB, domain, "", ParserOptions{HTTPClient: httpClient}, logger).RunOnce()
+	NewBlocker(ctx, "http://blocker:4000", domain, abuseDB, BlockerOptions{DryRun: true, HTTPClient: httpClient}, logger).RunOnce()
+	NewFinalizer(ctx, abuseDB, creds, "abuse@siasky.net", "INBOX", domain, FinalizerOptions{DryRun: true, MarkMode: MarkModeFlag}, logger).RunOnce()
+
+	reporter := NewReporter(abuseDB, mockAccountsClient{batchSupported: true}, NCMECCredentials{Debug: true}, []string{"https://siasky.net"}, domain, newTestReporter(), ReporterOptions{DryRun: true, HTTPClient: httpClient}, logger)
+	err = reporter.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = build.Retry(100, 100*time.Millisecond, func() error {
+		current, err := abuseDB.FindOne(email.UID)
+		if err != nil {
+			return err
+		}
+		if !current.Reported {
+			return errors.New("email not reported yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reporter.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the email went through the whole pipeline and is marked as dry
+	// run
+	current, err := abuseDB.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.Parsed || !current.Blocked || !current.Finalized || !current.Reported || !current.DryRun {
+		t.Fatal("unexpected email", current.Parsed, current.Blocked, current.Finalized, current.Reported, current.DryRun)
+	}
+	if len(current.BlockResult) != 1 || current.BlockResult[0] != database.AbuseStatusDryRun {
+		t.Fatal("unexpected block result", current.BlockResult)
+	}
+
+	// assert the reports are marked as dry run and are never filed
+	reports, err := abuseDB.FindReports(email.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || !reports[0].DryRun || reports[0].Filed {
+		t.Fatal("unexpected reports", reports)
+	}
+	unfiled, err := abuseDB.FindUnfiledReports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfiled) != 0 {
+		t.Fatal("expected dry run reports to never get filed", unfiled)
+	}
+
+	// assert nothing was sent
+	if calls := atomic.LoadUint64(&transport.calls); calls != 0 {
+		t.Fatalf("unexpected amount of HTTP requests, %v != 0", calls)
+	}
+	if conns := atomic.LoadUint64(&connections); conns != 0 {
+		t.Fatalf("unexpected amount of connections to the mail server, %v != 0", conns)
+	}
+}
@@ -0,0 +1,215 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// evidenceFetchTimeout is the maximum amount of time we allow for
+	// downloading a single evidence document
+	evidenceFetchTimeout = 30 * time.Second
+
+	// maxEvidenceDocuments is the maximum number of evidence documents we
+	// download for a single email
+	maxEvidenceDocuments = 10
+
+	// maxEvidenceSize is the maximum size of an evidence document, documents
+	// that exceed this size are ignored
+	maxEvidenceSize = 5 << 20 // 5 MiB
+
+	// maxEvidenceRedirects is the maximum number of redirects we follow when
+	// downloading an evidence document
+	maxEvidenceRedirects = 5
+)
+
+var (
+	// errEvidenceTooLarge is returned when an evidence document exceeds the
+	// maximum evidence size
+	errEvidenceTooLarge = errors.New("evidence document exceeds max size")
+
+	// extractEvidenceURLRE is a regex that is capable of extracting https URLs
+	// from text
+	extractEvidenceURLRE = regexp.MustCompile(`https://[^\s"'<>()\[\]]+`)
+
+	// googleDocRE and googleDriveRE are regexes that are capable of extracting
+	// the document id from a Google Docs or Google Drive URL path
+	googleDocRE   = regexp.MustCompile(`^/document/d/([a-zA-Z0-9-_]+)`)
+	googleDriveRE = regexp.MustCompile(`^/file/d/([a-zA-Z0-9-_]+)`)
+)
+
+type (
+	// evidenceFetcher is a helper object that downloads evidence documents
+	// from a set of trusted hosts and extracts the skylinks they contain.
+	// Hosts that are not explicitly allowlisted are never contacted.
+	evidenceFetcher struct {
+		staticClient          *http.Client
+		staticExtractSkylinks func(input []byte) []string
+		staticHosts           map[string]struct{}
+		staticLogger          *logrus.Entry
+		staticMaxSize         int64
+	}
+)
+
+// newEvidenceFetcher returns a new evidence fetcher for the given allowlist of
+// hosts, it returns nil if the allowlist is empty. Documents are downloaded
+// using a copy of the given shared client, skylinks are extracted from them
+// using the given extract function.
+func newEvidenceFetcher(hosts []string, client *http.Client, extract func(input []byte) []string, logger *logrus.Entry) *evidenceFetcher {
+	allowed := make(map[string]struct{})
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			allowed[host] = struct{}{}
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	ef := &evidenceFetcher{
+		staticExtractSkylinks: extract,
+		staticHosts:           allowed,
+		staticLogger:          logger,
+		staticMaxSize:         maxEvidenceSize,
+	}
+	ef.staticClient = &http.Client{
+		Transport:     client.Transport,
+		Timeout:       evidenceFetchTimeout,
+		CheckRedirect: ef.checkRedirect,
+	}
+	return ef
+}
+
+// FetchSkylinks extracts all evidence URLs that point to an allowlisted host
+// from the given input, downloads the documents and returns all skylinks they
+// contain.
+func (ef *evidenceFetcher) FetchSkylinks(ctx context.Context, input []byte) []string {
+	var skylinks []string
+	for i, evidenceURL := range ef.extractEvidenceURLs(input) {
+		if i == maxEvidenceDocuments {
+			ef.staticLogger.Warnf("Ignoring evidence documents, found more than %v", maxEvidenceDocuments)
+			break
+		}
+
+		text, err := ef.fetch(ctx, evidenceURL)
+		if err != nil {
+			ef.staticLogger.Errorf("Failed to fetch evidence document %v, err %v", evidenceURL, err)
+			continue
+		}
+		skylinks = append(skylinks, ef.staticExtractSkylinks(text)...)
+	}
+	return dedupe(skylinks)
+}
+
+// checkRedirect ensures we never follow a redirect to a host that is not
+// allowlisted, which would allow an attacker to make us perform requests to
+// arbitrary, potentially internal, hosts.
+func (ef *evidenceFetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxEvidenceRedirects {
+		return fmt.Errorf("stopped after %v redirects", maxEvidenceRedirects)
+	}
+	if !ef.isAllowed(req.URL) {
+		return fmt.Errorf("redirect to host '%v' is not allowed", req.URL.Hostname())
+	}
+	return nil
+}
+
+// extractEvidenceURLs returns all URLs from the given input that point to an
+// allowlisted host, the URLs are rewritten to their plain text export URL
+// where possible.
+func (ef *evidenceFetcher) extractEvidenceURLs(input []byte) []string {
+	var urls []string
+	for _, match := range extractEvidenceURLRE.FindAll(input, -1) {
+		u, err := url.Parse(strings.TrimRight(string(match), ".,;:!?"))
+		if err != nil || !ef.isAllowed(u) {
+			continue
+		}
+		urls = append(urls, exportURL(u))
+	}
+	return dedupe(urls)
+}
+
+// fetch downloads the evidence document at the given URL and returns its text
+// content.
+func (ef *evidenceFetcher) fetch(ctx context.Context, evidenceURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, evidenceFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, evidenceURL, nil)
+	if err != nil {
+		return nil, errors.AddContext(err, "could not create request")
+	}
+
+	resp, err := ef.staticClient.Do(req)
+	if err != nil {
+		return nil, errors.AddContext(err, "could not execute request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v", resp.StatusCode)
+	}
+	if resp.ContentLength > ef.staticMaxSize {
+		return nil, errEvidenceTooLarge
+	}
+
+	// read at most one byte more than the max size to detect oversized
+	// documents that did not set a content length
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ef.staticMaxSize+1))
+	if err != nil {
+		return nil, errors.AddContext(err, "could not read response body")
+	}
+	if int64(len(body)) > ef.staticMaxSize {
+		return nil, errEvidenceTooLarge
+	}
+
+	// extract the text if the document is HTML
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/html" {
+		text, err := extractTextFromHTML(strings.NewReader(string(body)))
+		if err != nil {
+			return nil, errors.AddContext(err, "could not extract text from HTML")
+		}
+		return []byte(text), nil
+	}
+	return body, nil
+}
+
+// isAllowed returns true if the given URL uses https and points to a host that
+// is allowlisted.
+func (ef *evidenceFetcher) isAllowed(u *url.URL) bool {
+	if u == nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	_, allowed := ef.staticHosts[strings.ToLower(u.Hostname())]
+	return allowed
+}
+
+// exportURL returns the URL at which the plain text version of the given
+// evidence document can be downloaded. Google Docs and Google Drive links are
+// rewritten to their export URL, all other URLs are returned as is.
+func exportURL(u *url.URL) string {
+	switch strings.ToLower(u.Hostname()) {
+	case "docs.google.com":
+		if m := googleDocRE.FindStringSubmatch(u.Path); len(m) == 2 {
+			return fmt.Sprintf("https://%s/document/d/%s/export?format=txt", u.Host, m[1])
+		}
+	case "drive.google.com":
+		if m := googleDriveRE.FindStringSubmatch(u.Path); len(m) == 2 {
+			return fmt.Sprintf("https://%s/uc?export=download&id=%s", u.Host, m[1])
+		}
+	}
+	return u.String()
+}
@@ -0,0 +1,176 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestEvidenceFetcher is a collection of unit tests that verify the
+// functionality of the evidence fetcher.
+func TestEvidenceFetcher(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	t.Run("ExportURL", testExportURL)
+	t.Run("FetchSkylinks", testFetchSkylinks)
+	t.Run("FetchSkylinksNotAllowed", testFetchSkylinksNotAllowed)
+	t.Run("FetchSkylinksTooLarge", testFetchSkylinksTooLarge)
+}
+
+// testExportURL is a unit test for the exportURL helper
+func testExportURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"https://docs.google.com/document/d/1aBc-D_e/edit?usp=sharing", "https://docs.google.com/document/d/1aBc-D_e/export?format=txt"},
+		{"https://drive.google.com/file/d/1aBc-D_e/view", "https://drive.google.com/uc?export=download&id=1aBc-D_e"},
+		{"https://docs.google.com/spreadsheets/d/1aBc/edit", "https://docs.google.com/spreadsheets/d/1aBc/edit"},
+		{"https://pastebin.com/raw/abc", "https://pastebin.com/raw/abc"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := exportURL(u); out != test.out {
+			t.Fatalf("unexpected export URL for '%v', %v != %v", test.in, out, test.out)
+		}
+	}
+}
+
+// testFetchSkylinks verifies the evidence fetcher downloads documents from an
+// allowlisted host and extracts the skylinks they contain.
+func testFetchSkylinks(t *testing.T) {
+	t.Parallel()
+
+	// create a mocked evidence host
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/doc.txt":
+			fmt.Fprintln(w, "Phishing found at")
+			fmt.Fprintln(w, "https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g")
+		case "/doc.html":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html><body><p>hxxps://siasky[.]net/nAA_hbtNaOYyR2WrM9UNIc5jRu4WfGy5QK_iTGosDgLmSA</p></body></html>")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ef := newTestEvidenceFetcher(server, "127.0.0.1")
+	body := []byte(fmt.Sprintf(`
+Please see the evidence at %[1]s/doc.txt, and at
+<a href="%[1]s/doc.html">%[1]s/doc.html</a>
+and %[1]s/missing.txt
+`, server.URL))
+
+	skylinks := ef.FetchSkylinks(context.Background(), body)
+	if len(skylinks) != 2 {
+		t.Fatalf("unexpected number of skylinks, %v != 2, skylinks %v", len(skylinks), skylinks)
+	}
+	if skylinks[0] != "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g" {
+		t.Fatal("unexpected skylink", skylinks[0])
+	}
+	if skylinks[1] != "nAA_hbtNaOYyR2WrM9UNIc5jRu4WfGy5QK_iTGosDgLmSA" {
+		t.Fatal("unexpected skylink", skylinks[1])
+	}
+}
+
+// testFetchSkylinksNotAllowed verifies the evidence fetcher never contacts a
+// host that is not allowlisted, not even through a redirect.
+func testFetchSkylinksNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	// create a mocked host that is not allowlisted
+	var hits uint64
+	internal := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&hits, 1)
+		fmt.Fprintln(w, "https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g")
+	}))
+	defer internal.Close()
+	internalURL := strings.Replace(internal.URL, "127.0.0.1", "localhost", 1)
+
+	// create an allowlisted host that redirects to the internal host
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internalURL+"/doc.txt", http.StatusFound)
+	}))
+	defer server.Close()
+
+	ef := newTestEvidenceFetcher(server, "127.0.0.1")
+
+	// assert a direct link to a host that is not allowlisted is ignored
+	skylinks := ef.FetchSkylinks(context.Background(), []byte(internalURL+"/doc.txt"))
+	if len(skylinks) != 0 {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
+
+	// assert non https links are ignored
+	httpURL := strings.Replace(server.URL, "https://", "http://", 1)
+	skylinks = ef.FetchSkylinks(context.Background(), []byte(httpURL+"/doc.txt"))
+	if len(skylinks) != 0 {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
+
+	// assert redirects to a host that is not allowlisted are not followed
+	skylinks = ef.FetchSkylinks(context.Background(), []byte(server.URL+"/doc.txt"))
+	if len(skylinks) != 0 {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
+	if atomic.LoadUint64(&hits) != 0 {
+		t.Fatal("unexpected request to host that is not allowlisted")
+	}
+
+	// assert the fetcher is nil if no hosts are allowlisted
+	if newEvidenceFetcher([]string{" ", ""}, http.DefaultClient, extractSkylinks, logrus.New().WithField("module", "Test")) != nil {
+		t.Fatal("expected nil evidence fetcher")
+	}
+}
+
+// testFetchSkylinksTooLarge verifies the evidence fetcher ignores documents
+// that exceed the max evidence size.
+func testFetchSkylinksTooLarge(t *testing.T) {
+	t.Parallel()
+
+	// create a mocked evidence host that returns a large document
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g")
+		fmt.Fprint(w, strings.Repeat("a", 1<<10))
+	}))
+	defer server.Close()
+
+	ef := newTestEvidenceFetcher(server, "127.0.0.1")
+	ef.staticMaxSize = 1 << 10
+
+	_, err := ef.fetch(context.Background(), server.URL+"/doc.txt")
+	if err != errEvidenceTooLarge {
+		t.Fatal("unexpected error", err)
+	}
+	skylinks := ef.FetchSkylinks(context.Background(), []byte(server.URL+"/doc.txt"))
+	if len(skylinks) != 0 {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
+}
+
+// newTestEvidenceFetcher returns an evidence fetcher for the given hosts that
+// trusts the certificate of the given test server.
+func newTestEvidenceFetcher(server *httptest.Server, hosts ...string) *evidenceFetcher {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ef := newEvidenceFetcher(hosts, http.DefaultClient, extractSkylinks, logger.WithField("module", "EvidenceFetcher"))
+	ef.staticClient.Transport = server.Client().Transport
+	return ef
+}
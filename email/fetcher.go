@@ -2,6 +2,9 @@ package email
 
 import (
 	"abuse-scanner/database"
+	"abuse-scanner/metrics"
+	"abuse-scanner/notifier"
+	"abuse-scanner/utils"
 	"context"
 	"fmt"
 	"io"
@@ -33,25 +36,94 @@ type (
 		staticContext          context.Context
 		staticDatabase         *database.AbuseScannerDB
 		staticEmailCredentials Credentials
+		staticLogSuppressor    *utils.LogSuppressor
 		staticLogger           *logrus.Entry
 		staticMailbox          string
+		staticOptions          FetcherOptions
 		staticServerDomain     string
 		staticWaitGroup        sync.WaitGroup
+
+		// allowedRecipients is reloadable, it's set from the options
+		allowedRecipients map[string]struct{}
+		lastFetch         time.Time
+		lastIngest        time.Time
+		mu                sync.Mutex
+	}
+
+	// FetcherOptions contains the configurable options of the fetcher.
+	FetcherOptions struct {
+		// AllowedRecipients is an optional list of addresses, if set the
+		// fetcher only processes emails that are addressed to at least one of
+		// these addresses, either in To or Cc. All other emails are skipped.
+		AllowedRecipients []string
+
+		// DedupeByMessageID indicates whether already processed mail is
+		// detected by its Message-ID within the mailbox, rather than only by
+		// its UID. The UID of every message changes when the UIDVALIDITY of
+		// the mailbox is reset, this option ensures such a reset does not
+		// cause the entire mailbox to be processed again.
+		DedupeByMessageID bool
+
+		// Notifier notifies the on-call if the loop of the fetcher panics, if
+		// nil no notifications are sent.
+		Notifier *notifier.Notifier
+
+		// Pause pauses the fetcher while the processing is paused, its loop
+		// keeps ticking but skips its work. If nil it's never paused.
+		Pause Pauser
+
+		// ShutdownTimeout is the amount of time Stop waits for the fetcher to
+		// shut down before it returns an error, defaults to
+		// defaultShutdownTimeout.
+		ShutdownTimeout time.Duration
+	}
+
+	// FetchStats are the counts of a single fetch pass.
+	FetchStats struct {
+		// Fetched is the amount of messages that got fetched and persisted.
+		Fetched int `json:"fetched"`
+
+		// Skipped is the amount of messages that got persisted as skipped,
+		// e.g. because they were sent by the scanner itself.
+		Skipped int `json:"skipped"`
 	}
 )
 
 // NewFetcher creates a new fetcher.
-func NewFetcher(ctx context.Context, database *database.AbuseScannerDB, emailCredentials Credentials, mailbox, serverDomain string, logger *logrus.Logger) *Fetcher {
+func NewFetcher(ctx context.Context, database *database.AbuseScannerDB, emailCredentials Credentials, mailbox, serverDomain string, opts FetcherOptions, logger *logrus.Logger) *Fetcher {
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
 	return &Fetcher{
 		staticContext:          ctx,
 		staticDatabase:         database,
 		staticEmailCredentials: emailCredentials,
-		staticLogger:           logger.WithField("module", "Fetcher"),
+		staticLogSuppressor:    utils.NewLogSuppressor(utils.DefaultLogSuppressInterval),
+		staticLogger:           logger.WithField("module", ModuleFetcher),
 		staticMailbox:          mailbox,
+		staticOptions:          opts,
 		staticServerDomain:     serverDomain,
+
+		allowedRecipients: recipientSet(opts.AllowedRecipients),
+		lastIngest:        time.Now(),
 	}
 }
 
+// Reload swaps the reloadable options of the fetcher for the ones in the given
+// options while the fetcher is running, only the AllowedRecipients are
+// reloadable. The other options are ignored.
+func (f *Fetcher) Reload(opts FetcherOptions) {
+	allowedRecipients := recipientSet(opts.AllowedRecipients)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allowedRecipients = allowedRecipients
+}
+
+// Name returns the name of the fetcher.
+func (f *Fetcher) Name() string {
+	return ModuleFetcher
+}
+
 // Start initializes the fetch process.
 func (f *Fetcher) Start() error {
 	f.staticWaitGroup.Add(1)
@@ -62,6 +134,86 @@ func (f *Fetcher) Start() error {
 	return nil
 }
 
+// RunOnce fetches new messages from the mailbox a single time, rather than
+// periodically, which allows running the scanner as a one-off job, e.g. from a
+// cron. It does not require the fetcher to be started. It returns the counts
+// of the fetch pass.
+func (f *Fetcher) RunOnce() FetchStats {
+	return f.fetchMessages()
+}
+
+// Refetch fetches the message with the given raw uid from the given mailbox
+// again and overwrites the email that was persisted for it, which then gets
+// parsed, blocked and finalized again, see database.Refetch. This is useful if
+// a prior fetch stored a truncated or corrupted body. It does not require the
+// fetcher to be started. It returns the uid of the email, and
+// database.ErrEmailNotFound if the fetcher does not fetch from the given
+// mailbox or the message does not exist. If the message gets skipped, e.g.
+// because it's addressed to none of the allowed recipients, the email is left
+// as is and database.ErrEmailSkipped is returned.
+func (f *Fetcher) Refetch(mailbox string, uid uint32) (_ string, err error) {
+	if mailbox != f.staticMailbox {
+		return "", errors.AddContext(database.ErrEmailNotFound, fmt.Sprintf("the fetcher does not fetch from mailbox '%v'", mailbox))
+	}
+
+	// create an email client and defer a logout
+	client, err := NewClient(f.staticEmailCredentials)
+	if err != nil {
+		return "", errors.AddContext(err, "failed to initialize email client")
+	}
+	defer func() {
+		err = errors.Compose(err, client.Logout())
+	}()
+
+	// select the mailbox, the uid of the email depends on its uid validity
+	status, err := client.Select(f.staticMailbox, false)
+	if err != nil {
+		return "", errors.AddContext(err, fmt.Sprintf("failed to select mailbox %v", f.staticMailbox))
+	}
+	emailUID := buildMessageUID(status, uid)
+
+	// fetch the message, fetchMessagesByUid only logs the error if the
+	// message can't be persisted so we capture it
+	var persistErr error
+	persist := func(mailbox *imap.MailboxStatus, msg *imap.Message, section *imap.BodySectionName) error {
+		persistErr = f.persistRefetchedMessage(mailbox, msg, section)
+		return persistErr
+	}
+	var stats FetchStats
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	err = f.fetchMessagesByUid(client, status, seqSet, persist, &stats)
+	if err = errors.Compose(err, persistErr); err != nil {
+		return "", errors.AddContext(err, fmt.Sprintf("failed to fetch message %v", uid))
+	}
+	switch {
+	case stats.Fetched > 0:
+		return emailUID, nil
+	case stats.Skipped > 0:
+		return "", errors.AddContext(database.ErrEmailSkipped, emailUID)
+	default:
+		return "", errors.AddContext(database.ErrEmailNotFound, fmt.Sprintf("message %v not found in mailbox '%v'", uid, mailbox))
+	}
+}
+
+// LastFetch returns the time of the last successful fetch, which is the last
+// time the fetcher listed the messages in the mailbox. It returns the zero time
+// if the fetcher did not fetch successfully yet.
+func (f *Fetcher) LastFetch() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastFetch
+}
+
+// LastIngest returns the time the fetcher last persisted a new email, or the
+// time it was created if it did not persist any email yet. Messages that are
+// skipped, such as the scanner's own replies, do not count as ingested.
+func (f *Fetcher) LastIngest() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastIngest
+}
+
 // Stop waits for the fetcher's waitgroup and times out after one minute.
 func (f *Fetcher) Stop() error {
 	c := make(chan struct{})
@@ -72,7 +224,7 @@ func (f *Fetcher) Stop() error {
 	select {
 	case <-c:
 		return nil
-	case <-time.After(time.Minute):
+	case <-time.After(f.staticOptions.ShutdownTimeout):
 		return errors.New("unclean fetcher shutdown")
 	}
 }
@@ -89,9 +241,13 @@ func (f *Fetcher) threadedFetchMessages() {
 	logger.Infof("Fetching messages for '%v' from mailbox '%v'", f.staticEmailCredentials.Username, f.staticMailbox)
 
 	// start the loop
+	guard := newLoopGuard(ModuleFetcher, f.staticOptions.Notifier, logger)
 	for {
 		logger.Debugln("threadedFetchMessages loop iteration triggered")
-		f.fetchMessages()
+		metrics.RecordLoopIteration(ModuleFetcher, fetchFrequency)
+		if !runIterationUnlessPaused(f.staticContext.Done(), guard, f.staticOptions.Pause, func() { f.fetchMessages() }) {
+			return
+		}
 
 		// sleep until next iteration
 		select {
@@ -104,8 +260,9 @@ func (f *Fetcher) threadedFetchMessages() {
 }
 
 // fetchMessages connects to the mailbox and downloads messages it has not seen
-// yet. It will store these as abuse emails in the database.
-func (f *Fetcher) fetchMessages() {
+// yet. It will store these as abuse emails in the database. It returns the
+// counts of the fetch pass.
+func (f *Fetcher) fetchMessages() (stats FetchStats) {
 	// convenience variables
 	logger := f.staticLogger
 
@@ -113,10 +270,10 @@ func (f *Fetcher) fetchMessages() {
 	client, err := NewClient(f.staticEmailCredentials)
 	if err != nil && strings.Contains(err.Error(), ErrTooManyConnections.Error()) {
 		logger.Debugf("Skipped due to Too Many Connections (expected)")
-		return
+		return stats
 	} else if err != nil {
 		logger.Errorf("Failed to initialize email client, err %v", err)
-		return
+		return stats
 	}
 
 	// defer a logout
@@ -132,34 +289,36 @@ func (f *Fetcher) fetchMessages() {
 	mailbox, err := client.Select(f.staticMailbox, false)
 	if err != nil {
 		logger.Errorf("Failed to select mailbox %v, err: %v", f.staticMailbox, err)
-		return
+		return stats
 	}
 
 	// return early if the mailbox has no messages
 	if mailbox.Messages == 0 {
 		logger.Debugf("No messages in mailbox %v", f.staticMailbox)
-		return
+		f.managedUpdateLastFetch()
+		return stats
 	}
 
 	// get all message ids
 	msgs, err := f.getMessageIds(client)
 	if err != nil {
 		logger.Errorf("Failed getting messages ids, err: %v", err)
-		return
+		return stats
 	}
 
 	// get missing messages
 	missing, err := f.getMessagesToFetch(mailbox, msgs)
 	if err != nil {
 		logger.Errorf("Failed listing messages, err: %v", err)
-		return
+		return stats
 	}
+	f.managedUpdateLastFetch()
 
 	// log missing messages count
 	numMissing := len(missing)
 	if numMissing == 0 {
 		logger.Debugf("Found %v missing messages", numMissing)
-		return
+		return stats
 	}
 
 	// fetch messages
@@ -167,18 +326,44 @@ func (f *Fetcher) fetchMessages() {
 	for _, msgUid := range missing {
 		seqSet := new(imap.SeqSet)
 		seqSet.AddNum(msgUid)
-		err := f.fetchMessagesByUid(client, mailbox, seqSet)
+		err := f.fetchMessagesByUid(client, mailbox, seqSet, f.persistMessage, &stats)
 		if err != nil {
-			logger.Errorf("Failed fetching message %v, err: %v", msgUid, err)
+			f.staticLogSuppressor.Errorf(logger, "Failed fetching message %v, err: %v", msgUid, err)
 		}
 	}
+	return stats
+}
+
+// managedAllowedRecipients returns the set of allowed recipients, the set is
+// replaced rather than modified when the fetcher is reloaded.
+func (f *Fetcher) managedAllowedRecipients() map[string]struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.allowedRecipients
+}
+
+// managedUpdateLastIngest sets the time the fetcher last persisted a new email
+// to now.
+func (f *Fetcher) managedUpdateLastIngest() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastIngest = time.Now()
+}
+
+// managedUpdateLastFetch sets the time of the last successful fetch to now.
+func (f *Fetcher) managedUpdateLastFetch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastFetch = time.Now()
 }
 
 // fetchMessagesByUid fetches all messages in the given seq set and persists
-// them in the database
-func (f *Fetcher) fetchMessagesByUid(client *client.Client, mailbox *imap.MailboxStatus, toFetch *imap.SeqSet) error {
+// them in the database using the given persist function, it adds the persisted
+// messages to the given stats.
+func (f *Fetcher) fetchMessagesByUid(client *client.Client, mailbox *imap.MailboxStatus, toFetch *imap.SeqSet, persist func(*imap.MailboxStatus, *imap.Message, *imap.BodySectionName) error, stats *FetchStats) error {
 	// convenience variables
 	logger := f.staticLogger
+	allowedRecipients := f.managedAllowedRecipients()
 
 	messageChan := make(chan *imap.Message)
 	section, err := imap.ParseBodySectionName("BODY[]")
@@ -197,10 +382,25 @@ func (f *Fetcher) fetchMessagesByUid(client *client.Client, mailbox *imap.Mailbo
 		// scanner as well
 		if isFromAbuseScanner(msg) {
 			logger.Debugf("skip message from abuse scanner (expected)")
-			err := f.persistSkipMessage(mailbox, msg)
+			err := f.persistSkipMessage(mailbox, msg, database.SkipReasonScannerOrigin)
 			if err != nil {
 				logger.Errorf("Failed to persist skip message, error: %v", err)
+				continue
 			}
+			stats.Skipped++
+			continue
+		}
+
+		// skip messages that are not addressed to any of the allowed
+		// recipients, if configured
+		if !isAddressedTo(msg, allowedRecipients) {
+			logger.Debugf("skip message not addressed to any of the allowed recipients (expected)")
+			err := f.persistSkipMessage(mailbox, msg, database.SkipReasonUnlistedRecipient)
+			if err != nil {
+				logger.Errorf("Failed to persist skip message, error: %v", err)
+				continue
+			}
+			stats.Skipped++
 			continue
 		}
 
@@ -209,18 +409,23 @@ func (f *Fetcher) fetchMessagesByUid(client *client.Client, mailbox *imap.Mailbo
 		// TODO: side-effect from UidFetch and can probably be avoided
 		if !hasBody(msg) {
 			logger.Debugf("skip message due to not having a body (expected)")
-			err := f.persistSkipMessage(mailbox, msg)
+			err := f.persistSkipMessage(mailbox, msg, database.SkipReasonNoBody)
 			if err != nil {
 				logger.Errorf("Failed to persist skip message, error: %v", err)
+				continue
 			}
+			stats.Skipped++
 			continue
 		}
 
 		toUnsee.AddNum(msg.Uid)
-		err := f.persistMessage(mailbox, msg, section)
+		err := persist(mailbox, msg, section)
 		if err != nil {
-			logger.Errorf("Failed to persist %v, error: %v", msg.Uid, err)
+			f.staticLogSuppressor.Errorf(logger, "Failed to persist %v, error: %v", msg.Uid, err)
+			continue
 		}
+		f.managedUpdateLastIngest()
+		stats.Fetched++
 	}
 
 	// unsee messages
@@ -290,7 +495,9 @@ func (f *Fetcher) getMessagesToFetch(mailbox *imap.MailboxStatus, msgs []uint32)
 	return toFetch, nil
 }
 
-// persistMessage will persist the given message in the abuse scanner database
+// persistMessage will persist the given message in the abuse scanner database.
+// If the fetcher dedupes by Message-ID and a message with the same Message-ID
+// was already fetched from this mailbox, the message is persisted as skipped.
 func (f *Fetcher) persistMessage(mailbox *imap.MailboxStatus, msg *imap.Message, section *imap.BodySectionName) error {
 	// sanity check parameters
 	if mailbox == nil || msg == nil || section == nil {
@@ -300,13 +507,65 @@ func (f *Fetcher) persistMessage(mailbox *imap.MailboxStatus, msg *imap.Message,
 	// convenience variables
 	abuseDB := f.staticDatabase
 
+	// skip the message if it was already processed under a different uid
+	if f.staticOptions.DedupeByMessageID && msg.Envelope != nil {
+		existing, err := abuseDB.FindOneByMessageID(mailbox.Name, msg.Envelope.MessageId)
+		if err != nil {
+			return errors.AddContext(err, "could not look up message by message id")
+		}
+		if existing != nil {
+			f.staticLogger.Debugf("skip message %v, it was already fetched as %v (expected after a UIDVALIDITY reset)", msg.Uid, existing.UID)
+			return f.persistSkipMessage(mailbox, msg, database.SkipReasonDuplicate)
+		}
+	}
+
+	// create the email entity from the message
+	email, err := f.newEmail(mailbox, msg, section)
+	if err != nil {
+		return err
+	}
+
+	// insert the message in the database
+	err = abuseDB.InsertOne(email)
+	if err != nil {
+		return errors.AddContext(err, "could not insert email")
+	}
+	return nil
+}
+
+// persistRefetchedMessage will persist the given message, which was fetched
+// from the mailbox again, in the abuse scanner database. It overwrites the
+// email that was persisted for the message, see database.Refetch.
+func (f *Fetcher) persistRefetchedMessage(mailbox *imap.MailboxStatus, msg *imap.Message, section *imap.BodySectionName) error {
+	// sanity check parameters
+	if mailbox == nil || msg == nil || section == nil {
+		return errors.New("missing input parameters")
+	}
+
+	// create the email entity from the message
+	email, err := f.newEmail(mailbox, msg, section)
+	if err != nil {
+		return err
+	}
+
+	// overwrite the email in the database
+	err = f.staticDatabase.Refetch(email)
+	if err != nil {
+		return errors.AddContext(err, "could not overwrite email")
+	}
+	return nil
+}
+
+// newEmail creates the email entity from the given message, it reads the body
+// of the message from the given section.
+func (f *Fetcher) newEmail(mailbox *imap.MailboxStatus, msg *imap.Message, section *imap.BodySectionName) (database.AbuseEmail, error) {
 	// build the uid
 	uid := buildMessageUID(mailbox, msg.Uid)
 
 	// read the entire message body
 	bodyLit := msg.GetBody(section)
 	if bodyLit == nil {
-		return fmt.Errorf("msg %v has no body", uid)
+		return database.AbuseEmail{}, fmt.Errorf("msg %v has no body", uid)
 	}
 
 	// limit the amount of bytes we read from the body
@@ -315,17 +574,19 @@ func (f *Fetcher) persistMessage(mailbox *imap.MailboxStatus, msg *imap.Message,
 	// read the imap literal into a byte slice
 	body, err := ioutil.ReadAll(bodyReader)
 	if err != nil {
-		return errors.AddContext(err, "could not read msg body")
+		return database.AbuseEmail{}, errors.AddContext(err, "could not read msg body")
 	}
 
 	// create the email entity from the message
-	email := database.AbuseEmail{
+	return database.AbuseEmail{
 		ID:        primitive.NewObjectID(),
 		UID:       uid,
 		UIDRaw:    msg.Uid,
 		Body:      body,
 		Subject:   msg.Envelope.Subject,
 		MessageID: msg.Envelope.MessageId,
+		Mailbox:   mailbox.Name,
+		Source:    database.EmailSourceIMAP,
 
 		From:    extractField("From", msg.Envelope),
 		ReplyTo: extractField("ReplyTo", msg.Envelope),
@@ -337,19 +598,14 @@ func (f *Fetcher) persistMessage(mailbox *imap.MailboxStatus, msg *imap.Message,
 
 		InsertedBy: f.staticServerDomain,
 		InsertedAt: time.Now().UTC(),
-	}
-
-	// insert the message in the database
-	err = abuseDB.InsertOne(email)
-	if err != nil {
-		return errors.AddContext(err, "could not insert email")
-	}
-	return nil
+	}, nil
 }
 
 // persistSkipMessage will persist the given message as finalized in the abuse
-// scanner database, this ensures the message won't be considered 'missing'
-func (f *Fetcher) persistSkipMessage(mailbox *imap.MailboxStatus, msg *imap.Message) error {
+// scanner database, this ensures the message won't be considered 'missing'. The
+// given reason is persisted alongside the message so skipped messages can be
+// audited.
+func (f *Fetcher) persistSkipMessage(mailbox *imap.MailboxStatus, msg *imap.Message, reason string) error {
 	// convenience variables
 	abuseDB := f.staticDatabase
 
@@ -365,17 +621,26 @@ func (f *Fetcher) persistSkipMessage(mailbox *imap.MailboxStatus, msg *imap.Mess
 		return nil
 	}
 
-	// create the email entity from the message
+	// create the email entity from the message, we record the message id so
+	// skipped messages are deduped as well
+	var messageID string
+	if msg.Envelope != nil {
+		messageID = msg.Envelope.MessageId
+	}
 	email := database.AbuseEmail{
-		ID:     primitive.NewObjectID(),
-		UID:    uid,
-		UIDRaw: msg.Uid,
+		ID:        primitive.NewObjectID(),
+		UID:       uid,
+		UIDRaw:    msg.Uid,
+		MessageID: messageID,
+		Mailbox:   mailbox.Name,
+		Source:    database.EmailSourceIMAP,
 
 		Parsed:    true,
 		Blocked:   true,
 		Finalized: true,
 
-		Skip: true,
+		Skip:       true,
+		SkipReason: reason,
 
 		InsertedAt: time.Now().UTC(),
 	}
@@ -402,7 +667,43 @@ func isFromAbuseScanner(msg *imap.Message) bool {
 	if len(msg.Envelope.From) != 1 {
 		return false
 	}
-	return msg.Envelope.From[0].Address() == scannerEmailAddress
+	return utils.EmailMatches(msg.Envelope.From[0].Address(), []string{scannerEmailAddress})
+}
+
+// recipientSet is a helper function that returns the given recipients as a
+// set of lowercased addresses, it returns nil if no recipients are given.
+func recipientSet(recipients []string) map[string]struct{} {
+	if len(recipients) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(recipients))
+	for _, recipient := range recipients {
+		set[strings.ToLower(recipient)] = struct{}{}
+	}
+	return set
+}
+
+// isAddressedTo returns true if the given message is addressed to one of the
+// given recipients, either in To or Cc. If no recipients are given, it always
+// returns true. The given recipients are expected to be lowercased.
+func isAddressedTo(msg *imap.Message, recipients map[string]struct{}) bool {
+	if len(recipients) == 0 {
+		return true
+	}
+	if msg.Envelope == nil {
+		return false
+	}
+	for _, addresses := range [][]*imap.Address{msg.Envelope.To, msg.Envelope.Cc} {
+		for _, address := range addresses {
+			if address == nil {
+				continue
+			}
+			if _, exists := recipients[strings.ToLower(address.Address())]; exists {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // hasBody returns true if the given message has a body
@@ -1,9 +1,17 @@
 package email
 
 import (
+	"abuse-scanner/database"
+	"bytes"
+	"context"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // TestFetcher is a collection of unit tests that verify the functionality of
@@ -15,6 +23,11 @@ func TestFetcher(t *testing.T) {
 	t.Parallel()
 
 	t.Run("ExtractField", testExtractField)
+	t.Run("IsAddressedTo", testIsAddressedTo)
+	t.Run("PersistMessageDedupe", testPersistMessageDedupe)
+	t.Run("PersistSkipMessage", testPersistSkipMessage)
+	t.Run("Refetch", testRefetch)
+	t.Run("Reload", testFetcherReload)
 }
 
 // testExtractField is a unit test that covers the extractField helper
@@ -50,3 +63,304 @@ func testExtractField(t *testing.T) {
 		t.Fatal("unexpected field value")
 	}
 }
+
+// testIsAddressedTo is a unit test that covers the isAddressedTo helper
+func testIsAddressedTo(t *testing.T) {
+	abuse := &imap.Address{HostName: "siasky.net", MailboxName: "abuse"}
+	other := &imap.Address{HostName: "siasky.net", MailboxName: "hello"}
+	recipients := map[string]struct{}{"abuse@siasky.net": {}}
+
+	tests := []struct {
+		name       string
+		envelope   *imap.Envelope
+		recipients map[string]struct{}
+		expected   bool
+	}{
+		{"NoAllowlist", &imap.Envelope{To: []*imap.Address{other}}, nil, true},
+		{"NoEnvelope", nil, recipients, false},
+		{"NoRecipients", &imap.Envelope{}, recipients, false},
+		{"To", &imap.Envelope{To: []*imap.Address{other, abuse}}, recipients, true},
+		{"Cc", &imap.Envelope{To: []*imap.Address{other}, Cc: []*imap.Address{abuse}}, recipients, true},
+		{"CaseInsensitive", &imap.Envelope{To: []*imap.Address{{HostName: "SiaSky.net", MailboxName: "Abuse"}}}, recipients, true},
+		{"NonMatching", &imap.Envelope{To: []*imap.Address{other}, Cc: []*imap.Address{other}}, recipients, false},
+		{"ReplyToOnly", &imap.Envelope{To: []*imap.Address{other}, ReplyTo: []*imap.Address{abuse}}, recipients, false},
+	}
+	for _, test := range tests {
+		msg := &imap.Message{Envelope: test.envelope}
+		if isAddressedTo(msg, test.recipients) != test.expected {
+			t.Fatalf("unexpected outcome for test '%v'", test.name)
+		}
+	}
+}
+
+// testFetcherReload verifies the allowed recipients of a running fetcher can be
+// swapped by reloading it
+func testFetcherReload(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	opts := FetcherOptions{AllowedRecipients: []string{"Abuse@siasky.net"}}
+	f := NewFetcher(context.Background(), nil, Credentials{}, "INBOX", "dev.siasky.net", opts, logger)
+
+	report := &imap.Message{Envelope: &imap.Envelope{To: []*imap.Address{{HostName: "siasky.net", MailboxName: "report"}}}}
+	if isAddressedTo(report, f.managedAllowedRecipients()) {
+		t.Fatal("expected the message to be skipped")
+	}
+
+	// reload the fetcher with an allowlist that includes the recipient
+	f.Reload(FetcherOptions{AllowedRecipients: []string{"abuse@siasky.net", "Report@siasky.net"}})
+	if !isAddressedTo(report, f.managedAllowedRecipients()) {
+		t.Fatal("expected the message to be processed after the reload")
+	}
+
+	// reload the fetcher without an allowlist
+	f.Reload(FetcherOptions{})
+	if f.managedAllowedRecipients() != nil {
+		t.Fatal("expected no allowlist after the reload")
+	}
+}
+
+// testPersistSkipMessage is a unit test that verifies skipped messages are
+// persisted along with the reason why they were skipped
+func testPersistSkipMessage(t *testing.T) {
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// create a fetcher
+	f := NewFetcher(ctx, abuseDB, Credentials{}, "INBOX", "dev.siasky.net", FetcherOptions{}, logger)
+
+	// persist a skip message
+	mailbox := &imap.MailboxStatus{Name: "INBOX", UidValidity: 1}
+	msg := &imap.Message{Uid: 1}
+	err = f.persistSkipMessage(mailbox, msg, database.SkipReasonScannerOrigin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the skip reason was persisted
+	email, err := abuseDB.FindOne(buildMessageUID(mailbox, msg.Uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email == nil || !email.Skip {
+		t.Fatal("expected skipped email", email)
+	}
+	if email.SkipReason != database.SkipReasonScannerOrigin {
+		t.Fatal("unexpected skip reason", email.SkipReason)
+	}
+	if email.Source != database.EmailSourceIMAP {
+		t.Fatal("unexpected source", email.Source)
+	}
+
+	// persist it again with a different reason and assert it's a no-op
+	err = f.persistSkipMessage(mailbox, msg, database.SkipReasonNoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, err = abuseDB.FindOne(buildMessageUID(mailbox, msg.Uid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email.SkipReason != database.SkipReasonScannerOrigin {
+		t.Fatal("unexpected skip reason", email.SkipReason)
+	}
+}
+
+// testPersistMessageDedupe is a unit test that verifies a UIDVALIDITY reset
+// does not cause messages to be processed again when the fetcher dedupes by
+// Message-ID
+func testPersistMessageDedupe(t *testing.T) {
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// create a fetcher that dedupes by message id
+	f := NewFetcher(ctx, abuseDB, Credentials{}, "INBOX", "dev.siasky.net", FetcherOptions{
+		DedupeByMessageID: true,
+	}, logger)
+
+	section, err := imap.ParseBodySectionName("BODY[]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMessage := func(uid uint32) *imap.Message {
+		return &imap.Message{
+			Uid:      uid,
+			Envelope: &imap.Envelope{MessageId: "<abuse-1@example.com>", Subject: "Phishing"},
+			Body: map[*imap.BodySectionName]imap.Literal{
+				section: bytes.NewBufferString("Subject: Phishing\n\nhttps://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"),
+			},
+		}
+	}
+
+	// persist the message
+	mailbox := &imap.MailboxStatus{Name: "INBOX", UidValidity: 1}
+	err = f.persistMessage(mailbox, newMessage(1), section)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a UIDVALIDITY reset, which assigns a new UID to the message
+	reset := &imap.MailboxStatus{Name: "INBOX", UidValidity: 2}
+	missing, err := f.getMessagesToFetch(reset, []uint32{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 {
+		t.Fatal("expected the message to be missing after the reset", missing)
+	}
+	err = f.persistMessage(reset, newMessage(7), section)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the message is persisted as skipped duplicate
+	email, err := abuseDB.FindOne(buildMessageUID(reset, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email == nil || !email.Skip || email.SkipReason != database.SkipReasonDuplicate {
+		t.Fatal("expected skipped duplicate email", email)
+	}
+
+	// assert it is no longer missing and only the original is unparsed
+	missing, err = f.getMessagesToFetch(reset, []uint32{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Fatal("unexpected missing messages", missing)
+	}
+	unparsed, err := abuseDB.FindUnparsed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unparsed) != 1 || unparsed[0].UID != buildMessageUID(mailbox, 1) {
+		t.Fatal("unexpected unparsed emails", unparsed)
+	}
+	if unparsed[0].Source != database.EmailSourceIMAP {
+		t.Fatal("unexpected source", unparsed[0].Source)
+	}
+
+	// assert the message is processed again if we don't dedupe by message id
+	f = NewFetcher(ctx, abuseDB, Credentials{}, "INBOX", "dev.siasky.net", FetcherOptions{}, logger)
+	reset = &imap.MailboxStatus{Name: "INBOX", UidValidity: 3}
+	err = f.persistMessage(reset, newMessage(9), section)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unparsed, err = abuseDB.FindUnparsed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unparsed) != 2 {
+		t.Fatal("unexpected amount of unparsed emails", len(unparsed))
+	}
+}
+
+// testRefetch is a unit test that verifies a message that is fetched again
+// overwrites the email that was persisted for it, and that only the mailbox of
+// the fetcher can be refetched from.
+func testRefetch(t *testing.T) {
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	f := NewFetcher(ctx, abuseDB, Credentials{}, "INBOX", "dev.siasky.net", FetcherOptions{}, logger)
+
+	// assert refetching from another mailbox fails before connecting
+	_, err = f.Refetch("Archive", 1)
+	if !errors.Contains(err, database.ErrEmailNotFound) {
+		t.Fatal("unexpected error", err)
+	}
+
+	section, err := imap.ParseBodySectionName("BODY[]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMessage := func(body string) *imap.Message {
+		return &imap.Message{
+			Uid:      1,
+			Envelope: &imap.Envelope{MessageId: "<abuse-1@example.com>", Subject: "Phishing"},
+			Body: map[*imap.BodySectionName]imap.Literal{
+				section: bytes.NewBufferString(body),
+			},
+		}
+	}
+
+	// persist a message with a truncated body and mark it parsed
+	mailbox := &imap.MailboxStatus{Name: "INBOX", UidValidity: 1}
+	err = f.persistMessage(mailbox, newMessage("Subject: Phishing\n\nhttps://siasky.net/"), section)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := buildMessageUID(mailbox, 1)
+	email, err := abuseDB.FindOne(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = abuseDB.UpdateNoLock(*email, bson.M{"$set": bson.M{"parsed": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// persist the refetched message
+	body := "Subject: Phishing\n\nhttps://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"
+	err = f.persistRefetchedMessage(mailbox, newMessage(body), section)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the email got overwritten and is parsed again
+	refetched, err := abuseDB.FindOne(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refetched.ID != email.ID || string(refetched.Body) != body || refetched.Parsed || refetched.RefetchedAt.IsZero() {
+		t.Fatal("unexpected email after refetch", refetched)
+	}
+}
@@ -2,13 +2,20 @@ package email
 
 import (
 	"abuse-scanner/database"
+	"abuse-scanner/metrics"
+	"abuse-scanner/notifier"
+	"abuse-scanner/utils"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/smtp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	uuid "github.com/nu7hatch/gouuid"
 	"github.com/sirupsen/logrus"
@@ -17,13 +24,43 @@ import (
 )
 
 const (
+	// DefaultMarkFlag is the IMAP keyword that is set on finalized messages
+	// if the mark mode is MarkModeFlag and no flag is configured.
+	DefaultMarkFlag = "$Processed"
+
+	// MarkModeFlag marks finalized messages by setting an IMAP keyword.
+	MarkModeFlag = "flag"
+
+	// MarkModeMove marks finalized messages by moving them to another
+	// mailbox.
+	MarkModeMove = "move"
+
+	// MarkModeNone leaves finalized messages untouched.
+	MarkModeNone = "none"
+
 	// finalizeFrequency defines the frequency with which we finalize reports
 	finalizeFrequency = 30 * time.Second
 
+	// ncmecNotifyWindow is the amount of time after an email got reported to
+	// NCMEC during which we wait for its reports to get filed, so we can
+	// notify the reporter. Emails of which the reports fail to get filed
+	// within this window are not considered anymore.
+	ncmecNotifyWindow = 7 * 24 * time.Hour
+
 	// scannerEmailAddress is the from email we use when sending abuse reports
 	scannerEmailAddress = "abuse-scanner@siasky.net"
 )
 
+var (
+	// smtpServerAddress is the address of the SMTP server the replies to the
+	// reporters are sent through
+	smtpServerAddress = "smtp.gmail.com:587"
+
+	// sendMail sends an email through the SMTP server, it's a variable so it
+	// can be replaced in testing
+	sendMail = smtp.SendMail
+)
+
 type (
 	// Finalizer is an object that will periodically scan the database for abuse
 	// reports that have not been finalized yet.
@@ -35,25 +72,154 @@ type (
 		staticEmailCredentials Credentials
 		staticLogger           *logrus.Entry
 		staticMailbox          string
+		staticOptions          FinalizerOptions
 		staticServerDomain     string
 		staticWaitGroup        sync.WaitGroup
+
+		// ncmecNotifyReporters and replyTemplates are reloadable, they're
+		// set from the options
+		ncmecNotifyReporters []string
+		replyTemplates       map[string]database.ResponseTemplates
+		mu                   sync.Mutex
+	}
+
+	// FinalizerOptions contains the configurable options of the finalizer.
+	FinalizerOptions struct {
+		// DigestLeader decides whether this instance sends the digest
+		// replies, which ensures they're sent once across all instances that
+		// share the database. If nil this instance always sends them.
+		DigestLeader Leader
+
+		// DigestWindow is the amount of time replies to the same reporter
+		// are held back so they can be combined into a single digest reply.
+		// The window starts when the oldest unfinalized email of the
+		// reporter got inserted. If zero every email is replied to
+		// individually.
+		DigestWindow time.Duration
+
+		// DryRun indicates whether the finalizer runs in dry-run mode, in
+		// which case the abuse report is not appended to the mailbox, no
+		// replies are sent and the original messages are not marked. The
+		// emails are still finalized, and marked as dry run.
+		DryRun bool
+
+		// GroupSkyTransfer indicates whether the replies list the skylinks
+		// that were resolved from a SkyTransfer URL under that URL, stating
+		// how many files the URL resolved to, rather than as separate links.
+		GroupSkyTransfer bool
+
+		// HoldLowConfidence indicates whether the reply to emails that were
+		// parsed with low confidence is held back for a manual review. The
+		// email is still finalized, but the reporter is not told the links
+		// were blocked, as we're unsure about them.
+		HoldLowConfidence bool
+
+		// MarkMode defines how the original message is marked in the mailbox
+		// once it's been finalized, it's one of MarkModeNone, MarkModeFlag or
+		// MarkModeMove. If empty it defaults to MarkModeNone.
+		MarkMode string
+
+		// MarkFlag is the IMAP keyword that is set on the original message if
+		// the mark mode is MarkModeFlag, defaults to DefaultMarkFlag.
+		MarkFlag string
+
+		// MarkMailbox is the mailbox the original message is moved to if the
+		// mark mode is MarkModeMove.
+		MarkMailbox string
+
+		// NCMECNotifyReporters is a list of trusted reporters, either an
+		// email address or a domain, which includes its subdomains. These
+		// reporters receive a follow-up once the content they reported got
+		// reported to NCMEC. If empty no follow-ups are sent.
+		NCMECNotifyReporters []string
+
+		// Notifier notifies the on-call if the loop of the finalizer panics,
+		// if nil no notifications are sent.
+		Notifier *notifier.Notifier
+
+		// Pause pauses the finalizer while the processing is paused, its loop
+		// keeps ticking but skips its work. If nil it's never paused.
+		Pause Pauser
+
+		// Redactor opens the reply tokens of emails of which the reporter's
+		// PII got redacted, replies to those emails fail if it's nil.
+		Redactor *Redactor
+
+		// ReplyLocales maps reporters onto the locale of the replies they
+		// receive, a reporter is either an email address or a domain, which
+		// includes its subdomains. The most specific match wins. Reporters
+		// that are not listed receive the English replies.
+		ReplyLocales map[string]string
+
+		// ReplyTemplates are the templates of the replies per locale, the
+		// replies to a reporter whose locale has no templates fall back to
+		// the English ones.
+		ReplyTemplates map[string]database.ResponseTemplates
+
+		// ShutdownTimeout is the amount of time Stop waits for the finalizer to
+		// shut down before it returns an error, defaults to
+		// defaultShutdownTimeout.
+		ShutdownTimeout time.Duration
+	}
+
+	// FinalizeStats are the counts of a single finalize pass.
+	FinalizeStats struct {
+		// Finalized is the amount of emails that got finalized.
+		Finalized int `json:"finalized"`
+
+		// RepliesSent is the amount of replies that got sent to the
+		// reporters, a digest counts as a single reply.
+		RepliesSent int `json:"replies_sent"`
+
+		// RepliesSuppressed is the amount of finalized emails of which the
+		// reply was held for review, suppressed or not sent because the
+		// email has no sender.
+		RepliesSuppressed int `json:"replies_suppressed"`
 	}
 )
 
 // NewFinalizer creates a new finalizer.
-func NewFinalizer(ctx context.Context, database *database.AbuseScannerDB, emailCredentials Credentials, emailAddress, mailbox, serverDomain string, logger *logrus.Logger) *Finalizer {
+func NewFinalizer(ctx context.Context, database *database.AbuseScannerDB, emailCredentials Credentials, emailAddress, mailbox, serverDomain string, opts FinalizerOptions, logger *logrus.Logger) *Finalizer {
+	if opts.MarkMode == "" {
+		opts.MarkMode = MarkModeNone
+	}
+	if opts.MarkFlag == "" {
+		opts.MarkFlag = DefaultMarkFlag
+	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
 	return &Finalizer{
 		staticContext:          ctx,
 		staticDatabase:         database,
 		staticEmailAddress:     emailAddress,
 		staticEmailAuth:        smtp.PlainAuth("", emailCredentials.Username, emailCredentials.Password, "smtp.gmail.com"),
 		staticEmailCredentials: emailCredentials,
-		staticLogger:           logger.WithField("module", "Finalizer"),
+		staticLogger:           logger.WithField("module", ModuleFinalizer),
 		staticMailbox:          mailbox,
+		staticOptions:          opts,
 		staticServerDomain:     serverDomain,
+
+		ncmecNotifyReporters: opts.NCMECNotifyReporters,
+		replyTemplates:       opts.ReplyTemplates,
 	}
 }
 
+// Reload swaps the reloadable options of the finalizer for the ones in the
+// given options while the finalizer is running, only the NCMECNotifyReporters
+// and the ReplyTemplates are reloadable. The other options are ignored.
+func (f *Finalizer) Reload(opts FinalizerOptions) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ncmecNotifyReporters = opts.NCMECNotifyReporters
+	f.replyTemplates = opts.ReplyTemplates
+}
+
+// Name returns the name of the finalizer.
+func (f *Finalizer) Name() string {
+	return ModuleFinalizer
+}
+
 // Start initializes the finalization process.
 func (f *Finalizer) Start() error {
 	f.staticWaitGroup.Add(1)
@@ -64,6 +230,14 @@ func (f *Finalizer) Start() error {
 	return nil
 }
 
+// RunOnce finalizes all unfinalized messages a single time, it does not require
+// the finalizer to be started. It returns the counts of the finalize pass.
+func (f *Finalizer) RunOnce() FinalizeStats {
+	stats := f.finalizeMessages()
+	f.notifyNCMECReporters()
+	return stats
+}
+
 // Stop waits for the finalizer's waitgroup and times out after one minute.
 func (f *Finalizer) Stop() error {
 	c := make(chan struct{})
@@ -74,7 +248,7 @@ func (f *Finalizer) Stop() error {
 	select {
 	case <-c:
 		return nil
-	case <-time.After(time.Minute):
+	case <-time.After(f.staticOptions.ShutdownTimeout):
 		return errors.New("unclean finalizer shutdown")
 	}
 }
@@ -82,21 +256,26 @@ func (f *Finalizer) Stop() error {
 // finalizeEmail will finalize the given email, it does so by responding to the
 // email with a report that shows an overview of what skylinks were found and
 // whether or not they got blocked successfully.
-func (f *Finalizer) finalizeEmail(client *client.Client, email database.AbuseEmail) (err error) {
+// If reply is false the original sender is not replied to, which is the case
+// if the reply is part of a digest. It returns whether the email got finalized
+// by this call and whether the reporter should get a reply to it, which is
+// decided on the current state of the email under lock, and adds the outcome
+// to the given stats.
+func (f *Finalizer) finalizeEmail(client *client.Client, mailbox *imap.MailboxStatus, email database.AbuseEmail, reply bool, stats *FinalizeStats) (finalized, replyEligible bool, err error) {
 	// sanity check every skylink has a blocked status
 	if len(email.BlockResult) != len(email.ParseResult.Skylinks) {
-		return fmt.Errorf("blockresult vs parseresult length, %v != %v, email with id %v", len(email.BlockResult), len(email.ParseResult.Skylinks), email.ID.String())
+		return false, false, fmt.Errorf("blockresult vs parseresult length, %v != %v, email with id %v", len(email.BlockResult), len(email.ParseResult.Skylinks), email.ID.String())
 	}
 
 	// convenience variables
 	abuseDB := f.staticDatabase
-	logger := f.staticLogger
+	logger := f.staticLogger.WithField("email_uid", email.UID)
 
 	// acquire a lock
 	lock := abuseDB.NewLock(email.UID)
 	err = lock.Lock()
 	if err != nil {
-		return errors.AddContext(err, "could not acquire lock")
+		return false, false, errors.AddContext(err, "could not acquire lock")
 	}
 
 	// defer the unlock
@@ -112,92 +291,327 @@ func (f *Finalizer) finalizeEmail(client *client.Client, email database.AbuseEma
 	// finalized by another process, if so we just return
 	current, err := abuseDB.FindOne(email.UID)
 	if err != nil {
-		return errors.AddContext(err, "could not find email")
+		return false, false, errors.AddContext(err, "could not find email")
 	}
 	if current.Finalized {
-		return nil
+		return false, false, nil
 	}
 
-	// generate a uuid as message id
-	err = sendAbuseReport(client, email, f.staticMailbox, f.staticEmailAddress)
-	if err != nil {
-		logger.Errorf("failed to send abuse report, err %v", err)
-		return err
+	// in dry-run mode we finalize the email without sending anything
+	dryRun := f.staticOptions.DryRun
+	if dryRun {
+		logger.Info("Dry run, not sending the abuse report nor the reply")
+	}
+
+	// send the abuse report to the abuse mailbox
+	if !dryRun {
+		err = sendAbuseReport(client, email, f.staticMailbox, f.staticEmailAddress)
+		if err != nil {
+			logger.Errorf("failed to send abuse report, err %v", err)
+			return false, false, err
+		}
 	}
 
-	// respond to the original sender, only if the abuse email was handled successfully
-	if email.Success() {
-		err = sendAutomatedReply(f.staticEmailAuth, email)
+	// respond to the original sender, only if the abuse email was handled
+	// successfully and we're confident about the skylinks we found, the
+	// reporter already got a reply to the copy of a duplicate
+	held := shouldHoldReply(email, f.staticOptions)
+	if held {
+		logger.Info("Holding the reply for manual review, the email was parsed with low confidence")
+	}
+	suppressed := current.ReplySuppressed
+	if suppressed {
+		logger.Info("Not replying to the reporter, the reply was suppressed")
+	}
+	noReply := email.ParseResult.Reporter.NoReply
+	if noReply {
+		logger.Info("Not replying to the reporter, the email has no sender")
+	}
+	replyEligible = email.Success() && !held && !suppressed && !noReply && email.DuplicateOf == ""
+	if reply && replyEligible && !dryRun {
+		var to string
+		to, err = f.replyAddress(email)
+		if err == nil {
+			err = sendAutomatedReply(f.staticEmailAuth, email, to, f.responseOptions(to))
+		}
 		if err != nil {
 			// simply log the error, we don't return it here
 			logger.Errorf("failed to send automated reply, err %v", err)
+		} else {
+			stats.RepliesSent++
 		}
 	}
 
 	// update the email
-	err = abuseDB.UpdateNoLock(email, bson.M{
-		"$set": bson.M{
-			"finalized":    true,
-			"finalized_by": f.staticServerDomain,
-			"finalized_at": time.Now().UTC(),
-		},
-	})
+	update := bson.M{
+		"finalized":    true,
+		"finalized_by": f.staticServerDomain,
+		"finalized_at": time.Now().UTC(),
+	}
+	if held {
+		update["reply_held"] = true
+	}
+	if dryRun {
+		update["dry_run"] = true
+	}
+	err = abuseDB.UpdateNoLockRetry(email, bson.M{
+		"$set": update,
+	}, func(current database.AbuseEmail) bool { return current.Finalized })
 	if err != nil {
-		return errors.AddContext(err, "could not update email")
+		return false, false, errors.AddContext(err, "could not update email")
+	}
+	stats.Finalized++
+	if held || suppressed || noReply {
+		stats.RepliesSuppressed++
 	}
 
-	return nil
+	// mark the original message, we only log the error here as the email
+	// has been finalized successfully
+	if !dryRun {
+		err = markMessage(client, mailbox, email, f.staticOptions)
+		if err != nil {
+			logger.Errorf("failed to mark message, err %v", err)
+		}
+	}
+
+	return true, replyEligible, nil
+}
+
+// finalizeDigest will finalize the given emails, which are all sent by the
+// same reporter, and respond to the reporter with a single digest reply that
+// covers all emails that were handled successfully. It adds the outcome to the
+// given stats.
+func (f *Finalizer) finalizeDigest(client *client.Client, mailbox *imap.MailboxStatus, emails []database.AbuseEmail, stats *FinalizeStats) {
+	// convenience variables
+	logger := f.staticLogger
+
+	// finalize the emails without replying to them individually, the digest
+	// covers the emails the reporter should get a reply to
+	var digest []database.AbuseEmail
+	for _, email := range emails {
+		finalized, replyEligible, err := f.finalizeEmail(client, mailbox, email, false, stats)
+		if err != nil {
+			logger.WithField("email_uid", email.UID).Errorf("Failed to finalize email, error %v", err)
+			continue
+		}
+		if finalized && replyEligible {
+			digest = append(digest, email)
+		}
+	}
+	if len(digest) == 0 || f.staticOptions.DryRun {
+		return
+	}
+
+	// respond to the reporter, we only log the error here as the emails have
+	// been finalized successfully
+	to, err := f.replyAddress(digest[0])
+	if err == nil {
+		err = sendDigestReply(f.staticEmailAuth, digest, to, f.responseOptions(to))
+	}
+	if err != nil {
+		logger.Errorf("failed to send digest reply for %v emails, err %v", len(digest), err)
+		return
+	}
+	stats.RepliesSent++
 }
 
 // finalizeMessages fetches all unfinalized messages from the database and
 // finalizes them. Finalizing means responding to the original abuse email with
 // an overview of what skylinks the abuse scanner discovered and what skylinks
-// have been blocked.
-func (f *Finalizer) finalizeMessages() {
+// have been blocked. It returns the counts of the finalize pass.
+func (f *Finalizer) finalizeMessages() (stats FinalizeStats) {
 	// convenience variables
 	abuseDB := f.staticDatabase
 	logger := f.staticLogger
 	mailbox := f.staticMailbox
 
-	// create an email client
-	client, err := NewClient(f.staticEmailCredentials)
-	if err != nil && strings.Contains(err.Error(), ErrTooManyConnections.Error()) {
-		logger.Debugf("Skipped due to Too Many Connections (expected)")
-		return
-	} else if err != nil {
-		logger.Errorf("Failed to initialize email client, err %v", err)
-		return
+	// digests are only sent by the leader
+	if f.staticOptions.DigestWindow > 0 && !isLeader(f.staticOptions.DigestLeader) {
+		logger.Debugln("Not the digest leader, skipping finalizing messages")
+		return stats
 	}
 
-	// defer a logout
-	defer func() {
-		err := client.Logout()
-		if err != nil {
-			logger.Errorf("Failed to close email client, err: %v", err)
+	// create an email client, in dry-run mode we never use the mailbox so we
+	// don't connect to it
+	var client *client.Client
+	if !f.staticOptions.DryRun {
+		var err error
+		client, err = NewClient(f.staticEmailCredentials)
+		if err != nil && strings.Contains(err.Error(), ErrTooManyConnections.Error()) {
+			logger.Debugf("Skipped due to Too Many Connections (expected)")
+			return stats
+		} else if err != nil {
+			logger.Errorf("Failed to initialize email client, err %v", err)
+			return stats
 		}
-	}()
+
+		// defer a logout
+		defer func() {
+			err := client.Logout()
+			if err != nil {
+				logger.Errorf("Failed to close email client, err: %v", err)
+			}
+		}()
+	}
 
 	// fetch all unfinalized emails
 	toFinalize, err := abuseDB.FindUnfinalized(mailbox)
 	if err != nil {
 		logger.Errorf("Failed fetching unfinalized emails, error %v", err)
-		return
+		return stats
 	}
 
 	// log unfinalized message count
 	numUnfinalized := len(toFinalize)
 	if numUnfinalized == 0 {
 		logger.Debugf("Found %v unfinalized messages", numUnfinalized)
-		return
+		return stats
 	}
 
 	logger.Infof("Found %v unfinalized messages", numUnfinalized)
 
+	// select the mailbox if we have to mark the original messages
+	var status *imap.MailboxStatus
+	if f.staticOptions.MarkMode != MarkModeNone && !f.staticOptions.DryRun {
+		status, err = client.Select(mailbox, false)
+		if err != nil {
+			logger.Errorf("Failed to select mailbox %v, err: %v", mailbox, err)
+		}
+	}
+
+	// if replies are sent as digest, finalize the emails per reporter once
+	// the digest window has elapsed
+	if f.staticOptions.DigestWindow > 0 {
+		for _, digest := range groupDigests(toFinalize, f.staticOptions.DigestWindow, time.Now().UTC()) {
+			f.finalizeDigest(client, status, digest, &stats)
+		}
+		return stats
+	}
+
 	// loop all emails and finalize them
 	for _, email := range toFinalize {
-		err := f.finalizeEmail(client, email)
+		_, _, err := f.finalizeEmail(client, status, email, true, &stats)
 		if err != nil {
-			logger.Errorf("Failed to finalize email %v, error %v", email.UID, err)
+			logger.WithField("email_uid", email.UID).Errorf("Failed to finalize email, error %v", err)
+		}
+	}
+	return stats
+}
+
+// notifyNCMECReporter notifies the reporter of the given email that the
+// content they reported was reported to NCMEC, if the reporter is one of the
+// given trusted reporters and all NCMEC reports of the email have been filed.
+// It returns whether the reporter got notified.
+func (f *Finalizer) notifyNCMECReporter(email database.AbuseEmail, trusted []string) (notified bool, err error) {
+	// convenience variables
+	abuseDB := f.staticDatabase
+
+	// only trusted reporters are notified, emails without a sender have no
+	// reporter to notify
+	if email.ParseResult.Reporter.NoReply {
+		return false, nil
+	}
+	to, err := f.replyAddress(email)
+	if err != nil {
+		return false, errors.AddContext(err, "could not get reply address")
+	}
+	if !isTrustedReporter(to, trusted) {
+		return false, nil
+	}
+
+	// only notify the reporter once all reports have been filed
+	reports, err := abuseDB.FindReports(email.ID)
+	if err != nil {
+		return false, errors.AddContext(err, "could not find reports")
+	}
+	if len(reports) == 0 {
+		return false, nil
+	}
+	reportIDs := make([]uint64, 0, len(reports))
+	for _, report := range reports {
+		if !report.Filed {
+			return false, nil
+		}
+		reportIDs = append(reportIDs, report.ReportID)
+	}
+
+	// acquire a lock
+	lock := abuseDB.NewLock(email.UID)
+	err = lock.Lock()
+	if err != nil {
+		return false, errors.AddContext(err, "could not acquire lock")
+	}
+
+	// defer the unlock
+	defer func() {
+		unlockErr := lock.Unlock()
+		if unlockErr != nil {
+			err = errors.Compose(err, errors.AddContext(unlockErr, "could not release lock"))
+		}
+	}()
+
+	// now that we have the lock, check whether the reporter has not yet been
+	// notified by another process, if so we just return
+	current, err := abuseDB.FindOne(email.UID)
+	if err != nil {
+		return false, errors.AddContext(err, "could not find email")
+	}
+	if current.NCMECNotified {
+		return false, nil
+	}
+
+	// send the follow-up
+	msg, err := buildNCMECNotification(email, reportIDs, to)
+	if err != nil {
+		return false, err
+	}
+	err = sendMail(smtpServerAddress, f.staticEmailAuth, email.To, []string{to}, []byte(msg))
+	if err != nil {
+		return false, errors.AddContext(err, "could not send NCMEC notification")
+	}
+
+	// update the email
+	err = abuseDB.UpdateNoLockRetry(email, bson.M{
+		"$set": bson.M{"ncmec_notified": true},
+	}, func(current database.AbuseEmail) bool { return current.NCMECNotified })
+	if err != nil {
+		return true, errors.AddContext(err, "could not update email")
+	}
+	return true, nil
+}
+
+// notifyNCMECReporters notifies the trusted reporters of the emails that were
+// recently reported to NCMEC once all of their NCMEC reports have been filed.
+func (f *Finalizer) notifyNCMECReporters() {
+	// convenience variables
+	abuseDB := f.staticDatabase
+	logger := f.staticLogger
+	f.mu.Lock()
+	trusted := f.ncmecNotifyReporters
+	f.mu.Unlock()
+
+	// follow-ups are disabled if there are no trusted reporters, and never
+	// sent in dry-run mode
+	if len(trusted) == 0 || f.staticOptions.DryRun {
+		return
+	}
+
+	// fetch all emails of which the reporter was not notified yet
+	toNotify, err := abuseDB.FindNCMECUnnotified(f.staticMailbox, time.Now().UTC().Add(-ncmecNotifyWindow))
+	if err != nil {
+		logger.Errorf("Failed fetching unnotified emails, error %v", err)
+		return
+	}
+
+	// loop all emails and notify their reporter
+	for _, email := range toNotify {
+		notified, err := f.notifyNCMECReporter(email, trusted)
+		if err != nil {
+			logger.WithField("email_uid", email.UID).Errorf("Failed to notify reporter of NCMEC report, error %v", err)
+			continue
+		}
+		if notified {
+			logger.WithField("email_uid", email.UID).Info("Notified reporter of NCMEC report")
 		}
 	}
 }
@@ -212,9 +626,16 @@ func (f *Finalizer) threadedFinalizeMessages() {
 	ticker := time.NewTicker(finalizeFrequency)
 
 	// start the loop
+	guard := newLoopGuard(ModuleFinalizer, f.staticOptions.Notifier, logger)
 	for {
 		logger.Debugln("threadedFinalizeMessages loop iteration triggered")
-		f.finalizeMessages()
+		metrics.RecordLoopIteration(ModuleFinalizer, finalizeFrequency)
+		if !runIterationUnlessPaused(f.staticContext.Done(), guard, f.staticOptions.Pause, func() { f.finalizeMessages() }) {
+			return
+		}
+		if !runIterationUnlessPaused(f.staticContext.Done(), guard, f.staticOptions.Pause, f.notifyNCMECReporters) {
+			return
+		}
 
 		select {
 		case <-f.staticContext.Done():
@@ -225,6 +646,177 @@ func (f *Finalizer) threadedFinalizeMessages() {
 	}
 }
 
+// replyAddress returns the address the reply to the given email is sent to,
+// for emails of which the reporter's PII got redacted that's the address in
+// the reply token.
+func (f *Finalizer) replyAddress(email database.AbuseEmail) (string, error) {
+	if email.ReplyToken == "" {
+		if !email.HasSender() {
+			return "", errors.New("the email has no sender")
+		}
+		return email.ReplyToEmail(), nil
+	}
+	if f.staticOptions.Redactor == nil {
+		return "", errors.New("the reply address is redacted but no redactor is configured")
+	}
+	return f.staticOptions.Redactor.ReplyAddress(email.ReplyToken)
+}
+
+// isTrustedReporter returns true if the given address matches one of the given
+// trusted reporters, which are either an email address or a domain. A domain
+// matches the addresses of the domain itself and all of its subdomains. This
+// is extracted in a standalone function for unit testing purposes.
+func isTrustedReporter(address string, trusted []string) bool {
+	patterns := make([]string, 0, 2*len(trusted))
+	for _, reporter := range trusted {
+		reporter = strings.TrimSpace(reporter)
+		if reporter == "" {
+			continue
+		}
+		if strings.Contains(reporter, "@") {
+			patterns = append(patterns, reporter)
+			continue
+		}
+		patterns = append(patterns, "@"+reporter, "*@*."+reporter)
+	}
+	return utils.EmailMatches(address, patterns)
+}
+
+// replyLocale returns the locale of the replies to the given address according
+// to the given map of reporters onto locales, the reporters are either an email
+// address or a domain, which matches its subdomains too. An address takes
+// precedence over a domain, and a subdomain over its parent domain. The address
+// is compared after normalization, see utils.NormalizeEmail. It returns an
+// empty string if the address does not match any of the reporters. This is
+// extracted in a standalone function for unit testing purposes.
+func replyLocale(address string, locales map[string]string) string {
+	if len(locales) == 0 {
+		return ""
+	}
+	local, domain, err := utils.NormalizeEmail(address)
+	if err != nil {
+		return ""
+	}
+	if locale, exists := locales[local+"@"+domain]; exists {
+		return locale
+	}
+
+	// walk up the domain until we find a match
+	for domain != "" {
+		if locale, exists := locales[domain]; exists {
+			return locale
+		}
+		dot := strings.Index(domain, ".")
+		if dot == -1 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return ""
+}
+
+// groupDigests groups the given emails per reporter and returns the groups for
+// which the digest window has elapsed, meaning the oldest email of the group got
+// inserted at least window ago. The reporters are compared after normalization,
+// see utils.NormalizeEmail. The emails within a group are sorted by the time
+// they got inserted. This is extracted in a standalone function for unit
+// testing purposes.
+func groupDigests(emails []database.AbuseEmail, window time.Duration, now time.Time) [][]database.AbuseEmail {
+	// group the emails per reporter, keeping track of the order in which we
+	// encounter the reporters so the result is deterministic
+	var reporters []string
+	grouped := make(map[string][]database.AbuseEmail)
+	for _, email := range emails {
+		reporter := strings.ToLower(email.ReplyToEmail())
+		if local, domain, err := utils.NormalizeEmail(reporter); err == nil {
+			reporter = local + "@" + domain
+		}
+		if _, exists := grouped[reporter]; !exists {
+			reporters = append(reporters, reporter)
+		}
+		grouped[reporter] = append(grouped[reporter], email)
+	}
+
+	// return the groups for which the window has elapsed
+	var digests [][]database.AbuseEmail
+	for _, reporter := range reporters {
+		group := grouped[reporter]
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].InsertedAt.Before(group[j].InsertedAt)
+		})
+		if now.Sub(group[0].InsertedAt) < window {
+			continue
+		}
+		digests = append(digests, group)
+	}
+	return digests
+}
+
+// shouldHoldReply is a helper function that returns true if the reply to the
+// given email has to be held for a manual review. That is the case if the
+// finalizer is configured to hold replies to emails that were parsed with low
+// confidence and the email would otherwise get a reply.
+func shouldHoldReply(email database.AbuseEmail, opts FinalizerOptions) bool {
+	return opts.HoldLowConfidence && email.ParseResult.LowConfidence && email.Success()
+}
+
+// CheckSMTP verifies we can authenticate with the SMTP server the replies are
+// sent through using the given credentials, it performs the handshake without
+// sending an email.
+func CheckSMTP(credentials Credentials) error {
+	host, _, err := net.SplitHostPort(smtpServerAddress)
+	if err != nil {
+		return errors.AddContext(err, "invalid SMTP server address")
+	}
+	c, err := smtp.Dial(smtpServerAddress)
+	if err != nil {
+		return errors.AddContext(err, "failed to connect")
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return errors.Compose(errors.AddContext(err, "failed to start TLS"), c.Close())
+		}
+	}
+	err = c.Auth(smtp.PlainAuth("", credentials.Username, credentials.Password, host))
+	if err != nil {
+		return errors.Compose(errors.AddContext(err, "failed to authenticate"), c.Close())
+	}
+	return c.Quit()
+}
+
+// markMessage marks the original message of the given email in the given
+// mailbox, depending on the mark mode it either sets an IMAP keyword or moves
+// the message to another mailbox. This is extracted in a standalone function
+// for unit testing purposes.
+func markMessage(client *client.Client, mailbox *imap.MailboxStatus, email database.AbuseEmail, opts FinalizerOptions) error {
+	if opts.MarkMode == "" || opts.MarkMode == MarkModeNone {
+		return nil
+	}
+	if mailbox == nil {
+		return errors.New("no mailbox selected")
+	}
+
+	// the message uid is only valid if the uid validity did not change
+	if buildMessageUID(mailbox, email.UIDRaw) != email.UID {
+		return fmt.Errorf("message %v not found in mailbox %v with uid validity %v", email.UID, mailbox.Name, mailbox.UidValidity)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(email.UIDRaw)
+
+	switch opts.MarkMode {
+	case MarkModeFlag:
+		flags := []interface{}{opts.MarkFlag}
+		return client.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil)
+	case MarkModeMove:
+		return client.UidMove(seqSet, opts.MarkMailbox)
+	default:
+		return fmt.Errorf("unknown mark mode '%v'", opts.MarkMode)
+	}
+}
+
 // sendAbuseReport sends the abuse report for the given abuse email to the given
 // email address. This is extracted in a standalone function for unit testing
 // purposes.
@@ -252,15 +844,100 @@ func sendAbuseReport(client *client.Client, email database.AbuseEmail, mailbox,
 	return client.Append(mailbox, nil, time.Now().UTC(), reader)
 }
 
+// responseOptions returns the options of the automated responses to the given
+// address, the responses use the templates of the reporter's locale if there
+// are any.
+func (f *Finalizer) responseOptions(to string) database.ResponseOptions {
+	opts := database.ResponseOptions{
+		GroupSkyTransfer: f.staticOptions.GroupSkyTransfer,
+	}
+	locale := replyLocale(to, f.staticOptions.ReplyLocales)
+	if locale == "" {
+		return opts
+	}
+	f.mu.Lock()
+	templates, exists := f.replyTemplates[locale]
+	f.mu.Unlock()
+	if !exists {
+		f.staticLogger.Debugf("No reply templates for locale '%v', falling back to '%v'", locale, database.DefaultResponseLocale)
+		return opts
+	}
+	opts.Templates = templates
+	return opts
+}
+
+// buildDigestReply builds the digest reply for the given abuse emails, which
+// are all sent by the same reporter, to the given address. The reply references
+// all original messages. This is extracted in a standalone function for unit
+// testing purposes.
+func buildDigestReply(emails []database.AbuseEmail, to string, opts database.ResponseOptions) (string, error) {
+	if len(emails) == 0 {
+		return "", errors.New("no emails to build a digest reply for")
+	}
+	first := emails[0]
+
+	// generate a uuid as message id
+	var u *uuid.UUID
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.AddContext(err, "failed to generate uid")
+	}
+
+	// collect the message ids of the original messages
+	var references []string
+	for _, email := range emails {
+		if email.MessageID != "" {
+			references = append(references, email.MessageID)
+		}
+	}
+
+	// construct the email message
+	var sb strings.Builder
+	if len(emails) == 1 {
+		sb.WriteString(fmt.Sprintf("Subject: Re: %s\n", first.Subject))
+	} else {
+		sb.WriteString(fmt.Sprintf("Subject: Re: %s (and %v more reports)\n", first.Subject, len(emails)-1))
+	}
+	sb.WriteString(fmt.Sprintf("Message-ID: <%s@abusescanner>\n", u))
+	sb.WriteString(fmt.Sprintf("References: %s\n", strings.Join(references, " ")))
+	sb.WriteString(fmt.Sprintf("In-Reply-To: %s\n", first.MessageID))
+	sb.WriteString(fmt.Sprintf("From: <%s>\n", first.To))
+	sb.WriteString(fmt.Sprintf("To:%s\n", to))
+	sb.WriteString("\n")
+	sb.WriteString(database.DigestResponse(emails, opts))
+	return sb.String(), nil
+}
+
+// sendDigestReply sends a single digest reply for the given abuse emails to
+// the given address of the reporter that sent them.
+func sendDigestReply(auth smtp.Auth, emails []database.AbuseEmail, to string, opts database.ResponseOptions) error {
+	msg, err := buildDigestReply(emails, to, opts)
+	if err != nil {
+		return err
+	}
+	first := emails[0]
+	return sendMail(smtpServerAddress, auth, first.To, []string{to}, []byte(msg))
+}
+
 // sendAutomatedReply sends the automated reply for the given abuse email to the
-// original email sender. This is extracted in a standalone function for unit
+// given address of the original email sender.
+func sendAutomatedReply(auth smtp.Auth, email database.AbuseEmail, to string, opts database.ResponseOptions) error {
+	msg, err := buildAutomatedReply(email, to, opts)
+	if err != nil {
+		return err
+	}
+	return sendMail(smtpServerAddress, auth, email.To, []string{to}, []byte(msg))
+}
+
+// buildAutomatedReply builds the automated reply for the given abuse email to
+// the given address. This is extracted in a standalone function for unit
 // testing purposes.
-func sendAutomatedReply(auth smtp.Auth, email database.AbuseEmail) error {
+func buildAutomatedReply(email database.AbuseEmail, to string, opts database.ResponseOptions) (string, error) {
 	// generate a uuid as message id
 	var u *uuid.UUID
 	u, err := uuid.NewV4()
 	if err != nil {
-		return errors.AddContext(err, "failed to generate uid")
+		return "", errors.AddContext(err, "failed to generate uid")
 	}
 
 	// construct the email message
@@ -270,10 +947,33 @@ func sendAutomatedReply(auth smtp.Auth, email database.AbuseEmail) error {
 	sb.WriteString(fmt.Sprintf("References: %s\n", email.MessageID))
 	sb.WriteString(fmt.Sprintf("In-Reply-To: %s\n", email.MessageID))
 	sb.WriteString(fmt.Sprintf("From: <%s>\n", email.To))
-	sb.WriteString(fmt.Sprintf("To:%s\n", email.ReplyToEmail()))
+	sb.WriteString(fmt.Sprintf("To:%s\n", to))
 	sb.WriteString("\n")
-	sb.WriteString(email.Response())
+	sb.WriteString(email.Response(opts))
+	return sb.String(), nil
+}
+
+// buildNCMECNotification builds the follow-up for the given abuse email to the
+// given address, which notifies the reporter that the content they reported
+// was reported to NCMEC in the reports with given ids. This is extracted in a
+// standalone function for unit testing purposes.
+func buildNCMECNotification(email database.AbuseEmail, reportIDs []uint64, to string) (string, error) {
+	// generate a uuid as message id
+	var u *uuid.UUID
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.AddContext(err, "failed to generate uid")
+	}
 
-	// send the automated response
-	return smtp.SendMail("smtp.gmail.com:587", auth, email.To, []string{email.ReplyToEmail()}, []byte(sb.String()))
+	// construct the email message
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Subject: Re: %s\n", email.Subject))
+	sb.WriteString(fmt.Sprintf("Message-ID: <%s@abusescanner>\n", u))
+	sb.WriteString(fmt.Sprintf("References: %s\n", email.MessageID))
+	sb.WriteString(fmt.Sprintf("In-Reply-To: %s\n", email.MessageID))
+	sb.WriteString(fmt.Sprintf("From: <%s>\n", email.To))
+	sb.WriteString(fmt.Sprintf("To:%s\n", to))
+	sb.WriteString("\n")
+	sb.WriteString(database.NCMECResponse(reportIDs))
+	return sb.String(), nil
 }
@@ -2,13 +2,28 @@ package email
 
 import (
 	"abuse-scanner/database"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
 	uuid "github.com/nu7hatch/gouuid"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.sia.tech/siad/build"
 )
 
 const (
@@ -20,6 +35,34 @@ const (
 
 	// testUsername is the email username used in unit tests
 	testUsername = ""
+
+	// testMessageUID is the uid of the message the in-memory IMAP backend
+	// contains by default
+	testMessageUID = 6
+)
+
+type (
+	// testMoveBackend wraps the in-memory IMAP backend so its mailboxes
+	// support the MOVE extension
+	testMoveBackend struct {
+		*memory.Backend
+	}
+
+	// testMoveUser wraps an in-memory IMAP user
+	testMoveUser struct {
+		backend.User
+	}
+
+	// testMoveMailbox wraps an in-memory IMAP mailbox and implements
+	// backend.MoveMailbox
+	testMoveMailbox struct {
+		backend.Mailbox
+	}
+
+	// testLeader is a Leader that is the leader if its field is set
+	testLeader struct {
+		leader bool
+	}
 )
 
 // TestFinalizer is a collection of unit tests that verify the functionality of
@@ -40,6 +83,667 @@ func TestFinalizer(t *testing.T) {
 	t.Run("SendAbuseReport", testSendAbuseReport)
 }
 
+// TestFinalizerMarkMessage is a collection of integration tests that verify
+// the finalizer marks the original messages against an in-memory IMAP server.
+func TestFinalizerMarkMessage(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	t.Run("Flag", testMarkMessageFlag)
+	t.Run("Move", testMarkMessageMove)
+	t.Run("None", testMarkMessageNone)
+}
+
+// TestFinalizerDigest verifies the finalizer combines the replies to emails of
+// the same reporter into a single digest reply.
+func TestFinalizerDigest(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	now := time.Now().UTC()
+	window := 10 * time.Minute
+
+	// create three emails from the same reporter, note the casing of the
+	// address differs, and one email from another reporter that got
+	// inserted within the digest window
+	var emails []database.AbuseEmail
+	for i, skylink := range []string{
+		"AAA_l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g",
+		"BBB_l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g",
+		"CCC_l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g",
+	} {
+		email := newTestEmail()
+		email.UID = fmt.Sprintf("INBOX-1-%v", i+1)
+		email.Subject = fmt.Sprintf("Phishing Report %v", i+1)
+		email.ParseResult.Skylinks = []string{skylink}
+		email.InsertedAt = now.Add(-time.Duration(i+1) * window)
+		if i == 1 {
+			email.ReplyTo = strings.ToUpper(email.ReplyTo)
+		}
+		emails = append(emails, email)
+	}
+	other := newTestEmail()
+	other.From = "jane.doe@example.com"
+	other.ReplyTo = ""
+	other.InsertedAt = now.Add(-time.Minute)
+	emails = append(emails, other)
+
+	// assert only the emails of the first reporter are ready, oldest first
+	digests := groupDigests(emails, window, now)
+	if len(digests) != 1 || len(digests[0]) != 3 {
+		t.Fatal("unexpected digests", digests)
+	}
+	if digests[0][0].UID != "INBOX-1-3" || digests[0][2].UID != "INBOX-1-1" {
+		t.Fatal("unexpected order", digests[0][0].UID, digests[0][2].UID)
+	}
+
+	// assert the other reporter's email is ready once the window elapsed
+	digests = groupDigests(emails, window, now.Add(window))
+	if len(digests) != 2 || len(digests[1]) != 1 || digests[1][0].From != other.From {
+		t.Fatal("unexpected digests", digests)
+	}
+
+	// assert a single digest reply is built that covers all emails
+	reply, err := buildDigestReply(digests[0], digests[0][0].ReplyToEmail(), database.ResponseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(reply, "Subject: ") != 1 || !strings.Contains(reply, "Subject: Re: Phishing Report 3 (and 2 more reports)") {
+		t.Fatal("unexpected subject", reply)
+	}
+	if !strings.Contains(reply, "we have processed 3 of your reports") {
+		t.Fatal("unexpected reply", reply)
+	}
+	for _, email := range digests[0] {
+		if !strings.Contains(reply, email.ParseResult.Skylinks[0]) || !strings.Contains(reply, email.Subject) {
+			t.Fatal("expected reply to contain the result of every email", reply)
+		}
+		if !strings.Contains(reply, email.MessageID) {
+			t.Fatal("expected reply to reference every email", reply)
+		}
+	}
+
+	// assert we can't build a digest without emails
+	_, err = buildDigestReply(nil, "", database.ResponseOptions{})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestGroupDigestsNormalized verifies the emails of a reporter are grouped
+// together regardless of how the reporter's address is written.
+func TestGroupDigestsNormalized(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+	var emails []database.AbuseEmail
+	for _, replyTo := range []string{
+		"John <JOHN+x@gmail.com>",
+		"john@gmail.com",
+		"John.Doe@Example.com",
+		"john.doe@example.com",
+		"john+x@example.com",
+	} {
+		email := newTestEmail()
+		email.ReplyTo = replyTo
+		email.InsertedAt = now.Add(-time.Hour)
+		emails = append(emails, email)
+	}
+
+	digests := groupDigests(emails, time.Minute, now)
+	if len(digests) != 3 || len(digests[0]) != 2 || len(digests[1]) != 2 || len(digests[2]) != 1 {
+		t.Fatal("unexpected digests", digests)
+	}
+	if digests[2][0].ReplyTo != "john+x@example.com" {
+		t.Fatal("expected the plus tag to be kept outside of gmail", digests[2][0].ReplyTo)
+	}
+}
+
+// TestFinalizerHoldReply verifies the finalizer only holds the reply to emails
+// that were parsed with low confidence, and only if it's configured to do so.
+func TestFinalizerHoldReply(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	high := newTestEmail()
+	low := newTestEmail()
+	low.ParseResult.Tags = []string{database.AbuseDefaultTag}
+	low.ParseResult.LowConfidence = true
+	failed := low
+	failed.BlockResult = []string{database.AbuseStatusNotBlocked}
+
+	hold := FinalizerOptions{HoldLowConfidence: true}
+	tests := []struct {
+		name  string
+		email database.AbuseEmail
+		opts  FinalizerOptions
+		held  bool
+	}{
+		{"HighConfidence", high, hold, false},
+		{"LowConfidence", low, hold, true},
+		{"LowConfidenceNotHeld", low, FinalizerOptions{}, false},
+		{"LowConfidenceNoReply", failed, hold, false},
+	}
+	for _, test := range tests {
+		if held := shouldHoldReply(test.email, test.opts); held != test.held {
+			t.Fatalf("%v: unexpected outcome %v", test.name, held)
+		}
+	}
+
+	// assert the abuse report mentions the reply was held
+	low.ReplyHeld = true
+	if !strings.Contains(low.String(), "held for manual review") {
+		t.Fatal("unexpected report", low.String())
+	}
+	if strings.Contains(high.String(), "Low Confidence") {
+		t.Fatal("unexpected report", high.String())
+	}
+}
+
+// TestFinalizerNCMECNotification verifies the finalizer only notifies the
+// reporter of an email that got reported to NCMEC once its reports have been
+// filed, and only if the reporter is trusted.
+func TestFinalizerNCMECNotification(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// capture every email that gets sent
+	var sent []string
+	var recipients []string
+	defer func(send func(string, smtp.Auth, string, []string, []byte) error) {
+		sendMail = send
+	}(sendMail)
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		recipients = append(recipients, to...)
+		sent = append(sent, string(msg))
+		return nil
+	}
+
+	// insert a reported email from a trusted reporter and one from an
+	// untrusted reporter, both with an unfiled report
+	skylink := "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"
+	trusted := newTestEmail()
+	trusted.UID = "INBOX-1-1"
+	trusted.From = "abuse@cert.switch.ch"
+	trusted.ReplyTo = ""
+	untrusted := newTestEmail()
+	untrusted.UID = "INBOX-1-2"
+	untrusted.From = "john.doe@example.com"
+	untrusted.ReplyTo = ""
+
+	var reports []database.NCMECReport
+	for i, email := range []*database.AbuseEmail{&trusted, &untrusted} {
+		email.ParseResult.Skylinks = []string{skylink}
+		email.ParseResult.Tags = []string{"csam"}
+		email.Finalized = true
+		email.Reported = true
+		email.ReportedAt = time.Now().UTC()
+		err = abuseDB.InsertOne(*email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report := database.NCMECReport{
+			ID:         primitive.NewObjectID(),
+			EmailID:    email.ID,
+			Report:     "<report/>",
+			ReportID:   uint64(1000 + i),
+			InsertedAt: time.Now().UTC(),
+		}
+		err = abuseDB.InsertReport(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, report)
+	}
+
+	opts := FinalizerOptions{NCMECNotifyReporters: []string{"switch.ch", "reporter@example.org"}}
+	finalizer := NewFinalizer(ctx, abuseDB, Credentials{}, "abuse@siasky.net", "INBOX", "dev.siasky.net", opts, logger)
+
+	// assert nothing is sent while the reports are not filed
+	finalizer.notifyNCMECReporters()
+	if len(sent) != 0 {
+		t.Fatal("unexpected notification before filing", sent)
+	}
+
+	// file the reports
+	for _, report := range reports {
+		err = abuseDB.UpdateReportNoLock(report, bson.M{"$set": bson.M{
+			"filed":    true,
+			"filed_at": time.Now().UTC(),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// assert only the trusted reporter is notified
+	finalizer.notifyNCMECReporters()
+	if len(sent) != 1 || len(recipients) != 1 || recipients[0] != trusted.From {
+		t.Fatal("unexpected notifications", recipients)
+	}
+	if !strings.Contains(sent[0], "NCMEC report ID: 1000") || !strings.Contains(sent[0], "In-Reply-To: "+trusted.MessageID) {
+		t.Fatal("unexpected notification", sent[0])
+	}
+	if strings.Contains(sent[0], skylink) {
+		t.Fatal("notification should not contain the skylink", sent[0])
+	}
+	current, err := abuseDB.FindOne(trusted.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.NCMECNotified {
+		t.Fatal("expected the email to be marked as notified")
+	}
+	current, err = abuseDB.FindOne(untrusted.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.NCMECNotified {
+		t.Fatal("expected the email not to be marked as notified")
+	}
+
+	// assert the trusted reporter is not notified twice
+	finalizer.notifyNCMECReporters()
+	if len(sent) != 1 {
+		t.Fatal("unexpected notifications", recipients)
+	}
+}
+
+// TestFinalizerDigestLeader verifies the finalizer only sends the digest
+// replies if it's the digest leader.
+func TestFinalizerDigestLeader(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// count every connection to the mail server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var connections uint64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddUint64(&connections, 1)
+			_ = conn.Close()
+		}
+	}()
+	creds := Credentials{Address: listener.Addr().String()}
+
+	// assert the follower does not connect to the mail server
+	leader := &testLeader{}
+	opts := FinalizerOptions{DigestLeader: leader, DigestWindow: time.Minute}
+	finalizer := NewFinalizer(context.Background(), nil, creds, "abuse@siasky.net", "INBOX", "dev.siasky.net", opts, logger)
+	finalizer.finalizeMessages()
+	if conns := atomic.LoadUint64(&connections); conns != 0 {
+		t.Fatalf("unexpected amount of connections, %v != 0", conns)
+	}
+
+	// assert the leader does
+	leader.leader = true
+	finalizer.finalizeMessages()
+	err = build.Retry(100, 10*time.Millisecond, func() error {
+		if atomic.LoadUint64(&connections) == 0 {
+			return errors.New("no connection")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFinalizerNoSender verifies the finalizer finalizes emails without a
+// sender, appending the abuse report to the mailbox, but never attempts to
+// reply to the reporter.
+func TestFinalizerNoSender(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// capture every email that gets sent
+	var sent []string
+	defer func(send func(string, smtp.Auth, string, []string, []byte) error) {
+		sendMail = send
+	}(sendMail)
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, string(msg))
+		return nil
+	}
+
+	// insert two emails with an empty envelope, both handled successfully
+	var emails []database.AbuseEmail
+	for i := 1; i <= 2; i++ {
+		email := newTestEmail()
+		email.ID = primitive.NewObjectID()
+		email.UID = fmt.Sprintf("INBOX-1-%v", i)
+		email.From = ""
+		email.ReplyTo = ""
+		email.ParseResult.Reporter = database.AbuseReporter{Email: "abuse@siasky.net", NoReply: true}
+		err = abuseDB.InsertOne(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		emails = append(emails, email)
+	}
+
+	c := newTestIMAPClient(t)
+	status, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numMessages := status.Messages
+
+	// assert the email is finalized without a reply
+	finalizer := NewFinalizer(ctx, abuseDB, Credentials{}, "abuse@siasky.net", "INBOX", "dev.siasky.net", FinalizerOptions{}, logger)
+	var stats FinalizeStats
+	finalized, _, err := finalizer.finalizeEmail(c, nil, emails[0], true, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !finalized {
+		t.Fatal("expected the email to be finalized")
+	}
+	if len(sent) != 0 {
+		t.Fatal("unexpected reply", sent)
+	}
+
+	// assert the abuse report got appended to the mailbox
+	status, err = c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != numMessages+1 {
+		t.Fatalf("unexpected amount of messages, %v != %v", status.Messages, numMessages+1)
+	}
+
+	// assert the email is finalized without a digest reply
+	finalizer.finalizeDigest(c, nil, emails[1:], &stats)
+	if len(sent) != 0 {
+		t.Fatal("unexpected reply", sent)
+	}
+
+	// assert the stats count the emails as finalized without a reply
+	if stats.Finalized != len(emails) || stats.RepliesSent != 0 || stats.RepliesSuppressed != len(emails) {
+		t.Fatal("unexpected stats", stats)
+	}
+	for _, email := range emails {
+		current, err := abuseDB.FindOne(email.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !current.Finalized {
+			t.Fatal("expected the email to be finalized", email.UID)
+		}
+	}
+}
+
+// TestFinalizerDigestSuppressed verifies an email of which the reply got
+// suppressed after the emails were listed is left out of the digest reply.
+func TestFinalizerDigestSuppressed(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create a null logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// capture every email that gets sent
+	var sent []string
+	defer func(send func(string, smtp.Auth, string, []string, []byte) error) {
+		sendMail = send
+	}(sendMail)
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, string(msg))
+		return nil
+	}
+
+	// insert two emails of the same reporter, and suppress the reply to the
+	// second one after the emails were listed
+	var emails []database.AbuseEmail
+	for i := 1; i <= 2; i++ {
+		email := newTestEmail()
+		email.UID = fmt.Sprintf("INBOX-1-%v", i)
+		email.Subject = fmt.Sprintf("Phishing Report %v", i)
+		err = abuseDB.InsertOne(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		emails = append(emails, email)
+	}
+	err = abuseDB.SuppressReply(emails[1].UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the digest reply only covers the first email
+	finalizer := NewFinalizer(ctx, abuseDB, Credentials{}, "abuse@siasky.net", "INBOX", "dev.siasky.net", FinalizerOptions{}, logger)
+	var stats FinalizeStats
+	finalizer.finalizeDigest(newTestIMAPClient(t), nil, emails, &stats)
+	if len(sent) != 1 {
+		t.Fatal("unexpected amount of replies", len(sent))
+	}
+	if !strings.Contains(sent[0], emails[0].MessageID) || strings.Contains(sent[0], emails[1].MessageID) {
+		t.Fatal("unexpected digest reply", sent[0])
+	}
+	if stats.Finalized != 2 || stats.RepliesSent != 1 || stats.RepliesSuppressed != 1 {
+		t.Fatal("unexpected stats", stats)
+	}
+}
+
+// TestIsTrustedReporter is a unit test for isTrustedReporter.
+func TestIsTrustedReporter(t *testing.T) {
+	t.Parallel()
+
+	trusted := []string{"switch.ch", "Reporter@Example.org", " "}
+	tests := []struct {
+		address string
+		trusted bool
+	}{
+		{"abuse@switch.ch", true},
+		{"abuse@cert.switch.ch", true},
+		{"ABUSE@SWITCH.CH", true},
+		{"abuse@notswitch.ch", false},
+		{"abuse@switch.ch.example.com", false},
+		{"reporter@example.org", true},
+		{"Reporter <REPORTER@example.org>", true},
+		{"Abuse Desk <abuse@cert.switch.ch>", true},
+		{"other@example.org", false},
+		{"example.org", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if isTrustedReporter(test.address, trusted) != test.trusted {
+			t.Fatalf("unexpected outcome for '%v', expected %v", test.address, test.trusted)
+		}
+	}
+	if isTrustedReporter("abuse@switch.ch", nil) {
+		t.Fatal("expected no reporter to be trusted")
+	}
+}
+
+// TestFinalizerReplyLocale verifies the replies to a reporter use the templates
+// of the reporter's locale, and that they fall back to the English templates if
+// the reporter has no locale or there are no templates for its locale.
+func TestFinalizerReplyLocale(t *testing.T) {
+	t.Parallel()
+
+	// write the German templates, the greeting is left out on purpose
+	dir := t.TempDir()
+	de := `{
+	"blocked": "die folgenden Links wurden am {blocked_at} auf allen unseren Servern gesperrt",
+	"legal_notice": "Vielen Dank für Ihre Meldung."
+}`
+	err := ioutil.WriteFile(filepath.Join(dir, "de.json"), []byte(de), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := database.LoadResponseTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	f := &Finalizer{
+		staticLogger: logger.WithField("module", ModuleFinalizer),
+		staticOptions: FinalizerOptions{
+			ReplyLocales: map[string]string{
+				"cert-bund.de":     "de",
+				"abuse@example.fr": "fr",
+			},
+		},
+		replyTemplates: templates,
+	}
+
+	email := newTestEmail()
+	for _, test := range []struct {
+		to     string
+		german bool
+	}{
+		{"abuse@cert-bund.de", true},
+		{"Abuse <abuse@reports.CERT-Bund.de>", true},
+		{"abuse@example.fr", false},
+		{"john.doe@example.com", false},
+	} {
+		reply, err := buildAutomatedReply(email, test.to, f.responseOptions(test.to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		german := strings.Contains(reply, "die folgenden Links wurden am") && strings.Contains(reply, "Vielen Dank für Ihre Meldung.")
+		english := strings.Contains(reply, "the following links were identified and blocked") && strings.Contains(reply, "Thank you for your report.")
+		if german != test.german || english == test.german {
+			t.Fatal("unexpected reply", test.to, reply)
+		}
+
+		// the greeting is not localized so it falls back to English
+		if !strings.Contains(reply, "Hello,") {
+			t.Fatal("expected the greeting to fall back to English", reply)
+		}
+	}
+
+	// assert the templates are reloadable, without the German templates the
+	// reply falls back to English
+	f.Reload(FinalizerOptions{})
+	reply, err := buildAutomatedReply(email, "abuse@cert-bund.de", f.responseOptions("abuse@cert-bund.de"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(reply, "die folgenden Links wurden am") || !strings.Contains(reply, "the following links were identified and blocked") {
+		t.Fatal("unexpected reply", reply)
+	}
+}
+
+// TestReplyLocale is a unit test for replyLocale.
+func TestReplyLocale(t *testing.T) {
+	t.Parallel()
+
+	locales := map[string]string{
+		"example.de":           "de",
+		"example.at":           "de",
+		"fr.example.at":        "fr",
+		"reporter@example.at":  "en",
+		"reporter@example.com": "es",
+		"reporter@gmail.com":   "it",
+	}
+	tests := []struct {
+		address string
+		locale  string
+	}{
+		{"abuse@example.de", "de"},
+		{"abuse@cert.example.de", "de"},
+		{"ABUSE@EXAMPLE.DE", "de"},
+		{"abuse@notexample.de", ""},
+		{"abuse@fr.example.at", "fr"},
+		{"abuse@cert.fr.example.at", "fr"},
+		{"reporter@example.at", "en"},
+		{"Reporter <reporter@example.com>", "es"},
+		{"other@example.com", ""},
+		{"John <REPORTER+abuse@Gmail.com>", "it"},
+		{"example.de", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if locale := replyLocale(test.address, locales); locale != test.locale {
+			t.Fatalf("unexpected locale for '%v', %v != %v", test.address, locale, test.locale)
+		}
+	}
+	if replyLocale("abuse@example.de", nil) != "" {
+		t.Fatal("expected no locale")
+	}
+}
+
 // testSendAutomatedReply sends the automated reply for a test email, this unit
 // test gets skipped by default but is committed for debugging purposes
 func testSendAutomatedReply(t *testing.T) {
@@ -47,7 +751,7 @@ func testSendAutomatedReply(t *testing.T) {
 
 	email := newTestEmail()
 	email.ReplyTo = testEmailTo
-	err := sendAutomatedReply(auth, email)
+	err := sendAutomatedReply(auth, email, email.ReplyToEmail(), database.ResponseOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,6 +784,200 @@ func testSendAbuseReport(t *testing.T) {
 	}
 }
 
+// testMarkMessageFlag verifies the original message is flagged with the
+// configured keyword
+func testMarkMessageFlag(t *testing.T) {
+	t.Parallel()
+
+	c := newTestIMAPClient(t)
+	mailbox, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert marking fails if the uid validity changed
+	email := database.AbuseEmail{UID: "INBOX-0-6", UIDRaw: testMessageUID}
+	opts := FinalizerOptions{MarkMode: MarkModeFlag, MarkFlag: DefaultMarkFlag}
+	err = markMessage(c, mailbox, email, opts)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// mark the message
+	email.UID = buildMessageUID(mailbox, testMessageUID)
+	err = markMessage(c, mailbox, email, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the flag was set and the existing flags were preserved, note
+	// that IMAP keywords are case-insensitive
+	flags := fetchTestFlags(t, c, testMessageUID)
+	if len(flags) != 2 || !hasFlag(flags, DefaultMarkFlag) || !hasFlag(flags, imap.SeenFlag) {
+		t.Fatal("unexpected flags", flags)
+	}
+}
+
+// testMarkMessageMove verifies the original message is moved to the
+// configured mailbox
+func testMarkMessageMove(t *testing.T) {
+	t.Parallel()
+
+	c := newTestIMAPClient(t)
+	err := c.Create("Processed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mark the message
+	email := database.AbuseEmail{UID: buildMessageUID(mailbox, testMessageUID), UIDRaw: testMessageUID}
+	err = markMessage(c, mailbox, email, FinalizerOptions{MarkMode: MarkModeMove, MarkMailbox: "Processed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the message was moved
+	status, err := c.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 0 {
+		t.Fatal("unexpected amount of messages in INBOX", status.Messages)
+	}
+	status, err = c.Status("Processed", []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Fatal("unexpected amount of messages in Processed", status.Messages)
+	}
+}
+
+// testMarkMessageNone verifies the original message is left untouched if the
+// mark mode is none
+func testMarkMessageNone(t *testing.T) {
+	t.Parallel()
+
+	c := newTestIMAPClient(t)
+	mailbox, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := database.AbuseEmail{UID: buildMessageUID(mailbox, testMessageUID), UIDRaw: testMessageUID}
+	for _, mode := range []string{"", MarkModeNone} {
+		err = markMessage(c, mailbox, email, FinalizerOptions{MarkMode: mode, MarkFlag: DefaultMarkFlag})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flags := fetchTestFlags(t, c, testMessageUID)
+	if len(flags) != 1 || flags[0] != imap.SeenFlag {
+		t.Fatal("unexpected flags", flags)
+	}
+}
+
+// newTestIMAPClient starts an in-memory IMAP server and returns a client that
+// is logged in, both are closed when the test finishes.
+func newTestIMAPClient(t *testing.T) *client.Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(testMoveBackend{memory.New()})
+	s.AllowInsecureAuth = true
+	go func() {
+		_ = s.Serve(l)
+	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+
+	c, err := client.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Logout()
+	})
+
+	err = c.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// fetchTestFlags returns the flags of the message with given uid in the
+// currently selected mailbox.
+func fetchTestFlags(t *testing.T, c *client.Client, uid uint32) []string {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	messages := make(chan *imap.Message, 1)
+	err := c.UidFetch(seqSet, []imap.FetchItem{imap.FetchFlags}, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-messages
+	if msg == nil {
+		t.Fatal("message not found", uid)
+	}
+	return msg.Flags
+}
+
+// hasFlag returns true if the given flags contain the given flag.
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Login implements the backend.Backend interface.
+func (b testMoveBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := b.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return testMoveUser{user}, nil
+}
+
+// GetMailbox implements the backend.User interface.
+func (u testMoveUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mailbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return testMoveMailbox{mailbox}, nil
+}
+
+// MoveMessages implements the backend.MoveMailbox interface.
+func (m testMoveMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	err := m.CopyMessages(uid, seqset, dest)
+	if err != nil {
+		return err
+	}
+	err = m.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.DeletedFlag})
+	if err != nil {
+		return err
+	}
+	return m.Expunge()
+}
+
+// IsLeader implements the Leader interface.
+func (l *testLeader) IsLeader() bool {
+	return l.leader
+}
+
 // newTestEmail returns a dummy abuse email used for testing
 func newTestEmail() database.AbuseEmail {
 	// generate a uuid as message id
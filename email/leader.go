@@ -0,0 +1,16 @@
+package email
+
+type (
+	// Leader decides whether a job that has to run exactly once across all
+	// instances of the scanner runs on this instance, it's implemented by
+	// database.LeaderLease.
+	Leader interface {
+		IsLeader() bool
+	}
+)
+
+// isLeader is a helper function that returns true if the given leader is nil,
+// meaning the job is not shared with other instances, or if it's the leader.
+func isLeader(leader Leader) bool {
+	return leader == nil || leader.IsLeader()
+}
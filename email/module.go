@@ -0,0 +1,28 @@
+package email
+
+const (
+	// the names of the modules, they match the module field of their log
+	// entries and the label of their loop metrics
+	ModuleBlocker   = "Blocker"
+	ModuleFetcher   = "Fetcher"
+	ModuleFinalizer = "Finalizer"
+	ModuleParser    = "Parser"
+	ModuleReporter  = "Reporter"
+)
+
+type (
+	// Module is a module of the scanner that runs in the background between
+	// the calls to Start and Stop, it's implemented by the Fetcher, the
+	// Parser, the Blocker, the Finalizer and the Reporter.
+	Module interface {
+		// Name returns the name of the module.
+		Name() string
+
+		// Start starts the background threads of the module.
+		Start() error
+
+		// Stop stops the module, it waits for the work that is in progress
+		// to finish.
+		Stop() error
+	}
+)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -27,9 +28,49 @@ const (
 	// when everything is ok.
 	ncmecStatusOK = 0
 
+	// ncmecStatusServerError is the custom status code ncmec uses on their
+	// endpoints when an error occurred on their end.
+	ncmecStatusServerError = 1000
+
+	// ncmecStatusNotAuthorized is the custom status code ncmec uses on their
+	// endpoints when the credentials are invalid.
+	ncmecStatusNotAuthorized = 1010
+
 	// ncmecStatusValidationFailed is the custom status code ncmec uses on
 	// their endpoints when validation fails.
 	ncmecStatusValidationFailed = 4100
+
+	// ncmecIncidentTypeCSAM is the incident type of the reports we file with
+	// NCMEC.
+	ncmecIncidentTypeCSAM = "Child Pornography (possession, manufacture, and distribution)"
+)
+
+const (
+	// NCMECActionBackoff stops filing reports until the next iteration, the
+	// report is retried then. It's meant for response codes that affect every
+	// report, e.g. when we're rate limited or the credentials are invalid.
+	NCMECActionBackoff = "backoff"
+
+	// NCMECActionFail marks the report as failed, failed reports are never
+	// retried and require manual intervention. It's meant for response codes
+	// that indicate a problem with the report itself, and it's the action for
+	// response codes that are unknown.
+	NCMECActionFail = "fail"
+
+	// NCMECActionRetry keeps the report pending, it's retried in the next
+	// iteration. It's meant for transient errors.
+	NCMECActionRetry = "retry"
+)
+
+var (
+	// defaultNCMECResponseActions maps the response codes of the NCMEC API
+	// onto the way the reporter handles them, the mapping can be extended or
+	// overridden through the reporter options
+	defaultNCMECResponseActions = map[uint64]string{
+		ncmecStatusServerError:      NCMECActionRetry,
+		ncmecStatusNotAuthorized:    NCMECActionBackoff,
+		ncmecStatusValidationFailed: NCMECActionFail,
+	}
 )
 
 type (
@@ -61,6 +102,10 @@ type (
 		Reporter        NCMECReporter        `xml:"reporter"`
 
 		Uploader ncmecReportedPerson `xml:"personOrUserReported"`
+
+		// AdditionalInfo mentions the version of the scanner that built the
+		// report.
+		AdditionalInfo string `xml:"additionalInfo,omitempty"`
 	}
 
 	// reportResponse is the xml response that gets returned when a report
@@ -71,6 +116,29 @@ type (
 		ReportId            uint64 `xml:"reportId"`
 	}
 
+	// uploadResponse is the xml response that gets returned when a file is
+	// uploaded to an open report
+	uploadResponse struct {
+		ResponseCode        uint64      `xml:"responseCode"`
+		ResponseDescription string      `xml:"responseDescription"`
+		ReportId            uint64      `xml:"reportId"`
+		FileId              ncmecFileId `xml:"fileId"`
+		Hash                string      `xml:"hash"`
+	}
+
+	// fileDetails is the xml that is sent to NCMEC to describe a file that
+	// was uploaded to an open report
+	fileDetails struct {
+		XMLName xml.Name `xml:"fileDetails"`
+
+		ReportId          uint64      `xml:"reportId"`
+		FileId            ncmecFileId `xml:"fileId"`
+		OriginalFileName  string      `xml:"originalFileName"`
+		LocationOfFile    string      `xml:"locationOfFile"`
+		PubliclyAvailable bool        `xml:"publiclyAvailable"`
+		AdditionalInfo    string      `xml:"additionalInfo"`
+	}
+
 	// reportDoneResponse is the xml response that gets returned when a report
 	// is finished with NCMEC
 	reportDoneResponse struct {
@@ -121,11 +189,21 @@ type (
 	// ncmecFileId represents a file identifier
 	ncmecFileId string
 
+	// ncmecResponseError is the error that is returned if the NCMEC API
+	// responded with an unexpected response code, it holds the action the
+	// reporter takes for that code.
+	ncmecResponseError struct {
+		action string
+		code   uint64
+		msg    string
+	}
+
 	// NCMECClient is a helper struct that abstracts all http requests that are
 	// needed to report a CSAM incident to NCMEC.
 	NCMECClient struct {
 		staticAuthorization string
 		staticBaseUri       string
+		staticHTTPClient    *http.Client
 	}
 )
 
@@ -152,33 +230,67 @@ func LoadNCMECCredentials() (NCMECCredentials, error) {
 	return creds, nil
 }
 
-// LoadNCMECReporter is a helper function that loads the NCMEC reporter from the
-// environment.
-func LoadNCMECReporter() (NCMECReporter, error) {
-	var reporter ncmecPerson
-	var ok bool
-	if reporter.FirstName, ok = os.LookupEnv("NCMEC_REPORTER_FIRSTNAME"); !ok {
-		return NCMECReporter{}, errors.New("missing env var NCMEC_REPORTER_FIRSTNAME")
-	}
-	if reporter.LastName, ok = os.LookupEnv("NCMEC_REPORTER_LASTNAME"); !ok {
-		return NCMECReporter{}, errors.New("missing env var NCMEC_REPORTER_LASTNAME")
-	}
-	if reporter.Email, ok = os.LookupEnv("NCMEC_REPORTER_EMAIL"); !ok {
-		return NCMECReporter{}, errors.New("missing env var NCMEC_REPORTER_EMAIL")
+// NewNCMECReporter returns the NCMEC reporter with the given name and email,
+// the reporter is the person that files the reports on behalf of the portal.
+func NewNCMECReporter(firstName, lastName, email string) NCMECReporter {
+	return NCMECReporter{
+		ReportingPerson: ncmecPerson{
+			FirstName: firstName,
+			LastName:  lastName,
+			Email:     email,
+		},
 	}
+}
 
-	return NCMECReporter{ReportingPerson: reporter}, nil
+// ParseNCMECResponseActions parses the given comma separated list of
+// 'code:action' pairs, e.g. '1000:retry,4100:fail', into a mapping of NCMEC
+// response codes onto the action the reporter takes. The action is one of
+// NCMECActionBackoff, NCMECActionFail or NCMECActionRetry.
+func ParseNCMECResponseActions(actionsStr string) (map[uint64]string, error) {
+	actions := make(map[uint64]string)
+	for _, pair := range strings.Split(actionsStr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid pair '%v', expected 'code:action'", pair)
+		}
+		code, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response code '%v'", parts[0])
+		}
+		switch action := strings.ToLower(strings.TrimSpace(parts[1])); action {
+		case NCMECActionBackoff, NCMECActionFail, NCMECActionRetry:
+			actions[code] = action
+		default:
+			return nil, fmt.Errorf("invalid action '%v' for response code %v, expected one of '%v', '%v' or '%v'", action, code, NCMECActionBackoff, NCMECActionFail, NCMECActionRetry)
+		}
+	}
+	return actions, nil
 }
 
-// NewNCMECClient returns a new instance of the NCMEC client.
-func NewNCMECClient(creds NCMECCredentials) *NCMECClient {
+// Error implements the error interface.
+func (e ncmecResponseError) Error() string {
+	return e.msg
+}
+
+// NewNCMECClient returns a new instance of the NCMEC client, it sends its
+// requests using the given shared HTTP client, if the client is nil it uses
+// http.DefaultClient.
+func NewNCMECClient(creds NCMECCredentials, client *http.Client) *NCMECClient {
 	baseUri := ncmecBaseURI
 	if creds.Debug {
 		baseUri = ncmecTestBaseURI
 	}
+	if client == nil {
+		client = http.DefaultClient
+	}
 	return &NCMECClient{
 		staticAuthorization: base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password)),
 		staticBaseUri:       baseUri,
+		staticHTTPClient:    client,
 	}
 }
 
@@ -203,6 +315,69 @@ func (c *NCMECClient) finishReport(reportId uint64) (reportDoneResponse, error)
 	return resp, nil
 }
 
+// fileInfo describes the file with given details, the file has to be uploaded
+// to the report first.
+func (c *NCMECClient) fileInfo(details fileDetails) (reportResponse, error) {
+	// marshal the details and create the request body
+	detailsBytes, err := xml.Marshal(&details)
+	if err != nil {
+		return reportResponse{}, err
+	}
+
+	xmlBytes := append([]byte{}, []byte(xml.Header)...)
+	xmlBytes = append(xmlBytes, detailsBytes...)
+	body := bytes.NewBuffer(xmlBytes)
+
+	// construct the request headers
+	headers := http.Header{}
+	headers.Set("Authorization", fmt.Sprintf("Basic %s", c.staticAuthorization))
+	headers.Add("Content-Type", "text/xml; charset=utf-8")
+
+	var resp reportResponse
+	err = c.post("/fileinfo", url.Values{}, headers, body, &resp)
+	if err != nil {
+		return reportResponse{}, err
+	}
+
+	return resp, nil
+}
+
+// uploadFile uploads the given file to the open report with given id
+func (c *NCMECClient) uploadFile(reportId uint64, filename string, file []byte) (uploadResponse, error) {
+	// create a multipart form with the report id and the file
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	err := writer.WriteField("id", fmt.Sprint(reportId))
+	if err != nil {
+		return uploadResponse{}, err
+	}
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return uploadResponse{}, err
+	}
+	_, err = part.Write(file)
+	if err != nil {
+		return uploadResponse{}, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return uploadResponse{}, err
+	}
+
+	// construct the request headers
+	headers := http.Header{}
+	headers.Set("Authorization", fmt.Sprintf("Basic %s", c.staticAuthorization))
+	headers.Add("Content-Type", writer.FormDataContentType())
+
+	var resp uploadResponse
+	err = c.post("/upload", url.Values{}, headers, body, &resp)
+	if err != nil {
+		return uploadResponse{}, err
+	}
+
+	return resp, nil
+}
+
 // openReport opens the given report with NCMEC
 func (c *NCMECClient) openReport(r report) (reportResponse, error) {
 	// marshal the report and create the request body
@@ -244,6 +419,19 @@ func (c *NCMECClient) status() (reportResponse, error) {
 	return resp, nil
 }
 
+// Status checks the status of the NCMEC API, it returns an error if the API is
+// unreachable, if the credentials are invalid, or if it's not healthy.
+func (c *NCMECClient) Status() error {
+	res, err := c.status()
+	if err != nil {
+		return fmt.Errorf("unexpected response from NCMEC API, err %v", err)
+	}
+	if res.ResponseCode != ncmecStatusOK {
+		return fmt.Errorf("unexpected status response from NCMEC API, status %v", res.ResponseCode)
+	}
+	return nil
+}
+
 // get is a helper function that executes a GET request on the given endpoint
 // with the provided query values. The response will get unmarshaled into the
 // given response object.
@@ -266,7 +454,7 @@ func (c *NCMECClient) get(endpoint string, query url.Values, headers http.Header
 		req.Header.Set(k, v[0])
 	}
 	var res *http.Response
-	res, err = http.DefaultClient.Do(req)
+	res, err = c.staticHTTPClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -301,7 +489,7 @@ func (c *NCMECClient) post(endpoint string, query url.Values, headers http.Heade
 		req.Header.Set(k, v[0])
 	}
 	var res *http.Response
-	res, err = http.DefaultClient.Do(req)
+	res, err = c.staticHTTPClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -2,6 +2,7 @@ package email
 
 import (
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -31,7 +32,7 @@ func TestNCMECClient(t *testing.T) {
 	}
 
 	// instantiate the client
-	client := NewNCMECClient(creds)
+	client := NewNCMECClient(creds, nil)
 
 	tests := []struct {
 		name string
@@ -55,6 +56,33 @@ func TestNCMECClient(t *testing.T) {
 	}
 }
 
+// TestParseNCMECResponseActions verifies the mapping of NCMEC response codes
+// onto actions is parsed correctly, and that invalid mappings are rejected.
+func TestParseNCMECResponseActions(t *testing.T) {
+	t.Parallel()
+
+	actions, err := ParseNCMECResponseActions(" 1000:backoff, 4100 : RETRY,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint64]string{1000: NCMECActionBackoff, 4100: NCMECActionRetry}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatal("unexpected actions", actions)
+	}
+
+	actions, err = ParseNCMECResponseActions("")
+	if err != nil || len(actions) != 0 {
+		t.Fatal("unexpected actions", actions, err)
+	}
+
+	for _, invalid := range []string{"1000", "-1:fail", "abc:fail", "1000:ignore"} {
+		_, err = ParseNCMECResponseActions(invalid)
+		if err == nil {
+			t.Fatal("expected error", invalid)
+		}
+	}
+}
+
 // testFinishReport is a unit test that verifies whether we can finish a report
 func testFinishReport(t *testing.T, c *NCMECClient) {
 	// quickly assert NCMEC is up
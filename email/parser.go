@@ -2,6 +2,9 @@ package email
 
 import (
 	"abuse-scanner/database"
+	"abuse-scanner/metrics"
+	"abuse-scanner/notifier"
+	"abuse-scanner/skylink"
 	"abuse-scanner/utils"
 	"bufio"
 	"bytes"
@@ -9,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -17,13 +21,14 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/emersion/go-message"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
-	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/net/html"
+	"golang.org/x/net/idna"
 
 	//nolint:golint,blank-imports
 	_ "github.com/emersion/go-message/charset"
@@ -51,22 +56,71 @@ module.exports = defineConfig({
 	}
 })`
 
+	// ExtractionModePrecision only extracts skylinks from links that are
+	// clearly on one of the known portals, avoiding false blocks.
+	ExtractionModePrecision = "precision"
+
+	// ExtractionModeRecall extracts anything that plausibly is a skylink,
+	// including skylinks that are not part of a link.
+	ExtractionModeRecall = "recall"
+
+	// IDNModeIgnore ignores the links with an internationalized host that is
+	// not encoded in punycode, they never match a portal.
+	IDNModeIgnore = "ignore"
+
+	// IDNModeNormalize converts the internationalized hosts of links to their
+	// punycode form before they are matched against the portals.
+	IDNModeNormalize = "normalize"
+
+	// maxResolutionLogSize is the maximum size, in bytes, of the cypress
+	// output we persist when the resolution of SkyTransfer URLs fails.
+	maxResolutionLogSize = 16 << 10 // 16 KiB
+
 	// defaultDirPerm defines the default permissions used for a new dir
 	defaultDirPerm = 0755
 
 	// defaultFilePerm defines the default permissions used for a new file
 	defaultFilePerm = 0644
 
+	// defaultParseTimeout is the default amount of time the parser spends
+	// extracting the skylinks and tags from a single email
+	defaultParseTimeout = 10 * time.Minute
+
+	// defaultSkyTransferResolutionMaxAge is the default maximum age of a
+	// stored SkyTransfer resolution for it to be reused
+	defaultSkyTransferResolutionMaxAge = 30 * 24 * time.Hour
+
+	// skyTransferResolutionMarker prefixes the lines the cypress tests log for
+	// every resolved SkyTransfer URL, the line contains the SkyTransfer URL
+	// followed by the URL of the request that downloads its files
+	skyTransferResolutionMarker = "skytransfer-resolution"
+
 	// parseFrequency defines the frequency with which the parser looks for
 	// emails to be parsed
 	parseFrequency = 30 * time.Second
 )
 
 var (
+	// DefaultConflictPatterns are the default patterns that suggest an email
+	// discusses abuse rather than reports it, they match phrases from the
+	// legal notice we include in our responses.
+	DefaultConflictPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)no\s+content\s+is\s+stored\s+on\s+our\s+servers`),
+		regexp.MustCompile(`(?i)decentrali[sz]ed\s+network\s+of\s+hosts`),
+		regexp.MustCompile(`(?i)not\s+to\s+be\s+held\s+accountable`),
+	}
+
+	// DefaultConflictTags are the default high-severity tags that are
+	// checked for conflicts.
+	DefaultConflictTags = []string{"csam", "terrorism"}
+
 	// extractSkylink64RE and extractSkylink64RE_2 are regexes capable of
-	// extracting base-64 encoded skylinks from text
-	extractSkylink64RE   = regexp.MustCompile(`.+?://.+?\..+?/([a-zA-Z0-9-_]{46})`)
-	extractSkylink64RE_2 = regexp.MustCompile(`(http.+|hxxp.+|\..+|://.+|^)([a-zA-Z0-9-_]{46})(\?.*)?$`)
+	// extracting base-64 encoded skylinks from text, the former extracts the
+	// path of a URL, which is then searched for skylinks using
+	// extractPathSkylink64RE on every path segment
+	extractSkylink64RE     = regexp.MustCompile(`.+?://[^/\s]+?\.[^/\s]+?(/\S*)`)
+	extractSkylink64RE_2   = regexp.MustCompile(`(http.+|hxxp.+|\..+|://.+|^)([a-zA-Z0-9-_]{46})(\?.*)?$`)
+	extractPathSkylink64RE = regexp.MustCompile(`^([a-zA-Z0-9-_]{46})`)
 
 	// extractSkylink32RE and extractSkylink32RE_2 are regexes capable of
 	// extracting base-32 encoded skylinks from text
@@ -76,39 +130,292 @@ var (
 	// extractSkytransferURL is a regex that is capable of extracting skytransfer URLs
 	extractSkytransferURL = regexp.MustCompile(`^.*((?:https://)?skytransfer.hns.*/.*?(\s|$))`)
 
+	// extractPortalLinkRE is a regex that is capable of extracting the host
+	// and the path of a (refanged) link
+	extractPortalLinkRE = regexp.MustCompile(`(?i)https?://([^/\s?#]+)(/[^\s]*)?`)
+
 	// extractPortalURL is a regex that is capable of extracting the portal from
 	// an hns URL
 	extractPortalURL = regexp.MustCompile(`^https://.*\.hns\.(.*?)/.*`)
 
+	// htmlBoundaryElements are the HTML elements that separate their contents
+	// from the surrounding text, i.e. the block-level elements, line breaks
+	// and code. The text of inline elements is joined without a separator, as
+	// reporters defang links using inline elements, e.g.
+	// 'siasky<span>[.]</span>net', while the text of adjacent block-level
+	// elements must not be concatenated into a bogus token.
+	htmlBoundaryElements = map[string]struct{}{
+		"address": {}, "article": {}, "aside": {}, "blockquote": {}, "br": {},
+		"code": {}, "dd": {}, "div": {}, "dl": {}, "dt": {}, "figcaption": {},
+		"figure": {}, "footer": {}, "form": {}, "h1": {}, "h2": {}, "h3": {},
+		"h4": {}, "h5": {}, "h6": {}, "header": {}, "hr": {}, "li": {},
+		"main": {}, "nav": {}, "ol": {}, "p": {}, "pre": {}, "section": {},
+		"table": {}, "td": {}, "th": {}, "tr": {}, "ul": {},
+	}
+
 	// space matches all whitespace
 	space = regexp.MustCompile(`\s+`)
 
+	// leadingPunctuation and trailingPunctuation contain the punctuation that
+	// is commonly found directly before or after a link or skylink in an
+	// abuse report, e.g. when it ends a sentence or is wrapped in parentheses
+	// or quotes
+	leadingPunctuation  = "([{<\"'“‘«"
+	trailingPunctuation = ".,;:!?)]}>\"'”’»"
+
 	validateSkylink64RE = regexp.MustCompile(`^([a-zA-Z0-9-_]{46})$`)
 	validateSkylink32RE = regexp.MustCompile(`(?i)^([a-z0-9]{55})$`)
 )
 
 type (
+	// resolutionError is returned when the resolution of SkyTransfer URLs
+	// failed, it contains the bounded output of the cypress command.
+	resolutionError struct {
+		staticErr error
+		staticLog string
+	}
+
+	// skyTransferResolver resolves the given SkyTransfer URLs to the skylinks
+	// they point to, alongside all skylinks it returns the skylinks per
+	// SkyTransfer URL.
+	skyTransferResolver func(ctx context.Context, urls []string, logger *logrus.Logger) ([]string, map[string][]string, error)
+
 	// Parser is an object that will periodically scan for unparsed emails and
 	// parse them for skylinks.
 	Parser struct {
-		staticContext      context.Context
-		staticDatabase     *database.AbuseScannerDB
-		staticLogger       *logrus.Entry
-		staticServerDomain string
-		staticSponsor      string
-		staticWaitGroup    sync.WaitGroup
+		staticContext         context.Context
+		staticDatabase        *database.AbuseScannerDB
+		staticExtractSkylinks func(input []byte) []string
+		staticLogger          *logrus.Entry
+		staticOptions         ParserOptions
+		staticServerDomain    string
+		staticSponsor         string
+		staticWaitGroup       sync.WaitGroup
+
+		// staticResolveSkyTransferURLs resolves the SkyTransfer URLs that
+		// have no stored resolution, it returns the resolved skylinks and
+		// the skylinks per SkyTransfer URL
+		staticResolveSkyTransferURLs func(ctx context.Context, urls []string, logger *logrus.Logger) ([]string, map[string][]string, error)
+
+		// the reloadable options, they're set from the options, the
+		// evidence fetcher and the URL expander are nil if their allowlist
+		// is empty
+		conflictPatterns []*regexp.Regexp
+		conflictTags     []string
+		evidenceFetcher  *evidenceFetcher
+		mailboxTags      map[string]string
+		reporterOrgs     map[string]string
+		urlExpander      *urlExpander
+		mu               sync.Mutex
+	}
+
+	// ParserOptions contains the configurable options of the parser.
+	ParserOptions struct {
+		// AuthMode defines whether the parser verifies the authentication
+		// of incoming emails, it's one of AuthModeNone, AuthModeRecord or
+		// AuthModeReview. If empty it defaults to AuthModeNone.
+		AuthMode string
+
+		// AuthServID is the authserv-id of our mail server, only the
+		// Authentication-Results header with this id is trusted. If empty,
+		// the topmost Authentication-Results header is trusted.
+		AuthServID string
+
+		// ConflictPatterns are the patterns that suggest an email discusses
+		// abuse rather than reports it, e.g. because it quotes our legal
+		// notice. If an email with one of the ConflictTags matches any of
+		// these patterns, it needs a manual review before it gets reported.
+		// Defaults to DefaultConflictPatterns.
+		ConflictPatterns []*regexp.Regexp
+
+		// ConflictTags are the high-severity tags that are checked for
+		// conflicts, defaults to DefaultConflictTags.
+		ConflictTags []string
+
+		// EvidenceHosts is an allowlist of trusted hosts, e.g.
+		// docs.google.com, from which we download linked evidence documents
+		// to extract skylinks from. Links to any other host are never
+		// followed. If empty, evidence documents are not downloaded.
+		EvidenceHosts []string
+
+		// ExtractionMode defines the tradeoff the parser makes when
+		// extracting skylinks, it's one of ExtractionModeRecall or
+		// ExtractionModePrecision. If empty it defaults to
+		// ExtractionModeRecall.
+		ExtractionMode string
+
+		// FallbackReporterEmail is the contact that is recorded as the
+		// reporter's email on emails that have no sender, i.e. neither a
+		// From nor a ReplyTo address. Those emails are still blocked and
+		// reported, but the reporter is never replied to. If empty, the
+		// reporter's email is left empty.
+		FallbackReporterEmail string
+
+		// HTTPClient is the shared HTTP client, the evidence fetcher and the
+		// URL expander use a copy of it with their own timeout and redirect
+		// policy, which shares its transport. Defaults to http.DefaultClient.
+		HTTPClient *http.Client
+
+		// IDNMode defines how the internationalized hosts of links are
+		// handled when matching them against the portals, it's one of
+		// IDNModeNormalize or IDNModeIgnore. If empty it defaults to
+		// IDNModeNormalize.
+		IDNMode string
+
+		// KnownPortals are the portal domains, e.g. siasky.net, links have to
+		// point to, or to a subdomain of, for their skylinks to be extracted
+		// if the extraction mode is ExtractionModePrecision.
+		KnownPortals []string
+
+		// LinkUnwrapRules map the hosts of link rewriters, e.g. the relays
+		// of corporate email gateways, onto the query parameter that holds
+		// the destination of a rewritten link. The destinations are
+		// extracted before the skylinks, so skylinks hidden behind a
+		// rewritten link are found. The rules extend and override
+		// DefaultLinkUnwrapRules.
+		LinkUnwrapRules map[string]string
+
+		// MailboxTags map the name of a mailbox, e.g. csam, onto the tag
+		// that every email fetched from that mailbox receives, alongside the
+		// tags derived from its keywords. This allows running dedicated
+		// mailboxes per category. The names are matched case-insensitively.
+		MailboxTags map[string]string
+
+		// Notifier notifies the on-call of every CSAM report that comes in,
+		// if nil no notifications are sent.
+		Notifier *notifier.Notifier
+
+		// ParseTimeout is the maximum amount of time the parser spends
+		// extracting the skylinks and tags from a single email, so one
+		// pathological email can't hold up the emails behind it. An email
+		// that exceeds it is marked as parsed with the skylinks and tags that
+		// were found so far, and ParseTimedOut set on its parse result.
+		// Defaults to defaultParseTimeout.
+		ParseTimeout time.Duration
+
+		// Pause pauses the parser while the processing is paused, its loop
+		// keeps ticking but skips its work. If nil it's never paused.
+		Pause Pauser
+
+		// PortalURLs are the URLs of the portals we operate, e.g.
+		// https://siasky.net, the portal the skylinks were reported on is
+		// detected from the links in the email and recorded on the parse
+		// result. If empty, the portal is not detected.
+		PortalURLs []string
+
+		// Redactor redacts the reporter's PII from the email once it's been
+		// parsed, if nil the email is stored as it was received.
+		Redactor *Redactor
+
+		// ReporterOrgs maps a sender domain to the organization that is known
+		// to send abuse reports from that domain, e.g. switch.ch to
+		// SWITCH-CERT.
+		ReporterOrgs map[string]string
+
+		// ShortenerHosts is an allowlist of URL shorteners, e.g. bit.ly, of
+		// which we expand the short URLs to extract the skylinks they point
+		// to. Only these hosts are contacted, the URL a short URL points to
+		// is never requested. If empty, short URLs are not expanded.
+		ShortenerHosts []string
+
+		// ShutdownTimeout is the amount of time Stop waits for the parser to
+		// shut down before it returns an error, defaults to
+		// defaultShutdownTimeout.
+		ShutdownTimeout time.Duration
+
+		// SkyTransferResolutionMaxAge is the maximum age of the stored
+		// resolution of a SkyTransfer URL for it to be reused, a URL of which
+		// the resolution is older is resolved again. Defaults to
+		// defaultSkyTransferResolutionMaxAge.
+		SkyTransferResolutionMaxAge time.Duration
+	}
+
+	// ParseStats are the counts of a single parse pass.
+	ParseStats struct {
+		// Parsed is the amount of emails that got parsed.
+		Parsed int `json:"parsed"`
 	}
 )
 
 // NewParser creates a new parser.
-func NewParser(ctx context.Context, database *database.AbuseScannerDB, serverDomain, sponsor string, logger *logrus.Logger) *Parser {
+func NewParser(ctx context.Context, database *database.AbuseScannerDB, serverDomain, sponsor string, opts ParserOptions, logger *logrus.Logger) *Parser {
+	if opts.AuthMode == "" {
+		opts.AuthMode = AuthModeNone
+	}
+	if opts.ConflictPatterns == nil {
+		opts.ConflictPatterns = DefaultConflictPatterns
+	}
+	if opts.ConflictTags == nil {
+		opts.ConflictTags = DefaultConflictTags
+	}
+	if opts.ExtractionMode == "" {
+		opts.ExtractionMode = ExtractionModeRecall
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.IDNMode == "" {
+		opts.IDNMode = IDNModeNormalize
+	}
+	if opts.ParseTimeout == 0 {
+		opts.ParseTimeout = defaultParseTimeout
+	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if opts.SkyTransferResolutionMaxAge == 0 {
+		opts.SkyTransferResolutionMaxAge = defaultSkyTransferResolutionMaxAge
+	}
+	extract := newLinkUnwrapper(opts.LinkUnwrapRules).WrapExtractor(newSkylinkExtractor(opts.ExtractionMode, opts.KnownPortals, opts.IDNMode))
+	parserLogger := logger.WithField("module", ModuleParser)
 	return &Parser{
-		staticContext:      ctx,
-		staticDatabase:     database,
-		staticLogger:       logger.WithField("module", "Parser"),
-		staticServerDomain: serverDomain,
-		staticSponsor:      sponsor,
+		staticContext:         ctx,
+		staticDatabase:        database,
+		staticExtractSkylinks: extract,
+		staticLogger:          parserLogger,
+		staticOptions:         opts,
+		staticServerDomain:    serverDomain,
+		staticSponsor:         sponsor,
+
+		staticResolveSkyTransferURLs: resolveSkyTransferURLs,
+
+		conflictPatterns: opts.ConflictPatterns,
+		conflictTags:     opts.ConflictTags,
+		evidenceFetcher:  newEvidenceFetcher(opts.EvidenceHosts, opts.HTTPClient, extract, parserLogger),
+		mailboxTags:      opts.MailboxTags,
+		reporterOrgs:     opts.ReporterOrgs,
+		urlExpander:      newURLExpander(opts.ShortenerHosts, opts.HTTPClient, extract, parserLogger),
+	}
+}
+
+// Reload swaps the reloadable options of the parser for the ones in the given
+// options while the parser is running, only the ConflictPatterns, ConflictTags,
+// EvidenceHosts, MailboxTags, ReporterOrgs and ShortenerHosts are reloadable.
+// The other options are ignored, the evidence documents and short URLs keep
+// being requested using the HTTP client the parser was created with.
+func (p *Parser) Reload(opts ParserOptions) {
+	if opts.ConflictPatterns == nil {
+		opts.ConflictPatterns = DefaultConflictPatterns
+	}
+	if opts.ConflictTags == nil {
+		opts.ConflictTags = DefaultConflictTags
 	}
+	evidenceFetcher := newEvidenceFetcher(opts.EvidenceHosts, p.staticOptions.HTTPClient, p.staticExtractSkylinks, p.staticLogger)
+	urlExpander := newURLExpander(opts.ShortenerHosts, p.staticOptions.HTTPClient, p.staticExtractSkylinks, p.staticLogger)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conflictPatterns = opts.ConflictPatterns
+	p.conflictTags = opts.ConflictTags
+	p.evidenceFetcher = evidenceFetcher
+	p.mailboxTags = opts.MailboxTags
+	p.reporterOrgs = opts.ReporterOrgs
+	p.urlExpander = urlExpander
+}
+
+// Name returns the name of the parser.
+func (p *Parser) Name() string {
+	return ModuleParser
 }
 
 // Start initializes the fetch process.
@@ -121,6 +428,12 @@ func (p *Parser) Start() error {
 	return nil
 }
 
+// RunOnce parses all unparsed messages a single time, it does not require the
+// parser to be started. It returns the counts of the parse pass.
+func (p *Parser) RunOnce() ParseStats {
+	return p.parseMessages()
+}
+
 // Stop waits for the parser's waitgroup and times out after one minute.
 func (p *Parser) Stop() error {
 	c := make(chan struct{})
@@ -131,47 +444,147 @@ func (p *Parser) Stop() error {
 	select {
 	case <-c:
 		return nil
-	case <-time.After(time.Minute):
+	case <-time.After(p.staticOptions.ShutdownTimeout):
 		return errors.New("unclean parser shutdown")
 	}
 }
 
 // buildAbuseReport will parse the email body into an abuse report. This report
-// contains information about the reporter, the tags and the skylinks.
-func (p *Parser) buildAbuseReport(email database.AbuseEmail) (database.AbuseReport, error) {
+// contains information about the reporter, the tags and the skylinks. Alongside
+// the report it returns the output of the SkyTransfer resolver if resolving the
+// SkyTransfer URLs in the email failed. If the parsing exceeds the parse
+// timeout the report contains what was found so far, and has ParseTimedOut set.
+func (p *Parser) buildAbuseReport(email database.AbuseEmail) (database.AbuseReport, string, error) {
 	// convenience variables
-	logger := p.staticLogger
+	logger := p.staticLogger.WithField("email_uid", email.UID)
+	p.mu.Lock()
+	conflictPatterns, conflictTags, mailboxTags, reporterOrgs := p.conflictPatterns, p.conflictTags, p.mailboxTags, p.reporterOrgs
+	evidenceFetcher, urlExpander := p.evidenceFetcher, p.urlExpander
+	p.mu.Unlock()
 
 	// check for nil body
 	body := email.Body
 	if body == nil {
-		return database.AbuseReport{}, errors.New("empty body")
+		return database.AbuseReport{}, "", errors.New("empty body")
 	}
 
 	// extract the reporter.
 	reporter := database.AbuseReporter{
-		Email: email.ReplyToEmail(),
+		Email:       email.ReplyToEmail(),
+		ReporterOrg: extractReporterOrg(email.ReplyToEmail(), reporterOrgs),
 	}
 
+	// automated submissions sometimes have an empty envelope, we can't reply
+	// to those so we fall back to the configured contact
+	if !email.HasSender() {
+		logger.Info("Email has no sender, the reporter will not be replied to")
+		reporter.Email = p.staticOptions.FallbackReporterEmail
+		reporter.NoReply = true
+	}
+
+	// bound the time we spend on the email, the extraction stops at the
+	// next step once the timeout is exceeded
+	ctx, cancel := context.WithTimeout(p.staticContext, p.staticOptions.ParseTimeout)
+	defer cancel()
+
 	// extract all tags and skylinks
-	skylinks, tags, err := parseBody(body, logger)
+	skylinks, sources, skyTransferURLs, tags, resolutionLog, err := parseBody(ctx, body, p.staticExtractSkylinks, p.resolveSkyTransferURLs, logger)
 	if err != nil {
-		return database.AbuseReport{}, err
+		return database.AbuseReport{}, "", err
+	}
+
+	// the mailbox the email was sent to can imply a tag, e.g. the csam tag
+	// for emails sent to a dedicated CSAM mailbox, regardless of its keywords,
+	// it replaces the default tag of emails without any matching keywords
+	if tag, exists := mailboxTags[strings.ToLower(email.Mailbox)]; exists {
+		if len(tags) == 1 && tags[0] == database.AbuseDefaultTag {
+			tags = nil
+		}
+		tags = mergeTags(tags, []string{tag})
+	}
+
+	// extract the skylinks from evidence documents hosted on trusted hosts
+	if evidenceFetcher != nil && ctx.Err() == nil {
+		for _, skylink := range evidenceFetcher.FetchSkylinks(ctx, body) {
+			if _, exists := sources[skylink]; !exists {
+				sources[skylink] = database.SkylinkSourceEvidence
+				skylinks = append(skylinks, skylink)
+			}
+		}
+	}
+
+	// extract the skylinks from short URLs of trusted URL shorteners
+	if urlExpander != nil && ctx.Err() == nil {
+		for _, skylink := range urlExpander.ExpandSkylinks(ctx, body) {
+			if _, exists := sources[skylink]; !exists {
+				sources[skylink] = database.SkylinkSourceShortener
+				skylinks = append(skylinks, skylink)
+			}
+		}
+	}
+
+	// the email is not marked as parsed if the parser is shutting down, it's
+	// parsed again on the next start
+	if p.staticContext.Err() != nil {
+		return database.AbuseReport{}, "", errors.New("parser context done")
+	}
+	timedOut := ctx.Err() != nil
+	if timedOut {
+		logger.Warnf("Parsing the email exceeded the timeout of %v, found %v skylinks so far", p.staticOptions.ParseTimeout, len(skylinks))
+	}
+
+	// check whether the tags conflict with the contents of the email
+	reason := detectTagConflict(body, tags, conflictTags, conflictPatterns)
+	if reason != "" {
+		logger.Infof("Email needs a manual review, %v", reason)
+	}
+
+	// check whether we are confident about the skylinks we found
+	lowConfidence := detectLowConfidence(body, skylinks, sources, tags)
+	if lowConfidence {
+		logger.Info("Email was parsed with low confidence")
+	}
+
+	// detect the portal the skylinks were reported on
+	portal := detectPortal(body, p.staticOptions.PortalURLs, p.staticOptions.IDNMode)
+
+	// check whether the email passed DKIM and SPF
+	var auth authResults
+	if p.staticOptions.AuthMode != AuthModeNone {
+		auth = parseAuthResults(body, p.staticOptions.AuthServID)
+		if p.staticOptions.AuthMode == AuthModeReview && !auth.passed() && reason == "" {
+			reason = reviewReasonAuth
+			logger.Infof("Email needs a manual review, %v", reason)
+		}
 	}
 
 	// return a report
 	return database.AbuseReport{
-		Skylinks: skylinks,
-		Reporter: reporter,
-		Sponsor:  p.staticSponsor,
-		Tags:     tags,
-	}, nil
+		Skylinks:        skylinks,
+		SkylinkSources:  sources,
+		SkyTransferURLs: skyTransferURLs,
+		Reporter:        reporter,
+		Sponsor:         p.staticSponsor,
+		Tags:            tags,
+
+		NeedsReview:  reason != "",
+		ReviewReason: reason,
+
+		LowConfidence: lowConfidence,
+		ParseTimedOut: timedOut,
+		Portal:        portal,
+
+		AuthChecked: auth.checked,
+		DKIMPass:    auth.dkimPass,
+		SPFPass:     auth.spfPass,
+	}, resolutionLog, nil
 }
 
 // parseEmail will parse the body of the given email into a list of abuse
 // reports. Every report contains a unique skylink with extra metadata and can
-// be used to block abusive skylinks.
-func (p *Parser) parseEmail(email database.AbuseEmail) (err error) {
+// be used to block abusive skylinks. It returns whether the email got parsed,
+// which is not the case if another process parsed it in the meantime.
+func (p *Parser) parseEmail(email database.AbuseEmail) (parsed bool, err error) {
 	// convenience variables
 	abuseDB := p.staticDatabase
 
@@ -179,7 +592,7 @@ func (p *Parser) parseEmail(email database.AbuseEmail) (err error) {
 	lock := abuseDB.NewLock(email.UID)
 	err = lock.Lock()
 	if err != nil {
-		return errors.AddContext(err, "could not acquire lock")
+		return false, errors.AddContext(err, "could not acquire lock")
 	}
 
 	// defer the unlock
@@ -191,32 +604,89 @@ func (p *Parser) parseEmail(email database.AbuseEmail) (err error) {
 		}
 	}()
 
+	// under lock, check whether the email has not been parsed yet by another
+	// process, if so we simply return
+	current, err := abuseDB.FindOne(email.UID)
+	if err != nil {
+		return false, errors.AddContext(err, "could not find email")
+	}
+	if current == nil {
+		return false, fmt.Errorf("email %v not found", email.UID)
+	}
+	if current.Parsed {
+		return false, nil
+	}
+
 	// parse the email body into a report
 	var report database.AbuseReport
-	report, err = p.buildAbuseReport(email)
+	var resolutionLog string
+	report, resolutionLog, err = p.buildAbuseReport(email)
 	if err != nil {
-		return errors.AddContext(err, "could not parse email body")
+		return false, errors.AddContext(err, "could not parse email body")
 	}
 
-	// update the email
-	err = abuseDB.UpdateNoLock(email, bson.M{
-		"$set": bson.M{
-			"parsed":       true,
-			"parsed_at":    time.Now().UTC(),
-			"parsed_by":    p.staticServerDomain,
-			"parse_result": report,
-		},
+	// update the email, persisting the resolver output if resolution failed
+	update := bson.M{
+		"parsed":       true,
+		"parsed_at":    time.Now().UTC(),
+		"parsed_by":    p.staticServerDomain,
+		"parse_result": report,
+	}
+	if resolutionLog != "" {
+		update["resolution_log"] = resolutionLog
+	}
+
+	// redact the reporter's PII, now that we've extracted what we need
+	if p.staticOptions.Redactor.enabled() {
+		redacted, err := p.staticOptions.Redactor.Redact(email)
+		if err != nil {
+			return false, errors.AddContext(err, "could not redact email")
+		}
+		if !report.Reporter.NoReply {
+			report.Reporter.Email = redacted.ReplyToEmail()
+		}
+		update["parse_result"] = report
+		update["email_body"] = redacted.Body
+		update["email_from"] = redacted.From
+		update["email_reply_to"] = redacted.ReplyTo
+		update["reply_token"] = redacted.ReplyToken
+	}
+	parsed = true
+	err = abuseDB.UpdateNoLockRetry(email, bson.M{
+		"$set": update,
+	}, func(current database.AbuseEmail) bool {
+		parsed = !current.Parsed
+		return current.Parsed
 	})
 	if err != nil {
-		return errors.AddContext(err, "could not update email")
+		return false, errors.AddContext(err, "could not update email")
 	}
-	return nil
+	if !parsed {
+		return false, nil
+	}
+
+	// notify the on-call of CSAM reports, every report is notified so the
+	// notifications are keyed by the email, the notification does not
+	// contain any of the reporter's PII
+	if report.HasTag("csam") {
+		err = p.staticOptions.Notifier.NotifyKeyed(notifier.SeverityCritical, "CSAM report received", email.UID, []notifier.Field{
+			{Name: "Email UID", Value: email.UID},
+			{Name: "Skylinks", Value: fmt.Sprint(len(report.Skylinks))},
+			{Name: "Reporter Org", Value: report.Reporter.ReporterOrg},
+			{Name: "Tags", Value: strings.Join(report.Tags, ", ")},
+		})
+		if err != nil {
+			p.staticLogger.WithField("email_uid", email.UID).Errorf("Failed to notify of CSAM report, error %v", err)
+		}
+	}
+	return true, nil
 }
 
 // parseMessages fetches all unparsed message from the database and parses them.
 // Parsing entails extracting all skylinks and tags from the email to build an
-// abuse report, which is set on the abuse email in the database.
-func (p *Parser) parseMessages() {
+// abuse report, which is set on the abuse email in the database. It returns
+// the counts of the parse pass.
+func (p *Parser) parseMessages() (stats ParseStats) {
 	// convenience variables
 	abuseDB := p.staticDatabase
 	logger := p.staticLogger
@@ -225,25 +695,30 @@ func (p *Parser) parseMessages() {
 	toParse, err := abuseDB.FindUnparsed()
 	if err != nil {
 		logger.Errorf("Failed fetching unparsed emails, error %v", err)
-		return
+		return stats
 	}
 
 	// log unparsed messages count
 	numUnparsed := len(toParse)
 	if numUnparsed == 0 {
 		logger.Debugf("Found %v unparsed messages", numUnparsed)
-		return
+		return stats
 	}
 
 	logger.Infof("Found %v unparsed messages", numUnparsed)
 
 	// loop all emails and parse them
 	for _, email := range toParse {
-		err = p.parseEmail(email)
+		parsed, err := p.parseEmail(email)
 		if err != nil {
-			logger.Errorf("Failed to parse email %v, error %v", email.UID, err)
+			logger.WithField("email_uid", email.UID).Errorf("Failed to parse email, error %v", err)
+			continue
+		}
+		if parsed {
+			stats.Parsed++
 		}
 	}
+	return stats
 }
 
 // threadedParseMessages will periodically fetch email messages that have not
@@ -256,9 +731,13 @@ func (p *Parser) threadedParseMessages() {
 	ticker := time.NewTicker(parseFrequency)
 
 	// start the loop
+	guard := newLoopGuard(ModuleParser, p.staticOptions.Notifier, logger)
 	for {
 		logger.Debugln("threadedParseMessages loop iteration triggered")
-		p.parseMessages()
+		metrics.RecordLoopIteration(ModuleParser, parseFrequency)
+		if !runIterationUnlessPaused(p.staticContext.Done(), guard, p.staticOptions.Pause, func() { p.parseMessages() }) {
+			return
+		}
 
 		select {
 		case <-p.staticContext.Done():
@@ -270,12 +749,20 @@ func (p *Parser) threadedParseMessages() {
 }
 
 // parseBody is a helper function that parses the given body bytes, extracted
-// as a standalone function for unit testing purposes
-func parseBody(body []byte, logger *logrus.Entry) ([]string, []string, error) {
+// as a standalone function for unit testing purposes. Skylinks are extracted
+// from the text using the given extract function. Alongside the skylinks and
+// tags it returns the source of every skylink, which is the extraction method
+// that found the skylink first, the SkyTransfer URL every skylink that was
+// found by resolving one was resolved from, and the output of the SkyTransfer
+// resolver if resolving the SkyTransfer URLs failed. The SkyTransfer URLs are resolved
+// using the given resolver. Once the given context is done the remaining parts
+// of a multipart body and the resolution of the SkyTransfer URLs are skipped,
+// what was found so far is returned.
+func parseBody(ctx context.Context, body []byte, extract func(input []byte) []string, resolve skyTransferResolver, logger *logrus.Entry) ([]string, map[string]string, map[string]string, []string, string, error) {
 	// use the message library to parse the email
 	msg, err := message.Read(bytes.NewBuffer(body))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, nil, "", err
 	}
 
 	// extract all tags and skylinks
@@ -283,10 +770,29 @@ func parseBody(body []byte, logger *logrus.Entry) ([]string, []string, error) {
 	var skylinks []string
 	var skytransferURLs []string
 
+	// addSkylinks adds the given skylinks, recording the given source for the
+	// ones we have not found yet
+	sources := make(map[string]string)
+	addSkylinks := func(source string, found []string) {
+		for _, skylink := range found {
+			if _, exists := sources[skylink]; !exists {
+				sources[skylink] = source
+				skylinks = append(skylinks, skylink)
+			}
+		}
+	}
+
+	// extract all skylinks from the subject
+	subject, err := msg.Header.Text("Subject")
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	addSkylinks(database.SkylinkSourceSubject, extract([]byte(subject)))
+
 	// create a multi-part reader from the message
 	mpr := msg.MultipartReader()
 	if mpr != nil {
-		for {
+		for ctx.Err() == nil {
 			p, err := mpr.NextPart()
 			if err == io.EOF {
 				break
@@ -299,6 +805,7 @@ func parseBody(body []byte, logger *logrus.Entry) ([]string, []string, error) {
 			if !shouldParseMediaType(t) {
 				continue
 			}
+			disp, _, _ := p.Header.ContentDisposition()
 			switch t {
 			case "text/html":
 				// extract all text from the HTML
@@ -309,7 +816,11 @@ func parseBody(body []byte, logger *logrus.Entry) ([]string, []string, error) {
 				}
 
 				// extract all skylinks from the HTML
-				skylinks = append(skylinks, extractSkylinks([]byte(text))...)
+				source := database.SkylinkSourceHTML
+				if disp == "attachment" {
+					source = database.SkylinkSourceAttachment
+				}
+				addSkylinks(source, extract([]byte(text)))
 
 				// extract all skytransfer URLs from the HTML
 				skytransferURLs = dedupe(append(skytransferURLs, extractSkyTransferURLs([]byte(text), logger.Logger)...))
@@ -324,7 +835,11 @@ func parseBody(body []byte, logger *logrus.Entry) ([]string, []string, error) {
 				}
 
 				// extract all skylinks from the email body
-				skylinks = append(skylinks, extractSkylinks(body)...)
+				source := database.SkylinkSourceBody
+				if disp == "attachment" {
+					source = database.SkylinkSourceAttachment
+				}
+				addSkylinks(source, extract(body))
 
 				// extract all skytransfer URLs from the HTML
 				skytransferURLs = dedupe(append(skytransferURLs, extractSkyTransferURLs(body, logger.Logger)...))
@@ -334,7 +849,31 @@ func parseBody(body []byte, logger *logrus.Entry) ([]string, []string, error) {
 			}
 		}
 	} else {
-		skylinks = extractSkylinks(body)
+		header, text := splitHeader(body)
+		addSkylinks(database.SkylinkSourceHeader, extract(header))
+
+		// extract all skylinks from the decoded HTML, the raw body might
+		// still be quoted-printable encoded
+		if t, _, _ := msg.Header.ContentType(); t == "text/html" {
+			htmlText, err := extractTextFromHTML(msg.Body)
+			if err != nil {
+				logger.Errorf("error occurred while trying to read the HTML from the body, err: %v", err)
+			} else {
+				addSkylinks(database.SkylinkSourceHTML, extract([]byte(htmlText)))
+			}
+		} else {
+			// read the body through the message, which decodes it according
+			// to its content transfer encoding, e.g. base64, we fall back to
+			// the raw body if that fails
+			decoded, err := ioutil.ReadAll(msg.Body)
+			if err != nil {
+				logger.Errorf("error occurred while trying to decode the body, err: %v", err)
+			} else {
+				text = decoded
+				body = bytes.Join([][]byte{header, decoded}, []byte("\n\n"))
+			}
+		}
+		addSkylinks(database.SkylinkSourceBody, extract(text))
 		skytransferURLs = dedupe(append(skytransferURLs, extractSkyTransferURLs(body, logger.Logger)...))
 		tags = extractTags(body)
 	}
@@ -344,20 +883,40 @@ func parseBody(body []byte, logger *logrus.Entry) ([]string, []string, error) {
 		tags = append(tags, database.AbuseDefaultTag)
 	}
 
-	// if we have found skytransfer URLs, resolve them to skylinks
-	if len(skytransferURLs) > 0 {
-		resolvedSkylinks, err := resolveSkyTransferURLs(skytransferURLs, logger.Logger)
+	// if we have found skytransfer URLs, resolve them to skylinks, we record
+	// the URL the skylinks we did not find yet were resolved from
+	var resolutionLog string
+	var skyTransferSkylinks map[string]string
+	if ctx.Err() != nil {
+		logger.Infof("Skipped resolving %v skytransfer URLs, %v", len(skytransferURLs), ctx.Err())
+	} else if len(skytransferURLs) > 0 {
+		resolvedSkylinks, resolutions, err := resolve(ctx, skytransferURLs, logger.Logger)
 		if err != nil {
-			fmt.Println(err)
 			logger.Errorf("failed to resolve skytransfer URLs, err %v", err)
+			if resErr, ok := err.(resolutionError); ok {
+				resolutionLog = resErr.staticLog
+			}
 		} else {
-			skylinks = append(skylinks, resolvedSkylinks...)
+			addSkylinks(database.SkylinkSourceSkyTransfer, resolvedSkylinks)
+			for _, url := range skytransferURLs {
+				for _, skylink := range resolutions[url] {
+					if sources[skylink] != database.SkylinkSourceSkyTransfer {
+						continue
+					}
+					if skyTransferSkylinks == nil {
+						skyTransferSkylinks = make(map[string]string)
+					}
+					if _, exists := skyTransferSkylinks[skylink]; !exists {
+						skyTransferSkylinks[skylink] = url
+					}
+				}
+			}
 		}
 	} else {
 		logger.Info("NO SKYTRANSFER URLS FOUND")
 	}
 
-	return dedupe(skylinks), dedupe(tags), nil
+	return skylinks, sources, skyTransferSkylinks, dedupe(tags), resolutionLog, nil
 }
 
 // dedupe is a helper function that deduplicates the given input slice
@@ -378,19 +937,20 @@ func dedupe(input []string) []string {
 }
 
 // extractSkylinks is a helper function that extracts all skylinks (as strings)
-// from the given byte slice.
+// from the given byte slice. Every line is searched as is, refanged with all
+// whitespace removed, and with the punctuation around its tokens trimmed.
 func extractSkylinks(input []byte) []string {
 	var maybeSkylinks []string
 
 	// range over the string line by line and extract potential skylinks
-	sc := bufio.NewScanner(bytes.NewBuffer(input))
-	for sc.Scan() {
+	for _, normalized := range utils.NormalizeLines(input) {
 		for _, line := range []string{
-			sc.Text(),
-			space.ReplaceAllString(sc.Text(), ""),
+			normalized,
+			utils.Refang(space.ReplaceAllString(normalized, "")),
+			trimPunctuation(normalized),
 		} {
 			base64matches := append(
-				extractSkylink64RE.FindAllStringSubmatch(line, -1),
+				extractPathSkylinks64(line),
 				extractSkylink64RE_2.FindAllStringSubmatch(line, -1)...,
 			)
 			base32matches := append(
@@ -415,36 +975,231 @@ func extractSkylinks(input []byte) []string {
 		}
 	}
 
-	// add the potential skylinks to a list of skylinks if LoadString succeeds
+	return dedupe(loadSkylinks(maybeSkylinks))
+}
+
+// extractPortalSkylinks is a helper function that extracts all skylinks from
+// links in the given input that point to one of the given portals, or to a
+// subdomain of one of them. Links are refanged before they are matched, e.g.
+// `hxxps:// siasky [.] net` is considered a link to siasky.net. Base-32
+// encoded skylinks are extracted from the subdomain, both base-32 and base-64
+// encoded skylinks are extracted from every path segment. Internationalized
+// hosts are handled according to the given IDN mode, see normalizeLinkHost.
+func extractPortalSkylinks(input []byte, portals []string, idnMode string) []string {
+	var maybeSkylinks []string
+	portals = normalizePortals(portals)
+
+	// range over the string line by line and extract the links, we remove
+	// all whitespace as defanged links often contain spaces
+	sc := bufio.NewScanner(bytes.NewBuffer(input))
+	for sc.Scan() {
+		line := utils.Refang(space.ReplaceAllString(sc.Text(), ""))
+		for _, match := range extractPortalLinkRE.FindAllStringSubmatch(line, -1) {
+			host := normalizeLinkHost(match[1], idnMode)
+			portal := matchPortal(host, portals)
+			if portal == "" {
+				continue
+			}
+
+			// extract the skylink from the subdomain
+			if subdomain := strings.TrimSuffix(host, "."+portal); subdomain != host {
+				labels := strings.Split(subdomain, ".")
+				if validateSkylink32RE.MatchString(labels[0]) {
+					maybeSkylinks = append(maybeSkylinks, labels[0])
+				}
+			}
+
+			// extract the skylinks from the path
+			for _, segment := range strings.Split(match[2], "/") {
+				segment = strings.TrimRight(segment, trailingPunctuation)
+				if validateSkylink32RE.MatchString(segment) {
+					maybeSkylinks = append(maybeSkylinks, segment)
+					continue
+				}
+				if m := extractPathSkylink64RE.FindStringSubmatch(segment); m != nil {
+					maybeSkylinks = append(maybeSkylinks, m[1])
+				}
+			}
+		}
+	}
+
+	return dedupe(loadSkylinks(maybeSkylinks))
+}
+
+// extractPathSkylinks64 is a helper function that extracts potential base-64
+// encoded skylinks from the path of every URL in the given line. Skylinks are
+// not necessarily found in the first path segment, e.g. portals serve content
+// at `/skynet/<skylink>` or `/hns/<name>/<skylink>` too, so every segment is
+// considered. The matches are returned in the same format as the output of
+// FindAllStringSubmatch.
+func extractPathSkylinks64(line string) [][]string {
+	var matches [][]string
+	for _, urlMatch := range extractSkylink64RE.FindAllStringSubmatch(line, -1) {
+		for _, segment := range strings.Split(urlMatch[1], "/") {
+			match := extractPathSkylink64RE.FindStringSubmatch(segment)
+			if match != nil {
+				matches = append(matches, match)
+			}
+		}
+	}
+	return matches
+}
+
+// trimPunctuation is a helper function that strips the punctuation that
+// directly precedes or follows every whitespace separated token in the given
+// line, this ensures a skylink followed by a period, comma, closing bracket or
+// quote still matches the anchored extraction regexes.
+func trimPunctuation(line string) string {
+	tokens := strings.Fields(line)
+	for i, token := range tokens {
+		tokens[i] = strings.TrimLeft(strings.TrimRight(token, trailingPunctuation), leadingPunctuation)
+	}
+	return strings.Join(tokens, " ")
+}
+
+// loadSkylinks is a helper function that returns the given potential skylinks
+// for which LoadString succeeds, in their base-64 encoded form.
+func loadSkylinks(maybeSkylinks []string) []string {
 	var skylinks []string
-	for _, skylink := range maybeSkylinks {
-		var sl skymodules.Skylink
-		err := sl.LoadString(skylink)
-		if err == nil {
-			skylinks = append(skylinks, sl.String())
+	for _, maybeSkylink := range maybeSkylinks {
+		if normalized, ok := skylink.Normalize(maybeSkylink); ok {
+			skylinks = append(skylinks, normalized)
 		}
 	}
+	return skylinks
+}
 
-	return dedupe(skylinks)
+// normalizeLinkHost is a helper function that normalizes the host of a link
+// that was matched by extractPortalLinkRE, it's lowercased and stripped of its
+// port and of the punctuation that might follow it. An internationalized host
+// is converted to its punycode form if the given IDN mode is IDNModeNormalize,
+// otherwise an empty string is returned, as it is if the host is not a valid
+// internationalized domain name.
+func normalizeLinkHost(host, idnMode string) string {
+	host = strings.ToLower(strings.Trim(strings.TrimRight(host, trailingPunctuation), "."))
+	if i := strings.Index(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	if isASCII(host) {
+		return host
+	}
+	if idnMode != IDNModeNormalize {
+		return ""
+	}
+	host, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(host, ".")
+}
+
+// normalizePortals is a helper function that returns the given portals in
+// their lowercased ASCII form, internationalized portals are converted to their
+// punycode form. Portals that are not valid domain names are omitted.
+func normalizePortals(portals []string) []string {
+	normalized := make([]string, 0, len(portals))
+	for _, portal := range portals {
+		portal = strings.ToLower(strings.TrimSpace(portal))
+		if portal == "" {
+			continue
+		}
+		if !isASCII(portal) {
+			var err error
+			portal, err = idna.Lookup.ToASCII(portal)
+			if err != nil {
+				continue
+			}
+		}
+		normalized = append(normalized, portal)
+	}
+	return normalized
+}
+
+// isASCII is a helper function that returns true if the given string only
+// contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPortal is a helper function that returns the portal of the given ones
+// the given host equals or is a subdomain of, it returns an empty string if
+// the host does not belong to any of the portals.
+func matchPortal(host string, portals []string) string {
+	for _, portal := range portals {
+		portal = strings.ToLower(strings.TrimSpace(portal))
+		if portal == "" {
+			continue
+		}
+		if host == portal || strings.HasSuffix(host, "."+portal) {
+			return portal
+		}
+	}
+	return ""
+}
+
+// newSkylinkExtractor returns the function that extracts skylinks for the
+// given extraction mode. In precision mode only skylinks in links to the given
+// portals are extracted, in recall mode anything that plausibly is a skylink is
+// extracted. The given IDN mode only applies to the precision mode.
+func newSkylinkExtractor(mode string, portals []string, idnMode string) func(input []byte) []string {
+	if mode == ExtractionModePrecision {
+		return func(input []byte) []string {
+			return extractPortalSkylinks(input, portals, idnMode)
+		}
+	}
+	return extractSkylinks
+}
+
+// extractReporterOrg is a helper function that returns the organization for the
+// given email address by looking up its domain in the given map of known
+// organizations. Subdomains resolve to the organization of their parent domain,
+// e.g. cert.switch.ch resolves to the organization registered for switch.ch.
+func extractReporterOrg(address string, orgs map[string]string) string {
+	if len(orgs) == 0 {
+		return ""
+	}
+
+	// extract the domain from the address
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return ""
+	}
+	domain := strings.ToLower(strings.Trim(address[at+1:], " >"))
+
+	// walk up the domain until we find a match
+	for domain != "" {
+		if org, exists := orgs[domain]; exists {
+			return org
+		}
+		dot := strings.Index(domain, ".")
+		if dot == -1 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return ""
 }
 
 // extractSkyTransferURLs is a helper function that extracts all skytransfer
-// URLs from the given byte slice.
+// URLs from the given byte slice, links are refanged before they are matched.
 func extractSkyTransferURLs(input []byte, logger *logrus.Logger) []string {
 	var skyTransferURLs []string
 
 	// range over the string line by line and extract potential skylinks
-	sc := bufio.NewScanner(bytes.NewBuffer(input))
-	for sc.Scan() {
-		for _, matches := range extractSkytransferURL.FindAllStringSubmatch(sc.Text(), -1) {
+	for _, line := range utils.NormalizeLines(input) {
+		for _, matches := range extractSkytransferURL.FindAllStringSubmatch(utils.Refang(line), -1) {
 			for _, match := range matches {
-				match = utils.SanitizeURL(match)
-				_, err := url.ParseRequestURI(match)
+				skyTransferURL, err := utils.SanitizeURLStrict(match, false)
 				if err != nil {
 					logger.Debugf("matched skytransfer URL '%v' but was invalid, err '%v'", match, err)
 					continue
 				}
-				skyTransferURLs = append(skyTransferURLs, match)
+				skyTransferURLs = append(skyTransferURLs, skyTransferURL)
 			}
 		}
 	}
@@ -452,6 +1207,136 @@ func extractSkyTransferURLs(input []byte, logger *logrus.Logger) []string {
 	return dedupe(skyTransferURLs)
 }
 
+// detectTagConflict is a helper function that checks whether any of the given
+// tags is a conflict tag while the body matches one of the given patterns,
+// which suggests the email discusses abuse rather than reports it. It returns
+// the reason of the conflict, or an empty string if there's no conflict.
+func detectTagConflict(body []byte, tags, conflictTags []string, patterns []*regexp.Regexp) string {
+	var conflicting []string
+	for _, tag := range tags {
+		for _, conflictTag := range conflictTags {
+			if tag == conflictTag {
+				conflicting = append(conflicting, tag)
+				break
+			}
+		}
+	}
+	if len(conflicting) == 0 {
+		return ""
+	}
+
+	// remove quoted-printable soft line breaks, they might split a pattern
+	body = unwrapQuotedPrintable(body)
+	for _, pattern := range patterns {
+		if pattern.Match(body) {
+			return fmt.Sprintf("tags %v conflict with pattern '%v'", strings.Join(conflicting, ","), pattern)
+		}
+	}
+	return ""
+}
+
+// detectLowConfidence is a helper function that returns true if the given
+// skylinks were parsed with low confidence. That is the case if no tags were
+// found in the email, other than the default tag, and none of the skylinks was
+// found in a link, meaning they were only picked up as loose tokens by the
+// loosest extraction regex.
+func detectLowConfidence(body []byte, skylinks []string, sources map[string]string, tags []string) bool {
+	if len(skylinks) == 0 {
+		return false
+	}
+	for _, tag := range tags {
+		if tag != database.AbuseDefaultTag {
+			return false
+		}
+	}
+
+	// skylinks from evidence documents, short URLs and SkyTransfer URLs are
+	// always linked
+	for _, skylink := range skylinks {
+		source := sources[skylink]
+		if source == database.SkylinkSourceEvidence || source == database.SkylinkSourceShortener || source == database.SkylinkSourceSkyTransfer {
+			return false
+		}
+	}
+
+	// remove quoted-printable soft line breaks, they might split a link
+	linked := make(map[string]struct{})
+	for _, skylink := range extractLinkedSkylinks(unwrapQuotedPrintable(body)) {
+		linked[skylink] = struct{}{}
+	}
+	for _, skylink := range skylinks {
+		if _, exists := linked[skylink]; exists {
+			return false
+		}
+	}
+	return true
+}
+
+// detectPortal is a helper function that returns the URL, of the given portal
+// URLs, of the portal the skylinks in the given body were reported on. That is
+// the portal the first link in the body to one of the portals, or to one of
+// their subdomains, points to. Links are refanged before they are matched, and
+// internationalized hosts are handled according to the given IDN mode. It
+// returns an empty string if the body does not link to any of the portals.
+func detectPortal(body []byte, portalURLs []string, idnMode string) string {
+	portals := make([]string, 0, len(portalURLs))
+	urls := make(map[string]string)
+	for _, portalURL := range portalURLs {
+		u, err := url.Parse(portalURL)
+		if err != nil {
+			continue
+		}
+		normalized := normalizePortals([]string{u.Hostname()})
+		if len(normalized) == 0 {
+			continue
+		}
+		portal := normalized[0]
+		if _, exists := urls[portal]; !exists {
+			portals = append(portals, portal)
+			urls[portal] = portalURL
+		}
+	}
+	if len(portals) == 0 {
+		return ""
+	}
+
+	// remove quoted-printable soft line breaks, they might split a link
+	sc := bufio.NewScanner(bytes.NewBuffer(unwrapQuotedPrintable(body)))
+	for sc.Scan() {
+		line := utils.Refang(space.ReplaceAllString(sc.Text(), ""))
+		for _, match := range extractPortalLinkRE.FindAllStringSubmatch(line, -1) {
+			if portal := matchPortal(normalizeLinkHost(match[1], idnMode), portals); portal != "" {
+				return urls[portal]
+			}
+		}
+	}
+	return ""
+}
+
+// extractLinkedSkylinks is a helper function that extracts the skylinks that
+// are part of a link from the given input, links are refanged before they are
+// matched. Unlike extractSkylinks it ignores skylinks that are loose tokens.
+func extractLinkedSkylinks(input []byte) []string {
+	var maybeSkylinks []string
+
+	sc := bufio.NewScanner(bytes.NewBuffer(input))
+	for sc.Scan() {
+		line := utils.Refang(space.ReplaceAllString(sc.Text(), ""))
+		for _, matches := range append(
+			extractPathSkylinks64(line),
+			extractSkylink32RE.FindAllStringSubmatch(line, -1)...,
+		) {
+			for _, match := range matches {
+				if validateSkylink64RE.MatchString(match) || validateSkylink32RE.MatchString(match) {
+					maybeSkylinks = append(maybeSkylinks, match)
+				}
+			}
+		}
+	}
+
+	return dedupe(loadSkylinks(maybeSkylinks))
+}
+
 // extract tags is a helper function that extracts a set of tags from the given
 // input
 func extractTags(input []byte) []string {
@@ -487,10 +1372,21 @@ func extractTags(input []byte) []string {
 
 // extractTextFromHTML is a helper function that parses the given email body,
 // which is expected to contain valid HTML, and returns the contents of all text
-// nodes as a string.
+// nodes as a string. The contents of the elements in htmlBoundaryElements are
+// put on separate lines, and the whitespace within <pre> blocks is preserved.
 func extractTextFromHTML(r io.Reader) (string, error) {
+	// read the HTML and remove any quoted-printable soft line breaks, these
+	// might split URLs in attributes as well as in the text
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	raw = unwrapQuotedPrintable(raw)
+
 	var text []string
-	tokenizer := html.NewTokenizer(r)
+	var links []string
+	var preDepth int
+	tokenizer := html.NewTokenizer(bytes.NewReader(raw))
 	for {
 		tt := tokenizer.Next()
 		if tt == html.ErrorToken {
@@ -499,34 +1395,159 @@ func extractTextFromHTML(r io.Reader) (string, error) {
 			}
 			return "", tokenizer.Err()
 		}
+		token := tokenizer.Token()
 
 		if tt == html.TextToken {
-			text = append(text, strings.TrimSpace(tokenizer.Token().Data))
+			if preDepth > 0 {
+				text = append(text, token.Data)
+			} else {
+				text = append(text, strings.TrimSpace(token.Data))
+			}
+			continue
+		}
+		if tt != html.StartTagToken && tt != html.EndTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		// separate the contents of block-level elements from the text
+		// around them
+		if _, boundary := htmlBoundaryElements[token.Data]; boundary {
+			text = append(text, "\n")
+		}
+		if token.Data == "pre" {
+			switch {
+			case tt == html.StartTagToken:
+				preDepth++
+			case tt == html.EndTagToken && preDepth > 0:
+				preDepth--
+			}
+		}
+
+		// collect the link targets that contain a skylink, the link text
+		// does not necessarily contain the skylink
+		for _, attr := range token.Attr {
+			if attr.Key == "href" && isSkylinkURL(attr.Val) {
+				links = append(links, strings.TrimSpace(attr.Val))
+			}
 		}
 	}
 
+	// append the links on separate lines so they're not glued to the text
+	if len(links) > 0 {
+		text = append(text, "\n"+strings.Join(links, "\n"))
+	}
 	return strings.Join(text, ""), nil
 }
 
+// isSkylinkURL is a helper function that returns true if the given URL
+// contains a skylink as one of its path segments or as one of the labels of
+// its host, or if one of its query parameters is such a URL, which is how
+// link rewriters wrap links. This is stricter than the skylink extraction,
+// which avoids picking up false positives from tracking links.
+func isSkylinkURL(link string) bool {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return false
+	}
+	if _, ok := skylink.FromURL(u.String()); ok {
+		return true
+	}
+	for _, values := range u.Query() {
+		for _, value := range values {
+			if strings.Contains(value, "://") && isSkylinkURL(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unwrapQuotedPrintable is a helper function that removes the quoted-printable
+// soft line breaks from the given input, which reassembles lines that were
+// wrapped by the sender but not decoded because the part was mislabeled.
+func unwrapQuotedPrintable(input []byte) []byte {
+	input = bytes.ReplaceAll(input, []byte("=\r\n"), nil)
+	return bytes.ReplaceAll(input, []byte("=\n"), nil)
+}
+
 // extractPortalFromHnsDomain is a helper function that extracts the portal from
-// a hns subdomain
+// a hns subdomain, an internationalized portal is returned in its punycode
+// form.
 func extractPortalFromHnsDomain(url string) string {
 	matches := extractPortalURL.FindStringSubmatch(url)
 	if len(matches) != 2 {
 		return ""
 	}
-	return matches[1]
+	if isASCII(matches[1]) {
+		return matches[1]
+	}
+	portal, err := idna.Lookup.ToASCII(matches[1])
+	if err != nil {
+		return ""
+	}
+	return portal
+}
+
+// resolveSkyTransferURLs will resolve the given SkyTransfer URLs to the skylinks
+// they point to. The stored resolutions of the URLs that were resolved before
+// are reused, the other URLs are resolved and their resolutions are stored.
+// Alongside all skylinks it returns the skylinks per SkyTransfer URL.
+func (p *Parser) resolveSkyTransferURLs(ctx context.Context, urls []string, logger *logrus.Logger) ([]string, map[string][]string, error) {
+	// look up the stored resolutions, if that fails we resolve all URLs
+	since := time.Now().Add(-p.staticOptions.SkyTransferResolutionMaxAge)
+	stored, err := p.staticDatabase.FindSkyTransferResolutions(urls, since)
+	if err != nil {
+		logger.Errorf("failed to look up the stored skytransfer resolutions, err %v", err)
+	}
+	var skylinks, unresolved []string
+	urlSkylinks := make(map[string][]string)
+	for _, url := range urls {
+		resolution, exists := stored[url]
+		if !exists {
+			unresolved = append(unresolved, url)
+			continue
+		}
+		logger.Debugf("reusing the resolution of skytransfer URL %v from %v", url, resolution.ResolvedAt)
+		skylinks = append(skylinks, resolution.Skylinks...)
+		urlSkylinks[url] = resolution.Skylinks
+	}
+	if len(unresolved) == 0 {
+		return dedupe(skylinks), urlSkylinks, nil
+	}
+
+	// resolve the other URLs
+	resolved, resolutions, err := p.staticResolveSkyTransferURLs(ctx, unresolved, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// store the resolutions, failing to do so only means the URLs get
+	// resolved again if they are reported again
+	for url, resolution := range resolutions {
+		urlSkylinks[url] = resolution
+		err = p.staticDatabase.UpsertSkyTransferResolution(database.SkyTransferResolution{
+			URL:        url,
+			Skylinks:   resolution,
+			ResolvedAt: time.Now().UTC(),
+			ResolvedBy: p.staticServerDomain,
+		})
+		if err != nil {
+			logger.Errorf("failed to store the resolution of skytransfer URL %v, err %v", url, err)
+		}
+	}
+	return dedupe(append(skylinks, resolved...)), urlSkylinks, nil
 }
 
 // resolveSkyTransferURLs takes a set of skytransfer URLs and attempts to
-// resolve them to the underlying skylink
-func resolveSkyTransferURLs(urls []string, logger *logrus.Logger) ([]string, error) {
+// resolve them to the underlying skylink. Alongside all skylinks found in the
+// output of the resolver, it returns the skylinks per SkyTransfer URL.
+func resolveSkyTransferURLs(ctx context.Context, urls []string, logger *logrus.Logger) ([]string, map[string][]string, error) {
 	logger.Debugf("resolving %v skytransfer.hns URLs\n", len(urls))
 
 	// prepare a tmp dir
 	dir, err := ioutil.TempDir(os.TempDir(), "abuse-scanner-skytransfer-resolve-")
 	if err != nil {
-		return nil, errors.AddContext(err, "could not create temporary directory")
+		return nil, nil, errors.AddContext(err, "could not create temporary directory")
 	}
 
 	logger.Debugf("generating tmp directory %v", dir)
@@ -535,32 +1556,87 @@ func resolveSkyTransferURLs(urls []string, logger *logrus.Logger) ([]string, err
 	// write cypress config to disk
 	err = writeCypressConfig(dir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// write cypress tests to disk
 	err = writeCypressTests(dir, urls, logger)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	cmd := exec.Command("docker", "run", "-v", fmt.Sprintf("%v:/e2e", dir), "-w", "/e2e", "cypress/included:10.3.0") //nolint:gosec
+	cmd := exec.CommandContext(ctx, "docker", "run", "-v", fmt.Sprintf("%v:/e2e", dir), "-w", "/e2e", "cypress/included:10.3.0") //nolint:gosec
 	logger.Debugf("executing cmd %v", cmd.String())
+
+	// run cypress
+	out, err := runCypress(cmd)
+	if err != nil {
+		logger.Debugf(err.Error())
+		return nil, nil, err
+	}
+
+	// extract the skylinks from the output
+	return extractSkylinks(out), parseSkyTransferResolutions(out), nil
+}
+
+// parseSkyTransferResolutions is a helper function that parses the lines the
+// cypress tests log for every resolved SkyTransfer URL from the given output,
+// it returns the skylinks per SkyTransfer URL.
+func parseSkyTransferResolutions(out []byte) map[string][]string {
+	resolutions := make(map[string][]string)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		i := strings.Index(line, skyTransferResolutionMarker+" ")
+		if i == -1 {
+			continue
+		}
+		fields := strings.Fields(line[i+len(skyTransferResolutionMarker):])
+		if len(fields) != 2 {
+			continue
+		}
+		skylinks := extractSkylinks([]byte(fields[1]))
+		if len(skylinks) > 0 {
+			resolutions[fields[0]] = dedupe(append(resolutions[fields[0]], skylinks...))
+		}
+	}
+	return resolutions
+}
+
+// runCypress runs the given cypress command and returns its output. If the
+// command fails it returns a resolutionError that contains the bounded output
+// of the command. This is extracted in a standalone function for unit testing
+// purposes.
+func runCypress(cmd *exec.Cmd) ([]byte, error) {
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
 
-	// run cypress
-	err = cmd.Run()
+	err := cmd.Run()
 	if err != nil {
-		msg := fmt.Sprintf("failed running cypress tests, err %v, stderr %v, stdout %v", err, stderr.String(), out.String())
-		logger.Debugf(msg)
-		return nil, errors.New(msg)
+		return nil, resolutionError{
+			staticErr: err,
+			staticLog: buildResolutionLog(out.Bytes(), stderr.Bytes()),
+		}
 	}
+	return out.Bytes(), nil
+}
 
-	// extract the skylinks from the output
-	return extractSkylinks(out.Bytes()), nil
+// buildResolutionLog combines the given stdout and stderr of the cypress
+// command into a single log. If the log exceeds maxResolutionLogSize, only its
+// tail is kept as that is where cypress reports the failure.
+func buildResolutionLog(stdout, stderr []byte) string {
+	log := fmt.Sprintf("stdout:\n%s\nstderr:\n%s", stdout, stderr)
+	if len(log) > maxResolutionLogSize {
+		log = "...(truncated)\n" + log[len(log)-maxResolutionLogSize:]
+	}
+	return strings.ToValidUTF8(log, "")
+}
+
+// Error implements the error interface.
+func (err resolutionError) Error() string {
+	return fmt.Sprintf("failed running cypress tests, err %v, output %v", err.staticErr, err.staticLog)
 }
 
 // writeCypressConfig writes the required cypress configuration to the given directory
@@ -590,7 +1666,7 @@ func writeCypressTests(dir string, urls []string, logger *logrus.Logger) error {
 		sb.WriteString(fmt.Sprintf("    cy.visit('%v');\n", url))
 		sb.WriteString(fmt.Sprintf("    cy.intercept('https://%v/*').as('myReq');\n", portal))
 		sb.WriteString("    cy.get('.ant-btn').contains('Download all files').click();\n")
-		sb.WriteString("    cy.wait('@myReq').should(($obj) => {cy.task('log', $obj.request.url)});\n")
+		sb.WriteString(fmt.Sprintf("    cy.wait('@myReq').should(($obj) => {cy.task('log', '%v %v ' + $obj.request.url)});\n", skyTransferResolutionMarker, url))
 		sb.WriteString("    cy.wait(30000);\n")
 		sb.WriteString("  })\n")
 	}
@@ -613,6 +1689,17 @@ func writeCypressTests(dir string, urls []string, logger *logrus.Logger) error {
 	return errors.AddContext(err, "could not write cypress tests file")
 }
 
+// splitHeader is a helper function that splits the given raw message into its
+// header and its body, the header is empty if the message has no header.
+func splitHeader(raw []byte) ([]byte, []byte) {
+	for _, sep := range [][]byte{[]byte("\r\n\r\n"), []byte("\n\n")} {
+		if i := bytes.Index(raw, sep); i != -1 {
+			return raw[:i], raw[i:]
+		}
+	}
+	return nil, raw
+}
+
 // shouldParseMediaType is a helper function that returns true if the given
 // media type is one that we should parse
 func shouldParseMediaType(mediaType string) bool {
@@ -2,10 +2,17 @@ package email
 
 import (
 	"abuse-scanner/database"
+	"abuse-scanner/email/testhelpers"
+	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
+	"net/mail"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
@@ -20,150 +27,100 @@ import (
 var (
 	// exampleBody is an example body of an abuse email as it gets reported by a
 	// provider, the Skylinks in the examples are scrambled and not real.
-	exampleBody = []byte(`
-	X-UI-Out-Filterresults: notjunk:1;V03:K0:sQbC5Bf/7VA=:BVBvnd1QjaGT0MiZL1Ho9A
-	 IfQpxAOa2PG7BhMwdjkSKRkIi/0Xi320ptoRVrfdAAfeBr+OlbE7g1lSC70AY1aq/+Fpbv4wK
-	 3w2N9ynN89sZ8DCaJdB7ly3XgvTsG63gsWdX8Qx0neby0Ej1pajsGSgib3Zm8tezcKH7kM+uH
-	 8vULEwVR983S1CyJCBaD2LqZ2TmObmdS+5OJ/edFn2tq2WoPNrpgdm2AFO0gTOwQJ7h7ZG7Cw
-	 C51GLljzSwED8mirSv3crcZeIBAS1Id6HFLPoaPWp4PveU/v0K8KtULYo7z19AK6hQgwViBiU
-	 Xq2l7J/I405Ww4d83HRzSQk5RYrUot3RK7Z1kuWHlS2xZrnuwbD/O/2jZ1wqm8ODWogMHSGkU
-	 I98W13ylJ0OsjeGFO+nsutUv3MjInhjUV3BBvOsnOMPOEOB6O6XEm1wr4UtjHcc9NUBPBvNh9
-	 H+gscpw0FrvBbZa+9XSyucw0nXv8ux6AcRDIkceD/k7QPuQ9qF7tieTcu08DuYDQn9NyBefCl
-	 RgFTNK0mc/IGzqsAmjjLJjN3Or8ZFb9AGX4Km12EJu5AVmgaX8HWNy7TkwU/G/8fRhwNm1MZA
-	 tvKIzaih0+MQ3vhyhX68w4FaCyw03DtqUuXiWc/B+ieWBognxojBZW8fnl6gh1JAtvlo0LKQp
-	 GMyXa9CB0//7vKj4QzhelXKBJJgYM8711kf0IFnD84KydbfFnV0LupfaJ57SHxX6EQpsO8YE5
-	 Q3y3pDDyLVRM6fCl4EjRAoVRJTN+cWfVrqR2XbR8PzsEhgLpvc0oqDoNuLLFLc9tNZyVRm+3M
-	 NDkpXctNC4+MD8zqzyiDiRUOZ27w9qeZqUIEqMlbnpmYnILxrfZL8A5WXYajQ5BDUYi1oMT4W
-	 UT47J3cxaP66B+03lzJqMDPAxGGzBoH4buNH0ku66gi0xcmhQtBcWhfDsGM9V9RSXeG/2FmHI
-	 i4y3714s6I4zN5G7Fr7EPgg61IkFB+swtoo1O5WrNJ+jFWe5nIsCXWCinXRZgaD4Q2/+57VP5
-	 idJHzNoSCPhRv6mwO/9+ia/4pVxgU8wVX6huAHRsFD2WkmpU42jsBGiWOwFj43HTwPuBxfBH9
-	 VhQDFA5VMxSpI+4TBiXX9ZYWqnKGpBoBtfKDHqGxF5C1JqWv2xMsiUD9c43po1Z9SsfBEC2A5
-	 cfV/KfZ5odL68cjZ0s7OQXt36o
-
-	Hello,
-
-	Please be informed that we have located another phishing content located at the following URLs:
-
-	hxxps:// siasky [.] net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g
-	hxxps:// siasky [.] net/nAA_hbtNaOYyR2WrM9UNIc5jRu4WfGy5QK_iTGosDgLmSA#info@jwmarine [.] com [.] au
-	hxxps:// siasky [.] net/CADEnmNNR6arnyDSH60MlGjQK5O3Sv-ecK1PGt3MNmQUhA#apg@franklinbank [.] com
-	hxxps:// siasky [.] net/GABJJhT8AlfNh-XS-6YVH8en7O-t377ej9XS2eclnv2yFg
-
-	https:// siasky [.]netAAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg
-	BBBg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg
-
-	As a reminder, phishing is expressly prohibited by our Universal Terms of Service Agreement, paragraph 7. "Acceptable Use Policy (AUP)"
-	`)
+	exampleBody = testhelpers.MustLoadEmail("example")
 
 	// exampleSkyTransferBody is an example body of an abuse email, as it gets
 	// reported by a provider, that contains a skytransfer URL.
-	exampleSkyTransferBody = []byte(`
-I again affirm that the link below contains material distributed illegally, WITHOUT MY authorization. Thus, I request the immediate removal of the 02 links:
+	exampleSkyTransferBody = testhelpers.MustLoadEmail("skytransfer")
 
-https://skytransfer.hns.siasky.net/#/v2/d871327aa70cd7525a3a323bf15896ea192da03254856602c0f030baeea8da8a/12a75f63a2cc182905731d68e9211d7d828f38e1203ff210c060d2eee81e6ff92b1fc48dfbf8649ab9b20b332780544626d83822621d63a44a187a90321bdf6a
-
-My original product links:
-	`)
+	// htmlBlocksBody is an example HTML body that lists the skylinks in a
+	// <pre> block and a table, without any whitespace between the elements,
+	// concatenating the text of the elements corrupts the skylinks.
+	htmlBlocksBody = string(testhelpers.MustLoadEmail("html_blocks"))
 
 	// htmlBody is an example body of an (actual) abuse email that contains
 	// HTML, the Skylinks in the examples are scrambled and not real.
-	htmlBody = `<html><head></head><body><p><span style="color: #808080;">&mdash;-&mdash;-&mdash;-&mdash;</span></p>
-	<p><span style="color: #808080;">Please reply above this line</span></p>
-	<p>&nbsp;</p>
-	<p>Hostkey Abuse Team commented:</p>
-	<p>      </p><p></p><p>Dear Client,</p><p>We have received a phishing complaint regarding your server with IP-address XXXXXX. <br />
-	Please remove the fraudulent content within the next 24 hours or we will have to consider blocking this address.</p><p>Thank you for understanding in that matter.</p><p>The original message of the complaint is presented below.</p><p> </p><p>Dear network operator,</p><p>SWITCH-CERT has been made aware of a phishing attack against ZHDK under the following URL(s):</p><p>hXXps://siasky<span class="error">[.]</span>net/CAA0F6NzigGep-VM6sJGewvHC6pZ2sJYTIVRsDYA4_QUVA#hs.admin@zhdk<span class="error">[.]</span>ch</p><p>The pages are intended for criminal purposes and may cause considerable damage to third parties including,<br />
-	but not limited to, fraudulent financial transactions and identity theft. To demonstrate the fraudulent<br />
-	intent of the websites, we have attached screenshots of the offending sites to this mail whenever possible.</p><p>The URL(s) and/or IP(s) mentioned above belong to your constituency which is why we have contacted you<br />
-	to help us with the appropriate actions to solve this issue. We would greatly appreciate your assistance<br />
-	in removing this content as soon as possible.</p><p>If you are not the correct person to be dealing with this incident, or there is a better way for us to<br />
-	report this incident, please let us know. You are free to pass this information on to other trusted<br />
-	parties (e.g. law enforcement), as you see fit.</p><p>Many thanks for your prompt attention to this matter. Please do not hesitate to get in touch with us<br />
-	under the email address cert@switch.ch when the site has been cleaned, and we will remove your site<br />
-	from our blacklist.</p><p>Kind Regards,</p><p>SWITCH-CERT</p><p>–<br />
-	SWITCH-CERT<br />
-	SWITCH, Werdstrasse 2, P.O. Box, 8021 Zurich, Switzerland<br />
-	incident phone +41 44 268 15 40<br />
-	<a href="https://r.relay.hostkey.com/tr/cl/dH8SAQr2PfuM9z2U69X3RU4lOXxLfUvBy-PoYz0i9xaU-qfb2ba8nHjnhjGmQJWvlh1RGqVuG5GRLOEjdLptEXfwTtQZwuZ-Ktri0FbnaNv4Qsq1IwvuKJBMJPPKrCqws00fZWfF5a6L27KGJyhOZ6z2sz5u3gTAI6c1Ngfuxits8DbOEwdXd35Mw2zhzPWS0bGe_PpfRvgPbv31wAxUs0MZP0eCDcrq">http://www.switch.ch/security</a></p>
-	  <img width="1" height="1" src="https://r.relay.hostkey.com/tr/op/aAMIbWQvCFUFW51yPO-mQwWdaGyPuvXUgRReI7L4Jg-v7wCrnpIWymrHdlMYdd5M6LNIEo-fcd6kxcD5KftPakp-3NrW3Z-dvYZ_KX54q8f5897S0HES-iPqJF3-uPx30Gu15Nax8rj16DaAgWW8eKHmKEZAGhMltg" alt="" /></body></html>
-	`
-
-	// contentTypeBody is an example email body that uses a bunch of different
-	// content types to ensure in testing we parse those parts of the email body
-	// properly
-	contentTypeBody = `Delivered-To: report@siasky.net
-Received: by 2002:a05:7000:a1a:0:0:0:0 with SMTP id ke26csp576371mab;
-        Sun, 26 Jun 2022 23:29:59 -0700 (PDT)
-Date: Mon, 27 Jun 2022 09:29:55 +0300
-From: =obfuscated<phishing@obfuscated.com>
-To: response@cert-gib.ru, abuse@namecheap.com, abuse@siasky.net
-Subject: [Ticket#22062706295325258] Phishing site
-MIME-Version: 1.0
-Content-Type: multipart/mixed; 
-        boundary="----=_Part_71086_603584994.1656311395405"
-
-------=_Part_71086_603584994.1656311395405
-Content-Type: multipart/alternative; 
-        boundary="----=_Part_71087_1111859740.1656311395408"
-
-------=_Part_71087_1111859740.1656311395408
-Content-Type: text/plain; charset=utf-8
-Content-Transfer-Encoding: quoted-printable
-
-Hi,
-=EF=BB=BF
-The bad news is you are hosting a phishing site:
-https://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA#abuse%40y=
-andex.ru
-
-The good news is that now that you know about this scam you can stop it. Pl=
-ease shut this site down.
-
-It would also help us greatly to prevent any phishing activity in the futur=
-e, if you could provide us with the source code of this site and any data t=
-hat has already been stolen so that we could use them for analysis.
-
-------=_Part_71087_1111859740.1656311395408
-Content-Type: text/html; charset=utf-8
-Content-Transfer-Encoding: 7bit
-
-<p>Hi,<br />&#xfeff;<br />The bad news is you are hosting a phishing site:<br /><a href="https://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA#abuse%obfuscated.ru" rel="nofollow">https://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA#abuse%40yandex.ru</a></p><br /><p>The good news is that now that you know about this scam you can stop it. Please shut this site down.</p><br /><p>It would also help us greatly to prevent any phishing activity in the future, if you could provide us with the source code of this site and any data that has already been stolen so that we could use them for analysis.</p><br /><p>--<br /><a href="https://forms.yandex.ru/surveys/10012037/?theme&#61;support-vote&amp;iframe&#61;1&amp;lang&#61;en&amp;session&#61;a20d99e6-2969-3f30-a04f-1a1b6935c3b8" rel="nofollow">Please rate our reply</a></p><br /><p>Some One<br />Support team<br /><a href="https://obfuscated.com/support/" rel="nofollow">https://obfuscated.com/support/</a></p>
-------=_Part_71087_1111859740.1656311395408--
-
-------=_Part_71086_603584994.1656311395405
-Content-Type: application/octet-stream; name=image.png
-Content-Transfer-Encoding: base64
-Content-Disposition: attachment; filename=image.png
-
-iVBORw0KGgoAAAANSUhEUgAAB4AAAAPtCAIAAADg5eUGAAAgAElEQVR4nOzd+7ddZX0/+vwFhJ/6
-BADCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanAqq1oQSOZXa4le09KsIiFzUEUPFfgvV
-QIJRAW1FTUyC7HCNkgDJPs/ec+25522t9ay911xz7vB6jc/Ateea81nPXLexfe8nn7ng6KNO7l3H
-------=_Part_71086_603584994.1656311395405
-
-------=_Part_71086_603584994.1656311395405
-Content-Type: image/png
-Content-Transfer-Encoding: base64
-Content-ID: <6B7613EB-E52E-44C0-9A21-DC3B25738265>
-Content-Disposition: inline; filename="Screenshot 2022-06-21 at 10.59.37.png"
-
-------=_Part_71086_603584994.1656311395405--`
-
-	// unknownCharsetBody is an example body that uses a character set that is
-	// not supported by default
-	unknownCharsetBody = `Received: by 2002:a05:7000:ae16:0:0:0:0 with SMTP id ij22csp429885mab;
-	Thu, 31 Mar 2022 01:17:25 -0700 (PDT)
-Content-Type: text/plain; charset="iso-8859-1"
-MIME-Version: 1.0
-Content-Transfer-Encoding: quoted-printable
-Content-Description: Mail message body
-Subject: Obfuscated
-To: "Some User" <obfuscated@unknown.com>
-From: "Some User" <obfuscated@unknown.com>
-Date: Thu, 31 Mar 2022 09:16:57 +0100
-
-Hi,
-phishing link found
-https://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA`
+	htmlBody = string(testhelpers.MustLoadEmail("html_hostkey"))
+
+	// softWrappedHTMLBody is an example email body where the skylink in the
+	// href of the HTML part is soft-wrapped using quoted-printable encoding,
+	// while the link text does not contain the skylink
+	softWrappedHTMLBody = "Subject: Phishing\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"boundary\"\r\n" +
+		"\r\n" +
+		"--boundary\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>=EF=BB=BFThe bad news is you are hosting a <a href=3D\"https://siasky.net/BACCHn5eHow5edoimjiwBtD2E=\r\n" +
+		"rM3OL57mf-_MghKeebanA#abuse\" rel=3D\"nofollow\">phishing site</a></p>\r\n" +
+		"--boundary--"
+
+	// relayWrappedBody is an example email body where the links to the
+	// skylinks were rewritten by link rewriters, the href of the HTML part
+	// points to a relay that wraps a Google redirect, the link in the text
+	// part is wrapped by Outlook's Safe Links
+	relayWrappedBody = "Subject: Phishing\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"boundary\"\r\n" +
+		"\r\n" +
+		"--boundary\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"The bad news is you are hosting a phishing site: https://eur02.safelinks.protection.outlook.com/?url=https%3A%2F%2Fskyportal.xyz%2FGAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g%2F&data=05%7C01%7Cabuse%40example.com&reserved=0\r\n" +
+		"--boundary\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p>The bad news is you are hosting a <a href=\"https://r.relay.example.com/tr/cl?id=dH8SAQr2PfuM9z2U&amp;url=https%3A%2F%2Fwww.google.com%2Furl%3Fq%3Dhttps%253A%252F%252Fsiasky.net%252FBACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA%26sa%3DD\">phishing site</a></p>\r\n" +
+		"--boundary--"
+
+	// secondaryPortalBody is an example email body that reports a skylink on a
+	// secondary portal, the body also mentions the primary portal, but only
+	// after the defanged link to the secondary one
+	secondaryPortalBody = []byte(`Subject: CSAM on your portal
+From: reporter@example.com
+
+Hello,
+
+the following content was found on your network:
+hxxps:// eu.skyportal [.] xyz/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g
+
+Please refer to https://siasky.net/terms.pdf for your own terms.`)
+
+	// base64Body is an example of a single-part body that is base64 encoded,
+	// the decoded body contains a skylink and the phishing tag
+	base64Body = "Subject: Abuse report\r\n" +
+		"From: reporter@example.com\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"SGVsbG8sDQoNCnBsZWFzZSB0YWtlIGRvd24gdGhlIGZvbGxvd2luZyBwaGlzaGluZyBwYWdlOg0K\r\n" +
+		"DQpodHRwczovL3NpYXNreS5uZXQvQkFDQ0huNWVIb3c1ZWRvaW1qaXdCdEQyRXJNM09MNTdtZi1f\r\n" +
+		"TWdoS2VlYmFuQQ0KDQpLaW5kIHJlZ2FyZHMNCg==\r\n"
+
+	// slowBody is an example of a multipart body of which every part holds a
+	// skylink and is marked as slow, the slow extractor takes a while to
+	// extract the skylinks from every part
+	slowBody = "Subject: Abuse report\r\n" +
+		"From: reporter@example.com\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"slow\"\r\n" +
+		"\r\n" +
+		"--slow\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"SLOW phishing https://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA\r\n" +
+		"--slow\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"SLOW https://siasky.net/CABbGpIwkPL0WDkiHUt5iMlWK-u5RYmdwsKuUY-TGyC9hw\r\n" +
+		"--slow\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"SLOW malware https://siasky.net/AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg\r\n" +
+		"--slow--\r\n"
 )
 
 // TestParser is a collection of unit tests that probe the functionality of
@@ -176,19 +133,95 @@ func TestParser(t *testing.T) {
 
 	t.Run("BuildAbuseReport", testBuildAbuseReport)
 	t.Run("Dedupe", testDedupe)
+	t.Run("DetectLowConfidence", testDetectLowConfidence)
+	t.Run("DetectPortal", testDetectPortal)
+	t.Run("DetectTagConflict", testDetectTagConflict)
 	t.Run("ExtractPortalFromHnsDomain", testExtractPortalFromHnsDomain)
+	t.Run("ExtractReporterOrg", testExtractReporterOrg)
 	t.Run("ExtractSkyTransferURLs", testExtractSkyTransferURLs)
 	t.Run("ExtractSkylinks", testExtractSkylinks)
+	t.Run("ExtractionModes", testExtractionModes)
 	t.Run("ExtractTags", testExtractTags)
 	t.Run("ExtractTextFromHTML", testExtractTextFromHTML)
+	t.Run("IDNHosts", testIDNHosts)
+	t.Run("MailboxTags", testMailboxTags)
 	t.Run("ParseBody", testParseBody)
+	t.Run("ParseBodyBase64", testParseBodyBase64)
+	t.Run("ParseBodyRelayWrapped", testParseBodyRelayWrapped)
 	t.Run("ParseBodySkyTransfer", testParseBodySkyTransfer)
+	t.Run("ParseBodySkyTransferURLs", testParseBodySkyTransferURLs)
+	t.Run("ParseBodySkylinkSources", testParseBodySkylinkSources)
+	t.Run("ParseBodySoftWrappedHTML", testParseBodySoftWrappedHTML)
+	t.Run("ParseBodyTimeout", testParseBodyTimeout)
+	t.Run("ParseTimeout", testParseTimeout)
+	t.Run("ParseSkyTransferResolutions", testParseSkyTransferResolutions)
+	t.Run("ResolutionLog", testResolutionLog)
+	t.Run("ResolveSkyTransferURLs", testResolveSkyTransferURLs)
 	t.Run("ShouldParseMediaType", testShouldParseMediaType)
 	t.Run("WriteCypressConfig", testWriteCypressConfig)
 	t.Run("WriteCypressTests", testWriteCypressTests)
 }
 
-// testParseBody is a unit test that covers the functionality of the parseBody helper
+// testMailboxTags verifies the emails from a mailbox that implies a tag receive
+// that tag, alongside the tags derived from their keywords.
+func testMailboxTags(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	parser := NewParser(context.Background(), nil, "dev.siasky.net", "somesponsor", ParserOptions{
+		MailboxTags: map[string]string{"csam": "csam"},
+	}, logger)
+
+	// assert an email from the csam mailbox receives the csam tag, even
+	// though none of its keywords match
+	email := newTestEmail()
+	email.Mailbox = "CSAM"
+	email.UID = "CSAM-1-1"
+	email.Body = []byte("Subject: Report\n\nHello,\n\nplease remove https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g\n")
+	report, _, err := parser.buildAbuseReport(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Tags, []string{"csam"}) {
+		t.Fatal("unexpected tags", report.Tags)
+	}
+
+	// assert the tag is merged with the keyword tags
+	email.Body = []byte("Subject: Report\n\nHello,\n\nplease remove the phishing page https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g\n")
+	report, _, err = parser.buildAbuseReport(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Tags, []string{"phishing", "csam"}) {
+		t.Fatal("unexpected tags", report.Tags)
+	}
+
+	// assert an email from another mailbox only receives the keyword tags
+	email.Mailbox = "INBOX"
+	email.UID = "INBOX-1-1"
+	report, _, err = parser.buildAbuseReport(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Tags, []string{"phishing"}) {
+		t.Fatal("unexpected tags", report.Tags)
+	}
+
+	// assert the mailbox tags are reloadable
+	parser.Reload(ParserOptions{MailboxTags: map[string]string{"inbox": "copyright"}})
+	report, _, err = parser.buildAbuseReport(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Tags, []string{"phishing", "copyright"}) {
+		t.Fatal("unexpected tags", report.Tags)
+	}
+}
+
+// testParseBody is a unit test that covers the functionality of the parseBody
+// helper, it parses every email in the golden email corpus and compares the
+// outcome to the expectations of the email.
 func testParseBody(t *testing.T) {
 	t.Parallel()
 
@@ -196,46 +229,392 @@ func testParseBody(t *testing.T) {
 	logger := logrus.New()
 	logger.Out = ioutil.Discard
 
-	// parse our example body with multipart content
-	skylinks, tags, err := parseBody([]byte(contentTypeBody), logger.WithField("module", "Parser"))
+	names, err := testhelpers.EmailFixtureNames()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(names) == 0 {
+		t.Fatal("no email fixtures found")
+	}
 
-	// assert we find the correct skylink and tag
-	if len(skylinks) != 1 {
-		t.Fatalf("unexpected amount of skylinks found, %v != 1", len(skylinks))
+	for _, name := range names {
+		fixture, err := testhelpers.LoadEmailFixture(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fixture.Expectations
+
+		skylinks, sources, _, tags, _, err := parseBody(context.Background(), fixture.Email(), extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		// assert we find the expected skylinks, in order, and tags
+		if len(skylinks) != len(expected.Skylinks) || (len(skylinks) > 0 && !reflect.DeepEqual(skylinks, expected.Skylinks)) {
+			t.Fatalf("%v: unexpected skylinks found, %v != %v", name, skylinks, expected.Skylinks)
+		}
+		if !reflect.DeepEqual(tags, expected.Tags) {
+			t.Fatalf("%v: unexpected tags found, %v != %v", name, tags, expected.Tags)
+		}
+
+		// assert we reply to the expected reporter
+		if reporter := fixtureReporter(fixture.Email()); reporter != expected.Reporter {
+			t.Fatalf("%v: unexpected reporter, %v != %v", name, reporter, expected.Reporter)
+		}
+
+		// assert the skylink in the email with multiple content types was
+		// attributed to the plain text part, which precedes the HTML part
+		if name == "content_types" && sources[skylinks[0]] != database.SkylinkSourceBody {
+			t.Fatal("unexpected skylink source", sources)
+		}
 	}
-	if skylinks[0] != "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA" {
-		t.Fatal("unexpected skylink found", skylinks[0])
+}
+
+// fixtureReporter is a helper function that returns the address we reply to
+// for the given raw email, it's empty if the email has no From or Reply-To
+// header.
+func fixtureReporter(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	address := func(key string) string {
+		parsed, err := mail.ParseAddress(msg.Header.Get(key))
+		if err != nil {
+			return ""
+		}
+		return parsed.Address
+	}
+	email := database.AbuseEmail{
+		From:    address("From"),
+		ReplyTo: address("Reply-To"),
 	}
+	return email.ReplyToEmail()
+}
 
-	if len(tags) != 1 {
-		t.Fatalf("unexpected amount of tags found, %v != 1", len(tags))
+// testParseBodyBase64 is a unit test that verifies parseBody decodes a
+// single-part body according to its content transfer encoding before it
+// extracts the skylinks and tags.
+func testParseBodyBase64(t *testing.T) {
+	t.Parallel()
+
+	// create discard logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	skylinks, sources, _, tags, _, err := parseBody(context.Background(), []byte(base64Body), extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if tags[0] != "phishing" {
-		t.Fatal("unexpected tag found", tags[0])
+
+	// assert we find the skylink in the decoded body and the tag
+	if len(skylinks) != 1 || skylinks[0] != "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA" {
+		t.Fatal("unexpected skylinks found", skylinks)
+	}
+	if sources[skylinks[0]] != database.SkylinkSourceBody {
+		t.Fatal("unexpected skylink source", sources)
+	}
+	if len(tags) != 1 || tags[0] != "phishing" {
+		t.Fatal("unexpected tags found", tags)
 	}
+}
+
+// testParseBodyRelayWrapped verifies the skylinks hidden behind links that
+// were rewritten by a link rewriter are extracted once the rewriter has a rule,
+// in both extraction modes.
+func testParseBodyRelayWrapped(t *testing.T) {
+	t.Parallel()
 
-	// parse our example body for unknown charsets
-	skylinks, tags, err = parseBody([]byte(unknownCharsetBody), logger.WithField("module", "Parser"))
+	// create discard logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	const htmlSkylink = "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"
+	const bodySkylink = "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"
+
+	// assert the skylinks are hidden without the unwrapper
+	skylinks, _, _, _, _, err := parseBody(context.Background(), []byte(relayWrappedBody), extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(skylinks) != 0 {
+		t.Fatal("unexpected skylinks found", skylinks)
+	}
 
-	// assert we find the correct skylink and tag
-	if len(skylinks) != 1 {
-		t.Fatalf("unexpected amount of skylinks found, %v != 1", len(skylinks))
+	// assert the default rules unwrap the Safe Links link, but not the relay
+	extract := newLinkUnwrapper(nil).WrapExtractor(extractSkylinks)
+	skylinks, _, _, _, _, err = parseBody(context.Background(), []byte(relayWrappedBody), extract, resolveUnstored, logger.WithField("module", "Parser"))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if skylinks[0] != "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA" {
-		t.Fatal("unexpected skylink found", skylinks[0])
+	if !reflect.DeepEqual(skylinks, []string{bodySkylink}) {
+		t.Fatal("unexpected skylinks found", skylinks)
 	}
 
-	if len(tags) != 1 {
-		t.Fatalf("unexpected amount of tags found, %v != 1", len(tags))
+	// assert the embedded skylink is extracted once the relay has a rule
+	rules := map[string]string{"r.relay.example.com": "url"}
+	for _, mode := range []string{ExtractionModeRecall, ExtractionModePrecision} {
+		extract := newLinkUnwrapper(rules).WrapExtractor(newSkylinkExtractor(mode, []string{"siasky.net", "skyportal.xyz"}, IDNModeNormalize))
+		skylinks, sources, _, _, _, err := parseBody(context.Background(), []byte(relayWrappedBody), extract, resolveUnstored, logger.WithField("module", "Parser"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(skylinks, []string{bodySkylink, htmlSkylink}) {
+			t.Fatal("unexpected skylinks found", mode, skylinks)
+		}
+		if sources[htmlSkylink] != database.SkylinkSourceHTML || sources[bodySkylink] != database.SkylinkSourceBody {
+			t.Fatal("unexpected skylink sources", mode, sources)
+		}
 	}
-	if tags[0] != "phishing" {
-		t.Fatal("unexpected tag found", tags[0])
+}
+
+// testParseBodySoftWrappedHTML is a unit test that verifies parseBody extracts
+// skylinks that are soft-wrapped inside of an href in quoted-printable HTML
+func testParseBodySoftWrappedHTML(t *testing.T) {
+	t.Parallel()
+
+	// create discard logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	const sl = "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"
+
+	// the HTML part is properly labeled, the simple HTML message is not
+	// multipart and the mislabeled part still contains the soft line break
+	// after decoding
+	mislabeled := strings.NewReplacer(
+		"quoted-printable", "7bit",
+		"=3D", "=",
+		"=EF=BB=BF", "",
+	).Replace(softWrappedHTMLBody)
+	simple := softWrappedHTMLBody[strings.Index(softWrappedHTMLBody, "Content-Type: text/html"):]
+	simple = strings.TrimSuffix(simple, "\r\n--boundary--")
+	simple = "Subject: Phishing\r\nMIME-Version: 1.0\r\n" + simple
+
+	for _, body := range []string{softWrappedHTMLBody, mislabeled, simple} {
+		skylinks, sources, _, _, _, err := parseBody(context.Background(), []byte(body), extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(skylinks) != 1 || skylinks[0] != sl {
+			t.Fatal("unexpected skylinks found", skylinks)
+		}
+		if sources[sl] != database.SkylinkSourceHTML {
+			t.Fatal("unexpected skylink source", sources)
+		}
+	}
+}
+
+// testParseBodyTimeout verifies parseBody stops parsing the remaining parts of
+// the body once its context is done, returning what it found so far.
+func testParseBodyTimeout(t *testing.T) {
+	t.Parallel()
+
+	// create discard logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// assert every skylink is found without a timeout
+	skylinks, _, _, tags, _, err := parseBody(context.Background(), []byte(slowBody), extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skylinks) != 3 || !reflect.DeepEqual(tags, []string{"phishing", "malware"}) {
+		t.Fatal("unexpected result", skylinks, tags)
+	}
+
+	// assert the third part is skipped, the timeout is exceeded while the
+	// second part is being parsed
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	skylinks, _, _, tags, _, err = parseBody(ctx, []byte(slowBody), newSlowExtractor(200*time.Millisecond), resolveUnstored, logger.WithField("module", "Parser"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA", "CABbGpIwkPL0WDkiHUt5iMlWK-u5RYmdwsKuUY-TGyC9hw"}
+	if !reflect.DeepEqual(skylinks, expected) || !reflect.DeepEqual(tags, []string{"phishing"}) {
+		t.Fatal("unexpected result", skylinks, tags)
+	}
+}
+
+// testParseTimeout verifies an email that exceeds the parse timeout is marked
+// as parsed with the skylinks that were found so far, and that the parser moves
+// on to the next email.
+func testParseTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create discard logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create test database
+	db, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, "testParseTimeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create a parser with a slow extractor
+	domain := "dev.siasky.net"
+	parser := NewParser(ctx, db, domain, "somesponsor", ParserOptions{
+		ParseTimeout: 300 * time.Millisecond,
+	}, logger)
+	parser.staticExtractSkylinks = newSlowExtractor(200 * time.Millisecond)
+
+	// insert a slow email and a regular one
+	for i, body := range [][]byte{[]byte(slowBody), exampleBody} {
+		err = db.InsertOne(database.AbuseEmail{
+			ID:         primitive.NewObjectID(),
+			UID:        fmt.Sprintf("INBOX-%d", i+1),
+			UIDRaw:     uint32(i + 1),
+			Body:       body,
+			From:       "someone@gmail.com",
+			Subject:    "Abuse Subject",
+			MessageID:  fmt.Sprintf("<msg_uid_%d>@gmail.com", i+1),
+			InsertedBy: domain,
+			InsertedAt: time.Now().UTC(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// parse the emails
+	parser.parseMessages()
+
+	// assert the slow email was parsed with partial results
+	slow, err := db.FindOne("INBOX-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slow.Parsed || !slow.ParseResult.ParseTimedOut {
+		t.Fatal("expected the email to be parsed with a timeout", slow.Parsed, slow.ParseResult)
+	}
+	if len(slow.ParseResult.Skylinks) != 2 {
+		t.Fatal("unexpected skylinks", slow.ParseResult.Skylinks)
+	}
+
+	// assert the regular email was parsed completely
+	regular, err := db.FindOne("INBOX-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regular.Parsed || regular.ParseResult.ParseTimedOut || len(regular.ParseResult.Skylinks) != 6 {
+		t.Fatal("expected the email to be parsed", regular.Parsed, regular.ParseResult)
+	}
+}
+
+// newSlowExtractor returns an extract function that sleeps for the given delay
+// before it extracts the skylinks from input that is marked as slow.
+func newSlowExtractor(delay time.Duration) func(input []byte) []string {
+	return func(input []byte) []string {
+		if bytes.Contains(input, []byte("SLOW")) {
+			time.Sleep(delay)
+		}
+		return extractSkylinks(input)
+	}
+}
+
+// testParseBodySkylinkSources is a unit test that verifies parseBody records
+// the extraction method that found each skylink
+func testParseBodySkylinkSources(t *testing.T) {
+	t.Parallel()
+
+	// create discard logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	const (
+		sl1 = "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"
+		sl2 = "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"
+		sl3 = "CABbGpIwkPL0WDkiHUt5iMlWK-u5RYmdwsKuUY-TGyC9hw"
+	)
+
+	tests := []struct {
+		name     string
+		body     string
+		expected map[string]string
+	}{
+		{
+			name: "Body",
+			body: fmt.Sprintf("Subject: Phishing\nX-Skylink: https://siasky.net/%s\n\nhttps://siasky.net/%s", sl1, sl2),
+			expected: map[string]string{
+				sl1: database.SkylinkSourceHeader,
+				sl2: database.SkylinkSourceBody,
+			},
+		},
+		{
+			name: "HTML",
+			body: fmt.Sprintf(`Subject: Phishing
+Content-Type: multipart/alternative; boundary="boundary"
+
+--boundary
+Content-Type: text/plain
+
+https://siasky.net/%s
+--boundary
+Content-Type: text/html
+
+<p><a href="https://siasky.net/%s">https://siasky.net/%s</a></p>
+--boundary
+Content-Type: text/plain
+Content-Disposition: attachment; filename="urls.txt"
+
+https://siasky.net/%s
+--boundary--`, sl1, sl1, sl1, sl2),
+			expected: map[string]string{
+				sl1: database.SkylinkSourceBody,
+				sl2: database.SkylinkSourceAttachment,
+			},
+		},
+		{
+			name: "HTMLOnly",
+			body: fmt.Sprintf(`Subject: Phishing
+Content-Type: multipart/alternative; boundary="boundary"
+
+--boundary
+Content-Type: text/html
+
+<p><a href="https://siasky.net/%s">https://siasky.net/%s</a></p>
+--boundary--`, sl1, sl1),
+			expected: map[string]string{
+				sl1: database.SkylinkSourceHTML,
+			},
+		},
+		{
+			name: "Subject",
+			body: fmt.Sprintf(`Subject: Phishing at https://siasky.net/%s
+Content-Type: multipart/alternative; boundary="boundary"
+
+--boundary
+Content-Type: text/plain
+
+https://siasky.net/%s
+https://siasky.net/%s
+--boundary--`, sl3, sl3, sl1),
+			expected: map[string]string{
+				sl1: database.SkylinkSourceBody,
+				sl3: database.SkylinkSourceSubject,
+			},
+		},
+	}
+	for _, test := range tests {
+		skylinks, sources, _, _, _, err := parseBody(context.Background(), []byte(test.body), extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if len(skylinks) != len(test.expected) {
+			t.Fatalf("%v: unexpected amount of skylinks found, %v != %v", test.name, len(skylinks), len(test.expected))
+		}
+		if !reflect.DeepEqual(sources, test.expected) {
+			t.Fatalf("%v: unexpected skylink sources %v", test.name, sources)
+		}
 	}
 }
 
@@ -250,7 +629,7 @@ func testParseBodySkyTransfer(t *testing.T) {
 	logger.Out = ioutil.Discard
 
 	// parse our example body containing skytransfer links
-	skylinks, tags, err := parseBody([]byte(exampleSkyTransferBody), logger.WithField("module", "Parser"))
+	skylinks, _, _, tags, _, err := parseBody(context.Background(), []byte(exampleSkyTransferBody), extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -270,6 +649,203 @@ func testParseBodySkyTransfer(t *testing.T) {
 	}
 }
 
+// testParseBodySkyTransferURLs verifies parseBody records the SkyTransfer URL
+// every skylink that was found by resolving one was resolved from.
+func testParseBodySkyTransferURLs(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// the first URL resolves to a folder, one of its skylinks is also linked
+	// directly in the email, the second URL resolves to a single skylink
+	sl1 := "EAC6rPvqSR8Mcp0ulwFvFHSYvCZsnsizCvDPxac8HiThjQ"
+	sl2 := "4BHyW37RDVl_I475WfO-5FD8zNOBbSCYJ9U_C9n3yondMw"
+	sl3 := "AAAFb6q43vcBvF8KByAygTvWEDHW9pq95WyTDrQhPrhqRg"
+	sl4 := "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"
+	url1 := "https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63"
+	url2 := "https://skytransfer.hns.siasky.net/#/v2/12a75f63/d871327"
+	resolve := func(ctx context.Context, urls []string, logger *logrus.Logger) ([]string, map[string][]string, error) {
+		if !reflect.DeepEqual(urls, []string{url1, url2}) {
+			t.Error("unexpected urls", urls)
+		}
+		resolutions := map[string][]string{url1: {sl1, sl2, sl3}, url2: {sl4}}
+		return []string{sl1, sl2, sl3, sl4}, resolutions, nil
+	}
+	body := fmt.Sprintf(`Subject: Phishing
+Content-Type: text/plain
+
+Please take down the files at
+%s
+%s
+including https://siasky.net/%s
+`, url1, url2, sl1)
+
+	skylinks, sources, skyTransferURLs, _, _, err := parseBody(context.Background(), []byte(body), extractSkylinks, resolve, logger.WithField("module", "Parser"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skylinks, []string{sl1, sl2, sl3, sl4}) {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
+	if sources[sl1] != database.SkylinkSourceBody || sources[sl2] != database.SkylinkSourceSkyTransfer {
+		t.Fatal("unexpected sources", sources)
+	}
+	expected := map[string]string{sl2: url1, sl3: url1, sl4: url2}
+	if !reflect.DeepEqual(skyTransferURLs, expected) {
+		t.Fatal("unexpected skytransfer URLs", skyTransferURLs)
+	}
+}
+
+// testParseSkyTransferResolutions is a unit test that covers the
+// parseSkyTransferResolutions helper function.
+func testParseSkyTransferResolutions(t *testing.T) {
+	t.Parallel()
+
+	out := []byte(`
+  SkyTransfer URL Resolver
+skytransfer-resolution https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63 https://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA?download=true
+    ✓ Resolves skylink for https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63 (35012ms)
+skytransfer-resolution https://skytransfer.hns.siasky.net/#/v2/12a75f63/d871327 https://siasky.net/skynet/registry
+skytransfer-resolution https://skytransfer.hns.siasky.net/#/v2/12a75f63/d871327
+`)
+	resolutions := parseSkyTransferResolutions(out)
+	expected := map[string][]string{
+		"https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63": {"BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"},
+	}
+	if !reflect.DeepEqual(resolutions, expected) {
+		t.Fatal("unexpected resolutions", resolutions)
+	}
+}
+
+// testResolveSkyTransferURLs verifies the resolutions of SkyTransfer URLs are
+// stored, and reused when the same URLs are resolved again.
+func testResolveSkyTransferURLs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create discard logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create test database
+	db, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, "testResolveSkyTransferURLs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create a parser with a resolver that records the URLs it resolves
+	domain := "dev.siasky.net"
+	parser := NewParser(ctx, db, domain, "somesponsor", ParserOptions{
+		SkyTransferResolutionMaxAge: time.Hour,
+	}, logger)
+	var resolved []string
+	parser.staticResolveSkyTransferURLs = func(ctx context.Context, urls []string, logger *logrus.Logger) ([]string, map[string][]string, error) {
+		resolved = append(resolved, urls...)
+		resolutions := make(map[string][]string)
+		for _, url := range urls {
+			resolutions[url] = []string{"skylink-of-" + url}
+		}
+		return []string{"skylink-of-" + urls[0]}, resolutions, nil
+	}
+
+	// resolve a URL and assert its resolution is stored
+	url1 := "https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63"
+	url2 := "https://skytransfer.hns.siasky.net/#/v2/12a75f63/d871327"
+	skylinks, _, err := parser.resolveSkyTransferURLs(ctx, []string{url1}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skylinks, []string{"skylink-of-" + url1}) || !reflect.DeepEqual(resolved, []string{url1}) {
+		t.Fatal("unexpected resolution", skylinks, resolved)
+	}
+	stored, err := db.FindSkyTransferResolutions([]string{url1}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || !reflect.DeepEqual(stored[url1].Skylinks, []string{"skylink-of-" + url1}) || stored[url1].ResolvedBy != domain {
+		t.Fatal("unexpected stored resolutions", stored)
+	}
+
+	// assert the stored resolution is reused, only the new URL is resolved
+	resolved = nil
+	skylinks, _, err = parser.resolveSkyTransferURLs(ctx, []string{url1, url2}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skylinks, []string{"skylink-of-" + url1, "skylink-of-" + url2}) || !reflect.DeepEqual(resolved, []string{url2}) {
+		t.Fatal("unexpected resolution", skylinks, resolved)
+	}
+
+	// assert a resolution that exceeds the max age is not reused
+	err = db.UpsertSkyTransferResolution(database.SkyTransferResolution{
+		URL:        url1,
+		Skylinks:   []string{"outdated"},
+		ResolvedAt: time.Now().Add(-2 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved = nil
+	skylinks, _, err = parser.resolveSkyTransferURLs(ctx, []string{url1}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skylinks, []string{"skylink-of-" + url1}) || !reflect.DeepEqual(resolved, []string{url1}) {
+		t.Fatal("unexpected resolution", skylinks, resolved)
+	}
+}
+
+// resolveUnstored resolves the given SkyTransfer URLs without storing their
+// resolutions.
+func resolveUnstored(ctx context.Context, urls []string, logger *logrus.Logger) ([]string, map[string][]string, error) {
+	return resolveSkyTransferURLs(ctx, urls, logger)
+}
+
+// testResolutionLog verifies the output of a failed cypress run is captured in
+// the resolution log, and that the log is bounded.
+func testResolutionLog(t *testing.T) {
+	t.Parallel()
+
+	// simulate a failed cypress run
+	_, err := runCypress(exec.Command("sh", "-c", "echo 'Visiting skytransfer.hns.siasky.net'; echo 'CypressError: timed out' >&2; exit 1"))
+	resErr, ok := err.(resolutionError)
+	if !ok {
+		t.Fatal("unexpected error", err)
+	}
+	if !strings.Contains(resErr.staticLog, "Visiting skytransfer.hns.siasky.net") || !strings.Contains(resErr.staticLog, "CypressError: timed out") {
+		t.Fatal("unexpected resolution log", resErr.staticLog)
+	}
+	if !strings.Contains(err.Error(), "CypressError: timed out") {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert a successful run returns the output
+	out, err := runCypress(exec.Command("sh", "-c", "echo 'Visiting skytransfer.hns.siasky.net'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "Visiting") {
+		t.Fatal("unexpected output", string(out))
+	}
+
+	// assert the log is bounded and keeps the tail of the output
+	stdout := bytes.Repeat([]byte("a"), 2*maxResolutionLogSize)
+	log := buildResolutionLog(stdout, []byte("CypressError: timed out"))
+	if len(log) > maxResolutionLogSize+len("...(truncated)\n") {
+		t.Fatal("unexpected resolution log size", len(log))
+	}
+	if !strings.HasPrefix(log, "...(truncated)") || !strings.HasSuffix(log, "CypressError: timed out") {
+		t.Fatal("unexpected resolution log", log[:32], log[len(log)-32:])
+	}
+}
+
 // testDedupe is a unit test that verifies the behaviour of the 'dedupe' helper
 // function
 func testDedupe(t *testing.T) {
@@ -310,6 +886,10 @@ func testExtractPortalFromHnsDomain(t *testing.T) {
 			url:    "https://skytransfer.hns.skyportal.xyz/#/v2/d871327aa70cd7525",
 			portal: "skyportal.xyz",
 		},
+		{
+			url:    "https://skytransfer.hns.skyportäl.xyz/#/v2/d871327aa70cd7525",
+			portal: "xn--skyportl-6za.xyz",
+		},
 		{
 			url:    "https://d871327aa70cd7525.skyportal.xyz/#/v2/d871327aa70cd7525",
 			portal: "",
@@ -324,6 +904,40 @@ func testExtractPortalFromHnsDomain(t *testing.T) {
 	}
 }
 
+// testExtractReporterOrg is a unit test that verifies the behaviour of the
+// 'extractReporterOrg' helper function
+func testExtractReporterOrg(t *testing.T) {
+	t.Parallel()
+
+	orgs := map[string]string{
+		"switch.ch":     "SWITCH-CERT",
+		"namecheap.com": "Namecheap",
+	}
+
+	cases := []struct {
+		address string
+		orgs    map[string]string
+		org     string
+	}{
+		{"cert@switch.ch", orgs, "SWITCH-CERT"},
+		{"CERT@SWITCH.CH", orgs, "SWITCH-CERT"},
+		{"incident@cert.switch.ch", orgs, "SWITCH-CERT"},
+		{"abuse@namecheap.com", orgs, "Namecheap"},
+		{"abuse@notnamecheap.com", orgs, ""},
+		{"john.doe@example.com", orgs, ""},
+		{"cert@switch.ch", nil, ""},
+		{"", orgs, ""},
+		{"invalid", orgs, ""},
+	}
+
+	for _, tt := range cases {
+		org := extractReporterOrg(tt.address, tt.orgs)
+		if org != tt.org {
+			t.Errorf("unexpected org for '%v', '%v' != '%v'", tt.address, org, tt.org)
+		}
+	}
+}
+
 // testExtractSkyTransferURLs is a unit test that verifies the behaviour of the
 // 'extractSkyTransferURLs' helper function
 func testExtractSkyTransferURLs(t *testing.T) {
@@ -448,6 +1062,140 @@ func testExtractSkylinks(t *testing.T) {
 		skylinks[1] != "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g" {
 		t.Fatal("unexpected skylinks", skylinks)
 	}
+
+	// extract base64 skylinks that are preceded by a subpath
+	skylinks = extractSkylinks([]byte(`
+	before https://siasky.net/skynet/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g after
+	hxxps:// siasky [.] net/hns/name/CABbGpIwkPL0WDkiHUt5iMlWK-u5RYmdwsKuUY-TGyC9hw/index.html
+	https://siasky.net/hns/thisisaveryveryverylongnamethatexceedsfortysixchars/AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg/index.html
+	`))
+	if len(skylinks) != 3 {
+		t.Log(skylinks)
+		t.Fatalf("unexpected amount of skylinks found, %v != 3", len(skylinks))
+	}
+	sort.Strings(skylinks)
+	if skylinks[0] != "AAAg4mZrsNcedNPazZ4kSFAYBzf7f8ZgHO1Tu1L-NN8Gjg" ||
+		skylinks[1] != "CABbGpIwkPL0WDkiHUt5iMlWK-u5RYmdwsKuUY-TGyC9hw" ||
+		skylinks[2] != "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g" {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
+
+	// extract skylinks that are directly followed by punctuation
+	var sl32 skymodules.Skylink
+	if err := sl32.LoadString("7g01n1fmusamd3k4c5l7ahb39356rfhfs92e9mjshj1vq93vk891m2o"); err != nil {
+		t.Fatal(err)
+	}
+	for _, punctuation := range []string{".", ",", ")", "]", "\"", "'"} {
+		for _, tc := range []struct {
+			line     string
+			expected string
+		}{
+			{"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g", "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"},
+			{"see siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g", "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"},
+			{"https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g", "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"},
+			{"7g01n1fmusamd3k4c5l7ahb39356rfhfs92e9mjshj1vq93vk891m2o", sl32.String()},
+			{"https://siasky.net/7g01n1fmusamd3k4c5l7ahb39356rfhfs92e9mjshj1vq93vk891m2o", sl32.String()},
+		} {
+			input := []byte(fmt.Sprintf("\n\t%s%s\n", tc.line, punctuation))
+			skylinks = extractSkylinks(input)
+			if len(skylinks) != 1 || skylinks[0] != tc.expected {
+				t.Fatalf("unexpected skylinks for '%s', %v != [%v]", input, skylinks, tc.expected)
+			}
+			skylinks = extractPortalSkylinks(input, []string{"siasky.net"}, IDNModeNormalize)
+			if strings.HasPrefix(tc.line, "https://") && (len(skylinks) != 1 || skylinks[0] != tc.expected) {
+				t.Fatalf("unexpected portal skylinks for '%s', %v != [%v]", input, skylinks, tc.expected)
+			}
+		}
+	}
+}
+
+// testExtractionModes is a unit test that verifies the difference between the
+// recall and precision extraction modes against the example bodies.
+func testExtractionModes(t *testing.T) {
+	t.Parallel()
+
+	recall := newSkylinkExtractor(ExtractionModeRecall, nil, IDNModeNormalize)
+	precision := newSkylinkExtractor(ExtractionModePrecision, []string{"siasky.net"}, IDNModeNormalize)
+
+	// base32 encoded skylinks, note only the first two are part of a link
+	// that clearly points to the portal
+	base32Body := []byte(`
+	hxxps:// 7g01n1fmusamd3k4c5l7ahb39356rfhfs92e9mjshj1vq93vk891m2o [.] siasky [.] net
+
+	hxxps:// [.] eu-ger-1 [.] siasky [.] net / 1005m6ki628f5t2o74h1qirph34lcavbn52oj7e2oan533sj3cgbr1o
+
+	hxxps:// [.] eu-ger-1 [.] siasky [.] net2005m6KI628f5t2o74h1qirph34lcavbn52oj7e2oan533sj3cgbr2b
+
+	3005m6ki628f5t2o74h1qirph34lcavbn52oj7e2oan533sj3cgbr2b
+	`)
+
+	tests := []struct {
+		name      string
+		input     []byte
+		recall    int
+		precision []string
+	}{
+		{
+			// the skylinks glued to the domain and the bare skylink are only
+			// extracted in recall mode
+			name:   "ExampleBody",
+			input:  exampleBody,
+			recall: 6,
+			precision: []string{
+				"CADEnmNNR6arnyDSH60MlGjQK5O3Sv-ecK1PGt3MNmQUhA",
+				"GABJJhT8AlfNh-XS-6YVH8en7O-t377ej9XS2eclnv2yFg",
+				"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g",
+				"nAA_hbtNaOYyR2WrM9UNIc5jRu4WfGy5QK_iTGosDgLmSA",
+			},
+		},
+		{
+			name:   "Base32",
+			input:  base32Body,
+			recall: 4,
+			precision: []string{
+				"CABbGpIwkPL0WDkiHUt5iMlWK-u5RYmdwsKuUY-TGyC9hw",
+				"PAAbhfb3FWaOhGFqdUVjSMptvi_iROTafIzD_SR_ohIbCw",
+			},
+		},
+		{
+			// links to other hosts are only extracted in recall mode
+			name:      "UnknownPortal",
+			input:     []byte(`https://example.com/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g`),
+			recall:    1,
+			precision: nil,
+		},
+		{
+			// lookalike domains are not considered to be on the portal
+			name:      "LookalikePortal",
+			input:     []byte(`https://notsiasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g`),
+			recall:    1,
+			precision: nil,
+		},
+		{
+			name:   "Subpath",
+			input:  []byte(`before https://SIASKY.net:443/skynet/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g?foo=bar after`),
+			recall: 1,
+			precision: []string{
+				"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g",
+			},
+		},
+	}
+	for _, test := range tests {
+		skylinks := recall(test.input)
+		if len(skylinks) != test.recall {
+			t.Fatalf("%v: unexpected amount of skylinks found in recall mode, %v != %v, skylinks %v", test.name, len(skylinks), test.recall, skylinks)
+		}
+		skylinks = precision(test.input)
+		sort.Strings(skylinks)
+		if !reflect.DeepEqual(skylinks, test.precision) {
+			t.Fatalf("%v: unexpected skylinks found in precision mode, %v != %v", test.name, skylinks, test.precision)
+		}
+	}
+
+	// assert precision mode does not extract anything without known portals
+	if skylinks := newSkylinkExtractor(ExtractionModePrecision, nil, IDNModeNormalize)(exampleBody); len(skylinks) != 0 {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
 }
 
 // testExtractTextFromHTML is a unit test that verifies the behaviour of the
@@ -478,6 +1226,24 @@ func testExtractTextFromHTML(t *testing.T) {
 	if tags[0] != "phishing" {
 		t.Fatalf("unexpected tag %v", tags[0])
 	}
+
+	// assert the text of adjacent block-level elements is not concatenated
+	text, err = extractTextFromHTML(strings.NewReader(htmlBlocksBody))
+	if err != nil {
+		t.Fatal("unexpected error while extracting text from HTML", err)
+	}
+	if strings.Contains(text, "banAGAEE") || strings.Contains(text, "9hw2022") {
+		t.Fatalf("unexpected text %q", text)
+	}
+	skylinks = extractSkylinks([]byte(text))
+	expected := []string{
+		"BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA",
+		"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g",
+		"CABbGpIwkPL0WDkiHUt5iMlWK-u5RYmdwsKuUY-TGyC9hw",
+	}
+	if !reflect.DeepEqual(skylinks, expected) {
+		t.Fatalf("unexpected skylinks, %v != %v", skylinks, expected)
+	}
 }
 
 // testExtractTags is a unit test that verifies the behaviour of the
@@ -523,6 +1289,178 @@ func testExtractTags(t *testing.T) {
 	}
 }
 
+// testDetectPortal is a unit test that verifies the portal the skylinks were
+// reported on is detected from the links in the email.
+func testDetectPortal(t *testing.T) {
+	t.Parallel()
+
+	portals := []string{"https://siasky.net", "https://skyportal.xyz"}
+	tests := []struct {
+		name     string
+		body     []byte
+		portals  []string
+		expected string
+	}{
+		{"Secondary", secondaryPortalBody, portals, "https://skyportal.xyz"},
+		{"Primary", exampleBody, portals, "https://siasky.net"},
+		{"SoftWrapped", []byte("Please take down https://skyportal.=\r\nxyz/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"), portals, "https://skyportal.xyz"},
+		{"Punycode", []byte("Please take down https://xn--skyportl-6za.xyz/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"), []string{"https://siasky.net", "https://skyportäl.xyz"}, "https://skyportäl.xyz"},
+		{"Unicode", []byte("Please take down https://SKYPORTÄL.xyz/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"), []string{"https://siasky.net", "https://xn--skyportl-6za.xyz"}, "https://xn--skyportl-6za.xyz"},
+		{"Unknown", []byte("Please take down https://example.com/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"), portals, ""},
+		{"NoPortals", secondaryPortalBody, nil, ""},
+	}
+	for _, test := range tests {
+		portal := detectPortal(test.body, test.portals, IDNModeNormalize)
+		if portal != test.expected {
+			t.Fatalf("%v: unexpected portal %q != %q", test.name, portal, test.expected)
+		}
+	}
+}
+
+// testIDNHosts is a unit test that verifies the internationalized hosts of
+// links are converted to their punycode form before they are matched against
+// the portals, unless they are ignored.
+func testIDNHosts(t *testing.T) {
+	t.Parallel()
+
+	skylink := "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"
+	sl32 := "7g01n1fmusamd3k4c5l7ahb39356rfhfs92e9mjshj1vq93vk891m2o"
+	var sl skymodules.Skylink
+	err := sl.LoadString(sl32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the portals are configured in both forms
+	portals := []string{"siasky.net", "skyportäl.xyz", "xn--skyprtal-r4a.xyz"}
+	tests := []struct {
+		name       string
+		body       string
+		normalized []string
+		ignored    []string
+	}{
+		{"Punycode", "https://xn--skyportl-6za.xyz/" + skylink, []string{skylink}, []string{skylink}},
+		{"Unicode", "https://skyportäl.xyz/" + skylink, []string{skylink}, nil},
+		{"UnicodeUppercase", "HTTPS://SKYPORTÄL.XYZ/" + skylink, []string{skylink}, nil},
+		{"UnicodePortalPunycode", "https://skyprötal.xyz/" + skylink, []string{skylink}, nil},
+		{"UnicodeSubdomain", "https://" + sl32 + ".skyportäl.xyz/", []string{sl.String()}, nil},
+		{"Defanged", "hxxps:// skyportäl [.] xyz / " + skylink, []string{skylink}, nil},
+		{"Homograph", "https://siаsky.net/" + skylink, nil, nil},
+		{"Invalid", "https://sky\u00adportäl.xyz\u2028/" + skylink, nil, nil},
+	}
+	for _, test := range tests {
+		body := []byte(fmt.Sprintf("Please take down %s today\n", test.body))
+		normalized := newSkylinkExtractor(ExtractionModePrecision, portals, IDNModeNormalize)(body)
+		if !reflect.DeepEqual(normalized, test.normalized) {
+			t.Fatalf("%v: unexpected skylinks %v != %v", test.name, normalized, test.normalized)
+		}
+		ignored := newSkylinkExtractor(ExtractionModePrecision, portals, IDNModeIgnore)(body)
+		if !reflect.DeepEqual(ignored, test.ignored) {
+			t.Fatalf("%v: unexpected skylinks in ignore mode %v != %v", test.name, ignored, test.ignored)
+		}
+	}
+
+	// assert the portal is detected from an internationalized host, unless
+	// those are ignored
+	body := []byte("Please take down https://skyportäl.xyz/" + skylink)
+	portalURLs := []string{"https://siasky.net", "https://xn--skyportl-6za.xyz"}
+	if portal := detectPortal(body, portalURLs, IDNModeNormalize); portal != "https://xn--skyportl-6za.xyz" {
+		t.Fatal("unexpected portal", portal)
+	}
+	if portal := detectPortal(body, portalURLs, IDNModeIgnore); portal != "" {
+		t.Fatal("unexpected portal", portal)
+	}
+}
+
+// testDetectLowConfidence is a unit test that verifies the
+// 'detectLowConfidence' helper only flags emails in which the skylinks were
+// found as loose tokens and no tags were found.
+func testDetectLowConfidence(t *testing.T) {
+	t.Parallel()
+
+	skylink := "BAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"
+	loose := []byte("Please take down the following: " + skylink)
+	linked := []byte("Please take down hxxps:// siasky [.] net/" + skylink)
+	wrapped := []byte("Please take down https://siasky.net/BAEE7l0IkIVcVEHDgRCcNkRYS8k=\r\neZKr9v_ffxf9_614m6g")
+	defaultTags := []string{database.AbuseDefaultTag}
+
+	tests := []struct {
+		name     string
+		body     []byte
+		skylinks []string
+		source   string
+		tags     []string
+		low      bool
+	}{
+		{"Loose", loose, []string{skylink}, database.SkylinkSourceBody, defaultTags, true},
+		{"LooseTagged", loose, []string{skylink}, database.SkylinkSourceBody, []string{"phishing"}, false},
+		{"Linked", linked, []string{skylink}, database.SkylinkSourceBody, defaultTags, false},
+		{"LinkedSoftWrapped", wrapped, []string{skylink}, database.SkylinkSourceBody, defaultTags, false},
+		{"Evidence", loose, []string{skylink}, database.SkylinkSourceEvidence, defaultTags, false},
+		{"SkyTransfer", loose, []string{skylink}, database.SkylinkSourceSkyTransfer, defaultTags, false},
+		{"NoSkylinks", loose, nil, "", defaultTags, false},
+	}
+	for _, test := range tests {
+		sources := make(map[string]string)
+		for _, skylink := range test.skylinks {
+			sources[skylink] = test.source
+		}
+		low := detectLowConfidence(test.body, test.skylinks, sources, test.tags)
+		if low != test.low {
+			t.Fatalf("%v: unexpected low confidence %v", test.name, low)
+		}
+	}
+
+	// assert base-32 skylinks in a subdomain are considered linked
+	skylink32 := "7g01n1fmusamd3k4c5l7ahb39356rfhfs92e9mjshj1vq93vk891m2o"
+	var sl skymodules.Skylink
+	if err := sl.LoadString(skylink32); err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(fmt.Sprintf("Please take down https://%v.siasky.net", skylink32))
+	if detectLowConfidence(body, []string{sl.String()}, map[string]string{sl.String(): database.SkylinkSourceBody}, defaultTags) {
+		t.Fatal("expected base-32 skylink in subdomain to be linked")
+	}
+}
+
+// testDetectTagConflict is a unit test that verifies the 'detectTagConflict'
+// helper flags high-severity tags on emails that discuss our policy.
+func testDetectTagConflict(t *testing.T) {
+	t.Parallel()
+
+	// the body quotes our legal notice, soft-wrapped using quoted-printable
+	quote := []byte("Regarding the child safety policy, you wrote \"no content is stored on our=\r\n servers\" but we disagree.")
+	report := []byte("We found child abuse material at https://siasky.net/BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA")
+
+	tests := []struct {
+		name     string
+		body     []byte
+		tags     []string
+		conflict bool
+	}{
+		{"Conflict", quote, []string{"csam"}, true},
+		{"ConflictTerrorism", quote, []string{"phishing", "terrorism"}, true},
+		{"NoConflictTag", quote, []string{"phishing"}, false},
+		{"NoConflictPattern", report, []string{"csam"}, false},
+	}
+	for _, test := range tests {
+		reason := detectTagConflict(test.body, test.tags, DefaultConflictTags, DefaultConflictPatterns)
+		if (reason != "") != test.conflict {
+			t.Fatalf("%v: unexpected conflict reason '%v'", test.name, reason)
+		}
+	}
+
+	// assert the conflict tags and patterns are configurable
+	custom := []*regexp.Regexp{regexp.MustCompile(`(?i)acceptable use policy`)}
+	body := []byte("Our Acceptable Use Policy forbids phishing")
+	if detectTagConflict(body, []string{"phishing"}, []string{"phishing"}, custom) == "" {
+		t.Fatal("expected conflict")
+	}
+	if detectTagConflict(quote, []string{"csam"}, []string{"csam"}, custom) != "" {
+		t.Fatal("unexpected conflict")
+	}
+}
+
 // testBuildAbuseReport is a unit test that verifies the functionality of the
 // 'buildAbuseReport' method on the Parser.
 func testBuildAbuseReport(t *testing.T) {
@@ -536,7 +1474,7 @@ func testBuildAbuseReport(t *testing.T) {
 	logger.Out = ioutil.Discard
 
 	// create test database
-	db, err := database.NewTestAbuseScannerDB(ctx, "testBuildAbuseReport")
+	db, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, "testBuildAbuseReport")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -549,7 +1487,9 @@ func testBuildAbuseReport(t *testing.T) {
 
 	// create a parser
 	domain := "dev.siasky.net"
-	parser := NewParser(ctx, db, domain, "somesponsor", logger)
+	parser := NewParser(ctx, db, domain, "somesponsor", ParserOptions{
+		ReporterOrgs: map[string]string{"gmail.com": "Google"},
+	}, logger)
 
 	// create an abuse email
 	email := database.AbuseEmail{
@@ -576,10 +1516,23 @@ func testBuildAbuseReport(t *testing.T) {
 	}
 
 	// parse the email
-	err = parser.parseEmail(email)
+	parsed, err := parser.parseEmail(email)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !parsed {
+		t.Fatal("expected the email to be parsed")
+	}
+
+	// assert the email is not parsed twice, e.g. when another process listed
+	// it as unparsed before it got parsed
+	parsed, err = parser.parseEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed {
+		t.Fatal("expected the email to be parsed only once")
+	}
 
 	// fetch the email
 	updated, err := db.FindOne(email.UID)
@@ -617,6 +1570,41 @@ func testBuildAbuseReport(t *testing.T) {
 	if pr.Reporter.Email != "someone@gmail.com" {
 		t.Fatal("unexpected reporter", pr.Reporter.Email)
 	}
+	if pr.Reporter.ReporterOrg != "Google" {
+		t.Fatal("unexpected reporter org", pr.Reporter.ReporterOrg)
+	}
+	if pr.Reporter.NoReply {
+		t.Fatal("expected the reporter to be replied to")
+	}
+
+	// assert an email without a sender is parsed, and the fallback contact
+	// is recorded as the reporter's email
+	parser = NewParser(ctx, db, domain, "somesponsor", ParserOptions{
+		FallbackReporterEmail: "abuse@siasky.net",
+	}, logger)
+	email.ID = primitive.NewObjectID()
+	email.UID = "INBOX-2"
+	email.UIDRaw = 2
+	email.From = "@"
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parser.parseEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err = db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr = updated.ParseResult
+	if !updated.Parsed || len(pr.Skylinks) != 6 {
+		t.Fatal("expected the email to be parsed", pr.Skylinks)
+	}
+	if !pr.Reporter.NoReply || pr.Reporter.Email != "abuse@siasky.net" || pr.Reporter.ReporterOrg != "" {
+		t.Fatal("unexpected reporter", pr.Reporter)
+	}
 }
 
 // testShouldParseMediaType is a unit test that covers the ShouldParseMediaType helper function
@@ -790,7 +1778,7 @@ func testWriteCypressTests(t *testing.T) {
     cy.visit('https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63');
     cy.intercept('https://siasky.net/*').as('myReq');
     cy.get('.ant-btn').contains('Download all files').click();
-    cy.wait('@myReq').should(($obj) => {cy.task('log', $obj.request.url)});
+    cy.wait('@myReq').should(($obj) => {cy.task('log', 'skytransfer-resolution https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63 ' + $obj.request.url)});
     cy.wait(30000);
   })
   it('Resolves skylink for https://skytransfer.hns.siasky.net/#/v2/12a75f63/d871327', () => {
@@ -799,7 +1787,7 @@ func testWriteCypressTests(t *testing.T) {
     cy.visit('https://skytransfer.hns.siasky.net/#/v2/12a75f63/d871327');
     cy.intercept('https://siasky.net/*').as('myReq');
     cy.get('.ant-btn').contains('Download all files').click();
-    cy.wait('@myReq').should(($obj) => {cy.task('log', $obj.request.url)});
+    cy.wait('@myReq').should(($obj) => {cy.task('log', 'skytransfer-resolution https://skytransfer.hns.siasky.net/#/v2/12a75f63/d871327 ' + $obj.request.url)});
     cy.wait(30000);
   })
 })
@@ -0,0 +1,27 @@
+package email
+
+type (
+	// Pauser decides whether the processing is paused, in which case the
+	// modules skip the work of their loop iterations while their loops keep
+	// ticking. It's implemented by database.PauseSwitch.
+	Pauser interface {
+		IsPaused() bool
+	}
+)
+
+// isPaused is a helper function that returns true if the given pauser is not
+// nil and the processing is paused.
+func isPaused(pause Pauser) bool {
+	return pause != nil && pause.IsPaused()
+}
+
+// runIterationUnlessPaused is a helper function that runs a single iteration
+// of the loop of a module using the given guard, see loopGuard, unless the
+// processing is paused. It returns false if the loop has to stop.
+func runIterationUnlessPaused(stop <-chan struct{}, guard *loopGuard, pause Pauser, iteration func()) bool {
+	if isPaused(pause) {
+		guard.staticLogger.Debugln("Processing is paused, skipping loop iteration")
+		return true
+	}
+	return guard.Run(stop, iteration)
+}
@@ -0,0 +1,79 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// testPauser is a pauser that is paused if it's true
+	testPauser bool
+)
+
+// IsPaused implements the Pauser interface.
+func (p testPauser) IsPaused() bool {
+	return bool(p)
+}
+
+// TestRunIterationUnlessPaused verifies a loop iteration is skipped while the
+// processing is paused.
+func TestRunIterationUnlessPaused(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.Out = new(bytes.Buffer)
+	entry := logger.WithField("module", "Parser")
+
+	for _, test := range []struct {
+		name     string
+		pause    Pauser
+		expected bool
+	}{
+		{"NoPauser", nil, true},
+		{"Paused", testPauser(true), false},
+		{"Resumed", testPauser(false), true},
+	} {
+		ran := false
+		runIterationUnlessPaused(nil, newLoopGuard("Parser", nil, entry), test.pause, func() { ran = true })
+		if ran != test.expected {
+			t.Fatalf("unexpected outcome for test '%v', %v != %v", test.name, ran, test.expected)
+		}
+	}
+}
+
+// TestPausedLoop verifies the loop of a module keeps ticking while the
+// processing is paused, but does not do any work. The parser has no database,
+// so any work it does would fail.
+func TestPausedLoop(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.SetLevel(logrus.DebugLevel)
+
+	// cancel the context upfront, the loop stops after its first iteration
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := NewParser(ctx, nil, "dev.siasky.net", "", ParserOptions{Pause: testPauser(true)}, logger)
+	err := p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := buf.String()
+	if !strings.Contains(output, "threadedParseMessages loop iteration triggered") || !strings.Contains(output, "Processing is paused, skipping loop iteration") {
+		t.Fatal("expected the loop to tick while paused", output)
+	}
+	if strings.Contains(output, "level=error") {
+		t.Fatal("expected the loop not to do any work while paused", output)
+	}
+}
@@ -0,0 +1,123 @@
+package email
+
+import (
+	"abuse-scanner/metrics"
+	"abuse-scanner/notifier"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// loopPanicBackoff is the amount of time a loop waits before it runs the
+	// next iteration after an iteration panicked, it doubles with every
+	// consecutive panic
+	loopPanicBackoff = 10 * time.Second
+
+	// maxLoopPanicBackoff is the maximum amount of time a loop waits after an
+	// iteration panicked
+	maxLoopPanicBackoff = 5 * time.Minute
+
+	// maxLoopPanics is the amount of consecutive panics after which a loop
+	// gives up, which fails the health check of its module
+	maxLoopPanics = 5
+)
+
+type (
+	// loopGuard guards the loop of a module against panics, every loop has
+	// its own guard. A panic in an iteration is recovered, see runIteration,
+	// after which the loop backs off before it runs the next iteration. The
+	// loop gives up after too many consecutive panics, as it's most likely
+	// stuck on the same input.
+	loopGuard struct {
+		panics int
+
+		staticBackoff   time.Duration
+		staticLogger    *logrus.Entry
+		staticMaxPanics int
+		staticModule    string
+		staticNotifier  *notifier.Notifier
+	}
+)
+
+// newLoopGuard returns a guard for a loop of the given module.
+func newLoopGuard(module string, n *notifier.Notifier, logger *logrus.Entry) *loopGuard {
+	return &loopGuard{
+		staticBackoff:   loopPanicBackoff,
+		staticLogger:    logger,
+		staticMaxPanics: maxLoopPanics,
+		staticModule:    module,
+		staticNotifier:  n,
+	}
+}
+
+// Run runs a single iteration of the loop, see runIteration. If the iteration
+// panicked the on-call is notified and Run waits for the backoff before it
+// returns. It returns false if the loop has to stop, either because it gave up
+// after too many consecutive panics or because the given stop channel got
+// closed while it was backing off.
+func (g *loopGuard) Run(stop <-chan struct{}, iteration func()) bool {
+	panicked, r := runIteration(g.staticLogger, iteration)
+	if !panicked {
+		g.panics = 0
+		return true
+	}
+	g.panics++
+	metrics.RecordLoopPanic(g.staticModule)
+
+	// give up if the loop keeps panicking
+	if g.panics >= g.staticMaxPanics {
+		reason := fmt.Sprintf("gave up after %v consecutive panics", g.panics)
+		g.staticLogger.Errorf("Stopping the loop, it %v", reason)
+		metrics.RecordLoopStopped(g.staticModule, reason)
+		g.notify(notifier.SeverityCritical, "Module loop stopped", r)
+		return false
+	}
+	g.notify(notifier.SeverityWarning, "Module loop panicked", r)
+
+	// back off before the next iteration
+	backoff := g.staticBackoff << (g.panics - 1)
+	if backoff > maxLoopPanicBackoff {
+		backoff = maxLoopPanicBackoff
+	}
+	g.staticLogger.Warnf("Restarting the loop in %v after %v consecutive panics", backoff, g.panics)
+	select {
+	case <-stop:
+		return false
+	case <-time.After(backoff):
+	}
+	return true
+}
+
+// notify notifies the on-call of the given panic.
+func (g *loopGuard) notify(severity, title string, r interface{}) {
+	err := g.staticNotifier.Notify(severity, title, []notifier.Field{
+		{Name: "Module", Value: g.staticModule},
+		{Name: "Panic", Value: fmt.Sprint(r)},
+		{Name: "Consecutive Panics", Value: fmt.Sprint(g.panics)},
+	})
+	if err != nil {
+		g.staticLogger.Errorf("Failed to notify of the panic, error %v", err)
+	}
+}
+
+// runIteration is a helper function that runs a single iteration of the loop
+// of a module. A panic in the iteration is recovered and logged as an error,
+// alongside the stack trace, which ensures the loop survives it and the panic
+// gets reported. The next iteration retries the work that was interrupted. It
+// returns whether the iteration panicked, and with what value.
+func runIteration(logger *logrus.Entry, iteration func()) (panicked bool, r interface{}) {
+	defer func() {
+		if r = recover(); r != nil {
+			panicked = true
+			logger.WithFields(logrus.Fields{
+				"panic": fmt.Sprint(r),
+				"stack": string(debug.Stack()),
+			}).Errorf("Recovered from panic in loop iteration, err %v", r)
+		}
+	}()
+	iteration()
+	return false, nil
+}
@@ -0,0 +1,111 @@
+package email
+
+import (
+	"abuse-scanner/api"
+	"abuse-scanner/metrics"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestRunIteration verifies a panic in a loop iteration is recovered and
+// logged as an error.
+func TestRunIteration(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+
+	ran := false
+	panicked, r := runIteration(logger.WithField("module", "Parser"), func() {
+		ran = true
+		panic("nil email")
+	})
+	if !ran || !panicked || r != "nil email" {
+		t.Fatal("expected the iteration to run and panic", ran, panicked, r)
+	}
+	output := buf.String()
+	if !strings.Contains(output, "level=error") || !strings.Contains(output, `panic="nil email"`) || !strings.Contains(output, "module=Parser") {
+		t.Fatal("unexpected output", output)
+	}
+	if !strings.Contains(output, "stack=") {
+		t.Fatal("expected the stack trace to be logged", output)
+	}
+}
+
+// TestLoopGuard verifies the loop guard recovers from a panicking iteration,
+// backs off before the next one, and gives up after too many consecutive
+// panics, which fails the health check of the module.
+func TestLoopGuard(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+
+	// use a module name that is unique to this test, the loop state is global
+	module := "TestLoopGuard"
+	guard := newLoopGuard(module, nil, logger.WithField("module", module))
+	guard.staticBackoff = 10 * time.Millisecond
+	guard.staticMaxPanics = 3
+
+	// assert the loop survives a panicking iteration after a backoff
+	start := time.Now()
+	if !guard.Run(nil, func() { panic("malformed html") }) {
+		t.Fatal("expected the loop to continue")
+	}
+	if time.Since(start) < guard.staticBackoff {
+		t.Fatal("expected the loop to back off")
+	}
+	if !strings.Contains(buf.String(), `panic="malformed html"`) || !strings.Contains(buf.String(), "Restarting the loop in 10ms after 1 consecutive panics") {
+		t.Fatal("unexpected output", buf.String())
+	}
+
+	// assert a successful iteration resets the consecutive panics
+	ran := false
+	if !guard.Run(nil, func() { ran = true }) || !ran || guard.panics != 0 {
+		t.Fatal("expected the iteration to succeed", ran, guard.panics)
+	}
+
+	// assert the backoff doubles with every consecutive panic, and that the
+	// guard stops backing off if the loop is stopped
+	guard.Run(nil, func() { panic("malformed html") })
+	stop := make(chan struct{})
+	close(stop)
+	if guard.Run(stop, func() { panic("malformed html") }) {
+		t.Fatal("expected the loop to stop")
+	}
+	if !strings.Contains(buf.String(), "Restarting the loop in 20ms after 2 consecutive panics") {
+		t.Fatal("unexpected output", buf.String())
+	}
+	if _, stopped := metrics.LoopStopped(module); stopped {
+		t.Fatal("expected the loop not to give up")
+	}
+
+	// assert the loop gives up after the max consecutive panics
+	guard.panics = 0
+	for i := 0; i < guard.staticMaxPanics-1; i++ {
+		if !guard.Run(nil, func() { panic("malformed html") }) {
+			t.Fatal("expected the loop to continue")
+		}
+	}
+	if guard.Run(nil, func() { panic("malformed html") }) {
+		t.Fatal("expected the loop to give up")
+	}
+	reason, stopped := metrics.LoopStopped(module)
+	if !stopped || reason != "gave up after 3 consecutive panics" {
+		t.Fatal("unexpected loop state", stopped, reason)
+	}
+
+	// assert the health check of the module fails
+	metrics.RecordLoopIteration(module, time.Minute)
+	err := api.LoopCheck(module, time.Minute)(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "stopped its loop") {
+		t.Fatal("unexpected error", err)
+	}
+}
@@ -0,0 +1,246 @@
+package email
+
+import (
+	"abuse-scanner/database"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// RedactionModeNone stores the reporter's PII as it was received, this is
+	// the default.
+	RedactionModeNone = "none"
+
+	// RedactionModeHash replaces the sender addresses of the stored email by
+	// a pseudonym, the reply address is stored as an encrypted reply token.
+	RedactionModeHash = "hash"
+
+	// RedactionModeRedact does everything RedactionModeHash does, and on top
+	// of that it redacts email addresses, phone numbers and the address
+	// headers from the stored email body.
+	RedactionModeRedact = "redact"
+
+	// redactedPlaceholder is the value that replaces redacted PII
+	redactedPlaceholder = "[redacted]"
+
+	// minPhoneDigits is the minimum number of digits a sequence of digits
+	// needs to be redacted as a phone number, it excludes dates
+	minPhoneDigits = 9
+
+	// pseudonymSize is the number of bytes of the keyed hash that make up
+	// the local part of a pseudonymized address
+	pseudonymSize = 8
+)
+
+var (
+	// errInvalidReplyToken is returned when a reply token can not be
+	// decrypted, e.g. because it was created with another key
+	errInvalidReplyToken = errors.New("invalid reply token")
+
+	// redactAddressHeaderRE is a regex that matches the headers of the raw
+	// message that contain the names and addresses of the reporter, folded
+	// header lines are not matched as we can't tell them apart from indented
+	// body lines, the addresses on those lines are redacted as any other
+	redactAddressHeaderRE = regexp.MustCompile(`(?mi)^(from|reply-to|sender|return-path|cc):[^\r\n]*`)
+
+	// redactEmailRE is a regex that matches email addresses
+	redactEmailRE = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+
+	// redactPhoneRE is a regex that matches sequences of digits that might be
+	// phone numbers, both in national and international format, they are
+	// only redacted if they contain at least minPhoneDigits digits
+	redactPhoneRE = regexp.MustCompile(`\+?\(?\d[\d ()-]{7,}\d`)
+)
+
+type (
+	// Redactor minimizes the reporter's PII we store. It replaces the sender
+	// addresses by a pseudonym, which is stable for the same address so the
+	// replies to a reporter can still be grouped, and encrypts the reply
+	// address into a reply token that only the finalizer opens to send the
+	// reply. Depending on the mode it also redacts the stored email body.
+	//
+	// Note that the body redaction is best effort, PII in encoded parts of
+	// the raw message, e.g. base64 encoded attachments, is not redacted.
+	Redactor struct {
+		staticAEAD    cipher.AEAD
+		staticHashKey []byte
+		staticMode    string
+	}
+)
+
+// NewRedactor returns a redactor for the given mode, the key is used to derive
+// both the key of the pseudonyms and the key that encrypts the reply tokens.
+// The key is required in every mode, as opening the reply tokens of emails
+// that were redacted before the mode was set to RedactionModeNone requires it.
+func NewRedactor(mode, key string) (*Redactor, error) {
+	switch mode {
+	case RedactionModeNone, RedactionModeHash, RedactionModeRedact:
+	default:
+		return nil, fmt.Errorf("unknown redaction mode '%v'", mode)
+	}
+	if key == "" {
+		return nil, errors.New("the redaction key can not be empty")
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, "reply-token"))
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create AEAD")
+	}
+	return &Redactor{
+		staticAEAD:    aead,
+		staticHashKey: deriveKey(key, "pseudonym"),
+		staticMode:    mode,
+	}, nil
+}
+
+// Redact returns a copy of the given email in which the reporter's PII is
+// redacted according to the redactor's mode. Emails that were redacted before,
+// which is the case if they have a reply token, keep their pseudonyms and
+// reply token.
+func (r *Redactor) Redact(email database.AbuseEmail) (database.AbuseEmail, error) {
+	if !r.enabled() {
+		return email, nil
+	}
+
+	if email.ReplyToken == "" {
+		token, err := r.ReplyToken(email.ReplyToEmail())
+		if err != nil {
+			return database.AbuseEmail{}, errors.AddContext(err, "failed to create reply token")
+		}
+		email.ReplyToken = token
+		email.From = r.pseudonym(email.From)
+		email.ReplyTo = r.pseudonym(email.ReplyTo)
+	}
+
+	if r.staticMode == RedactionModeRedact {
+		email.Body = redactBody(email.Body)
+	}
+	return email, nil
+}
+
+// enabled returns true if the redactor redacts PII, a nil redactor does not.
+func (r *Redactor) enabled() bool {
+	return r != nil && r.staticMode != RedactionModeNone
+}
+
+// ReplyAddress opens the given reply token and returns the reply address it
+// contains.
+func (r *Redactor) ReplyAddress(token string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", errInvalidReplyToken
+	}
+	nonceSize := r.staticAEAD.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errInvalidReplyToken
+	}
+	address, err := r.staticAEAD.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", errInvalidReplyToken
+	}
+	return string(address), nil
+}
+
+// ReplyToken encrypts the given reply address into a reply token.
+func (r *Redactor) ReplyToken(address string) (string, error) {
+	nonce := make([]byte, r.staticAEAD.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := r.staticAEAD.Seal(nonce, nonce, []byte(address), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// pseudonym returns the pseudonym of the given address, the local part is
+// replaced by a keyed hash of the address while the domain is kept, as we
+// extract the reporter's organization from it.
+func (r *Redactor) pseudonym(address string) string {
+	if address == "" {
+		return ""
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	mac := hmac.New(sha256.New, r.staticHashKey)
+	mac.Write([]byte(address))
+	hash := hex.EncodeToString(mac.Sum(nil)[:pseudonymSize])
+
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return hash
+	}
+	return hash + address[at:]
+}
+
+// deriveKey is a helper function that derives a 32-byte key for the given
+// purpose from the given key.
+func deriveKey(key, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// redactBody is a helper function that redacts the address headers, email
+// addresses and phone numbers from the given raw message. Matches that are
+// part of a larger token, such as the digits in a skylink, are left untouched
+// so the body can still be parsed again.
+func redactBody(body []byte) []byte {
+	body = redactAddressHeaderRE.ReplaceAllFunc(body, func(header []byte) []byte {
+		name := header[:bytes.IndexByte(header, ':')]
+		return []byte(fmt.Sprintf("%s: %s", name, redactedPlaceholder))
+	})
+	body = redactEmailRE.ReplaceAll(body, []byte(redactedPlaceholder))
+	return redactPhoneNumbers(body)
+}
+
+// redactPhoneNumbers is a helper function that redacts the phone numbers from
+// the given body. Sequences of digits that are directly surrounded by
+// characters that can be part of a skylink are left untouched.
+func redactPhoneNumbers(body []byte) []byte {
+	var redacted []byte
+	var last int
+	for _, match := range redactPhoneRE.FindAllIndex(body, -1) {
+		start, end := match[0], match[1]
+		if start > 0 && isSkylinkChar(body[start-1]) {
+			continue
+		}
+		if end < len(body) && isSkylinkChar(body[end]) {
+			continue
+		}
+		var digits int
+		for _, c := range body[start:end] {
+			if c >= '0' && c <= '9' {
+				digits++
+			}
+		}
+		if digits < minPhoneDigits {
+			continue
+		}
+		redacted = append(redacted, body[last:start]...)
+		redacted = append(redacted, redactedPlaceholder...)
+		last = end
+	}
+	return append(redacted, body[last:]...)
+}
+
+// isSkylinkChar returns true if the given character can be part of a base32 or
+// base64 encoded skylink.
+func isSkylinkChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
@@ -0,0 +1,271 @@
+package email
+
+import (
+	"abuse-scanner/database"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// testRedactionKey is the redaction key used in unit tests
+	testRedactionKey = "redaction-key"
+
+	// testReporterAddress is the address of the reporter in the redaction
+	// tests
+	testReporterAddress = "john.doe@example.com"
+
+	// testPIIBody is a raw abuse email that contains the reporter's PII
+	testPIIBody = `From: John Doe <john.doe@example.com>
+Reply-To: John Doe <john.doe@example.com>
+To: abuse@siasky.net
+Subject: Phishing Report
+
+Hello,
+
+On 2022-03-01 we found a phishing page at the following URL:
+
+hxxps:// siasky [.] net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g
+
+Please call me at +41 44 268 15 40 or reach out to my colleague at
+jane.doe@example.org.
+`
+)
+
+// testPII contains the PII of the reporter that occurs in the test body
+var testPII = []string{
+	"John Doe <",
+	testReporterAddress,
+	"+41 44 268 15 40",
+	"jane.doe@example.org",
+}
+
+// TestRedactor is a unit test that covers the redaction of the reporter's PII.
+func TestRedactor(t *testing.T) {
+	t.Parallel()
+
+	// assert the constructor validates its arguments
+	_, err := NewRedactor("mask", testRedactionKey)
+	if err == nil || !strings.Contains(err.Error(), "unknown redaction mode") {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = NewRedactor(RedactionModeRedact, "")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	r, err := NewRedactor(RedactionModeRedact, testRedactionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := newTestEmail()
+	email.Body = []byte(testPIIBody)
+	email.From = testReporterAddress
+	email.ReplyTo = ""
+	redacted, err := r.Redact(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the PII is redacted
+	for _, pii := range testPII {
+		if strings.Contains(string(redacted.Body), pii) {
+			t.Fatalf("expected '%v' to be redacted, body %v", pii, string(redacted.Body))
+		}
+	}
+	if !strings.Contains(string(redacted.Body), "From: [redacted]") {
+		t.Fatal("expected the from header to be redacted", string(redacted.Body))
+	}
+	if redacted.From == testReporterAddress || !strings.HasSuffix(redacted.From, "@example.com") {
+		t.Fatal("unexpected pseudonym", redacted.From)
+	}
+	if redacted.ReplyTo != "" {
+		t.Fatal("unexpected reply to", redacted.ReplyTo)
+	}
+
+	// assert the pseudonym is stable, case insensitive, and keyed
+	if r.pseudonym("John.Doe@example.com") != redacted.From {
+		t.Fatal("expected the pseudonym to be stable")
+	}
+	other, err := NewRedactor(RedactionModeRedact, "other-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.pseudonym(testReporterAddress) == redacted.From {
+		t.Fatal("expected the pseudonym to depend on the key")
+	}
+
+	// assert the body can still be parsed, the date is not redacted
+	if !strings.Contains(string(redacted.Body), "2022-03-01") {
+		t.Fatal("expected the date to remain", string(redacted.Body))
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	expected, _, _, _, _, err := parseBody(context.Background(), email.Body, extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, _, _, _, _, err := parseBody(context.Background(), redacted.Body, extractSkylinks, resolveUnstored, logger.WithField("module", "Parser"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 1 || !reflect.DeepEqual(actual, expected) {
+		t.Fatal("unexpected skylinks", actual, expected)
+	}
+
+	// assert redacting a redacted email keeps its pseudonyms and token
+	again, err := r.Redact(redacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.From != redacted.From || again.ReplyToken != redacted.ReplyToken || !reflect.DeepEqual(again.Body, redacted.Body) {
+		t.Fatal("expected redaction to be idempotent", again)
+	}
+
+	// assert the reply token only opens with the same key
+	address, err := r.ReplyAddress(redacted.ReplyToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != testReporterAddress {
+		t.Fatal("unexpected reply address", address)
+	}
+	_, err = other.ReplyAddress(redacted.ReplyToken)
+	if !errors.Contains(err, errInvalidReplyToken) {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = r.ReplyAddress("not-a-token")
+	if !errors.Contains(err, errInvalidReplyToken) {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert the hash mode leaves the body untouched
+	r, err = NewRedactor(RedactionModeHash, testRedactionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed, err := r.Redact(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashed.From != redacted.From || hashed.ReplyToken == "" || !reflect.DeepEqual(hashed.Body, email.Body) {
+		t.Fatal("unexpected email", hashed)
+	}
+
+	// assert the none mode leaves the email untouched
+	r, err = NewRedactor(RedactionModeNone, testRedactionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unredacted, err := r.Redact(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unredacted, email) {
+		t.Fatal("unexpected email", unredacted)
+	}
+}
+
+// TestRedactorStorage verifies the reporter's PII is redacted in the database
+// once the email is parsed, while the reply still reaches the reporter.
+func TestRedactorStorage(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create discard logger
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// create test database
+	db, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create a parser that redacts the PII
+	redactor, err := NewRedactor(RedactionModeRedact, testRedactionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := "dev.siasky.net"
+	parser := NewParser(ctx, db, domain, "somesponsor", ParserOptions{Redactor: redactor}, logger)
+
+	// insert and parse an email
+	email := database.AbuseEmail{
+		ID:         primitive.NewObjectID(),
+		UID:        "INBOX-1",
+		UIDRaw:     1,
+		Body:       []byte(testPIIBody),
+		From:       testReporterAddress,
+		ReplyTo:    testReporterAddress,
+		To:         "abuse@siasky.net",
+		Subject:    "Phishing Report",
+		MessageID:  "<msg_uid>@example.com",
+		InsertedBy: domain,
+		InsertedAt: time.Now().UTC(),
+	}
+	err = db.InsertOne(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parser.parseEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the stored email does not contain the PII
+	stored, err := db.FindOne(email.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.ParseResult.Skylinks) != 1 {
+		t.Fatal("unexpected skylinks", stored.ParseResult.Skylinks)
+	}
+	for _, pii := range testPII {
+		for _, field := range []string{string(stored.Body), stored.From, stored.ReplyTo, stored.ParseResult.Reporter.Email} {
+			if strings.Contains(field, pii) {
+				t.Fatalf("expected '%v' to be redacted, found '%v'", pii, field)
+			}
+		}
+	}
+	if stored.ReplyToken == "" || stored.ParseResult.Reporter.Email != stored.ReplyToEmail() {
+		t.Fatal("unexpected email", stored)
+	}
+
+	// assert the reply is addressed to the reporter
+	f := &Finalizer{staticOptions: FinalizerOptions{Redactor: redactor}}
+	to, err := f.replyAddress(*stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Blocked = true
+	stored.BlockResult = []string{database.AbuseStatusBlocked}
+	reply, err := buildAutomatedReply(*stored, to, database.ResponseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply, "To:"+testReporterAddress+"\n") {
+		t.Fatal("expected the reply to be addressed to the reporter", reply)
+	}
+
+	// assert the reply fails without a redactor rather than being sent to
+	// the pseudonym
+	f = &Finalizer{}
+	_, err = f.replyAddress(*stored)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -3,8 +3,16 @@ package email
 import (
 	"abuse-scanner/accounts"
 	"abuse-scanner/database"
+	"abuse-scanner/metrics"
+	"abuse-scanner/notifier"
+	"abuse-scanner/skylink"
+	"abuse-scanner/utils"
+	"abuse-scanner/version"
+	"context"
 	"encoding/xml"
 	"fmt"
+	"net/http"
+	"path"
 	"sync"
 	"time"
 
@@ -15,18 +23,53 @@ import (
 	"go.sia.tech/siad/build"
 )
 
+const (
+	// SkylinkVersionV1 and SkylinkVersionV2 are the versions of skylinks, v1
+	// skylinks are immutable while v2 skylinks resolve to a v1 skylink
+	// through the registry, which makes them mutable.
+	SkylinkVersionV1 = "v1"
+	SkylinkVersionV2 = "v2"
+)
+
 const (
 	// anonUser is a helper constant used to identify an anonymous upload for
 	// which we don't have any information
 	anonUser = "anon"
 
-	// maxShutdownTimeout is the amount of time we wait on the waitgroup when
-	// Stop is being called before returning an error that indicates an unclean
-	// shutdown.
-	maxShutdownTimeout = time.Minute
+	// attributionUnavailableInfo is the additional info we add to reports
+	// that are attributed to the anonymous user because the accounts API was
+	// unavailable.
+	attributionUnavailableInfo = "Uploader attribution unavailable, the upload info could not be looked up."
+
+	// defaultAccountsBreakerCooldown is the default amount of time the
+	// accounts API circuit breaker stays open before it allows a trial
+	// request.
+	defaultAccountsBreakerCooldown = 5 * time.Minute
+
+	// defaultAccountsBreakerThreshold is the default amount of consecutive
+	// failed requests to the accounts API after which the circuit breaker
+	// opens.
+	defaultAccountsBreakerThreshold = 5
+
+	// defaultMaxReportSize is the default maximum size, in bytes, of the
+	// marshaled XML of a single NCMEC report.
+	defaultMaxReportSize = 1 << 20 // 1 MiB
+
+	// defaultShutdownTimeout is the default amount of time the modules wait
+	// on their waitgroup when Stop is being called before returning an error
+	// that indicates an unclean shutdown.
+	defaultShutdownTimeout = time.Minute
 )
 
 var (
+	// errAccountsBreakerOpen is returned when the upload info is not looked up
+	// because the accounts API circuit breaker is open.
+	errAccountsBreakerOpen = errors.New("accounts API circuit breaker is open")
+
+	// errReportRejected is returned when NCMEC permanently rejected finishing
+	// a report, the report is stored as failed and does not count as filed.
+	errReportRejected = errors.New("NCMEC rejected finishing the report")
+
 	// ncmecFileFrequency defines the frequency with which we file reports to
 	// NCMEC.
 	ncmecFileFrequency = build.Select(build.Var{
@@ -48,43 +91,164 @@ type (
 	// Reporter is an object that will periodically scan the database for CSAM
 	// abuse reports that have not been reported to NCMEC yet.
 	Reporter struct {
-		staticAbuseDatabase  *database.AbuseScannerDB
-		staticAccountsClient accounts.AccountsAPI
-		staticClient         *NCMECClient
-		staticDebug          bool
-		staticLogger         *logrus.Entry
-		staticPortalURL      string
-		staticReporter       NCMECReporter
-		staticServerDomain   string
-		staticStopChan       chan struct{}
-		staticWaitGroup      sync.WaitGroup
+		staticAbuseDatabase   *database.AbuseScannerDB
+		staticAccountsBreaker *utils.CircuitBreaker
+		staticAccountsClient  accounts.AccountsAPI
+		staticCancel          context.CancelFunc
+		staticClient          *NCMECClient
+		staticCtx             context.Context
+		staticDebug           bool
+		staticLogSuppressor   *utils.LogSuppressor
+		staticLogger          *logrus.Entry
+		staticOptions         ReporterOptions
+		staticPortalURLs      []string
+		staticReporter        NCMECReporter
+		staticServerDomain    string
+		staticStopChan        chan struct{}
+		staticWaitGroup       sync.WaitGroup
+
+		accountsHealth error
+		ncmecHealth    error
+		mu             sync.Mutex
+	}
+
+	// ReporterOptions contains the configurable options of the reporter.
+	ReporterOptions struct {
+		// AccountsBreakerCooldown is the amount of time the accounts API
+		// circuit breaker stays open before it allows a trial request,
+		// defaults to defaultAccountsBreakerCooldown.
+		AccountsBreakerCooldown time.Duration
+
+		// AccountsBreakerThreshold is the amount of consecutive failed
+		// requests to the accounts API after which the circuit breaker opens,
+		// defaults to defaultAccountsBreakerThreshold. While the breaker is
+		// open all skylinks are reported anonymously.
+		AccountsBreakerThreshold int
+
+		// DryRun indicates whether the reporter runs in dry-run mode, in which
+		// case the reports are built and marked as dry run, but the NCMEC API
+		// is never called and the reports are never filed.
+		DryRun bool
+
+		// FilingLeader decides whether this instance files the NCMEC reports,
+		// which ensures they're filed by a single instance across all
+		// instances that share the database. If nil this instance always
+		// files them.
+		FilingLeader Leader
+
+		// HTTPClient is the shared HTTP client used to call the NCMEC API,
+		// defaults to http.DefaultClient.
+		HTTPClient *http.Client
+
+		// MaxReportSize is the maximum size, in bytes, of the marshaled XML
+		// of a single NCMEC report. Reports that exceed this size are split
+		// into multiple reports. If zero it defaults to defaultMaxReportSize.
+		MaxReportSize int
+
+		// NCMECResponseActions maps the response codes of the NCMEC API onto
+		// the action the reporter takes when it gets that code while filing
+		// a report, it's one of NCMECActionBackoff, NCMECActionFail or
+		// NCMECActionRetry. It extends and overrides the default mapping,
+		// unknown response codes fail the report.
+		NCMECResponseActions map[uint64]string
+
+		// Notifier escalates the problems that require manual intervention
+		// to the on-call, e.g. reports that failed to get filed. If nil no
+		// notifications are sent.
+		Notifier *notifier.Notifier
+
+		// Pause pauses the reporter while the processing is paused, its
+		// loops keep ticking but skip their work. If nil it's never paused.
+		Pause Pauser
+
+		// RequireAccountsHealthy indicates whether the reporter fails to
+		// start if the accounts API is not healthy, if false it only logs a
+		// warning.
+		RequireAccountsHealthy bool
+
+		// Screenshots provides the evidence screenshots of the reported
+		// skylinks, if set the screenshots that are available are uploaded
+		// to the CSAM reports. Failing to attach a screenshot never prevents
+		// the report from being filed.
+		Screenshots ScreenshotSource
+
+		// ShutdownTimeout is the amount of time Stop waits for the reporter to
+		// shut down before it returns an error, defaults to
+		// defaultShutdownTimeout.
+		ShutdownTimeout time.Duration
+
+		// SkylinkVersions are the versions of the skylinks that are reported
+		// to NCMEC, either SkylinkVersionV1 or SkylinkVersionV2. The skylinks
+		// of the other versions are only blocked. If empty the skylinks of
+		// all versions are reported.
+		SkylinkVersions []string
+	}
+
+	// ReportStats are the counts of a single reporting pass.
+	ReportStats struct {
+		// Created is the amount of NCMEC reports that got built and stored.
+		Created int `json:"created"`
+
+		// Filed is the amount of NCMEC reports that got filed with NCMEC.
+		Filed int `json:"filed"`
 	}
 )
 
-// NewReporter creates a new reporter.
-func NewReporter(abuseDB *database.AbuseScannerDB, accountsClient accounts.AccountsAPI, creds NCMECCredentials, portalURL, serverDomain string, reporter NCMECReporter, logger *logrus.Logger) *Reporter {
+// NewReporter creates a new reporter. The reported URLs point to the portal the
+// skylinks were reported on if it's one of the given portal URLs, and to the
+// first of them, the primary portal, otherwise.
+func NewReporter(abuseDB *database.AbuseScannerDB, accountsClient accounts.AccountsAPI, creds NCMECCredentials, portalURLs []string, serverDomain string, reporter NCMECReporter, opts ReporterOptions, logger *logrus.Logger) *Reporter {
+	if opts.AccountsBreakerCooldown == 0 {
+		opts.AccountsBreakerCooldown = defaultAccountsBreakerCooldown
+	}
+	if opts.AccountsBreakerThreshold == 0 {
+		opts.AccountsBreakerThreshold = defaultAccountsBreakerThreshold
+	}
+	if opts.MaxReportSize == 0 {
+		opts.MaxReportSize = defaultMaxReportSize
+	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Reporter{
-		staticAbuseDatabase:  abuseDB,
-		staticAccountsClient: accountsClient,
-		staticClient:         NewNCMECClient(creds),
-		staticDebug:          creds.Debug,
-		staticLogger:         logger.WithField("module", "Reporter"),
-		staticPortalURL:      portalURL,
-		staticReporter:       reporter,
-		staticServerDomain:   serverDomain,
-		staticStopChan:       make(chan struct{}),
+		staticAbuseDatabase:   abuseDB,
+		staticAccountsBreaker: utils.NewCircuitBreaker(opts.AccountsBreakerThreshold, opts.AccountsBreakerCooldown),
+		staticAccountsClient:  accountsClient,
+		staticCancel:          cancel,
+		staticClient:          NewNCMECClient(creds, opts.HTTPClient),
+		staticCtx:             ctx,
+		staticDebug:           creds.Debug,
+		staticLogSuppressor:   utils.NewLogSuppressor(utils.DefaultLogSuppressInterval),
+		staticLogger:          logger.WithField("module", ModuleReporter),
+		staticOptions:         opts,
+		staticPortalURLs:      portalURLs,
+		staticReporter:        reporter,
+		staticServerDomain:    serverDomain,
+		staticStopChan:        make(chan struct{}),
 	}
 }
 
+// Name returns the name of the reporter.
+func (r *Reporter) Name() string {
+	return ModuleReporter
+}
+
 // Start initializes the reporter process.
 func (r *Reporter) Start() error {
-	// check the status endpoint before we start this module
-	res, err := r.staticClient.status()
-	if err != nil {
-		return fmt.Errorf("unexpected response from NCMEC API, err %v", err)
+	// check the status endpoint before we start this module, in dry-run mode
+	// we never call the NCMEC API
+	if !r.staticOptions.DryRun {
+		err := r.managedCheckNCMECHealth()
+		if err != nil {
+			return err
+		}
 	}
-	if res.ResponseCode != ncmecStatusOK {
-		return fmt.Errorf("unexpected status response from NCMEC API, status %v", res.ResponseCode)
+
+	// check the accounts API health before we start this module
+	err := r.managedCheckAccountsHealth()
+	if err != nil {
+		return err
 	}
 
 	r.staticWaitGroup.Add(1)
@@ -93,6 +257,11 @@ func (r *Reporter) Start() error {
 		r.staticWaitGroup.Done()
 	}()
 
+	// in dry-run mode the reports are never filed
+	if r.staticOptions.DryRun {
+		r.staticLogger.Info("Dry run, NCMEC reports are built but not filed")
+		return nil
+	}
 	r.staticWaitGroup.Add(1)
 	go func() {
 		r.threadedFileReports()
@@ -101,9 +270,81 @@ func (r *Reporter) Start() error {
 	return nil
 }
 
+// RunOnce builds the NCMEC reports of all unreported emails and files the
+// unfiled reports a single time, it does not require the reporter to be
+// started. It returns the counts of the reporting pass. Like the loops of the
+// reporter, reports are not filed in dry-run mode, nor if the reporter is not
+// the filing leader or the NCMEC API is unavailable.
+func (r *Reporter) RunOnce() (stats ReportStats) {
+	stats.Created = r.buildReports()
+	if r.staticOptions.DryRun || !isLeader(r.staticOptions.FilingLeader) {
+		return stats
+	}
+	err := r.managedCheckNCMECHealth()
+	if err != nil {
+		r.staticLogger.Errorf("%v, skipping filing reports", err)
+		return stats
+	}
+	stats.Filed = r.fileReports()
+	return stats
+}
+
+// AccountsHealth returns the outcome of the most recent accounts API health
+// check, it returns nil if the accounts API was healthy.
+func (r *Reporter) AccountsHealth() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.accountsHealth
+}
+
+// NCMECHealth returns the outcome of the most recent NCMEC API status check,
+// it returns nil if the NCMEC API was healthy.
+func (r *Reporter) NCMECHealth() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ncmecHealth
+}
+
+// AccountsBreakerState returns the state of the accounts API circuit breaker,
+// it's one of utils.BreakerClosed, utils.BreakerHalfOpen or utils.BreakerOpen.
+func (r *Reporter) AccountsBreakerState() string {
+	return r.staticAccountsBreaker.State()
+}
+
+// managedCheckAccountsHealth checks the health of the accounts API and records
+// the outcome. If the accounts API is not healthy it logs a warning, or
+// returns an error if the reporter requires the accounts API to be healthy.
+func (r *Reporter) managedCheckAccountsHealth() error {
+	err := r.staticAccountsClient.HealthGET(r.staticCtx)
+
+	r.mu.Lock()
+	r.accountsHealth = err
+	r.mu.Unlock()
+
+	if err != nil && r.staticOptions.RequireAccountsHealthy {
+		return errors.AddContext(err, "accounts API health check failed")
+	}
+	if err != nil {
+		r.staticLogger.Warnf("accounts API health check failed, uploader lookups will likely fail, err %v", err)
+	}
+	return nil
+}
+
+// managedCheckNCMECHealth checks the status of the NCMEC API and records the
+// outcome, it returns an error if the NCMEC API is not healthy.
+func (r *Reporter) managedCheckNCMECHealth() error {
+	err := r.staticClient.Status()
+
+	r.mu.Lock()
+	r.ncmecHealth = err
+	r.mu.Unlock()
+	return err
+}
+
 // Stop waits for the finalizer's waitgroup and times out after one minute.
 func (r *Reporter) Stop() error {
 	close(r.staticStopChan)
+	r.staticCancel()
 
 	c := make(chan struct{})
 	go func() {
@@ -113,15 +354,15 @@ func (r *Reporter) Stop() error {
 	select {
 	case <-c:
 		return nil
-	case <-time.After(maxShutdownTimeout):
+	case <-time.After(r.staticOptions.ShutdownTimeout):
 		return errors.New("unclean reporter shutdown")
 	}
 }
 
 // buildReports fetches all abuse emails from the database that have not been
 // converted to NCMEC reports yet and converts those emails to a set of NCMEC
-// reports.
-func (r *Reporter) buildReports() {
+// reports. It returns the amount of reports it built.
+func (r *Reporter) buildReports() (created int) {
 	// convenience variables
 	abuseDB := r.staticAbuseDatabase
 	logger := r.staticLogger
@@ -130,41 +371,43 @@ func (r *Reporter) buildReports() {
 	toReport, err := abuseDB.FindUnreported()
 	if err != nil {
 		logger.Errorf("Failed fetching unreported emails, error %v", err)
-		return
+		return created
 	}
 
 	// log unreported message count
 	numUnreported := len(toReport)
 	if numUnreported == 0 {
 		logger.Debugf("Found %v unreported abuse emails", numUnreported)
-		return
+		return created
 	}
 
 	logger.Infof("Found %v unreported abuse emails", numUnreported)
 
 	// loop all emails and report them
 	for _, email := range toReport {
-		err := r.buildReportsForEmail(email)
+		n, err := r.buildReportsForEmail(email)
+		created += n
 		if err != nil {
-			logger.Errorf("Failed building NCMEC reports for email %v, error %v", email.UID, err)
+			r.staticLogSuppressor.Errorf(logger.WithField("email_uid", email.UID), "Failed building NCMEC reports, error %v", err)
 		}
 	}
+	return created
 }
 
 // buildReportsForEmail will build a set of NCMEC reports for the given email
 // and persist them in the database. One abuse email can explode into a set of
 // NCMEC reports as those reports are unique to a single uploader, if we have
-// that information.
-func (r *Reporter) buildReportsForEmail(email database.AbuseEmail) error {
+// that information. It returns the amount of reports it stored.
+func (r *Reporter) buildReportsForEmail(email database.AbuseEmail) (created int, err error) {
 	// convenience variables
-	logger := r.staticLogger
+	logger := r.staticLogger.WithField("email_uid", email.UID)
 	abuseDB := r.staticAbuseDatabase
 
 	// acquire a lock on the email
 	lock := abuseDB.NewLock(email.UID)
-	err := lock.Lock()
+	err = lock.Lock()
 	if err != nil {
-		return errors.AddContext(err, "could not acquire lock")
+		return 0, errors.AddContext(err, "could not acquire lock")
 	}
 
 	// defer the unlock
@@ -180,16 +423,19 @@ func (r *Reporter) buildReportsForEmail(email database.AbuseEmail) error {
 	// process, if so we simply return
 	current, err := abuseDB.FindOne(email.UID)
 	if err != nil {
-		return errors.AddContext(err, "could not find email")
+		return 0, errors.AddContext(err, "could not find email")
 	}
 	if current.Reported {
-		return nil
+		return 0, nil
 	}
 
 	// build the reports
-	reports, err := r.buildReportsForEmailInner(email)
+	reports, failed, err := r.buildReportsForEmailInner(email)
 	if err != nil {
-		return errors.AddContext(err, "could not build reports")
+		return 0, errors.AddContext(err, "could not build reports")
+	}
+	if len(failed) > 0 {
+		logger.Warnf("Failed to look up the uploader of %v skylinks, they are reported anonymously", len(failed))
 	}
 
 	// build the report for every uploader and set of skylinks, and insert it
@@ -210,40 +456,74 @@ func (r *Reporter) buildReportsForEmail(email database.AbuseEmail) error {
 				InsertedAt:  time.Now().UTC(),
 				Report:      string(reportBytes),
 				ReportDebug: r.staticDebug,
+				DryRun:      r.staticOptions.DryRun,
 			},
 		)
 		if err != nil {
 			logger.Errorf("failed to insert report, err %v", err)
 			continue
 		}
+		created++
 	}
 
 	// update the email
-	err = abuseDB.UpdateNoLock(email, bson.M{
-		"$set": bson.M{
-			"reported":    true,
-			"reported_by": r.staticServerDomain,
-			"reported_at": time.Now().UTC(),
-		},
-	})
+	update := bson.M{
+		"reported":               true,
+		"reported_by":            r.staticServerDomain,
+		"reported_at":            time.Now().UTC(),
+		"report_lookup_failures": failed,
+	}
+	if r.staticOptions.DryRun {
+		update["dry_run"] = true
+	}
+	err = abuseDB.UpdateNoLockRetry(email, bson.M{
+		"$set": update,
+	}, func(current database.AbuseEmail) bool { return current.Reported })
 	if err != nil {
-		return errors.AddContext(err, "could not update email")
+		return created, errors.AddContext(err, "could not update email")
 	}
-	return nil
+	return created, nil
 }
 
 // buildReportsForEmailInner will build a set of NCMEC reports for the given
 // email and persist them in the database. It's called by buildReportsForEmail.
-func (r *Reporter) buildReportsForEmailInner(email database.AbuseEmail) ([]report, error) {
+// Skylinks for which the upload info lookup failed are attributed to the
+// anonymous user and returned alongside the reports. If the accounts API
+// circuit breaker is open, all skylinks are attributed to the anonymous user
+// and the reports are annotated that the uploader attribution was unavailable.
+func (r *Reporter) buildReportsForEmailInner(email database.AbuseEmail) ([]report, []string, error) {
 	incidentDate := email.InsertedAt
+	portalURL := r.reportPortalURL(email.ParseResult.Portal)
+
+	// only report the skylinks of the configured versions
+	skylinks := r.reportedSkylinks(email.ParseResult.Skylinks)
+	if excluded := len(email.ParseResult.Skylinks) - len(skylinks); excluded > 0 {
+		r.staticLogger.WithField("email_uid", email.UID).Debugf("Excluded %v skylinks from the report as their version is not reported", excluded)
+	}
+
+	// fetch the upload infos, if the accounts API is degraded we report all
+	// skylinks anonymously rather than holding back the report
+	var attributionUnavailable bool
+	uploadInfos, failed, err := r.fetchUploadInfos(skylinks)
+	if errors.Contains(err, errAccountsBreakerOpen) {
+		r.staticLogger.WithField("email_uid", email.UID).Warn("Accounts API circuit breaker is open, reporting the skylinks of the email anonymously")
+		attributionUnavailable = true
+		uploadInfos = nil
+		failed = append([]string(nil), skylinks...)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	// if the reporter is shutting down the lookups were aborted, in which
+	// case we don't want to attribute the skylinks to the anonymous user
+	if r.staticCtx.Err() != nil {
+		return nil, nil, errors.AddContext(r.staticCtx.Err(), "upload info lookups aborted")
+	}
 
 	// group the upload infos per user
 	grouped := make(map[string][]accounts.UploadInfo)
-	for _, skylink := range email.ParseResult.Skylinks {
-		infos, err := r.staticAccountsClient.UploadInfoGET(skylink)
-		if err != nil {
-			return nil, errors.AddContext(err, "could not fetch upload info")
-		}
+	for _, skylink := range skylinks {
+		infos := uploadInfos[skylink]
 		if len(infos) == 0 {
 			grouped[anonUser] = append(grouped[anonUser], accounts.UploadInfo{
 				Skylink: skylink,
@@ -251,7 +531,11 @@ func (r *Reporter) buildReportsForEmailInner(email database.AbuseEmail) ([]repor
 			continue
 		}
 		for _, info := range infos {
+			// uploads without uploader info are anonymous
 			user := info.Sub
+			if user == "" {
+				user = anonUser
+			}
 			grouped[user] = append(grouped[user], info)
 		}
 	}
@@ -260,27 +544,193 @@ func (r *Reporter) buildReportsForEmailInner(email database.AbuseEmail) ([]repor
 	// skylinks he uploaded and potentially more information about the upload
 	var reports []report
 	for user, uploads := range grouped {
-		reports = append(reports, r.buildReportForUploads(incidentDate, user, uploads))
+		reports = append(reports, r.buildSizedReportsForUploads(incidentDate, portalURL, user, uploads)...)
+	}
+
+	// annotate the reports if the uploader attribution was unavailable
+	if attributionUnavailable {
+		for i := range reports {
+			reports[i].Uploader.AdditionalInfo = attributionUnavailableInfo
+		}
 	}
-	return reports, nil
+	return reports, failed, nil
 }
 
-// buildReportForUploads takes an email and a set of uploads and returns an
-// NCMEC report
-func (r *Reporter) buildReportForUploads(date time.Time, user string, uploads []accounts.UploadInfo) report {
+// reportedSkylinks returns the given skylinks of the versions that are
+// reported, see SkylinkVersions. Skylinks that fail to load are reported, as
+// their version is unknown.
+func (r *Reporter) reportedSkylinks(skylinks []string) []string {
+	versions := r.staticOptions.SkylinkVersions
+	if len(versions) == 0 {
+		return skylinks
+	}
+	var reported []string
+	for _, skylink := range skylinks {
+		slVersion := skylinkVersion(skylink)
+		if slVersion == "" {
+			reported = append(reported, skylink)
+			continue
+		}
+		for _, v := range versions {
+			if v == slVersion {
+				reported = append(reported, skylink)
+				break
+			}
+		}
+	}
+	return reported
+}
+
+// reportPortalURL returns the URL of the portal the reported URLs point to,
+// which is the given portal the skylinks were reported on if it's one of our
+// portals, and the primary portal otherwise.
+func (r *Reporter) reportPortalURL(detected string) string {
+	for _, portalURL := range r.staticPortalURLs {
+		if detected != "" && portalURL == detected {
+			return portalURL
+		}
+	}
+	if len(r.staticPortalURLs) == 0 {
+		return ""
+	}
+	return r.staticPortalURLs[0]
+}
+
+// buildSizedReportsForUploads builds the NCMEC report for the given uploads,
+// if the marshaled report exceeds the max report size the uploads are split in
+// half and a report is built for each half, recursively. Every resulting report
+// contains the URLs and IP captures of its own uploads.
+func (r *Reporter) buildSizedReportsForUploads(date time.Time, portalURL, user string, uploads []accounts.UploadInfo) []report {
+	rep := r.buildReportForUploads(date, portalURL, user, uploads)
+	if len(uploads) <= 1 || r.staticOptions.MaxReportSize <= 0 {
+		return []report{rep}
+	}
+
+	// estimate the size of the report
+	reportBytes, err := xml.Marshal(rep)
+	if err != nil || len(reportBytes) <= r.staticOptions.MaxReportSize {
+		return []report{rep}
+	}
+
+	// split the uploads
+	half := len(uploads) / 2
+	return append(
+		r.buildSizedReportsForUploads(date, portalURL, user, uploads[:half]),
+		r.buildSizedReportsForUploads(date, portalURL, user, uploads[half:])...,
+	)
+}
+
+// fetchUploadInfos fetches the upload infos for all given skylinks, keyed by
+// skylink. It uses the batch endpoint and falls back to fetching the upload
+// info per skylink if the batch request fails. Lookups that fail do not abort
+// the fetch, instead the skylinks for which the lookup failed are returned.
+// Lookups that time out are considered transient, they do abort the fetch so
+// the email can be retried later. Every lookup is guarded by the accounts API
+// circuit breaker, if it is open the fetch is aborted with
+// errAccountsBreakerOpen.
+func (r *Reporter) fetchUploadInfos(skylinks []string) (map[string][]accounts.UploadInfo, []string, error) {
 	// convenience variables
-	portalURL := r.staticPortalURL
+	breaker := r.staticAccountsBreaker
+	logger := r.staticLogger
+
+	if len(skylinks) == 0 {
+		return nil, nil, nil
+	}
+
+	// try the batch endpoint first
+	if !breaker.Allow() {
+		return nil, nil, errAccountsBreakerOpen
+	}
+	uploadInfos, err := r.staticAccountsClient.UploadInfoBatchPOST(r.staticCtx, skylinks)
+	if err == nil {
+		r.recordAccountsSuccess()
+		return uploadInfos, nil, nil
+	}
+	if errors.Contains(err, accounts.ErrBatchUnsupported) {
+		r.recordAccountsSuccess()
+		logger.Debugf("batch upload info endpoint not supported, falling back to fetching upload info for %v skylinks one by one", len(skylinks))
+	} else {
+		r.recordAccountsFailure()
+		logger.Errorf("failed to fetch upload info in batch, falling back to fetching upload info for %v skylinks one by one, err %v", len(skylinks), err)
+	}
+
+	// fall back to fetching the upload info per skylink
+	var failed []string
+	uploadInfos = make(map[string][]accounts.UploadInfo, len(skylinks))
+	for _, skylink := range skylinks {
+		if !breaker.Allow() {
+			return nil, nil, errAccountsBreakerOpen
+		}
+		infos, err := r.staticAccountsClient.UploadInfoGET(r.staticCtx, skylink)
+		if errors.Contains(err, accounts.ErrUploadInfoTruncated) {
+			logger.WithField("skylink", skylink).Warnf("upload info might be incomplete, reporting the %v uploads we fetched, err %v", len(infos), err)
+			err = nil
+		}
+		if errors.Contains(err, accounts.ErrUploadInfoNotFound) {
+			r.recordAccountsSuccess()
+			logger.WithField("skylink", skylink).Debug("no upload info found, the skylink is reported anonymously")
+			continue
+		}
+		if errors.Contains(err, accounts.ErrTimeout) {
+			if r.recordAccountsFailure() {
+				return nil, nil, errAccountsBreakerOpen
+			}
+			return nil, nil, errors.AddContext(err, fmt.Sprintf("upload info lookup for skylink %v timed out", skylink))
+		}
+		if errors.Contains(err, accounts.ErrInvalidResponse) {
+			r.recordAccountsSuccess()
+			logger.WithField("skylink", skylink).Errorf("accounts API returned invalid upload info, err %v", err)
+			failed = append(failed, skylink)
+			continue
+		}
+		if err != nil {
+			if r.recordAccountsFailure() {
+				return nil, nil, errAccountsBreakerOpen
+			}
+			r.staticLogSuppressor.Errorf(logger.WithField("skylink", skylink), "failed to fetch upload info, err %v", err)
+			failed = append(failed, skylink)
+			continue
+		}
+		r.recordAccountsSuccess()
+		uploadInfos[skylink] = infos
+	}
+	return uploadInfos, failed, nil
+}
+
+// recordAccountsFailure records a failed request to the accounts API in the
+// circuit breaker, it returns true if the breaker is open. Requests that fail
+// because the reporter is shutting down are not recorded.
+func (r *Reporter) recordAccountsFailure() bool {
+	if r.staticCtx.Err() != nil {
+		return false
+	}
+	if r.staticAccountsBreaker.RecordFailure() {
+		r.staticLogger.Warnf("Accounts API circuit breaker opened, skylinks are reported anonymously for at least %v", r.staticOptions.AccountsBreakerCooldown)
+	}
+	return r.staticAccountsBreaker.State() == utils.BreakerOpen
+}
 
+// recordAccountsSuccess records a successful request to the accounts API in
+// the circuit breaker.
+func (r *Reporter) recordAccountsSuccess() {
+	if r.staticAccountsBreaker.RecordSuccess() {
+		r.staticLogger.Infoln("Accounts API circuit breaker closed, uploader attribution resumed")
+	}
+}
+
+// buildReportForUploads takes an email and a set of uploads and returns an
+// NCMEC report, the reported URLs point to the given portal.
+func (r *Reporter) buildReportForUploads(date time.Time, portalURL, user string, uploads []accounts.UploadInfo) report {
 	// construct the urls
 	var urls []string
 	for _, upload := range uploads {
-		urls = append(urls, fmt.Sprintf("%s/%s", portalURL, upload.Skylink))
+		urls = append(urls, skylink.ToPortalURL(portalURL, upload.Skylink))
 	}
 
 	// create the report
 	report := report{
 		IncidentSummary: ncmecIncidentSummary{
-			IncidentType:     "Child Pornography (possession, manufacture, and distribution)",
+			IncidentType:     ncmecIncidentTypeCSAM,
 			IncidentDateTime: date.Format(time.RFC3339),
 		},
 		InternetDetails: ncmecInternetDetails{
@@ -289,7 +739,8 @@ func (r *Reporter) buildReportForUploads(date time.Time, user string, uploads []
 				Url:                     urls,
 			},
 		},
-		Reporter: r.staticReporter,
+		Reporter:       r.staticReporter,
+		AdditionalInfo: reportAdditionalInfo(),
 	}
 
 	// return early if we don't have any uploader info
@@ -323,9 +774,44 @@ func (r *Reporter) buildReportForUploads(date time.Time, user string, uploads []
 	return report
 }
 
+// reportAdditionalInfo is a helper function that returns the additional info
+// of the NCMEC reports, it mentions the version of the scanner.
+func reportAdditionalInfo() string {
+	return fmt.Sprintf("Reported by %v.", version.Current())
+}
+
+// updateUnfiledReportsMetrics counts the reports that have not been filed and
+// records them in the metrics, failed reports are logged as they are never
+// retried and require manual intervention.
+func (r *Reporter) updateUnfiledReportsMetrics() {
+	pending, failed, err := r.staticAbuseDatabase.CountUnfiledReports()
+	if err != nil {
+		r.staticLogger.Errorf("Failed counting unfiled NCMEC reports, error %v", err)
+		return
+	}
+	metrics.RecordUnfiledReports(pending, failed)
+	if failed > 0 {
+		r.staticLogger.Warnf("Found %v NCMEC reports that failed to get filed, they require manual intervention", failed)
+		r.escalate("NCMEC reports failed to get filed", []notifier.Field{
+			{Name: "Failed Reports", Value: fmt.Sprint(failed)},
+			{Name: "Pending Reports", Value: fmt.Sprint(pending)},
+		})
+	}
+}
+
+// escalate notifies the on-call of a problem with filing the NCMEC reports that
+// requires manual intervention.
+func (r *Reporter) escalate(title string, fields []notifier.Field) {
+	err := r.staticOptions.Notifier.Notify(notifier.SeverityCritical, title, fields)
+	if err != nil {
+		r.staticLogger.Errorf("Failed to escalate '%v', error %v", title, err)
+	}
+}
+
 // fileReports fetches all reports from the database that have not been
-// successfully reported yet to NCMEC.
-func (r *Reporter) fileReports() {
+// successfully reported yet to NCMEC. It returns the amount of reports it
+// filed.
+func (r *Reporter) fileReports() (filed int) {
 	// convenience variables
 	abuseDB := r.staticAbuseDatabase
 	logger := r.staticLogger
@@ -334,25 +820,34 @@ func (r *Reporter) fileReports() {
 	unfiled, err := abuseDB.FindUnfiledReports()
 	if err != nil {
 		logger.Errorf("Failed fetching unreported emails, error %v", err)
-		return
+		return filed
 	}
 
 	// log unreported message count
 	numUnfiled := len(unfiled)
 	if numUnfiled == 0 {
 		logger.Debugf("Found %v unfiled NCMEC reports", numUnfiled)
-		return
+		return filed
 	}
 
 	logger.Infof("Found %v unfiled NCMEC reports", numUnfiled)
 
-	// loop over all unfiled reports and file them with NCMEC
-	for _, report := range unfiled {
+	// loop over all unfiled reports and file them with NCMEC, if NCMEC
+	// responds with a code that requires us to back off we stop filing and
+	// file the remaining reports in the next iteration
+	for i, report := range unfiled {
 		err := r.fileReport(report)
-		if err != nil {
-			logger.Infof("Failed filing report, err %v", err)
+		if err == nil {
+			filed++
+			continue
+		}
+		logger.Infof("Failed filing report, err %v", err)
+		if ncmecErrorAction(err) == NCMECActionBackoff {
+			logger.Warnf("Backing off, %v NCMEC reports are filed in the next iteration", numUnfiled-i)
+			return filed
 		}
 	}
+	return filed
 }
 
 // fileReport will open the report with NCMEC and immediately finish it
@@ -406,6 +901,12 @@ func (r *Reporter) fileReport(report database.NCMECReport) error {
 		return err
 	}
 
+	// attach the evidence screenshots, if that fails we still file the
+	// report with only the urls
+	if err == nil {
+		r.attachScreenshots(report, reportId)
+	}
+
 	// set the report id and finish the report
 	report.ReportID = reportId
 	err = r.finishReport(report)
@@ -417,6 +918,82 @@ func (r *Reporter) fileReport(report database.NCMECReport) error {
 	return nil
 }
 
+// attachScreenshots uploads the evidence screenshots of the skylinks in the
+// given report to the open report with given id, and links every screenshot to
+// the url of its skylink. Screenshots are only attached to CSAM reports.
+// Failures are logged, as they must not prevent the report from being filed.
+func (r *Reporter) attachScreenshots(entity database.NCMECReport, reportId uint64) {
+	// convenience variables
+	screenshots := r.staticOptions.Screenshots
+	logger := r.staticLogger.WithField("report_id", reportId)
+	if screenshots == nil {
+		return
+	}
+
+	// unmarshal the report
+	var report report
+	err := xml.Unmarshal([]byte(entity.Report), &report)
+	if err != nil {
+		logger.Errorf("failed to unmarshal report, err %v", err)
+		return
+	}
+	if report.IncidentSummary.IncidentType != ncmecIncidentTypeCSAM {
+		return
+	}
+
+	var attached int
+	for _, url := range report.InternetDetails.WebPageIncident.Url {
+		skylink := path.Base(url)
+		if len(loadSkylinks([]string{skylink})) != 1 {
+			continue
+		}
+
+		screenshot, found, err := screenshots.Screenshot(skylink)
+		if err != nil {
+			logger.Warnf("failed to load screenshot of skylink %v, err %v", skylink, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		err = r.attachScreenshot(reportId, skylink, url, screenshot)
+		if err != nil {
+			logger.Warnf("failed to attach screenshot of skylink %v, err %v", skylink, err)
+			continue
+		}
+		attached++
+	}
+	if attached > 0 {
+		logger.Infof("attached %v screenshots to report", attached)
+	}
+}
+
+// attachScreenshot uploads the given screenshot of the given skylink to the
+// open report with given id, and describes it as the content found at the
+// given url.
+func (r *Reporter) attachScreenshot(reportId uint64, skylink, url string, screenshot []byte) error {
+	filename := fmt.Sprintf("%s.png", skylink)
+	upload, err := r.staticClient.uploadFile(reportId, filename, screenshot)
+	if err == nil && upload.ResponseCode != ncmecStatusOK {
+		err = fmt.Errorf("unexpected response code %v when uploading file", upload.ResponseCode)
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := r.staticClient.fileInfo(fileDetails{
+		ReportId:         reportId,
+		FileId:           upload.FileId,
+		OriginalFileName: filename,
+		LocationOfFile:   url,
+		AdditionalInfo:   "Screenshot of the content at the reported url, captured when it got blocked.",
+	})
+	if err == nil && res.ResponseCode != ncmecStatusOK {
+		err = fmt.Errorf("unexpected response code %v when describing file %v", res.ResponseCode, upload.FileId)
+	}
+	return err
+}
+
 // finishReport will finish the report with NCMEC
 func (r *Reporter) finishReport(report database.NCMECReport) error {
 	// convenience variables
@@ -426,7 +1003,22 @@ func (r *Reporter) finishReport(report database.NCMECReport) error {
 	var reportErr string
 	res, err := r.staticClient.finishReport(report.ReportID)
 	if err == nil && res.ResponseCode != ncmecStatusOK {
-		err = fmt.Errorf("unexpected response code %v when finishing report '%v'", res.ResponseCode, report.ID.Hex())
+		err = r.newResponseError(res.ResponseCode, fmt.Sprintf("when finishing report '%v'", report.ID.Hex()))
+	}
+
+	// if the report is retried we only persist the report id, that way we
+	// try to finish the same report again instead of opening a new one
+	if err != nil && ncmecErrorAction(err) != NCMECActionFail {
+		logger.Warnf("failed to finish report %v, it will be retried, err '%v'", report.ReportID, err)
+		updateErr := r.staticAbuseDatabase.UpdateReportNoLock(report, bson.M{
+			"$set": bson.M{
+				"report_id": report.ReportID,
+			},
+		})
+		if updateErr != nil {
+			logger.Errorf("failed to update report %v, err '%v'", report.ID, updateErr)
+		}
+		return err
 	}
 	if err != nil {
 		reportErr = err.Error()
@@ -434,7 +1026,7 @@ func (r *Reporter) finishReport(report database.NCMECReport) error {
 	}
 
 	// update the email and set the report err and reported flag
-	err = r.staticAbuseDatabase.UpdateReportNoLock(report, bson.M{
+	updateErr := r.staticAbuseDatabase.UpdateReportNoLock(report, bson.M{
 		"$set": bson.M{
 			"filed":     err == nil,
 			"filed_at":  time.Now().UTC(),
@@ -443,9 +1035,15 @@ func (r *Reporter) finishReport(report database.NCMECReport) error {
 			"report_id": report.ReportID,
 		},
 	})
+	if updateErr != nil {
+		logger.Errorf("failed to update report %v, err '%v'", report.ID, updateErr)
+		return updateErr
+	}
+
+	// the report is failed permanently, it's stored as such but it was not
+	// filed so we return an error
 	if err != nil {
-		logger.Errorf("failed to update report %v, err '%v'", report.ID, err)
-		return err
+		return errors.Compose(errReportRejected, err)
 	}
 	return nil
 }
@@ -471,7 +1069,12 @@ func (r *Reporter) openReport(entity database.NCMECReport) (uint64, error) {
 	reportedAt := time.Now().UTC()
 	resp, err := r.staticClient.openReport(report)
 	if err == nil && resp.ResponseCode != ncmecStatusOK {
-		err = fmt.Errorf("unexpected response code %v when opening report '%v'", resp.ResponseCode, entity.ID.Hex())
+		err = r.newResponseError(resp.ResponseCode, fmt.Sprintf("when opening report '%v'", entity.ID.Hex()))
+	}
+	if err != nil && ncmecErrorAction(err) != NCMECActionFail {
+		// the report err is not set, so the report is retried
+		logger.Warnf("failed to open report, it will be retried, err '%v'", err)
+		return 0, err
 	}
 	if err != nil {
 		// update the email and set the report err
@@ -505,6 +1108,40 @@ func (r *Reporter) openReport(entity database.NCMECReport) (uint64, error) {
 	return reportId, nil
 }
 
+// newResponseError returns the error for the given unexpected response code of
+// the NCMEC API, it holds the action the reporter takes for that code. The
+// context describes the request that got the response.
+func (r *Reporter) newResponseError(code uint64, context string) error {
+	return ncmecResponseError{
+		action: r.responseAction(code),
+		code:   code,
+		msg:    fmt.Sprintf("unexpected response code %v %v", code, context),
+	}
+}
+
+// responseAction returns the action the reporter takes for the given response
+// code of the NCMEC API, the actions in the options take precedence over the
+// defaults. Unknown response codes fail the report.
+func (r *Reporter) responseAction(code uint64) string {
+	if action, exists := r.staticOptions.NCMECResponseActions[code]; exists {
+		return action
+	}
+	if action, exists := defaultNCMECResponseActions[code]; exists {
+		return action
+	}
+	return NCMECActionFail
+}
+
+// ncmecErrorAction returns the action the reporter takes for the given error,
+// errors that are not caused by an unexpected response code of the NCMEC API
+// fail the report.
+func ncmecErrorAction(err error) string {
+	if respErr, ok := err.(ncmecResponseError); ok {
+		return respErr.action
+	}
+	return NCMECActionFail
+}
+
 // threadedBuildReports will periodically fetch messages that have been tagged
 // as csam and have not been converted into NCMEC reports yet.
 func (r *Reporter) threadedBuildReports() {
@@ -515,9 +1152,13 @@ func (r *Reporter) threadedBuildReports() {
 	ticker := time.NewTicker(reportingFrequency)
 
 	// start the loop
+	guard := newLoopGuard(ModuleReporter, r.staticOptions.Notifier, logger)
 	for {
 		logger.Debugln("threadedBuildReports loop iteration triggered")
-		r.buildReports()
+		metrics.RecordLoopIteration(ModuleReporter, reportingFrequency)
+		if !runIterationUnlessPaused(r.staticStopChan, guard, r.staticOptions.Pause, func() { r.buildReports() }) {
+			return
+		}
 
 		select {
 		case <-r.staticStopChan:
@@ -538,23 +1179,42 @@ func (r *Reporter) threadedFileReports() {
 	ticker := time.NewTicker(ncmecFileFrequency)
 
 	// start the loop
+	guard := newLoopGuard(ModuleReporter, r.staticOptions.Notifier, logger)
 	for {
-		func() {
+		ok := guard.Run(r.staticStopChan, func() {
 			logger.Debugln("threadedFileReports loop iteration triggered")
+			metrics.RecordLoopIteration(ModuleReporter, ncmecFileFrequency)
 
-			// check the status endpoint before filing reports
-			res, err := r.staticClient.status()
-			if err != nil {
-				logger.Errorf("unexpected response from NCMEC API, err %v, skipping filing reports", err)
+			// update the backlog metrics, even if NCMEC is unreachable
+			r.updateUnfiledReportsMetrics()
+
+			// no reports are filed while the processing is paused
+			if isPaused(r.staticOptions.Pause) {
+				logger.Debugln("Processing is paused, skipping filing reports")
 				return
 			}
-			if res.ResponseCode != ncmecStatusOK {
-				logger.Errorf("unexpected status response from NCMEC API, status %v, skipping filing reports", res.ResponseCode)
+
+			// reports are only filed by the leader
+			if !isLeader(r.staticOptions.FilingLeader) {
+				logger.Debugln("Not the filing leader, skipping filing reports")
+				return
+			}
+
+			// check the status endpoint before filing reports
+			err := r.managedCheckNCMECHealth()
+			if err != nil {
+				logger.Errorf("%v, skipping filing reports", err)
+				r.escalate("NCMEC API unavailable, reports are not being filed", []notifier.Field{
+					{Name: "Error", Value: err.Error()},
+				})
 				return
 			}
 
 			r.fileReports()
-		}()
+		})
+		if !ok {
+			return
+		}
 
 		select {
 		case <-r.staticStopChan:
@@ -564,3 +1224,17 @@ func (r *Reporter) threadedFileReports() {
 		}
 	}
 }
+
+// skylinkVersion is a helper function that returns the version of the given
+// skylink, either SkylinkVersionV1 or SkylinkVersionV2. It returns an empty
+// string if the skylink fails to load.
+func skylinkVersion(sl string) string {
+	isV2, ok := skylink.IsV2(sl)
+	if !ok {
+		return ""
+	}
+	if isV2 {
+		return SkylinkVersionV2
+	}
+	return SkylinkVersionV1
+}
@@ -2,19 +2,33 @@ package email
 
 import (
 	"abuse-scanner/accounts"
+	"abuse-scanner/accounts/accountstest"
 	"abuse-scanner/database"
+	"abuse-scanner/utils"
 	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.sia.tech/siad/build"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
 )
 
 const (
@@ -30,48 +44,133 @@ var (
 	ul1 = time.Now().Add(-time.Hour).UTC()
 	ul2 = time.Now().Add(-2 * time.Hour).UTC()
 	ul3 = time.Now().Add(-3 * time.Hour).UTC()
+
+	// upload and user ids used in testing
+	uploadID1 = primitive.NewObjectID()
+	uploadID2 = primitive.NewObjectID()
+	uploadID3 = primitive.NewObjectID()
+	userID1   = primitive.NewObjectID()
+	userID2   = primitive.NewObjectID()
 )
 
 type (
 	// mockAccountsClient is a simple struct that allows mocking the accounts
-	// API.
-	mockAccountsClient struct{}
+	// API. It's used by the unit tests that need precise control over the
+	// errors the accounts client returns, all other tests use the fake
+	// accounts API from the accountstest package.
+	mockAccountsClient struct {
+		// batchSupported indicates whether the mock supports the batch
+		// upload info endpoint
+		batchSupported bool
+
+		// batchCalls and getCalls keep track of the amount of times the
+		// endpoints got called, they are optional
+		batchCalls *uint64
+		getCalls   *uint64
+
+		// timingOut is a skylink for which the lookup times out
+		timingOut string
+
+		// truncated is a skylink for which the upload info is returned
+		// alongside ErrUploadInfoTruncated
+		truncated string
+
+		// healthErr is the error returned by the health check
+		healthErr error
+	}
 )
 
+// HealthGET mocks the API response
+func (m mockAccountsClient) HealthGET(_ context.Context) error {
+	return m.healthErr
+}
+
+// UploadInfoBatchPOST mocks the API response
+func (m mockAccountsClient) UploadInfoBatchPOST(_ context.Context, skylinks []string) (map[string][]accounts.UploadInfo, error) {
+	if m.batchCalls != nil {
+		atomic.AddUint64(m.batchCalls, 1)
+	}
+	if !m.batchSupported {
+		return nil, accounts.ErrBatchUnsupported
+	}
+	infos := make(map[string][]accounts.UploadInfo)
+	for _, skylink := range skylinks {
+		info, err := mockUploadInfo(skylink)
+		if err != nil {
+			return nil, err
+		}
+		if len(info) > 0 {
+			infos[skylink] = info
+		}
+	}
+	return infos, nil
+}
+
 // UploadInfoGET mocks the API response
-func (m mockAccountsClient) UploadInfoGET(skylink string) ([]accounts.UploadInfo, error) {
+func (m mockAccountsClient) UploadInfoGET(_ context.Context, skylink string) ([]accounts.UploadInfo, error) {
+	if m.getCalls != nil {
+		atomic.AddUint64(m.getCalls, 1)
+	}
+	if skylink == m.timingOut {
+		return nil, accounts.ErrTimeout
+	}
+
+	// mock the accounts client, which returns a typed error if there's no
+	// upload info for the skylink
+	infos, err := mockUploadInfo(skylink)
+	if err == nil && len(infos) == 0 {
+		return nil, accounts.ErrUploadInfoNotFound
+	}
+	if err == nil && skylink == m.truncated {
+		return infos, accounts.ErrUploadInfoTruncated
+	}
+	return infos, err
+}
+
+// mockUploadInfo returns the mocked upload info for the given skylink
+func mockUploadInfo(skylink string) ([]accounts.UploadInfo, error) {
 	switch skylink {
 	case sl1:
 		return []accounts.UploadInfo{
 			{
-				Skylink:   sl1,
-				IP:        "81.196.117.164",
-				CreatedAt: ul1,
+				UploadID:   uploadID1,
+				Skylink:    sl1,
+				IP:         "81.196.117.164",
+				PortalName: "siasky.net",
+				CreatedAt:  ul1,
 				UploaderInfo: accounts.UploaderInfo{
-					Sub:   "user_1_sub",
-					Email: "user.one@gmail.com",
+					UserID: userID1,
+					Sub:    "user_1_sub",
+					Email:  "user.one@gmail.com",
 				},
 			},
 		}, nil
 	case sl2:
 		return []accounts.UploadInfo{
 			{
-				Skylink:   sl2,
-				IP:        "", // no IP
-				CreatedAt: ul2,
+				UploadID:   uploadID2,
+				Skylink:    sl2,
+				IP:         "", // no IP
+				PortalName: "siasky.net",
+				Unpinned:   true,
+				CreatedAt:  ul2,
 				UploaderInfo: accounts.UploaderInfo{
-					Sub:   "user_1_sub",
-					Email: "user.one@gmail.com",
+					UserID: userID1,
+					Sub:    "user_1_sub",
+					Email:  "user.one@gmail.com",
 				},
 			},
 		}, nil
 	case sl3:
 		return []accounts.UploadInfo{
 			{
-				Skylink:   sl3,
-				IP:        "13.192.32.50",
-				CreatedAt: ul3,
+				UploadID:   uploadID3,
+				Skylink:    sl3,
+				IP:         "13.192.32.50",
+				PortalName: "siasky.net",
+				CreatedAt:  ul3,
 				UploaderInfo: accounts.UploaderInfo{
+					UserID:   userID2,
 					Sub:      "user_2_sub",
 					Email:    "user.two@gmail.com",
 					StripeID: "stripe_id_user_2",
@@ -97,6 +196,62 @@ func TestReporter(t *testing.T) {
 		name string
 		test func(t *testing.T)
 	}{
+		{
+			name: "AccountsHealth",
+			test: testAccountsHealth,
+		},
+		{
+			name: "AttachScreenshots",
+			test: testAttachScreenshots,
+		},
+		{
+			name: "BuildReportsBreaker",
+			test: testBuildReportsBreaker,
+		},
+		{
+			name: "BuildReportsBatch",
+			test: testBuildReportsBatch,
+		},
+		{
+			name: "BuildReportsFallback",
+			test: testBuildReportsFallback,
+		},
+		{
+			name: "BuildReportsLookupFailure",
+			test: testBuildReportsLookupFailure,
+		},
+		{
+			name: "BuildReportsPortal",
+			test: testBuildReportsPortal,
+		},
+		{
+			name: "BuildReportsShutdown",
+			test: testBuildReportsShutdown,
+		},
+		{
+			name: "BuildReportsTimeout",
+			test: testBuildReportsTimeout,
+		},
+		{
+			name: "BuildReportsTruncated",
+			test: testBuildReportsTruncated,
+		},
+		{
+			name: "BuildReportsUploadInfo",
+			test: testBuildReportsUploadInfo,
+		},
+		{
+			name: "BuildReportsSplit",
+			test: testBuildReportsSplit,
+		},
+		{
+			name: "BuildReportsSkylinkVersions",
+			test: testBuildReportsSkylinkVersions,
+		},
+		{
+			name: "FileReportsResponseCodes",
+			test: testFileReportsResponseCodes,
+		},
 		{
 			name: "Reporter",
 			test: testReporter,
@@ -107,6 +262,721 @@ func TestReporter(t *testing.T) {
 	}
 }
 
+// testAttachScreenshots verifies the evidence screenshots of the skylinks in a
+// CSAM report are uploaded to the open report and linked to their url, and
+// that a screenshot that fails to upload is skipped.
+func testAttachScreenshots(t *testing.T) {
+	t.Parallel()
+
+	// store a screenshot for all but one skylink
+	dir := t.TempDir()
+	for _, skylink := range []string{sl1, sl2, sl4} {
+		err := ioutil.WriteFile(filepath.Join(dir, skylink+".png"), []byte("screenshot of "+skylink), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// create a stubbed NCMEC API that fails to upload the screenshot of sl2
+	var mu sync.Mutex
+	var uploads []string
+	var details []fileDetails
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload":
+			file, header, err := r.FormFile("file")
+			if err != nil || r.FormValue("id") != "42" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			content, _ := ioutil.ReadAll(file)
+			if string(content) != "screenshot of "+strings.TrimSuffix(header.Filename, ".png") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			uploads = append(uploads, header.Filename)
+			mu.Unlock()
+			code := ncmecStatusOK
+			if header.Filename == sl2+".png" {
+				code = ncmecStatusValidationFailed
+			}
+			fmt.Fprintf(w, "<reportResponse><responseCode>%v</responseCode><reportId>42</reportId><fileId>file-%v</fileId></reportResponse>", code, header.Filename)
+		case "/fileinfo":
+			var d fileDetails
+			err := xml.NewDecoder(r.Body).Decode(&d)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			details = append(details, d)
+			mu.Unlock()
+			fmt.Fprint(w, "<reportResponse><responseCode>0</responseCode><reportId>42</reportId></reportResponse>")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	r := newTestReporterModule(nil)
+	r.staticClient = &NCMECClient{staticBaseUri: server.URL, staticHTTPClient: server.Client()}
+	r.staticOptions.Screenshots = ScreenshotDir(dir)
+
+	// newReport is a helper that returns a report for the test skylinks with
+	// the given incident type
+	newReport := func(incidentType string) database.NCMECReport {
+		report := r.buildReportForUploads(time.Now().UTC(), "https://siasky.net", anonUser, []accounts.UploadInfo{{Skylink: sl1}, {Skylink: sl2}, {Skylink: sl3}, {Skylink: sl4}})
+		report.IncidentSummary.IncidentType = incidentType
+		reportBytes, err := xml.Marshal(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return database.NCMECReport{ID: primitive.NewObjectID(), Report: string(reportBytes)}
+	}
+
+	// assert the screenshots are only attached to CSAM reports
+	r.attachScreenshots(newReport("Online Enticement of Children for Sexual Acts"), 42)
+	if len(uploads) != 0 {
+		t.Fatal("unexpected uploads", uploads)
+	}
+
+	// assert every available screenshot got uploaded, but only the ones
+	// that uploaded successfully got described
+	r.attachScreenshots(newReport(ncmecIncidentTypeCSAM), 42)
+	if !reflect.DeepEqual(uploads, []string{sl1 + ".png", sl2 + ".png", sl4 + ".png"}) {
+		t.Fatal("unexpected uploads", uploads)
+	}
+	if len(details) != 2 {
+		t.Fatal("unexpected file details", details)
+	}
+	for i, skylink := range []string{sl1, sl4} {
+		d := details[i]
+		if d.ReportId != 42 || d.FileId != ncmecFileId("file-"+skylink+".png") || d.LocationOfFile != "https://siasky.net/"+skylink {
+			t.Fatal("unexpected file details", d)
+		}
+	}
+
+	// assert the screenshot dir only accepts skylinks
+	_, _, err := ScreenshotDir(dir).Screenshot("../" + sl1)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	_, found, err := ScreenshotDir(dir).Screenshot(sl3)
+	if err != nil || found {
+		t.Fatal("unexpected screenshot", found, err)
+	}
+}
+
+// testBuildReportsBatch verifies the reporter fetches the upload info using
+// the batch endpoint if the accounts service supports it.
+func testBuildReportsBatch(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAccountsServer()
+	defer server.Close()
+	server.SetBatchSupported(true)
+	r := newTestReporterModule(newTestAccountsClient(t, server))
+
+	reports, failed, err := r.buildReportsForEmailInner(newTestCSAMEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatal("unexpected failed lookups", failed)
+	}
+	assertTestReports(t, reports)
+
+	batchCalls := server.Calls(accountstest.EndpointBatch)
+	getCalls := server.Calls(accountstest.EndpointUploadInfo)
+	if batchCalls != 1 || getCalls != 0 {
+		t.Fatalf("unexpected calls, %v batch calls and %v get calls", batchCalls, getCalls)
+	}
+}
+
+// testBuildReportsBreaker verifies the reporter keeps building reports, with
+// anonymous attribution, while the accounts API circuit breaker is open, and
+// that it resumes the attribution once the accounts API recovered.
+func testBuildReportsBreaker(t *testing.T) {
+	t.Parallel()
+
+	// create a failing accounts API
+	server := newTestAccountsServer()
+	defer server.Close()
+	server.SetBatchSupported(true)
+	server.SetErrorRate(1)
+
+	// create a reporter of which the breaker opens after two failures
+	cooldown := 100 * time.Millisecond
+	r := newTestReporterModule(newTestAccountsClient(t, server))
+	r.staticAccountsBreaker = utils.NewCircuitBreaker(2, cooldown)
+	r.staticOptions.AccountsBreakerCooldown = cooldown
+	r.staticOptions.AccountsBreakerThreshold = 2
+
+	// assertAnonReports is a helper that asserts all skylinks are reported
+	// anonymously in a single annotated report
+	email := newTestCSAMEmail()
+	assertAnonReports := func(reports []report, failed []string) {
+		t.Helper()
+		if !reflect.DeepEqual(failed, email.ParseResult.Skylinks) {
+			t.Fatal("unexpected failed lookups", failed)
+		}
+		if len(reports) != 1 {
+			t.Fatalf("unexpected number of reports, %v != 1", len(reports))
+		}
+		if len(reports[0].InternetDetails.WebPageIncident.Url) != len(email.ParseResult.Skylinks) {
+			t.Fatal("unexpected urls", reports[0].InternetDetails.WebPageIncident.Url)
+		}
+		if reports[0].Uploader.UserReported.Email != "" || reports[0].Uploader.AdditionalInfo != attributionUnavailableInfo {
+			t.Fatal("unexpected uploader", reports[0].Uploader)
+		}
+	}
+
+	// assert the failed batch and the first failed lookup open the breaker,
+	// and that the reports are still built
+	reports, failed, err := r.buildReportsForEmailInner(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnonReports(reports, failed)
+	if r.AccountsBreakerState() != utils.BreakerOpen {
+		t.Fatal("unexpected breaker state", r.AccountsBreakerState())
+	}
+	batchCalls := server.Calls(accountstest.EndpointBatch)
+	getCalls := server.Calls(accountstest.EndpointUploadInfo)
+	if batchCalls != 1 || getCalls != 1 {
+		t.Fatalf("unexpected calls, %v batch calls and %v get calls", batchCalls, getCalls)
+	}
+
+	// assert the accounts API is not called while the breaker is open
+	reports, failed, err = r.buildReportsForEmailInner(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAnonReports(reports, failed)
+	if server.Calls(accountstest.EndpointBatch) != batchCalls || server.Calls(accountstest.EndpointUploadInfo) != getCalls {
+		t.Fatal("unexpected calls while the breaker is open")
+	}
+
+	// recover the accounts API and assert the trial request closes the
+	// breaker once the cooldown elapsed
+	server.SetErrorRate(0)
+	time.Sleep(cooldown)
+	if r.AccountsBreakerState() != utils.BreakerHalfOpen {
+		t.Fatal("unexpected breaker state", r.AccountsBreakerState())
+	}
+	reports, failed, err = r.buildReportsForEmailInner(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatal("unexpected failed lookups", failed)
+	}
+	assertTestReports(t, reports)
+	if r.AccountsBreakerState() != utils.BreakerClosed {
+		t.Fatal("unexpected breaker state", r.AccountsBreakerState())
+	}
+}
+
+// testBuildReportsFallback verifies the reporter falls back to fetching the
+// upload info per skylink if the batch endpoint is not supported.
+func testBuildReportsFallback(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAccountsServer()
+	defer server.Close()
+	r := newTestReporterModule(newTestAccountsClient(t, server))
+
+	// note that there's no upload info for sl4, which should not be
+	// considered a failed lookup but should be reported anonymously
+	reports, failed, err := r.buildReportsForEmailInner(newTestCSAMEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatal("unexpected failed lookups", failed)
+	}
+	assertTestReports(t, reports)
+
+	batchCalls := server.Calls(accountstest.EndpointBatch)
+	getCalls := server.Calls(accountstest.EndpointUploadInfo)
+	if batchCalls != 1 || getCalls != 4 {
+		t.Fatalf("unexpected calls, %v batch calls and %v get calls", batchCalls, getCalls)
+	}
+}
+
+// testBuildReportsLookupFailure verifies the reporter still builds reports if
+// the upload info lookup fails for some of the skylinks, those skylinks should
+// be attributed to the anonymous user.
+func testBuildReportsLookupFailure(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAccountsServer()
+	defer server.Close()
+	server.SetBatchSupported(true)
+	server.SetFailing(sl1, http.StatusInternalServerError)
+	r := newTestReporterModule(newTestAccountsClient(t, server))
+
+	reports, failed, err := r.buildReportsForEmailInner(newTestCSAMEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0] != sl1 {
+		t.Fatal("unexpected failed lookups", failed)
+	}
+
+	// assert the batch failure made us fall back to the per skylink lookup
+	batchCalls := server.Calls(accountstest.EndpointBatch)
+	getCalls := server.Calls(accountstest.EndpointUploadInfo)
+	if batchCalls != 1 || getCalls != 4 {
+		t.Fatalf("unexpected calls, %v batch calls and %v get calls", batchCalls, getCalls)
+	}
+
+	// assert we still have a report for every user
+	if len(reports) != 3 {
+		t.Fatalf("unexpected number of reports, %v != 3", len(reports))
+	}
+	urls := make(map[string][]string)
+	for _, report := range reports {
+		urls[report.Uploader.UserReported.Email] = report.InternetDetails.WebPageIncident.Url
+	}
+	expected := map[string][]string{
+		"user.one@gmail.com": {"https://siasky.net/" + sl2},
+		"user.two@gmail.com": {"https://siasky.net/" + sl3},
+		"":                   {"https://siasky.net/" + sl1, "https://siasky.net/" + sl4},
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatal("unexpected reports", urls)
+	}
+}
+
+// testAccountsHealth verifies the reporter records the accounts API health and
+// only fails the health check if it requires the accounts API to be healthy.
+func testAccountsHealth(t *testing.T) {
+	t.Parallel()
+
+	// healthy
+	r := newTestReporterModule(mockAccountsClient{})
+	err := r.managedCheckAccountsHealth()
+	if err != nil || r.AccountsHealth() != nil {
+		t.Fatal("unexpected error", err, r.AccountsHealth())
+	}
+
+	// unhealthy, warn but continue
+	r = newTestReporterModule(mockAccountsClient{healthErr: accounts.ErrUnhealthy})
+	err = r.managedCheckAccountsHealth()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !errors.Contains(r.AccountsHealth(), accounts.ErrUnhealthy) {
+		t.Fatal("unexpected accounts health", r.AccountsHealth())
+	}
+
+	// unhealthy, fail hard
+	r.staticOptions.RequireAccountsHealthy = true
+	err = r.managedCheckAccountsHealth()
+	if !errors.Contains(err, accounts.ErrUnhealthy) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testBuildReportsTimeout verifies the reporter does not build any reports if
+// an upload info lookup timed out, rather than attributing the skylink to the
+// anonymous user, so the email is retried later.
+func testBuildReportsTimeout(t *testing.T) {
+	t.Parallel()
+
+	var getCalls uint64
+	r := newTestReporterModule(mockAccountsClient{
+		getCalls:  &getCalls,
+		timingOut: sl2,
+	})
+
+	reports, failed, err := r.buildReportsForEmailInner(newTestCSAMEmail())
+	if !errors.Contains(err, accounts.ErrTimeout) {
+		t.Fatal("unexpected error", err)
+	}
+	if len(reports) != 0 || len(failed) != 0 {
+		t.Fatal("unexpected reports or failed lookups", reports, failed)
+	}
+
+	// assert the fetch was aborted after the timeout
+	if getCalls != 2 {
+		t.Fatal("unexpected amount of get calls", getCalls)
+	}
+}
+
+// testBuildReportsShutdown verifies the reporter does not build any reports if
+// it is shutting down, rather than attributing the skylinks for which the
+// lookups were aborted to the anonymous user.
+func testBuildReportsShutdown(t *testing.T) {
+	t.Parallel()
+
+	var batchCalls, getCalls uint64
+	r := newTestReporterModule(mockAccountsClient{
+		batchCalls: &batchCalls,
+		getCalls:   &getCalls,
+	})
+	r.staticCancel()
+
+	reports, failed, err := r.buildReportsForEmailInner(newTestCSAMEmail())
+	if !errors.Contains(err, context.Canceled) {
+		t.Fatal("unexpected error", err)
+	}
+	if len(reports) != 0 || len(failed) != 0 {
+		t.Fatal("unexpected reports or failed lookups", reports, failed)
+	}
+}
+
+// testBuildReportsTruncated verifies the reporter reports the upload info that
+// was fetched for a skylink if the upload info might be truncated, rather than
+// considering the lookup as failed.
+func testBuildReportsTruncated(t *testing.T) {
+	t.Parallel()
+
+	r := newTestReporterModule(mockAccountsClient{truncated: sl1})
+
+	reports, failed, err := r.buildReportsForEmailInner(newTestCSAMEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatal("unexpected failed lookups", failed)
+	}
+	assertTestReports(t, reports)
+}
+
+// testBuildReportsUploadInfo verifies the reporter reports upload infos without
+// uploader info anonymously, and that it considers the lookup of a skylink for
+// which the accounts API returns invalid upload info as failed.
+func testBuildReportsUploadInfo(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAccountsServer()
+	defer server.Close()
+	r := newTestReporterModule(newTestAccountsClient(t, server))
+
+	// mock an anonymous upload of sl2 and an upload info without skylink for
+	// sl3, which is invalid
+	server.SetUploadInfo(sl2, []accounts.UploadInfo{{
+		UploadID:   uploadID2,
+		Skylink:    sl2,
+		IP:         "81.196.117.165",
+		PortalName: "siasky.net",
+		CreatedAt:  ul2,
+	}})
+	server.SetUploadInfo(sl3, []accounts.UploadInfo{{
+		UploadID: uploadID3,
+		IP:       "13.192.32.50",
+	}})
+
+	reports, failed, err := r.buildReportsForEmailInner(newTestCSAMEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failed, []string{sl3}) {
+		t.Fatal("unexpected failed lookups", failed)
+	}
+
+	// assert sl2, sl3 and sl4 are reported anonymously, without IP captures
+	urls := make(map[string][]string)
+	for _, report := range reports {
+		email := report.Uploader.UserReported.Email
+		urls[email] = report.InternetDetails.WebPageIncident.Url
+		if email == "" && len(report.Uploader.IPCaptureEvent) != 0 {
+			t.Fatal("unexpected ip captures", report.Uploader.IPCaptureEvent)
+		}
+	}
+	expected := map[string][]string{
+		"user.one@gmail.com": {"https://siasky.net/" + sl1},
+		"":                   {"https://siasky.net/" + sl2, "https://siasky.net/" + sl3, "https://siasky.net/" + sl4},
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatal("unexpected reports", urls)
+	}
+}
+
+// testBuildReportsPortal verifies the reported URLs point to the portal the
+// skylinks were reported on, and to the primary portal if it was not detected
+// or if it's not one of our portals.
+func testBuildReportsPortal(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAccountsServer()
+	defer server.Close()
+	r := newTestReporterModule(newTestAccountsClient(t, server))
+
+	for _, test := range []struct {
+		detected string
+		expected string
+	}{
+		{"https://skyportal.xyz", "https://skyportal.xyz"},
+		{"", "https://siasky.net"},
+		{"https://unknown.example.com", "https://siasky.net"},
+	} {
+		email := newTestCSAMEmail()
+		email.ParseResult.Portal = test.detected
+		reports, _, err := r.buildReportsForEmailInner(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var urls []string
+		for _, report := range reports {
+			urls = append(urls, report.InternetDetails.WebPageIncident.Url...)
+		}
+		if len(urls) != len(email.ParseResult.Skylinks) {
+			t.Fatal("unexpected urls", urls)
+		}
+		for _, u := range urls {
+			if !strings.HasPrefix(u, test.expected+"/") {
+				t.Fatal("unexpected url", test.detected, u)
+			}
+		}
+	}
+}
+
+// testBuildReportsSkylinkVersions verifies the reporter only reports the
+// skylinks of the configured versions.
+func testBuildReportsSkylinkVersions(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAccountsServer()
+	defer server.Close()
+
+	// create an email with a mix of v1 and v2 skylinks
+	slV2 := skymodules.NewSkylinkV2(types.SiaPublicKey{}, crypto.HashObject("tweak")).String()
+	email := newTestCSAMEmail()
+	email.ParseResult.Skylinks = []string{sl1, slV2, sl2}
+
+	for _, test := range []struct {
+		versions []string
+		expected []string
+	}{
+		{nil, []string{sl1, sl2, slV2}},
+		{[]string{SkylinkVersionV1, SkylinkVersionV2}, []string{sl1, sl2, slV2}},
+		{[]string{SkylinkVersionV1}, []string{sl1, sl2}},
+		{[]string{SkylinkVersionV2}, []string{slV2}},
+	} {
+		r := newTestReporterModule(newTestAccountsClient(t, server))
+		r.staticOptions.SkylinkVersions = test.versions
+		reports, _, err := r.buildReportsForEmailInner(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// collect the reported skylinks from the reported URLs
+		var reported []string
+		for _, report := range reports {
+			for _, u := range report.InternetDetails.WebPageIncident.Url {
+				reported = append(reported, path.Base(u))
+			}
+		}
+		sort.Strings(reported)
+		sort.Strings(test.expected)
+		if !reflect.DeepEqual(reported, test.expected) {
+			t.Fatal("unexpected skylinks reported", test.versions, reported, test.expected)
+		}
+	}
+}
+
+// testBuildReportsSplit verifies the reporter splits reports that exceed the
+// max report size into multiple reports.
+func testBuildReportsSplit(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAccountsServer()
+	defer server.Close()
+	server.SetBatchSupported(true)
+	r := newTestReporterModule(newTestAccountsClient(t, server))
+
+	// set the max report size to the size of a report with a single upload,
+	// that way the report for user one, who uploaded two skylinks, has to be
+	// split in two
+	uploads, err := mockUploadInfo(sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := xml.Marshal(r.buildReportForUploads(time.Now().UTC(), "https://siasky.net", "user_1_sub", uploads))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.staticOptions.MaxReportSize = len(single)
+
+	reports, _, err := r.buildReportsForEmailInner(newTestCSAMEmail())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 4 {
+		t.Fatalf("unexpected number of reports, %v != 4", len(reports))
+	}
+
+	// assert every report contains a single url and only contains the IP
+	// captures of its own upload, the split reports of user one should be
+	// within the max size
+	for _, report := range reports {
+		urls := report.InternetDetails.WebPageIncident.Url
+		if len(urls) != 1 {
+			t.Fatal("unexpected urls", urls)
+		}
+		reportBytes, err := xml.Marshal(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Uploader.UserReported.Email == "user.one@gmail.com" && len(reportBytes) > r.staticOptions.MaxReportSize {
+			t.Fatalf("report exceeds max size, %v > %v", len(reportBytes), r.staticOptions.MaxReportSize)
+		}
+		ipCaptures := report.Uploader.IPCaptureEvent
+		switch urls[0] {
+		case "https://siasky.net/" + sl1:
+			if len(ipCaptures) != 1 || ipCaptures[0].IPAddress != "81.196.117.164" {
+				t.Fatal("unexpected ip captures", ipCaptures)
+			}
+		case "https://siasky.net/" + sl3:
+			if len(ipCaptures) != 1 || ipCaptures[0].IPAddress != "13.192.32.50" {
+				t.Fatal("unexpected ip captures", ipCaptures)
+			}
+		default:
+			if len(ipCaptures) != 0 {
+				t.Fatal("unexpected ip captures", ipCaptures)
+			}
+		}
+	}
+}
+
+// testFileReportsResponseCodes verifies the reporter handles the response codes
+// of the NCMEC API according to the action they map onto, a report that fails
+// validation fails permanently while a server error is retried.
+func testFileReportsResponseCodes(t *testing.T) {
+	t.Parallel()
+
+	// create a context w/timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// create the abuse database
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name()+"_AbuseDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := abuseDB.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// create a stubbed NCMEC API that responds with the given codes when a
+	// report is opened and finished
+	var submitCode, submitCalls, finishCode uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/submit":
+			atomic.AddUint64(&submitCalls, 1)
+			fmt.Fprintf(w, "<reportResponse><responseCode>%v</responseCode><reportId>42</reportId></reportResponse>", atomic.LoadUint64(&submitCode))
+		case "/finish":
+			fmt.Fprintf(w, "<reportDoneResponse><responseCode>%v</responseCode><reportId>42</reportId></reportDoneResponse>", atomic.LoadUint64(&finishCode))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	r := newTestReporterModule(nil)
+	r.staticAbuseDatabase = abuseDB
+	r.staticClient = &NCMECClient{staticBaseUri: server.URL, staticHTTPClient: server.Client()}
+
+	// insertReport is a helper that inserts an unfiled report
+	insertReport := func() database.NCMECReport {
+		t.Helper()
+		reportBytes, err := xml.Marshal(r.buildReportForUploads(time.Now().UTC(), "https://siasky.net", anonUser, []accounts.UploadInfo{{Skylink: sl1}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		report := database.NCMECReport{ID: primitive.NewObjectID(), Report: string(reportBytes), InsertedAt: time.Now().UTC()}
+		err = abuseDB.InsertReport(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	// assertUnfiled is a helper that asserts the amount of pending and failed
+	// reports
+	assertUnfiled := func(pending, failed int64) {
+		t.Helper()
+		p, f, err := abuseDB.CountUnfiledReports()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != pending || f != failed {
+			t.Fatalf("unexpected unfiled reports, %v pending and %v failed", p, f)
+		}
+	}
+
+	// assertFiled is a helper that files the unfiled reports and asserts the
+	// amount of reports that got filed
+	assertFiled := func(expected int) {
+		t.Helper()
+		if filed := r.fileReports(); filed != expected {
+			t.Fatalf("unexpected filed reports, %v != %v", filed, expected)
+		}
+	}
+
+	// assert a server error keeps the report pending
+	report := insertReport()
+	atomic.StoreUint64(&submitCode, ncmecStatusServerError)
+	assertFiled(0)
+	assertUnfiled(1, 0)
+
+	// assert a failed validation fails the report permanently
+	atomic.StoreUint64(&submitCode, ncmecStatusValidationFailed)
+	assertFiled(0)
+	assertUnfiled(0, 1)
+	current, err := abuseDB.FindReport(report.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Filed || !strings.Contains(current.FiledErr, fmt.Sprint(ncmecStatusValidationFailed)) {
+		t.Fatal("unexpected report", current)
+	}
+
+	// assert the reporter stops filing when it has to back off
+	insertReport()
+	insertReport()
+	atomic.StoreUint64(&submitCalls, 0)
+	atomic.StoreUint64(&submitCode, ncmecStatusNotAuthorized)
+	assertFiled(0)
+	if calls := atomic.LoadUint64(&submitCalls); calls != 1 {
+		t.Fatal("unexpected submit calls", calls)
+	}
+	assertUnfiled(2, 1)
+
+	// assert the options override the default actions, and that the
+	// pending reports get filed once NCMEC recovers
+	r.staticOptions.NCMECResponseActions = map[uint64]string{ncmecStatusNotAuthorized: NCMECActionRetry}
+	assertFiled(0)
+	if calls := atomic.LoadUint64(&submitCalls); calls != 3 {
+		t.Fatal("unexpected submit calls", calls)
+	}
+	assertUnfiled(2, 1)
+	atomic.StoreUint64(&submitCode, ncmecStatusOK)
+	assertFiled(2)
+	assertUnfiled(0, 1)
+
+	// assert a report that fails to finish permanently is stored as failed
+	// and is not counted as filed
+	report = insertReport()
+	atomic.StoreUint64(&finishCode, ncmecStatusValidationFailed)
+	assertFiled(0)
+	assertUnfiled(0, 2)
+	current, err = abuseDB.FindReport(report.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Filed || current.ReportID != 42 || !strings.Contains(current.FiledErr, fmt.Sprint(ncmecStatusValidationFailed)) {
+		t.Fatal("unexpected report", current)
+	}
+}
+
 // testReporter verifies the messages that contain csam get corresponding NCMEC
 // reports in the database and those reports get filed with NCMEC.
 //
@@ -140,7 +1010,7 @@ func testReporter(t *testing.T) {
 
 	// create the abuse databases
 	abuseDBName := t.Name() + "_AbuseDB"
-	abuseDB, err := database.NewTestAbuseScannerDB(ctx, abuseDBName)
+	abuseDB, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, abuseDBName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -150,10 +1020,13 @@ func testReporter(t *testing.T) {
 		}
 	}()
 
+	// create a fake accounts API
+	server := newTestAccountsServer()
+	defer server.Close()
+
 	// create a reporter
-	accountsMock := mockAccountsClient{}
 	reporter := newTestReporter()
-	r := NewReporter(abuseDB, accountsMock, creds, "https://siasky.net", "eu-pol-2.siasky.net", reporter, logger)
+	r := NewReporter(abuseDB, newTestAccountsClient(t, server), creds, []string{"https://siasky.net"}, "eu-pol-2.siasky.net", reporter, ReporterOptions{}, logger)
 
 	// insert an email to report
 	insertedAt := time.Now().UTC()
@@ -266,7 +1139,8 @@ func testReporter(t *testing.T) {
 				},
 			},
 		},
-		Reporter: newTestReporter(),
+		Reporter:       newTestReporter(),
+		AdditionalInfo: reportAdditionalInfo(),
 		Uploader: ncmecReportedPerson{
 			UserReported: ncmecPerson{
 				Email: "user.one@gmail.com",
@@ -293,7 +1167,8 @@ func testReporter(t *testing.T) {
 				},
 			},
 		},
-		Reporter: reporter,
+		Reporter:       reporter,
+		AdditionalInfo: reportAdditionalInfo(),
 		Uploader: ncmecReportedPerson{
 			UserReported: ncmecPerson{
 				Email: "user.two@gmail.com",
@@ -321,7 +1196,8 @@ func testReporter(t *testing.T) {
 				},
 			},
 		},
-		Reporter: reporter,
+		Reporter:       reporter,
+		AdditionalInfo: reportAdditionalInfo(),
 	}
 
 	// find NCMEC reports
@@ -354,6 +1230,91 @@ func testReporter(t *testing.T) {
 	}
 }
 
+// assertTestReports asserts the given reports are the reports we expect for
+// the email returned by newTestCSAMEmail, the reports are grouped per user.
+func assertTestReports(t *testing.T, reports []report) {
+	t.Helper()
+
+	if len(reports) != 3 {
+		t.Fatalf("unexpected number of reports, %v != 3", len(reports))
+	}
+
+	urls := make(map[string][]string)
+	for _, report := range reports {
+		urls[report.Uploader.UserReported.Email] = report.InternetDetails.WebPageIncident.Url
+	}
+	expected := map[string][]string{
+		"user.one@gmail.com": {"https://siasky.net/" + sl1, "https://siasky.net/" + sl2},
+		"user.two@gmail.com": {"https://siasky.net/" + sl3},
+		"":                   {"https://siasky.net/" + sl4},
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatal("unexpected reports", urls)
+	}
+}
+
+// newTestCSAMEmail returns an abuse email tagged with csam that contains all
+// test skylinks.
+func newTestCSAMEmail() database.AbuseEmail {
+	return database.AbuseEmail{
+		ID:  primitive.NewObjectID(),
+		UID: "INBOX-0",
+
+		Parsed:  true,
+		Blocked: true,
+
+		ParseResult: database.AbuseReport{
+			Tags:     []string{"csam"},
+			Skylinks: []string{sl1, sl2, sl3, sl4},
+		},
+
+		InsertedAt: time.Now().UTC(),
+	}
+}
+
+// newTestAccountsServer returns a fake accounts API that serves the mocked
+// upload info of the test skylinks.
+func newTestAccountsServer() *accountstest.Server {
+	server := accountstest.NewServer()
+	for _, skylink := range []string{sl1, sl2, sl3, sl4} {
+		infos, _ := mockUploadInfo(skylink)
+		server.SetUploadInfo(skylink, infos)
+	}
+	return server
+}
+
+// newTestAccountsClient returns an accounts client that talks to the given
+// fake accounts API, it does not retry failed requests.
+func newTestAccountsClient(t *testing.T, server *accountstest.Server) *accounts.AccountsClient {
+	t.Helper()
+	c, err := server.AccountsClient(accounts.AccountsClientOptions{MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestReporterModule returns a reporter that uses the given accounts client,
+// it is not connected to a database nor the NCMEC API.
+func newTestReporterModule(accountsClient accounts.AccountsAPI) *Reporter {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Reporter{
+		staticAccountsBreaker: utils.NewCircuitBreaker(defaultAccountsBreakerThreshold, defaultAccountsBreakerCooldown),
+		staticAccountsClient:  accountsClient,
+		staticCancel:          cancel,
+		staticCtx:             ctx,
+		staticLogger:          logger.WithField("module", "Reporter"),
+		staticOptions: ReporterOptions{
+			AccountsBreakerCooldown:  defaultAccountsBreakerCooldown,
+			AccountsBreakerThreshold: defaultAccountsBreakerThreshold,
+		},
+		staticPortalURLs: []string{"https://siasky.net", "https://skyportal.xyz"},
+		staticReporter:   newTestReporter(),
+	}
+}
+
 // newTestReporter returns a reporter object for use in testing.
 func newTestReporter() NCMECReporter {
 	return NCMECReporter{
@@ -0,0 +1,62 @@
+package email
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// maxScreenshotSize is the maximum size of an evidence screenshot,
+	// screenshots that exceed this size are not attached to the report
+	maxScreenshotSize = 10 << 20 // 10 MiB
+)
+
+var (
+	// errScreenshotTooLarge is returned when an evidence screenshot exceeds
+	// the maximum screenshot size
+	errScreenshotTooLarge = errors.New("screenshot exceeds max size")
+)
+
+type (
+	// ScreenshotSource provides the evidence screenshots that were captured
+	// when the skylinks got blocked. Screenshot returns false if there's no
+	// screenshot for the given skylink.
+	ScreenshotSource interface {
+		Screenshot(skylink string) ([]byte, bool, error)
+	}
+
+	// ScreenshotDir is a screenshot source that loads the screenshots from a
+	// directory, the screenshot of a skylink is expected to be stored as
+	// '<skylink>.png'.
+	ScreenshotDir string
+)
+
+// Screenshot implements the ScreenshotSource interface.
+func (dir ScreenshotDir) Screenshot(skylink string) ([]byte, bool, error) {
+	// only accept valid skylinks, the skylink ends up in the path
+	if len(loadSkylinks([]string{skylink})) != 1 || filepath.Base(skylink) != skylink {
+		return nil, false, fmt.Errorf("invalid skylink '%v'", skylink)
+	}
+
+	file := filepath.Join(string(dir), skylink+".png")
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() > maxScreenshotSize {
+		return nil, false, errScreenshotTooLarge
+	}
+
+	screenshot, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false, err
+	}
+	return screenshot, true, nil
+}
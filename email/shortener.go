@@ -0,0 +1,194 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// maxShortenerHops is the maximum number of redirects we follow when
+	// expanding a short URL, redirects are only followed to other shortener
+	// hosts
+	maxShortenerHops = 5
+
+	// maxShortenedURLs is the maximum number of short URLs we expand for a
+	// single email
+	maxShortenedURLs = 10
+
+	// maxShortenerResponseSize is the maximum size of a response of a
+	// shortener we read, some shorteners respond with a preview page that
+	// contains the target rather than with a redirect
+	maxShortenerResponseSize = 64 << 10 // 64 KiB
+
+	// shortenerTimeout is the maximum amount of time we allow for expanding a
+	// single short URL
+	shortenerTimeout = 10 * time.Second
+)
+
+var (
+	// errTooManyShortenerHops is returned when a short URL redirects to
+	// another short URL more than maxShortenerHops times
+	errTooManyShortenerHops = fmt.Errorf("stopped after %v redirects", maxShortenerHops)
+
+	// extractPreviewLinkRE is a regex that is capable of extracting links
+	// from the preview page of a shortener
+	extractPreviewLinkRE = regexp.MustCompile(`https?://[^\s"'<>()\[\]]+`)
+
+	// extractShortURLRE is a regex that is capable of extracting URLs, with
+	// or without scheme, from text, the host and path are captured
+	extractShortURLRE = regexp.MustCompile(`(?i)(?:https?://)?([a-z0-9-]+(?:\.[a-z0-9-]+)+(?::\d+)?)(/[^\s"'<>()\[\]]*)`)
+)
+
+type (
+	// urlExpander is a helper object that expands short URLs from a set of
+	// allowlisted URL shorteners, e.g. bit.ly, and extracts the skylinks from
+	// the URLs they point to. Only the shorteners are ever contacted, the URL
+	// a short URL points to is never requested, we only extract the skylinks
+	// from the URL itself.
+	urlExpander struct {
+		staticClient          *http.Client
+		staticExtractSkylinks func(input []byte) []string
+		staticHosts           map[string]struct{}
+		staticLogger          *logrus.Entry
+	}
+)
+
+// newURLExpander returns a new URL expander for the given allowlist of
+// shortener hosts, it returns nil if the allowlist is empty. The shorteners are
+// contacted using a copy of the given shared client, skylinks are extracted
+// from the expanded URLs using the given extract function.
+func newURLExpander(hosts []string, client *http.Client, extract func(input []byte) []string, logger *logrus.Entry) *urlExpander {
+	allowed := make(map[string]struct{})
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			allowed[host] = struct{}{}
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	return &urlExpander{
+		staticClient: &http.Client{
+			Transport: client.Transport,
+			Timeout:   shortenerTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		staticExtractSkylinks: extract,
+		staticHosts:           allowed,
+		staticLogger:          logger,
+	}
+}
+
+// ExpandSkylinks extracts all short URLs of an allowlisted shortener from the
+// given input, expands them and returns all skylinks they point to.
+func (ue *urlExpander) ExpandSkylinks(ctx context.Context, input []byte) []string {
+	var skylinks []string
+	for i, shortURL := range ue.extractShortURLs(input) {
+		if i == maxShortenedURLs {
+			ue.staticLogger.Warnf("Ignoring short URLs, found more than %v", maxShortenedURLs)
+			break
+		}
+
+		expanded, err := ue.expand(ctx, shortURL)
+		if err != nil {
+			ue.staticLogger.Errorf("Failed to expand short URL %v, err %v", shortURL, err)
+			continue
+		}
+		skylinks = append(skylinks, expanded...)
+	}
+	return dedupe(skylinks)
+}
+
+// expand follows the redirects of the given short URL as long as they point
+// to an allowlisted shortener, and returns the skylinks in the URL it
+// eventually points to. If the shortener responds with a page rather than a
+// redirect, the skylinks on that page are returned.
+func (ue *urlExpander) expand(ctx context.Context, shortURL string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, shortenerTimeout)
+	defer cancel()
+
+	current := shortURL
+	for hop := 0; hop <= maxShortenerHops; hop++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, current, nil)
+		if err != nil {
+			return nil, errors.AddContext(err, "could not create request")
+		}
+		resp, err := ue.staticClient.Do(req)
+		if err != nil {
+			return nil, errors.AddContext(err, "could not execute request")
+		}
+
+		// read at most the max response size, the body is only used if the
+		// shortener did not respond with a redirect
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxShortenerResponseSize))
+		closeErr := resp.Body.Close()
+		if err != nil || closeErr != nil {
+			return nil, errors.AddContext(errors.Compose(err, closeErr), "could not read response body")
+		}
+
+		switch {
+		case resp.StatusCode >= 300 && resp.StatusCode < 400:
+			target, err := resp.Location()
+			if err != nil {
+				return nil, errors.AddContext(err, "invalid redirect")
+			}
+			if ue.isAllowed(target) {
+				current = target.String()
+				continue
+			}
+			return ue.staticExtractSkylinks([]byte(target.String())), nil
+		case resp.StatusCode == http.StatusOK:
+			// the shortener responded with a preview page, extract the
+			// skylinks from the links on the page
+			links := extractPreviewLinkRE.FindAll(body, -1)
+			return ue.staticExtractSkylinks(bytes.Join(links, []byte("\n"))), nil
+		default:
+			return nil, fmt.Errorf("unexpected status code %v", resp.StatusCode)
+		}
+	}
+	return nil, errTooManyShortenerHops
+}
+
+// extractShortURLs returns all URLs from the given input that point to an
+// allowlisted shortener, URLs without a scheme are included, all URLs are
+// rewritten to use https.
+func (ue *urlExpander) extractShortURLs(input []byte) []string {
+	var urls []string
+	for _, match := range extractShortURLRE.FindAllSubmatch(input, -1) {
+		path := strings.TrimRight(string(match[2]), ".,;:!?")
+		if path == "/" {
+			continue
+		}
+		u, err := url.Parse("https://" + string(match[1]) + path)
+		if err != nil || !ue.isAllowed(u) {
+			continue
+		}
+		urls = append(urls, u.String())
+	}
+	return dedupe(urls)
+}
+
+// isAllowed returns true if the given URL uses https and points to a
+// shortener that is allowlisted.
+func (ue *urlExpander) isAllowed(u *url.URL) bool {
+	if u == nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	_, allowed := ue.staticHosts[strings.ToLower(u.Hostname())]
+	return allowed
+}
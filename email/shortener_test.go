@@ -0,0 +1,197 @@
+package email
+
+import (
+	"abuse-scanner/database"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestURLExpander is a collection of unit tests that verify the functionality
+// of the URL expander.
+func TestURLExpander(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	t.Run("ExpandSkylinks", testExpandSkylinks)
+	t.Run("ExpandSkylinksNotAllowed", testExpandSkylinksNotAllowed)
+	t.Run("ParserShortURLs", testParserShortURLs)
+}
+
+// testExpandSkylinks verifies the URL expander follows the redirects of an
+// allowlisted shortener and extracts the skylinks from the target, without
+// requesting the target.
+func testExpandSkylinks(t *testing.T) {
+	t.Parallel()
+
+	// create a mocked host a short URL points to, it should never be hit
+	var hits uint64
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&hits, 1)
+	}))
+	defer target.Close()
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+
+	// create a mocked shortener
+	shortener := newTestShortener(targetURL)
+	defer shortener.Close()
+
+	ue := newTestURLExpander(shortener, "127.0.0.1")
+	shortenerHost := strings.TrimPrefix(shortener.URL, "https://")
+	body := []byte(fmt.Sprintf(`
+Phishing found at %[1]s/abc, and at %[2]s/chain.
+Also see <a href="%[1]s/preview">%[1]s/preview</a> and %[1]s/missing
+`, shortener.URL, shortenerHost))
+
+	skylinks := ue.ExpandSkylinks(context.Background(), body)
+	expected := []string{
+		"GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g",
+		"nAA_hbtNaOYyR2WrM9UNIc5jRu4WfGy5QK_iTGosDgLmSA",
+	}
+	if len(skylinks) != len(expected) {
+		t.Fatalf("unexpected number of skylinks, %v != %v, skylinks %v", len(skylinks), len(expected), skylinks)
+	}
+	for i, skylink := range expected {
+		if skylinks[i] != skylink {
+			t.Fatal("unexpected skylink", skylinks[i])
+		}
+	}
+	if atomic.LoadUint64(&hits) != 0 {
+		t.Fatal("unexpected request to the target of a short URL")
+	}
+}
+
+// testExpandSkylinksNotAllowed verifies the URL expander never contacts a
+// host that is not an allowlisted shortener.
+func testExpandSkylinksNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	// create a mocked shortener that is not allowlisted
+	var hits uint64
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&hits, 1)
+		http.Redirect(w, r, "https://siasky.net/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g", http.StatusFound)
+	}))
+	defer other.Close()
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+
+	// create an allowlisted shortener
+	shortener := newTestShortener("https://siasky.net")
+	defer shortener.Close()
+
+	ue := newTestURLExpander(shortener, "127.0.0.1")
+
+	// assert a short URL of a host that is not allowlisted is ignored
+	skylinks := ue.ExpandSkylinks(context.Background(), []byte(otherURL+"/abc"))
+	if len(skylinks) != 0 {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
+	if atomic.LoadUint64(&hits) != 0 {
+		t.Fatal("unexpected request to host that is not allowlisted")
+	}
+
+	// assert the number of redirects between shorteners is bounded
+	_, err := ue.expand(context.Background(), shortener.URL+"/loop")
+	if err != errTooManyShortenerHops {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert the expander is nil if no hosts are allowlisted
+	if newURLExpander([]string{" ", ""}, http.DefaultClient, extractSkylinks, logrus.New().WithField("module", "Test")) != nil {
+		t.Fatal("expected nil URL expander")
+	}
+}
+
+// testParserShortURLs verifies the parser records the skylinks found behind
+// short URLs with the shortener source, and that the allowlist of shorteners is
+// reloadable.
+func testParserShortURLs(t *testing.T) {
+	t.Parallel()
+
+	shortener := newTestShortener("https://siasky.net")
+	defer shortener.Close()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	parser := NewParser(context.Background(), nil, "dev.siasky.net", "somesponsor", ParserOptions{
+		HTTPClient:     shortener.Client(),
+		ShortenerHosts: []string{"127.0.0.1"},
+	}, logger)
+
+	email := newTestEmail()
+	email.Body = []byte(fmt.Sprintf("Subject: Phishing Report\n\nHello,\n\nplease remove the phishing page at %v/abc\n", shortener.URL))
+	report, _, err := parser.buildAbuseReport(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Skylinks) != 1 || report.Skylinks[0] != "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g" {
+		t.Fatal("unexpected skylinks", report.Skylinks)
+	}
+	if report.SkylinkSources[report.Skylinks[0]] != database.SkylinkSourceShortener {
+		t.Fatal("unexpected source", report.SkylinkSources)
+	}
+	if report.LowConfidence {
+		t.Fatal("expected skylinks behind short URLs to be linked")
+	}
+
+	// assert the short URL is no longer expanded once the shortener is
+	// removed from the allowlist
+	parser.Reload(ParserOptions{ShortenerHosts: []string{"bit.ly"}})
+	report, _, err = parser.buildAbuseReport(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Skylinks) != 0 {
+		t.Fatal("unexpected skylinks", report.Skylinks)
+	}
+
+	// assert it's expanded again once the shortener is added back
+	parser.Reload(ParserOptions{ShortenerHosts: []string{"bit.ly", "127.0.0.1"}})
+	report, _, err = parser.buildAbuseReport(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Skylinks) != 1 || report.SkylinkSources[report.Skylinks[0]] != database.SkylinkSourceShortener {
+		t.Fatal("unexpected skylinks", report.Skylinks)
+	}
+}
+
+// newTestShortener returns a mocked URL shortener, its short URLs redirect to
+// the given target.
+func newTestShortener(target string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/abc":
+			http.Redirect(w, r, target+"/GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g", http.StatusMovedPermanently)
+		case "/chain":
+			http.Redirect(w, r, server.URL+"/abc", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, server.URL+"/loop", http.StatusFound)
+		case "/preview":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<html><body><a href="%v/nAA_hbtNaOYyR2WrM9UNIc5jRu4WfGy5QK_iTGosDgLmSA">Continue</a></body></html>`, target)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+// newTestURLExpander returns a URL expander for the given hosts that trusts
+// the certificate of the given test server.
+func newTestURLExpander(server *httptest.Server, hosts ...string) *urlExpander {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ue := newURLExpander(hosts, http.DefaultClient, extractSkylinks, logger.WithField("module", "URLExpander"))
+	ue.staticClient.Transport = server.Client().Transport
+	return ue
+}
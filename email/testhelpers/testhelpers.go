@@ -0,0 +1,156 @@
+package testhelpers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// expectationsExt is the extension of the file that holds the
+	// expectations of an email fixture.
+	expectationsExt = ".yaml"
+
+	// htmlExt is the extension of the fixtures that only contain the HTML
+	// body of an email.
+	htmlExt = ".html"
+)
+
+var (
+	// fixtureExts are the extensions of the email fixtures, either a full
+	// email, or only the body of an email in plain text or HTML.
+	fixtureExts = []string{".eml", ".txt", htmlExt}
+)
+
+type (
+	// EmailFixture is a sample email of the golden email corpus, alongside
+	// what the parser is expected to extract from it.
+	EmailFixture struct {
+		Name         string
+		Raw          []byte
+		Expectations EmailExpectations
+
+		isHTML bool
+	}
+
+	// EmailExpectations are what the parser is expected to extract from an
+	// email fixture. The skylinks are in the order in which they appear in
+	// the email.
+	EmailExpectations struct {
+		// Reporter is the address the reporter gets replied to, it's empty
+		// if the fixture is only the body of an email.
+		Reporter string   `yaml:"reporter"`
+		Skylinks []string `yaml:"skylinks"`
+		Tags     []string `yaml:"tags"`
+	}
+)
+
+// EmailsDir returns the directory that holds the golden email corpus. Adding a
+// sample to the corpus is a matter of dropping the email, e.g. `sample.eml`,
+// and its expectations, e.g. `sample.yaml`, in this directory.
+func EmailsDir() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "testdata", "emails")
+}
+
+// EmailFixtureNames returns the names of all fixtures in the golden email
+// corpus, sorted alphabetically. The name of a fixture is its file name
+// without the extension.
+func EmailFixtureNames() ([]string, error) {
+	entries, err := ioutil.ReadDir(EmailsDir())
+	if err != nil {
+		return nil, errors.AddContext(err, "could not read the email fixtures")
+	}
+	var names []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		for _, fixtureExt := range fixtureExts {
+			if ext == fixtureExt {
+				names = append(names, strings.TrimSuffix(entry.Name(), ext))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadEmailFixture loads the email fixture with the given name, and its
+// expectations, from the golden email corpus. Every fixture must have
+// expectations, unknown fields in the expectations are rejected to catch
+// typos.
+func LoadEmailFixture(name string) (EmailFixture, error) {
+	raw, ext, err := loadEmail(name)
+	if err != nil {
+		return EmailFixture{}, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(EmailsDir(), name+expectationsExt))
+	if err != nil {
+		return EmailFixture{}, errors.AddContext(err, fmt.Sprintf("could not read the expectations of fixture '%v'", name))
+	}
+	var expectations EmailExpectations
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(&expectations)
+	if err != nil {
+		return EmailFixture{}, errors.AddContext(err, fmt.Sprintf("could not decode the expectations of fixture '%v'", name))
+	}
+	return EmailFixture{
+		Name:         name,
+		Raw:          raw,
+		Expectations: expectations,
+
+		isHTML: ext == htmlExt,
+	}, nil
+}
+
+// Email returns the fixture as a raw email. A fixture that only contains the
+// HTML body of an email is wrapped in a single-part HTML email, the other
+// fixtures are returned as is.
+func (f EmailFixture) Email() []byte {
+	if !f.isHTML {
+		return f.Raw
+	}
+	header := "MIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\n\r\n"
+	return append([]byte(header), f.Raw...)
+}
+
+// LoadEmail loads the contents of the fixture with the given name from the
+// golden email corpus, without its expectations.
+func LoadEmail(name string) ([]byte, error) {
+	raw, _, err := loadEmail(name)
+	return raw, err
+}
+
+// loadEmail loads the contents of the fixture with the given name from the
+// golden email corpus, it returns the extension of the fixture as well.
+func loadEmail(name string) ([]byte, string, error) {
+	for _, ext := range fixtureExts {
+		raw, err := ioutil.ReadFile(filepath.Join(EmailsDir(), name+ext))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", errors.AddContext(err, fmt.Sprintf("could not read fixture '%v'", name))
+		}
+		return raw, ext, nil
+	}
+	return nil, "", fmt.Errorf("fixture '%v' not found", name)
+}
+
+// MustLoadEmail is like LoadEmail but panics if the fixture can't be loaded,
+// which allows loading fixtures into package level test variables.
+func MustLoadEmail(name string) []byte {
+	raw, err := LoadEmail(name)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
@@ -0,0 +1,52 @@
+package testhelpers
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestLoadEmailFixture is a unit test that verifies every fixture in the golden
+// email corpus can be loaded, alongside its expectations.
+func TestLoadEmailFixture(t *testing.T) {
+	t.Parallel()
+
+	names, err := EmailFixtureNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Fatal("no email fixtures found")
+	}
+
+	for _, name := range names {
+		fixture, err := LoadEmailFixture(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fixture.Name != name || len(fixture.Raw) == 0 {
+			t.Fatal("unexpected fixture", name, fixture.Name, len(fixture.Raw))
+		}
+		if len(fixture.Expectations.Tags) == 0 {
+			t.Fatal("fixture without expected tags", name)
+		}
+
+		// assert only the HTML fixtures are wrapped in an email
+		email := fixture.Email()
+		if fixture.isHTML != bytes.HasPrefix(email, []byte("MIME-Version: 1.0\r\n")) {
+			t.Fatal("unexpected email", name)
+		}
+		if !bytes.HasSuffix(email, fixture.Raw) {
+			t.Fatal("unexpected email", name)
+		}
+	}
+
+	// assert loading an unknown fixture fails
+	_, err = LoadEmailFixture("unknown")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	_, err = LoadEmail("unknown")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
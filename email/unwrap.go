@@ -0,0 +1,150 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// maxUnwrapDepth is the maximum number of times we unwrap a link, links
+	// are sometimes rewritten more than once, e.g. a Google redirect that is
+	// rewritten by Outlook's Safe Links
+	maxUnwrapDepth = 5
+)
+
+var (
+	// DefaultLinkUnwrapRules map the hosts of well-known link rewriters onto
+	// the query parameter that holds the destination of a rewritten link.
+	DefaultLinkUnwrapRules = map[string]string{
+		"l.facebook.com":                   "u",
+		"safelinks.protection.outlook.com": "url",
+		"www.google.com":                   "q",
+	}
+)
+
+type (
+	// linkUnwrapper is a helper object that recovers the destination of links
+	// that were rewritten by a relay or a redirector, e.g. the link rewriters
+	// of corporate email gateways. The rewritten link hides the skylink in
+	// an encoded query parameter, which the skylink extraction does not
+	// decode. The rewritten link is never requested, the destination is
+	// decoded from the link itself.
+	linkUnwrapper struct {
+		staticRules map[string]string
+	}
+)
+
+// newLinkUnwrapper returns a link unwrapper for DefaultLinkUnwrapRules extended
+// with the given rules, a rule for the same host overrides the default.
+func newLinkUnwrapper(rules map[string]string) *linkUnwrapper {
+	all := make(map[string]string)
+	for _, r := range []map[string]string{DefaultLinkUnwrapRules, rules} {
+		for host, param := range r {
+			all[strings.ToLower(strings.TrimSpace(host))] = strings.TrimSpace(param)
+		}
+	}
+	return &linkUnwrapper{staticRules: all}
+}
+
+// ParseLinkUnwrapRules parses the given comma separated list of 'host=param'
+// pairs, e.g. 'r.relay.example.com=url', into a mapping of the hosts of link
+// rewriters onto the query parameter that holds the destination of a rewritten
+// link. A rule applies to the host and all of its subdomains.
+func ParseLinkUnwrapRules(rulesStr string) (map[string]string, error) {
+	rules := make(map[string]string)
+	for _, pair := range strings.Split(rulesStr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid pair '%v', expected format 'host=param'", pair)
+		}
+		host := strings.ToLower(strings.TrimSpace(parts[0]))
+		param := strings.TrimSpace(parts[1])
+		if host == "" || param == "" {
+			return nil, fmt.Errorf("invalid pair '%v', host and param can't be empty", pair)
+		}
+		rules[host] = param
+	}
+	return rules, nil
+}
+
+// Unwrap returns the destinations of all rewritten links in the given input.
+// Destinations that are rewritten links themselves are unwrapped as well, both
+// the intermediate and the final destinations are returned.
+func (lu *linkUnwrapper) Unwrap(input []byte) []string {
+	var destinations []string
+	for _, link := range extractPreviewLinkRE.FindAllString(string(input), -1) {
+		for depth := 0; depth < maxUnwrapDepth; depth++ {
+			destination, ok := lu.unwrapLink(link)
+			if !ok {
+				break
+			}
+			destinations = append(destinations, destination)
+			link = destination
+		}
+	}
+	return dedupe(destinations)
+}
+
+// WrapExtractor returns an extract function that extracts the skylinks from
+// the given input using the given extract function, after appending the
+// destinations of the rewritten links in the input to it.
+func (lu *linkUnwrapper) WrapExtractor(extract func(input []byte) []string) func(input []byte) []string {
+	return func(input []byte) []string {
+		destinations := lu.Unwrap(input)
+		if len(destinations) == 0 {
+			return extract(input)
+		}
+
+		// append the destinations on separate lines, the input is copied so
+		// the caller's slice is never modified
+		buf := bytes.NewBuffer(append([]byte(nil), input...))
+		for _, destination := range destinations {
+			buf.WriteString("\n" + destination)
+		}
+		return extract(buf.Bytes())
+	}
+}
+
+// unwrapLink returns the destination of the given link if it was rewritten by
+// one of the link rewriters in the rules, the boolean indicates whether the
+// link was unwrapped. Only absolute HTTP(S) destinations are returned.
+func (lu *linkUnwrapper) unwrapLink(link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	param := lu.matchRule(strings.ToLower(u.Hostname()))
+	if param == "" {
+		return "", false
+	}
+
+	destination := strings.TrimSpace(u.Query().Get(param))
+	d, err := url.Parse(destination)
+	if err != nil || (d.Scheme != "http" && d.Scheme != "https") || d.Host == "" {
+		return "", false
+	}
+	return destination, true
+}
+
+// matchRule returns the query parameter of the rule for the given host, or for
+// the closest of its parent domains that has a rule. It returns an empty string
+// if no rule applies to the host.
+func (lu *linkUnwrapper) matchRule(host string) string {
+	for host != "" {
+		if param, exists := lu.staticRules[host]; exists {
+			return param
+		}
+		i := strings.Index(host, ".")
+		if i == -1 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestLinkUnwrapper verifies the link unwrapper decodes the destinations of the
+// links of the link rewriters it has a rule for, including nested ones.
+func TestLinkUnwrapper(t *testing.T) {
+	t.Parallel()
+
+	lu := newLinkUnwrapper(map[string]string{
+		"r.relay.example.com": "dest",
+		"www.google.com":      "target",
+	})
+
+	// assert nested links are unwrapped, and that the rule applies to the
+	// subdomains of the host
+	input := []byte(`see <https://eu.r.relay.example.com/cl?dest=https%3A%2F%2Feur02.safelinks.protection.outlook.com%2F%3Furl%3Dhttps%253A%252F%252Fsiasky.net%252Fabc%26data%3D05> and`)
+	expected := []string{
+		"https://eur02.safelinks.protection.outlook.com/?url=https%3A%2F%2Fsiasky.net%2Fabc&data=05",
+		"https://siasky.net/abc",
+	}
+	if destinations := lu.Unwrap(input); !reflect.DeepEqual(destinations, expected) {
+		t.Fatal("unexpected destinations", destinations)
+	}
+
+	// assert the rules override the defaults
+	input = []byte("https://www.google.com/url?q=https%3A%2F%2Fsiasky.net%2Fabc&target=https%3A%2F%2Fsiasky.net%2Fdef")
+	if destinations := lu.Unwrap(input); !reflect.DeepEqual(destinations, []string{"https://siasky.net/def"}) {
+		t.Fatal("unexpected destinations", destinations)
+	}
+
+	// assert the links of other hosts, and destinations that aren't absolute
+	// HTTP(S) links, are ignored
+	for _, link := range []string{
+		"https://relay.example.com/cl?dest=https%3A%2F%2Fsiasky.net%2Fabc",
+		"https://r.relay.example.com/cl?dest=%2Fabc",
+		"https://r.relay.example.com/cl?dest=javascript%3Aalert(1)",
+		"https://www.google.com/search?target=skylink",
+	} {
+		if destinations := lu.Unwrap([]byte(link)); len(destinations) != 0 {
+			t.Fatal("unexpected destinations", link, destinations)
+		}
+	}
+
+	// assert the wrapped extractor extracts the skylinks from the destinations
+	input = []byte("https://r.relay.example.com/cl?dest=https%3A%2F%2Fsiasky.net%2FBACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA")
+	skylinks := lu.WrapExtractor(extractSkylinks)(input)
+	if !reflect.DeepEqual(skylinks, []string{"BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"}) {
+		t.Fatal("unexpected skylinks", skylinks)
+	}
+}
+
+// TestParseLinkUnwrapRules is a unit test that covers ParseLinkUnwrapRules.
+func TestParseLinkUnwrapRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := ParseLinkUnwrapRules(" R.Relay.example.com = url, l.example.com=u,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"r.relay.example.com": "url", "l.example.com": "u"}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatal("unexpected rules", rules)
+	}
+
+	rules, err = ParseLinkUnwrapRules("")
+	if err != nil || len(rules) != 0 {
+		t.Fatal("unexpected rules", rules, err)
+	}
+
+	for _, invalid := range []string{"r.relay.example.com", "=url", "r.relay.example.com="} {
+		_, err = ParseLinkUnwrapRules(invalid)
+		if err == nil {
+			t.Fatal("expected error", invalid)
+		}
+	}
+}
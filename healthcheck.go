@@ -0,0 +1,91 @@
+package main
+
+import (
+	"abuse-scanner/database"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// healthcheckTimeout is the maximum amount of time the healthcheck
+	// command is allowed to take, container runtimes kill slow healthchecks
+	healthcheckTimeout = 5 * time.Second
+
+	// probeHTTP probes the health endpoint of the scanner's HTTP server, this
+	// is the default probe of the healthcheck command
+	probeHTTP = "http"
+
+	// probeMongo pings the database, it's meant for instances of which the
+	// HTTP server is not reachable from within the container
+	probeMongo = "mongo"
+
+	// maxHealthResponseSize is the maximum amount of bytes read from the
+	// health response, it's only used in the error if the scanner is unhealthy
+	maxHealthResponseSize = 1 << 10 // 1 KiB
+)
+
+// healthcheck runs the given probe against the scanner that runs with the given
+// config, it returns an error if the scanner is unhealthy or if the probe
+// takes longer than the given timeout.
+func healthcheck(ctx context.Context, cfg Config, probe string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// not every step of the probes respects the context, so a probe that
+	// times out is abandoned rather than interrupted
+	errChan := make(chan error, 1)
+	go func() {
+		switch probe {
+		case probeHTTP:
+			errChan <- probeHealthEndpoint(ctx, cfg.ListenAddress)
+		case probeMongo:
+			errChan <- database.PingMongo(ctx, cfg.DBURI, cfg.DBCredentials)
+		default:
+			errChan <- fmt.Errorf("unknown probe '%v'", probe)
+		}
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%v probe timed out after %v", probe, timeout)
+	}
+}
+
+// probeHealthEndpoint requests the health endpoint of the HTTP server that
+// listens on the given address, it returns an error unless the server responds
+// with a 200. Addresses without a host, or with an unspecified host, are
+// probed on localhost.
+func probeHealthEndpoint(ctx context.Context, listenAddress string) error {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return errors.AddContext(err, "invalid listen address")
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+
+	url := fmt.Sprintf("http://%s/health", net.JoinHostPort(host, port))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.AddContext(err, "failed to create request")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthResponseSize))
+		return fmt.Errorf("unexpected status code %v, response '%s'", resp.StatusCode, body)
+	}
+	return nil
+}
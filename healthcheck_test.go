@@ -0,0 +1,125 @@
+package main
+
+import (
+	"abuse-scanner/test"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestHealthcheck verifies the probes of the healthcheck command, and that the
+// command fails if a probe exceeds its timeout.
+func TestHealthcheck(t *testing.T) {
+	t.Parallel()
+
+	t.Run("HTTP", testHealthcheckHTTP)
+	t.Run("Mongo", testHealthcheckMongo)
+	t.Run("Timeout", testHealthcheckTimeout)
+}
+
+// testHealthcheckHTTP verifies the HTTP probe requests the health endpoint on
+// localhost and fails unless the scanner is healthy.
+func testHealthcheckHTTP(t *testing.T) {
+	t.Parallel()
+
+	var status int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"status":"unhealthy"}`))
+	}))
+	defer server.Close()
+
+	// the listen address has no host, like the default listen address
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{ListenAddress: ":" + port}
+
+	status = http.StatusOK
+	err = healthcheck(context.Background(), cfg, probeHTTP, healthcheckTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = http.StatusServiceUnavailable
+	err = healthcheck(context.Background(), cfg, probeHTTP, healthcheckTimeout)
+	if err == nil || !strings.Contains(err.Error(), "unexpected status code 503") || !strings.Contains(err.Error(), "unhealthy") {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert the probe fails if the server is not running
+	server.Close()
+	err = healthcheck(context.Background(), cfg, probeHTTP, healthcheckTimeout)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// testHealthcheckMongo verifies the mongo probe pings the database, it fails
+// within the timeout if the database can't be reached.
+func testHealthcheckMongo(t *testing.T) {
+	t.Parallel()
+
+	// assert an invalid URI fails right away
+	cfg := Config{DBURI: "invalid://mongo"}
+	err := healthcheck(context.Background(), cfg, probeMongo, healthcheckTimeout)
+	if err == nil || !strings.Contains(err.Error(), "failed to connect") {
+		t.Fatal("unexpected error", err)
+	}
+
+	// assert an unreachable database fails within the timeout
+	timeout := 500 * time.Millisecond
+	cfg = Config{DBURI: "mongodb://127.0.0.1:1", DBCredentials: options.Credential{Username: "admin", Password: "pass"}}
+	start := time.Now()
+	err = healthcheck(context.Background(), cfg, probeMongo, timeout)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*timeout {
+		t.Fatal("probe exceeded its timeout", elapsed)
+	}
+
+	// assert a reachable database is healthy, this requires a database
+	if testing.Short() {
+		return
+	}
+	cfg = Config{DBURI: test.MongoDBURI(), DBCredentials: options.Credential{Username: test.MongoDBUsername, Password: test.MongoDBPassword}}
+	err = healthcheck(context.Background(), cfg, probeMongo, healthcheckTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHealthcheckTimeout verifies the healthcheck fails if the scanner doesn't
+// respond within the timeout.
+func testHealthcheckTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	timeout := 200 * time.Millisecond
+	start := time.Now()
+	err := healthcheck(context.Background(), Config{ListenAddress: server.Listener.Addr().String()}, probeHTTP, timeout)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Fatal("unexpected error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*timeout {
+		t.Fatal("probe exceeded its timeout", elapsed)
+	}
+}
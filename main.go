@@ -1,224 +1,486 @@
 package main
 
 import (
-	"abuse-scanner/accounts"
+	"abuse-scanner/api"
 	"abuse-scanner/database"
-	"abuse-scanner/email"
+	"abuse-scanner/metrics"
 	"abuse-scanner/utils"
+	"abuse-scanner/version"
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
-
-	"context"
-	"log"
-	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func main() {
 	// load env
 	_ = godotenv.Load()
 
-	// create a context
-	ctx, cancel := context.WithCancel(context.Background())
+	// parse the command, running the scanner without arguments is equal to
+	// the run command
+	cmd, err := parseCommand(os.Args[1:], os.Stderr, time.Now().UTC())
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// fetch env variables
-	abuseLoglevel := os.Getenv("ABUSE_LOG_LEVEL")
-	abuseMailaddress := os.Getenv("ABUSE_MAILADDRESS")
-	abuseMailbox := os.Getenv("ABUSE_MAILBOX")
-	abusePortalURL := utils.SanitizeURL(os.Getenv("ABUSE_PORTAL_URL"))
-	abuseSponsor := os.Getenv("ABUSE_SPONSOR")
-	accountsHost := os.Getenv("SKYNET_ACCOUNTS_HOST")
-	accountsPort := os.Getenv("SKYNET_ACCOUNTS_PORT")
-	blockerHost := os.Getenv("BLOCKER_HOST")
-	blockerPort := os.Getenv("BLOCKER_PORT")
-	serverDomain := os.Getenv("SERVER_DOMAIN")
-
-	// parse ncmec reporting enabled variable
-	ncmecReportingEnabled := false
-	ncmecReportingEnabledStr := os.Getenv("ABUSE_NCMEC_REPORTING_ENABLED")
-	if ncmecReportingEnabledStr != "" {
-		var err error
-		ncmecReportingEnabled, err = strconv.ParseBool(ncmecReportingEnabledStr)
+	// the version doesn't require a config
+	if cmd.name == commandVersion {
+		err = printVersion(os.Stdout)
 		if err != nil {
-			log.Fatalf("Failed parsing the value for env variable ABUSE_NCMEC_REPORTING_ENABLED '%s' as a boolean, err %v", ncmecReportingEnabledStr, err)
+			log.Fatal(err)
 		}
+		return
 	}
 
-	// TODO: validate env variables
+	// the config file is passed using the -config flag or the env
+	cmd.configPath = configFilePath(cmd.configPath)
 
-	// sanitize the inputs
-	abuseMailbox = strings.Trim(abuseMailbox, "\"")
-	abuseSponsor = strings.Trim(abuseSponsor, "\"")
+	// the healthcheck runs frequently, so it only loads the variables it
+	// requires and doesn't log the config
+	if cmd.name == commandHealthcheck {
+		cfg, errs := loadHealthcheckConfig(cmd.configPath)
+		if len(errs) > 0 {
+			log.Fatalf("Invalid configuration, found %v problem(s):%s", len(errs), formatProblems(errs))
+		}
+		err = healthcheck(context.Background(), cfg, cmd.probe, healthcheckTimeout)
+		if err != nil {
+			log.Fatalf("Unhealthy, err: %v", err)
+		}
+		return
+	}
+
+	// load the config from the environment and the config file, every problem
+	// with it is reported at once
+	cfg, errs := loadConfig(cmd.configPath)
+	if len(errs) > 0 {
+		log.Fatalf("Invalid configuration, found %v problem(s):%s", len(errs), formatProblems(errs))
+	}
 
-	// load email credentials
-	emailCredentials, err := loadEmailCredentials()
+	// initialize a logger, if a log file is configured the logs are written
+	// to both stderr and the file
+	var out io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		logFile, err := utils.NewRotatingFile(cfg.LogFile, cfg.LogFileOptions())
+		if err != nil {
+			log.Fatalf("Failed to open log file %v, err: %v", cfg.LogFile, err)
+		}
+		defer logFile.Close()
+		out = io.MultiWriter(os.Stderr, logFile)
+	}
+	logger := newLogger(cfg, out)
+
+	// report errors to Sentry, this is a no-op if no DSN is configured
+	hook, err := newSentryHook(cfg.SentryDSN, cfg.ServerDomain, nil)
 	if err != nil {
-		log.Fatal("Failed to load email credentials", err)
+		log.Fatal(err)
+	}
+	if hook != nil {
+		logger.AddHook(hook)
 	}
 
-	// initialize a logger
-	logger := logrus.New()
+	// print the version and a summary of the config
+	logger.Infof("Starting %v", version.Current())
+	logger.Infof("Loaded config:\n%v", cfg)
+	if cfg.DryRun {
+		logger.Warn("DRY RUN mode is enabled, no skylinks are blocked, no emails are sent and no NCMEC reports are filed")
+	}
 
-	// configure log level
-	logLevel, err := logrus.ParseLevel(abuseLoglevel)
+	// run the command, the error is logged rather than passed to log.Fatal so
+	// it gets reported to Sentry, which is flushed before we exit
+	err = runCommand(cmd, cfg, logger)
+	if err != nil {
+		logger.Errorf("Failed to %v, err: %v", cmd.name, err)
+	}
+	if !hook.Flush(sentryFlushTimeout) {
+		log.Printf("Failed to flush the Sentry events within %v", sentryFlushTimeout)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// runCommand runs the given command using the given config.
+func runCommand(cmd command, cfg Config, logger *logrus.Logger) (err error) {
+	if cmd.check {
+		return checkDependencies(context.Background(), os.Stdout, cfg, logger)
+	}
+	if cmd.name == commandRun {
+		return run(cfg, cmd.configPath, logger)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cmd.name == commandScanOnce {
+		return scanOnce(ctx, os.Stdout, cfg, cmd.maxErrors, logger)
+	}
+
+	// the remaining commands only require the database
+	abuseDB, err := database.NewAbuseScannerDB(ctx, cfg.ServerDomain, database.DBAbuseScanner, cfg.DBURI, cfg.DBCredentials, cfg.DBOptions(), logger)
 	if err != nil {
-		logLevel = logrus.InfoLevel
+		return errors.AddContext(err, "failed to initialize database client")
 	}
-	logger.SetLevel(logLevel)
+	defer func() {
+		err = errors.Compose(err, abuseDB.Close())
+	}()
 
-	// configure log formatter
+	switch cmd.name {
+	case commandExport:
+		return exportEmails(ctx, os.Stdout, abuseDB, cmd)
+	case commandPause:
+		return setPaused(abuseDB, true, cmd.reason, logger)
+	case commandReparse:
+		return resetEmails(cmd.uids, abuseDB.Reparse, logger)
+	case commandRequeue:
+		return resetEmails(cmd.uids, abuseDB.Requeue, logger)
+	case commandResume:
+		return setPaused(abuseDB, false, "", logger)
+	case commandStats:
+		return printStats(os.Stdout, abuseDB, cmd)
+	}
+	return fmt.Errorf("unknown command '%v'", cmd.name)
+}
+
+// formatProblems returns the given problems with the config as a list, every
+// problem on its own line.
+func formatProblems(errs []error) string {
+	var sb strings.Builder
+	for _, err := range errs {
+		sb.WriteString(fmt.Sprintf("\n- %v", err))
+	}
+	return sb.String()
+}
+
+// newLogger returns a logger that writes to the given output, using the log
+// level and format from the given config.
+func newLogger(cfg Config, out io.Writer) *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(out)
+
+	// configure log level
+	logger.SetLevel(cfg.LogLevel)
+
+	// configure log formatter, the JSON formatter is meant for log
+	// aggregation, it keeps the fields of an entry, such as the module and
+	// email_uid, as separate keys
+	if cfg.LogFormat == logFormatJSON {
+		formatter := new(logrus.JSONFormatter)
+		formatter.TimestampFormat = time.RFC3339Nano
+		logger.SetFormatter(formatter)
+		return logger
+	}
 	formatter := new(logrus.TextFormatter)
 	formatter.TimestampFormat = "2006-01-02 15:04:05"
 	formatter.FullTimestamp = true
 	logger.SetFormatter(formatter)
+	return logger
+}
 
-	// create a database client
-	mongoUri, mongoCreds, err := loadDBCredentials()
-	if err != nil {
-		log.Fatal("Failed to load mongo database credentials", err)
+// newModuleLogger returns the logger of the given module. If the config
+// overrides the log level of the module that's a copy of the given logger that
+// logs at the module's level, it shares the output, the formatter and the hooks
+// of the given logger. Otherwise it's the given logger.
+func newModuleLogger(logger *logrus.Logger, cfg Config, module string) *logrus.Logger {
+	level, exists := cfg.ModuleLogLevels[module]
+	if !exists {
+		return logger
+	}
+	return &logrus.Logger{
+		Out:          logger.Out,
+		Hooks:        logger.Hooks,
+		Formatter:    logger.Formatter,
+		ReportCaller: logger.ReportCaller,
+		Level:        level,
+		ExitFunc:     logger.ExitFunc,
 	}
+}
 
-	// create a database instance
-	abuseDB, err := database.NewAbuseScannerDB(ctx, serverDomain, database.DBAbuseScanner, mongoUri, mongoCreds, logger)
+// run runs the scanner as a long-running process, it starts the enabled
+// modules and blocks until the process receives an exit signal. On SIGHUP the
+// reloadable variables are reloaded from the config file at the given path,
+// the environment is not re-read, see reloadConfig.
+func run(cfg Config, configPath string, logger *logrus.Logger) error {
+	// create a context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// verify we can reach all dependencies before we start, so a
+	// misconfigured deployment fails right away
+	var sb strings.Builder
+	err := checkDependencies(ctx, &sb, cfg, logger)
+	logger.Infof("Dependency checks:\n%v", sb.String())
 	if err != nil {
-		log.Fatalf("Failed to initialize database client, err: %v", err)
+		return err
 	}
 
-	// create a new mail fetcher, it downloads the emails
-	logger.Info("Initializing email fetcher...")
-	fetcher := email.NewFetcher(ctx, abuseDB, emailCredentials, abuseMailbox, serverDomain, logger)
-	err = fetcher.Start()
+	// start the HTTP server, it serves the metrics and the health of the
+	// scanner
+	server := api.NewServer(cfg.ListenAddress, metrics.Registry, cfg.ServerOptions(), logger)
+	err = server.Start()
 	if err != nil {
-		log.Fatal("Failed to start the email fetcher, err: ", err)
+		return errors.AddContext(err, "failed to start the HTTP server")
 	}
 
-	// create a new mail parser, it parses any email that's not parsed yet for
-	// abuse skylinks and a set of abuse tag
-	logger.Info("Initializing email parser...")
-	parser := email.NewParser(ctx, abuseDB, serverDomain, abuseSponsor, logger)
-	err = parser.Start()
-	if err != nil {
-		log.Fatal("Failed to start the email parser, err: ", err)
+	// if we fail to start, stop the components that were started already
+	components := []component{{name: "server", stop: server.Stop}}
+	abort := func(err error) error {
+		return errors.Compose(err, stopComponents(components, cfg.ShutdownTimeout, logger))
 	}
 
-	// create a new blocker, it blocks skylinks for any emails which have been
-	// parsed but not blocked yet, it uses the blocker API for this.
-	logger.Info("Initializing blocker...")
-	blockerApiUrl := fmt.Sprintf("http://%s:%s", blockerHost, blockerPort)
-	blocker := email.NewBlocker(ctx, blockerApiUrl, serverDomain, abuseDB, logger)
-	err = blocker.Start()
+	// create a database instance
+	abuseDB, err := database.NewAbuseScannerDB(ctx, cfg.ServerDomain, database.DBAbuseScanner, cfg.DBURI, cfg.DBCredentials, cfg.DBOptions(), logger)
 	if err != nil {
-		log.Fatal("Failed to start the blocker, err: ", err)
+		return abort(errors.AddContext(err, "failed to initialize database client"))
 	}
+	components = append(components, component{name: "database", stop: abuseDB.Close})
 
-	// create a new finalizer, it finalizes the abuse report for any emails
-	// which are parsed, blocked, but not yet finalized. An email is finalized
-	// when the abuse scanner has replied with a report of all the skylinks that
-	// have been found and blocked.
-	logger.Info("Initializing finalizer...")
-	finalizer := email.NewFinalizer(ctx, abuseDB, emailCredentials, abuseMailaddress, abuseMailbox, serverDomain, logger)
-	err = finalizer.Start()
+	// start the modules that are enabled, the modules that were started
+	// already are stopped by startModules if one fails to start
+	logger.Infof("Enabled modules: %v", strings.Join(cfg.EnabledModules(), ", "))
+	m, err := startModules(ctx, cfg, abuseDB, logger)
 	if err != nil {
-		log.Fatal("Failed to start the email finalizer, err: ", err)
+		return abort(err)
 	}
 
-	// create a new reporter, it will scan for emails that contain CSAM and
-	// report those instances to NCMEC.
-	var reporter *email.Reporter
-	if ncmecReportingEnabled {
-		// load NCMEC credentials
-		ncmecCredentials, err := email.LoadNCMECCredentials()
-		if err != nil {
-			log.Fatal("Failed to load NCMEC credentials", err)
-		}
-
-		// load NCMEC reporter
-		ncmecReporter, err := email.LoadNCMECReporter()
-		if err != nil {
-			log.Fatal("Failed to load NCMEC reporter", err)
-		}
-
-		// create an accounts client
-		accountsClient := accounts.NewAccountsClient(accountsHost, accountsPort)
+	// register the health checks, and serve the admin API if enabled
+	server.AddCheck("mongo", true, abuseDB.Ping)
+	server.SetAdminDatabase(abuseDB)
+	if m.fetcher != nil {
+		server.SetRefetcher(m.fetcher)
+	}
+	m.addChecks(server, cfg)
 
-		logger.Info("Initializing reporter...")
-		reporter := email.NewReporter(abuseDB, accountsClient, ncmecCredentials, abusePortalURL, serverDomain, ncmecReporter, logger)
-		err = reporter.Start()
-		if err != nil {
-			log.Fatal("Failed to start the NCMEC reporter, err: ", err)
-		}
+	// watch the module loops, and the ingest if an alert window is set, a
+	// stalled loop or ingest degrades the health
+	wd := newWatchdog(cfg.EnabledModules(), cfg.Notifier, logger)
+	if m.fetcher != nil && cfg.IngestAlertWindow > 0 {
+		wd.watchIngest(m.fetcher.LastIngest, m.pause, cfg.IngestAlertWindow)
 	}
+	wd.Start()
+	server.AddCheck("watchdog", false, wd.Health)
+	server.SetReady()
 
-	// catch exit signals
+	// catch exit signals, and reload the config on SIGHUP until we exit
 	exitSignal := make(chan os.Signal, 1)
 	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-	<-exitSignal
-
-	// on exit call cancel and stop all components
-	cancel()
-	err = errors.Compose(
-		abuseDB.Close(),
-		fetcher.Stop(),
-		parser.Stop(),
-		blocker.Stop(),
-		finalizer.Stop(),
-	)
-	if reporter != nil {
-		err = errors.Compose(
-			err,
-			reporter.Stop(),
-		)
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	for running := true; running; {
+		select {
+		case <-exitSignal:
+			running = false
+		case <-reloadSignal:
+			logger.Info("Reloading config...")
+			cfg, err = reloadConfig(cfg, configPath, m, logger)
+			if err != nil {
+				logger.Errorf("Failed to reload config, keeping the current config, err: %v", err)
+			}
+		}
 	}
+	signal.Stop(reloadSignal)
+
+	// on exit stop all components in reverse dependency order, the watchdog
+	// is stopped first so the modules that stop are not reported as stalled,
+	// then the fetcher so no new work arrives, every module gets to finish
+	// the work that is in progress, the database is closed last
+	logger.Infof("Shutting down, allowing %v to stop all components", cfg.ShutdownTimeout)
+	components = append(append([]component{{name: "watchdog", stop: wd.Stop}}, m.components...), components...)
+	err = stopComponents(components, cfg.ShutdownTimeout, logger)
 	if err != nil {
-		log.Fatal("Failed to cleanly close all components, err: ", err)
+		return errors.AddContext(err, "failed to cleanly close all components")
 	}
 
 	logger.Info("Abuse Scanner Terminated.")
+	return nil
+}
+
+// parseList is a helper function that parses the given comma separated list
+// into a slice of lowercased values, empty values are omitted.
+func parseList(listStr string) []string {
+	var values []string
+	for _, value := range strings.Split(listStr, ",") {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// parseConflictPatterns is a helper function that parses the given semicolon
+// separated list of regular expressions, the patterns are case-insensitive. It
+// returns nil if the list is empty, which means the defaults are used.
+func parseConflictPatterns(patternsStr string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, pattern := range strings.Split(patternsStr, ";") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%v', err %v", pattern, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
 }
 
-// loadDBCredentials is a helper function that loads the mongo db credentials
-// from the environment. If any of the values are empty, it returns an error
-// that indicates what env variable is missing.
-func loadDBCredentials() (string, options.Credential, error) {
-	var creds options.Credential
-	var ok bool
-	if creds.Username, ok = os.LookupEnv("SKYNET_DB_USER"); !ok {
-		return "", options.Credential{}, errors.New("missing env var SKYNET_DB_USER")
+// parseLogLevels is a helper function that parses the given string into the
+// default log level and the log levels of the modules that override it. The
+// expected format is a comma separated list of the default level and
+// module=level pairs, e.g. 'info,parser=debug,blocker=warn'. The default level
+// is optional and defaults to info, the module names are case-insensitive.
+func parseLogLevels(logLevelsStr string) (logrus.Level, map[string]logrus.Level, error) {
+	modules := make(map[string]string)
+	for _, module := range []string{moduleBlocker, moduleFetcher, moduleFinalizer, moduleParser, moduleReporter} {
+		modules[strings.ToLower(module)] = module
 	}
-	if creds.Password, ok = os.LookupEnv("SKYNET_DB_PASS"); !ok {
-		return "", options.Credential{}, errors.New("missing env var SKYNET_DB_PASS")
+
+	level := logrus.InfoLevel
+	var hasDefault bool
+	moduleLevels := make(map[string]logrus.Level)
+	for _, pair := range strings.Split(logLevelsStr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		// the pair without a module is the default level
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 1 {
+			if hasDefault {
+				return logrus.InfoLevel, nil, fmt.Errorf("multiple default levels, '%v' is not a module=level pair", pair)
+			}
+			defaultLevel, err := logrus.ParseLevel(pair)
+			if err != nil {
+				return logrus.InfoLevel, nil, err
+			}
+			level = defaultLevel
+			hasDefault = true
+			continue
+		}
+
+		module, exists := modules[strings.ToLower(strings.TrimSpace(parts[0]))]
+		if !exists {
+			return logrus.InfoLevel, nil, fmt.Errorf("unknown module '%v' in pair '%v'", strings.TrimSpace(parts[0]), pair)
+		}
+		moduleLevel, err := logrus.ParseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return logrus.InfoLevel, nil, err
+		}
+		moduleLevels[module] = moduleLevel
 	}
-	var host, port string
-	if host, ok = os.LookupEnv("SKYNET_DB_HOST"); !ok {
-		return "", options.Credential{}, errors.New("missing env var SKYNET_DB_HOST")
+	return level, moduleLevels, nil
+}
+
+// parseKeyValueList is a helper function that parses the given comma separated
+// list of key=value pairs, e.g. 'csam=10,phishing=1'. The keys and values are
+// trimmed and can't be empty, the keys are lowercased. Every pair is passed to
+// the given function, which converts and stores the value. The given names of
+// the key and the value are used in the errors.
+func parseKeyValueList(str, keyName, valueName string, convert func(key, value string) error) error {
+	for _, pair := range strings.Split(str, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid pair '%v', expected format '%v=%v'", pair, keyName, valueName)
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		if key == "" || value == "" {
+			return fmt.Errorf("invalid pair '%v', %v and %v can't be empty", pair, keyName, valueName)
+		}
+		err := convert(key, value)
+		if err != nil {
+			return err
+		}
 	}
-	if port, ok = os.LookupEnv("SKYNET_DB_PORT"); !ok {
-		return "", options.Credential{}, errors.New("missing env var SKYNET_DB_PORT")
+	return nil
+}
+
+// parseReporterOrgs is a helper function that parses the given string into a
+// map of sender domains to the organization that sends reports from that
+// domain. The expected format is a comma separated list of domain=organization
+// pairs, e.g. 'switch.ch=SWITCH-CERT,namecheap.com=Namecheap'.
+func parseReporterOrgs(reporterOrgsStr string) (map[string]string, error) {
+	reporterOrgs := make(map[string]string)
+	err := parseKeyValueList(reporterOrgsStr, "domain", "organization", func(domain, org string) error {
+		reporterOrgs[domain] = org
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return fmt.Sprintf("mongodb://%v:%v", host, port), creds, nil
+	return reporterOrgs, nil
 }
 
-// loadEmailCredentials is a helper function that loads the email credentials
-// from the environment. If any of the values are empty, it returns an error
-// that indicates what env variable is missing.
-func loadEmailCredentials() (email.Credentials, error) {
-	var creds email.Credentials
-	var ok bool
-	if creds.Address, ok = os.LookupEnv("EMAIL_SERVER"); !ok {
-		return email.Credentials{}, errors.New("missing env var 'EMAIL_SERVER'")
+// parseMailboxTags is a helper function that parses the given string into a
+// map of mailbox names onto the tag every email from that mailbox receives.
+// The expected format is a comma separated list of mailbox=tag pairs, e.g.
+// 'csam=csam,phishing=phishing', the names and tags are lowercased.
+func parseMailboxTags(mailboxTagsStr string) (map[string]string, error) {
+	mailboxTags := make(map[string]string)
+	err := parseKeyValueList(mailboxTagsStr, "mailbox", "tag", func(mailbox, tag string) error {
+		mailboxTags[mailbox] = strings.ToLower(tag)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if creds.Username, ok = os.LookupEnv("EMAIL_USERNAME"); !ok {
-		return email.Credentials{}, errors.New("missing env var 'EMAIL_USERNAME'")
+	return mailboxTags, nil
+}
+
+// parseReplyLocales is a helper function that parses the given string into a
+// map of reporters onto the locale of the replies they receive. The expected
+// format is a comma separated list of reporter=locale pairs, e.g.
+// 'cert-bund.de=de,abuse@example.at=de', a reporter is either an email address
+// or a domain. Both the reporters and the locales are lowercased.
+func parseReplyLocales(replyLocalesStr string) (map[string]string, error) {
+	replyLocales := make(map[string]string)
+	err := parseKeyValueList(replyLocalesStr, "reporter", "locale", func(reporter, locale string) error {
+		replyLocales[reporter] = strings.ToLower(locale)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if creds.Password, ok = os.LookupEnv("EMAIL_PASSWORD"); !ok {
-		return email.Credentials{}, errors.New("missing env var 'EMAIL_PASSWORD'")
+	return replyLocales, nil
+}
+
+// parseTagPriorities is a helper function that parses the given string into a
+// map of tags to the priority of the emails that have that tag. The expected
+// format is a comma separated list of tag=priority pairs, e.g.
+// 'csam=10,terrorism=10,phishing=1', the priority is an integer.
+func parseTagPriorities(tagPrioritiesStr string) (map[string]int, error) {
+	tagPriorities := make(map[string]int)
+	err := parseKeyValueList(tagPrioritiesStr, "tag", "priority", func(tag, priorityStr string) error {
+		priority, err := strconv.Atoi(priorityStr)
+		if err != nil {
+			return fmt.Errorf("invalid priority '%v' for tag '%v', expected an integer", priorityStr, tag)
+		}
+		tagPriorities[tag] = priority
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return creds, nil
+	return tagPriorities, nil
 }
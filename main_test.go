@@ -1,26 +1,34 @@
 package main
 
 import (
+	"abuse-scanner/email"
+	"abuse-scanner/test/mongotest"
+	"abuse-scanner/utils"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"gitlab.com/NebulousLabs/errors"
 )
 
-// TestLoadDBCredentials is a unit test that covers the loadDBCredentials
-// helper.
-func TestLoadDBCredentials(t *testing.T) {
-	variables := []string{
-		"SKYNET_DB_USER",
-		"SKYNET_DB_PASS",
-		"SKYNET_DB_HOST",
-		"SKYNET_DB_PORT",
-	}
+// TestMain starts a disposable test DB for the tests that touch the database if
+// opted into, see mongotest.Main.
+func TestMain(m *testing.M) {
+	os.Exit(mongotest.Main(m))
+}
 
+// TestLoadConfig is a table-driven unit test that covers the loadConfig
+// helper, it verifies every problem with the config is reported at once.
+func TestLoadConfig(t *testing.T) {
 	// create a function to restore the environment
-	restoreEnvFn := restoreEnv(variables)
+	restoreEnvFn := restoreEnv(configVariables)
 	defer func() {
 		err := restoreEnvFn()
 		if err != nil {
@@ -28,95 +36,851 @@ func TestLoadDBCredentials(t *testing.T) {
 		}
 	}()
 
-	// set every env variable to its name
-	for _, variable := range variables {
-		os.Setenv(variable, variable)
+	// validEnv is a minimal valid environment
+	validEnv := map[string]string{
+		"ABUSE_MAILADDRESS": "abuse@siasky.net",
+		"ABUSE_MAILBOX":     "\"INBOX\"",
+		"BLOCKER_HOST":      "blocker",
+		"BLOCKER_PORT":      "4000",
+		"EMAIL_PASSWORD":    "emailpass",
+		"EMAIL_SERVER":      "imap.siasky.net:993",
+		"EMAIL_USERNAME":    "abuse",
+		"SERVER_DOMAIN":     "siasky.net",
+		"SKYNET_DB_HOST":    "mongo",
+		"SKYNET_DB_PASS":    "dbpass",
+		"SKYNET_DB_PORT":    "27017",
+		"SKYNET_DB_USER":    "admin",
 	}
 
-	// load db credentials and assert its output (happy case)
-	connstring, credentials, err := loadDBCredentials()
-	if err != nil {
-		t.Fatal(err)
+	// ncmecEnv is the environment that is required when NCMEC reporting is
+	// enabled
+	ncmecEnv := map[string]string{
+		"ABUSE_NCMEC_REPORTING_ENABLED": "true",
+		"ABUSE_PORTAL_URL":              "siasky.net",
+		"NCMEC_DEBUG":                   "true",
+		"NCMEC_PASSWORD":                "ncmecpass",
+		"NCMEC_REPORTER_EMAIL":          "john@siasky.net",
+		"NCMEC_REPORTER_FIRSTNAME":      "John",
+		"NCMEC_REPORTER_LASTNAME":       "Doe",
+		"NCMEC_USERNAME":                "ncmec",
+		"SKYNET_ACCOUNTS_HOST":          "accounts",
+		"SKYNET_ACCOUNTS_PORT":          "3000",
 	}
-	if credentials.Username != "SKYNET_DB_USER" || credentials.Password != "SKYNET_DB_PASS" {
-		t.Fatal("unexpected", credentials)
+
+	tests := []struct {
+		name     string
+		env      []map[string]string
+		unset    []string
+		expected []string
+	}{
+		{
+			name: "Valid",
+			env:  []map[string]string{validEnv},
+		},
+		{
+			name: "ValidNCMEC",
+			env:  []map[string]string{validEnv, ncmecEnv},
+		},
+		{
+			name: "MissingRequired",
+			env:  []map[string]string{validEnv},
+			unset: []string{
+				"ABUSE_MAILADDRESS",
+				"BLOCKER_HOST",
+				"EMAIL_PASSWORD",
+				"EMAIL_SERVER",
+				"EMAIL_USERNAME",
+				"SERVER_DOMAIN",
+				"SKYNET_DB_HOST",
+				"SKYNET_DB_PASS",
+				"SKYNET_DB_USER",
+			},
+			expected: []string{
+				"missing env var ABUSE_MAILADDRESS",
+				"missing env var BLOCKER_HOST",
+				"missing env var EMAIL_PASSWORD",
+				"missing env var EMAIL_SERVER",
+				"missing env var EMAIL_USERNAME",
+				"missing env var SERVER_DOMAIN",
+				"missing env var SKYNET_DB_HOST",
+				"missing env var SKYNET_DB_PASS",
+				"missing env var SKYNET_DB_USER",
+			},
+		},
+		{
+			name:  "MissingRequiredNCMEC",
+			env:   []map[string]string{validEnv, ncmecEnv},
+			unset: []string{"ABUSE_PORTAL_URL", "NCMEC_DEBUG", "NCMEC_PASSWORD", "SKYNET_ACCOUNTS_HOST"},
+			expected: []string{
+				"missing env var ABUSE_PORTAL_URL",
+				"missing env var NCMEC_DEBUG",
+				"missing env var NCMEC_PASSWORD",
+				"missing env var SKYNET_ACCOUNTS_HOST",
+			},
+		},
+		{
+			name: "InvalidPorts",
+			env: []map[string]string{validEnv, ncmecEnv, {
+				"ABUSE_LISTEN_ADDRESS": "9091",
+				"BLOCKER_PORT":         "40o0",
+				"SKYNET_ACCOUNTS_PORT": "0",
+				"SKYNET_DB_PORT":       "",
+			}},
+			expected: []string{
+				"ABUSE_LISTEN_ADDRESS '9091' as a listen address",
+				"BLOCKER_PORT '40o0' as a port number",
+				"SKYNET_ACCOUNTS_PORT '0' as a port number",
+				"SKYNET_DB_PORT can't be empty",
+			},
+		},
+		{
+			name: "InvalidURLs",
+			env: []map[string]string{validEnv, ncmecEnv, {
+				"ABUSE_BLOCKER_ADDITIONAL_URLS": "blocker.eu.siasky.net:4000,ftp://blocker",
+				"ABUSE_NOTIFY_WEBHOOK_URL":      "hooks.slack.com/services/T00/B00/secrettoken",
+				"ABUSE_PORTAL_URL":              "siasky.net,https://siasky net",
+				"ABUSE_SENTRY_DSN":              "sentry.io/42",
+				"SKYNET_ACCOUNTS_HOST":          "ftp://accounts",
+			}},
+			expected: []string{
+				"ABUSE_BLOCKER_ADDITIONAL_URLS 'ftp://blocker'",
+				"ABUSE_NOTIFY_WEBHOOK_URL as a webhook URL",
+				"ABUSE_PORTAL_URL 'https://siasky net' as a URL",
+				"ABUSE_SENTRY_DSN as a Sentry DSN",
+				"SKYNET_ACCOUNTS_HOST 'ftp://accounts'",
+			},
+		},
+		{
+			name: "InvalidLogLevels",
+			env: []map[string]string{validEnv, {
+				"ABUSE_LOG_LEVEL": "info,scanner=debug",
+			}},
+			expected: []string{
+				"ABUSE_LOG_LEVEL 'info,scanner=debug', err unknown module 'scanner'",
+			},
+		},
+		{
+			name: "InvalidFallbackReporterEmail",
+			env: []map[string]string{validEnv, {
+				"ABUSE_FALLBACK_REPORTER_EMAIL": "abuse-at-siasky.net",
+			}},
+			expected: []string{
+				"ABUSE_FALLBACK_REPORTER_EMAIL 'abuse-at-siasky.net' as an email address",
+			},
+		},
+		{
+			name: "InvalidLinkUnwrapRules",
+			env: []map[string]string{validEnv, {
+				"ABUSE_LINK_UNWRAP_RULES": "r.relay.example.com",
+			}},
+			expected: []string{
+				"ABUSE_LINK_UNWRAP_RULES 'r.relay.example.com'",
+			},
+		},
+		{
+			name: "InvalidNCMECResponseActions",
+			env: []map[string]string{validEnv, ncmecEnv, {
+				"ABUSE_NCMEC_RESPONSE_ACTIONS": "1000:retry,4100:ignore",
+			}},
+			expected: []string{
+				"ABUSE_NCMEC_RESPONSE_ACTIONS, err invalid action 'ignore' for response code 4100",
+			},
+		},
+		{
+			name: "InvalidNCMECSkylinkVersions",
+			env: []map[string]string{validEnv, ncmecEnv, {
+				"ABUSE_NCMEC_SKYLINK_VERSIONS": "v1,v3",
+			}},
+			expected: []string{
+				"ABUSE_NCMEC_SKYLINK_VERSIONS 'v3', expected 'v1' or 'v2'",
+			},
+		},
+		{
+			name: "InvalidScreenshotDir",
+			env: []map[string]string{validEnv, ncmecEnv, {
+				"ABUSE_NCMEC_SCREENSHOT_DIR": "main_test.go",
+			}},
+			expected: []string{
+				"ABUSE_NCMEC_SCREENSHOT_DIR 'main_test.go', expected an existing directory",
+			},
+		},
+		{
+			name: "InvalidDurations",
+			env: []map[string]string{validEnv, {
+				"ABUSE_ACCOUNTS_TIMEOUT":               "10",
+				"ABUSE_BLOCKER_BACKLOG_SLA":            "1d",
+				"ABUSE_BLOCKER_RECENT_BLOCK_WINDOW":    "-1h",
+				"ABUSE_HEALTH_MAX_FETCH_AGE":           "0s",
+				"ABUSE_HTTP_DIAL_TIMEOUT":              "5",
+				"ABUSE_INGEST_ALERT_WINDOW":            "-24h",
+				"ABUSE_LEADER_LEASE_TTL":               "1s",
+				"ABUSE_LOG_FILE_MAX_AGE":               "30d",
+				"ABUSE_NOTIFY_MIN_INTERVAL":            "0",
+				"ABUSE_PARSE_TIMEOUT":                  "5 minutes",
+				"ABUSE_REPLY_DIGEST_WINDOW":            "-1m",
+				"ABUSE_SHUTDOWN_TIMEOUT":               "1h30",
+				"ABUSE_SKYTRANSFER_RESOLUTION_MAX_AGE": "-720h",
+			}},
+			expected: []string{
+				"ABUSE_ACCOUNTS_TIMEOUT '10' as a positive duration",
+				"ABUSE_BLOCKER_BACKLOG_SLA '1d' as a positive duration",
+				"ABUSE_BLOCKER_RECENT_BLOCK_WINDOW '-1h' as a positive duration",
+				"ABUSE_HEALTH_MAX_FETCH_AGE '0s' as a positive duration",
+				"ABUSE_HTTP_DIAL_TIMEOUT '5' as a positive duration",
+				"ABUSE_INGEST_ALERT_WINDOW '-24h' as a positive duration",
+				"ABUSE_LEADER_LEASE_TTL '1s', it has to be at least 3s",
+				"ABUSE_LOG_FILE_MAX_AGE '30d' as a positive duration",
+				"ABUSE_NOTIFY_MIN_INTERVAL '0' as a positive duration",
+				"ABUSE_PARSE_TIMEOUT '5 minutes' as a positive duration",
+				"ABUSE_REPLY_DIGEST_WINDOW '-1m' as a positive duration",
+				"ABUSE_SHUTDOWN_TIMEOUT '1h30' as a positive duration",
+				"ABUSE_SKYTRANSFER_RESOLUTION_MAX_AGE '-720h' as a positive duration",
+			},
+		},
+		{
+			name: "InvalidBooleans",
+			env: []map[string]string{validEnv, {
+				"ABUSE_BLOCKER_INCLUDE_EXCERPT": "yes",
+				"ABUSE_DEBUG_PPROF":             "on",
+				"ABUSE_DEDUPE_BY_MESSAGE_ID":    "1",
+				"ABUSE_DRY_RUN":                 "True",
+				"ABUSE_MODULE_PARSER":           "off",
+				"ABUSE_REPLY_GROUP_SKYTRANSFER": "grouped",
+			}},
+			expected: []string{
+				"ABUSE_BLOCKER_INCLUDE_EXCERPT 'yes' as a boolean",
+				"ABUSE_DEBUG_PPROF 'on' as a boolean",
+				"ABUSE_DEDUPE_BY_MESSAGE_ID '1' as a boolean",
+				"ABUSE_DRY_RUN 'True' as a boolean",
+				"ABUSE_MODULE_PARSER 'off' as a boolean",
+				"ABUSE_REPLY_GROUP_SKYTRANSFER 'grouped' as a boolean",
+			},
+		},
+		{
+			name: "ValidDisabledModules",
+			env: []map[string]string{validEnv, {
+				"ABUSE_MODULE_BLOCKER":   "false",
+				"ABUSE_MODULE_FETCHER":   "false",
+				"ABUSE_MODULE_FINALIZER": "false",
+			}},
+			unset: []string{
+				"ABUSE_MAILADDRESS",
+				"ABUSE_MAILBOX",
+				"BLOCKER_HOST",
+				"BLOCKER_PORT",
+				"EMAIL_PASSWORD",
+				"EMAIL_SERVER",
+				"EMAIL_USERNAME",
+			},
+		},
+		{
+			name: "NoEnabledModules",
+			env: []map[string]string{validEnv, {
+				"ABUSE_MODULE_BLOCKER":   "false",
+				"ABUSE_MODULE_FETCHER":   "false",
+				"ABUSE_MODULE_FINALIZER": "false",
+				"ABUSE_MODULE_PARSER":    "false",
+			}},
+			expected: []string{
+				"every module is disabled",
+			},
+		},
+		{
+			name: "InvalidIntegers",
+			env: []map[string]string{validEnv, {
+				"ABUSE_BLOCKER_BREAKER_THRESHOLD": "0",
+				"ABUSE_DB_MAX_UPDATE_RETRIES":     "0",
+				"ABUSE_HTTP_MAX_CONNS_PER_HOST":   "-4",
+				"ABUSE_LOG_FILE_MAX_BACKUPS":      "0",
+				"ABUSE_LOG_FILE_MAX_SIZE":         "100MB",
+				"ABUSE_NCMEC_MAX_REPORT_SIZE":     "1MiB",
+				"ABUSE_TAG_PRIORITIES":            "csam=high",
+			}},
+			expected: []string{
+				"ABUSE_BLOCKER_BREAKER_THRESHOLD '0' as a positive integer",
+				"ABUSE_DB_MAX_UPDATE_RETRIES '0' as a positive integer",
+				"ABUSE_HTTP_MAX_CONNS_PER_HOST '-4' as a positive integer",
+				"ABUSE_LOG_FILE_MAX_BACKUPS '0' as a positive integer",
+				"ABUSE_LOG_FILE_MAX_SIZE '100MB' as a positive integer",
+				"ABUSE_NCMEC_MAX_REPORT_SIZE '1MiB' as a positive integer",
+				"ABUSE_TAG_PRIORITIES 'csam=high'",
+			},
+		},
+		{
+			name: "InvalidModes",
+			env: []map[string]string{validEnv, {
+				"ABUSE_ADMIN_TOKEN":               "secret",
+				"ABUSE_AUTH_MODE":                 "enforce",
+				"ABUSE_BLOCKER_INFLIGHT_HANDLING": "skip",
+				"ABUSE_BLOCKER_INFLIGHT_KEY":      "subject",
+				"ABUSE_BLOCKER_RETRY_POLICY":      "tries=3",
+				"ABUSE_EXTRACTION_MODE":           "precision",
+				"ABUSE_IDN_MODE":                  "unicode",
+				"ABUSE_LOG_FORMAT":                "logfmt",
+				"ABUSE_LOG_LEVEL":                 "verbose",
+				"ABUSE_MAILBOX_TAGS":              "csam",
+				"ABUSE_MARK_FLAG":                 "(processed)",
+				"ABUSE_MARK_MODE":                 "move",
+				"ABUSE_NOTIFY_FORMAT":             "teams",
+				"ABUSE_PII_REDACTION":             "redact",
+				"ABUSE_REPLY_LOCALES":             "de",
+				"ABUSE_REPLY_TEMPLATES_DIR":       "does-not-exist",
+				"ABUSE_REPORTER_ORGS":             "switch.ch",
+			}},
+			expected: []string{
+				"ABUSE_ADMIN_TOKEN, it has to be at least 16 characters",
+				"ABUSE_AUTH_MODE 'enforce'",
+				"ABUSE_BLOCKER_INFLIGHT_HANDLING 'skip'",
+				"ABUSE_BLOCKER_INFLIGHT_KEY 'subject'",
+				"ABUSE_BLOCKER_RETRY_POLICY 'tries=3'",
+				"ABUSE_KNOWN_PORTALS is required",
+				"ABUSE_IDN_MODE 'unicode'",
+				"ABUSE_LOG_FORMAT 'logfmt'",
+				"ABUSE_LOG_LEVEL 'verbose'",
+				"ABUSE_MAILBOX_TAGS 'csam'",
+				"ABUSE_MARK_FLAG '(processed)'",
+				"ABUSE_MARK_MAILBOX is required",
+				"ABUSE_NOTIFY_FORMAT 'teams'",
+				"missing env var ABUSE_PII_KEY",
+				"ABUSE_REPLY_LOCALES 'de'",
+				"ABUSE_REPLY_TEMPLATES_DIR 'does-not-exist', err no response templates found",
+				"ABUSE_REPORTER_ORGS 'switch.ch'",
+			},
+		},
 	}
-	if connstring != "mongodb://SKYNET_DB_HOST:SKYNET_DB_PORT" {
-		t.Fatal("unexpected", connstring)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// reset the environment
+			for _, variable := range configVariables {
+				if err := os.Unsetenv(variable); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, env := range test.env {
+				for variable, value := range env {
+					if err := os.Setenv(variable, value); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for _, variable := range test.unset {
+				if err := os.Unsetenv(variable); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// load the config and assert every problem is reported
+			_, errs := loadConfig("")
+			if len(errs) != len(test.expected) {
+				t.Fatal("unexpected amount of problems", len(errs), errs)
+			}
+			for _, expected := range test.expected {
+				var found bool
+				for _, err := range errs {
+					if strings.Contains(err.Error(), expected) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Fatal("expected problem not found", expected, errs)
+				}
+			}
+		})
 	}
+}
 
-	// unset every env variable one by one and assert the helper indicates what
-	// environment variable is missing
-	for _, variable := range variables {
-		bkp := os.Getenv(variable)
-		err = os.Unsetenv(variable)
+// TestConfig is a unit test that covers the values of a loaded config and its
+// redacted summary.
+func TestConfig(t *testing.T) {
+	// create a function to restore the environment
+	restoreEnvFn := restoreEnv(configVariables)
+	defer func() {
+		err := restoreEnvFn()
 		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for _, variable := range configVariables {
+		if err := os.Unsetenv(variable); err != nil {
 			t.Fatal(err)
 		}
+	}
+	env := map[string]string{
+		"ABUSE_ACCOUNTS_TIMEOUT":               "5s",
+		"ABUSE_ADMIN_TOKEN":                    "0123456789abcdef",
+		"ABUSE_AUTH_MODE":                      "review",
+		"ABUSE_AUTH_SERV_ID":                   "mx.siasky.net",
+		"ABUSE_BLOCKER_ADDITIONAL_URLS":        "blocker.eu.siasky.net:4000, https://blocker.us.siasky.net/",
+		"ABUSE_BLOCKER_INFLIGHT_HANDLING":      "merge",
+		"ABUSE_BLOCKER_RECENT_BLOCK_WINDOW":    "24h",
+		"ABUSE_BLOCKER_RETRY_POLICY":           "attempts=3, backoff=500ms, jitter=0.2",
+		"ABUSE_DRY_RUN":                        "true",
+		"ABUSE_FALLBACK_REPORTER_EMAIL":        "Abuse <abuse@siasky.net>",
+		"ABUSE_HTTP_MAX_CONNS_PER_HOST":        "4",
+		"ABUSE_IDN_MODE":                       "ignore",
+		"ABUSE_INGEST_ALERT_WINDOW":            "24h",
+		"ABUSE_LINK_UNWRAP_RULES":              "R.Relay.example.com = url",
+		"ABUSE_LOG_FILE":                       "/var/log/abuse-scanner/abuse-scanner.log",
+		"ABUSE_LOG_FILE_MAX_AGE":               "168h",
+		"ABUSE_LOG_FILE_MAX_SIZE":              "1048576",
+		"ABUSE_LOG_FORMAT":                     "json",
+		"ABUSE_LOG_LEVEL":                      "debug, blocker=warn",
+		"ABUSE_MAILADDRESS":                    "abuse@siasky.net",
+		"ABUSE_MAILBOX":                        "\"INBOX\"",
+		"ABUSE_MAILBOX_TAGS":                   "CSAM=csam, phishing=Phishing",
+		"ABUSE_NCMEC_NOTIFY_REPORTERS":         "switch.ch, abuse@example.com",
+		"ABUSE_NCMEC_RESPONSE_ACTIONS":         "1000:backoff, 5000:RETRY",
+		"ABUSE_NCMEC_SKYLINK_VERSIONS":         "V1",
+		"ABUSE_NOTIFY_FORMAT":                  "discord",
+		"ABUSE_NOTIFY_WEBHOOK_URL":             "https://discord.com/api/webhooks/42/secrettoken",
+		"ABUSE_PARSE_TIMEOUT":                  "2m",
+		"ABUSE_SKYTRANSFER_RESOLUTION_MAX_AGE": "168h",
+		"ABUSE_PII_KEY":                        "piikey",
+		"ABUSE_PII_REDACTION":                  "hash",
+		"ABUSE_PORTAL_URL":                     "siasky.net, http://skyportal.xyz/",
+		"ABUSE_REPLY_GROUP_SKYTRANSFER":        "true",
+		"ABUSE_REPLY_LOCALES":                  "CERT-Bund.de=DE, abuse@example.at=de",
+		"ABUSE_SENTRY_DSN":                     "https://sentrykey@sentry.siasky.net/42",
+		"ABUSE_TAG_PRIORITIES":                 "Phishing=1, spam=-1",
+		"BLOCKER_HOST":                         "blocker",
+		"BLOCKER_PORT":                         "4000",
+		"EMAIL_PASSWORD":                       "emailpass",
+		"EMAIL_SERVER":                         "imap.siasky.net:993",
+		"EMAIL_USERNAME":                       "abuse",
+		"SERVER_DOMAIN":                        "siasky.net",
+		"SKYNET_ACCOUNTS_API_KEY":              "apikey",
+		"SKYNET_DB_HOST":                       "mongo",
+		"SKYNET_DB_PASS":                       "dbpass",
+		"SKYNET_DB_PORT":                       "27017",
+		"SKYNET_DB_USER":                       "admin",
+	}
+	for variable, value := range env {
+		if err := os.Setenv(variable, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, errs := loadConfig("")
+	if len(errs) != 0 {
+		t.Fatal("unexpected problems", errs)
+	}
+
+	// assert the values
+	if cfg.AbuseMailbox != "INBOX" {
+		t.Fatal("unexpected mailbox", cfg.AbuseMailbox)
+	}
+	if cfg.AccountsTimeout != 5*time.Second {
+		t.Fatal("unexpected accounts timeout", cfg.AccountsTimeout)
+	}
+	if cfg.ParserOptions().ParseTimeout != 2*time.Minute {
+		t.Fatal("unexpected parse timeout", cfg.ParserOptions().ParseTimeout)
+	}
+	if !cfg.FinalizerOptions().GroupSkyTransfer {
+		t.Fatal("expected the skytransfer skylinks to be grouped")
+	}
+	if !reflect.DeepEqual(cfg.FinalizerOptions().ReplyLocales, map[string]string{"cert-bund.de": "de", "abuse@example.at": "de"}) {
+		t.Fatal("unexpected reply locales", cfg.FinalizerOptions().ReplyLocales)
+	}
+	if !reflect.DeepEqual(cfg.ParserOptions().MailboxTags, map[string]string{"csam": "csam", "phishing": "phishing"}) {
+		t.Fatal("unexpected mailbox tags", cfg.ParserOptions().MailboxTags)
+	}
+	if cfg.IngestAlertWindow != 24*time.Hour {
+		t.Fatal("unexpected ingest alert window", cfg.IngestAlertWindow)
+	}
+	if cfg.BlockerOptions().RecentBlockWindow != 24*time.Hour {
+		t.Fatal("unexpected recent block window", cfg.BlockerOptions().RecentBlockWindow)
+	}
+	if cfg.BlockerOptions().RetryPolicy.MaxAttempts != 3 || cfg.BlockerOptions().RetryPolicy.BaseBackoff != 500*time.Millisecond || cfg.BlockerOptions().RetryPolicy.Jitter != 0.2 {
+		t.Fatal("unexpected blocker retry policy", cfg.BlockerOptions().RetryPolicy)
+	}
+	if cfg.ParserOptions().AuthMode != email.AuthModeReview || cfg.ParserOptions().AuthServID != "mx.siasky.net" {
+		t.Fatal("unexpected auth options", cfg.ParserOptions().AuthMode, cfg.ParserOptions().AuthServID)
+	}
+	if cfg.ParserOptions().IDNMode != email.IDNModeIgnore {
+		t.Fatal("unexpected IDN mode", cfg.ParserOptions().IDNMode)
+	}
+	if cfg.ParserOptions().SkyTransferResolutionMaxAge != 168*time.Hour {
+		t.Fatal("unexpected skytransfer resolution max age", cfg.ParserOptions().SkyTransferResolutionMaxAge)
+	}
+	if cfg.BlockerURL != "http://blocker:4000" {
+		t.Fatal("unexpected blocker URL", cfg.BlockerURL)
+	}
+	if !reflect.DeepEqual(cfg.BlockerOptions().AdditionalURLs, []string{"http://blocker.eu.siasky.net:4000", "https://blocker.us.siasky.net"}) {
+		t.Fatal("unexpected additional blocker URLs", cfg.BlockerOptions().AdditionalURLs)
+	}
+	if cfg.DBURI != "mongodb://mongo:27017" {
+		t.Fatal("unexpected db URI", cfg.DBURI)
+	}
+	if cfg.DBCredentials.Username != "admin" || cfg.DBCredentials.Password != "dbpass" {
+		t.Fatal("unexpected db credentials", cfg.DBCredentials)
+	}
+	if cfg.EmailCredentials.Address != "imap.siasky.net:993" || cfg.EmailCredentials.Username != "abuse" || cfg.EmailCredentials.Password != "emailpass" {
+		t.Fatal("unexpected email credentials", cfg.EmailCredentials)
+	}
+	if cfg.ListenAddress != ":9091" {
+		t.Fatal("unexpected listen address", cfg.ListenAddress)
+	}
+	transport, ok := cfg.HTTPClient.Transport.(*http.Transport)
+	if !ok || transport.MaxConnsPerHost != 4 || transport.MaxIdleConns != utils.DefaultHTTPMaxIdleConns {
+		t.Fatal("unexpected HTTP transport", cfg.HTTPClient.Transport)
+	}
+	if cfg.AccountsClientOptions().HTTPClient != cfg.HTTPClient || cfg.BlockerOptions().HTTPClient != cfg.HTTPClient || cfg.ParserOptions().HTTPClient != cfg.HTTPClient || cfg.ReporterOptions().HTTPClient != cfg.HTTPClient {
+		t.Fatal("expected the HTTP client to be shared by all components")
+	}
+	if cfg.Redactor == nil || cfg.ParserOptions().Redactor != cfg.Redactor || cfg.FinalizerOptions().Redactor != cfg.Redactor {
+		t.Fatal("expected the redactor to be shared by the parser and finalizer")
+	}
+	if cfg.Notifier == nil || cfg.BlockerOptions().Notifier != cfg.Notifier || cfg.ParserOptions().Notifier != cfg.Notifier || cfg.ReporterOptions().Notifier != cfg.Notifier {
+		t.Fatal("expected the notifier to be shared by the parser, blocker and reporter")
+	}
+	if cfg.ServerOptions().AdminToken != "0123456789abcdef" {
+		t.Fatal("unexpected admin token", cfg.ServerOptions().AdminToken)
+	}
+	if cfg.LogFormat != logFormatJSON {
+		t.Fatal("unexpected log format", cfg.LogFormat)
+	}
+	if cfg.LogLevel != logrus.DebugLevel || !reflect.DeepEqual(cfg.ModuleLogLevels, map[string]logrus.Level{moduleBlocker: logrus.WarnLevel}) {
+		t.Fatal("unexpected log level", cfg.LogLevel, cfg.ModuleLogLevels)
+	}
+	if !cfg.DryRun || !cfg.BlockerOptions().DryRun || !cfg.FinalizerOptions().DryRun || !cfg.ReporterOptions().DryRun {
+		t.Fatal("expected dry-run mode to be enabled in every module that has side effects")
+	}
+	if cfg.BlockerOptions().InflightHandling != email.InflightHandlingMerge || cfg.BlockerOptions().InflightKey != "" {
+		t.Fatal("unexpected in-flight handling", cfg.BlockerOptions().InflightHandling, cfg.BlockerOptions().InflightKey)
+	}
+	if !reflect.DeepEqual(cfg.FinalizerOptions().NCMECNotifyReporters, []string{"switch.ch", "abuse@example.com"}) {
+		t.Fatal("unexpected NCMEC notify reporters", cfg.FinalizerOptions().NCMECNotifyReporters)
+	}
+	if cfg.LogFile != "/var/log/abuse-scanner/abuse-scanner.log" || cfg.LogFileOptions() != (utils.RotatingFileOptions{MaxAge: 7 * 24 * time.Hour, MaxSize: 1 << 20}) {
+		t.Fatal("unexpected log file", cfg.LogFile, cfg.LogFileOptions())
+	}
+	if !reflect.DeepEqual(cfg.PortalURLs, []string{"https://siasky.net", "https://skyportal.xyz"}) || !reflect.DeepEqual(cfg.ParserOptions().PortalURLs, cfg.PortalURLs) {
+		t.Fatal("unexpected portal URLs", cfg.PortalURLs)
+	}
+	if !reflect.DeepEqual(cfg.DBOptions().TagPriorities, map[string]int{"phishing": 1, "spam": -1}) {
+		t.Fatal("unexpected tag priorities", cfg.DBOptions().TagPriorities)
+	}
+	if cfg.ParserOptions().FallbackReporterEmail != "abuse@siasky.net" {
+		t.Fatal("unexpected fallback reporter email", cfg.ParserOptions().FallbackReporterEmail)
+	}
+	if !reflect.DeepEqual(cfg.ParserOptions().LinkUnwrapRules, map[string]string{"r.relay.example.com": "url"}) {
+		t.Fatal("unexpected link unwrap rules", cfg.ParserOptions().LinkUnwrapRules)
+	}
+	if !reflect.DeepEqual(cfg.ReporterOptions().NCMECResponseActions, map[uint64]string{1000: email.NCMECActionBackoff, 5000: email.NCMECActionRetry}) {
+		t.Fatal("unexpected NCMEC response actions", cfg.ReporterOptions().NCMECResponseActions)
+	}
+	if !reflect.DeepEqual(cfg.ReporterOptions().SkylinkVersions, []string{email.SkylinkVersionV1}) {
+		t.Fatal("unexpected skylink versions", cfg.ReporterOptions().SkylinkVersions)
+	}
+	if !reflect.DeepEqual(cfg.EnabledModules(), []string{moduleFetcher, moduleParser, moduleBlocker, moduleFinalizer}) {
+		t.Fatal("unexpected enabled modules", cfg.EnabledModules())
+	}
+
+	// assert the summary lists every variable but redacts the secrets
+	summary := cfg.String()
+	for variable, value := range env {
+		if !strings.Contains(summary, variable+": ") {
+			t.Fatal("variable missing from summary", variable, summary)
+		}
+		secret := variable == "ABUSE_ADMIN_TOKEN" || variable == "ABUSE_NOTIFY_WEBHOOK_URL" || variable == "ABUSE_PII_KEY" || variable == "ABUSE_SENTRY_DSN" || variable == "EMAIL_PASSWORD" || variable == "SKYNET_ACCOUNTS_API_KEY" || variable == "SKYNET_DB_PASS"
+		if secret && strings.Contains(summary, value) {
+			t.Fatal("secret not redacted", variable, summary)
+		}
+		if secret && !strings.Contains(summary, fmt.Sprintf("%v: %v", variable, redacted)) {
+			t.Fatal("secret not redacted", variable, summary)
+		}
+	}
 
-		_, _, err := loadDBCredentials()
-		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("missing env var %v", variable)) {
-			t.Fatal("unexpected outcome", err)
+	// assert the usernames are masked and the secrets don't leak through the
+	// derived values
+	for _, secret := range []string{"admin", "sentrykey", "secrettoken", "0123456789abcdef"} {
+		if strings.Contains(summary, secret) {
+			t.Fatal("secret not redacted", secret, summary)
+		}
+	}
+	for _, expected := range []string{
+		"EMAIL_USERNAME: ****buse\n",
+		"SKYNET_DB_USER: ****dmin\n",
+		"  blocker URLs: http://blocker:4000, http://blocker.eu.siasky.net:4000, https://blocker.us.siasky.net\n",
+		"  database URI: mongodb://mongo:27017\n",
+		"  log level: debug (Blocker=warning)\n",
+		"  portal URLs: https://siasky.net, https://skyportal.xyz\n",
+	} {
+		if !strings.Contains(summary, expected) {
+			t.Fatal("expected line missing from summary", expected, summary)
 		}
+	}
+}
 
-		// put it back
-		err = os.Setenv(variable, bkp)
-		if err != nil {
-			t.Fatal(err)
+// TestNewLogger verifies the logger writes the fields of an entry as separate
+// keys when it's configured to log JSON.
+func TestNewLogger(t *testing.T) {
+	t.Parallel()
+
+	// assert the JSON output contains the structured fields
+	var buf bytes.Buffer
+	logger := newLogger(Config{LogFormat: logFormatJSON, LogLevel: logrus.InfoLevel}, &buf)
+	logger.WithFields(logrus.Fields{
+		"module":    "Parser",
+		"email_uid": "INBOX-1-1",
+	}).Error("Failed to parse email,\nerror empty body")
+
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if strings.Count(strings.TrimSpace(buf.String()), "\n") != 0 {
+		t.Fatal("expected the entry to be logged on a single line", buf.String())
+	}
+	expected := map[string]string{
+		"email_uid": "INBOX-1-1",
+		"level":     "error",
+		"module":    "Parser",
+		"msg":       "Failed to parse email,\nerror empty body",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Fatalf("unexpected value for key '%v', %v != %v", key, entry[key], value)
 		}
 	}
+	if _, ok := entry["time"]; !ok {
+		t.Fatal("expected a timestamp", entry)
+	}
+
+	// assert the text output is used by default
+	buf.Reset()
+	logger = newLogger(Config{LogFormat: logFormatText, LogLevel: logrus.InfoLevel}, &buf)
+	logger.WithField("email_uid", "INBOX-1-1").Info("Parsed email")
+	if !strings.Contains(buf.String(), `msg="Parsed email" email_uid=INBOX-1-1`) {
+		t.Fatal("unexpected text output", buf.String())
+	}
 }
 
-// TestLoadEmailCredentials is a unit test that covers the loadEmailCredentials
+// TestNewModuleLogger verifies the log level of a module can be overridden,
+// without affecting the level of the other modules.
+func TestNewModuleLogger(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	cfg := Config{
+		LogFormat: logFormatText,
+		LogLevel:  logrus.InfoLevel,
+		ModuleLogLevels: map[string]logrus.Level{
+			moduleBlocker: logrus.WarnLevel,
+			moduleParser:  logrus.DebugLevel,
+		},
+	}
+	logger := newLogger(cfg, &buf)
+
+	// assert the debug line of the parser is emitted while the same line of
+	// the blocker is suppressed
+	newModuleLogger(logger, cfg, moduleParser).WithField("module", moduleParser).Debug("Parsing email")
+	newModuleLogger(logger, cfg, moduleBlocker).WithField("module", moduleBlocker).Debug("Blocking email")
+	if !strings.Contains(buf.String(), `level=debug msg="Parsing email" module=Parser`) {
+		t.Fatal("expected the parser's debug line", buf.String())
+	}
+	if strings.Contains(buf.String(), "Blocking email") {
+		t.Fatal("unexpected blocker debug line", buf.String())
+	}
+
+	// assert the blocker only logs warnings, and the other modules log at
+	// the default level
+	buf.Reset()
+	newModuleLogger(logger, cfg, moduleBlocker).WithField("module", moduleBlocker).Info("Blocked email")
+	newModuleLogger(logger, cfg, moduleBlocker).WithField("module", moduleBlocker).Warn("Blocker backlog exceeds SLA")
+	newModuleLogger(logger, cfg, moduleFetcher).WithField("module", moduleFetcher).Debug("Fetching emails")
+	newModuleLogger(logger, cfg, moduleFetcher).WithField("module", moduleFetcher).Info("Fetched emails")
+	if strings.Contains(buf.String(), "Blocked email") || strings.Contains(buf.String(), "Fetching emails") {
+		t.Fatal("unexpected lines", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Blocker backlog exceeds SLA") || !strings.Contains(buf.String(), "Fetched emails") {
+		t.Fatal("expected lines", buf.String())
+	}
+	if newModuleLogger(logger, cfg, moduleFetcher) != logger {
+		t.Fatal("expected the logger of a module without an override to be the shared logger")
+	}
+}
+
+// TestParseConflictPatterns is a unit test that covers the
+// parseConflictPatterns helper.
+func TestParseConflictPatterns(t *testing.T) {
+	// empty case
+	patterns, err := parseConflictPatterns(" ; ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patterns != nil {
+		t.Fatal("unexpected", patterns)
+	}
+
+	// happy case, patterns are case-insensitive and may contain commas
+	patterns, err = parseConflictPatterns("acceptable use policy; terms\\s{1,3}of service ;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 2 || !patterns[0].MatchString("our Acceptable Use Policy") || !patterns[1].MatchString("Terms  of Service") {
+		t.Fatal("unexpected", patterns)
+	}
+
+	// invalid case
+	_, err = parseConflictPatterns("terms of (service")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestParseLogLevels is a unit test that covers the parseLogLevels helper.
+func TestParseLogLevels(t *testing.T) {
+	t.Parallel()
+
+	level, moduleLevels, err := parseLogLevels(" warn, Parser = debug,blocker=error,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level != logrus.WarnLevel {
+		t.Fatal("unexpected level", level)
+	}
+	expected := map[string]logrus.Level{moduleParser: logrus.DebugLevel, moduleBlocker: logrus.ErrorLevel}
+	if !reflect.DeepEqual(moduleLevels, expected) {
+		t.Fatal("unexpected module levels", moduleLevels)
+	}
+
+	// assert the default level is optional
+	level, moduleLevels, err = parseLogLevels("fetcher=trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level != logrus.InfoLevel || !reflect.DeepEqual(moduleLevels, map[string]logrus.Level{moduleFetcher: logrus.TraceLevel}) {
+		t.Fatal("unexpected levels", level, moduleLevels)
+	}
+
+	for _, invalid := range []string{"verbose", "info,debug", "scanner=debug", "parser=verbose"} {
+		_, _, err = parseLogLevels(invalid)
+		if err == nil {
+			t.Fatal("expected error", invalid)
+		}
+	}
+}
+
+// TestParseTagPriorities is a unit test that covers the parseTagPriorities
 // helper.
-func TestLoadEmailCredentials(t *testing.T) {
-	variables := []string{
-		"EMAIL_SERVER",
-		"EMAIL_USERNAME",
-		"EMAIL_PASSWORD",
+func TestParseTagPriorities(t *testing.T) {
+	// empty case
+	priorities, err := parseTagPriorities("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(priorities) != 0 {
+		t.Fatal("unexpected", priorities)
 	}
 
-	// create a function to restore the environment
-	restoreEnvFn := restoreEnv(variables)
-	defer func() {
-		err := restoreEnvFn()
-		if err != nil {
-			t.Error(err)
+	// happy case
+	priorities, err = parseTagPriorities(" CSAM=10, phishing = 1 , spam=-1,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(priorities, map[string]int{"csam": 10, "phishing": 1, "spam": -1}) {
+		t.Fatal("unexpected", priorities)
+	}
+
+	// invalid cases
+	for _, input := range []string{"csam", "csam=", "=10", "csam=high", "csam=1.5"} {
+		_, err = parseTagPriorities(input)
+		if err == nil {
+			t.Fatal("expected error", input)
 		}
-	}()
+	}
+}
 
-	// set every env variable to its name
-	for _, variable := range variables {
-		os.Setenv(variable, variable)
+// TestParseMailboxTags is a unit test that covers the parseMailboxTags helper.
+func TestParseMailboxTags(t *testing.T) {
+	// empty case
+	tags, err := parseMailboxTags("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 0 {
+		t.Fatal("unexpected", tags)
 	}
 
-	// load email credentials and assert its output (happy case)
-	credentials, err := loadEmailCredentials()
+	// happy case
+	tags, err = parseMailboxTags(" CSAM=csam, copyright = Copyright ,")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if credentials.Address != "EMAIL_SERVER" || credentials.Username != "EMAIL_USERNAME" || credentials.Password != "EMAIL_PASSWORD" {
-		t.Fatal("unexpected", credentials)
+	if len(tags) != 2 || tags["csam"] != "csam" || tags["copyright"] != "copyright" {
+		t.Fatal("unexpected", tags)
 	}
 
-	// unset every env variable one by one and assert the helper indicates what
-	// environment variable is missing
-	for _, variable := range variables {
-		bkp := os.Getenv(variable)
-		err = os.Unsetenv(variable)
-		if err != nil {
-			t.Fatal(err)
+	// invalid cases
+	for _, input := range []string{"csam", "csam=", "=csam"} {
+		_, err = parseMailboxTags(input)
+		if err == nil {
+			t.Fatal("expected error for input", input)
 		}
+	}
+}
+
+// TestParseReplyLocales is a unit test that covers the parseReplyLocales
+// helper.
+func TestParseReplyLocales(t *testing.T) {
+	// empty case
+	locales, err := parseReplyLocales("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locales) != 0 {
+		t.Fatal("unexpected", locales)
+	}
+
+	// happy case
+	locales, err = parseReplyLocales(" CERT-Bund.de=DE, abuse@example.at = de ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locales) != 2 || locales["cert-bund.de"] != "de" || locales["abuse@example.at"] != "de" {
+		t.Fatal("unexpected", locales)
+	}
 
-		_, err := loadEmailCredentials()
-		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("missing env var '%v'", variable)) {
-			t.Fatal("unexpected outcome", variable, err)
+	// invalid cases
+	for _, input := range []string{"de", "cert-bund.de=", "=de"} {
+		_, err = parseReplyLocales(input)
+		if err == nil {
+			t.Fatal("expected error for input", input)
 		}
+	}
+}
 
-		// put it back
-		err = os.Setenv(variable, bkp)
-		if err != nil {
-			t.Fatal(err)
+// TestParseReporterOrgs is a unit test that covers the parseReporterOrgs
+// helper.
+func TestParseReporterOrgs(t *testing.T) {
+	// empty case
+	orgs, err := parseReporterOrgs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 0 {
+		t.Fatal("unexpected", orgs)
+	}
+
+	// happy case
+	orgs, err = parseReporterOrgs(" Switch.ch=SWITCH-CERT, namecheap.com = Namecheap Abuse ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 2 || orgs["switch.ch"] != "SWITCH-CERT" || orgs["namecheap.com"] != "Namecheap Abuse" {
+		t.Fatal("unexpected", orgs)
+	}
+
+	// invalid cases
+	for _, input := range []string{"switch.ch", "switch.ch=", "=SWITCH-CERT"} {
+		_, err = parseReporterOrgs(input)
+		if err == nil {
+			t.Fatal("expected error for input", input)
 		}
 	}
 }
@@ -159,6 +923,113 @@ func TestRestoreEnv(t *testing.T) {
 	}
 }
 
+// configVariables contains all env variables that are loaded by loadConfig.
+var configVariables = []string{
+	"ABUSE_ACCOUNTS_BREAKER_COOLDOWN",
+	"ABUSE_ACCOUNTS_BREAKER_THRESHOLD",
+	"ABUSE_ACCOUNTS_CACHE_TTL",
+	"ABUSE_ACCOUNTS_REQUIRE_HEALTHY",
+	"ABUSE_ACCOUNTS_STRICT_DECODING",
+	"ABUSE_ACCOUNTS_TIMEOUT",
+	"ABUSE_ADMIN_TOKEN",
+	"ABUSE_ALLOWED_RECIPIENTS",
+	"ABUSE_AUTH_MODE",
+	"ABUSE_AUTH_SERV_ID",
+	"ABUSE_BLOCKER_ADDITIONAL_URLS",
+	"ABUSE_BLOCKER_BACKLOG_SLA",
+	"ABUSE_BLOCKER_BREAKER_COOLDOWN",
+	"ABUSE_BLOCKER_BREAKER_THRESHOLD",
+	"ABUSE_BLOCKER_INCLUDE_EXCERPT",
+	"ABUSE_BLOCKER_INFLIGHT_HANDLING",
+	"ABUSE_BLOCKER_INFLIGHT_KEY",
+	"ABUSE_BLOCKER_MERGE_TAGS",
+	"ABUSE_BLOCKER_RECENT_BLOCK_WINDOW",
+	"ABUSE_BLOCKER_RETRY_POLICY",
+	"ABUSE_CONFLICT_PATTERNS",
+	"ABUSE_CONFLICT_TAGS",
+	"ABUSE_DB_MAX_UPDATE_RETRIES",
+	"ABUSE_DEBUG_PPROF",
+	"ABUSE_DEDUPE_BY_MESSAGE_ID",
+	"ABUSE_DRY_RUN",
+	"ABUSE_EVIDENCE_HOSTS",
+	"ABUSE_EXTRACTION_MODE",
+	"ABUSE_FALLBACK_REPORTER_EMAIL",
+	"ABUSE_HEALTH_LOOP_GRACE_PERIOD",
+	"ABUSE_HEALTH_MAX_FETCH_AGE",
+	"ABUSE_HOLD_LOW_CONFIDENCE_REPLIES",
+	"ABUSE_IDN_MODE",
+	"ABUSE_HTTP_DIAL_TIMEOUT",
+	"ABUSE_HTTP_IDLE_CONN_TIMEOUT",
+	"ABUSE_INGEST_ALERT_WINDOW",
+	"ABUSE_HTTP_MAX_CONNS_PER_HOST",
+	"ABUSE_HTTP_MAX_IDLE_CONNS",
+	"ABUSE_HTTP_MAX_IDLE_CONNS_PER_HOST",
+	"ABUSE_HTTP_RESPONSE_HEADER_TIMEOUT",
+	"ABUSE_KNOWN_PORTALS",
+	"ABUSE_LEADER_LEASE_TTL",
+	"ABUSE_LINK_UNWRAP_RULES",
+	"ABUSE_LISTEN_ADDRESS",
+	"ABUSE_LOG_FILE",
+	"ABUSE_LOG_FILE_MAX_AGE",
+	"ABUSE_LOG_FILE_MAX_BACKUPS",
+	"ABUSE_LOG_FILE_MAX_SIZE",
+	"ABUSE_LOG_FORMAT",
+	"ABUSE_LOG_LEVEL",
+	"ABUSE_MAILADDRESS",
+	"ABUSE_MAILBOX",
+	"ABUSE_MAILBOX_TAGS",
+	"ABUSE_MARK_FLAG",
+	"ABUSE_MARK_MAILBOX",
+	"ABUSE_MARK_MODE",
+	"ABUSE_MODULE_BLOCKER",
+	"ABUSE_MODULE_FETCHER",
+	"ABUSE_MODULE_FINALIZER",
+	"ABUSE_MODULE_PARSER",
+	"ABUSE_NCMEC_MAX_REPORT_SIZE",
+	"ABUSE_NCMEC_NOTIFY_REPORTERS",
+	"ABUSE_NCMEC_REPORTING_ENABLED",
+	"ABUSE_NCMEC_RESPONSE_ACTIONS",
+	"ABUSE_NCMEC_SCREENSHOT_DIR",
+	"ABUSE_NCMEC_SKYLINK_VERSIONS",
+	"ABUSE_NOTIFY_FORMAT",
+	"ABUSE_NOTIFY_MIN_INTERVAL",
+	"ABUSE_NOTIFY_WEBHOOK_URL",
+	"ABUSE_PARSE_TIMEOUT",
+	"ABUSE_PII_KEY",
+	"ABUSE_PII_REDACTION",
+	"ABUSE_PORTAL_URL",
+	"ABUSE_REPLY_DIGEST_WINDOW",
+	"ABUSE_REPLY_GROUP_SKYTRANSFER",
+	"ABUSE_REPLY_LOCALES",
+	"ABUSE_REPLY_TEMPLATES_DIR",
+	"ABUSE_REPORTER_ORGS",
+	"ABUSE_SENTRY_DSN",
+	"ABUSE_SHORTENER_HOSTS",
+	"ABUSE_SHUTDOWN_TIMEOUT",
+	"ABUSE_SKYTRANSFER_RESOLUTION_MAX_AGE",
+	"ABUSE_SPONSOR",
+	"ABUSE_TAG_PRIORITIES",
+	"BLOCKER_HOST",
+	"BLOCKER_PORT",
+	"EMAIL_PASSWORD",
+	"EMAIL_SERVER",
+	"EMAIL_USERNAME",
+	"NCMEC_DEBUG",
+	"NCMEC_PASSWORD",
+	"NCMEC_REPORTER_EMAIL",
+	"NCMEC_REPORTER_FIRSTNAME",
+	"NCMEC_REPORTER_LASTNAME",
+	"NCMEC_USERNAME",
+	"SERVER_DOMAIN",
+	"SKYNET_ACCOUNTS_API_KEY",
+	"SKYNET_ACCOUNTS_HOST",
+	"SKYNET_ACCOUNTS_PORT",
+	"SKYNET_DB_HOST",
+	"SKYNET_DB_PASS",
+	"SKYNET_DB_PORT",
+	"SKYNET_DB_USER",
+}
+
 // restoreEnv is a helper function that returns a function that, when executed,
 // restores the environment to the point restoreEnv got called. It restores the
 // environment only for the given set of environment variable names.
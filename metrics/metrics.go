@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// namespace is the namespace of all abuse scanner metrics
+	namespace = "abuse_scanner"
+
+	// ReportStateFailed and ReportStatePending are the states of unfiled
+	// NCMEC reports, failed reports are not retried.
+	ReportStateFailed  = "failed"
+	ReportStatePending = "pending"
+)
+
+var (
+	// Registry is the registry every abuse scanner metric is registered
+	// with, it is served by the scanner's HTTP server. Next to the scanner
+	// metrics it contains the standard Go runtime and process metrics.
+	Registry = prometheus.NewRegistry()
+
+	// IngestStalled is 1 while the watchdog finds no new emails were ingested
+	// within the configured window, and 0 otherwise.
+	IngestStalled = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ingest_stalled",
+		Help:      "Whether no new emails were ingested within the configured window, according to the watchdog.",
+	})
+
+	// LoopIterations counts the iterations of the main loop of every module.
+	LoopIterations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "loop_iterations_total",
+		Help:      "The amount of iterations of the main loop of every module.",
+	}, []string{"module"})
+
+	// LoopPanics counts the panics in the main loop of every module.
+	LoopPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "loop_panics_total",
+		Help:      "The amount of panics in the main loop of every module.",
+	}, []string{"module"})
+
+	// LoopLastIteration is the time of the last iteration of the main loop
+	// of every module.
+	LoopLastIteration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "loop_last_iteration_timestamp_seconds",
+		Help:      "The unix time of the last iteration of the main loop of every module.",
+	}, []string{"module"})
+
+	// LoopStalled is 1 for every module of which the watchdog found the main
+	// loop stalled, and 0 otherwise.
+	LoopStalled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "loop_stalled",
+		Help:      "Whether the main loop of every module is stalled, according to the watchdog.",
+	}, []string{"module"})
+
+	// NCMECUnfiledReports is the amount of NCMEC reports that have not been
+	// filed, by state. A growing amount of failed reports needs attention,
+	// as does a pending amount that does not decrease.
+	NCMECUnfiledReports = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ncmec_unfiled_reports",
+		Help:      "The amount of NCMEC reports that have not been filed, by state, either pending or failed.",
+	}, []string{"state"})
+
+	// Paused is 1 if the processing is paused through the global pause
+	// switch, and 0 otherwise.
+	Paused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "paused",
+		Help:      "Whether the processing is paused through the global pause switch.",
+	})
+)
+
+type (
+	// LoopHeartbeat is the heartbeat the main loop of a module records at
+	// the top of every iteration.
+	LoopHeartbeat struct {
+		// Deadline is the time by which the next iteration is expected.
+		Deadline time.Time
+
+		// Interval is the time between the iterations.
+		Interval time.Duration
+	}
+)
+
+var (
+	// loopHeartbeats contains the last heartbeat of the main loop of every
+	// module, it's used to detect modules that are wedged
+	loopHeartbeats   = make(map[string]LoopHeartbeat)
+	loopHeartbeatsMu sync.Mutex
+
+	// loopsStopped contains the reason why the main loop of a module stopped,
+	// for the modules of which the loop gave up
+	loopsStopped   = make(map[string]string)
+	loopsStoppedMu sync.Mutex
+)
+
+// modules are the names of the modules that report metrics, these correspond
+// to the module field of their logger
+var modules = []string{
+	"Blocker",
+	"Fetcher",
+	"Finalizer",
+	"Parser",
+	"Reporter",
+}
+
+// init registers all metrics with the registry.
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		IngestStalled,
+		LoopIterations,
+		LoopLastIteration,
+		LoopPanics,
+		LoopStalled,
+		NCMECUnfiledReports,
+		Paused,
+	)
+
+	// initialize the label values so the metrics are exported before the
+	// modules report them for the first time
+	for _, module := range modules {
+		LoopIterations.WithLabelValues(module)
+		LoopPanics.WithLabelValues(module)
+		LoopStalled.WithLabelValues(module)
+	}
+}
+
+// LoopDeadline returns the time by which the next iteration of the main loop
+// of the given module is expected. It returns false if the module did not
+// report any iteration yet.
+func LoopDeadline(module string) (time.Time, bool) {
+	heartbeat, exists := LoopHeartbeatFor(module)
+	return heartbeat.Deadline, exists
+}
+
+// LoopHeartbeatFor returns the last heartbeat of the main loop of the given
+// module, if a module runs multiple loops that's the heartbeat with the latest
+// deadline. It returns false if the module did not report any iteration yet.
+func LoopHeartbeatFor(module string) (LoopHeartbeat, bool) {
+	loopHeartbeatsMu.Lock()
+	defer loopHeartbeatsMu.Unlock()
+	heartbeat, exists := loopHeartbeats[module]
+	return heartbeat, exists
+}
+
+// RecordLoopIteration records an iteration of the main loop of the given
+// module, the interval is the time until its next iteration.
+func RecordLoopIteration(module string, interval time.Duration) {
+	now := time.Now()
+	LoopIterations.WithLabelValues(module).Inc()
+	LoopLastIteration.WithLabelValues(module).Set(float64(now.Unix()))
+
+	loopHeartbeatsMu.Lock()
+	defer loopHeartbeatsMu.Unlock()
+	deadline := now.Add(interval)
+	if deadline.After(loopHeartbeats[module].Deadline) {
+		loopHeartbeats[module] = LoopHeartbeat{
+			Deadline: deadline,
+			Interval: interval,
+		}
+	}
+}
+
+// LoopStopped returns the reason why the main loop of the given module stopped,
+// it returns false if the loop did not stop.
+func LoopStopped(module string) (string, bool) {
+	loopsStoppedMu.Lock()
+	defer loopsStoppedMu.Unlock()
+	reason, stopped := loopsStopped[module]
+	return reason, stopped
+}
+
+// RecordLoopPanic records a panic in the main loop of the given module.
+func RecordLoopPanic(module string) {
+	LoopPanics.WithLabelValues(module).Inc()
+}
+
+// RecordIngestStalled records whether the watchdog found no new emails were
+// ingested within the configured window.
+func RecordIngestStalled(stalled bool) {
+	if stalled {
+		IngestStalled.Set(1)
+		return
+	}
+	IngestStalled.Set(0)
+}
+
+// RecordLoopStalled records whether the watchdog found the main loop of the
+// given module stalled.
+func RecordLoopStalled(module string, stalled bool) {
+	if stalled {
+		LoopStalled.WithLabelValues(module).Set(1)
+		return
+	}
+	LoopStalled.WithLabelValues(module).Set(0)
+}
+
+// RecordLoopStopped records the main loop of the given module stopped for the
+// given reason.
+func RecordLoopStopped(module, reason string) {
+	loopsStoppedMu.Lock()
+	defer loopsStoppedMu.Unlock()
+	loopsStopped[module] = reason
+}
+
+// RecordUnfiledReports records the amount of NCMEC reports that have not been
+// filed.
+func RecordUnfiledReports(pending, failed int64) {
+	NCMECUnfiledReports.WithLabelValues(ReportStatePending).Set(float64(pending))
+	NCMECUnfiledReports.WithLabelValues(ReportStateFailed).Set(float64(failed))
+}
+
+// RecordPaused records whether the processing is paused.
+func RecordPaused(paused bool) {
+	if paused {
+		Paused.Set(1)
+		return
+	}
+	Paused.Set(0)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"abuse-scanner/accounts"
+	"abuse-scanner/api"
+	"abuse-scanner/database"
+	"abuse-scanner/email"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// the names of the modules, see email.Module
+	moduleBlocker   = email.ModuleBlocker
+	moduleFetcher   = email.ModuleFetcher
+	moduleFinalizer = email.ModuleFinalizer
+	moduleParser    = email.ModuleParser
+	moduleReporter  = email.ModuleReporter
+
+	// the names of the jobs that run on a single instance across all
+	// instances that share the database
+	jobDigest      = "digest"
+	jobNCMECFiling = "ncmec_filing"
+)
+
+type (
+	// modules contains the modules of the scanner, a module that is disabled
+	// in the config is nil.
+	modules struct {
+		fetcher   *email.Fetcher
+		parser    *email.Parser
+		blocker   *email.Blocker
+		finalizer *email.Finalizer
+		reporter  *email.Reporter
+
+		// pause is the pause switch the modules share
+		pause *database.PauseSwitch
+
+		// components contains the modules that were started, in the order
+		// in which they have to be stopped
+		components []component
+	}
+)
+
+// startModules creates and starts the modules that are enabled in the given
+// config. Every module gets its own child context of the given context, which
+// gets cancelled right before the module is stopped. If starting a module
+// fails, the components that were started already are stopped before the error
+// is returned.
+func startModules(ctx context.Context, cfg Config, abuseDB *database.AbuseScannerDB, logger *logrus.Logger) (_ *modules, err error) {
+	m := new(modules)
+
+	// the pause switch pauses the modules of all instances at once, it's
+	// stopped after all modules
+	pause := abuseDB.NewPauseSwitch(ctx, 0)
+	err = pause.Start()
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to start the pause switch")
+	}
+	m.pause = pause
+	pauseComponent := component{name: "pause switch", stop: pause.Stop}
+
+	// if a module fails to start, stop the components that were started
+	// already in the order in which they're stopped on shutdown, which is the
+	// reverse of the order in which they depend on each other
+	defer func() {
+		if err != nil {
+			components := append(m.components, pauseComponent)
+			err = errors.Compose(err, stopComponents(components, cfg.ShutdownTimeout, logger))
+		}
+	}()
+	if pause.IsPaused() {
+		logger.Warn("Processing is paused, run the resume command to resume it")
+	}
+
+	// create a new mail fetcher, it downloads the emails
+	if cfg.ModuleFetcher {
+		logger.Info("Initializing email fetcher...")
+		fetcherCtx, cancel := context.WithCancel(ctx)
+		opts := cfg.FetcherOptions()
+		opts.Pause = pause
+		m.fetcher = email.NewFetcher(fetcherCtx, abuseDB, cfg.EmailCredentials, cfg.AbuseMailbox, cfg.ServerDomain, opts, newModuleLogger(logger, cfg, moduleFetcher))
+		err := m.start(m.fetcher, cancel)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to start the email fetcher")
+		}
+	}
+
+	// create a new mail parser, it parses any email that's not parsed yet for
+	// abuse skylinks and a set of abuse tag
+	if cfg.ModuleParser {
+		logger.Info("Initializing email parser...")
+		parserCtx, cancel := context.WithCancel(ctx)
+		opts := cfg.ParserOptions()
+		opts.Pause = pause
+		m.parser = email.NewParser(parserCtx, abuseDB, cfg.ServerDomain, cfg.AbuseSponsor, opts, newModuleLogger(logger, cfg, moduleParser))
+		err := m.start(m.parser, cancel)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to start the email parser")
+		}
+	}
+
+	// create a new blocker, it blocks skylinks for any emails which have been
+	// parsed but not blocked yet, it uses the blocker API for this.
+	if cfg.ModuleBlocker {
+		logger.Info("Initializing blocker...")
+		blockerCtx, cancel := context.WithCancel(ctx)
+		opts := cfg.BlockerOptions()
+		opts.Pause = pause
+		m.blocker = email.NewBlocker(blockerCtx, cfg.BlockerURL, cfg.ServerDomain, abuseDB, opts, newModuleLogger(logger, cfg, moduleBlocker))
+		err := m.start(m.blocker, cancel)
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to start the blocker")
+		}
+	}
+
+	// create a new finalizer, it finalizes the abuse report for any emails
+	// which are parsed, blocked, but not yet finalized. An email is finalized
+	// when the abuse scanner has replied with a report of all the skylinks
+	// that have been found and blocked.
+	if cfg.ModuleFinalizer {
+		logger.Info("Initializing finalizer...")
+		finalizerCtx, cancel := context.WithCancel(ctx)
+		opts := cfg.FinalizerOptions()
+		opts.Pause = pause
+
+		// the digest replies are sent by a single instance
+		var lease *database.LeaderLease
+		if cfg.ReplyDigestWindow > 0 {
+			lease = abuseDB.NewLeaderLease(finalizerCtx, jobDigest, cfg.LeaderLeaseTTL)
+			err := lease.Start()
+			if err != nil {
+				cancel()
+				return nil, errors.AddContext(err, "failed to start the digest leader lease")
+			}
+			opts.DigestLeader = lease
+		}
+
+		m.finalizer = email.NewFinalizer(finalizerCtx, abuseDB, cfg.EmailCredentials, cfg.AbuseMailaddress, cfg.AbuseMailbox, cfg.ServerDomain, opts, newModuleLogger(logger, cfg, moduleFinalizer))
+		err := m.start(m.finalizer, cancel)
+		if err != nil {
+			return nil, errors.Compose(errors.AddContext(err, "failed to start the email finalizer"), stopLease(lease))
+		}
+		if lease != nil {
+			m.components = append(m.components, component{name: "digest leader lease", stop: lease.Stop})
+		}
+	}
+
+	// create a new reporter, it will scan for emails that contain CSAM and
+	// report those instances to NCMEC.
+	if cfg.NCMECReportingEnabled {
+		// create an accounts client
+		accountsClient, err := accounts.NewAccountsClient(cfg.AccountsHost, cfg.AccountsPort, cfg.AccountsClientOptions())
+		if err != nil {
+			return nil, errors.AddContext(err, fmt.Sprintf("failed to create the accounts client for host '%s' and port '%s'", cfg.AccountsHost, cfg.AccountsPort))
+		}
+
+		logger.Info("Initializing reporter...")
+		opts := cfg.ReporterOptions()
+		opts.Pause = pause
+
+		// the NCMEC reports are filed by a single instance, in dry-run mode
+		// they're never filed
+		var lease *database.LeaderLease
+		if !cfg.DryRun {
+			lease = abuseDB.NewLeaderLease(ctx, jobNCMECFiling, cfg.LeaderLeaseTTL)
+			err = lease.Start()
+			if err != nil {
+				return nil, errors.AddContext(err, "failed to start the NCMEC filing leader lease")
+			}
+			opts.FilingLeader = lease
+		}
+
+		m.reporter = email.NewReporter(abuseDB, accountsClient, cfg.NCMECCredentials, cfg.PortalURLs, cfg.ServerDomain, cfg.NCMECReporter, opts, newModuleLogger(logger, cfg, moduleReporter))
+		err = m.start(m.reporter, nil)
+		if err != nil {
+			return nil, errors.Compose(errors.AddContext(err, "failed to start the NCMEC reporter"), stopLease(lease))
+		}
+		if lease != nil {
+			m.components = append(m.components, component{name: "NCMEC filing leader lease", stop: lease.Stop})
+		}
+	}
+	m.components = append(m.components, pauseComponent)
+	return m, nil
+}
+
+// stopLease is a helper function that stops the given leader lease of a module
+// that failed to start, the lease is nil if the module does not use one.
+func stopLease(lease *database.LeaderLease) error {
+	if lease == nil {
+		return nil
+	}
+	return errors.AddContext(lease.Stop(), "failed to stop the leader lease")
+}
+
+// start starts the given module and adds it to the components that are stopped
+// on shutdown, under the lowercased name of the module. The given cancel
+// function, if any, cancels the context of the module, it's called right
+// before the module is stopped, or right away if the module fails to start.
+func (m *modules) start(module email.Module, cancel context.CancelFunc) error {
+	err := module.Start()
+	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
+		return err
+	}
+	stop := module.Stop
+	if cancel != nil {
+		stop = cancelAndStop(cancel, module.Stop)
+	}
+	m.components = append(m.components, component{name: strings.ToLower(module.Name()), stop: stop})
+	return nil
+}
+
+// reload swaps the reloadable options in the given config into the modules
+// that were started.
+func (m *modules) reload(cfg Config) {
+	if m.fetcher != nil {
+		m.fetcher.Reload(cfg.FetcherOptions())
+	}
+	if m.parser != nil {
+		m.parser.Reload(cfg.ParserOptions())
+	}
+	if m.finalizer != nil {
+		m.finalizer.Reload(cfg.FinalizerOptions())
+	}
+}
+
+// addChecks registers the health checks of the modules that were started with
+// the given server, the liveness of every module is checked through the loop
+// iterations it records.
+func (m *modules) addChecks(server *api.Server, cfg Config) {
+	if m.fetcher != nil {
+		server.AddCheck("imap", true, api.AgeCheck(m.fetcher.LastFetch, cfg.HealthMaxFetchAge))
+	}
+	if m.blocker != nil {
+		server.AddCheck("blocker_api", false, m.blocker.Health)
+	}
+	if m.reporter != nil {
+		reporter := m.reporter
+		server.AddCheck("ncmec_api", false, func(context.Context) error {
+			return reporter.NCMECHealth()
+		})
+	}
+	for _, module := range cfg.EnabledModules() {
+		server.AddCheck(strings.ToLower(module)+"_loop", true, api.LoopCheck(module, cfg.HealthLoopGracePeriod))
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"abuse-scanner/database"
+	"abuse-scanner/email"
+	"abuse-scanner/metrics"
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// testModule is a module that records its calls to Start and Stop.
+	testModule struct {
+		calls    *[]string
+		name     string
+		startErr error
+	}
+)
+
+// Name implements the email.Module interface.
+func (tm *testModule) Name() string {
+	return tm.name
+}
+
+// Start implements the email.Module interface.
+func (tm *testModule) Start() error {
+	*tm.calls = append(*tm.calls, "start "+tm.name)
+	return tm.startErr
+}
+
+// Stop implements the email.Module interface.
+func (tm *testModule) Stop() error {
+	*tm.calls = append(*tm.calls, "stop "+tm.name)
+	return nil
+}
+
+// TestModulesStart verifies the modules that are started are stopped on
+// shutdown, in the order in which they were started, and that the context of a
+// module is cancelled before it is stopped.
+func TestModulesStart(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	var calls []string
+	cancelFunc := func(name string) context.CancelFunc {
+		return func() { calls = append(calls, "cancel "+name) }
+	}
+
+	// start a module with a context, and the reporter, which has none
+	m := new(modules)
+	err := m.start(&testModule{calls: &calls, name: moduleParser}, cancelFunc(moduleParser))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.start(&testModule{calls: &calls, name: moduleReporter}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert a module that fails to start has its context cancelled and is
+	// not stopped on shutdown
+	startErr := errors.New("start failure")
+	err = m.start(&testModule{calls: &calls, name: moduleBlocker, startErr: startErr}, cancelFunc(moduleBlocker))
+	if err != startErr {
+		t.Fatal("unexpected error", err)
+	}
+	if len(m.components) != 2 || m.components[0].name != "parser" || m.components[1].name != "reporter" {
+		t.Fatal("unexpected components", m.components)
+	}
+
+	// assert the reporter is stopped on shutdown
+	err = stopComponents(m.components, time.Minute, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"start Parser",
+		"start Reporter",
+		"start Blocker",
+		"cancel Blocker",
+		"cancel Parser",
+		"stop Parser",
+		"stop Reporter",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatal("unexpected calls", calls)
+	}
+
+	// assert all modules of the scanner implement the interface
+	_ = []email.Module{
+		new(email.Blocker),
+		new(email.Fetcher),
+		new(email.Finalizer),
+		new(email.Parser),
+		new(email.Reporter),
+	}
+}
+
+// TestStartModules verifies only the modules that are enabled in the config
+// are started, and that the loops of the disabled modules never run.
+func TestStartModules(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// start the scanner with only the parser enabled
+	cfg := Config{
+		ModuleParser:    true,
+		ServerDomain:    "dev.siasky.net",
+		ShutdownTimeout: time.Minute,
+	}
+	m, err := startModules(ctx, cfg, db, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.parser == nil || m.fetcher != nil || m.blocker != nil || m.finalizer != nil || m.reporter != nil {
+		t.Fatal("unexpected modules", m)
+	}
+	if len(m.components) != 2 || m.components[0].name != "parser" || m.components[1].name != "pause switch" {
+		t.Fatal("unexpected components", m.components)
+	}
+
+	// assert the parser loop runs
+	start := time.Now()
+	for {
+		if _, ok := metrics.LoopDeadline(moduleParser); ok {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("expected the parser loop to run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// assert the loops of the disabled modules did not run
+	for _, module := range []string{moduleBlocker, moduleFetcher, moduleFinalizer, moduleReporter} {
+		if _, ok := metrics.LoopDeadline(module); ok {
+			t.Fatalf("expected the %v loop not to run", module)
+		}
+	}
+
+	// assert only the parser and the pause switch are stopped
+	err = stopComponents(m.components, cfg.ShutdownTimeout, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStartModulesFailure verifies the components that were started are
+// stopped when a module fails to start, which releases their leader leases.
+func TestStartModulesFailure(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, err := database.NewTestAbuseScannerDBWithCleanup(ctx, t, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	// start the scanner with the finalizer, which holds the digest lease, and
+	// the reporter, which fails to start because the accounts host is empty
+	cfg := Config{
+		ModuleFinalizer:       true,
+		NCMECReportingEnabled: true,
+		ReplyDigestWindow:     time.Hour,
+		ServerDomain:          "dev.siasky.net",
+		ShutdownTimeout:       time.Minute,
+	}
+	_, err = startModules(ctx, cfg, db, logger)
+	if err == nil {
+		t.Fatal("expected the reporter to fail to start")
+	}
+
+	// assert the digest lease was released, another instance takes over
+	// right away
+	lease := db.NewLeaderLease(ctx, jobDigest, 0)
+	err = lease.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := lease.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if !lease.IsLeader() {
+		t.Fatal("expected the digest lease to be released")
+	}
+}
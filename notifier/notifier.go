@@ -0,0 +1,282 @@
+// Package notifier sends notifications about high-severity events, e.g. a CSAM
+// report that came in, to a Slack or Discord channel using an incoming
+// webhook, so the on-call gets pinged right away.
+package notifier
+
+import (
+	"abuse-scanner/version"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// DefaultMinInterval is the default minimum amount of time between two
+	// notifications of the same event.
+	DefaultMinInterval = 15 * time.Minute
+
+	// FormatDiscord formats the notifications as Discord webhook payloads.
+	FormatDiscord = "discord"
+
+	// FormatSlack formats the notifications as Slack webhook payloads, this
+	// is the default.
+	FormatSlack = "slack"
+
+	// SeverityCritical is the severity of events that need immediate
+	// attention, e.g. NCMEC filing that keeps failing.
+	SeverityCritical = "critical"
+
+	// SeverityWarning is the severity of events that need attention soon,
+	// e.g. a growing backlog.
+	SeverityWarning = "warning"
+
+	// maxResponseSize is the maximum amount of bytes read from the response
+	// of the webhook, it's only used in the error if the request failed
+	maxResponseSize = 1 << 10 // 1 KiB
+
+	// webhookTimeout is the timeout of a single webhook request
+	webhookTimeout = 10 * time.Second
+)
+
+var (
+	// severityColors are the colors of the notifications per severity, as
+	// an RGB value
+	severityColors = map[string]int{
+		SeverityCritical: 0xd00000,
+		SeverityWarning:  0xffa500,
+	}
+)
+
+type (
+	// Field is a named value that is shown in the notification.
+	Field struct {
+		Name  string
+		Value string
+	}
+
+	// Notifier sends notifications to a webhook, it limits the rate at which
+	// the same event is notified. A nil notifier, or a notifier without a
+	// webhook URL, does not send any notifications.
+	Notifier struct {
+		staticClient  *http.Client
+		staticOptions NotifierOptions
+		staticURL     string
+
+		// lastSent is the time the last notification of every event was sent,
+		// suppressed is the amount of notifications of that event that were
+		// suppressed since
+		lastSent   map[string]time.Time
+		suppressed map[string]int
+		mu         sync.Mutex
+	}
+
+	// NotifierOptions contains the configurable options of the notifier.
+	NotifierOptions struct {
+		// Format is the format of the webhook payload, it's one of
+		// FormatSlack or FormatDiscord. If empty it defaults to FormatSlack.
+		Format string
+
+		// HTTPClient is the shared HTTP client, the notifier uses a copy of
+		// it with its own timeout. Defaults to http.DefaultClient.
+		HTTPClient *http.Client
+
+		// MinInterval is the minimum amount of time between two notifications
+		// of the same event, which is identified by its severity, title and
+		// key. The notifications in between are suppressed. Defaults to
+		// DefaultMinInterval.
+		MinInterval time.Duration
+
+		// ServerDomain is the domain of the server the scanner runs on, it's
+		// included in every notification.
+		ServerDomain string
+	}
+
+	// slackPayload is the payload of a Slack incoming webhook
+	slackPayload struct {
+		Text        string            `json:"text"`
+		Attachments []slackAttachment `json:"attachments,omitempty"`
+	}
+
+	// slackAttachment is an attachment of a Slack message
+	slackAttachment struct {
+		Color  string       `json:"color"`
+		Fields []slackField `json:"fields"`
+	}
+
+	// slackField is a field of an attachment of a Slack message
+	slackField struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+		Short bool   `json:"short"`
+	}
+
+	// discordPayload is the payload of a Discord webhook
+	discordPayload struct {
+		Content string         `json:"content"`
+		Embeds  []discordEmbed `json:"embeds,omitempty"`
+	}
+
+	// discordEmbed is an embed of a Discord message
+	discordEmbed struct {
+		Title  string         `json:"title"`
+		Color  int            `json:"color"`
+		Fields []discordField `json:"fields"`
+	}
+
+	// discordField is a field of an embed of a Discord message
+	discordField struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+)
+
+// NewNotifier returns a notifier that sends its notifications to the given
+// webhook URL, if the URL is empty no notifications are sent.
+func NewNotifier(url string, opts NotifierOptions) *Notifier {
+	if opts.Format == "" {
+		opts.Format = FormatSlack
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.MinInterval == 0 {
+		opts.MinInterval = DefaultMinInterval
+	}
+
+	client := *opts.HTTPClient
+	client.Timeout = webhookTimeout
+	return &Notifier{
+		staticClient:  &client,
+		staticOptions: opts,
+		staticURL:     url,
+
+		lastSent:   make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// Notify sends a notification of the event with given severity and title, the
+// fields are shown in the given order. The notification is suppressed if the
+// same event was notified within the minimum interval, the amount of
+// suppressed notifications is included in the next one.
+func (n *Notifier) Notify(severity, title string, fields []Field) error {
+	return n.NotifyKeyed(severity, title, "", fields)
+}
+
+// NotifyKeyed sends a notification like Notify, but the event is identified by
+// the given key too, e.g. the UID of an email. That way the notifications
+// about different subjects are not suppressed by one another, only repeated
+// notifications about the same subject are.
+func (n *Notifier) NotifyKeyed(severity, title, key string, fields []Field) error {
+	if n == nil || n.staticURL == "" {
+		return nil
+	}
+
+	// rate limit the notifications per event
+	event := severity + "/" + title + "/" + key
+	n.mu.Lock()
+	n.pruneEvents()
+	if last, exists := n.lastSent[event]; exists && time.Since(last) < n.staticOptions.MinInterval {
+		n.suppressed[event]++
+		n.mu.Unlock()
+		return nil
+	}
+	suppressed := n.suppressed[event]
+	n.lastSent[event] = time.Now()
+	n.suppressed[event] = 0
+	n.mu.Unlock()
+
+	if suppressed > 0 {
+		fields = append(fields, Field{
+			Name:  "Suppressed",
+			Value: fmt.Sprintf("%v notifications within the last %v", suppressed, n.staticOptions.MinInterval),
+		})
+	}
+	payload, err := n.payload(severity, title, fields)
+	if err != nil {
+		return errors.AddContext(err, "failed to build the payload")
+	}
+	return n.send(payload)
+}
+
+// pruneEvents removes the events of which the interval elapsed and no
+// notifications were suppressed since, as they no longer affect the rate
+// limit. This keeps the keyed events from piling up. It must be called while
+// holding the lock.
+func (n *Notifier) pruneEvents() {
+	for event, last := range n.lastSent {
+		if time.Since(last) >= n.staticOptions.MinInterval && n.suppressed[event] == 0 {
+			delete(n.lastSent, event)
+			delete(n.suppressed, event)
+		}
+	}
+}
+
+// payload returns the JSON payload of the notification, in the format of the
+// notifier.
+func (n *Notifier) payload(severity, title string, fields []Field) ([]byte, error) {
+	text := fmt.Sprintf("[%s] %s", severity, title)
+	if n.staticOptions.ServerDomain != "" {
+		text = fmt.Sprintf("[%s] %s on %s", severity, title, n.staticOptions.ServerDomain)
+	}
+	color := severityColors[severity]
+
+	switch n.staticOptions.Format {
+	case FormatDiscord:
+		embed := discordEmbed{Title: title, Color: color, Fields: []discordField{}}
+		for _, field := range fields {
+			// discord rejects fields with an empty value
+			value := field.Value
+			if value == "" {
+				value = "-"
+			}
+			embed.Fields = append(embed.Fields, discordField{Name: field.Name, Value: value, Inline: true})
+		}
+		return json.Marshal(discordPayload{Content: text, Embeds: []discordEmbed{embed}})
+	case FormatSlack:
+		attachment := slackAttachment{Color: fmt.Sprintf("#%06x", color), Fields: []slackField{}}
+		for _, field := range fields {
+			attachment.Fields = append(attachment.Fields, slackField{Title: field.Name, Value: field.Value, Short: true})
+		}
+		return json.Marshal(slackPayload{Text: text, Attachments: []slackAttachment{attachment}})
+	}
+	return nil, fmt.Errorf("unknown format '%v'", n.staticOptions.Format)
+}
+
+// send posts the given payload to the webhook.
+func (n *Notifier) send(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.staticURL, bytes.NewReader(payload))
+	if err != nil {
+		// the error is not returned as it contains the URL, which contains
+		// the secret token of the webhook
+		return errors.New("failed to create the webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", version.UserAgent())
+
+	resp, err := n.staticClient.Do(req)
+	if err != nil {
+		// strip the URL from the error, it contains the secret token
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return errors.AddContext(err, "failed to send the webhook request")
+	}
+	defer resp.Body.Close()
+
+	// Slack responds with 200 and Discord with 204 on success
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		return fmt.Errorf("unexpected status code %v from the webhook, response '%s'", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package notifier
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhook is a webhook that records the payloads it receives.
+type testWebhook struct {
+	payloads [][]byte
+	status   int
+	mu       sync.Mutex
+}
+
+// newTestWebhook returns a test server that records the payloads posted to it
+// and responds with the given status code.
+func newTestWebhook(t *testing.T, status int) (*httptest.Server, *testWebhook) {
+	webhook := &testWebhook{status: status}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Error("unexpected request", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		webhook.mu.Lock()
+		webhook.payloads = append(webhook.payloads, body)
+		webhook.mu.Unlock()
+		w.WriteHeader(webhook.status)
+		_, _ = w.Write([]byte("invalid_payload\n"))
+	}))
+	t.Cleanup(server.Close)
+	return server, webhook
+}
+
+// received returns the payloads the webhook received.
+func (w *testWebhook) received() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([][]byte(nil), w.payloads...)
+}
+
+// TestNotifier runs the notifier tests.
+func TestNotifier(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Disabled", testNotifierDisabled)
+	t.Run("Discord", testNotifierDiscord)
+	t.Run("Error", testNotifierError)
+	t.Run("RateLimit", testNotifierRateLimit)
+	t.Run("Slack", testNotifierSlack)
+}
+
+// testNotifierDisabled verifies a nil notifier, and a notifier without a
+// webhook URL, don't send any notifications.
+func testNotifierDisabled(t *testing.T) {
+	t.Parallel()
+
+	var nilNotifier *Notifier
+	if err := nilNotifier.Notify(SeverityCritical, "title", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewNotifier("", NotifierOptions{}).Notify(SeverityCritical, "title", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testNotifierDiscord verifies the shape of the Discord payload.
+func testNotifierDiscord(t *testing.T) {
+	t.Parallel()
+
+	server, webhook := newTestWebhook(t, http.StatusNoContent)
+	n := NewNotifier(server.URL, NotifierOptions{Format: FormatDiscord, ServerDomain: "siasky.net"})
+	err := n.Notify(SeverityWarning, "Blocker backlog exceeds SLA", []Field{
+		{Name: "Unblocked Emails", Value: "42"},
+		{Name: "Reporter Org", Value: ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := webhook.received()
+	if len(payloads) != 1 {
+		t.Fatal("unexpected amount of payloads", len(payloads))
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(payloads[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"content": "[warning] Blocker backlog exceeds SLA on siasky.net",
+		"embeds": []interface{}{map[string]interface{}{
+			"title": "Blocker backlog exceeds SLA",
+			"color": float64(0xffa500),
+			"fields": []interface{}{
+				map[string]interface{}{"name": "Unblocked Emails", "value": "42", "inline": true},
+				map[string]interface{}{"name": "Reporter Org", "value": "-", "inline": true},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(payload, expected) {
+		t.Fatal("unexpected payload", string(payloads[0]))
+	}
+}
+
+// testNotifierError verifies an unexpected status code is returned as an
+// error, and that the error does not contain the webhook URL.
+func testNotifierError(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newTestWebhook(t, http.StatusBadRequest)
+	err := NewNotifier(server.URL+"/secrettoken", NotifierOptions{}).Notify(SeverityCritical, "title", nil)
+	if err == nil || !strings.Contains(err.Error(), "unexpected status code 400") || !strings.Contains(err.Error(), "invalid_payload") {
+		t.Fatal("unexpected error", err)
+	}
+
+	// close the server and assert the URL is not leaked in the error
+	server.Close()
+	err = NewNotifier(server.URL+"/secrettoken", NotifierOptions{}).Notify(SeverityCritical, "title", nil)
+	if err == nil || strings.Contains(err.Error(), "secrettoken") {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// testNotifierRateLimit verifies the same event is only notified once within
+// the minimum interval, that other events are not affected, and that the
+// amount of suppressed notifications is included in the next one.
+func testNotifierRateLimit(t *testing.T) {
+	t.Parallel()
+
+	server, webhook := newTestWebhook(t, http.StatusOK)
+	interval := 500 * time.Millisecond
+	n := NewNotifier(server.URL, NotifierOptions{MinInterval: interval})
+
+	// notify the same event three times, and another event once
+	for i := 0; i < 3; i++ {
+		if err := n.Notify(SeverityCritical, "CSAM report received", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Notify(SeverityWarning, "CSAM report received", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(webhook.received()) != 2 {
+		t.Fatal("unexpected amount of payloads", len(webhook.received()))
+	}
+
+	// assert the event is notified again after the interval
+	time.Sleep(interval)
+	if err := n.Notify(SeverityCritical, "CSAM report received", nil); err != nil {
+		t.Fatal(err)
+	}
+	payloads := webhook.received()
+	if len(payloads) != 3 {
+		t.Fatal("unexpected amount of payloads", len(payloads))
+	}
+	var payload slackPayload
+	if err := json.Unmarshal(payloads[2], &payload); err != nil {
+		t.Fatal(err)
+	}
+	fields := payload.Attachments[0].Fields
+	if len(fields) != 1 || fields[0].Title != "Suppressed" || !strings.HasPrefix(fields[0].Value, "2 notifications") {
+		t.Fatal("unexpected fields", fields)
+	}
+
+	// assert keyed events are only suppressed by events with the same key
+	for _, key := range []string{"INBOX-1", "INBOX-2", "INBOX-1"} {
+		if err := n.NotifyKeyed(SeverityCritical, "CSAM report received", key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(webhook.received()) != 5 {
+		t.Fatal("unexpected amount of payloads", len(webhook.received()))
+	}
+
+	// assert the events without suppressed notifications are pruned once
+	// their interval elapsed
+	time.Sleep(interval)
+	if err := n.Notify(SeverityWarning, "Blocker backlog exceeds SLA", nil); err != nil {
+		t.Fatal(err)
+	}
+	n.mu.Lock()
+	events := len(n.lastSent)
+	n.mu.Unlock()
+	if events != 2 {
+		t.Fatal("unexpected amount of events", events)
+	}
+}
+
+// testNotifierSlack verifies the shape of the Slack payload, which is the
+// default format.
+func testNotifierSlack(t *testing.T) {
+	t.Parallel()
+
+	server, webhook := newTestWebhook(t, http.StatusOK)
+	n := NewNotifier(server.URL, NotifierOptions{})
+	err := n.Notify(SeverityCritical, "CSAM report received", []Field{
+		{Name: "Email UID", Value: "INBOX-42"},
+		{Name: "Skylinks", Value: "3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := webhook.received()
+	if len(payloads) != 1 {
+		t.Fatal("unexpected amount of payloads", len(payloads))
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(payloads[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"text": "[critical] CSAM report received",
+		"attachments": []interface{}{map[string]interface{}{
+			"color": "#d00000",
+			"fields": []interface{}{
+				map[string]interface{}{"title": "Email UID", "value": "INBOX-42", "short": true},
+				map[string]interface{}{"title": "Skylinks", "value": "3", "short": true},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(payload, expected) {
+		t.Fatal("unexpected payload", string(payloads[0]))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+var (
+	// reloadableVariables are the variables that can be changed while the
+	// scanner is running, they're reloaded when the process receives a
+	// SIGHUP. A change to any other variable requires a restart.
+	reloadableVariables = map[string]struct{}{
+		"ABUSE_ALLOWED_RECIPIENTS":     {},
+		"ABUSE_CONFLICT_PATTERNS":      {},
+		"ABUSE_CONFLICT_TAGS":          {},
+		"ABUSE_EVIDENCE_HOSTS":         {},
+		"ABUSE_MAILBOX_TAGS":           {},
+		"ABUSE_NCMEC_NOTIFY_REPORTERS": {},
+		"ABUSE_REPLY_TEMPLATES_DIR":    {},
+		"ABUSE_REPORTER_ORGS":          {},
+		"ABUSE_SHORTENER_HOSTS":        {},
+	}
+)
+
+// reloadConfig loads the config from the config file at the given path, and
+// swaps its reloadable variables into the running modules. The environment of
+// the process can't change while it runs, and env variables override the
+// config file, so a reloadable variable that is set in the environment keeps
+// its value, which is logged as a warning. If the new config is invalid it's
+// rejected, in which case the modules keep the current config. It returns the
+// config that is in effect after the reload, the variables that require a
+// restart keep their current value.
+func reloadConfig(current Config, path string, m *modules, logger *logrus.Logger) (Config, error) {
+	next, errs := loadConfig(path)
+	if len(errs) > 0 {
+		return current, errors.AddContext(errors.Compose(errs...), fmt.Sprintf("invalid configuration, found %v problem(s)", len(errs)))
+	}
+
+	// the variables that can't be reloaded keep their current value
+	var reloaded []string
+	for _, name := range changedVariables(current, next) {
+		if _, reloadable := reloadableVariables[name]; !reloadable {
+			logger.Warnf("Ignoring the change to %v, it requires a restart", name)
+			continue
+		}
+		reloaded = append(reloaded, name)
+	}
+
+	// the reloadable variables that are set in the environment override the
+	// config file, so editing the config file has no effect on them
+	for _, variable := range next.variables {
+		if _, reloadable := reloadableVariables[variable.name]; reloadable && variable.location == "" {
+			logger.Warnf("%v is set in the environment, which overrides the config file, its value can't be reloaded", variable.name)
+		}
+	}
+
+	cfg := current
+	cfg.AllowedRecipients = next.AllowedRecipients
+	cfg.ConflictPatterns = next.ConflictPatterns
+	cfg.ConflictTags = next.ConflictTags
+	cfg.EvidenceHosts = next.EvidenceHosts
+	cfg.MailboxTags = next.MailboxTags
+	cfg.NCMECNotifyReporters = next.NCMECNotifyReporters
+	cfg.ReplyTemplates = next.ReplyTemplates
+	cfg.ReporterOrgs = next.ReporterOrgs
+	cfg.ShortenerHosts = next.ShortenerHosts
+
+	// keep the summary of the config in sync with the values in effect
+	cfg.variables = nil
+	for _, variable := range current.variables {
+		if _, reloadable := reloadableVariables[variable.name]; !reloadable {
+			cfg.variables = append(cfg.variables, variable)
+		}
+	}
+	for _, variable := range next.variables {
+		if _, reloadable := reloadableVariables[variable.name]; reloadable {
+			cfg.variables = append(cfg.variables, variable)
+		}
+	}
+
+	m.reload(cfg)
+	logger.Infof("Reloaded config, changed variables: %v", reloaded)
+	return cfg, nil
+}
+
+// changedVariables returns the names of the variables that were set, unset or
+// changed between the given configs, in alphabetical order.
+func changedVariables(current, next Config) []string {
+	values := make(map[string]string)
+	for _, variable := range current.variables {
+		values[variable.name] = variable.value
+	}
+
+	var changed []string
+	for _, variable := range next.variables {
+		value, exists := values[variable.name]
+		if !exists || value != variable.value {
+			changed = append(changed, variable.name)
+		}
+		delete(values, variable.name)
+	}
+	for name := range values {
+		changed = append(changed, name)
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"abuse-scanner/email"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestReloadConfig verifies the reloadable variables in the config file are
+// swapped into the running config, that the variables that require a restart
+// keep their value, that an invalid config is rejected, and that a variable set
+// in the environment keeps its value.
+func TestReloadConfig(t *testing.T) {
+	// create a function to restore the environment
+	restoreEnvFn := restoreEnv(configVariables)
+	defer func() {
+		err := restoreEnvFn()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	for _, variable := range configVariables {
+		if err := os.Unsetenv(variable); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(testConfigFile+content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("ABUSE_ALLOWED_RECIPIENTS: abuse@siasky.net\n")
+	cfg, errs := loadConfig(path)
+	if len(errs) != 0 {
+		t.Fatal("unexpected problems", errs)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &modules{
+		fetcher: email.NewFetcher(ctx, nil, cfg.EmailCredentials, cfg.AbuseMailbox, cfg.ServerDomain, cfg.FetcherOptions(), logger),
+		parser:  email.NewParser(ctx, nil, cfg.ServerDomain, cfg.AbuseSponsor, cfg.ParserOptions(), logger),
+	}
+
+	// swap the allowlist and change a variable that requires a restart
+	writeConfig("ABUSE_ALLOWED_RECIPIENTS:\n  - abuse@siasky.net\n  - report@siasky.net\nABUSE_CONFLICT_TAGS: csam\nABUSE_LISTEN_ADDRESS: :4000\n")
+	reloaded, err := reloadConfig(cfg, path, m, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded.AllowedRecipients, []string{"abuse@siasky.net", "report@siasky.net"}) {
+		t.Fatal("unexpected allowed recipients", reloaded.AllowedRecipients)
+	}
+	if !reflect.DeepEqual(reloaded.ConflictTags, []string{"csam"}) {
+		t.Fatal("unexpected conflict tags", reloaded.ConflictTags)
+	}
+	if reloaded.ListenAddress != cfg.ListenAddress {
+		t.Fatal("unexpected listen address", reloaded.ListenAddress)
+	}
+	summary := reloaded.String()
+	if !strings.Contains(summary, "ABUSE_ALLOWED_RECIPIENTS: abuse@siasky.net,report@siasky.net") || strings.Contains(summary, "ABUSE_LISTEN_ADDRESS") {
+		t.Fatal("unexpected config summary", summary)
+	}
+
+	// assert an invalid config is rejected and the current config is kept
+	writeConfig("ABUSE_ALLOWED_RECIPIENTS: other@siasky.net\nABUSE_LOG_LEVEL: loud\n")
+	rejected, err := reloadConfig(reloaded, path, m, logger)
+	if err == nil || !strings.Contains(err.Error(), "ABUSE_LOG_LEVEL") {
+		t.Fatal("unexpected error", err)
+	}
+	if !reflect.DeepEqual(rejected.AllowedRecipients, reloaded.AllowedRecipients) || rejected.String() != summary {
+		t.Fatal("expected the current config to be kept", rejected)
+	}
+
+	// swap the evidence and shortener allowlists and assert they are
+	// reloaded rather than ignored until the next restart
+	var logs bytes.Buffer
+	logger.Out = &logs
+	writeConfig("ABUSE_EVIDENCE_HOSTS: docs.google.com\nABUSE_SHORTENER_HOSTS:\n  - bit.ly\n  - tinyurl.com\n")
+	reloaded, err = reloadConfig(reloaded, path, m, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "requires a restart") {
+		t.Fatal("unexpected restart warning", logs.String())
+	}
+	opts := reloaded.ParserOptions()
+	if !reflect.DeepEqual(opts.EvidenceHosts, []string{"docs.google.com"}) || !reflect.DeepEqual(opts.ShortenerHosts, []string{"bit.ly", "tinyurl.com"}) {
+		t.Fatal("unexpected allowlists", opts.EvidenceHosts, opts.ShortenerHosts)
+	}
+
+	// add reply templates and assert they are reloaded
+	dir := t.TempDir()
+	err = ioutil.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"greeting": "Hallo,"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(fmt.Sprintf("ABUSE_REPLY_TEMPLATES_DIR: %v\n", dir))
+	reloaded, err = reloadConfig(reloaded, path, m, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "requires a restart") {
+		t.Fatal("unexpected restart warning", logs.String())
+	}
+	if _, exists := reloaded.FinalizerOptions().ReplyTemplates["de"]; !exists {
+		t.Fatal("unexpected reply templates", reloaded.ReplyTemplates)
+	}
+	if strings.Contains(logs.String(), "set in the environment") {
+		t.Fatal("unexpected environment warning", logs.String())
+	}
+
+	// assert a variable set in the environment overrides the config file on
+	// reload, and that this is logged
+	err = os.Setenv("ABUSE_CONFLICT_TAGS", "spam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfig("ABUSE_CONFLICT_TAGS: csam\n")
+	reloaded, err = reloadConfig(reloaded, path, m, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded.ConflictTags, []string{"spam"}) {
+		t.Fatal("unexpected conflict tags", reloaded.ConflictTags)
+	}
+	if !strings.Contains(logs.String(), "ABUSE_CONFLICT_TAGS is set in the environment") {
+		t.Fatal("expected an environment warning", logs.String())
+	}
+}
+
+// TestChangedVariables is a unit test that covers the changedVariables helper.
+func TestChangedVariables(t *testing.T) {
+	t.Parallel()
+
+	current := Config{variables: []configVariable{
+		{name: "ABUSE_CONFLICT_TAGS", value: "csam"},
+		{name: "ABUSE_DRY_RUN", value: "true"},
+		{name: "SERVER_DOMAIN", value: "siasky.net", location: "config.yaml:1:1"},
+	}}
+	next := Config{variables: []configVariable{
+		{name: "ABUSE_ALLOWED_RECIPIENTS", value: "abuse@siasky.net"},
+		{name: "ABUSE_CONFLICT_TAGS", value: "csam,terrorism"},
+		{name: "SERVER_DOMAIN", value: "siasky.net", location: "config.yaml:2:1"},
+	}}
+	changed := changedVariables(current, next)
+	expected := []string{"ABUSE_ALLOWED_RECIPIENTS", "ABUSE_CONFLICT_TAGS", "ABUSE_DRY_RUN"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Fatal("unexpected changed variables", changed)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// sentryFlushTimeout is the maximum amount of time we wait for the
+	// buffered events to be sent to Sentry on shutdown
+	sentryFlushTimeout = 5 * time.Second
+)
+
+var (
+	// sentryTagFields are the fields of a log entry that are sent to Sentry as
+	// tags, which makes them searchable, all other fields are sent as extra
+	// data
+	sentryTagFields = []string{"module", "email_uid"}
+)
+
+type (
+	// sentryHook is a logrus hook that reports every entry that is logged at
+	// the error level or above to Sentry.
+	sentryHook struct {
+		staticHub          *sentry.Hub
+		staticServerDomain string
+	}
+)
+
+// newSentryHook returns a hook that reports to Sentry using the given DSN, it
+// returns nil if the DSN is empty, which disables the integration. The
+// transport is optional, it defaults to Sentry's HTTP transport.
+func newSentryHook(dsn, serverDomain string, transport sentry.Transport) (*sentryHook, error) {
+	if dsn == "" {
+		return nil, nil
+	}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:        dsn,
+		ServerName: serverDomain,
+		Transport:  transport,
+	})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create Sentry client")
+	}
+	return &sentryHook{
+		staticHub:          sentry.NewHub(client, sentry.NewScope()),
+		staticServerDomain: serverDomain,
+	}, nil
+}
+
+// Levels implements the logrus.Hook interface.
+func (h *sentryHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel}
+}
+
+// Fire implements the logrus.Hook interface, it converts the given entry into
+// an event and captures it.
+func (h *sentryHook) Fire(entry *logrus.Entry) error {
+	event := sentry.NewEvent()
+	event.Level = sentry.LevelError
+	if entry.Level < logrus.ErrorLevel {
+		event.Level = sentry.LevelFatal
+	}
+	event.Message = entry.Message
+	event.Timestamp = entry.Time
+	event.Tags["server_domain"] = h.staticServerDomain
+
+	for key, value := range entry.Data {
+		if isSentryTagField(key) {
+			event.Tags[key] = fmt.Sprint(value)
+			continue
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		event.Extra[key] = value
+	}
+
+	h.staticHub.CaptureEvent(event)
+	return nil
+}
+
+// Flush waits until the buffered events are sent to Sentry or the given
+// timeout elapses, it returns false if the timeout elapsed. It is a no-op if
+// the hook is nil.
+func (h *sentryHook) Flush(timeout time.Duration) bool {
+	if h == nil {
+		return true
+	}
+	return h.staticHub.Flush(timeout)
+}
+
+// isSentryTagField returns true if the field with the given key is sent to
+// Sentry as a tag.
+func isSentryTagField(key string) bool {
+	for _, field := range sentryTagFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
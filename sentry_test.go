@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	// testSentryTransport is a Sentry transport that captures the events
+	// rather than sending them.
+	testSentryTransport struct {
+		events []*sentry.Event
+		mu     sync.Mutex
+	}
+)
+
+// Configure implements the sentry.Transport interface.
+func (tst *testSentryTransport) Configure(sentry.ClientOptions) {}
+
+// Flush implements the sentry.Transport interface.
+func (tst *testSentryTransport) Flush(time.Duration) bool { return true }
+
+// SendEvent implements the sentry.Transport interface.
+func (tst *testSentryTransport) SendEvent(event *sentry.Event) {
+	tst.mu.Lock()
+	defer tst.mu.Unlock()
+	tst.events = append(tst.events, event)
+}
+
+// Events returns the events that were captured.
+func (tst *testSentryTransport) Events() []*sentry.Event {
+	tst.mu.Lock()
+	defer tst.mu.Unlock()
+	return append([]*sentry.Event(nil), tst.events...)
+}
+
+// TestSentryHook verifies the Sentry hook reports the entries logged at the
+// error level with the module, server domain and email UID as tags.
+func TestSentryHook(t *testing.T) {
+	t.Parallel()
+
+	// assert the hook is disabled if no DSN is set
+	hook, err := newSentryHook("", "dev.siasky.net", nil)
+	if err != nil || hook != nil {
+		t.Fatal("expected no hook", hook, err)
+	}
+	if !hook.Flush(time.Second) {
+		t.Fatal("expected flushing a nil hook to be a no-op")
+	}
+
+	// create a logger that reports to a test transport
+	transport := new(testSentryTransport)
+	hook, err = newSentryHook("https://key@sentry.siasky.net/42", "dev.siasky.net", transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(hook)
+
+	// log an info and an error entry
+	entry := logger.WithFields(logrus.Fields{
+		"module":    "Parser",
+		"email_uid": "INBOX-1-1",
+	})
+	entry.Info("Parsed email")
+	entry.WithError(errors.New("empty body")).Error("Failed to parse email")
+	if !hook.Flush(time.Second) {
+		t.Fatal("failed to flush")
+	}
+
+	// assert only the error got reported
+	events := transport.Events()
+	if len(events) != 1 {
+		t.Fatal("unexpected number of events", len(events))
+	}
+	event := events[0]
+	if event.Level != sentry.LevelError || event.Message != "Failed to parse email" {
+		t.Fatal("unexpected event", event.Level, event.Message)
+	}
+	expected := map[string]string{
+		"email_uid":     "INBOX-1-1",
+		"module":        "Parser",
+		"server_domain": "dev.siasky.net",
+	}
+	for key, value := range expected {
+		if event.Tags[key] != value {
+			t.Fatalf("unexpected value for tag '%v', %v != %v", key, event.Tags[key], value)
+		}
+	}
+	if event.Extra[logrus.ErrorKey] != "empty body" {
+		t.Fatal("unexpected extra", event.Extra)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// defaultShutdownTimeout is the default shutdown budget, it is the total
+	// amount of time we allow the scanner to take to shut down, it should be
+	// lower than the time the process manager waits before killing us.
+	defaultShutdownTimeout = 90 * time.Second
+
+	// shutdownComponentCount is the maximum amount of components that are
+	// stopped on shutdown, the shutdown budget is divided among them.
+	shutdownComponentCount = 7
+)
+
+type (
+	// component is a part of the scanner that gets stopped on shutdown.
+	component struct {
+		name string
+		stop func() error
+	}
+)
+
+// cancelAndStop is a helper function that returns a stop function that cancels
+// the context of a module before stopping it, which ensures the module is not
+// interrupted before it is its turn to stop.
+func cancelAndStop(cancel context.CancelFunc, stop func() error) func() error {
+	return func() error {
+		cancel()
+		return stop()
+	}
+}
+
+// stopComponents stops the given components one by one, in the given order.
+// The shutdown budget is divided among the components, every component gets
+// the remaining budget divided by the amount of components that still have to
+// be stopped, so the time a component does not use is available to the ones
+// that come after it. A component that does not stop within its share is
+// abandoned, which ensures the shutdown never exceeds the budget.
+func stopComponents(components []component, budget time.Duration, logger *logrus.Logger) error {
+	deadline := time.Now().Add(budget)
+
+	var errs []error
+	for i, c := range components {
+		name, stop := c.name, c.stop
+		share := time.Until(deadline) / time.Duration(len(components)-i)
+
+		start := time.Now()
+		done := make(chan error, 1)
+		go func() {
+			done <- stop()
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				errs = append(errs, errors.AddContext(err, fmt.Sprintf("failed to stop %v", name)))
+			}
+			logger.Infof("Stopped %v in %v", name, time.Since(start).Round(time.Millisecond))
+		case <-time.After(share):
+			errs = append(errs, fmt.Errorf("%v did not stop within %v", name, share.Round(time.Millisecond)))
+			logger.Errorf("Abandoned %v after %v", name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	return errors.Compose(errs...)
+}
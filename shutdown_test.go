@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestStopComponents verifies components are stopped in order and that the
+// shutdown does not exceed its budget when a component hangs.
+func TestStopComponents(t *testing.T) {
+	t.Parallel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	var mu sync.Mutex
+	var stopped []string
+	stopAfter := func(name string, d time.Duration, err error) component {
+		return component{name: name, stop: func() error {
+			time.Sleep(d)
+			mu.Lock()
+			stopped = append(stopped, name)
+			mu.Unlock()
+			return err
+		}}
+	}
+
+	// stop four components within a budget of 400ms, the second hangs and
+	// gets abandoned after its share of 100ms, the third fails
+	hang := make(chan struct{})
+	defer close(hang)
+	components := []component{
+		stopAfter("fetcher", 0, nil),
+		{name: "parser", stop: func() error {
+			<-hang
+			return nil
+		}},
+		stopAfter("blocker", 0, errors.New("blocker failure")),
+		stopAfter("database", 0, nil),
+	}
+
+	start := time.Now()
+	err := stopComponents(components, 400*time.Millisecond, logger)
+	elapsed := time.Since(start)
+
+	// assert the components that stopped did so in order
+	mu.Lock()
+	order := append([]string(nil), stopped...)
+	mu.Unlock()
+	if !reflect.DeepEqual(order, []string{"fetcher", "blocker", "database"}) {
+		t.Fatal("unexpected order", order)
+	}
+
+	// assert the errors of both the abandoned and the failed component are
+	// returned
+	if err == nil || !strings.Contains(err.Error(), "parser did not stop within") {
+		t.Fatal("expected the parser to be abandoned", err)
+	}
+	if !strings.Contains(err.Error(), "blocker failure") {
+		t.Fatal("expected the blocker failure to be returned", err)
+	}
+
+	// assert the hanging component only consumed its share of the budget
+	if elapsed < 90*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Fatal("unexpected shutdown duration", elapsed)
+	}
+
+	// assert the time a component does not use rolls over to the next ones,
+	// the first component stops immediately so the second one gets half of the
+	// budget rather than a third of it
+	stopped = nil
+	components = []component{
+		stopAfter("fetcher", 0, nil),
+		stopAfter("parser", 120*time.Millisecond, nil),
+		stopAfter("database", 0, nil),
+	}
+	err = stopComponents(components, 300*time.Millisecond, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stopped, []string{"fetcher", "parser", "database"}) {
+		t.Fatal("unexpected order", stopped)
+	}
+}
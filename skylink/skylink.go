@@ -0,0 +1,82 @@
+package skylink
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+)
+
+var (
+	// skylink32RE matches a string that is formatted like a base-32 encoded
+	// skylink, which is how skylinks appear in the subdomain of a portal URL
+	skylink32RE = regexp.MustCompile(`(?i)^([a-z0-9]{55})$`)
+
+	// skylink64RE matches a string that is formatted like a base-64 encoded
+	// skylink, which is how skylinks appear in the path of a portal URL
+	skylink64RE = regexp.MustCompile(`^([a-zA-Z0-9-_]{46})$`)
+)
+
+// Normalize returns the given candidate in its canonical, base-64 encoded,
+// form. The candidate can be either base-64 or base-32 encoded, a path or
+// query that follows it is ignored. It returns false if the candidate is not
+// a valid skylink.
+func Normalize(candidate string) (string, bool) {
+	var sl skymodules.Skylink
+	if err := sl.LoadString(candidate); err != nil {
+		return "", false
+	}
+	return sl.String(), true
+}
+
+// FromURL returns the skylink in the given URL, in its canonical form. The
+// skylink is either one of the segments of its path, base-64 encoded, or one
+// of the labels of its host, base-32 encoded. It returns false if the URL does
+// not contain a skylink.
+func FromURL(u string) (string, bool) {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	if err != nil {
+		return "", false
+	}
+	for _, segment := range strings.Split(parsed.Path, "/") {
+		if skylink64RE.MatchString(segment) {
+			if skylink, ok := Normalize(segment); ok {
+				return skylink, true
+			}
+		}
+	}
+	for _, label := range strings.Split(parsed.Hostname(), ".") {
+		if skylink32RE.MatchString(label) {
+			if skylink, ok := Normalize(label); ok {
+				return skylink, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ToPortalURL returns the URL at which the given skylink is served by the
+// given portal.
+func ToPortalURL(portal, skylink string) string {
+	return strings.TrimRight(portal, "/") + "/" + skylink
+}
+
+// Equal returns true if the given skylinks are the same skylink, regardless of
+// their encoding. Invalid skylinks are never equal.
+func Equal(a, b string) bool {
+	normalizedA, okA := Normalize(a)
+	normalizedB, okB := Normalize(b)
+	return okA && okB && normalizedA == normalizedB
+}
+
+// IsV2 returns true if the given skylink is a version 2 skylink, i.e. one that
+// resolves through the registry. It returns false as its second value if the
+// skylink is invalid.
+func IsV2(skylink string) (bool, bool) {
+	var sl skymodules.Skylink
+	if err := sl.LoadString(skylink); err != nil {
+		return false, false
+	}
+	return sl.IsSkylinkV2(), true
+}
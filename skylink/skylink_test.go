@@ -0,0 +1,126 @@
+package skylink
+
+import (
+	"strings"
+	"testing"
+
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
+)
+
+const (
+	// testSkylink is a valid base-64 encoded skylink
+	testSkylink = "GAEE7l0IkIVcVEHDgRCcNkRYS8keZKr9v_ffxf9_614m6g"
+)
+
+// testSkylink32 returns the base-32 encoded form of testSkylink
+func testSkylink32(t *testing.T) string {
+	var sl skymodules.Skylink
+	if err := sl.LoadString(testSkylink); err != nil {
+		t.Fatal(err)
+	}
+	return sl.Base32EncodedString()
+}
+
+// TestNormalize is a unit test for Normalize
+func TestNormalize(t *testing.T) {
+	b32 := testSkylink32(t)
+	cases := []struct {
+		input  string
+		output string
+		valid  bool
+	}{
+		{testSkylink, testSkylink, true},
+		{testSkylink + "/path/file.txt", testSkylink, true},
+		{testSkylink + "?attachment=true", testSkylink, true},
+		{b32, testSkylink, true},
+		{strings.ToUpper(b32), testSkylink, true},
+		{"", "", false},
+		{"not-a-skylink", "", false},
+		{testSkylink[:45], "", false},
+		{"______________________________________________", "", false},
+	}
+	for _, c := range cases {
+		output, valid := Normalize(c.input)
+		if output != c.output || valid != c.valid {
+			t.Errorf("unexpected result for '%v', %v %v != %v %v", c.input, output, valid, c.output, c.valid)
+		}
+	}
+}
+
+// TestFromURL is a unit test for FromURL
+func TestFromURL(t *testing.T) {
+	b32 := testSkylink32(t)
+	cases := []struct {
+		input  string
+		output string
+		valid  bool
+	}{
+		{"https://siasky.net/" + testSkylink, testSkylink, true},
+		{"https://siasky.net/" + testSkylink + "/index.html?x=1", testSkylink, true},
+		{"https://siasky.net/dir/" + testSkylink, testSkylink, true},
+		{" https://siasky.net/" + testSkylink + " ", testSkylink, true},
+		{"https://" + b32 + ".siasky.net", testSkylink, true},
+		{"https://" + b32 + ".siasky.net/index.html", testSkylink, true},
+		{"https://siasky.net", "", false},
+		{"https://siasky.net/" + testSkylink[:45], "", false},
+		{"https://siasky.net/?skylink=" + testSkylink, "", false},
+		{"https://siasky.net/______________________________________________", "", false},
+		{"://" + testSkylink, "", false},
+	}
+	for _, c := range cases {
+		output, valid := FromURL(c.input)
+		if output != c.output || valid != c.valid {
+			t.Errorf("unexpected result for '%v', %v %v != %v %v", c.input, output, valid, c.output, c.valid)
+		}
+	}
+}
+
+// TestToPortalURL is a unit test for ToPortalURL
+func TestToPortalURL(t *testing.T) {
+	expected := "https://siasky.net/" + testSkylink
+	for _, portal := range []string{"https://siasky.net", "https://siasky.net/"} {
+		if url := ToPortalURL(portal, testSkylink); url != expected {
+			t.Fatal("unexpected portal URL", url)
+		}
+	}
+}
+
+// TestEqual is a unit test for Equal
+func TestEqual(t *testing.T) {
+	b32 := testSkylink32(t)
+	other := "BACCHn5eHow5edoimjiwBtD2ErM3OL57mf-_MghKeebanA"
+	cases := []struct {
+		a, b  string
+		equal bool
+	}{
+		{testSkylink, testSkylink, true},
+		{testSkylink, b32, true},
+		{b32, strings.ToUpper(b32), true},
+		{testSkylink, testSkylink + "/path", true},
+		{testSkylink, other, false},
+		{b32, other, false},
+		{testSkylink, "", false},
+		{"invalid", "invalid", false},
+	}
+	for _, c := range cases {
+		if Equal(c.a, c.b) != c.equal || Equal(c.b, c.a) != c.equal {
+			t.Errorf("unexpected result for '%v' and '%v', expected %v", c.a, c.b, c.equal)
+		}
+	}
+}
+
+// TestIsV2 is a unit test for IsV2
+func TestIsV2(t *testing.T) {
+	v2 := skymodules.NewSkylinkV2(types.SiaPublicKey{}, crypto.HashObject("tweak")).String()
+	if isV2, ok := IsV2(testSkylink); isV2 || !ok {
+		t.Fatal("unexpected result for v1 skylink", isV2, ok)
+	}
+	if isV2, ok := IsV2(v2); !isV2 || !ok {
+		t.Fatal("unexpected result for v2 skylink", isV2, ok)
+	}
+	if _, ok := IsV2("invalid"); ok {
+		t.Fatal("expected invalid skylink to fail")
+	}
+}
@@ -1,5 +1,7 @@
 package test
 
+import "os"
+
 const (
 	// MongoDBUsername is the username used to connect with the test DB.
 	MongoDBUsername = "admin"
@@ -9,4 +11,23 @@ const (
 
 	// MongoDBConnString is the connection string to connect with the test DB.
 	MongoDBConnString = "mongodb://localhost:37017"
+
+	// MongoDBURIEnv is the environment variable that overrides the connection
+	// string of the test DB. It's how an external test DB is provided, and how
+	// the test DB that gets started by the mongotest package is exported.
+	MongoDBURIEnv = "MONGODB_TEST_URI"
+
+	// MongoDBDockerEnv is the environment variable that opts into starting a
+	// disposable test DB container, see the mongotest package. It's only
+	// started if the variable is set to 'true'.
+	MongoDBDockerEnv = "MONGODB_TEST_DOCKER"
 )
+
+// MongoDBURI returns the connection string to connect with the test DB, which
+// is the value of MongoDBURIEnv if it's set and MongoDBConnString otherwise.
+func MongoDBURI() string {
+	if uri := os.Getenv(MongoDBURIEnv); uri != "" {
+		return uri
+	}
+	return MongoDBConnString
+}
@@ -0,0 +1,168 @@
+package mongotest
+
+import (
+	"abuse-scanner/test"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// mongoImage is the repository of the image of the test DB container.
+	mongoImage = "mongo"
+
+	// mongoImageTag is the tag of the image of the test DB container, it
+	// matches the one in test/setup.sh.
+	mongoImageTag = "5.0"
+
+	// mongoPort is the port mongo listens on inside the test DB container.
+	mongoPort = "27017/tcp"
+
+	// mongoReplSet is the name of the replica set of the test DB, which is
+	// required for transactions.
+	mongoReplSet = "skynet"
+
+	// containerExpiry is the time after which docker kills the test DB
+	// container, it ensures the container is removed if the tests got killed
+	// before they could tear it down.
+	containerExpiry = 30 * time.Minute
+
+	// maxWait is the maximum amount of time we wait for the test DB to accept
+	// connections, and for its replica set to elect a primary.
+	maxWait = 2 * time.Minute
+)
+
+// Main runs the tests of a package that touch the test DB, it's meant to be
+// called from the package's TestMain, i.e. `os.Exit(mongotest.Main(m))`. The
+// container is opt-in, if test.MongoDBDockerEnv is set to 'true' and no
+// external test DB is provided through test.MongoDBURIEnv, it starts a
+// disposable mongo container with a single node replica set, exports its
+// connection string to the test helpers and tears it down after the tests
+// ran. Otherwise the tests run against the test DB at test.MongoDBURI as
+// usual. Nothing is started in short mode, as the tests that touch the test
+// DB are skipped. It returns the exit code of the tests.
+func Main(m *testing.M) int {
+	flag.Parse()
+	if testing.Short() || os.Getenv(test.MongoDBURIEnv) != "" || os.Getenv(test.MongoDBDockerEnv) != "true" {
+		return m.Run()
+	}
+
+	pool, resource, uri, err := startMongo()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start the test DB, either make sure docker is available or provide a test DB through %v instead of setting %v, err: %v\n", test.MongoDBURIEnv, test.MongoDBDockerEnv, err)
+		return 1
+	}
+	defer func() {
+		if err := pool.Purge(resource); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to remove the test DB container, err: %v\n", err)
+		}
+	}()
+
+	err = os.Setenv(test.MongoDBURIEnv, uri)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to export the test DB, err: %v\n", err)
+		return 1
+	}
+	defer os.Unsetenv(test.MongoDBURIEnv)
+	return m.Run()
+}
+
+// startMongo starts a mongo container with a single node replica set and
+// returns it, alongside the connection string of the test DB.
+func startMongo() (*dockertest.Pool, *dockertest.Resource, string, error) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		return nil, nil, "", errors.AddContext(err, "could not connect to docker")
+	}
+	pool.MaxWait = maxWait
+
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: mongoImage,
+		Tag:        mongoImageTag,
+		Env: []string{
+			"MONGO_INITDB_ROOT_USERNAME=" + test.MongoDBUsername,
+			"MONGO_INITDB_ROOT_PASSWORD=" + test.MongoDBPassword,
+		},
+		Cmd: []string{"mongod", "--replSet=" + mongoReplSet},
+	}, func(hc *docker.HostConfig) {
+		hc.AutoRemove = true
+		hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		return nil, nil, "", errors.AddContext(err, "could not start the mongo container")
+	}
+
+	// the members of the replica set are only reachable from within the
+	// container, so we connect directly to the mapped port instead of
+	// discovering the replica set
+	uri := fmt.Sprintf("mongodb://localhost:%v/?directConnection=true", resource.GetPort(mongoPort))
+	err = errors.Compose(resource.Expire(uint(containerExpiry.Seconds())), initReplicaSet(pool, uri))
+	if err != nil {
+		return nil, nil, "", errors.Compose(err, pool.Purge(resource))
+	}
+	return pool, resource, uri, nil
+}
+
+// initReplicaSet waits for the test DB at the given connection string to
+// accept connections, initiates its replica set and waits for it to elect a
+// primary.
+func initReplicaSet(pool *dockertest.Pool, uri string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), maxWait)
+	defer cancel()
+
+	opts := options.Client().ApplyURI(uri).SetAuth(options.Credential{
+		Username: test.MongoDBUsername,
+		Password: test.MongoDBPassword,
+	})
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return errors.AddContext(err, "could not create the mongo client")
+	}
+	defer func() {
+		_ = client.Disconnect(context.Background())
+	}()
+
+	// wait for mongo to accept connections
+	err = pool.Retry(func() error {
+		return client.Ping(ctx, nil)
+	})
+	if err != nil {
+		return errors.AddContext(err, "mongo did not accept connections")
+	}
+
+	// initiate a single node replica set
+	admin := client.Database("admin")
+	err = admin.RunCommand(ctx, bson.D{{Key: "replSetInitiate", Value: bson.M{
+		"_id":     mongoReplSet,
+		"members": bson.A{bson.M{"_id": 0, "host": "localhost:27017"}},
+	}}}).Err()
+	if err != nil {
+		return errors.AddContext(err, "could not initiate the replica set")
+	}
+
+	// wait for the node to become primary
+	err = pool.Retry(func() error {
+		var res struct {
+			IsMaster bool `bson:"ismaster"`
+		}
+		err := admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res)
+		if err != nil {
+			return err
+		}
+		if !res.IsMaster {
+			return errors.New("the replica set has no primary yet")
+		}
+		return nil
+	})
+	return errors.AddContext(err, "the replica set did not elect a primary")
+}
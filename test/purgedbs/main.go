@@ -0,0 +1,31 @@
+package main
+
+import (
+	"abuse-scanner/database"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// purgedbs drops all stale test databases from the test database server, it
+// is meant to be run periodically on CI to avoid test databases from
+// accumulating on the server.
+func main() {
+	prefix := flag.String("prefix", "", "only purge test databases that start with this prefix")
+	olderThan := flag.Duration("older-than", 24*time.Hour, "only purge test databases that are older than this duration")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	purged, err := database.PurgeStaleTestDatabases(ctx, *prefix, *olderThan)
+	if err != nil {
+		log.Fatalf("Failed to purge stale test databases, err: %v", err)
+	}
+	for _, name := range purged {
+		fmt.Println("Purged", name)
+	}
+	fmt.Printf("Purged %v stale test databases\n", len(purged))
+}
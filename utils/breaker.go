@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// BreakerClosed is the state of a circuit breaker that allows all
+	// requests.
+	BreakerClosed = "closed"
+
+	// BreakerHalfOpen is the state of a circuit breaker whose cooldown has
+	// elapsed, it allows a single trial request to test whether the service
+	// has recovered.
+	BreakerHalfOpen = "half-open"
+
+	// BreakerOpen is the state of a circuit breaker that rejects all requests
+	// until its cooldown has elapsed.
+	BreakerOpen = "open"
+)
+
+type (
+	// CircuitBreaker is a circuit breaker that opens after a number of
+	// consecutive failures. While open, it rejects all requests until the
+	// cooldown elapses, after which it half-opens and allows a single trial
+	// request. If the trial succeeds the breaker closes, if it fails the
+	// breaker opens again. It is safe for concurrent use.
+	CircuitBreaker struct {
+		failures int
+		openedAt time.Time
+		state    string
+		trial    bool
+		mu       sync.Mutex
+
+		staticCooldown  time.Duration
+		staticThreshold int
+	}
+)
+
+// NewCircuitBreaker returns a closed circuit breaker that opens after the given
+// amount of consecutive failures and stays open for the given cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		state:           BreakerClosed,
+		staticCooldown:  cooldown,
+		staticThreshold: threshold,
+	}
+}
+
+// Allow returns whether a request is allowed. If the breaker is half-open,
+// only the first caller is allowed to perform the trial request.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.updateState()
+	switch cb.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if cb.trial {
+			return false
+		}
+		cb.trial = true
+		return true
+	default:
+		return false
+	}
+}
+
+// RecordFailure records a failed request, it opens the breaker if the
+// threshold of consecutive failures is reached or if the trial request of a
+// half-open breaker failed. It returns true if the breaker got opened.
+func (cb *CircuitBreaker) RecordFailure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.updateState()
+	cb.failures++
+	if cb.state == BreakerOpen {
+		return false
+	}
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.staticThreshold {
+		cb.state = BreakerOpen
+		cb.openedAt = time.Now()
+		cb.trial = false
+		return true
+	}
+	return false
+}
+
+// RecordSuccess records a successful request, it closes the breaker and
+// resets the amount of consecutive failures. It returns true if the breaker
+// got closed.
+func (cb *CircuitBreaker) RecordSuccess() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	closed := cb.state != BreakerClosed
+	cb.failures = 0
+	cb.state = BreakerClosed
+	cb.trial = false
+	return closed
+}
+
+// State returns the current state of the breaker.
+func (cb *CircuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.updateState()
+	return cb.state
+}
+
+// updateState half-opens the breaker if it is open and the cooldown
+// has elapsed. The caller is expected to hold the lock.
+func (cb *CircuitBreaker) updateState() {
+	if cb.state == BreakerOpen && time.Since(cb.openedAt) >= cb.staticCooldown {
+		cb.state = BreakerHalfOpen
+		cb.trial = false
+	}
+}
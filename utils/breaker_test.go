@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCircuitBreaker is a unit test that drives the circuit breaker through
+// all of its states.
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	cooldown := 50 * time.Millisecond
+	cb := NewCircuitBreaker(3, cooldown)
+
+	// assert a success resets the consecutive failures
+	cb.RecordFailure()
+	cb.RecordFailure()
+	cb.RecordSuccess()
+	cb.RecordFailure()
+	cb.RecordFailure()
+	if cb.State() != BreakerClosed || !cb.Allow() {
+		t.Fatal("unexpected state", cb.State())
+	}
+
+	// assert the breaker opens after the threshold is reached
+	if !cb.RecordFailure() {
+		t.Fatal("expected the breaker to open")
+	}
+	if cb.State() != BreakerOpen || cb.Allow() {
+		t.Fatal("unexpected state", cb.State())
+	}
+
+	// assert it half-opens after the cooldown and allows a single trial
+	time.Sleep(2 * cooldown)
+	if cb.State() != BreakerHalfOpen {
+		t.Fatal("unexpected state", cb.State())
+	}
+	if !cb.Allow() || cb.Allow() {
+		t.Fatal("expected a single trial request to be allowed")
+	}
+
+	// assert a failed trial opens the breaker again
+	if !cb.RecordFailure() {
+		t.Fatal("expected the breaker to open")
+	}
+	if cb.State() != BreakerOpen || cb.Allow() {
+		t.Fatal("unexpected state", cb.State())
+	}
+
+	// assert a successful trial closes the breaker
+	time.Sleep(2 * cooldown)
+	if !cb.Allow() {
+		t.Fatal("expected the trial request to be allowed")
+	}
+	if !cb.RecordSuccess() {
+		t.Fatal("expected the breaker to close")
+	}
+	if cb.State() != BreakerClosed || !cb.Allow() {
+		t.Fatal("unexpected state", cb.State())
+	}
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"strings"
+)
+
+var (
+	// plusAddressingDomains are the domains of which the mail servers ignore
+	// everything after a plus in the local part of an address, i.e.
+	// `john+abuse@gmail.com` is delivered to `john@gmail.com`
+	plusAddressingDomains = map[string]struct{}{
+		"gmail.com":      {},
+		"googlemail.com": {},
+	}
+)
+
+// NormalizeEmail is a helper function that returns the local part and the
+// domain of the given email address, both lowercased. The address can be
+// wrapped in a display name, e.g. `John <JOHN@Example.COM>`. The tag of a
+// plus-addressed gmail address is dropped, so `john+abuse@gmail.com` becomes
+// `john` and `gmail.com`. It returns an error if the address is invalid.
+func NormalizeEmail(addr string) (local, domain string, err error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(addr))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid email address '%v', %v", addr, err)
+	}
+	at := strings.LastIndex(parsed.Address, "@")
+	if at <= 0 || at == len(parsed.Address)-1 {
+		return "", "", fmt.Errorf("invalid email address '%v'", addr)
+	}
+	local = strings.ToLower(parsed.Address[:at])
+	domain = strings.TrimSuffix(strings.ToLower(parsed.Address[at+1:]), ".")
+	if _, exists := plusAddressingDomains[domain]; exists {
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	return local, domain, nil
+}
+
+// EmailMatches is a helper function that returns true if the given email
+// address matches one of the given patterns. A pattern is either an address,
+// which matches the address itself, a domain prefixed with an `@`, e.g.
+// `@example.com`, which matches every address of that domain, or a wildcard
+// pattern, e.g. `*@example.com` or `noreply*@*.example.com`, in which a `*`
+// matches any sequence of characters. The address and the patterns are
+// compared after normalization, see NormalizeEmail. It returns false if the
+// address is invalid.
+func EmailMatches(addr string, patterns []string) bool {
+	local, domain, err := NormalizeEmail(addr)
+	if err != nil {
+		return false
+	}
+	address := local + "@" + domain
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+			continue
+		case strings.Contains(pattern, "*"):
+			if matched, err := path.Match(pattern, address); err == nil && matched {
+				return true
+			}
+		case strings.HasPrefix(pattern, "@"):
+			if strings.TrimSuffix(pattern[1:], ".") == domain {
+				return true
+			}
+		default:
+			patternLocal, patternDomain, err := NormalizeEmail(pattern)
+			if err == nil && patternLocal == local && patternDomain == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
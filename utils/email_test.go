@@ -0,0 +1,100 @@
+package utils
+
+import "testing"
+
+// TestNormalizeEmail is a unit test for NormalizeEmail
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		input  string
+		local  string
+		domain string
+		valid  bool
+	}{
+		// plain addresses
+		{"john@example.com", "john", "example.com", true},
+		{"JOHN@Example.COM", "john", "example.com", true},
+		{" john@example.com ", "john", "example.com", true},
+		{"john.doe@sub.example.com", "john.doe", "sub.example.com", true},
+
+		// display names
+		{"John <JOHN@Example.COM>", "john", "example.com", true},
+		{`"Doe, John" <john@example.com>`, "john", "example.com", true},
+		{"<john@example.com>", "john", "example.com", true},
+
+		// plus-addressing
+		{"john+abuse@gmail.com", "john", "gmail.com", true},
+		{"John+Abuse@GMAIL.com", "john", "gmail.com", true},
+		{"john+abuse+more@googlemail.com", "john", "googlemail.com", true},
+		{"john+abuse@example.com", "john+abuse", "example.com", true},
+
+		// invalid addresses
+		{"", "", "", false},
+		{"john", "", "", false},
+		{"example.com", "", "", false},
+		{"@example.com", "", "", false},
+		{"john@", "", "", false},
+		{"John <john@example.com", "", "", false},
+	}
+	for _, c := range cases {
+		local, domain, err := NormalizeEmail(c.input)
+		if (err == nil) != c.valid {
+			t.Errorf("unexpected error for '%v', %v", c.input, err)
+			continue
+		}
+		if local != c.local || domain != c.domain {
+			t.Errorf("unexpected result for '%v', %v %v != %v %v", c.input, local, domain, c.local, c.domain)
+		}
+	}
+}
+
+// TestEmailMatches is a unit test for EmailMatches
+func TestEmailMatches(t *testing.T) {
+	cases := []struct {
+		address  string
+		patterns []string
+		matches  bool
+	}{
+		// exact patterns
+		{"john@example.com", []string{"john@example.com"}, true},
+		{"JOHN@Example.COM", []string{"john@example.com"}, true},
+		{"john@example.com", []string{"John <JOHN@EXAMPLE.COM>"}, true},
+		{"John <john@example.com>", []string{"john@example.com"}, true},
+		{"john+abuse@gmail.com", []string{"john@gmail.com"}, true},
+		{"john@gmail.com", []string{"john+other@gmail.com"}, true},
+		{"john+abuse@example.com", []string{"john@example.com"}, false},
+		{"jane@example.com", []string{"john@example.com"}, false},
+		{"john@example.org", []string{"john@example.com"}, false},
+
+		// domain patterns
+		{"john@example.com", []string{"@example.com"}, true},
+		{"john@EXAMPLE.com", []string{"@Example.COM"}, true},
+		{"john@sub.example.com", []string{"@example.com"}, false},
+		{"john@notexample.com", []string{"@example.com"}, false},
+
+		// wildcard patterns
+		{"john@example.com", []string{"*@example.com"}, true},
+		{"john@sub.example.com", []string{"*@example.com"}, false},
+		{"john@sub.example.com", []string{"*@*.example.com"}, true},
+		{"john@example.com", []string{"*@*.example.com"}, false},
+		{"noreply-123@example.com", []string{"noreply*@example.com"}, true},
+		{"john@example.com", []string{"noreply*@example.com"}, false},
+		{"john@example.com", []string{"*"}, true},
+		{"john@example.com", []string{"[*@example.com"}, false},
+
+		// multiple patterns
+		{"john@example.com", []string{"jane@example.com", "@example.org", "*@example.com"}, true},
+		{"john@example.com", []string{"jane@example.com", "@example.org"}, false},
+
+		// empty and invalid input
+		{"john@example.com", nil, false},
+		{"john@example.com", []string{"", " "}, false},
+		{"", []string{"*"}, false},
+		{"example.com", []string{"@example.com"}, false},
+		{"john@example.com", []string{"john"}, false},
+	}
+	for _, c := range cases {
+		if EmailMatches(c.address, c.patterns) != c.matches {
+			t.Errorf("unexpected result for '%v' and %v, expected %v", c.address, c.patterns, c.matches)
+		}
+	}
+}
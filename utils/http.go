@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultHTTPDialTimeout is the default maximum amount of time it takes
+	// to establish a connection, including the TLS handshake.
+	DefaultHTTPDialTimeout = 10 * time.Second
+
+	// DefaultHTTPIdleConnTimeout is the default amount of time an idle
+	// connection is kept open.
+	DefaultHTTPIdleConnTimeout = 90 * time.Second
+
+	// DefaultHTTPMaxConnsPerHost is the default maximum amount of
+	// connections to a single host.
+	DefaultHTTPMaxConnsPerHost = 16
+
+	// DefaultHTTPMaxIdleConns is the default maximum amount of idle
+	// connections across all hosts.
+	DefaultHTTPMaxIdleConns = 64
+
+	// DefaultHTTPMaxIdleConnsPerHost is the default maximum amount of idle
+	// connections to a single host.
+	DefaultHTTPMaxIdleConnsPerHost = 8
+
+	// DefaultHTTPResponseHeaderTimeout is the default maximum amount of time
+	// we wait for the response headers after the request was written.
+	DefaultHTTPResponseHeaderTimeout = time.Minute
+)
+
+type (
+	// HTTPClientOptions contains the configurable options of the transport of
+	// the shared HTTP client.
+	HTTPClientOptions struct {
+		// DialTimeout is the maximum amount of time it takes to establish a
+		// connection, it also applies to the TLS handshake. Defaults to
+		// DefaultHTTPDialTimeout.
+		DialTimeout time.Duration
+
+		// IdleConnTimeout is the amount of time an idle connection is kept
+		// open, defaults to DefaultHTTPIdleConnTimeout.
+		IdleConnTimeout time.Duration
+
+		// MaxConnsPerHost is the maximum amount of connections to a single
+		// host, requests block until a connection becomes available. Defaults
+		// to DefaultHTTPMaxConnsPerHost.
+		MaxConnsPerHost int
+
+		// MaxIdleConns is the maximum amount of idle connections across all
+		// hosts, defaults to DefaultHTTPMaxIdleConns.
+		MaxIdleConns int
+
+		// MaxIdleConnsPerHost is the maximum amount of idle connections to a
+		// single host, defaults to DefaultHTTPMaxIdleConnsPerHost.
+		MaxIdleConnsPerHost int
+
+		// ResponseHeaderTimeout is the maximum amount of time we wait for the
+		// response headers after the request was written, defaults to
+		// DefaultHTTPResponseHeaderTimeout.
+		ResponseHeaderTimeout time.Duration
+	}
+)
+
+// NewHTTPClient returns an HTTP client with a transport that is configured
+// using the given options. The client is meant to be shared by all components
+// that make outbound requests, which ensures the connection limits apply to
+// all of them together. Components that need a different timeout or redirect
+// policy use a copy of the client, the copy shares the transport.
+func NewHTTPClient(opts HTTPClientOptions) *http.Client {
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = DefaultHTTPDialTimeout
+	}
+	if opts.IdleConnTimeout == 0 {
+		opts.IdleConnTimeout = DefaultHTTPIdleConnTimeout
+	}
+	if opts.MaxConnsPerHost == 0 {
+		opts.MaxConnsPerHost = DefaultHTTPMaxConnsPerHost
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = DefaultHTTPMaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost == 0 {
+		opts.MaxIdleConnsPerHost = DefaultHTTPMaxIdleConnsPerHost
+	}
+	if opts.ResponseHeaderTimeout == 0 {
+		opts.ResponseHeaderTimeout = DefaultHTTPResponseHeaderTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			IdleConnTimeout:       opts.IdleConnTimeout,
+			MaxConnsPerHost:       opts.MaxConnsPerHost,
+			MaxIdleConns:          opts.MaxIdleConns,
+			MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+			ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+			TLSHandshakeTimeout:   opts.DialTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestNewHTTPClient is a unit test for the NewHTTPClient helper
+func TestNewHTTPClient(t *testing.T) {
+	// assert the defaults are applied
+	client := NewHTTPClient(HTTPClientOptions{})
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("unexpected transport", client.Transport)
+	}
+	if transport.MaxConnsPerHost != DefaultHTTPMaxConnsPerHost || transport.MaxIdleConns != DefaultHTTPMaxIdleConns || transport.MaxIdleConnsPerHost != DefaultHTTPMaxIdleConnsPerHost {
+		t.Fatal("unexpected connection limits", transport.MaxConnsPerHost, transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != DefaultHTTPIdleConnTimeout || transport.ResponseHeaderTimeout != DefaultHTTPResponseHeaderTimeout || transport.TLSHandshakeTimeout != DefaultHTTPDialTimeout {
+		t.Fatal("unexpected timeouts", transport.IdleConnTimeout, transport.ResponseHeaderTimeout, transport.TLSHandshakeTimeout)
+	}
+
+	// assert the options are applied
+	client = NewHTTPClient(HTTPClientOptions{
+		DialTimeout:           time.Second,
+		MaxConnsPerHost:       2,
+		ResponseHeaderTimeout: time.Minute,
+	})
+	transport = client.Transport.(*http.Transport)
+	if transport.MaxConnsPerHost != 2 || transport.TLSHandshakeTimeout != time.Second || transport.ResponseHeaderTimeout != time.Minute {
+		t.Fatal("unexpected transport", transport)
+	}
+	if client.Timeout != 0 {
+		t.Fatal("unexpected client timeout", client.Timeout)
+	}
+}
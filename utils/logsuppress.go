@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLogSuppressInterval is the default interval in which a repeated
+	// log line is only logged once.
+	DefaultLogSuppressInterval = time.Minute
+)
+
+type (
+	// LogSuppressor deduplicates log lines that are repeated in hot error
+	// paths, e.g. an error per skylink while the blocker API is down. A line
+	// is identified by its message template and the module of the logger, the
+	// arguments are ignored. The first occurrence is logged, the occurrences
+	// within the interval after it are counted. The first occurrence after the
+	// interval is logged alongside a summary of the suppressed ones. A nil
+	// suppressor logs every line. It is safe for concurrent use.
+	LogSuppressor struct {
+		lines map[string]*suppressedLine
+		mu    sync.Mutex
+
+		staticInterval time.Duration
+	}
+
+	// suppressedLine tracks the occurrences of a log line
+	suppressedLine struct {
+		loggedAt   time.Time
+		suppressed int
+	}
+)
+
+// NewLogSuppressor returns a log suppressor that logs a repeated line at most
+// once per given interval.
+func NewLogSuppressor(interval time.Duration) *LogSuppressor {
+	return &LogSuppressor{
+		lines:          make(map[string]*suppressedLine),
+		staticInterval: interval,
+	}
+}
+
+// Errorf logs the given line at the error level, unless it's suppressed.
+func (s *LogSuppressor) Errorf(logger *logrus.Entry, format string, args ...interface{}) {
+	s.Logf(logger, logrus.ErrorLevel, format, args...)
+}
+
+// Warnf logs the given line at the warning level, unless it's suppressed.
+func (s *LogSuppressor) Warnf(logger *logrus.Entry, format string, args ...interface{}) {
+	s.Logf(logger, logrus.WarnLevel, format, args...)
+}
+
+// Logf logs the given line at the given level, unless the same line was logged
+// within the interval. If occurrences of the line were suppressed, a summary
+// is logged before the line.
+func (s *LogSuppressor) Logf(logger *logrus.Entry, level logrus.Level, format string, args ...interface{}) {
+	if s == nil {
+		logger.Logf(level, format, args...)
+		return
+	}
+
+	// the module is part of the key, so the same template logged by
+	// different modules is suppressed independently
+	key := fmt.Sprintf("%v/%v", logger.Data["module"], format)
+	now := time.Now()
+
+	s.mu.Lock()
+	line, exists := s.lines[key]
+	if exists && now.Sub(line.loggedAt) < s.staticInterval {
+		line.suppressed++
+		s.mu.Unlock()
+		return
+	}
+	var suppressed int
+	var since time.Duration
+	if exists {
+		suppressed = line.suppressed
+		since = now.Sub(line.loggedAt)
+	}
+	s.lines[key] = &suppressedLine{loggedAt: now}
+	s.mu.Unlock()
+
+	if suppressed > 0 {
+		logger.Logf(level, "%q repeated %v times in the last %v", format, suppressed, since.Round(time.Second))
+	}
+	logger.Logf(level, format, args...)
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestLogger returns a logger that writes the message of every entry on a
+// separate line to the returned buffer.
+func newTestLogger() (*logrus.Logger, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	logger := logrus.New()
+	logger.Out = buf
+	logger.Formatter = &logrus.TextFormatter{DisableTimestamp: true, DisableQuote: true}
+	return logger, buf
+}
+
+// logLines returns the non-empty lines in the given buffer and resets it.
+func logLines(buf *bytes.Buffer) []string {
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	buf.Reset()
+	return lines
+}
+
+// TestLogSuppressor verifies repeated log lines are only logged once per
+// interval, and that the suppressed occurrences are summarized.
+func TestLogSuppressor(t *testing.T) {
+	t.Parallel()
+
+	logger, buf := newTestLogger()
+	blocker := logger.WithField("module", "Blocker")
+	fetcher := logger.WithField("module", "Fetcher")
+
+	interval := 100 * time.Millisecond
+	s := NewLogSuppressor(interval)
+
+	// assert only the first occurrence is logged, the arguments are ignored
+	for i := 0; i < 5; i++ {
+		s.Errorf(blocker.WithField("skylink", i), "Failed to block skylink, err %v", i)
+	}
+	lines := logLines(buf)
+	if len(lines) != 1 || !strings.Contains(lines[0], "level=error") || !strings.Contains(lines[0], "err 0") {
+		t.Fatal("unexpected lines", lines)
+	}
+
+	// assert the same template is suppressed per module, and that other
+	// templates are not affected
+	s.Errorf(fetcher, "Failed to block skylink, err %v", 5)
+	s.Warnf(blocker, "Failed to block email, err %v", 6)
+	if lines := logLines(buf); len(lines) != 2 {
+		t.Fatal("unexpected lines", lines)
+	}
+
+	// assert the first occurrence after the interval is logged alongside a
+	// summary of the suppressed occurrences
+	time.Sleep(interval)
+	s.Errorf(blocker, "Failed to block skylink, err %v", 7)
+	lines = logLines(buf)
+	if len(lines) != 2 {
+		t.Fatal("unexpected lines", lines)
+	}
+	if !strings.Contains(lines[0], `"Failed to block skylink, err %v" repeated 4 times in the last`) || !strings.Contains(lines[1], "err 7") {
+		t.Fatal("unexpected lines", lines)
+	}
+
+	// assert no summary is logged if nothing was suppressed
+	time.Sleep(interval)
+	s.Errorf(blocker, "Failed to block skylink, err %v", 8)
+	if lines := logLines(buf); len(lines) != 1 {
+		t.Fatal("unexpected lines", lines)
+	}
+
+	// assert a nil suppressor logs every line
+	var nilSuppressor *LogSuppressor
+	nilSuppressor.Errorf(blocker, "Failed to block skylink, err %v", 9)
+	nilSuppressor.Errorf(blocker, "Failed to block skylink, err %v", 10)
+	if lines := logLines(buf); len(lines) != 2 {
+		t.Fatal("unexpected lines", lines)
+	}
+}
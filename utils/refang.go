@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// refangDots matches the ways a dot is defanged in abuse reports, e.g.
+	// `[.]`, `(.)` or `[dot]`, including the whitespace around it
+	refangDots = regexp.MustCompile(`(?i)\s*(\[\s*\.\s*\]|\(\s*\.\s*\)|\{\s*\.\s*\}|\[\s*dot\s*\]|\(\s*dot\s*\)|\{\s*dot\s*\})\s*`)
+
+	// refangColons matches the ways a colon is defanged in abuse reports,
+	// e.g. `[:]`, including the whitespace around it
+	refangColons = regexp.MustCompile(`\s*(\[\s*:\s*\]|\(\s*:\s*\))\s*`)
+
+	// refangScheme matches the ways the scheme of a link is defanged in
+	// abuse reports, e.g. `hxxp` or `h**p`, in any case
+	refangScheme = regexp.MustCompile(`(?i)h(xx|\*\*|\[tt\])p(s?)`)
+
+	// refangSchemeSeparator matches the separator after the scheme of a link,
+	// either defanged, e.g. `[:]//` or `[://]`, or with whitespace around it
+	refangSchemeSeparator = regexp.MustCompile(`(?i)\b(https?)\s*(\[://\]|(\[:\]|\(:\)|:)\s*/\s*/)\s*`)
+
+	// zeroWidthReplacer removes the invisible characters that break up
+	// links, either by accident when copied from a rich text document or on
+	// purpose to evade filters
+	zeroWidthReplacer = strings.NewReplacer(
+		"\u00ad", "", // soft hyphen
+		"\u180e", "", // mongolian vowel separator
+		"\u200b", "", // zero width space
+		"\u200c", "", // zero width non-joiner
+		"\u200d", "", // zero width joiner
+		"\u2060", "", // word joiner
+		"\ufeff", "", // zero width no-break space
+	)
+)
+
+// Refang is a helper function that undoes the most common ways links are
+// defanged in abuse reports. It normalizes the scheme, e.g. `hxxps://`,
+// `hxxp[:]//` and `http[://]`, dots in brackets or parentheses, e.g. `[.]`,
+// `(.)` and `[dot]`, and colons in brackets. It removes the whitespace around
+// those separators and all zero-width characters. So `hxxps :// siasky [.] net`
+// becomes `https://siasky.net`. Text that is not defanged is left as is, other
+// than the zero-width characters.
+func Refang(s string) string {
+	s = zeroWidthReplacer.Replace(s)
+	s = refangScheme.ReplaceAllStringFunc(s, func(scheme string) string {
+		if strings.HasSuffix(strings.ToLower(scheme), "s") {
+			return "https"
+		}
+		return "http"
+	})
+	s = refangSchemeSeparator.ReplaceAllString(s, "${1}://")
+	s = refangDots.ReplaceAllString(s, ".")
+	s = refangColons.ReplaceAllString(s, ":")
+	return s
+}
+
+// NormalizeLines is a helper function that splits the given input into the
+// lines the extractors search, it removes the zero-width characters and the
+// surrounding whitespace of every line and drops the empty lines. Unlike a
+// bufio.Scanner it does not limit the length of a line.
+func NormalizeLines(input []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(string(input), "\n") {
+		line = strings.TrimSpace(zeroWidthReplacer.Replace(line))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
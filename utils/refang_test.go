@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestRefang is a unit test for the Refang helper
+func TestRefang(t *testing.T) {
+	cases := []struct {
+		input  string
+		output string
+	}{
+		// not defanged
+		{"", ""},
+		{"https://siasky.net", "https://siasky.net"},
+		{"Please remove this file.", "Please remove this file."},
+		{"HTTPS://SIASKY.NET/path?x=1", "HTTPS://SIASKY.NET/path?x=1"},
+		{"see (this) and [that]", "see (this) and [that]"},
+
+		// scheme
+		{"hxxp://siasky.net", "http://siasky.net"},
+		{"hxxps://siasky.net", "https://siasky.net"},
+		{"hXXps://siasky.net", "https://siasky.net"},
+		{"HXXPS://siasky.net", "https://siasky.net"},
+		{"hXxPs://siasky.net", "https://siasky.net"},
+		{"h**ps://siasky.net", "https://siasky.net"},
+		{"h[tt]ps://siasky.net", "https://siasky.net"},
+		{"hxxps[:]//siasky.net", "https://siasky.net"},
+		{"hxxps(:)//siasky.net", "https://siasky.net"},
+		{"https[://]siasky.net", "https://siasky.net"},
+		{"hxxps :// siasky.net", "https://siasky.net"},
+		{"https: / / siasky.net", "https://siasky.net"},
+
+		// dots
+		{"siasky[.]net", "siasky.net"},
+		{"siasky(.)net", "siasky.net"},
+		{"siasky{.}net", "siasky.net"},
+		{"siasky[dot]net", "siasky.net"},
+		{"siasky[DOT]net", "siasky.net"},
+		{"siasky(dot)net", "siasky.net"},
+		{"siasky{dot}net", "siasky.net"},
+		{"siasky [.] net", "siasky.net"},
+		{"siasky [ . ] net", "siasky.net"},
+		{"siasky [ dot ] net", "siasky.net"},
+		{"sub[.]siasky[.]net", "sub.siasky.net"},
+
+		// colons
+		{"siasky.net[:]443", "siasky.net:443"},
+		{"siasky.net (:) 443", "siasky.net:443"},
+
+		// zero-width characters
+		{"sia\u200bsky.net", "siasky.net"},
+		{"sia\u200csky\u200d.net", "siasky.net"},
+		{"\ufeffsiasky.net\u2060", "siasky.net"},
+		{"sia\u00adsky.net", "siasky.net"},
+		{"sia\u180esky.net", "siasky.net"},
+
+		// combined
+		{"hxxps :// siasky [.] net/AABB", "https://siasky.net/AABB"},
+		{"Link: hXXps[:]//sky\u200btransfer[.]hns[.]siasky(dot)net/#/v2/a/b", "Link: https://skytransfer.hns.siasky.net/#/v2/a/b"},
+	}
+	for _, test := range cases {
+		if res := Refang(test.input); res != test.output {
+			t.Fatalf("unexpected result for '%v', %v != %v", test.input, res, test.output)
+		}
+	}
+}
+
+// TestNormalizeLines is a unit test for the NormalizeLines helper
+func TestNormalizeLines(t *testing.T) {
+	cases := []struct {
+		input  string
+		output []string
+	}{
+		{"", nil},
+		{"\n\n", nil},
+		{" \t\n\u200b\n", nil},
+		{"one", []string{"one"}},
+		{"one\ntwo", []string{"one", "two"}},
+		{"one\r\ntwo\r\n", []string{"one", "two"}},
+		{"  one  \n\n\ttwo\t", []string{"one", "two"}},
+		{"sia\u200bsky.net\n\ufeffline", []string{"siasky.net", "line"}},
+		{"hxxps://siasky[.]net", []string{"hxxps://siasky[.]net"}},
+	}
+	for _, test := range cases {
+		if res := NormalizeLines([]byte(test.input)); !reflect.DeepEqual(res, test.output) {
+			t.Fatalf("unexpected result for '%v', %v != %v", test.input, res, test.output)
+		}
+	}
+
+	// assert long lines are not truncated
+	long := make([]byte, 1<<20)
+	for i := range long {
+		long[i] = 'a'
+	}
+	if res := NormalizeLines(long); len(res) != 1 || len(res[0]) != len(long) {
+		t.Fatal("unexpected result for a long line")
+	}
+}
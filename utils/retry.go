@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// defaultRetryBaseBackoff is the default backoff after the first failed
+	// attempt, it doubles with every subsequent attempt.
+	defaultRetryBaseBackoff = 250 * time.Millisecond
+
+	// defaultRetryMaxAttempts is the default maximum amount of attempts.
+	defaultRetryMaxAttempts = 3
+)
+
+var (
+	// retryRand is the source of the jitter that is applied to the backoff,
+	// it's guarded by retryRandMu as a rand.Rand is not safe for concurrent
+	// use.
+	retryRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	retryRandMu sync.Mutex
+)
+
+type (
+	// RetryPolicy defines how an operation is retried by Retry. The zero
+	// value retries an operation up to defaultRetryMaxAttempts times with an
+	// exponential backoff that starts at defaultRetryBaseBackoff, without
+	// jitter and without a budget.
+	RetryPolicy struct {
+		// BaseBackoff is the backoff after the first failed attempt, it
+		// doubles with every subsequent attempt. Defaults to
+		// defaultRetryBaseBackoff.
+		BaseBackoff time.Duration
+
+		// Budget is the maximum amount of time spent on an operation, an
+		// operation is not retried if the backoff would exceed it. If zero
+		// the operation is retried until it ran out of attempts.
+		Budget time.Duration
+
+		// Jitter is the fraction, between 0 and 1, by which every backoff is
+		// randomly lengthened or shortened, which spreads out the retries of
+		// operations that failed at the same time. If zero the backoff is not
+		// randomized.
+		Jitter float64
+
+		// MaxAttempts is the maximum amount of attempts, including the first
+		// one. Defaults to defaultRetryMaxAttempts.
+		MaxAttempts int
+
+		// MaxBackoff caps the backoff between two attempts, before the
+		// jitter is applied. If zero the backoff is not capped.
+		MaxBackoff time.Duration
+
+		// Retryable classifies the errors of the operation, an operation that
+		// failed with an error for which it returns false is not retried. If
+		// nil every error is retryable.
+		Retryable func(err error) bool
+	}
+)
+
+// ParseRetryPolicy is a helper function that parses the given string into a
+// retry policy. The expected format is a comma separated list of key=value
+// pairs, e.g. 'attempts=5,backoff=500ms,max_backoff=10s,jitter=0.2,budget=1m',
+// every key is optional. An empty string results in the zero value policy.
+func ParseRetryPolicy(policyStr string) (RetryPolicy, error) {
+	var policy RetryPolicy
+	for _, pair := range strings.Split(policyStr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return RetryPolicy{}, fmt.Errorf("invalid pair '%v', expected format 'key=value'", pair)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+
+		var err error
+		switch key {
+		case "attempts":
+			policy.MaxAttempts, err = strconv.Atoi(value)
+			if err == nil && policy.MaxAttempts <= 0 {
+				err = errors.New("it has to be positive")
+			}
+		case "backoff":
+			policy.BaseBackoff, err = parsePositiveDuration(value)
+		case "budget":
+			policy.Budget, err = parsePositiveDuration(value)
+		case "jitter":
+			policy.Jitter, err = strconv.ParseFloat(value, 64)
+			if err == nil && (policy.Jitter < 0 || policy.Jitter > 1) {
+				err = errors.New("it has to be between 0 and 1")
+			}
+		case "max_backoff":
+			policy.MaxBackoff, err = parsePositiveDuration(value)
+		default:
+			return RetryPolicy{}, fmt.Errorf("unknown key '%v', expected one of 'attempts', 'backoff', 'budget', 'jitter' or 'max_backoff'", key)
+		}
+		if err != nil {
+			return RetryPolicy{}, fmt.Errorf("invalid value '%v' for key '%v', %v", value, key, err)
+		}
+	}
+	return policy, nil
+}
+
+// Retry calls the given operation until it succeeds, or until it failed with
+// an error that is not retryable, it ran out of attempts or the next backoff
+// would exceed its budget, see RetryPolicy. In between attempts it waits for
+// an exponentially increasing backoff. It returns the error of the last
+// attempt, composed with the context error if the context is done while it
+// waits for the backoff.
+func Retry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	policy = policy.withDefaults()
+
+	var deadline time.Time
+	if policy.Budget > 0 {
+		deadline = time.Now().Add(policy.Budget)
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		if policy.Retryable != nil && !policy.Retryable(err) {
+			return err
+		}
+
+		// don't retry if the backoff would exceed the budget
+		backoff := policy.backoff(attempt)
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		// wait for the backoff, or until the context is done
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Compose(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the backoff after the given failed attempt, including the
+// jitter.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < attempt; i++ {
+		if (p.MaxBackoff > 0 && backoff >= p.MaxBackoff) || backoff > math.MaxInt64/2 {
+			break
+		}
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		retryRandMu.Lock()
+		factor := 1 + p.Jitter*(2*retryRand.Float64()-1)
+		retryRandMu.Unlock()
+		backoff = time.Duration(float64(backoff) * factor)
+	}
+	return backoff
+}
+
+// withDefaults returns the policy with the defaults applied to the fields
+// that are not set.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.BaseBackoff <= 0 {
+		p.BaseBackoff = defaultRetryBaseBackoff
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	return p
+}
+
+// parsePositiveDuration is a helper function that parses the given string
+// into a duration, which has to be positive.
+func parsePositiveDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("it has to be positive")
+	}
+	return d, nil
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// errRetryTest is the error the operations in the retry tests fail with.
+var errRetryTest = errors.New("retry test error")
+
+// TestRetry is a unit test for Retry
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		failures int
+		attempts int
+		success  bool
+	}{
+		{"Success", RetryPolicy{BaseBackoff: time.Millisecond}, 0, 1, true},
+		{"SuccessAfterRetry", RetryPolicy{BaseBackoff: time.Millisecond}, 2, 3, true},
+		{"DefaultMaxAttempts", RetryPolicy{BaseBackoff: time.Millisecond}, 10, defaultRetryMaxAttempts, false},
+		{"MaxAttempts", RetryPolicy{BaseBackoff: time.Millisecond, MaxAttempts: 5}, 10, 5, false},
+		{"SingleAttempt", RetryPolicy{BaseBackoff: time.Millisecond, MaxAttempts: 1}, 10, 1, false},
+		{"Budget", RetryPolicy{BaseBackoff: 10 * time.Millisecond, Budget: 25 * time.Millisecond, MaxAttempts: 10}, 10, 2, false},
+	}
+	for _, test := range tests {
+		var attempts int
+		err := Retry(context.Background(), test.policy, func() error {
+			attempts++
+			if attempts <= test.failures {
+				return errRetryTest
+			}
+			return nil
+		})
+		if (err == nil) != test.success {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%v: unexpected amount of attempts %v, expected %v", test.name, attempts, test.attempts)
+		}
+	}
+}
+
+// TestRetryClassification verifies Retry does not retry operations that
+// failed with an error that is not retryable.
+func TestRetryClassification(t *testing.T) {
+	t.Parallel()
+
+	errPermanent := errors.New("permanent error")
+	policy := RetryPolicy{
+		BaseBackoff: time.Millisecond,
+		MaxAttempts: 10,
+		Retryable: func(err error) bool {
+			return err != errPermanent
+		},
+	}
+
+	// assert the retryable errors are retried until the permanent one
+	var attempts int
+	err := Retry(context.Background(), policy, func() error {
+		attempts++
+		if attempts < 3 {
+			return errRetryTest
+		}
+		return errPermanent
+	})
+	if err != errPermanent || attempts != 3 {
+		t.Fatal("unexpected outcome", err, attempts)
+	}
+}
+
+// TestRetryCancellation verifies Retry stops waiting for the backoff as soon
+// as the context is done.
+func TestRetryCancellation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var attempts int
+	start := time.Now()
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := Retry(ctx, RetryPolicy{BaseBackoff: time.Minute, MaxAttempts: 3}, func() error {
+		attempts++
+		return errRetryTest
+	})
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatal("expected the backoff to be interrupted", elapsed)
+	}
+	if attempts != 1 {
+		t.Fatal("unexpected amount of attempts", attempts)
+	}
+	if !errors.Contains(err, errRetryTest) || !errors.Contains(err, context.Canceled) {
+		t.Fatal("expected the error to include the context error", err)
+	}
+
+	// assert an operation is not retried if the context is done already
+	attempts = 0
+	err = Retry(ctx, RetryPolicy{BaseBackoff: time.Millisecond}, func() error {
+		attempts++
+		return errRetryTest
+	})
+	if err != errRetryTest || attempts != 1 {
+		t.Fatal("unexpected outcome", err, attempts)
+	}
+}
+
+// TestRetryPolicyBackoff verifies the backoff doubles with every attempt, is
+// capped at the max backoff, and that the jitter stays within its bounds.
+func TestRetryPolicyBackoff(t *testing.T) {
+	t.Parallel()
+
+	// assert the exponential backoff and the cap
+	p := RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, e := range expected {
+		if backoff := p.backoff(i + 1); backoff != e*time.Millisecond {
+			t.Fatalf("unexpected backoff after attempt %v, %v != %v", i+1, backoff, e*time.Millisecond)
+		}
+	}
+
+	// assert the backoff does not overflow without a cap
+	p = RetryPolicy{BaseBackoff: time.Second}.withDefaults()
+	if backoff := p.backoff(1000); backoff <= 0 {
+		t.Fatal("unexpected backoff", backoff)
+	}
+
+	// assert the jitter stays within its bounds, and that it's spread out
+	// evenly over them
+	const samples = 10000
+	p = RetryPolicy{BaseBackoff: time.Second, Jitter: 0.2}.withDefaults()
+	min, max := 800*time.Millisecond, 1200*time.Millisecond
+	var sum float64
+	var below, above int
+	for i := 0; i < samples; i++ {
+		backoff := p.backoff(1)
+		if backoff < min || backoff > max {
+			t.Fatal("backoff out of bounds", backoff)
+		}
+		if backoff < time.Second {
+			below++
+		} else {
+			above++
+		}
+		sum += float64(backoff)
+	}
+	mean := time.Duration(sum / samples)
+	if math.Abs(float64(mean-time.Second)) > float64(10*time.Millisecond) {
+		t.Fatal("unexpected mean backoff", mean)
+	}
+	if below < samples*45/100 || above < samples*45/100 {
+		t.Fatal("jitter is not spread out evenly", below, above)
+	}
+}
+
+// TestParseRetryPolicy is a unit test for ParseRetryPolicy
+func TestParseRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected RetryPolicy
+		valid    bool
+	}{
+		{"", RetryPolicy{}, true},
+		{"attempts=5", RetryPolicy{MaxAttempts: 5}, true},
+		{" Attempts = 5 , backoff=500ms,max_backoff=10s, jitter=0.2,budget=1m ", RetryPolicy{
+			BaseBackoff: 500 * time.Millisecond,
+			Budget:      time.Minute,
+			Jitter:      0.2,
+			MaxAttempts: 5,
+			MaxBackoff:  10 * time.Second,
+		}, true},
+		{"attempts=5,,", RetryPolicy{MaxAttempts: 5}, true},
+		{"attempts", RetryPolicy{}, false},
+		{"attempts=0", RetryPolicy{}, false},
+		{"attempts=five", RetryPolicy{}, false},
+		{"backoff=-1s", RetryPolicy{}, false},
+		{"backoff=1", RetryPolicy{}, false},
+		{"budget=0s", RetryPolicy{}, false},
+		{"jitter=1.5", RetryPolicy{}, false},
+		{"jitter=-0.1", RetryPolicy{}, false},
+		{"max_backoff=soon", RetryPolicy{}, false},
+		{"tries=3", RetryPolicy{}, false},
+	}
+	for _, test := range tests {
+		policy, err := ParseRetryPolicy(test.input)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected error for '%v', %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(policy, test.expected) {
+			t.Errorf("unexpected policy for '%v', %+v", test.input, policy)
+		}
+	}
+}
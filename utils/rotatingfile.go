@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// DefaultLogFileMaxAge is the default maximum age of a rotated log file.
+	DefaultLogFileMaxAge = 30 * 24 * time.Hour
+
+	// DefaultLogFileMaxBackups is the default maximum number of rotated log
+	// files that are kept.
+	DefaultLogFileMaxBackups = 5
+
+	// DefaultLogFileMaxSize is the default size, in bytes, at which a log
+	// file is rotated.
+	DefaultLogFileMaxSize = 100 << 20 // 100 MiB
+
+	// rotatedFileTimeFormat is the format of the timestamp that is appended
+	// to the name of a rotated file, it sorts chronologically and is precise
+	// enough to never reuse the name of a previous rotation
+	rotatedFileTimeFormat = "2006-01-02T15-04-05.000000000"
+)
+
+type (
+	// RotatingFile is a writer that appends to a file, which is rotated once
+	// writing to it would exceed the max size. The rotated file is renamed to
+	// the name of the file suffixed with the time of the rotation. Rotated
+	// files beyond the max number of backups, or older than the max age, are
+	// removed. It is safe for concurrent use.
+	RotatingFile struct {
+		file *os.File
+		size int64
+		mu   sync.Mutex
+
+		staticOptions RotatingFileOptions
+		staticPath    string
+	}
+
+	// RotatingFileOptions contains the configurable options of a rotating
+	// file.
+	RotatingFileOptions struct {
+		// MaxAge is the maximum age of a rotated file, older ones are
+		// removed on rotation. Defaults to DefaultLogFileMaxAge.
+		MaxAge time.Duration
+
+		// MaxBackups is the maximum number of rotated files that are kept,
+		// the oldest ones are removed on rotation. Defaults to
+		// DefaultLogFileMaxBackups.
+		MaxBackups int
+
+		// MaxSize is the size in bytes at which the file is rotated, defaults
+		// to DefaultLogFileMaxSize.
+		MaxSize int64
+	}
+)
+
+// NewRotatingFile opens the file at the given path for appending, it's created
+// alongside its directory if it doesn't exist.
+func NewRotatingFile(path string, opts RotatingFileOptions) (*RotatingFile, error) {
+	if opts.MaxAge == 0 {
+		opts.MaxAge = DefaultLogFileMaxAge
+	}
+	if opts.MaxBackups == 0 {
+		opts.MaxBackups = DefaultLogFileMaxBackups
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultLogFileMaxSize
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to create log directory")
+	}
+	rf := &RotatingFile{
+		staticOptions: opts,
+		staticPath:    path,
+	}
+	err = rf.open()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Close closes the file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
+
+// Write implements the io.Writer interface, it rotates the file before the
+// write if the write would exceed the max size. A write that exceeds the max
+// size by itself is written to an empty file. If the rotation fails the write
+// is still attempted, the rotation error is returned alongside its result.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	var rotateErr error
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.staticOptions.MaxSize {
+		rotateErr = errors.AddContext(rf.rotate(), "failed to rotate log file")
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, errors.Compose(err, rotateErr)
+}
+
+// backups returns the paths of the rotated files, oldest first.
+func (rf *RotatingFile) backups() ([]string, error) {
+	paths, err := filepath.Glob(rf.staticPath + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	prefix := rf.staticPath + "."
+	for _, path := range paths {
+		_, err := time.Parse(rotatedFileTimeFormat, strings.TrimPrefix(path, prefix))
+		if err == nil {
+			backups = append(backups, path)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// open opens the file for appending.
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.staticPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.AddContext(err, "failed to open log file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Compose(errors.AddContext(err, "failed to stat log file"), file.Close())
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// prune removes the rotated files beyond the max number of backups and the ones
+// older than the max age.
+func (rf *RotatingFile) prune() error {
+	backups, err := rf.backups()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-rf.staticOptions.MaxAge)
+	var errs error
+	for i, path := range backups {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if i < len(backups)-rf.staticOptions.MaxBackups || info.ModTime().Before(cutoff) {
+			errs = errors.Compose(errs, os.Remove(path))
+		}
+	}
+	return errs
+}
+
+// rotate renames the file to a backup, opens a new file and prunes the backups.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.%s", rf.staticPath, time.Now().UTC().Format(rotatedFileTimeFormat))
+	err = os.Rename(rf.staticPath, backup)
+	if err != nil {
+		// keep writing to the current file if it can't be rotated
+		return errors.Compose(err, rf.open())
+	}
+	err = rf.open()
+	if err != nil {
+		return err
+	}
+	return rf.prune()
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRotatingFile verifies the rotating file is rotated once it exceeds its
+// max size, and that the rotated files are pruned.
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "abuse-scanner.log")
+
+	// create a backup that is older than the max age
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := path + "." + time.Now().Add(-48*time.Hour).UTC().Format(rotatedFileTimeFormat)
+	err = ioutil.WriteFile(old, []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTime := time.Now().Add(-48 * time.Hour)
+	err = os.Chtimes(old, oldTime, oldTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := NewRotatingFile(path, RotatingFileOptions{
+		MaxAge:     24 * time.Hour,
+		MaxBackups: 2,
+		MaxSize:    100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write a line that fits and assert no rotation happened
+	line := bytes.Repeat([]byte("a"), 39)
+	line = append(line, '\n')
+	for i := 0; i < 2; i++ {
+		_, err = rf.Write(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := rf.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatal("unexpected backups", backups)
+	}
+
+	// write past the max size a couple of times
+	for i := 0; i < 6; i++ {
+		_, err = rf.Write(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the old backup was pruned and only the max number of backups is
+	// kept, all of which are full
+	backups, err = rf.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatal("unexpected backups", backups)
+	}
+	for _, backup := range backups {
+		if backup == old {
+			t.Fatal("expected the old backup to be pruned")
+		}
+		info, err := os.Stat(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 80 {
+			t.Fatal("unexpected backup size", backup, info.Size())
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 80 {
+		t.Fatal("unexpected size", info.Size())
+	}
+
+	// assert the file is appended to when it's reopened
+	rf, err = NewRotatingFile(path, RotatingFileOptions{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rf.Write([]byte("b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 82 || !bytes.HasSuffix(content, []byte("a\nb\n")) {
+		t.Fatalf("unexpected content %q", content)
+	}
+}
@@ -2,20 +2,136 @@ package utils
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+
+	"gitlab.com/NebulousLabs/errors"
+	"golang.org/x/net/idna"
 )
 
+// urlTrailingPunctuation are the characters that are trimmed from the end of
+// a URL, they usually end up there when the URL is extracted from email text,
+// e.g. when it ends a sentence.
+const urlTrailingPunctuation = ".,;:!?"
+
 // SanitizeURL is a helper function that sanitizes the given input portal
-// URL, stripping away trailing slashes and ensuring it's prefixed with https.
-func SanitizeURL(portalURL string) string {
-	portalURL = strings.TrimSpace(portalURL)
-	portalURL = strings.TrimSuffix(portalURL, "/")
-	if strings.HasPrefix(portalURL, "https://") {
-		return portalURL
-	}
-	portalURL = strings.TrimPrefix(portalURL, "http://")
+// URL, see SanitizeURLStrict. It returns an empty string if the URL is
+// invalid.
+func SanitizeURL(portalURL string, stripFragment bool) string {
+	sanitized, err := SanitizeURLStrict(portalURL, stripFragment)
+	if err != nil {
+		return ""
+	}
+	return sanitized
+}
+
+// SanitizeURLStrict is a helper function that sanitizes the given input
+// portal URL. It trims whitespace and trailing punctuation, ensures the URL
+// uses https, lowercases the host and converts it to its punycode form, and
+// drops the port if it's the default https port. The path and query are
+// preserved, though a trailing slash is stripped if the URL has neither a
+// query nor a fragment. The fragment is stripped if stripFragment is true. It
+// returns an error if the URL does not parse, has no host or a scheme other
+// than http(s).
+func SanitizeURLStrict(portalURL string, stripFragment bool) (string, error) {
+	portalURL = strings.TrimRight(strings.TrimSpace(portalURL), urlTrailingPunctuation)
 	if portalURL == "" {
-		return portalURL
+		return "", errors.New("URL is empty")
+	}
+	if !strings.Contains(portalURL, "://") {
+		portalURL = "https://" + portalURL
+	}
+
+	// parse the URL
+	u, err := url.Parse(portalURL)
+	if err != nil {
+		return "", errors.AddContext(err, "could not parse URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme '%v'", u.Scheme)
+	}
+	u.Scheme = "https"
+
+	// normalize the host, IP addresses are left as is
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", fmt.Errorf("URL '%v' has no host", portalURL)
+	}
+	if net.ParseIP(host) == nil {
+		host, err = idna.Lookup.ToASCII(host)
+		if err != nil {
+			return "", errors.AddContext(err, "invalid host")
+		}
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	// preserve an explicit port, unless it's the default
+	port := u.Port()
+	if port != "" && port != "443" {
+		portNum, err := strconv.Atoi(port)
+		if err != nil || portNum <= 0 || portNum > 65535 {
+			return "", fmt.Errorf("invalid port '%v'", port)
+		}
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	u.Host = host
+
+	if stripFragment {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+	if u.RawQuery == "" && u.Fragment == "" {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	}
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// SanitizeServiceURL is a helper function that builds the URL of an internal
+// service from the given host and port. Unlike SanitizeURL it defaults to http,
+// as these services are usually only reachable from within the cluster, and it
+// preserves the scheme if the host already contains one. The port is appended
+// unless the host already contains it. It returns an error if the resulting URL
+// is not a valid http(s) URL.
+func SanitizeServiceURL(host, port string) (string, error) {
+	host = strings.TrimSpace(host)
+	port = strings.TrimSpace(port)
+	if host == "" {
+		return "", errors.New("host is empty")
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+
+	// parse the URL
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", errors.AddContext(err, "could not parse URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme '%v'", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("URL '%v' has no host", host)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	// add the port if the host doesn't contain one already
+	if port == "" {
+		return u.String(), nil
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum <= 0 || portNum > 65535 {
+		return "", fmt.Errorf("invalid port '%v'", port)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	} else if u.Port() != port {
+		return "", fmt.Errorf("host contains port '%v' which conflicts with port '%v'", u.Port(), port)
 	}
-	return fmt.Sprintf("https://%s", portalURL)
+	return u.String(), nil
 }
@@ -2,23 +2,113 @@ package utils
 
 import "testing"
 
-// TestSanitizeURL is a unit test for the sanitizePortalURL helper
+// TestSanitizeURL is a unit test for the SanitizeURL and SanitizeURLStrict
+// helpers
 func TestSanitizeURL(t *testing.T) {
 	cases := []struct {
-		input  string
-		output string
+		input         string
+		stripFragment bool
+		output        string
+		valid         bool
 	}{
-		{"https://siasky.net", "https://siasky.net"},
-		{"https://siasky.net ", "https://siasky.net"},
-		{" https://siasky.net ", "https://siasky.net"},
-		{"https://siasky.net/", "https://siasky.net"},
-		{"http://siasky.net", "https://siasky.net"},
-		{"siasky.net", "https://siasky.net"},
+		// scheme and whitespace
+		{"https://siasky.net", false, "https://siasky.net", true},
+		{"https://siasky.net ", false, "https://siasky.net", true},
+		{" https://siasky.net ", false, "https://siasky.net", true},
+		{"https://siasky.net/", false, "https://siasky.net", true},
+		{"http://siasky.net", false, "https://siasky.net", true},
+		{"siasky.net", false, "https://siasky.net", true},
+		{"HTTPS://SIASKY.NET/path?x=1", false, "https://siasky.net/path?x=1", true},
+
+		// ports
+		{"siasky.net:443/", false, "https://siasky.net", true},
+		{"siasky.net:8443/", false, "https://siasky.net:8443", true},
+		{"http://10.10.10.70:9980", false, "https://10.10.10.70:9980", true},
+		{"https://[::1]:9980/", false, "https://[::1]:9980", true},
+		{"https://[::1]/", false, "https://[::1]", true},
+
+		// trailing punctuation from email text
+		{"siasky.net.", false, "https://siasky.net", true},
+		{"https://siasky.net/path,", false, "https://siasky.net/path", true},
+		{"https://siasky.net.:443", false, "https://siasky.net", true},
+
+		// unicode hosts
+		{"siaský.net", false, "https://xn--siask-uva.net", true},
+		{"https://SIASKÝ.net/path", false, "https://xn--siask-uva.net/path", true},
+
+		// paths, queries and fragments
+		{"https://siasky.net/path/", false, "https://siasky.net/path", true},
+		{"https://siasky.net/path/?x=1", false, "https://siasky.net/path/?x=1", true},
+		{"https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63", false, "https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63", true},
+		{"https://skytransfer.hns.siasky.net/#/v2/d871327/12a75f63", true, "https://skytransfer.hns.siasky.net", true},
+		{"https://siasky.net/path?x=1#frag", true, "https://siasky.net/path?x=1", true},
+
+		// invalid
+		{"", false, "", false},
+		{" / ", false, "", false},
+		{"ftp://siasky.net", false, "", false},
+		{"https://", false, "", false},
+		{"https://sia sky.net", false, "", false},
+		{"https://siasky.net:port", false, "", false},
+		{"https://siasky.net:70000", false, "", false},
 	}
 
 	// Test set cases to ensure known edge cases are always handled
 	for _, test := range cases {
-		res := SanitizeURL(test.input)
+		res, err := SanitizeURLStrict(test.input, test.stripFragment)
+		if test.valid && err != nil {
+			t.Fatalf("unexpected error for '%v', %v", test.input, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("expected an error for '%v', got %v", test.input, res)
+		}
+		if res != test.output {
+			t.Fatalf("unexpected result, %v != %v", res, test.output)
+		}
+		if res := SanitizeURL(test.input, test.stripFragment); res != test.output {
+			t.Fatalf("unexpected result, %v != %v", res, test.output)
+		}
+	}
+}
+
+// TestSanitizeServiceURL is a unit test for the SanitizeServiceURL helper
+func TestSanitizeServiceURL(t *testing.T) {
+	cases := []struct {
+		host   string
+		port   string
+		output string
+		valid  bool
+	}{
+		// host only
+		{"accounts", "3000", "http://accounts:3000", true},
+		{" accounts ", " 3000 ", "http://accounts:3000", true},
+		{"10.10.10.70", "3000", "http://10.10.10.70:3000", true},
+		{"accounts", "", "http://accounts", true},
+
+		// host with scheme
+		{"http://accounts", "3000", "http://accounts:3000", true},
+		{"https://accounts/", "3000", "https://accounts:3000", true},
+		{"http://accounts:3000", "3000", "http://accounts:3000", true},
+		{"http://accounts:3000", "", "http://accounts:3000", true},
+
+		// invalid
+		{"", "3000", "", false},
+		{"ftp://accounts", "3000", "", false},
+		{"http://", "3000", "", false},
+		{"accounts", "port", "", false},
+		{"accounts", "70000", "", false},
+		{"http://accounts:4000", "3000", "", false},
+		{"http://acc ounts", "3000", "", false},
+	}
+
+	for _, test := range cases {
+		res, err := SanitizeServiceURL(test.host, test.port)
+		if test.valid && err != nil {
+			t.Fatalf("unexpected error for host '%v' and port '%v', %v", test.host, test.port, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("expected error for host '%v' and port '%v'", test.host, test.port)
+		}
 		if res != test.output {
 			t.Fatalf("unexpected result, %v != %v", res, test.output)
 		}
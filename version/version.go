@@ -0,0 +1,55 @@
+// Package version contains the version information of the abuse scanner, it's
+// embedded at build time using -ldflags, e.g.
+//
+//	-X abuse-scanner/version.Version=v1.2.0
+//	-X abuse-scanner/version.Commit=8f1c2d3
+//	-X abuse-scanner/version.BuildDate=2022-06-21T10:59:37Z
+package version
+
+import "fmt"
+
+var (
+	// Version is the released version of the scanner.
+	Version = "dev"
+
+	// Commit is the git commit the scanner was built from.
+	Commit = "unknown"
+
+	// BuildDate is the time at which the scanner was built.
+	BuildDate = "unknown"
+)
+
+type (
+	// Info contains the version information of the scanner.
+	Info struct {
+		Version   string `json:"version"`
+		Commit    string `json:"commit"`
+		BuildDate string `json:"build_date"`
+	}
+)
+
+// Current returns the version information the scanner was built with.
+func Current() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+	}
+}
+
+// String returns a human-readable representation of the version information.
+func (i Info) String() string {
+	return fmt.Sprintf("abuse-scanner %s (commit %s, built %s)", i.Version, i.Commit, i.BuildDate)
+}
+
+// UserAgent returns the User-Agent the scanner sends to the APIs it calls. It
+// starts with 'Sia-Agent' because skyd only accepts requests to its API from
+// user agents that contain it.
+func (i Info) UserAgent() string {
+	return fmt.Sprintf("Sia-Agent abuse-scanner/%s (%s)", i.Version, i.Commit)
+}
+
+// UserAgent returns the User-Agent of the current version.
+func UserAgent() string {
+	return Current().UserAgent()
+}
@@ -0,0 +1,25 @@
+package version
+
+import (
+	"regexp"
+	"testing"
+)
+
+// TestUserAgent verifies the format of the User-Agent and the version string.
+func TestUserAgent(t *testing.T) {
+	t.Parallel()
+
+	info := Info{Version: "v1.2.0", Commit: "8f1c2d3", BuildDate: "2022-06-21T10:59:37Z"}
+	if ua := info.UserAgent(); ua != "Sia-Agent abuse-scanner/v1.2.0 (8f1c2d3)" {
+		t.Fatal("unexpected user agent", ua)
+	}
+	if s := info.String(); s != "abuse-scanner v1.2.0 (commit 8f1c2d3, built 2022-06-21T10:59:37Z)" {
+		t.Fatal("unexpected version string", s)
+	}
+
+	// assert the default version is a valid user agent product
+	re := regexp.MustCompile(`^Sia-Agent abuse-scanner/\S+ \(\S+\)$`)
+	if ua := UserAgent(); !re.MatchString(ua) {
+		t.Fatal("unexpected user agent", ua)
+	}
+}
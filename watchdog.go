@@ -0,0 +1,228 @@
+package main
+
+import (
+	"abuse-scanner/email"
+	"abuse-scanner/metrics"
+	"abuse-scanner/notifier"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+const (
+	// watchdogCheckInterval is the interval at which the watchdog checks the
+	// heartbeats of the module loops.
+	watchdogCheckInterval = time.Minute
+
+	// watchdogStallFactor is the amount of loop intervals after which a
+	// module loop that did not tick is considered stalled.
+	watchdogStallFactor = 10
+)
+
+type (
+	// watchdog periodically checks the heartbeats the module loops record at
+	// the top of every iteration. A loop that did not tick within a multiple
+	// of its interval is stalled, e.g. because an iteration hangs on an
+	// external process, the watchdog logs and notifies that, and reports the
+	// scanner as degraded until the loop ticks again. Loops that stopped
+	// after repeated panics are reported by their guard instead.
+	//
+	// If it watches the ingest, see watchIngest, it also reports the scanner
+	// as degraded while the fetcher runs but did not ingest any new email
+	// within the ingest window, e.g. because its credentials were revoked or
+	// the mailbox was renamed.
+	watchdog struct {
+		ingestResumed time.Time
+		ingestStalled time.Duration
+		stalled       map[string]time.Duration
+		mu            sync.Mutex
+
+		staticCheckInterval time.Duration
+		staticIngestPause   email.Pauser
+		staticIngestWindow  time.Duration
+		staticLastIngest    func() time.Time
+		staticLogger        *logrus.Entry
+		staticModules       []string
+		staticNotifier      *notifier.Notifier
+		staticStallFactor   int
+		staticStopChan      chan struct{}
+		staticWaitGroup     sync.WaitGroup
+	}
+)
+
+// newWatchdog returns a watchdog for the loops of the given modules.
+func newWatchdog(modules []string, n *notifier.Notifier, logger *logrus.Logger) *watchdog {
+	return &watchdog{
+		stalled: make(map[string]time.Duration),
+
+		staticCheckInterval: watchdogCheckInterval,
+		staticLogger:        logger.WithField("module", "Watchdog"),
+		staticModules:       modules,
+		staticNotifier:      n,
+		staticStallFactor:   watchdogStallFactor,
+		staticStopChan:      make(chan struct{}),
+	}
+}
+
+// watchIngest makes the watchdog alert when the fetcher did not ingest any new
+// email within the given window, according to the given function that returns
+// the time of the last ingest. The window does not include the time the
+// processing was paused using the given pauser. It has to be called before the
+// watchdog is started.
+func (w *watchdog) watchIngest(lastIngest func() time.Time, pause email.Pauser, window time.Duration) {
+	w.staticIngestPause = pause
+	w.staticIngestWindow = window
+	w.staticLastIngest = lastIngest
+}
+
+// Health returns an error that lists the stalled module loops, and whether the
+// ingest stalled, if any.
+func (w *watchdog) Health(_ context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var problems []string
+	var stalled []string
+	for module, duration := range w.stalled {
+		stalled = append(stalled, fmt.Sprintf("%v for %v", module, duration.Round(time.Second)))
+	}
+	if len(stalled) > 0 {
+		sort.Strings(stalled)
+		problems = append(problems, fmt.Sprintf("stalled module loops: %v", strings.Join(stalled, ", ")))
+	}
+	if w.ingestStalled > 0 {
+		problems = append(problems, fmt.Sprintf("no emails ingested for %v", w.ingestStalled.Round(time.Second)))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// Start starts checking the heartbeats in the background.
+func (w *watchdog) Start() {
+	w.staticWaitGroup.Add(1)
+	go func() {
+		defer w.staticWaitGroup.Done()
+		ticker := time.NewTicker(w.staticCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.staticStopChan:
+				return
+			case <-ticker.C:
+			}
+			w.managedCheck(time.Now())
+		}
+	}()
+}
+
+// Stop stops the watchdog.
+func (w *watchdog) Stop() error {
+	close(w.staticStopChan)
+	w.staticWaitGroup.Wait()
+	return nil
+}
+
+// managedCheck checks the heartbeats of the module loops at the given time. A
+// loop is reported once when it stalls and once when it recovers.
+func (w *watchdog) managedCheck(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, module := range w.staticModules {
+		heartbeat, exists := metrics.LoopHeartbeatFor(module)
+		if !exists {
+			continue
+		}
+		if _, stopped := metrics.LoopStopped(module); stopped {
+			continue
+		}
+
+		// the deadline is one interval after the last tick
+		lastTick := heartbeat.Deadline.Add(-heartbeat.Interval)
+		since := now.Sub(lastTick)
+		_, wasStalled := w.stalled[module]
+		if since <= time.Duration(w.staticStallFactor)*heartbeat.Interval {
+			if wasStalled {
+				w.staticLogger.Infof("Module %v recovered, its loop ticked again", module)
+				delete(w.stalled, module)
+				metrics.RecordLoopStalled(module, false)
+			}
+			continue
+		}
+
+		w.stalled[module] = since
+		if wasStalled {
+			continue
+		}
+		w.staticLogger.Errorf("Module %v stalled, its loop did not tick for %v while it ticks every %v", module, since.Round(time.Second), heartbeat.Interval)
+		metrics.RecordLoopStalled(module, true)
+		err := w.staticNotifier.Notify(notifier.SeverityCritical, fmt.Sprintf("%v loop stalled", module), []notifier.Field{
+			{Name: "Module", Value: module},
+			{Name: "Stalled For", Value: since.Round(time.Second).String()},
+			{Name: "Loop Interval", Value: heartbeat.Interval.String()},
+		})
+		if err != nil {
+			w.staticLogger.Errorf("Failed to notify of the stalled %v loop, error %v", module, err)
+		}
+	}
+
+	w.checkIngest(now)
+}
+
+// checkIngest checks the time of the last ingest at the given time. A stalled
+// ingest is reported once when it stalls and once when it recovers. The ingest
+// is not checked while the fetcher loop is stalled or stopped, as that is
+// reported already, nor while the processing is paused.
+func (w *watchdog) checkIngest(now time.Time) {
+	if w.staticLastIngest == nil || w.staticIngestWindow == 0 {
+		return
+	}
+	if _, stalled := w.stalled[email.ModuleFetcher]; stalled {
+		return
+	}
+	if _, stopped := metrics.LoopStopped(email.ModuleFetcher); stopped {
+		return
+	}
+	if w.staticIngestPause != nil && w.staticIngestPause.IsPaused() {
+		w.ingestResumed = now
+		return
+	}
+
+	// the window starts at the last ingest, or when the processing resumed
+	lastIngest := w.staticLastIngest()
+	if w.ingestResumed.After(lastIngest) {
+		lastIngest = w.ingestResumed
+	}
+	since := now.Sub(lastIngest)
+	wasStalled := w.ingestStalled > 0
+	if since <= w.staticIngestWindow {
+		if wasStalled {
+			w.staticLogger.Infof("Ingest recovered, the fetcher ingested new emails again")
+			w.ingestStalled = 0
+			metrics.RecordIngestStalled(false)
+		}
+		return
+	}
+
+	w.ingestStalled = since
+	if wasStalled {
+		return
+	}
+	w.staticLogger.Errorf("No emails were ingested for %v while the fetcher is running, it might fail to fetch the mailbox", since.Round(time.Second))
+	metrics.RecordIngestStalled(true)
+	err := w.staticNotifier.Notify(notifier.SeverityCritical, "No emails ingested", []notifier.Field{
+		{Name: "Last Ingest", Value: lastIngest.UTC().Format(time.RFC3339)},
+		{Name: "Stalled For", Value: since.Round(time.Second).String()},
+		{Name: "Alert Window", Value: w.staticIngestWindow.String()},
+	})
+	if err != nil {
+		w.staticLogger.Errorf("Failed to notify of the stalled ingest, error %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"abuse-scanner/metrics"
+	"abuse-scanner/notifier"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestWatchdog verifies the watchdog reports a module loop that stops ticking
+// as stalled, alongside the duration it stalled for, and that it reports the
+// module recovered once the loop ticks again.
+func TestWatchdog(t *testing.T) {
+	t.Parallel()
+
+	// capture the notifications
+	var mu sync.Mutex
+	var notifications []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		notifications = append(notifications, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+
+	// register a fake module, the loop state is global so its name is unique
+	// to this test
+	module := "TestWatchdog"
+	metrics.RecordLoopIteration(module, 10*time.Millisecond)
+
+	wd := newWatchdog([]string{module, "TestWatchdogNotStarted"}, notifier.NewNotifier(server.URL, notifier.NotifierOptions{}), logger)
+	wd.staticCheckInterval = 5 * time.Millisecond
+	wd.staticStallFactor = 5
+
+	// assert the module is healthy while it ticks
+	wd.managedCheck(time.Now())
+	if err := wd.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// stop ticking and assert the watchdog fires
+	wd.Start()
+	start := time.Now()
+	for wd.Health(context.Background()) == nil {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("expected the watchdog to fire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	err := wd.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wd.Health(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "stalled module loops: TestWatchdog for ") {
+		t.Fatal("unexpected error", err)
+	}
+	logs := buf.String()
+	if !strings.Contains(logs, "Module TestWatchdog stalled, its loop did not tick for") || !strings.Contains(logs, "while it ticks every 10ms") {
+		t.Fatal("unexpected logs", logs)
+	}
+	mu.Lock()
+	if len(notifications) != 1 || !strings.Contains(notifications[0], "TestWatchdog loop stalled") || !strings.Contains(notifications[0], "Stalled For") {
+		t.Fatal("unexpected notifications", notifications)
+	}
+	mu.Unlock()
+
+	// assert the watchdog reports the module recovered once it ticks again
+	metrics.RecordLoopIteration(module, 10*time.Millisecond)
+	wd.managedCheck(time.Now())
+	if err := wd.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	logs = buf.String()
+	if !strings.Contains(logs, "Module TestWatchdog recovered") {
+		t.Fatal("unexpected logs", logs)
+	}
+}
+
+// TestWatchdogIngest verifies the watchdog reports the ingest as stalled when
+// the fetcher runs but does not ingest any new email within the alert window,
+// that it ignores the time the processing is paused, and that it reports the
+// ingest recovered once the fetcher ingests an email again.
+func TestWatchdogIngest(t *testing.T) {
+	t.Parallel()
+
+	// capture the notifications
+	var mu sync.Mutex
+	var notifications []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		notifications = append(notifications, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+
+	// simulate a fetcher that keeps ticking but stopped ingesting an hour ago
+	now := time.Now()
+	lastIngest := now.Add(-time.Hour)
+	pause := new(testPauser)
+	wd := newWatchdog(nil, notifier.NewNotifier(server.URL, notifier.NotifierOptions{}), logger)
+	wd.watchIngest(func() time.Time { return lastIngest }, pause, 2*time.Hour)
+
+	// assert the ingest is healthy within the window
+	wd.managedCheck(now)
+	if err := wd.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// assert the watchdog fires once the window passed, and only once
+	wd.managedCheck(now.Add(90 * time.Minute))
+	wd.managedCheck(now.Add(2 * time.Hour))
+	err := wd.Health(context.Background())
+	if err == nil || err.Error() != "no emails ingested for 3h0m0s" {
+		t.Fatal("unexpected error", err)
+	}
+	logs := buf.String()
+	if !strings.Contains(logs, "No emails were ingested for 2h30m0s while the fetcher is running") {
+		t.Fatal("unexpected logs", logs)
+	}
+	mu.Lock()
+	if len(notifications) != 1 || !strings.Contains(notifications[0], "No emails ingested") || !strings.Contains(notifications[0], "Alert Window") {
+		t.Fatal("unexpected notifications", notifications)
+	}
+	mu.Unlock()
+
+	// assert the watchdog reports the ingest recovered once the fetcher
+	// ingests an email again
+	lastIngest = now.Add(2 * time.Hour)
+	wd.managedCheck(now.Add(2 * time.Hour))
+	if err := wd.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Ingest recovered") {
+		t.Fatal("unexpected logs", buf.String())
+	}
+
+	// assert the time the processing is paused does not count
+	*pause = true
+	wd.managedCheck(now.Add(5 * time.Hour))
+	*pause = false
+	wd.managedCheck(now.Add(6 * time.Hour))
+	if err := wd.Health(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wd.managedCheck(now.Add(8 * time.Hour))
+	if err := wd.Health(context.Background()); err == nil {
+		t.Fatal("expected the watchdog to fire")
+	}
+	if strings.Count(buf.String(), "No emails were ingested for 3h0m0s") != 1 {
+		t.Fatal("unexpected logs", buf.String())
+	}
+}
+
+// testPauser is a pauser that is paused if it's true
+type testPauser bool
+
+// IsPaused implements the email.Pauser interface.
+func (p *testPauser) IsPaused() bool {
+	return bool(*p)
+}